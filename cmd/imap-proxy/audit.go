@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/report"
+)
+
+// auditCommand implements "imap-proxy audit query", which prints stored
+// audit events matching the given filters.
+func auditCommand(args []string) int {
+	if len(args) == 0 || args[0] != "query" {
+		fmt.Fprintln(os.Stderr, "usage: imap-proxy audit query [-config path] [-db path] [-user u] [-type t] [-verb v] [-since t] [-until t] [-limit n] [-json]")
+		return 2
+	}
+	fs := flag.NewFlagSet("audit query", flag.ContinueOnError)
+	configPath := fs.String("config", "config.toml", "path to config file (for server.audit.sqlite_path)")
+	dbPath := fs.String("db", "", "audit database (default: server.audit.sqlite_path from config)")
+	user := fs.String("user", "", "only events for this account")
+	typ := fs.String("type", "", "only events of this type (e.g. login_failure, folder_access)")
+	verb := fs.String("verb", "", "only events for this command (e.g. SELECT; STORE also matches UID STORE)")
+	since := fs.String("since", "", "only events at or after this time (RFC 3339, YYYY-MM-DD, or a duration ago such as 24h)")
+	until := fs.String("until", "", "only events before this time (same formats as -since)")
+	limit := fs.Int("limit", 0, "print at most this many events")
+	asJSON := fs.Bool("json", false, "print one JSON object per line")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	path, err := auditDBPath(*dbPath, *configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit query: %v\n", err)
+		return 1
+	}
+
+	now := time.Now()
+	q := audit.Query{User: *user, Type: *typ, Verb: *verb, Limit: *limit}
+	if q.Since, err = audit.ParseTime(*since, now); err != nil {
+		fmt.Fprintf(os.Stderr, "audit query: -since: %v\n", err)
+		return 2
+	}
+	if q.Until, err = audit.ParseTime(*until, now); err != nil {
+		fmt.Fprintf(os.Stderr, "audit query: -until: %v\n", err)
+		return 2
+	}
+
+	store, err := audit.OpenStore(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit query: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	events, err := store.Query(q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit query: %v\n", err)
+		return 1
+	}
+	if err := writeEvents(os.Stdout, events, *asJSON); err != nil {
+		fmt.Fprintf(os.Stderr, "audit query: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// auditDBPath returns dbPath, or the audit database configured in the
+// config file at configPath.
+func auditDBPath(dbPath, configPath string) (string, error) {
+	if dbPath != "" {
+		return dbPath, nil
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Server.Audit.SQLitePath == "" {
+		return "", errors.New("server.audit.sqlite_path is not set; use -db")
+	}
+	return cfg.Server.Audit.SQLitePath, nil
+}
+
+// reportCommand implements "imap-proxy report", which summarizes per
+// account and folder what was listed, selected and fetched.
+func reportCommand(args []string) int {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	configPath := fs.String("config", "config.toml", "path to config file (for server.audit.sqlite_path)")
+	dbPath := fs.String("db", "", "audit database (default: server.audit.sqlite_path from config)")
+	user := fs.String("user", "", "only this account")
+	since := fs.String("since", "", "start of the period (RFC 3339, YYYY-MM-DD, or a duration ago such as 720h)")
+	until := fs.String("until", "", "end of the period, exclusive (same formats as -since)")
+	format := fs.String("format", report.FormatCSV, "output format: csv or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != report.FormatCSV && *format != report.FormatJSON {
+		fmt.Fprintf(os.Stderr, "report: unknown format %q\n", *format)
+		return 2
+	}
+
+	now := time.Now()
+	q := report.Query{User: *user}
+	var err error
+	if q.Since, err = audit.ParseTime(*since, now); err != nil {
+		fmt.Fprintf(os.Stderr, "report: -since: %v\n", err)
+		return 2
+	}
+	if q.Until, err = audit.ParseTime(*until, now); err != nil {
+		fmt.Fprintf(os.Stderr, "report: -until: %v\n", err)
+		return 2
+	}
+
+	path, err := auditDBPath(*dbPath, *configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 1
+	}
+	store, err := audit.OpenStore(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	rows, err := report.Generate(store, q)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 1
+	}
+	if err := report.Write(os.Stdout, rows, *format); err != nil {
+		fmt.Fprintf(os.Stderr, "report: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func writeEvents(w io.Writer, events []audit.Event, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		for _, ev := range events {
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, ev := range events {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %s", ev.Time.Format(time.RFC3339), ev.Type)
+		if ev.User != "" {
+			fmt.Fprintf(&b, " user=%s", ev.User)
+		}
+		if ev.ClientIP != "" {
+			fmt.Fprintf(&b, " client=%s", ev.ClientIP)
+		}
+		keys := make([]string, 0, len(ev.Fields))
+		for k := range ev.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%q", k, ev.Fields[k])
+		}
+		if _, err := fmt.Fprintln(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
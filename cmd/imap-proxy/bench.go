@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"imap-proxy/internal/bench"
+)
+
+// benchCommand implements "imap-proxy bench": it runs synthetic clients
+// against the proxy (or any IMAP server) and reports throughput and
+// latency percentiles per operation.
+func benchCommand(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:143", "IMAP server to load, host:port")
+	useTLS := fs.Bool("tls", false, "connect with implicit TLS")
+	insecure := fs.Bool("insecure-skip-verify", false, "do not verify the server certificate")
+	user := fs.String("user", "", "user name to log in with (required)")
+	password := fs.String("password", "", "password to log in with")
+	clients := fs.Int("clients", 10, "number of concurrent clients")
+	duration := fs.Duration("duration", 30*time.Second, "how long to run")
+	workload := fs.String("workload", strings.Join(bench.DefaultWorkload, ","),
+		"comma-separated operations each client repeats: login, select, fetch, idle")
+	folder := fs.String("folder", "INBOX", "folder to SELECT")
+	fetch := fs.String("fetch", "1:* (UID FLAGS RFC822.SIZE)", "FETCH arguments")
+	idle := fs.Duration("idle", 5*time.Second, "how long each IDLE lasts")
+	timeout := fs.Duration("timeout", 30*time.Second, "wait this long for each response")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	b := &bench.Bench{
+		Addr: *addr, TLS: *useTLS, InsecureSkipVerify: *insecure,
+		User: *user, Password: *password,
+		Clients: *clients, Workload: splitList(*workload),
+		Folder: *folder, Fetch: *fetch, IdleTime: *idle, Timeout: *timeout,
+	}
+	if err := b.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// Stop after -duration, or earlier on SIGINT/SIGTERM.
+	stop := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	go func() {
+		select {
+		case <-sigCh:
+		case <-time.After(*duration):
+		}
+		close(stop)
+	}()
+
+	fmt.Printf("Running %d clients against %s for %s: %s\n\n", *clients, *addr, *duration, strings.Join(b.Workload, ", "))
+	r := b.Run(stop)
+	fmt.Printf("Ran for %s.\n", r.Duration.Round(time.Millisecond))
+	r.Write(os.Stdout)
+	for _, op := range r.Ops {
+		if op.Errors > 0 {
+			return 1
+		}
+	}
+	return 0
+}
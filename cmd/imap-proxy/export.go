@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/export"
+	"imap-proxy/internal/imapclient"
+	"imap-proxy/internal/proxy"
+)
+
+// exportCommand implements "imap-proxy export": it logs into the configured
+// upstreams and copies the folders each account may see into maildir or
+// mbox archives. Repeated runs continue where the previous one stopped.
+func exportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	configPath := fs.String("config", "config.toml", "path to config file")
+	users := fs.String("user", "", "comma-separated accounts to export (default: all)")
+	folders := fs.String("folder", "", "comma-separated folders to export (default: all visible folders)")
+	format := fs.String("format", export.FormatMaildir, "archive format: maildir or mbox")
+	out := fs.String("out", "", "directory to write archives to, one subdirectory per account (required)")
+	logFile := fs.String("log-file", "", "append logs to this file instead of stderr")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "export: -out is required")
+		return 2
+	}
+	if *format != export.FormatMaildir && *format != export.FormatMbox {
+		fmt.Fprintf(os.Stderr, "export: unknown format %q\n", *format)
+		return 2
+	}
+
+	logger, closeLog, err := newLogger(*logFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: open log file: %v\n", err)
+		return 1
+	}
+	defer closeLog()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+	if err := proxy.CheckUpstreamTLS(cfg, logger); err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+
+	selected := splitList(*users)
+	hosts := proxy.NewHostLimits(cfg.Server)
+	var exporters []*export.Exporter
+	for i := range cfg.Accounts {
+		acct := &cfg.Accounts[i]
+		if acct.Honeypot || len(selected) > 0 && !slices.Contains(selected, acct.LocalUser) {
+			continue
+		}
+		exporters = append(exporters, &export.Exporter{
+			Account: acct, Folders: splitList(*folders), Dir: *out, Format: *format, Logger: logger,
+			Upstream: imapclient.Upstream{Hosts: hosts},
+		})
+	}
+	if len(exporters) == 0 {
+		fmt.Fprintln(os.Stderr, "export: no accounts to export")
+		return 1
+	}
+
+	stop := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		logger.Info("received signal, stopping export", "signal", sig)
+		close(stop)
+	}()
+
+	status := 0
+	for _, e := range exporters {
+		stats, err := e.Run(stop)
+		logger.Info("export finished", "user", e.Account.LocalUser, "folders", stats.Folders,
+			"messages", stats.Messages, "bytes", stats.Bytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: account %q: %v\n", e.Account.LocalUser, err)
+			status = 1
+		}
+		select {
+		case <-stop:
+			return 1
+		default:
+		}
+	}
+	return status
+}
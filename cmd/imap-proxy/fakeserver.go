@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"imap-proxy/internal/imaptest"
+)
+
+// fakeserverCommand implements "imap-proxy fakeserver": it serves canned
+// mail over plaintext IMAP so client integrations and config changes can
+// be tried without a real mail server.
+func fakeserverCommand(args []string) int {
+	flags := flag.NewFlagSet("fakeserver", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:1143", "address to accept IMAP connections on")
+	dir := flags.String("dir", "", "maildir tree to serve, seeded with canned mail if it does not exist (default: a temporary copy)")
+	user := flags.String("user", imaptest.User, "user name to accept; empty accepts any credentials")
+	password := flags.String("password", imaptest.Password, "password to accept")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	root := *dir
+	if root == "" {
+		tmp, err := os.MkdirTemp("", "imap-proxy-fakeserver")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fakeserver: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(tmp)
+		root = tmp
+	}
+	// An existing -dir is served as is.
+	switch _, err := os.Stat(root); {
+	case *dir == "" || errors.Is(err, fs.ErrNotExist):
+		if err := imaptest.Seed(root); err != nil {
+			fmt.Fprintf(os.Stderr, "fakeserver: seed %s: %v\n", root, err)
+			return 1
+		}
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "fakeserver: %v\n", err)
+		return 1
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fakeserver: %v\n", err)
+		return 1
+	}
+	s := imaptest.NewListenerServer(l, root, *user, *password)
+	defer s.Close()
+
+	acct := s.Account("dev", "dev")
+	fmt.Printf("Serving %s on %s. Example account:\n\n", root, s.Addr)
+	fmt.Printf("[[accounts]]\nlocal_user = %q\nlocal_password = %q\nremote_host = %q\nremote_port = %d\n"+
+		"remote_user = %q\nremote_password = %q\nremote_allow_plaintext = true\n",
+		acct.LocalUser, acct.LocalPassword, acct.RemoteHost, acct.RemotePort, acct.RemoteUser, acct.RemotePassword)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+	return 0
+}
@@ -2,42 +2,380 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"imap-proxy/internal/admin"
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/backup"
+	"imap-proxy/internal/buildinfo"
 	"imap-proxy/internal/config"
+	"imap-proxy/internal/geoip"
+	"imap-proxy/internal/jmap"
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/nats"
 	"imap-proxy/internal/proxy"
+	"imap-proxy/internal/quota"
+	"imap-proxy/internal/redis"
+	"imap-proxy/internal/rest"
+)
+
+const (
+	// quotaFlushInterval is how often download quota counters are saved.
+	quotaFlushInterval = 30 * time.Second
+	// auditPruneInterval is how often expired audit events are deleted.
+	auditPruneInterval = time.Hour
+	// passwordFileCheckInterval is how often password_file is checked for
+	// changes.
+	passwordFileCheckInterval = 5 * time.Second
+
+	// HTTP clients must send each request within httpReadTimeout, its
+	// headers within httpReadHeaderTimeout, and are disconnected after
+	// httpIdleTimeout without one. Responses, such as large downloads, are
+	// not bounded; WebSocket sessions clear the deadlines.
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = time.Minute
+	httpIdleTimeout       = 2 * time.Minute
 )
 
 func main() {
+	// Subcommands are dispatched before flag parsing; each parses its own flags.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "service":
+			os.Exit(serviceCommand(os.Args[2:]))
+		case "healthcheck":
+			os.Exit(healthcheckCommand(os.Args[2:]))
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		case "audit":
+			os.Exit(auditCommand(os.Args[2:]))
+		case "report":
+			os.Exit(reportCommand(os.Args[2:]))
+		case "watch":
+			os.Exit(watchCommand(os.Args[2:]))
+		case "export":
+			os.Exit(exportCommand(os.Args[2:]))
+		case "fakeserver":
+			os.Exit(fakeserverCommand(os.Args[2:]))
+		case "replay":
+			os.Exit(replayCommand(os.Args[2:]))
+		case "bench":
+			os.Exit(benchCommand(os.Args[2:]))
+		}
+	}
+
 	configPath := flag.String("config", "config.toml", "path to config file")
+	logFile := flag.String("log-file", "", "append logs to this file instead of stderr")
+	showVersion := flag.Bool("version", false, "print version information and exit")
 	flag.Parse()
 
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	if *showVersion {
+		fmt.Println(buildinfo.String())
+		return
+	}
 
-	cfg, err := config.Load(*configPath)
+	logger, closeLog, err := newLogger(*logFile)
 	if err != nil {
-		logger.Error("failed to load config", "err", err)
+		fmt.Fprintf(os.Stderr, "open log file: %v\n", err)
 		os.Exit(1)
 	}
+	defer closeLog()
 
-	logger.Info("starting imap-proxy", "listen", cfg.Server.Listen, "accounts", len(cfg.Accounts))
+	// When started by the Windows service control manager, hand control to it.
+	if isWindowsService() {
+		if err := runService(*configPath, logger); err != nil {
+			logger.Error("service error", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	srv := proxy.NewServer(cfg, logger)
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		logger.Error("failed to load config", "err", err)
+		os.Exit(1)
+	}
 
 	// Handle signals for graceful shutdown.
+	stop := make(chan struct{})
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigCh
 		logger.Info("received signal, shutting down", "signal", sig)
-		srv.Close()
+		close(stop)
 	}()
 
-	if err := srv.ListenAndServe(); err != nil {
+	if err := serve(cfg, logger, stop); err != nil {
 		logger.Error("server error", "err", err)
 		os.Exit(1)
 	}
 }
+
+// newLogger returns a text logger writing to path, or to stderr when path is empty.
+func newLogger(path string) (*slog.Logger, func(), error) {
+	var w io.Writer = os.Stderr
+	closeFn := func() {}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = f
+		closeFn = func() { f.Close() }
+	}
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelInfo})), closeFn, nil
+}
+
+// newHTTPServer returns an http.Server for h with the HTTP timeouts.
+func newHTTPServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+}
+
+// serve runs the proxy (and metrics listener, if configured) until stop is
+// closed or the listener fails.
+func serve(cfg *config.Config, logger *slog.Logger, stop <-chan struct{}) error {
+	logger.Info("starting imap-proxy", "listen", cfg.Server.Listen, "accounts", len(cfg.Accounts),
+		"version", buildinfo.Version, "commit", buildinfo.CommitHash())
+
+	if cfg.Server.MetricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default.Handler())
+		go func() {
+			logger.Info("serving metrics", "listen", cfg.Server.MetricsListen)
+			hs := newHTTPServer(mux)
+			hs.Addr = cfg.Server.MetricsListen
+			if err := hs.ListenAndServe(); err != nil {
+				logger.Error("metrics server error", "err", err)
+			}
+		}()
+	}
+
+	if err := proxy.CheckUpstreamTLS(cfg, logger); err != nil {
+		return err
+	}
+	srv := proxy.NewServer(cfg, logger)
+	tlsCfg, err := proxy.ServerTLSConfig(cfg.Server)
+	if err != nil {
+		return err
+	}
+	if tlsCfg != nil {
+		srv.SetTLSConfig(tlsCfg)
+	}
+	if cfg.Server.GeoIPDatabase != "" {
+		db, err := geoip.Open(cfg.Server.GeoIPDatabase)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		srv.SetCountryLookup(db)
+	}
+	var auditStore *audit.Store
+	if ac := cfg.Server.Audit; ac.SQLitePath != "" {
+		store, err := audit.OpenStore(ac.SQLitePath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		store.OnError = func(err error) { logger.Error("failed to store audit event", "err", err) }
+		if ac.Retention > 0 {
+			go store.PruneEvery(ac.Retention, auditPruneInterval, stop, func(err error) {
+				logger.Error("failed to prune audit events", "err", err)
+			})
+		}
+		srv.AddAuditSink(store)
+		auditStore = store
+	}
+	if hook := cfg.Server.Audit.AlertWebhook; hook != "" {
+		sink := audit.NewWebhookSink(hook, audit.HoneypotLogin)
+		sink.OnError = func(err error) { logger.Error("failed to send alert", "err", err) }
+		defer sink.Close()
+		srv.AddAuditSink(sink)
+	}
+	if sc := cfg.Server.Audit.SIEM; sc.Address != "" {
+		encode := audit.EncodeJSON
+		if sc.Format == "cef" {
+			encode = audit.EncodeCEF
+		}
+		sink := audit.NewSIEMSink(sc.Protocol, sc.Address, encode, sc.BufferSize)
+		sink.OnError = func(err error) { logger.Error("SIEM stream error", "err", err) }
+		defer sink.Close()
+		srv.AddAuditSink(sink)
+	}
+	if ec := cfg.Server.Events; ec.NATSURL != "" {
+		pub, err := nats.NewPublisher(ec.NATSURL, ec.BufferSize)
+		if err != nil {
+			return err
+		}
+		pub.OnError = func(err error) { logger.Error("event bus error", "err", err) }
+		defer pub.Close()
+		srv.SetEventPublisher(pub, ec.SubjectPrefix)
+	}
+	if cfg.Server.QuotaStateFile != "" {
+		store, err := quota.Open(cfg.Server.QuotaStateFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := store.Flush(); err != nil {
+				logger.Error("failed to save download quotas", "err", err)
+			}
+		}()
+		go store.FlushEvery(quotaFlushInterval, stop, func(err error) {
+			logger.Error("failed to save download quotas", "err", err)
+		})
+		srv.SetQuotaStore(store)
+	}
+	if sc := cfg.Server.SharedState; sc.RedisURL != "" {
+		client, err := redis.New(sc.RedisURL)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		srv.SetSharedState(client, sc.KeyPrefix)
+	}
+
+	if pw := cfg.Passwords(); pw != nil {
+		go pw.ReloadEvery(passwordFileCheckInterval, stop, func(users int) {
+			logger.Info("password file reloaded", "path", cfg.Server.PasswordFile, "users", users)
+		}, func(err error) {
+			logger.Error("failed to reload password file", "err", err)
+		})
+	}
+
+	if cfg.Server.Backup.Dir != "" {
+		b, err := backup.New(cfg, logger)
+		if err != nil {
+			return err
+		}
+		b.Upstream.Hosts = srv.HostLimits()
+		go b.Run(stop)
+	}
+
+	if cfg.Server.AdminListen != "" {
+		adm := admin.New(cfg.Server.AdminToken)
+		adm.Handle("GET /config", admin.ConfigHandler(cfg))
+		adm.Handle("GET /accounts/{user}/log-level", srv.LogLevelHandler())
+		adm.Handle("PUT /accounts/{user}/log-level", srv.LogLevelHandler())
+		adm.Handle("DELETE /accounts/{user}/caches", srv.CacheHandler())
+		adm.Handle("GET /sessions", srv.SessionsHandler())
+		adm.Handle("GET /sessions/{id}/log-level", srv.SessionLogLevelHandler())
+		adm.Handle("PUT /sessions/{id}/log-level", srv.SessionLogLevelHandler())
+		adm.Handle("GET /sessions/{id}/wire-trace", srv.WireTraceHandler())
+		adm.Handle("PUT /sessions/{id}/wire-trace", srv.WireTraceHandler())
+		if auditStore != nil {
+			adm.Handle("GET /report", admin.ReportHandler(auditStore))
+		}
+		go func() {
+			logger.Info("serving admin API", "listen", cfg.Server.AdminListen)
+			hs := newHTTPServer(adm)
+			hs.Addr = cfg.Server.AdminListen
+			if err := hs.ListenAndServe(); err != nil {
+				logger.Error("admin server error", "err", err)
+			}
+		}()
+	}
+
+	if cfg.Server.HTTPListen != "" {
+		api := http.NewServeMux()
+		j := jmap.New(cfg, srv, logger)
+		api.Handle("/.well-known/jmap", j)
+		api.Handle("/jmap/", j)
+		api.Handle("/accounts/", rest.New(cfg, srv, logger))
+		api.Handle("GET /imap", srv.WebSocketHandler())
+		l, err := proxy.Listen(cfg.Server.HTTPListen, cfg.Server.ReusePort)
+		if err != nil {
+			return err
+		}
+		// Connections get the IMAP listener's access lists and per-IP rate
+		// limit.
+		l = srv.LimitListener(l)
+		go func() {
+			logger.Info("serving HTTP APIs", "listen", cfg.Server.HTTPListen)
+			hs := newHTTPServer(api)
+			var err error
+			if cfg.Server.TLSCertFile != "" {
+				err = hs.ServeTLS(l, cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+			} else {
+				err = hs.Serve(l)
+			}
+			if err != nil {
+				logger.Error("HTTP API server error", "err", err)
+			}
+		}()
+	}
+
+	go func() {
+		<-stop
+		srv.Close()
+	}()
+
+	return srv.ListenAndServe()
+}
+
+// healthcheckCommand implements "imap-proxy healthcheck": it exits 0 if the
+// configured listener answers with an OK greeting and 1 otherwise.
+func healthcheckCommand(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	configPath := fs.String("config", "config.toml", "path to config file")
+	addr := fs.String("addr", "", "address to check (default: server.listen from config)")
+	timeout := fs.Duration("timeout", 5*time.Second, "connect and read timeout")
+	proxyHeader := fs.Bool("proxy-protocol", false, "send a PROXY protocol header first (default: server.proxy_protocol from config)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	target := *addr
+	if target == "" {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "healthcheck: %v\n", err)
+			return 1
+		}
+		target = cfg.Server.Listen
+		*proxyHeader = *proxyHeader || cfg.Server.ProxyProtocol
+	}
+
+	if err := proxy.HealthCheck(target, *timeout, *proxyHeader); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// configCommand implements "imap-proxy config dump", which prints the
+// effective configuration with secrets masked.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: imap-proxy config dump [-config path]")
+		return 2
+	}
+	fs := flag.NewFlagSet("config dump", flag.ContinueOnError)
+	configPath := fs.String("config", "config.toml", "path to config file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := cfg.Redacted().WriteTOML(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
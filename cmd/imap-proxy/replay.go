@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/transcript"
+)
+
+// replayCommand implements "imap-proxy replay": it sends the client side
+// of a recorded session to the proxy or an upstream server and reports
+// the commands whose responses differ from the recording.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	addr := fs.String("addr", "", "IMAP server to replay against, host:port (required)")
+	useTLS := fs.Bool("tls", false, "connect with implicit TLS")
+	insecure := fs.Bool("insecure-skip-verify", false, "do not verify the server certificate")
+	user := fs.String("user", "", "user name to log in with in place of the redacted one")
+	password := fs.String("password", "", "password to log in with")
+	timing := fs.Bool("timing", false, "keep the recorded pauses between commands")
+	timeout := fs.Duration("timeout", 30*time.Second, "wait this long for each response")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: imap-proxy replay -addr host:port [flags] transcript.jsonl")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *addr == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	events, err := transcript.Read(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	var conn net.Conn
+	if *useTLS {
+		host, _, _ := net.SplitHostPort(*addr)
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: *timeout}, "tcp", *addr,
+			&tls.Config{ServerName: host, InsecureSkipVerify: *insecure})
+	} else {
+		conn, err = net.DialTimeout("tcp", *addr, *timeout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	rp := &transcript.Replayer{User: *user, Password: *password, Out: os.Stdout, Timing: *timing, Timeout: *timeout}
+	diffs, err := rp.Run(conn, events)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	if len(diffs) == 0 {
+		fmt.Println("\nAll responses match the recording.")
+		return 0
+	}
+	for _, d := range diffs {
+		fmt.Printf("\nDifferent responses to %s\n", d.Command)
+		fmt.Printf("  recorded:\n    %s\n", strings.Join(d.Recorded, "\n    "))
+		fmt.Printf("  replayed:\n    %s\n", strings.Join(d.Replayed, "\n    "))
+	}
+	return 1
+}
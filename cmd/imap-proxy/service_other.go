@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// isWindowsService always reports false outside Windows.
+func isWindowsService() bool { return false }
+
+func runService(string, *slog.Logger) error {
+	return errors.New("service mode is only supported on Windows")
+}
+
+// serviceCommand is a stub; use systemd or another supervisor on this platform.
+func serviceCommand([]string) int {
+	fmt.Fprintln(os.Stderr, "imap-proxy service: only supported on Windows; use systemd or another supervisor")
+	return 1
+}
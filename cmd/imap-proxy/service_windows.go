@@ -0,0 +1,198 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/debug"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"imap-proxy/internal/config"
+)
+
+const (
+	serviceName        = "imap-proxy"
+	serviceDisplayName = "IMAP read-only proxy"
+	serviceDescription = "Proxies IMAP clients to upstream mail servers in read-only mode."
+)
+
+// isWindowsService reports whether the process was started by the service control manager.
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runService runs the proxy under the service control manager.
+func runService(configPath string, logger *slog.Logger) error {
+	return svc.Run(serviceName, &proxyService{configPath: configPath, logger: logger})
+}
+
+// proxyService implements svc.Handler.
+type proxyService struct {
+	configPath string
+	logger     *slog.Logger
+}
+
+// Execute starts the proxy and translates service control requests into a
+// graceful shutdown.
+func (p *proxyService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.StartPending}
+
+	cfg, err := config.Load(p.configPath)
+	if err != nil {
+		p.logger.Error("failed to load config", "err", err)
+		return true, 1
+	}
+
+	stop := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() { errCh <- serve(cfg, p.logger, stop) }()
+
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				p.logger.Info("received service control request, shutting down", "cmd", req.Cmd)
+				status <- svc.Status{State: svc.StopPending}
+				close(stop)
+				if err := <-errCh; err != nil {
+					p.logger.Error("server error", "err", err)
+					return true, 1
+				}
+				return false, 0
+			default:
+				p.logger.Warn("unexpected service control request", "cmd", req.Cmd)
+			}
+		case err := <-errCh:
+			if err != nil {
+				p.logger.Error("server error", "err", err)
+				return true, 1
+			}
+			return false, 0
+		}
+	}
+}
+
+// serviceCommand implements "imap-proxy service <install|uninstall|start|stop|run>".
+func serviceCommand(args []string) int {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	configPath := fs.String("config", "config.toml", "path to config file")
+	logFile := fs.String("log-file", "", "log file used when running as a service")
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: imap-proxy service <install|uninstall|start|stop|run> [flags]")
+		return 2
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var err error
+	switch action {
+	case "install":
+		err = installService(*configPath, *logFile)
+	case "uninstall":
+		err = uninstallService()
+	case "start":
+		err = controlService(func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = controlService(func(s *mgr.Service) error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+	case "run":
+		// Run in the foreground with the service handler, for debugging.
+		logger, closeLog, lerr := newLogger(*logFile)
+		if lerr != nil {
+			err = lerr
+			break
+		}
+		defer closeLog()
+		err = debug.Run(serviceName, &proxyService{configPath: *configPath, logger: logger})
+	default:
+		fmt.Fprintf(os.Stderr, "unknown service action %q\n", action)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "service %s: %v\n", action, err)
+		return 1
+	}
+	return 0
+}
+
+func installService(configPath, logFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return err
+	}
+	if logFile == "" {
+		logFile = filepath.Join(filepath.Dir(absConfig), "imap-proxy.log")
+	}
+	absLog, err := filepath.Abs(logFile)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, "-config", absConfig, "-log-file", absLog)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Restart automatically after unexpected exits.
+	return s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+	}, uint32((24 * time.Hour).Seconds()))
+}
+
+func uninstallService() error {
+	return controlService(func(s *mgr.Service) error { return s.Delete() })
+}
+
+func controlService(fn func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("open service %s: %w", serviceName, err)
+	}
+	defer s.Close()
+	return fn(s)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imapclient"
+	"imap-proxy/internal/proxy"
+	"imap-proxy/internal/watch"
+)
+
+// watchCommand implements "imap-proxy watch": it logs into the configured
+// upstreams without starting the listener and reports folder changes as
+// JSON lines on stdout, webhooks or exec hooks.
+func watchCommand(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	configPath := fs.String("config", "config.toml", "path to config file")
+	users := fs.String("user", "", "comma-separated accounts to watch (default: all)")
+	folders := fs.String("folder", "INBOX", "comma-separated folders to watch in each account")
+	webhook := fs.String("webhook", "", "POST each event as JSON to this URL")
+	execCmd := fs.String("exec", "", "run this command for each event, with the event as JSON on stdin")
+	poll := fs.Duration("poll", 0, "NOOP polling interval for upstreams without IDLE (default 1m)")
+	logFile := fs.String("log-file", "", "append logs to this file instead of stderr")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	logger, closeLog, err := newLogger(*logFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "watch: open log file: %v\n", err)
+		return 1
+	}
+	defer closeLog()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "watch: %v\n", err)
+		return 1
+	}
+	if err := proxy.CheckUpstreamTLS(cfg, logger); err != nil {
+		fmt.Fprintf(os.Stderr, "watch: %v\n", err)
+		return 1
+	}
+
+	var sinks []watch.Sink
+	if *webhook != "" {
+		sinks = append(sinks, &watch.WebhookSink{URL: *webhook})
+	}
+	if *execCmd != "" {
+		sinks = append(sinks, &watch.ExecSink{Command: strings.Fields(*execCmd)})
+	}
+	if len(sinks) == 0 {
+		sinks = append(sinks, watch.NewJSONSink(os.Stdout))
+	}
+
+	selected := splitList(*users)
+	hosts := proxy.NewHostLimits(cfg.Server)
+	var watchers []*watch.Watcher
+	for i := range cfg.Accounts {
+		acct := &cfg.Accounts[i]
+		if acct.Honeypot || len(selected) > 0 && !slices.Contains(selected, acct.LocalUser) {
+			continue
+		}
+		for _, folder := range splitList(*folders) {
+			watchers = append(watchers, &watch.Watcher{
+				Account: acct, Folder: folder, Sinks: sinks, Logger: logger, PollInterval: *poll,
+				Upstream: imapclient.Upstream{Hosts: hosts},
+			})
+		}
+	}
+	if len(watchers) == 0 {
+		fmt.Fprintln(os.Stderr, "watch: no accounts or folders to watch")
+		return 1
+	}
+
+	stop := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		logger.Info("received signal, shutting down", "signal", sig)
+		close(stop)
+	}()
+
+	logger.Info("watching upstream folders", "watchers", len(watchers))
+	var wg sync.WaitGroup
+	for _, w := range watchers {
+		wg.Go(func() { w.Run(stop) })
+	}
+	wg.Wait()
+	return 0
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+// Package admin implements the proxy's HTTP admin API.
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/report"
+)
+
+// Server routes admin API requests, optionally requiring a bearer token.
+type Server struct {
+	mux   *http.ServeMux
+	token string
+}
+
+// New returns an admin Server. If token is non-empty, every request must
+// carry "Authorization: Bearer <token>".
+func New(token string) *Server {
+	return &Server{mux: http.NewServeMux(), token: token}
+}
+
+// Handle registers h for pattern (http.ServeMux syntax).
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="imap-proxy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// ConfigHandler serves the effective configuration as TOML with secrets masked.
+func ConfigHandler(cfg *config.Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/toml; charset=utf-8")
+		cfg.Redacted().WriteTOML(w)
+	})
+}
+
+// ReportHandler serves folder access reports generated from store. Query
+// parameters: user, since, until (see audit.ParseTime) and format ("json",
+// the default, or "csv").
+func ReportHandler(store *audit.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		now := time.Now()
+		since, err := audit.ParseTime(params.Get("since"), now)
+		if err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		until, err := audit.ParseTime(params.Get("until"), now)
+		if err != nil {
+			http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := params.Get("format")
+		switch format {
+		case "", report.FormatJSON:
+			format = report.FormatJSON
+			w.Header().Set("Content-Type", "application/json")
+		case report.FormatCSV:
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		default:
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := report.Generate(store, report.Query{User: params.Get("user"), Since: since, Until: until})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		report.Write(w, rows, format)
+	})
+}
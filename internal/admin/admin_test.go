@@ -0,0 +1,108 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Server: config.ServerConfig{Listen: ":143", AdminToken: "s3cret"},
+		Accounts: []config.AccountConfig{
+			{LocalUser: "reader1", LocalPassword: "localpass1", RemotePassword: "realpass"},
+		},
+	}
+}
+
+func TestConfigHandlerRedacts(t *testing.T) {
+	srv := New("")
+	srv.Handle("GET /config", ConfigHandler(testConfig()))
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, secret := range []string{"localpass1", "realpass", "s3cret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("body leaks secret %q:\n%s", secret, body)
+		}
+	}
+	if !strings.Contains(body, `local_user = "reader1"`) {
+		t.Errorf("body missing account:\n%s", body)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	srv := New("s3cret")
+	srv.Handle("GET /config", ConfigHandler(testConfig()))
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "missing", want: http.StatusUnauthorized},
+		{name: "wrong", header: "Bearer nope", want: http.StatusUnauthorized},
+		{name: "wrong scheme", header: "Basic s3cret", want: http.StatusUnauthorized},
+		{name: "valid", header: "Bearer s3cret", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/config", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportHandler(t *testing.T) {
+	store, err := audit.OpenStore(filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	defer store.Close()
+	store.Record(audit.Event{Type: audit.FolderUsage, User: "reader1", Fields: map[string]string{
+		"folder": "INBOX", "listed": "true", "selects": "2", "messages": "7", "bytes": "700",
+	}})
+	store.Flush()
+	srv := New("")
+	srv.Handle("GET /report", ReportHandler(store))
+
+	tests := []struct {
+		query    string
+		wantCode int
+		wantBody string
+	}{
+		{query: "", wantCode: http.StatusOK, wantBody: `"messages": 7`},
+		{query: "?format=csv&since=24h", wantCode: http.StatusOK, wantBody: "reader1,INBOX,1,2,7,700"},
+		{query: "?user=other", wantCode: http.StatusOK, wantBody: "[]"},
+		{query: "?format=xml", wantCode: http.StatusBadRequest},
+		{query: "?since=yesterday", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("GET", "/report"+tt.query, nil))
+		if rec.Code != tt.wantCode {
+			t.Errorf("GET /report%s status = %d, want %d", tt.query, rec.Code, tt.wantCode)
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Errorf("GET /report%s body = %q, want it to contain %q", tt.query, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package audit
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorderFanOut(t *testing.T) {
+	var a, b []Event
+	r := New(SinkFunc(func(ev Event) { a = append(a, ev) }), SinkFunc(func(ev Event) { b = append(b, ev) }))
+
+	r.Record(Event{Type: LoginFailure, User: "reader1"})
+
+	if len(a) != 1 || len(b) != 1 {
+		t.Fatalf("sinks received %d and %d events, want 1 each", len(a), len(b))
+	}
+	if a[0].Time.IsZero() {
+		t.Error("Record should stamp the event time")
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var r *Recorder
+	r.Record(Event{Type: LoginSuccess}) // must not panic
+}
+
+func TestSlogSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := SlogSink{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+
+	sink.Record(Event{
+		Time:     time.Now(),
+		Type:     AccountLocked,
+		User:     "reader1",
+		ClientIP: "192.0.2.1",
+		Fields:   map[string]string{"locked_for": "1m0s", "failures": "5"},
+	})
+
+	out := buf.String()
+	for _, want := range []string{"msg=audit", "event=account_locked", "user=reader1", "client=192.0.2.1", "failures=5 locked_for=1m0s"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q: %s", want, out)
+		}
+	}
+}
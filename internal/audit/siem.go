@@ -0,0 +1,242 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"imap-proxy/internal/buildinfo"
+)
+
+const (
+	// siemDialTimeout bounds each connection attempt to the collector, and
+	// siemWriteTimeout each event written to it.
+	siemDialTimeout  = 5 * time.Second
+	siemWriteTimeout = 10 * time.Second
+	// siemMaxBackoff caps the wait between reconnection attempts, which
+	// starts at siemMinBackoff and doubles after each failure.
+	siemMinBackoff = time.Second
+	siemMaxBackoff = 30 * time.Second
+	// DefaultSIEMBuffer is the number of events held while the collector
+	// is unreachable when no buffer size is configured.
+	DefaultSIEMBuffer = 1000
+)
+
+// SIEMSink streams security events to a SIEM collector over TCP or UDP, one
+// encoded event per line or datagram. Events are queued and written in the
+// background; while the collector is unreachable the sink reconnects with
+// backoff and holds up to its buffer size of events, dropping newer ones.
+type SIEMSink struct {
+	network, address string
+	encode           func(Event) []byte
+
+	// OnError is called when the collector cannot be reached (once per
+	// outage) and when events were dropped. It may be nil and must be set
+	// before the first event is recorded.
+	OnError func(error)
+
+	mu      sync.Mutex // guards closed and sends on queue
+	closed  bool
+	queue   chan Event
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Int64
+
+	// sleep waits between reconnection attempts; tests replace it.
+	sleep func(time.Duration, <-chan struct{})
+}
+
+// NewSIEMSink returns a sink writing the SecurityEvents to the collector at
+// address ("host:port") over network ("tcp" or "udp"), encoded by encode,
+// holding up to buffer events. Close stops it.
+func NewSIEMSink(network, address string, encode func(Event) []byte, buffer int) *SIEMSink {
+	if buffer <= 0 {
+		buffer = DefaultSIEMBuffer
+	}
+	s := &SIEMSink{
+		network: network,
+		address: address,
+		encode:  encode,
+		queue:   make(chan Event, buffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		sleep:   sleepOrStop,
+	}
+	go s.run()
+	return s
+}
+
+// Record implements Sink.
+func (s *SIEMSink) Record(ev Event) {
+	if !slices.Contains(SecurityEvents, ev.Type) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Close writes the queued events if the collector is reachable and stops
+// the sink. Events recorded after Close are discarded.
+func (s *SIEMSink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *SIEMSink) run() {
+	defer close(s.done)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	backoff := siemMinBackoff
+	failing := false
+	for ev := range s.queue {
+		line := append(s.encode(ev), '\n')
+		for {
+			var err error
+			if conn == nil {
+				conn, err = net.DialTimeout(s.network, s.address, siemDialTimeout)
+			}
+			if err == nil {
+				conn.SetWriteDeadline(time.Now().Add(siemWriteTimeout))
+				if _, err = conn.Write(line); err != nil {
+					conn.Close()
+					conn = nil
+				}
+			}
+			if err == nil {
+				break
+			}
+			if !failing {
+				s.fail(fmt.Errorf("siem: %s %s: %w", s.network, s.address, err))
+				failing = true
+			}
+			select {
+			case <-s.stop:
+				// Closing; the collector is unreachable, so give up.
+				return
+			default:
+			}
+			s.sleep(backoff, s.stop)
+			backoff = min(backoff*2, siemMaxBackoff)
+		}
+		failing = false
+		backoff = siemMinBackoff
+		if n := s.dropped.Swap(0); n > 0 {
+			s.fail(fmt.Errorf("siem: dropped %d events while the buffer was full", n))
+		}
+	}
+}
+
+func (s *SIEMSink) fail(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+// sleepOrStop waits for d or until stop is closed.
+func sleepOrStop(d time.Duration, stop <-chan struct{}) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-stop:
+	}
+}
+
+// EncodeJSON encodes ev as a single-line JSON object.
+func EncodeJSON(ev Event) []byte {
+	b, _ := json.Marshal(ev) // an Event always marshals
+	return b
+}
+
+// cefSeverity rates each security event on CEF's 0-10 scale.
+var cefSeverity = map[string]int{
+	LoginSuccess:   3,
+	CommandBlocked: 4,
+	LoginFailure:   5,
+	AccountLocked:  7,
+	IPBanned:       7,
+	HoneypotLogin:  9,
+}
+
+// cefMaxCustom is the number of custom string fields (cs1 to cs6) CEF
+// defines.
+const cefMaxCustom = 6
+
+// EncodeCEF encodes ev in ArcSight Common Event Format. The event type is
+// the signature ID, the time, user and client IP map to rt, suser and src,
+// and the other fields to the custom strings cs1 to cs6 in name order. Any
+// fields beyond those are appended to msg as name=value pairs.
+func EncodeCEF(ev Event) []byte {
+	var b strings.Builder
+	b.WriteString("CEF:0|imap-proxy|imap-proxy|")
+	b.WriteString(cefHeader(buildinfo.Version))
+	b.WriteByte('|')
+	b.WriteString(cefHeader(ev.Type))
+	b.WriteByte('|')
+	b.WriteString(cefHeader(strings.ReplaceAll(ev.Type, "_", " ")))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(cefSeverity[ev.Type]))
+	b.WriteByte('|')
+
+	ext := []string{"rt=" + strconv.FormatInt(ev.Time.UnixMilli(), 10)}
+	if ev.User != "" {
+		ext = append(ext, "suser="+cefValue(ev.User))
+	}
+	if ev.ClientIP != "" {
+		ext = append(ext, "src="+cefValue(ev.ClientIP))
+	}
+	keys := make([]string, 0, len(ev.Fields))
+	for k := range ev.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var rest []string
+	for i, k := range keys {
+		if i >= cefMaxCustom {
+			rest = append(rest, k+"="+ev.Fields[k])
+			continue
+		}
+		n := strconv.Itoa(i + 1)
+		ext = append(ext, "cs"+n+"Label="+cefValue(k), "cs"+n+"="+cefValue(ev.Fields[k]))
+	}
+	if len(rest) > 0 {
+		ext = append(ext, "msg="+cefValue(strings.Join(rest, " ")))
+	}
+	b.WriteString(strings.Join(ext, " "))
+	return []byte(b.String())
+}
+
+// cefHeader escapes a CEF header field.
+func cefHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ").Replace(s)
+}
+
+// cefValue escapes a CEF extension value.
+func cefValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,205 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acceptLines accepts connections on ln and sends each line received, and
+// returns the connections so tests can drop them.
+func acceptLines(t *testing.T, ln net.Listener) (<-chan string, <-chan net.Conn) {
+	t.Helper()
+	lines := make(chan string, 100)
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+			go func() {
+				sc := bufio.NewScanner(c)
+				for sc.Scan() {
+					lines <- sc.Text()
+				}
+			}()
+		}
+	}()
+	return lines, conns
+}
+
+func readSIEMLine(t *testing.T, lines <-chan string) string {
+	t.Helper()
+	select {
+	case l := <-lines:
+		return l
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+		return ""
+	}
+}
+
+func TestSIEMSinkTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lines, _ := acceptLines(t, ln)
+
+	sink := NewSIEMSink("tcp", ln.Addr().String(), EncodeJSON, 0)
+	sink.OnError = func(err error) { t.Errorf("OnError: %v", err) }
+	sink.Record(Event{Type: FolderAccess, User: "reader1"}) // not a security event
+	sink.Record(Event{Type: LoginFailure, User: "reader1", ClientIP: "192.0.2.1", Fields: map[string]string{"reason": "wrong password"}})
+	sink.Record(Event{Type: IPBanned, ClientIP: "192.0.2.1"})
+
+	var ev Event
+	if err := json.Unmarshal([]byte(readSIEMLine(t, lines)), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != LoginFailure || ev.User != "reader1" || ev.Fields["reason"] != "wrong password" {
+		t.Errorf("first event = %+v", ev)
+	}
+	if l := readSIEMLine(t, lines); !strings.Contains(l, `"type":"ip_banned"`) {
+		t.Errorf("second event = %s", l)
+	}
+	sink.Close()
+	sink.Record(Event{Type: LoginFailure}) // discarded, must not panic
+}
+
+func TestSIEMSinkUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	sink := NewSIEMSink("udp", pc.LocalAddr().String(), EncodeCEF, 0)
+	defer sink.Close()
+	sink.Record(Event{Type: HoneypotLogin, User: "admin"})
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); !strings.HasPrefix(got, "CEF:0|imap-proxy|") || !strings.HasSuffix(got, "\n") {
+		t.Errorf("datagram = %q", got)
+	}
+}
+
+func TestSIEMSinkReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lines, conns := acceptLines(t, ln)
+
+	sink := NewSIEMSink("tcp", ln.Addr().String(), EncodeJSON, 0)
+	sink.sleep = func(time.Duration, <-chan struct{}) { time.Sleep(time.Millisecond) }
+	defer sink.Close()
+
+	sink.Record(Event{Type: LoginSuccess, User: "first"})
+	readSIEMLine(t, lines)
+	(<-conns).Close()
+
+	// Writes to the dropped connection may still succeed until the reset
+	// arrives, so keep sending until one arrives over the new connection.
+	deadline := time.After(5 * time.Second)
+	for {
+		sink.Record(Event{Type: LoginSuccess, User: "again"})
+		select {
+		case l := <-lines:
+			if !strings.Contains(l, `"user":"again"`) {
+				t.Fatalf("event = %s", l)
+			}
+			return
+		case <-deadline:
+			t.Fatal("no event after the collector dropped the connection")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestSIEMSinkBuffersWhileDown(t *testing.T) {
+	// Reserve an address, then close it so connections are refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var mu sync.Mutex
+	var errs []string
+	retry := make(chan struct{})
+	sink := NewSIEMSink("tcp", addr, EncodeJSON, 2)
+	sink.OnError = func(err error) {
+		mu.Lock()
+		errs = append(errs, err.Error())
+		mu.Unlock()
+	}
+	sink.sleep = func(time.Duration, <-chan struct{}) { <-retry }
+
+	// One event is held by the writer and two are buffered; the rest are dropped.
+	for range 6 {
+		sink.Record(Event{Type: LoginFailure})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	defer ln.Close()
+	lines, _ := acceptLines(t, ln)
+	close(retry)
+	for range 3 {
+		readSIEMLine(t, lines)
+	}
+	sink.Record(Event{Type: LoginFailure}) // reports the drops once delivered
+	readSIEMLine(t, lines)
+	sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 2 || !strings.Contains(errs[0], "refused") || !strings.Contains(errs[1], "dropped 3 events") {
+		t.Errorf("errors = %q, want one connection error and 3 dropped", errs)
+	}
+}
+
+func TestEncodeCEF(t *testing.T) {
+	ev := Event{
+		Time:     time.UnixMilli(1_700_000_000_123),
+		Type:     LoginFailure,
+		User:     "a=b",
+		ClientIP: "192.0.2.1",
+		Fields: map[string]string{
+			"reason": "wrong\npassword", "country": "DE",
+			"f3": "3", "f4": "4", "f5": "5", "f6": "6", "f7": `back\slash`,
+		},
+	}
+	got := string(EncodeCEF(ev))
+	head, ext, ok := strings.Cut(got, "|5|")
+	if !ok || !strings.HasPrefix(head, "CEF:0|imap-proxy|imap-proxy|") || !strings.HasSuffix(head, "|login_failure|login failure") {
+		t.Fatalf("header = %q", got)
+	}
+	want := `rt=1700000000123 suser=a\=b src=192.0.2.1 cs1Label=country cs1=DE cs2Label=f3 cs2=3 cs3Label=f4 cs3=4 ` +
+		`cs4Label=f5 cs4=5 cs5Label=f6 cs5=6 cs6Label=f7 cs6=back\\slash msg=reason\=wrong\npassword`
+	if ext != want {
+		t.Errorf("extension =\n%s\nwant\n%s", ext, want)
+	}
+}
+
+func TestCEFHeaderEscaping(t *testing.T) {
+	if got := cefHeader(`a|b\c`); got != `a\|b\\c` {
+		t.Errorf("cefHeader = %q", got)
+	}
+}
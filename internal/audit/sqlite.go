@@ -0,0 +1,293 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS events (
+	id        INTEGER PRIMARY KEY,
+	time      INTEGER NOT NULL,
+	type      TEXT NOT NULL,
+	user      TEXT NOT NULL DEFAULT '',
+	client_ip TEXT NOT NULL DEFAULT '',
+	verb      TEXT NOT NULL DEFAULT '',
+	folder    TEXT NOT NULL DEFAULT '',
+	fields    TEXT NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS events_time ON events (time);
+CREATE INDEX IF NOT EXISTS events_user_time ON events (user, time);
+`
+
+// storeQueue is how many events may wait to be written before new ones
+// are dropped.
+const storeQueue = 1000
+
+// Store persists events in an SQLite database. It implements Sink. Events
+// are written in the background by a single writer, so a slow disk never
+// delays the session that recorded them.
+type Store struct {
+	db *sql.DB
+
+	// OnError is called when an event cannot be written, and when events
+	// were dropped because the queue was full. It may be nil and must be
+	// set before the first event is recorded.
+	OnError func(error)
+
+	mu      sync.Mutex // guards closed and sends on queue
+	closed  bool
+	queue   chan Event
+	flush   chan chan struct{}
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// OpenStore opens (creating if necessary) the SQLite database at path.
+func OpenStore(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("audit: open %s: %w", path, err)
+	}
+	// SQLite allows a single writer; serialize through one connection.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", schema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("audit: init %s: %w", path, err)
+		}
+	}
+	s := &Store{
+		db:    db,
+		queue: make(chan Event, storeQueue),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Close writes the queued events and closes the database. Events recorded
+// after Close are discarded.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return s.db.Close()
+}
+
+// Record implements Sink, stamping ev with the current time if unset. The
+// event is queued for writing, or dropped if the queue is full. The "verb"
+// and "folder" fields are stored in their own columns so they can be
+// queried efficiently.
+func (s *Store) Record(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Flush waits until the events recorded before it have been written.
+func (s *Store) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case s.flush <- flushed:
+		<-flushed
+	case <-s.done:
+	}
+}
+
+func (s *Store) run() {
+	defer close(s.done)
+	for {
+		select {
+		case ev, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			s.write(ev)
+		case flushed := <-s.flush:
+			for range len(s.queue) {
+				s.write(<-s.queue)
+			}
+			close(flushed)
+		}
+	}
+}
+
+func (s *Store) write(ev Event) {
+	if err := s.insert(ev); err != nil {
+		s.fail(err)
+	}
+	if n := s.dropped.Swap(0); n > 0 {
+		s.fail(fmt.Errorf("audit: dropped %d events while the queue was full", n))
+	}
+}
+
+func (s *Store) fail(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
+
+func (s *Store) insert(ev Event) error {
+	fields, err := json.Marshal(ev.Fields)
+	if err != nil {
+		return fmt.Errorf("audit: encode fields: %w", err)
+	}
+	if ev.Fields == nil {
+		fields = []byte("{}")
+	}
+	_, err = s.db.Exec(`INSERT INTO events (time, type, user, client_ip, verb, folder, fields) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		ev.Time.UnixNano(), ev.Type, ev.User, ev.ClientIP, ev.Fields["verb"], ev.Fields["folder"], string(fields))
+	if err != nil {
+		return fmt.Errorf("audit: insert: %w", err)
+	}
+	return nil
+}
+
+// Query selects stored events. Zero-valued fields do not filter.
+type Query struct {
+	User string
+	Type string
+	// Verb is matched case-insensitively. A verb without "UID " also
+	// matches its UID form, so STORE finds "UID STORE" too.
+	Verb  string
+	Since time.Time
+	Until time.Time // exclusive
+	Limit int
+}
+
+// Query returns the events matching q, oldest first.
+func (s *Store) Query(q Query) ([]Event, error) {
+	var where []string
+	var args []any
+	if q.User != "" {
+		where = append(where, "user = ?")
+		args = append(args, q.User)
+	}
+	if q.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, q.Type)
+	}
+	if q.Verb != "" {
+		verb := strings.ToUpper(strings.Join(strings.Fields(q.Verb), " "))
+		if strings.HasPrefix(verb, "UID ") {
+			where = append(where, "verb = ?")
+			args = append(args, verb)
+		} else {
+			where = append(where, "verb IN (?, ?)")
+			args = append(args, verb, "UID "+verb)
+		}
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, q.Since.UnixNano())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, q.Until.UnixNano())
+	}
+
+	query := "SELECT time, type, user, client_ip, fields FROM events"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time, id"
+	if q.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("audit: query: %w", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var ev Event
+		var ts int64
+		var fields string
+		if err := rows.Scan(&ts, &ev.Type, &ev.User, &ev.ClientIP, &fields); err != nil {
+			return nil, fmt.Errorf("audit: query: %w", err)
+		}
+		ev.Time = time.Unix(0, ts)
+		if err := json.Unmarshal([]byte(fields), &ev.Fields); err != nil {
+			return nil, fmt.Errorf("audit: decode fields: %w", err)
+		}
+		if len(ev.Fields) == 0 {
+			ev.Fields = nil
+		}
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("audit: query: %w", err)
+	}
+	return events, nil
+}
+
+// Prune deletes events older than before and returns how many were removed.
+func (s *Store) Prune(before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM events WHERE time < ?", before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("audit: prune: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// PruneEvery deletes events older than retention every interval until stop
+// is closed, reporting failures to onErr.
+func (s *Store) PruneEvery(retention, interval time.Duration, stop <-chan struct{}, onErr func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := s.Prune(time.Now().Add(-retention)); err != nil && onErr != nil {
+			onErr(err)
+		}
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ParseTime parses a query bound: an RFC 3339 timestamp, a date
+// (YYYY-MM-DD, local time), or a duration that is subtracted from now. An
+// empty string yields the zero time, which does not filter.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time or duration", s)
+}
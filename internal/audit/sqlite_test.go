@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := OpenStore(filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.OnError = func(err error) { t.Errorf("record: %v", err) }
+	return s
+}
+
+func TestStoreQuery(t *testing.T) {
+	s := openTestStore(t)
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.Record(Event{Time: base, Type: LoginSuccess, User: "alice", ClientIP: "192.0.2.1", Fields: map[string]string{"country": "DE"}})
+	s.Record(Event{Time: base.Add(time.Minute), Type: FolderAccess, User: "alice", Fields: map[string]string{"verb": "SELECT", "folder": "INBOX"}})
+	s.Record(Event{Time: base.Add(2 * time.Minute), Type: CommandBlocked, User: "bob", Fields: map[string]string{"verb": "EXPUNGE"}})
+	s.Record(Event{Time: base.Add(3 * time.Minute), Type: LoginFailure, User: "alice"})
+	s.Record(Event{Time: base.Add(4 * time.Minute), Type: CommandBlocked, User: "carol", Fields: map[string]string{"verb": "UID STORE"}})
+	s.Flush()
+
+	tests := []struct {
+		name  string
+		q     Query
+		types []string
+	}{
+		{name: "all", q: Query{}, types: []string{LoginSuccess, FolderAccess, CommandBlocked, LoginFailure, CommandBlocked}},
+		{name: "user", q: Query{User: "bob"}, types: []string{CommandBlocked}},
+		{name: "type", q: Query{Type: LoginFailure}, types: []string{LoginFailure}},
+		{name: "verb case-insensitive", q: Query{Verb: "select"}, types: []string{FolderAccess}},
+		{name: "verb matches UID form", q: Query{Verb: "store"}, types: []string{CommandBlocked}},
+		{name: "UID verb", q: Query{Verb: "uid  expunge"}, types: nil},
+		{name: "since", q: Query{Since: base.Add(2 * time.Minute)}, types: []string{CommandBlocked, LoginFailure, CommandBlocked}},
+		{name: "until exclusive", q: Query{Until: base.Add(time.Minute)}, types: []string{LoginSuccess}},
+		{name: "limit", q: Query{User: "alice", Limit: 2}, types: []string{LoginSuccess, FolderAccess}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := s.Query(tt.q)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			var got []string
+			for _, ev := range events {
+				got = append(got, ev.Type)
+			}
+			if len(got) != len(tt.types) {
+				t.Fatalf("got %v, want %v", got, tt.types)
+			}
+			for i := range got {
+				if got[i] != tt.types[i] {
+					t.Fatalf("got %v, want %v", got, tt.types)
+				}
+			}
+		})
+	}
+
+	events, _ := s.Query(Query{Type: LoginSuccess})
+	ev := events[0]
+	if !ev.Time.Equal(base) || ev.ClientIP != "192.0.2.1" || ev.Fields["country"] != "DE" {
+		t.Errorf("round-tripped event = %+v", ev)
+	}
+}
+
+func TestStorePrune(t *testing.T) {
+	s := openTestStore(t)
+	now := time.Now()
+	s.Record(Event{Time: now.Add(-48 * time.Hour), Type: LoginSuccess, User: "old"})
+	s.Record(Event{Time: now, Type: LoginSuccess, User: "new"})
+	s.Flush()
+
+	n, err := s.Prune(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Prune removed %d events, want 1", n)
+	}
+	events, _ := s.Query(Query{})
+	if len(events) != 1 || events[0].User != "new" {
+		t.Fatalf("remaining events = %+v", events)
+	}
+}
+
+func TestStoreAsSink(t *testing.T) {
+	s := openTestStore(t)
+	r := New().With(s)
+	r.Record(Event{Type: AccountLocked, User: "alice"})
+	s.Flush()
+	events, err := s.Query(Query{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(events) != 1 || events[0].Time.IsZero() {
+		t.Fatalf("events = %+v, want one stamped event", events)
+	}
+}
+
+func TestStoreDropsWhenFull(t *testing.T) {
+	s := openTestStore(t)
+	var errs []error
+	s.OnError = func(err error) { errs = append(errs, err) }
+	// Holding the only database connection stalls the writer.
+	conn, err := s.db.Conn(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range storeQueue + 10 {
+		s.Record(Event{Type: LoginSuccess, User: "alice"})
+	}
+	conn.Close()
+	s.Flush()
+
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "events while the queue was full") {
+		t.Fatalf("errors = %v, want one report of dropped events", errs)
+	}
+	events, _ := s.Query(Query{})
+	if n := len(events); n < storeQueue || n > storeQueue+1 {
+		t.Errorf("stored %d events, want the %d queued and possibly one being written", n, storeQueue)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "", want: time.Time{}},
+		{in: "2024-05-01T08:00:00Z", want: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)},
+		{in: "2024-05-01", want: time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+		{in: "24h", want: now.Add(-24 * time.Hour)},
+		{in: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTime(tt.in, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTime(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseTime(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
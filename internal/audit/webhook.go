@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookTimeout bounds each webhook request.
+	webhookTimeout = 10 * time.Second
+	// webhookQueue is how many events may wait for delivery before new
+	// ones are dropped.
+	webhookQueue = 100
+)
+
+// WebhookSink POSTs events of selected types as JSON to a URL. Delivery
+// happens in the background, one event at a time, so a slow receiver never
+// delays the session that recorded the event.
+type WebhookSink struct {
+	url    string
+	types  []string
+	client *http.Client
+
+	// OnError is called when an event cannot be delivered or is dropped
+	// because the queue is full. It may be nil and must be set before the
+	// first event is recorded.
+	OnError func(error)
+
+	mu     sync.Mutex // guards closed and sends on queue
+	closed bool
+	queue  chan Event
+	wg     sync.WaitGroup
+}
+
+// NewWebhookSink returns a sink posting events of the given types to url.
+// Close stops it.
+func NewWebhookSink(url string, types ...string) *WebhookSink {
+	s := &WebhookSink{
+		url:    url,
+		types:  types,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan Event, webhookQueue),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Record implements Sink.
+func (s *WebhookSink) Record(ev Event) {
+	if !slices.Contains(s.types, ev.Type) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- ev:
+	default:
+		s.fail(fmt.Errorf("audit: webhook queue full, dropped %s event", ev.Type))
+	}
+}
+
+// Close delivers the queued events and stops the sink. Events recorded
+// after Close are discarded.
+func (s *WebhookSink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *WebhookSink) run() {
+	defer s.wg.Done()
+	for ev := range s.queue {
+		if err := s.post(ev); err != nil {
+			s.fail(err)
+		}
+	}
+}
+
+func (s *WebhookSink) post(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("audit: encode event: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("audit: webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("audit: webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit: webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *WebhookSink) fail(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
@@ -0,0 +1,145 @@
+// Package backup runs scheduled incremental exports of the configured
+// accounts, keeps the archives within their retention and checks them for
+// files that went missing or changed between runs.
+package backup
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/cron"
+	"imap-proxy/internal/export"
+	"imap-proxy/internal/imapclient"
+	"imap-proxy/internal/metrics"
+)
+
+var (
+	runsTotal = metrics.Default.NewCounter("imap_proxy_backup_runs_total",
+		"Scheduled account backups, by result.", "result")
+	messagesTotal = metrics.Default.NewCounter("imap_proxy_backup_messages_total",
+		"Messages archived by scheduled backups.")
+	prunedTotal = metrics.Default.NewCounter("imap_proxy_backup_pruned_total",
+		"Archived messages deleted by backup retention_days.")
+	integrityErrorsTotal = metrics.Default.NewCounter("imap_proxy_backup_integrity_errors_total",
+		"Archive files found missing or modified since the previous backup.")
+	lastSuccess = metrics.Default.NewGauge("imap_proxy_backup_last_success_timestamp_seconds",
+		"Unix time of the last backup run in which every account succeeded.")
+)
+
+// Backup runs the backups configured in server.backup.
+type Backup struct {
+	cfg      config.BackupConfig
+	schedule cron.Schedule
+	accounts []*config.AccountConfig
+	logger   *slog.Logger
+
+	// Upstream is passed on to the exporter.
+	Upstream imapclient.Upstream
+}
+
+// New returns the backup configured in cfg, which must have passed
+// config.Load validation.
+func New(cfg *config.Config, logger *slog.Logger) (*Backup, error) {
+	bc := cfg.Server.Backup
+	schedule, err := cron.Parse(bc.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{cfg: bc, schedule: schedule, logger: logger}
+	for i := range cfg.Accounts {
+		acct := &cfg.Accounts[i]
+		if !acct.Honeypot && (len(bc.Accounts) == 0 || slices.Contains(bc.Accounts, acct.LocalUser)) {
+			b.accounts = append(b.accounts, acct)
+		}
+	}
+	return b, nil
+}
+
+// Run backs up the accounts at each scheduled time until stop is closed.
+func (b *Backup) Run(stop <-chan struct{}) {
+	for {
+		next := b.schedule.Next(time.Now())
+		b.logger.Info("next backup scheduled", "at", next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		b.RunOnce(stop)
+	}
+}
+
+// RunOnce backs up every account once. It reports whether all succeeded.
+func (b *Backup) RunOnce(stop <-chan struct{}) bool {
+	ok := true
+	for _, acct := range b.accounts {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+		if err := b.backupAccount(acct, stop); err != nil {
+			b.logger.Error("backup failed", "user", acct.LocalUser, "err", err)
+			runsTotal.Inc("error")
+			ok = false
+			continue
+		}
+		runsTotal.Inc("ok")
+	}
+	if ok {
+		lastSuccess.Set(float64(time.Now().Unix()))
+	}
+	return ok
+}
+
+// backupAccount verifies the account's archive, exports what is new,
+// applies the retention and records the result for the next verification.
+func (b *Backup) backupAccount(acct *config.AccountConfig, stop <-chan struct{}) error {
+	e := &export.Exporter{
+		Account: acct, Folders: b.cfg.Folders, Dir: b.cfg.Dir, Format: b.cfg.Format,
+		Logger: b.logger, Upstream: b.Upstream,
+	}
+	dir := e.AccountDir()
+	logger := b.logger.With("user", acct.LocalUser)
+
+	m, err := loadManifest(dir)
+	if err != nil {
+		return err
+	}
+	problems, err := m.verify(dir)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		logger.Error("backup integrity check failed", "file", p.path, "problem", p.problem)
+	}
+	integrityErrorsTotal.Add(float64(len(problems)))
+
+	stats, exportErr := e.Run(stop)
+	messagesTotal.Add(float64(stats.Messages))
+	pruned := 0
+	if b.cfg.RetentionDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -b.cfg.RetentionDays)
+		pruned, err = export.Prune(dir, b.cfg.Format, cutoff)
+		prunedTotal.Add(float64(pruned))
+		if err != nil {
+			exportErr = errors.Join(exportErr, err)
+		}
+	}
+	// Record what the archive holds now, even after a failed export, so
+	// that the messages it did write are verified next time.
+	if err := recordManifest(dir); err != nil {
+		return errors.Join(exportErr, err)
+	}
+	if exportErr != nil {
+		return exportErr
+	}
+	logger.Info("backup finished", "folders", stats.Folders, "messages", stats.Messages,
+		"bytes", stats.Bytes, "pruned", pruned, "integrity_errors", len(problems))
+	return nil
+}
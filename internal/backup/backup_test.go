@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imaptest"
+)
+
+var testDate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestBackup(t *testing.T, bc config.BackupConfig, inbox ...imaptest.Message) (*Backup, *imaptest.Server) {
+	t.Helper()
+	up := imaptest.NewServerWith(map[string][]imaptest.Message{"INBOX": inbox})
+	t.Cleanup(up.Close)
+	bc.Dir = t.TempDir()
+	bc.Schedule = "@daily"
+	cfg := &config.Config{
+		Server:   config.ServerConfig{Backup: bc},
+		Accounts: []config.AccountConfig{up.Account("reader1", ""), up.Account("reader2", "")},
+	}
+	b, err := New(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Upstream.Dial = up.Dial
+	return b, up
+}
+
+func TestBackupIntegrity(t *testing.T) {
+	b, up := newTestBackup(t, config.BackupConfig{Format: "mbox", Accounts: []string{"reader2"}},
+		imaptest.Message{UID: 1, Date: testDate, Body: "Subject: a\r\n\r\n"})
+	if len(b.accounts) != 1 || b.accounts[0].LocalUser != "reader2" {
+		t.Fatalf("accounts = %v, want reader2 only", b.accounts)
+	}
+	if !b.RunOnce(nil) {
+		t.Fatal("first run failed")
+	}
+	dir := filepath.Join(b.cfg.Dir, "reader2")
+	m, err := loadManifest(dir)
+	if err != nil || len(m.Files) != 1 {
+		t.Fatalf("manifest = %+v, %v; want the mbox", m, err)
+	}
+
+	// Appending new messages to the mbox is not an integrity error.
+	if err := up.Add("INBOX", imaptest.Message{UID: 2, Date: testDate, Body: "Subject: b\r\n\r\n"}); err != nil {
+		t.Fatal(err)
+	}
+	before := integrityErrorsTotal.Value()
+	if !b.RunOnce(nil) {
+		t.Fatal("second run failed")
+	}
+	if got := integrityErrorsTotal.Value() - before; got != 0 {
+		t.Errorf("integrity errors after append = %v, want 0", got)
+	}
+
+	// Changing archived data is.
+	path := filepath.Join(dir, "INBOX.mbox")
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(data), "Subject: a", "Subject: x", 1)), 0o600)
+	b.RunOnce(nil)
+	if got := integrityErrorsTotal.Value() - before; got != 1 {
+		t.Errorf("integrity errors after modification = %v, want 1", got)
+	}
+}
+
+func TestBackupRetention(t *testing.T) {
+	b, _ := newTestBackup(t, config.BackupConfig{Format: "maildir"},
+		imaptest.Message{UID: 1, Date: testDate, Body: "Subject: a\r\n\r\n"},
+		imaptest.Message{UID: 2, Date: testDate, Body: "Subject: b\r\n\r\n"})
+	if !b.RunOnce(nil) {
+		t.Fatal("run failed")
+	}
+	cur := filepath.Join(b.cfg.Dir, "reader1", "INBOX", "cur")
+	if entries, _ := os.ReadDir(cur); len(entries) != 2 {
+		t.Fatalf("archived %d messages, want 2", len(entries))
+	}
+
+	// The messages date from 2020, so any retention removes them, and
+	// the manifest follows without reporting them as missing.
+	b.cfg.RetentionDays = 30
+	before := integrityErrorsTotal.Value()
+	if !b.RunOnce(nil) {
+		t.Fatal("run with retention failed")
+	}
+	if entries, _ := os.ReadDir(cur); len(entries) != 0 {
+		t.Errorf("%d messages left after retention, want 0", len(entries))
+	}
+	b.RunOnce(nil)
+	if got := integrityErrorsTotal.Value() - before; got != 0 {
+		t.Errorf("integrity errors = %v, want 0", got)
+	}
+	if lastSuccess.Value() < float64(time.Now().Add(-time.Minute).Unix()) {
+		t.Errorf("last success = %v, want now", lastSuccess.Value())
+	}
+}
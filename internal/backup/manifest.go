@@ -0,0 +1,134 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// manifestName is the file in an account directory recording the archive
+// files and their checksums after each backup.
+const manifestName = ".backup-manifest.json"
+
+// fileSum is the recorded size and SHA-256 of an archive file.
+type fileSum struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifest maps archive files, relative to the account directory and with
+// forward slashes, to their checksums.
+type manifest struct {
+	Files map[string]fileSum `json:"files"`
+}
+
+// problem is an archive file that failed verification.
+type problem struct {
+	path    string
+	problem string
+}
+
+func loadManifest(dir string) (*manifest, error) {
+	m := &manifest{Files: map[string]fileSum{}}
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", manifestName, err)
+	}
+	return m, nil
+}
+
+// verify checks the recorded files. Exports only add files and append to
+// mbox files, so a file must still start with the recorded content.
+func (m *manifest) verify(dir string) ([]problem, error) {
+	var problems []problem
+	for _, rel := range slices.Sorted(maps.Keys(m.Files)) {
+		want := m.Files[rel]
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, problem{rel, "missing"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sum, n, err := checksum(io.LimitReader(f, want.Size))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case n < want.Size:
+			problems = append(problems, problem{rel, "truncated"})
+		case sum != want.SHA256:
+			problems = append(problems, problem{rel, "modified"})
+		}
+	}
+	return problems, nil
+}
+
+// recordManifest writes the manifest for the files now in dir.
+func recordManifest(dir string) error {
+	m := &manifest{Files: map[string]fileSum{}}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			// Maildir tmp directories only hold files being written.
+			if d.Name() == "tmp" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Skip the export state and this manifest.
+		if !strings.Contains(rel, "/") && strings.HasPrefix(rel, ".") {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sum, n, err := checksum(f)
+		if err != nil {
+			return err
+		}
+		m.Files[rel] = fileSum{Size: n, SHA256: sum}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, manifestName)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func checksum(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	return hex.EncodeToString(h.Sum(nil)), n, err
+}
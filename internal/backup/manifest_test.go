@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestVerify(t *testing.T) {
+	dir := t.TempDir()
+	write := func(rel, content string) {
+		t.Helper()
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("INBOX/cur/1.1_1:2,S", "one")
+	write("INBOX/cur/1.1_2:2,S", "two")
+	write("INBOX/cur/1.1_3:2,S", "three")
+	write("INBOX/cur/1.1_4:2,S", "four")
+	write("INBOX/tmp/partial", "x")
+	write("Sent.mbox", "From a\n")
+	write(".export-maildir.json", "{}")
+	if err := recordManifest(dir); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 5 {
+		t.Errorf("manifest has %d files, want the 4 messages and the mbox: %v", len(m.Files), m.Files)
+	}
+
+	os.Remove(filepath.Join(dir, "INBOX/cur/1.1_1:2,S"))
+	write("INBOX/cur/1.1_2:2,S", "tw")
+	write("INBOX/cur/1.1_3:2,S", "thre3")
+	write("INBOX/cur/1.1_4:2,S", "four, longer")
+	write("Sent.mbox", "From a\nFrom b\n")
+	problems, err := m.verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []problem{
+		{"INBOX/cur/1.1_1:2,S", "missing"},
+		{"INBOX/cur/1.1_2:2,S", "truncated"},
+		{"INBOX/cur/1.1_3:2,S", "modified"},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("problems = %v, want %v", problems, want)
+	}
+}
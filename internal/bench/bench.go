@@ -0,0 +1,333 @@
+// Package bench generates IMAP load: synthetic clients repeat a workload
+// of LOGIN, SELECT, FETCH and IDLE against a server and the latency of
+// each operation is collected for a report.
+package bench
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/imap"
+)
+
+// Operations of a workload.
+const (
+	// OpLogin connects, reads the greeting and logs in; its latency
+	// covers all three. A workload with it logs out and reconnects on
+	// every iteration, one without it keeps its session.
+	OpLogin  = "login"
+	OpSelect = "select"
+	OpFetch  = "fetch"
+	// OpIdle starts IDLE, waits IdleTime and sends DONE. Its latency is
+	// the time to the continuation response.
+	OpIdle = "idle"
+)
+
+// DefaultWorkload is used when Bench.Workload is empty.
+var DefaultWorkload = []string{OpLogin, OpSelect, OpFetch}
+
+const (
+	defaultFolder  = "INBOX"
+	defaultFetch   = "1:* (UID FLAGS RFC822.SIZE)"
+	defaultTimeout = 30 * time.Second
+	// errorBackoff delays a client after a failed operation so a broken
+	// server is not hammered.
+	errorBackoff = 100 * time.Millisecond
+)
+
+// Bench runs Clients concurrent clients against Addr.
+type Bench struct {
+	Addr               string
+	TLS                bool // implicit TLS
+	InsecureSkipVerify bool
+	User, Password     string
+
+	Clients  int
+	Workload []string      // operations per iteration (default DefaultWorkload)
+	Folder   string        // folder to SELECT (default INBOX)
+	Fetch    string        // FETCH arguments (default "1:* (UID FLAGS RFC822.SIZE)")
+	IdleTime time.Duration // how long each IDLE lasts
+	Timeout  time.Duration // bound on each response (default 30s)
+
+	// Dial connects to the server; it defaults to a TCP or TLS dial of Addr.
+	Dial func() (net.Conn, error)
+}
+
+// Validate checks the workload.
+func (b *Bench) Validate() error {
+	if b.Clients < 1 {
+		return errors.New("bench: clients must be at least 1")
+	}
+	for _, op := range b.Workload {
+		switch op {
+		case OpLogin, OpSelect, OpFetch, OpIdle:
+		default:
+			return fmt.Errorf("bench: unknown operation %q", op)
+		}
+	}
+	if b.User == "" {
+		return errors.New("bench: a user name is required")
+	}
+	return nil
+}
+
+// Run starts the clients and stops them when stop is closed, then
+// returns the report. Operations in flight at that moment are not
+// counted.
+func (b *Bench) Run(stop <-chan struct{}) *Report {
+	rec := &recorder{ops: map[string]*opStats{}}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range max(b.Clients, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			(&client{b: b, rec: rec, stop: stop}).run()
+		}()
+	}
+	wg.Wait()
+	return rec.report(time.Since(start))
+}
+
+func (b *Bench) workload() []string {
+	if len(b.Workload) == 0 {
+		return DefaultWorkload
+	}
+	return b.Workload
+}
+
+func (b *Bench) dial() (net.Conn, error) {
+	if b.Dial != nil {
+		return b.Dial()
+	}
+	d := &net.Dialer{Timeout: b.timeout()}
+	if !b.TLS {
+		return d.Dial("tcp", b.Addr)
+	}
+	host, _, _ := net.SplitHostPort(b.Addr)
+	return tls.DialWithDialer(d, "tcp", b.Addr, &tls.Config{ServerName: host, InsecureSkipVerify: b.InsecureSkipVerify})
+}
+
+func (b *Bench) timeout() time.Duration {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return defaultTimeout
+}
+
+// client is one synthetic client.
+type client struct {
+	b    *Bench
+	rec  *recorder
+	stop <-chan struct{}
+
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+func (c *client) run() {
+	defer c.close()
+	ops := c.b.workload()
+	relogin := slices.Contains(ops, OpLogin)
+	for {
+		for _, op := range ops {
+			if c.stopped() {
+				return
+			}
+			if c.conn == nil && op != OpLogin {
+				// Without OpLogin in the workload, log in once per session.
+				latency, err := c.do(OpLogin)
+				if err != nil {
+					c.failed(OpLogin, err)
+					break
+				}
+				c.rec.add(OpLogin, latency)
+			}
+			latency, err := c.do(op)
+			if c.stopped() {
+				return
+			}
+			if err != nil {
+				c.failed(op, err)
+				break
+			}
+			c.rec.add(op, latency)
+		}
+		if relogin && c.conn != nil {
+			c.logout()
+		}
+	}
+}
+
+func (c *client) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// failed counts an error, drops the connection and backs off.
+func (c *client) failed(op string, err error) {
+	if c.stopped() {
+		return
+	}
+	c.rec.fail(op, err)
+	c.close()
+	select {
+	case <-c.stop:
+	case <-time.After(errorBackoff):
+	}
+}
+
+func (c *client) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// do runs op and returns its latency.
+func (c *client) do(op string) (time.Duration, error) {
+	start := time.Now()
+	var err error
+	switch op {
+	case OpLogin:
+		c.close()
+		err = c.login()
+	case OpSelect:
+		err = c.command("SELECT " + imap.Quote(c.folder()))
+	case OpFetch:
+		fetch := c.b.Fetch
+		if fetch == "" {
+			fetch = defaultFetch
+		}
+		err = c.command("FETCH " + fetch)
+	case OpIdle:
+		return c.idle()
+	default:
+		err = fmt.Errorf("unknown operation %q", op)
+	}
+	return time.Since(start), err
+}
+
+func (c *client) folder() string {
+	if c.b.Folder != "" {
+		return c.b.Folder
+	}
+	return defaultFolder
+}
+
+func (c *client) login() error {
+	conn, err := c.b.dial()
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(c.b.timeout()))
+	greeting, err := c.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return fmt.Errorf("greeting: %s", strings.TrimSpace(greeting))
+	}
+	return c.command("LOGIN " + imap.Quote(c.b.User) + " " + imap.Quote(c.b.Password))
+}
+
+func (c *client) logout() {
+	c.command("LOGOUT")
+	c.close()
+}
+
+// command sends cmd and waits for an OK tagged response.
+func (c *client) command(cmd string) error {
+	tag := c.nextTag()
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, cmd); err != nil {
+		return err
+	}
+	return c.waitTagged(tag)
+}
+
+// idle runs IDLE for IdleTime and returns the time to the continuation.
+func (c *client) idle() (time.Duration, error) {
+	start := time.Now()
+	tag := c.nextTag()
+	if _, err := fmt.Fprintf(c.conn, "%s IDLE\r\n", tag); err != nil {
+		return 0, err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return 0, err
+		}
+		if strings.HasPrefix(line, "+") {
+			break
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return 0, fmt.Errorf("IDLE: %s", line)
+		}
+	}
+	latency := time.Since(start)
+	select {
+	case <-c.stop:
+	case <-time.After(c.b.IdleTime):
+	}
+	if _, err := fmt.Fprint(c.conn, "DONE\r\n"); err != nil {
+		return 0, err
+	}
+	return latency, c.waitTagged(tag)
+}
+
+// waitTagged reads responses, skipping literals, until the one tagged
+// with tag, and returns an error unless it is OK.
+func (c *client) waitTagged(tag string) error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if rest, ok := strings.CutPrefix(line, tag+" "); ok {
+			if !strings.HasPrefix(rest, "OK") {
+				return errors.New(rest)
+			}
+			return nil
+		}
+	}
+}
+
+// readLine reads one response line without CRLF, discarding the data of
+// any literals it announces.
+func (c *client) readLine() (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.b.timeout()))
+	var b strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		b.WriteString(line)
+		n, _, ok := imap.ParseLiteral([]byte(line))
+		if !ok {
+			return b.String(), nil
+		}
+		if _, err := c.r.Discard(int(n)); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (c *client) nextTag() string {
+	c.seq++
+	return fmt.Sprintf("b%d", c.seq)
+}
@@ -0,0 +1,103 @@
+package bench
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/imaptest"
+)
+
+// runFor runs b for d and returns the report.
+func runFor(b *Bench, d time.Duration) *Report {
+	stop := make(chan struct{})
+	time.AfterFunc(d, func() { close(stop) })
+	return b.Run(stop)
+}
+
+func opReport(r *Report, op string) OpReport {
+	for _, o := range r.Ops {
+		if o.Op == op {
+			return o
+		}
+	}
+	return OpReport{}
+}
+
+func TestBench(t *testing.T) {
+	s := imaptest.NewServer()
+	defer s.Close()
+	b := &Bench{
+		Addr: s.Addr, User: imaptest.User, Password: imaptest.Password, Clients: 3,
+		Workload: []string{OpLogin, OpSelect, OpFetch, OpIdle}, IdleTime: 10 * time.Millisecond,
+		Timeout: 5 * time.Second,
+	}
+	if err := b.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	r := runFor(b, 300*time.Millisecond)
+	for _, op := range b.Workload {
+		o := opReport(r, op)
+		if o.Count == 0 || o.Errors != 0 {
+			t.Errorf("%s: count %d, errors %d %q", op, o.Count, o.Errors, o.ErrorSamples)
+		}
+		if o.P50 > o.P99 || o.P99 > o.Max || o.Rate <= 0 {
+			t.Errorf("%s: inconsistent stats %+v", op, o)
+		}
+	}
+	// IDLE latency is the time to the continuation, not the idle time.
+	if o := opReport(r, OpIdle); o.P50 >= b.IdleTime {
+		t.Errorf("idle p50 %v includes the idle time", o.P50)
+	}
+}
+
+func TestBenchPersistentSession(t *testing.T) {
+	s := imaptest.NewServer()
+	defer s.Close()
+	b := &Bench{Addr: s.Addr, User: imaptest.User, Password: imaptest.Password, Clients: 1, Workload: []string{OpSelect, OpFetch}}
+	r := runFor(b, 100*time.Millisecond)
+	if o := opReport(r, OpLogin); o.Count != 1 {
+		t.Errorf("%d logins, want 1 for a workload without login", o.Count)
+	}
+	if o := opReport(r, OpFetch); o.Count < 2 || o.Errors != 0 {
+		t.Errorf("fetch %+v, want repeated fetches on one session", o)
+	}
+}
+
+func TestBenchErrors(t *testing.T) {
+	s := imaptest.NewServer()
+	defer s.Close()
+	b := &Bench{Addr: s.Addr, User: imaptest.User, Password: "wrong", Clients: 2}
+	r := runFor(b, 150*time.Millisecond)
+	o := opReport(r, OpLogin)
+	if o.Count != 0 || o.Errors == 0 {
+		t.Fatalf("login: count %d, errors %d", o.Count, o.Errors)
+	}
+	if len(o.ErrorSamples) != 1 || !strings.Contains(o.ErrorSamples[0], "AUTHENTICATIONFAILED") {
+		t.Errorf("error samples %q", o.ErrorSamples)
+	}
+}
+
+func TestBenchValidate(t *testing.T) {
+	tests := []struct {
+		b    Bench
+		want string
+	}{
+		{Bench{User: "u", Clients: 1}, ""},
+		{Bench{User: "u"}, "clients must be at least 1"},
+		{Bench{Clients: 1}, "user name is required"},
+		{Bench{User: "u", Clients: 1, Workload: []string{"search"}}, `unknown operation "search"`},
+	}
+	for _, tt := range tests {
+		err := tt.b.Validate()
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("Validate(%+v) = %v", tt.b, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Validate(%+v) = %v, want %q", tt.b, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxErrorSamples caps the distinct error messages kept per operation.
+const maxErrorSamples = 5
+
+// Report summarizes a run.
+type Report struct {
+	Duration time.Duration
+	Ops      []OpReport // in workload order of first completion
+}
+
+// OpReport summarizes one operation.
+type OpReport struct {
+	Op     string
+	Count  int     // successful operations
+	Errors int     // failed operations
+	Rate   float64 // successful operations per second
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+	// ErrorSamples holds the first distinct error messages.
+	ErrorSamples []string
+}
+
+// Write prints the report as a table.
+func (r *Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "%-8s %8s %7s %9s %9s %9s %9s %9s\n", "op", "count", "errors", "ops/s", "p50", "p90", "p99", "max")
+	for _, op := range r.Ops {
+		fmt.Fprintf(w, "%-8s %8d %7d %9.1f %9s %9s %9s %9s\n", op.Op, op.Count, op.Errors, op.Rate,
+			round(op.P50), round(op.P90), round(op.P99), round(op.Max))
+	}
+	for _, op := range r.Ops {
+		for _, msg := range op.ErrorSamples {
+			fmt.Fprintf(w, "%s error: %s\n", op.Op, msg)
+		}
+	}
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
+
+// recorder collects latencies from all clients.
+type recorder struct {
+	mu    sync.Mutex
+	order []string
+	ops   map[string]*opStats
+}
+
+type opStats struct {
+	latencies []time.Duration
+	errors    int
+	samples   []string
+}
+
+func (r *recorder) stats(op string) *opStats {
+	s := r.ops[op]
+	if s == nil {
+		s = &opStats{}
+		r.ops[op] = s
+		r.order = append(r.order, op)
+	}
+	return s
+}
+
+func (r *recorder) add(op string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats(op)
+	s.latencies = append(s.latencies, d)
+}
+
+func (r *recorder) fail(op string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats(op)
+	s.errors++
+	if msg := err.Error(); len(s.samples) < maxErrorSamples && !slices.Contains(s.samples, msg) {
+		s.samples = append(s.samples, msg)
+	}
+}
+
+func (r *recorder) report(elapsed time.Duration) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rep := &Report{Duration: elapsed}
+	for _, op := range r.order {
+		s := r.ops[op]
+		slices.Sort(s.latencies)
+		o := OpReport{
+			Op:           op,
+			Count:        len(s.latencies),
+			Errors:       s.errors,
+			P50:          percentile(s.latencies, 50),
+			P90:          percentile(s.latencies, 90),
+			P99:          percentile(s.latencies, 99),
+			ErrorSamples: s.samples,
+		}
+		if n := len(s.latencies); n > 0 {
+			o.Max = s.latencies[n-1]
+		}
+		if elapsed > 0 {
+			o.Rate = float64(o.Count) / elapsed.Seconds()
+		}
+		rep.Ops = append(rep.Ops, o)
+	}
+	return rep
+}
+
+// percentile returns the p-th percentile of sorted by the nearest-rank
+// method, or 0 for no samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	return sorted[max(rank, 1)-1]
+}
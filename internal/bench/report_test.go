@@ -0,0 +1,65 @@
+package bench
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		in   []time.Duration
+		p    int
+		want time.Duration
+	}{
+		{nil, 50, 0},
+		{sorted[:1], 99, time.Millisecond},
+		{sorted, 50, 50 * time.Millisecond},
+		{sorted, 90, 90 * time.Millisecond},
+		{sorted, 99, 99 * time.Millisecond},
+		{sorted[:10], 99, 10 * time.Millisecond},
+		{sorted[:10], 50, 5 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := percentile(tt.in, tt.p); got != tt.want {
+			t.Errorf("percentile(%d samples, %d) = %v, want %v", len(tt.in), tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	rec := &recorder{ops: map[string]*opStats{}}
+	for _, ms := range []int{30, 10, 20} {
+		rec.add(OpFetch, time.Duration(ms)*time.Millisecond)
+	}
+	rec.add(OpLogin, time.Millisecond)
+	for range 10 {
+		rec.fail(OpLogin, errors.New("NO busy"))
+	}
+	r := rec.report(2 * time.Second)
+	if len(r.Ops) != 2 || r.Ops[0].Op != OpFetch {
+		t.Fatalf("ops %+v, want fetch first", r.Ops)
+	}
+	f := r.Ops[0]
+	if f.Count != 3 || f.Rate != 1.5 || f.P50 != 20*time.Millisecond || f.Max != 30*time.Millisecond {
+		t.Errorf("fetch %+v", f)
+	}
+	if l := r.Ops[1]; l.Errors != 10 || len(l.ErrorSamples) != 1 {
+		t.Errorf("login %+v, want 10 errors with one sample", l)
+	}
+
+	var out strings.Builder
+	r.Write(&out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "fetch") || lines[3] != "login error: NO busy" {
+		t.Errorf("report:\n%s", out.String())
+	}
+	if !strings.Contains(lines[1], "20ms") {
+		t.Errorf("fetch line %q lacks p50", lines[1])
+	}
+}
@@ -0,0 +1,48 @@
+// Package buildinfo exposes the version and commit the binary was built from.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version and Commit are set at build time via
+//
+//	-ldflags "-X imap-proxy/internal/buildinfo.Version=... -X imap-proxy/internal/buildinfo.Commit=..."
+//
+// When unset, Commit falls back to the VCS revision recorded by the Go toolchain.
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// GoVersion returns the Go toolchain version the binary was built with.
+func GoVersion() string {
+	return runtime.Version()
+}
+
+// CommitHash returns the build commit, falling back to the embedded VCS
+// revision (shortened to 12 characters) or "unknown".
+func CommitHash() string {
+	if Commit != "" {
+		return Commit
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" && s.Value != "" {
+				if len(s.Value) > 12 {
+					return s.Value[:12]
+				}
+				return s.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// String returns a human-readable build description, e.g.
+// "imap-proxy 1.2.0 (commit abc123, go1.25.0)".
+func String() string {
+	return fmt.Sprintf("imap-proxy %s (commit %s, %s)", Version, CommitHash(), GoVersion())
+}
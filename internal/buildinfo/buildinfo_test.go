@@ -0,0 +1,30 @@
+package buildinfo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommitHashOverride(t *testing.T) {
+	old := Commit
+	defer func() { Commit = old }()
+
+	Commit = "abc123"
+	if got := CommitHash(); got != "abc123" {
+		t.Errorf("CommitHash() = %q, want %q", got, "abc123")
+	}
+}
+
+func TestString(t *testing.T) {
+	oldV, oldC := Version, Commit
+	defer func() { Version, Commit = oldV, oldC }()
+
+	Version = "1.2.3"
+	Commit = "deadbeef"
+	got := String()
+	for _, want := range []string{"imap-proxy 1.2.3", "commit deadbeef", GoVersion()} {
+		if !strings.Contains(got, want) {
+			t.Errorf("String() = %q, missing %q", got, want)
+		}
+	}
+}
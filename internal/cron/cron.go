@@ -0,0 +1,153 @@
+// Package cron parses five-field cron schedules.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron specification. Each field is a bit set of the
+// values it matches.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set when the day of month or day of week is
+	// "*". When both are restricted, a day matching either one matches.
+	domAny, dowAny bool
+}
+
+// shortcuts are the predefined schedules.
+var shortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// Parse parses a schedule of the form "minute hour day-of-month month
+// day-of-week". Fields accept *, numbers, ranges (1-5), lists (1,15) and
+// steps (*/15, 8-18/2); Sunday is 0 or 7. The shortcuts @hourly, @daily,
+// @weekly, @monthly and @yearly are accepted too.
+func Parse(spec string) (Schedule, error) {
+	if s, ok := shortcuts[strings.ToLower(strings.TrimSpace(spec))]; ok {
+		spec = s
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return Schedule{}, fmt.Errorf("cron: %q: want 5 fields, got %d", spec, len(fields))
+	}
+	var s Schedule
+	var err error
+	bounds := []struct {
+		dst      *uint64
+		lo, hi   int
+		name     string
+		wildcard *bool
+	}{
+		{&s.minute, 0, 59, "minute", nil},
+		{&s.hour, 0, 23, "hour", nil},
+		{&s.dom, 1, 31, "day of month", &s.domAny},
+		{&s.month, 1, 12, "month", nil},
+		{&s.dow, 0, 7, "day of week", &s.dowAny},
+	}
+	for i, b := range bounds {
+		if *b.dst, err = parseField(fields[i], b.lo, b.hi); err != nil {
+			return Schedule{}, fmt.Errorf("cron: %q: %s: %w", spec, b.name, err)
+		}
+		if b.wildcard != nil {
+			*b.wildcard = fields[i] == "*" || strings.HasPrefix(fields[i], "*/")
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	if s.Next(time.Now()).IsZero() {
+		return Schedule{}, fmt.Errorf("cron: %q never matches", spec)
+	}
+	return s, nil
+}
+
+// parseField parses one comma-separated field into a bit set.
+func parseField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+			step = n
+		}
+		start, end := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = parseValue(a, lo, hi); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = parseValue(b, lo, hi); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = hi
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := start; v <= end; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func parseValue(s string, lo, hi int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if n < lo || n > hi {
+		return 0, fmt.Errorf("value %d out of range %d-%d", n, lo, hi)
+	}
+	return n, nil
+}
+
+// Next returns the first time after t that matches the schedule, in t's
+// location, or the zero time if none does within five years.
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,60 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"0 0 30 2 *",
+		"@sometimes",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Monday 2024-01-15 10:07.
+	from := time.Date(2024, 1, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"* * * * *", "2024-01-15 10:08"},
+		{"*/15 * * * *", "2024-01-15 10:15"},
+		{"0 3 * * *", "2024-01-16 03:00"},
+		{"@daily", "2024-01-16 00:00"},
+		{"@hourly", "2024-01-15 11:00"},
+		{"30 2 * * 0", "2024-01-21 02:30"},
+		{"30 2 * * 7", "2024-01-21 02:30"},
+		{"0 9 1 * *", "2024-02-01 09:00"},
+		{"0 8-18/2 * * 1-5", "2024-01-15 12:00"},
+		{"0 0 1,15 * 3", "2024-01-17 00:00"}, // either day field matches
+		{"0 0 29 2 *", "2024-02-29 00:00"},
+		{"5,10 10 15 1 *", "2024-01-15 10:10"},
+		{"0 0 1 1 *", "2025-01-01 00:00"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(from).Format("2006-01-02 15:04"); got != tt.want {
+			t.Errorf("Next(%q) = %s, want %s", tt.spec, got, tt.want)
+		}
+	}
+}
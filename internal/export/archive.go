@@ -0,0 +1,253 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// message is one exported message.
+type message struct {
+	uid         uint32
+	uidValidity uint32
+	flags       []string
+	date        time.Time // INTERNALDATE, zero if unknown
+	body        []byte
+}
+
+// archive receives the messages of one folder.
+type archive interface {
+	write(m message) error
+	close() error
+}
+
+func openArchive(format, path string) (archive, error) {
+	if format == FormatMbox {
+		return openMbox(path + ".mbox")
+	}
+	return openMaildir(path)
+}
+
+// folderPath returns where folder f is archived in dir: one directory level
+// per hierarchy level of its name.
+func folderPath(dir string, f folder) string {
+	parts := []string{f.name}
+	if f.delim != "" {
+		parts = strings.Split(f.name, f.delim)
+	}
+	elems := []string{dir}
+	for _, p := range parts {
+		elems = append(elems, safeName(p))
+	}
+	return filepath.Join(elems...)
+}
+
+// safeName makes a folder or user name usable as a single path element
+// that cannot be mistaken for a maildir subdirectory or an export file.
+func safeName(name string) string {
+	name = strings.NewReplacer("/", "_", `\`, "_", "\x00", "_").Replace(name)
+	switch {
+	case name == "", strings.HasPrefix(name, "."),
+		name == "cur", name == "new", name == "tmp":
+		name = "_" + name
+	}
+	return name
+}
+
+// maildir writes messages into a maildir, each through tmp into cur.
+type maildir struct {
+	dir string
+}
+
+func openMaildir(dir string) (*maildir, error) {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &maildir{dir: dir}, nil
+}
+
+// maildirFlags maps system flags to maildir info letters, in the
+// alphabetical order maildir requires.
+var maildirFlags = []struct {
+	flag   string
+	letter byte
+}{
+	{`\Draft`, 'D'},
+	{`\Flagged`, 'F'},
+	{`\Answered`, 'R'},
+	{`\Seen`, 'S'},
+	{`\Deleted`, 'T'},
+}
+
+func (m *maildir) write(msg message) error {
+	date := msg.date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	var info []byte
+	for _, f := range maildirFlags {
+		if slices.ContainsFunc(msg.flags, func(s string) bool { return strings.EqualFold(s, f.flag) }) {
+			info = append(info, f.letter)
+		}
+	}
+	// The UIDVALIDITY and UID make the name unique and stable across runs.
+	name := fmt.Sprintf("%d.%d_%d.imap-proxy:2,%s", date.Unix(), msg.uidValidity, msg.uid, info)
+	tmp := filepath.Join(m.dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg.body, 0o600); err != nil {
+		return err
+	}
+	os.Chtimes(tmp, date, date)
+	return os.Rename(tmp, filepath.Join(m.dir, "cur", name))
+}
+
+func (m *maildir) close() error { return nil }
+
+// mbox appends messages to an mboxrd file.
+type mbox struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func openMbox(path string) (*mbox, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &mbox{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// write appends the message with a From_ line, LF line endings and
+// mboxrd quoting of body lines starting with ">*From ".
+func (m *mbox) write(msg message) error {
+	date := msg.date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	fmt.Fprintf(m.w, "From MAILER-DAEMON %s\n", date.UTC().Format(time.ANSIC))
+	body := bytes.ReplaceAll(msg.body, []byte("\r\n"), []byte("\n"))
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line = body[:i+1]
+		}
+		body = body[len(line):]
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			m.w.WriteByte('>')
+		}
+		m.w.Write(line)
+		if line[len(line)-1] != '\n' {
+			m.w.WriteByte('\n')
+		}
+	}
+	m.w.WriteByte('\n')
+	// Flush per message so a checkpoint never covers unwritten data.
+	return m.w.Flush()
+}
+
+func (m *mbox) close() error {
+	err := m.w.Flush()
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Prune deletes the messages in an account directory written by an export
+// in format whose date is before cutoff, and returns how many it deleted.
+// Checkpoints are kept, so pruned messages are not exported again.
+func Prune(dir, format string, cutoff time.Time) (int, error) {
+	pruned := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		var n int
+		switch {
+		case format == FormatMaildir && filepath.Base(filepath.Dir(path)) == "cur":
+			n, err = pruneMaildirFile(path, cutoff)
+		case format == FormatMbox && strings.HasSuffix(path, ".mbox"):
+			n, err = pruneMbox(path, cutoff)
+		}
+		pruned += n
+		return err
+	})
+	return pruned, err
+}
+
+// pruneMaildirFile deletes a maildir message whose name starts with a Unix
+// time before cutoff.
+func pruneMaildirFile(path string, cutoff time.Time) (int, error) {
+	stamp, _, _ := strings.Cut(filepath.Base(path), ".")
+	sec, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil || !time.Unix(sec, 0).Before(cutoff) {
+		return 0, nil
+	}
+	return 1, os.Remove(path)
+}
+
+// pruneMbox rewrites an mbox without the messages whose From_ line date is
+// before cutoff.
+func pruneMbox(path string, cutoff time.Time) (pruned int, err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		out.Close()
+		if err != nil || pruned == 0 {
+			os.Remove(tmp)
+		}
+	}()
+
+	r, w := bufio.NewReader(in), bufio.NewWriter(out)
+	keep := true
+	for {
+		line, rerr := r.ReadBytes('\n')
+		if sender, ok := bytes.CutPrefix(line, []byte("From ")); ok {
+			_, date, _ := bytes.Cut(bytes.TrimRight(sender, "\n"), []byte(" "))
+			t, perr := time.Parse(time.ANSIC, string(date))
+			keep = perr != nil || !t.Before(cutoff)
+			if !keep {
+				pruned++
+			}
+		}
+		if keep {
+			w.Write(line)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return 0, rerr
+		}
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	return pruned, os.Rename(tmp, path)
+}
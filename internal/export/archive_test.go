@@ -0,0 +1,103 @@
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "INBOX.mbox")
+	date := time.Date(2024, 1, 2, 15, 4, 5, 0, time.FixedZone("", 3600))
+	for _, body := range []string{"Subject: a\r\n\r\nFrom here\r\n>From there\r\nend", "Subject: b\r\n\r\nx\r\n"} {
+		a, err := openArchive(FormatMbox, filepath.Join(filepath.Dir(path), "INBOX"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.write(message{uid: 1, date: date, body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "From MAILER-DAEMON Tue Jan  2 14:04:05 2024\nSubject: a\n\n>From here\n>>From there\nend\n\n" +
+		"From MAILER-DAEMON Tue Jan  2 14:04:05 2024\nSubject: b\n\nx\n\n"
+	if string(data) != want {
+		t.Errorf("mbox = %q, want %q", data, want)
+	}
+}
+
+func TestFolderPath(t *testing.T) {
+	tests := []struct {
+		name, delim string
+		want        string
+	}{
+		{"INBOX", "/", "d/INBOX"},
+		{"Work/Sub", "/", "d/Work/Sub"},
+		{"Work.Sub", ".", "d/Work/Sub"},
+		{"a/b", "", "d/a_b"},
+		{"../x", "/", "d/_../x"},
+		{"Work//x", "/", "d/Work/_/x"},
+		{".export-maildir.json", "/", "d/_.export-maildir.json"},
+	}
+	for _, tt := range tests {
+		got := folderPath("d", folder{name: tt.name, delim: tt.delim})
+		if got != filepath.FromSlash(tt.want) {
+			t.Errorf("folderPath(%q, %q) = %q, want %q", tt.name, tt.delim, got, tt.want)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	md, err := openMaildir(filepath.Join(dir, "INBOX"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb, err := openMbox(filepath.Join(dir, "INBOX.mbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, date := range []time.Time{old, recent, old} {
+		m := message{uid: uint32(i + 1), date: date, body: []byte("Subject: x\r\n\r\nFrom me\r\n")}
+		if err := md.write(m); err != nil {
+			t.Fatal(err)
+		}
+		if err := mb.write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mb.close()
+
+	n, err := Prune(dir, FormatMaildir, cutoff)
+	if err != nil || n != 2 {
+		t.Fatalf("Prune maildir = %d, %v; want 2", n, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "INBOX", "cur"))
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "1717200000.") {
+		t.Errorf("maildir after prune = %v", entries)
+	}
+
+	n, err = Prune(dir, FormatMbox, cutoff)
+	if err != nil || n != 2 {
+		t.Fatalf("Prune mbox = %d, %v; want 2", n, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "INBOX.mbox"))
+	if want := "From MAILER-DAEMON Sat Jun  1 00:00:00 2024\nSubject: x\n\n>From me\n\n"; string(data) != want {
+		t.Errorf("mbox after prune = %q, want %q", data, want)
+	}
+	if n, err := Prune(dir, FormatMbox, cutoff); n != 0 || err != nil {
+		t.Errorf("second Prune = %d, %v; want nothing", n, err)
+	}
+}
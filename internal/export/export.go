@@ -0,0 +1,344 @@
+// Package export copies upstream folders to local maildir or mbox archives
+// without a client connection, resuming from the last exported UID of each
+// folder.
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/imapclient"
+	"imap-proxy/internal/proxy"
+)
+
+// Archive formats.
+const (
+	FormatMaildir = "maildir"
+	FormatMbox    = "mbox"
+)
+
+const (
+	// commandTimeout bounds the response to each upstream command.
+	commandTimeout = 2 * time.Minute
+	// fetchBatch is the number of messages fetched per UID FETCH; the
+	// checkpoint is saved after each batch.
+	fetchBatch = 100
+)
+
+// Stats summarizes an export.
+type Stats struct {
+	Folders  int
+	Messages int
+	Bytes    int64
+}
+
+// Exporter copies the folders of one account into Dir/<local_user>.
+type Exporter struct {
+	Account *config.AccountConfig
+	// Folders to export; empty means every selectable folder the account
+	// may see. Virtual folders may be named too.
+	Folders []string
+	Dir     string
+	Format  string // FormatMaildir or FormatMbox
+	Logger  *slog.Logger
+
+	Upstream imapclient.Upstream
+}
+
+// folder is a folder to export: the name it is archived under, the
+// upstream folder holding its messages and the search keys selecting them.
+type folder struct {
+	name     string
+	upstream string
+	delim    string
+	criteria string // without the account's visibility rules
+}
+
+// Run exports the folders, stopping early when stop is closed. Messages
+// exported before an error are kept and not exported again by the next run.
+func (e *Exporter) Run(stop <-chan struct{}) (Stats, error) {
+	if e.Format != FormatMaildir && e.Format != FormatMbox {
+		return Stats{}, fmt.Errorf("unknown format %q", e.Format)
+	}
+	dir := e.AccountDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return Stats{}, err
+	}
+	st, err := loadState(dir, e.Format)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	nc, r, err := e.Upstream.Connect(e.Account, stop)
+	if err != nil {
+		return Stats{}, err
+	}
+	c := imapclient.New(nc, r, "e", commandTimeout)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		c.Close()
+	}()
+	go func() {
+		select {
+		case <-stop:
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	folders, err := e.folders(c)
+	if err != nil {
+		return Stats{}, err
+	}
+	var stats Stats
+	for _, f := range folders {
+		n, size, err := e.exportFolder(c, st, dir, f)
+		stats.Messages += n
+		stats.Bytes += size
+		if err != nil {
+			return stats, fmt.Errorf("folder %q: %w", f.name, err)
+		}
+		stats.Folders++
+	}
+	c.Command("LOGOUT", nil)
+	return stats, nil
+}
+
+// AccountDir returns the directory the account's archives are written to.
+func (e *Exporter) AccountDir() string {
+	return filepath.Join(e.Dir, safeName(e.Account.LocalUser))
+}
+
+// folders returns the folders to export.
+func (e *Exporter) folders(c *imapclient.Conn) ([]folder, error) {
+	var listed []imap.ListEntry
+	err := c.Command(`LIST "" "*"`, func(r imapclient.Response) error {
+		if entry, ok := imap.ParseListEntry([]byte(r.Text)); ok {
+			listed = append(listed, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	selectable := func(entry imap.ListEntry) bool {
+		return !entry.HasFlag(`\Noselect`) && !entry.HasFlag(`\NonExistent`)
+	}
+
+	if len(e.Folders) == 0 {
+		var folders []folder
+		for _, entry := range listed {
+			if selectable(entry) && e.Account.FolderAllowed(entry.Mailbox) {
+				folders = append(folders, folder{name: entry.Mailbox, upstream: entry.Mailbox, delim: entry.Delimiter})
+			}
+		}
+		return folders, nil
+	}
+	var folders []folder
+	for _, name := range e.Folders {
+		if !e.Account.FolderAllowed(name) {
+			return nil, fmt.Errorf("folder %q is not visible to account %q", name, e.Account.LocalUser)
+		}
+		if vf := e.Account.VirtualFolder(name); vf != nil {
+			folders = append(folders, folder{name: name, upstream: vf.Folder, criteria: "(" + vf.Search + ")"})
+			continue
+		}
+		i := slices.IndexFunc(listed, func(entry imap.ListEntry) bool {
+			return entry.Mailbox == name || strings.EqualFold(name, "INBOX") && strings.EqualFold(entry.Mailbox, "INBOX")
+		})
+		if i < 0 || !selectable(listed[i]) {
+			return nil, fmt.Errorf("folder %q not found", name)
+		}
+		folders = append(folders, folder{name: listed[i].Mailbox, upstream: listed[i].Mailbox, delim: listed[i].Delimiter})
+	}
+	return folders, nil
+}
+
+// exportFolder exports the messages of f newer than its checkpoint and
+// returns how many it wrote.
+func (e *Exporter) exportFolder(c *imapclient.Conn, st *state, dir string, f folder) (n int, size int64, err error) {
+	logger := e.Logger.With("user", e.Account.LocalUser, "folder", f.name)
+	v, err := c.Examine(f.upstream)
+	if err != nil {
+		return 0, 0, err
+	}
+	var validity uint32
+	if v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad UIDVALIDITY %q", v)
+		}
+		validity = uint32(n)
+	}
+	cp := st.Folders[f.name]
+	if cp.UIDValidity != validity {
+		if cp.LastUID > 0 {
+			logger.Warn("UIDVALIDITY changed, exporting the folder again", "old", cp.UIDValidity, "new", validity)
+		}
+		cp = checkpoint{UIDValidity: validity}
+	}
+
+	criteria := strings.TrimSpace(fmt.Sprintf("UID %d:* %s %s", cp.LastUID+1, f.criteria,
+		proxy.VisibilityCriteria(e.Account, f.upstream, time.Now())))
+	uids, err := c.Search(criteria)
+	if err != nil {
+		return 0, 0, err
+	}
+	// "last:*" always includes the highest UID, even if older.
+	uids = slices.DeleteFunc(uids, func(uid uint32) bool { return uid <= cp.LastUID })
+	if len(uids) == 0 {
+		return 0, 0, nil
+	}
+	slices.Sort(uids)
+	uids = slices.Compact(uids)
+
+	a, err := openArchive(e.Format, folderPath(dir, f))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if cerr := a.close(); err == nil {
+			err = cerr
+		}
+	}()
+	logger.Info("exporting folder", "messages", len(uids), "from_uid", cp.LastUID+1)
+	for batch := range slices.Chunk(uids, fetchBatch) {
+		written := map[uint32]bool{}
+		err := c.Command("UID FETCH "+imap.FormatSeqSet(batch)+" (UID FLAGS INTERNALDATE BODY.PEEK[])", func(r imapclient.Response) error {
+			m, ok := parseFetch(r)
+			if !ok {
+				return nil
+			}
+			m.uidValidity = validity
+			m.body = proxy.ScrubMessage(e.Account, m.body)
+			if err := a.write(m); err != nil {
+				return err
+			}
+			written[m.uid] = true
+			n++
+			size += int64(len(m.body))
+			return nil
+		})
+		if err != nil {
+			// Keep the messages written before the failure that need not
+			// be fetched again.
+			for _, uid := range batch {
+				if !written[uid] {
+					break
+				}
+				cp.LastUID = uid
+			}
+		} else {
+			cp.LastUID = batch[len(batch)-1]
+		}
+		st.Folders[f.name] = cp
+		if serr := st.save(); err == nil {
+			err = serr
+		}
+		if err != nil {
+			return n, size, err
+		}
+	}
+	return n, size, nil
+}
+
+// checkpoint records how far a folder has been exported.
+type checkpoint struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	LastUID     uint32 `json:"last_uid"`
+}
+
+// state holds the checkpoints of an account's archive directory. Each
+// format has its own state file, so both can share a directory.
+type state struct {
+	path    string
+	Folders map[string]checkpoint `json:"folders"`
+}
+
+func loadState(dir, format string) (*state, error) {
+	st := &state{path: filepath.Join(dir, ".export-"+format+".json"), Folders: map[string]checkpoint{}}
+	data, err := os.ReadFile(st.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", st.path, err)
+	}
+	if st.Folders == nil {
+		st.Folders = map[string]checkpoint{}
+	}
+	return st, nil
+}
+
+// save writes the state atomically.
+func (st *state) save() error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// parseFetch returns the message in a FETCH response for
+// (UID FLAGS INTERNALDATE BODY.PEEK[]).
+func parseFetch(r imapclient.Response) (message, bool) {
+	fields := strings.Fields(r.Text)
+	if len(fields) < 3 || fields[0] != "*" || !strings.EqualFold(fields[2], "FETCH") || len(r.Literals) != 1 {
+		return message{}, false
+	}
+	var m message
+	uid, ok := fetchItem(r.Text, "UID")
+	if !ok {
+		return message{}, false
+	}
+	uid, _, _ = strings.Cut(uid, " ")
+	n, err := strconv.ParseUint(strings.TrimRight(uid, ")"), 10, 32)
+	if err != nil || n == 0 {
+		return message{}, false
+	}
+	m.uid = uint32(n)
+	if flags, ok := fetchItem(r.Text, "FLAGS"); ok && strings.HasPrefix(flags, "(") {
+		flags, _, _ = strings.Cut(flags[1:], ")")
+		m.flags = strings.Fields(flags)
+	}
+	if date, ok := fetchItem(r.Text, "INTERNALDATE"); ok && strings.HasPrefix(date, `"`) {
+		date, _, _ = strings.Cut(date[1:], `"`)
+		m.date, _ = time.Parse("_2-Jan-2006 15:04:05 -0700", date)
+	}
+	m.body = r.Literals[0]
+	return m, true
+}
+
+// fetchItem returns what follows the named item in a FETCH response.
+func fetchItem(text, name string) (string, bool) {
+	upper := strings.ToUpper(text)
+	for i := 0; ; {
+		j := strings.Index(upper[i:], name+" ")
+		if j < 0 {
+			return "", false
+		}
+		i += j
+		if i > 0 && (upper[i-1] == ' ' || upper[i-1] == '(') {
+			return text[i+len(name)+1:], true
+		}
+		i += len(name)
+	}
+}
@@ -0,0 +1,65 @@
+// Package geoip resolves client IP addresses to ISO country codes using a
+// MaxMind (GeoIP2/GeoLite2 Country or City) database.
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is an open MaxMind database. It is safe for concurrent use.
+type DB struct {
+	r *maxminddb.Reader
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Open opens the MaxMind database at path.
+func Open(path string) (*DB, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: open %s: %w", path, err)
+	}
+	return &DB{r: r}, nil
+}
+
+// FromBytes opens a MaxMind database held in memory.
+func FromBytes(b []byte) (*DB, error) {
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %w", err)
+	}
+	return &DB{r: r}, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 country code for ip, falling back
+// to the registered country. It returns "" when ip is invalid or unknown
+// (e.g. private ranges).
+func (d *DB) Country(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	var rec countryRecord
+	if err := d.r.Lookup(parsed, &rec); err != nil {
+		return ""
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode
+	}
+	return rec.RegisteredCountry.ISOCode
+}
+
+// Close releases the database.
+func (d *DB) Close() error {
+	return d.r.Close()
+}
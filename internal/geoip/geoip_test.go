@@ -0,0 +1,169 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbWriter builds a minimal IPv4 MaxMind DB (record size 24) mapping
+// prefixes to {"country": {"iso_code": code}} records.
+type mmdbWriter struct {
+	nodes [][2]int // -1: empty; >= 0: node index; <= -2: data index -(i+2)
+	data  [][]byte
+}
+
+func (w *mmdbWriter) insert(t *testing.T, cidr, iso string) {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ones, _ := ipnet.Mask.Size()
+	ip := ipnet.IP.To4()
+
+	w.data = append(w.data, encodeCountry(iso))
+	dataRef := -(len(w.data) - 1 + 2)
+
+	if len(w.nodes) == 0 {
+		w.nodes = append(w.nodes, [2]int{-1, -1})
+	}
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := (ip[i/8] >> (7 - i%8)) & 1
+		if i == ones-1 {
+			w.nodes[node][bit] = dataRef
+			return
+		}
+		if w.nodes[node][bit] < 0 {
+			w.nodes = append(w.nodes, [2]int{-1, -1})
+			w.nodes[node][bit] = len(w.nodes) - 1
+		}
+		node = w.nodes[node][bit]
+	}
+}
+
+func (w *mmdbWriter) bytes() []byte {
+	nodeCount := len(w.nodes)
+	var dataSection bytes.Buffer
+	offsets := make([]int, len(w.data))
+	for i, d := range w.data {
+		offsets[i] = dataSection.Len()
+		dataSection.Write(d)
+	}
+
+	var out bytes.Buffer
+	put24 := func(v int) { out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)}) }
+	for _, n := range w.nodes {
+		for _, rec := range n {
+			switch {
+			case rec == -1:
+				put24(nodeCount)
+			case rec >= 0:
+				put24(rec)
+			default:
+				put24(nodeCount + 16 + offsets[-rec-2])
+			}
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(dataSection.Bytes())
+
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	out.Write(encodeMap(
+		"binary_format_major_version", encodeUint(5, 2),
+		"binary_format_minor_version", encodeUint(5, 0),
+		"build_epoch", encodeUint64(1),
+		"database_type", encodeString("Test-Country"),
+		"description", encodeMap("en", encodeString("test")),
+		"ip_version", encodeUint(5, 4),
+		"languages", []byte{0x01, 0x04, 0x42, 'e', 'n'}, // array of one string
+		"node_count", encodeUint(6, uint64(nodeCount)),
+		"record_size", encodeUint(5, 24),
+	))
+	return out.Bytes()
+}
+
+func encodeString(s string) []byte {
+	return append([]byte{byte(2<<5 | len(s))}, s...)
+}
+
+// encodeUint encodes v as the given type (5 = uint16, 6 = uint32).
+func encodeUint(typ byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	trimmed := bytes.TrimLeft(b[:], "\x00")
+	return append([]byte{typ<<5 | byte(len(trimmed))}, trimmed...)
+}
+
+func encodeUint64(v uint64) []byte {
+	u := encodeUint(0, v)
+	// Extended type: uint64 is 9, stored as 9-7 in the byte after the control byte.
+	return append([]byte{u[0], 2}, u[1:]...)
+}
+
+func encodeMap(kv ...any) []byte {
+	out := []byte{byte(7<<5 | len(kv)/2)}
+	for i := 0; i < len(kv); i += 2 {
+		out = append(out, encodeString(kv[i].(string))...)
+		out = append(out, kv[i+1].([]byte)...)
+	}
+	return out
+}
+
+func encodeCountry(iso string) []byte {
+	return encodeMap("country", encodeMap("iso_code", encodeString(iso)))
+}
+
+func testDB(t *testing.T) []byte {
+	t.Helper()
+	w := &mmdbWriter{}
+	w.insert(t, "192.0.2.0/24", "DE")
+	w.insert(t, "198.51.100.0/24", "US")
+	return w.bytes()
+}
+
+func TestCountry(t *testing.T) {
+	db, err := FromBytes(testDB(t))
+	if err != nil {
+		t.Fatalf("FromBytes: %v", err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.77", want: "DE"},
+		{ip: "198.51.100.1", want: "US"},
+		{ip: "203.0.113.1", want: ""},
+		{ip: "not-an-ip", want: ""},
+	}
+	for _, tt := range tests {
+		if got := db.Country(tt.ip); got != tt.want {
+			t.Errorf("Country(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, testDB(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	if got := db.Country("192.0.2.1"); got != "DE" {
+		t.Errorf("Country = %q, want DE", got)
+	}
+
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("expected error opening missing file")
+	}
+}
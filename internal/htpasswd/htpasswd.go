@@ -0,0 +1,233 @@
+// Package htpasswd verifies passwords against an Apache htpasswd-style file
+// of "user:hash" lines, re-reading it when it changes so credentials can be
+// rotated without restarting the proxy.
+package htpasswd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// File is a loaded password file. It is safe for concurrent use.
+type File struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]string // user → hash
+	modTime time.Time
+	size    int64
+}
+
+// Open reads the password file at path. Every line must be empty, a
+// comment starting with "#", or "user:hash" with a bcrypt ($2y$), Apache
+// MD5 ($apr1$) or SHA-1 ({SHA}) hash.
+func Open(path string) (*File, error) {
+	f := &File{path: path}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload re-reads the file if its modification time or size has changed,
+// and reports whether it did. If the new contents cannot be read or
+// parsed, the previous entries are kept.
+func (f *File) Reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, fmt.Errorf("htpasswd: %w", err)
+	}
+	f.mu.RLock()
+	unchanged := f.entries != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, fmt.Errorf("htpasswd: %w", err)
+	}
+	entries, err := parse(data)
+	if err != nil {
+		return false, fmt.Errorf("htpasswd: %s: %w", f.path, err)
+	}
+	f.mu.Lock()
+	f.entries, f.modTime, f.size = entries, info.ModTime(), info.Size()
+	f.mu.Unlock()
+	return true, nil
+}
+
+// ReloadEvery calls Reload every interval until stop is closed, passing
+// the number of users to onReload after each change and failures to
+// onErr.
+func (f *File) ReloadEvery(interval time.Duration, stop <-chan struct{}, onReload func(users int), onErr func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			changed, err := f.Reload()
+			switch {
+			case err != nil && onErr != nil:
+				onErr(err)
+			case changed && onReload != nil:
+				onReload(f.Len())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Len returns the number of users in the file.
+func (f *File) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.entries)
+}
+
+// Verify reports whether user is in the file and whether password matches
+// their hash. Unknown users are checked against a dummy bcrypt hash, so the
+// time taken does not reveal whether the user exists.
+func (f *File) Verify(user, password string) (known, ok bool) {
+	f.mu.RLock()
+	hash, known := f.entries[user]
+	f.mu.RUnlock()
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false, false
+	}
+	return true, check(hash, password)
+}
+
+// dummyHash is the bcrypt hash compared against for unknown users.
+var dummyHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("imap-proxy"), bcrypt.DefaultCost)
+	return h
+})
+
+// parse reads "user:hash" lines.
+func parse(data []byte) (map[string]string, error) {
+	entries := make(map[string]string)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("line %d: want user:hash", n)
+		}
+		if !supported(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash for user %q (use bcrypt, apr1 or SHA)", n, user)
+		}
+		if _, dup := entries[user]; dup {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, user)
+		}
+		entries[user] = hash
+	}
+	return entries, sc.Err()
+}
+
+func supported(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		return strings.Count(hash, "$") == 3
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	}
+	return false
+}
+
+// check reports whether password matches hash, which parse has accepted.
+func check(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(hash[len("$apr1$"):], "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+// apr1 returns the Apache MD5 crypt hash of password with salt, in the
+// "$apr1$salt$hash" form htpasswd writes.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	d := md5.New()
+	d.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		d.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := range 1000 {
+		d := md5.New()
+		if i&1 != 0 {
+			d.Write(pw)
+		} else {
+			d.Write(final)
+		}
+		if i%3 != 0 {
+			d.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d.Write(pw)
+		}
+		if i&1 != 0 {
+			d.Write(final)
+		} else {
+			d.Write(pw)
+		}
+		final = d.Sum(nil)
+	}
+
+	var b strings.Builder
+	b.WriteString(magic + salt + "$")
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(&b, uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	to64(&b, uint(final[11]), 2)
+	return b.String()
+}
+
+// to64 appends the n low 6-bit groups of v in crypt's base-64 alphabet.
+func to64(b *strings.Builder, v uint, n int) {
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	for range n {
+		b.WriteByte(itoa64[v&0x3f])
+		v >>= 6
+	}
+}
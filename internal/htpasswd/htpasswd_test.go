@@ -0,0 +1,143 @@
+package htpasswd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeFile(t, path, strings.Join([]string{
+		"# managed by tooling",
+		"",
+		"bcrypt:" + string(bc),
+		"apr1:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0",
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"empty:$apr1$ab$S8K6Sgp3W8c9Jb6LxgywZ.",
+	}, "\n"))
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", f.Len())
+	}
+
+	tests := []struct {
+		user, pass string
+		known, ok  bool
+	}{
+		{"bcrypt", "secret", true, true},
+		{"bcrypt", "wrong", true, false},
+		{"apr1", "secret", true, true},
+		{"apr1", "Secret", true, false},
+		{"sha", "secret", true, true},
+		{"sha", "", true, false},
+		{"empty", "", true, true},
+		{"nobody", "secret", false, false},
+	}
+	for _, tt := range tests {
+		known, ok := f.Verify(tt.user, tt.pass)
+		if known != tt.known || ok != tt.ok {
+			t.Errorf("Verify(%q, %q) = %v, %v, want %v, %v", tt.user, tt.pass, known, ok, tt.known, tt.ok)
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"no colon", "alice\n", "line 1"},
+		{"empty user", ":{SHA}x\n", "line 1"},
+		{"crypt", "# c\nalice:abJnggxhB/yWI\n", "line 2: unsupported hash"},
+		{"plain", "alice:secret\n", "unsupported hash"},
+		{"bad bcrypt", "alice:$2y$xx$abc\n", "unsupported hash"},
+		{"duplicate", "alice:{SHA}x\nalice:{SHA}y\n", "duplicate user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "htpasswd")
+			writeFile(t, path, tt.content)
+			_, err := Open(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Open() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Open() of a missing file succeeded")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeFile(t, path, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := f.Reload(); changed || err != nil {
+		t.Fatalf("Reload() of an unchanged file = %v, %v", changed, err)
+	}
+
+	// Rotate alice's password and add bob.
+	writeFile(t, path, "alice:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\nbob:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n")
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if changed, err := f.Reload(); !changed || err != nil {
+		t.Fatalf("Reload() = %v, %v, want a change", changed, err)
+	}
+	if _, ok := f.Verify("bob", "secret"); !ok {
+		t.Error("bob not loaded")
+	}
+
+	// A broken file keeps the previous entries.
+	writeFile(t, path, "garbage\n")
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute))
+	if _, err := f.Reload(); err == nil {
+		t.Fatal("Reload() of a broken file succeeded")
+	}
+	if _, ok := f.Verify("alice", "secret"); !ok {
+		t.Error("previous entries dropped after a failed reload")
+	}
+}
+
+func TestReloadEvery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeFile(t, path, "alice:{SHA}x\n")
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, "alice:{SHA}x\nbob:{SHA}y\n")
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+
+	stop := make(chan struct{})
+	reloaded := make(chan int, 1)
+	go f.ReloadEvery(10*time.Millisecond, stop, func(users int) { reloaded <- users }, nil)
+	defer close(stop)
+	select {
+	case n := <-reloaded:
+		if n != 2 {
+			t.Errorf("reloaded %d users, want 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("file not reloaded")
+	}
+}
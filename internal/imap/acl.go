@@ -0,0 +1,68 @@
+package imap
+
+import (
+	"bytes"
+	"strings"
+)
+
+// RewriteRights passes each rights string of an RFC 4314 ACL or MYRIGHTS
+// response through rewrite, together with the response's mailbox, and
+// returns the rebuilt line. It returns ok=false if line is not such a
+// response or announces a literal, which is left to the caller.
+func RewriteRights(line []byte, rewrite func(mailbox, rights string) string) (rewritten []byte, ok bool) {
+	data := bytes.TrimRight(line, "\r\n")
+	if _, _, hasLiteral := ParseLiteral(data); hasLiteral {
+		return nil, false
+	}
+	if len(data) < 2 || data[0] != '*' || data[1] != ' ' {
+		return nil, false
+	}
+	rest := data[2:]
+	sp := bytes.IndexByte(rest, ' ')
+	if sp < 0 {
+		return nil, false
+	}
+	verb := strings.ToUpper(string(rest[:sp]))
+	if verb != "ACL" && verb != "MYRIGHTS" {
+		return nil, false
+	}
+	head := data[:2+sp] // "* ACL" as received
+
+	// Each argument is kept as received, except for the rights strings.
+	var raw, values []string
+	for rest = rest[sp:]; len(rest) > 0; {
+		trimmed := bytes.TrimLeft(rest, " ")
+		if len(trimmed) == len(rest) {
+			return nil, false
+		}
+		value, r, ok := parseAString(trimmed)
+		if !ok {
+			return nil, false
+		}
+		raw = append(raw, string(trimmed[:len(trimmed)-len(r)]))
+		values = append(values, value)
+		rest = r
+	}
+	// MYRIGHTS has a mailbox and rights, ACL a mailbox and any number of
+	// identifier and rights pairs.
+	if verb == "MYRIGHTS" && len(values) != 2 || verb == "ACL" && (len(values) == 0 || len(values)%2 == 0) {
+		return nil, false
+	}
+
+	var b bytes.Buffer
+	b.Write(head)
+	for i, r := range raw {
+		b.WriteByte(' ')
+		if isRights := i > 0 && (verb == "MYRIGHTS" || i%2 == 0); !isRights {
+			b.WriteString(r)
+			continue
+		}
+		rights := rewrite(values[0], values[i])
+		if rights == "" {
+			rights = `""`
+		}
+		b.WriteString(rights)
+	}
+	b.WriteString("\r\n")
+	return b.Bytes(), true
+}
@@ -0,0 +1,35 @@
+package imap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteRights(t *testing.T) {
+	upper := func(mailbox, rights string) string { return mailbox + ":" + strings.ToUpper(rights) }
+	tests := []struct {
+		line   string
+		want   string
+		wantOk bool
+	}{
+		{"* MYRIGHTS INBOX lrswipkxte\r\n", "* MYRIGHTS INBOX INBOX:LRSWIPKXTE\r\n", true},
+		{"* ACL \"Shared Box\" fred lrs \"anyone\" l\r\n", "* ACL \"Shared Box\" fred Shared Box:LRS \"anyone\" Shared Box:L\r\n", true},
+		{"* acl Drafts\r\n", "* acl Drafts\r\n", true},
+		{"* ACL INBOX fred\r\n", "", false},
+		{"* MYRIGHTS INBOX\r\n", "", false},
+		{"* MYRIGHTS {5}\r\n", "", false},
+		{"* LIST () \"/\" INBOX\r\n", "", false},
+		{"A1 OK MYRIGHTS completed\r\n", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := RewriteRights([]byte(tt.line), upper)
+		if string(got) != tt.want || ok != tt.wantOk {
+			t.Errorf("RewriteRights(%q) = %q, %v, want %q, %v", tt.line, got, ok, tt.want, tt.wantOk)
+		}
+	}
+
+	empty := func(string, string) string { return "" }
+	if got, _ := RewriteRights([]byte("* MYRIGHTS INBOX w\r\n"), empty); string(got) != "* MYRIGHTS INBOX \"\"\r\n" {
+		t.Errorf("empty rights = %q, want a quoted empty string", got)
+	}
+}
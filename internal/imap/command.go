@@ -15,9 +15,9 @@ type Command struct {
 }
 
 var (
-	errEmptyLine   = errors.New("empty line")
-	errMissingTag  = errors.New("missing tag")
-	errMissingVerb = errors.New("missing verb")
+	errEmptyLine   = errors.New("empty command line")
+	errMissingTag  = errors.New("command line starts with a space instead of a tag")
+	errMissingVerb = errors.New("missing command name after the tag")
 )
 
 // ParseCommand parses an IMAP command line into a Command.
@@ -100,3 +100,11 @@ func ParseCommand(line []byte) (Command, error) {
 
 	return cmd, nil
 }
+
+// Quote returns s as an IMAP quoted string, for command arguments such as
+// mailbox names and passwords.
+func Quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
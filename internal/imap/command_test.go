@@ -150,3 +150,25 @@ func TestParseCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`simple`, `"simple"`},
+		{`with"quote`, `"with\"quote"`},
+		{`multiple""quotes`, `"multiple\"\"quotes"`},
+		{``, `""`},
+		{`with\backslash`, `"with\\backslash"`},
+		{`back\and"quote`, `"back\\and\"quote"`},
+		{`trailing\`, `"trailing\\"`},
+	}
+
+	for _, tt := range tests {
+		got := Quote(tt.input)
+		if got != tt.want {
+			t.Errorf("Quote(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
@@ -30,6 +30,9 @@ var blockedVerbs = map[string]bool{
 	"SUBSCRIBE":      true,
 	"UNSUBSCRIBE":    true,
 	"AUTHENTICATE":   true,
+	"SETACL":         true,
+	"DELETEACL":      true,
+	"SETMETADATA":    true,
 }
 
 // blockedUIDSubVerbs lists UID sub-commands that mutate mailbox state.
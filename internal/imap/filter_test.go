@@ -80,6 +80,24 @@ func TestFilter(t *testing.T) {
 			wantAction:    Block,
 			wantRejectMsg: "A011 NO AUTHENTICATE not allowed in read-only mode\r\n",
 		},
+		{
+			name:          "block SETACL",
+			cmd:           Command{Tag: "A012", Verb: "SETACL", Raw: []byte("A012 SETACL INBOX fred +w\r\n")},
+			wantAction:    Block,
+			wantRejectMsg: "A012 NO SETACL not allowed in read-only mode\r\n",
+		},
+		{
+			name:          "block DELETEACL",
+			cmd:           Command{Tag: "A013", Verb: "DELETEACL", Raw: []byte("A013 DELETEACL INBOX fred\r\n")},
+			wantAction:    Block,
+			wantRejectMsg: "A013 NO DELETEACL not allowed in read-only mode\r\n",
+		},
+		{
+			name:          "block SETMETADATA",
+			cmd:           Command{Tag: "A014", Verb: "SETMETADATA", Raw: []byte("A014 SETMETADATA INBOX (/private/comment NIL)\r\n")},
+			wantAction:    Block,
+			wantRejectMsg: "A014 NO SETMETADATA not allowed in read-only mode\r\n",
+		},
 
 		// Blocked UID subverbs
 		{
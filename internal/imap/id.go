@@ -0,0 +1,113 @@
+package imap
+
+import (
+	"bytes"
+	"strings"
+)
+
+// ParseIDParams parses the argument of an RFC 2971 ID command line
+// ("tag ID (...)" or "tag ID NIL") into a field/value map. Field names are
+// lowercased; NIL values become "". It returns ok=false for malformed input.
+func ParseIDParams(line []byte) (params map[string]string, ok bool) {
+	data := bytes.TrimRight(line, "\r\n")
+	// Skip tag and verb.
+	for i := 0; i < 2; i++ {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return nil, false
+		}
+		data = bytes.TrimLeft(data[sp+1:], " ")
+	}
+	if len(data) == 3 && strings.EqualFold(string(data), "NIL") {
+		return map[string]string{}, true
+	}
+	if len(data) < 2 || data[0] != '(' || data[len(data)-1] != ')' {
+		return nil, false
+	}
+	rest := data[1 : len(data)-1]
+
+	params = make(map[string]string)
+	for {
+		rest = bytes.TrimLeft(rest, " ")
+		if len(rest) == 0 {
+			return params, true
+		}
+		key, r, ok := parseNString(rest)
+		if !ok {
+			return nil, false
+		}
+		value, r, ok := parseNString(bytes.TrimLeft(r, " "))
+		if !ok {
+			return nil, false
+		}
+		params[strings.ToLower(key)] = value
+		rest = r
+	}
+}
+
+// parseNString parses a quoted string or NIL at the start of data and
+// returns its value and the remaining input.
+func parseNString(data []byte) (value string, rest []byte, ok bool) {
+	if len(data) >= 3 && strings.EqualFold(string(data[:3]), "NIL") && (len(data) == 3 || data[3] == ' ') {
+		return "", data[3:], true
+	}
+	if len(data) == 0 || data[0] != '"' {
+		return "", nil, false
+	}
+	var b strings.Builder
+	for i := 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			if i+1 >= len(data) {
+				return "", nil, false
+			}
+			i++
+			b.WriteByte(data[i])
+		case '"':
+			return b.String(), data[i+1:], true
+		default:
+			b.WriteByte(data[i])
+		}
+	}
+	return "", nil, false
+}
+
+// ParseClientIDArgs parses the arguments of a CLIENTID command line
+// ("tag CLIENTID type value"), each an atom or a quoted string. The type is
+// uppercased. It returns ok=false for malformed input.
+func ParseClientIDArgs(line []byte) (idType, value string, ok bool) {
+	data := bytes.TrimRight(line, "\r\n")
+	// Skip tag and verb.
+	for i := 0; i < 2; i++ {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			return "", "", false
+		}
+		data = bytes.TrimLeft(data[sp+1:], " ")
+	}
+	idType, data, ok = parseAString(data)
+	if !ok || idType == "" || len(data) == 0 || data[0] != ' ' {
+		return "", "", false
+	}
+	value, data, ok = parseAString(bytes.TrimLeft(data, " "))
+	if !ok || len(bytes.TrimLeft(data, " ")) > 0 {
+		return "", "", false
+	}
+	return strings.ToUpper(idType), value, true
+}
+
+// parseAString parses an atom or a quoted string at the start of data and
+// returns its value and the remaining input.
+func parseAString(data []byte) (value string, rest []byte, ok bool) {
+	if len(data) > 0 && data[0] == '"' {
+		return parseNString(data)
+	}
+	end := bytes.IndexAny(data, " ()\"")
+	if end < 0 {
+		end = len(data)
+	}
+	if end == 0 {
+		return "", nil, false
+	}
+	return string(data[:end]), data[end:], true
+}
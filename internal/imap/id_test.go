@@ -0,0 +1,84 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIDParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   map[string]string
+		wantOk bool
+	}{
+		{
+			name:   "name and version",
+			input:  "A1 ID (\"name\" \"Thunderbird\" \"version\" \"115.3\")\r\n",
+			want:   map[string]string{"name": "Thunderbird", "version": "115.3"},
+			wantOk: true,
+		},
+		{
+			name:   "NIL",
+			input:  "A1 ID NIL\r\n",
+			want:   map[string]string{},
+			wantOk: true,
+		},
+		{
+			name:   "field names lowercased and NIL value",
+			input:  "A1 ID (\"Name\" \"k9\" \"OS\" NIL)\r\n",
+			want:   map[string]string{"name": "k9", "os": ""},
+			wantOk: true,
+		},
+		{
+			name:   "escaped quote",
+			input:  "A1 ID (\"name\" \"my \\\"client\\\"\")\r\n",
+			want:   map[string]string{"name": "my \"client\""},
+			wantOk: true,
+		},
+		{
+			name:   "empty list",
+			input:  "A1 ID ()\r\n",
+			want:   map[string]string{},
+			wantOk: true,
+		},
+		{name: "missing argument", input: "A1 ID\r\n"},
+		{name: "unterminated list", input: "A1 ID (\"name\" \"x\"\r\n"},
+		{name: "unterminated string", input: "A1 ID (\"name\" \"x)\r\n"},
+		{name: "odd number of fields", input: "A1 ID (\"name\")\r\n"},
+		{name: "atom value", input: "A1 ID (\"name\" foo)\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseIDParams([]byte(tt.input))
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v (params %v)", ok, tt.wantOk, got)
+			}
+			if tt.wantOk && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("params = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseClientIDArgs(t *testing.T) {
+	tests := []struct {
+		input         string
+		idType, value string
+		wantOk        bool
+	}{
+		{"A1 CLIENTID UDID 0123abcd\r\n", "UDID", "0123abcd", true},
+		{"A1 CLIENTID tokenid \"abc def\"\r\n", "TOKENID", "abc def", true},
+		{"A1 CLIENTID \"UDID\" \"x\"\r\n", "UDID", "x", true},
+		{"A1 CLIENTID UDID\r\n", "", "", false},
+		{"A1 CLIENTID\r\n", "", "", false},
+		{"A1 CLIENTID UDID a b\r\n", "", "", false},
+		{"A1 CLIENTID UDID \"unterminated\r\n", "", "", false},
+	}
+	for _, tt := range tests {
+		idType, value, ok := ParseClientIDArgs([]byte(tt.input))
+		if idType != tt.idType || value != tt.value || ok != tt.wantOk {
+			t.Errorf("ParseClientIDArgs(%q) = %q, %q, %v, want %q, %q, %v", tt.input, idType, value, ok, tt.idType, tt.value, tt.wantOk)
+		}
+	}
+}
@@ -2,62 +2,91 @@ package imap
 
 import (
 	"bytes"
+	"strconv"
 	"strings"
 )
 
 // ParseListResponse extracts the mailbox name from an IMAP LIST or LSUB
 // untagged response. It returns ok=false if the line is not a LIST/LSUB response.
 func ParseListResponse(line []byte) (mailbox string, ok bool) {
+	entry, ok := ParseListEntry(line)
+	return entry.Mailbox, ok
+}
+
+// ListEntry is a parsed LIST or LSUB response.
+type ListEntry struct {
+	Flags     []string // mailbox attributes such as \Noselect
+	Delimiter string   // hierarchy delimiter, "" for NIL
+	Mailbox   string
+}
+
+// HasFlag reports whether the entry has the attribute, ignoring case.
+func (e ListEntry) HasFlag(flag string) bool {
+	for _, f := range e.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseListEntry parses an IMAP LIST or LSUB untagged response. It returns
+// ok=false if the line is not a LIST/LSUB response.
+func ParseListEntry(line []byte) (entry ListEntry, ok bool) {
 	data := bytes.TrimRight(line, "\r\n")
 
 	// Must start with "* "
 	if len(data) < 7 || data[0] != '*' || data[1] != ' ' {
-		return "", false
+		return ListEntry{}, false
 	}
 	rest := data[2:]
 
 	// Verb: LIST or LSUB (case-insensitive), followed by space.
 	if len(rest) < 5 || rest[4] != ' ' {
-		return "", false
+		return ListEntry{}, false
 	}
 	verb := strings.ToUpper(string(rest[:4]))
 	if verb != "LIST" && verb != "LSUB" {
-		return "", false
+		return ListEntry{}, false
 	}
 	rest = rest[5:]
 
 	// Parenthesized flags.
 	rest = bytes.TrimLeft(rest, " ")
 	if len(rest) == 0 || rest[0] != '(' {
-		return "", false
+		return ListEntry{}, false
 	}
 	closeIdx := bytes.IndexByte(rest, ')')
 	if closeIdx < 0 {
-		return "", false
+		return ListEntry{}, false
+	}
+	if flags := strings.Fields(string(rest[1:closeIdx])); len(flags) > 0 {
+		entry.Flags = flags
 	}
 	rest = rest[closeIdx+1:]
 
 	// Delimiter: quoted string or NIL.
 	rest = bytes.TrimLeft(rest, " ")
 	if len(rest) == 0 {
-		return "", false
+		return ListEntry{}, false
 	}
 	if rest[0] == '"' {
 		end := bytes.IndexByte(rest[1:], '"')
 		if end < 0 {
-			return "", false
+			return ListEntry{}, false
 		}
+		entry.Delimiter = strings.ReplaceAll(string(rest[1:end+1]), `\\`, `\`)
 		rest = rest[end+2:]
 	} else if len(rest) >= 3 && strings.EqualFold(string(rest[:3]), "NIL") {
 		rest = rest[3:]
 	} else {
-		return "", false
+		return ListEntry{}, false
 	}
 
 	// Mailbox name: quoted string or atom.
 	rest = bytes.TrimLeft(rest, " ")
 	if len(rest) == 0 {
-		return "", false
+		return ListEntry{}, false
 	}
 	if rest[0] == '"' {
 		var b strings.Builder
@@ -69,12 +98,52 @@ func ParseListResponse(line []byte) (mailbox string, ok bool) {
 				continue
 			}
 			if rest[i] == '"' {
-				return b.String(), true
+				entry.Mailbox = b.String()
+				return entry, true
 			}
 			b.WriteByte(rest[i])
 			i++
 		}
-		return "", false
+		return ListEntry{}, false
+	}
+	entry.Mailbox = string(rest)
+	return entry, true
+}
+
+// ParseMessageData parses the untagged mailbox size responses "* N EXISTS",
+// "* N RECENT" and "* N EXPUNGE". kind is returned uppercased.
+func ParseMessageData(line []byte) (n int, kind string, ok bool) {
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || fields[0] != "*" {
+		return 0, "", false
+	}
+	kind = strings.ToUpper(fields[2])
+	if kind != "EXISTS" && kind != "RECENT" && kind != "EXPUNGE" {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 0 {
+		return 0, "", false
+	}
+	return n, kind, true
+}
+
+// ParseResponseCode extracts the response code of an untagged status
+// response, such as "* OK [UIDVALIDITY 3857529045] UIDs valid". code is
+// returned uppercased; arg is the text after it inside the brackets.
+func ParseResponseCode(line []byte) (code, arg string, ok bool) {
+	rest, found := strings.CutPrefix(string(line), "* ")
+	if !found {
+		return "", "", false
+	}
+	_, rest, found = strings.Cut(rest, " ")
+	if !found || !strings.HasPrefix(rest, "[") {
+		return "", "", false
+	}
+	inner, _, found := strings.Cut(rest[1:], "]")
+	if !found || inner == "" {
+		return "", "", false
 	}
-	return string(rest), true
+	code, arg, _ = strings.Cut(inner, " ")
+	return strings.ToUpper(code), arg, true
 }
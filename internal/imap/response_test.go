@@ -1,6 +1,9 @@
 package imap
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestParseListResponse(t *testing.T) {
 	tests := []struct {
@@ -97,3 +100,76 @@ func TestParseListResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMessageData(t *testing.T) {
+	tests := []struct {
+		line string
+		n    int
+		kind string
+		ok   bool
+	}{
+		{"* 12 EXISTS\r\n", 12, "EXISTS", true},
+		{"* 3 expunge\r\n", 3, "EXPUNGE", true},
+		{"* 1 RECENT\r\n", 1, "RECENT", true},
+		{"* 0 EXISTS\r\n", 0, "EXISTS", true},
+		{"* OK [UIDNEXT 4] ok\r\n", 0, "", false},
+		{"* 2 FETCH (FLAGS (\\Seen))\r\n", 0, "", false},
+		{"* x EXISTS\r\n", 0, "", false},
+		{"* -1 EXISTS\r\n", 0, "", false},
+		{"A1 12 EXISTS\r\n", 0, "", false},
+	}
+	for _, tt := range tests {
+		n, kind, ok := ParseMessageData([]byte(tt.line))
+		if n != tt.n || kind != tt.kind || ok != tt.ok {
+			t.Errorf("ParseMessageData(%q) = %d, %q, %v; want %d, %q, %v", tt.line, n, kind, ok, tt.n, tt.kind, tt.ok)
+		}
+	}
+}
+
+func TestParseResponseCode(t *testing.T) {
+	tests := []struct {
+		line string
+		code string
+		arg  string
+		ok   bool
+	}{
+		{"* OK [UIDVALIDITY 3857529045] UIDs valid\r\n", "UIDVALIDITY", "3857529045", true},
+		{"* OK [uidnext 4] predicted\r\n", "UIDNEXT", "4", true},
+		{"* NO [ALERT] disk full\r\n", "ALERT", "", true},
+		{"* OK [PERMANENTFLAGS (\\Seen \\*)] ok\r\n", "PERMANENTFLAGS", "(\\Seen \\*)", true},
+		{"* OK no code\r\n", "", "", false},
+		{"* OK [] empty\r\n", "", "", false},
+		{"* OK [UNTERMINATED\r\n", "", "", false},
+		{"A1 OK [READ-ONLY] done\r\n", "", "", false},
+	}
+	for _, tt := range tests {
+		code, arg, ok := ParseResponseCode([]byte(tt.line))
+		if code != tt.code || arg != tt.arg || ok != tt.ok {
+			t.Errorf("ParseResponseCode(%q) = %q, %q, %v; want %q, %q, %v", tt.line, code, arg, ok, tt.code, tt.arg, tt.ok)
+		}
+	}
+}
+
+func TestParseListEntry(t *testing.T) {
+	tests := []struct {
+		line  string
+		flags []string
+		delim string
+		name  string
+	}{
+		{`* LIST (\HasNoChildren) "/" INBOX` + "\r\n", []string{`\HasNoChildren`}, "/", "INBOX"},
+		{`* LIST (\Noselect \HasChildren) "." "Public Folders"` + "\r\n", []string{`\Noselect`, `\HasChildren`}, ".", "Public Folders"},
+		{`* LSUB () "\\" Work` + "\r\n", nil, `\`, "Work"},
+		{`* LIST () NIL Flat` + "\r\n", nil, "", "Flat"},
+	}
+	for _, tt := range tests {
+		entry, ok := ParseListEntry([]byte(tt.line))
+		if !ok || !reflect.DeepEqual(entry.Flags, tt.flags) || entry.Delimiter != tt.delim || entry.Mailbox != tt.name {
+			t.Errorf("ParseListEntry(%q) = %+v, %v", tt.line, entry, ok)
+		}
+	}
+	entry, _ := ParseListEntry([]byte(`* LIST (\NoSelect) "/" Archive` + "\r\n"))
+	if !entry.HasFlag(`\Noselect`) || entry.HasFlag(`\Marked`) {
+		t.Errorf("HasFlag on %+v", entry)
+	}
+}
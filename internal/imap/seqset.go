@@ -0,0 +1,105 @@
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SeqRange is one element of a sequence set. A zero bound stands for "*",
+// the largest number in use.
+type SeqRange struct {
+	Start, Stop uint32
+}
+
+// SeqSet is a parsed sequence set such as "1:4,7,9:*".
+type SeqSet []SeqRange
+
+var errBadSeqSet = errors.New("invalid sequence set")
+
+// ParseSeqSet parses an IMAP sequence set of message sequence numbers or
+// UIDs.
+func ParseSeqSet(s string) (SeqSet, error) {
+	if s == "" {
+		return nil, errBadSeqSet
+	}
+	var set SeqSet
+	for part := range strings.SplitSeq(s, ",") {
+		first, last, isRange := strings.Cut(part, ":")
+		start, err := parseSeqNumber(first)
+		if err != nil {
+			return nil, err
+		}
+		stop := start
+		if isRange {
+			if stop, err = parseSeqNumber(last); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, SeqRange{Start: start, Stop: stop})
+	}
+	return set, nil
+}
+
+func parseSeqNumber(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	if s == "" || s[0] < '1' || s[0] > '9' {
+		return 0, errBadSeqSet
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, errBadSeqSet
+	}
+	return uint32(n), nil
+}
+
+// IsSeqSet reports whether s is syntactically a sequence set.
+func IsSeqSet(s string) bool {
+	_, err := ParseSeqSet(s)
+	return err == nil
+}
+
+// Contains reports whether n is in the set, with "*" standing for last.
+// The bounds of a range may be given in either order.
+func (set SeqSet) Contains(n, last uint32) bool {
+	for _, r := range set {
+		lo, hi := r.Start, r.Stop
+		if lo == 0 {
+			lo = last
+		}
+		if hi == 0 {
+			hi = last
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if n >= lo && n <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatSeqSet formats ascending numbers as a sequence set, collapsing
+// consecutive runs into ranges.
+func FormatSeqSet(nums []uint32) string {
+	var b strings.Builder
+	for i := 0; i < len(nums); {
+		j := i
+		for j+1 < len(nums) && nums[j+1] == nums[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatUint(uint64(nums[i]), 10))
+		if j > i {
+			b.WriteByte(':')
+			b.WriteString(strconv.FormatUint(uint64(nums[j]), 10))
+		}
+		i = j + 1
+	}
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSeqSet(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    SeqSet
+		wantErr bool
+	}{
+		{in: "1", want: SeqSet{{1, 1}}},
+		{in: "1:4,7,9:*", want: SeqSet{{1, 4}, {7, 7}, {9, 0}}},
+		{in: "*", want: SeqSet{{0, 0}}},
+		{in: "5:2", want: SeqSet{{5, 2}}},
+		{in: "", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "1,", wantErr: true},
+		{in: "1:", wantErr: true},
+		{in: "a", wantErr: true},
+		{in: "01", wantErr: true},
+		{in: "4294967296", wantErr: true},
+		{in: "ALL", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSeqSet(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSeqSet(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSeqSet(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+		if IsSeqSet(tt.in) == tt.wantErr {
+			t.Errorf("IsSeqSet(%q) = %v", tt.in, !tt.wantErr)
+		}
+	}
+}
+
+func TestSeqSetContains(t *testing.T) {
+	set, err := ParseSeqSet("2:4,7,9:*,12:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		n, last uint32
+		want    bool
+	}{
+		{1, 20, false},
+		{2, 20, true},
+		{4, 20, true},
+		{5, 20, false},
+		{7, 20, true},
+		{8, 20, false},
+		{15, 20, true},
+		{20, 20, true},
+		{8, 8, true}, // 9:* is 8:9 when the last number is 8
+		{11, 20, true},
+	}
+	for _, tt := range tests {
+		if got := set.Contains(tt.n, tt.last); got != tt.want {
+			t.Errorf("Contains(%d, %d) = %v, want %v", tt.n, tt.last, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSeqSet(t *testing.T) {
+	tests := []struct {
+		nums []uint32
+		want string
+	}{
+		{nil, ""},
+		{[]uint32{7}, "7"},
+		{[]uint32{1, 2, 3, 5, 7, 8}, "1:3,5,7:8"},
+	}
+	for _, tt := range tests {
+		if got := FormatSeqSet(tt.nums); got != tt.want {
+			t.Errorf("FormatSeqSet(%v) = %q, want %q", tt.nums, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package imap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// State is the connection state a command is validated in.
+type State int
+
+const (
+	NotAuthenticated State = iota
+	Authenticated
+	Selected
+)
+
+// Reasons for a ProtocolError, usable as metric labels.
+const (
+	ReasonTag         = "tag"
+	ReasonState       = "state"
+	ReasonArguments   = "arguments"
+	ReasonSyntax      = "syntax"
+	ReasonSequenceSet = "sequence_set"
+)
+
+// ProtocolError is a violation of the RFC 3501 command grammar. Its
+// message is suitable as the text of a BAD response.
+type ProtocolError struct {
+	Reason string
+	Msg    string
+}
+
+func (e *ProtocolError) Error() string { return e.Msg }
+
+// states in which a command is valid.
+type states int
+
+const (
+	anyState states = iota
+	notAuthOnly
+	authOnly // authenticated or selected
+	selectedOnly
+)
+
+// commandSpec describes a command's arguments and the states it is valid in.
+type commandSpec struct {
+	states   states
+	min, max int  // argument count; max < 0 is unbounded
+	seqSet   bool // the first argument is a sequence set
+}
+
+// commandSpecs covers RFC 3501 and the extensions the proxy passes on.
+// Argument maxima leave room for extension parameters, e.g. SELECT
+// (CONDSTORE) or FETCH (CHANGEDSINCE n).
+var commandSpecs = map[string]commandSpec{
+	"CAPABILITY": {anyState, 0, 0, false},
+	"NOOP":       {anyState, 0, 0, false},
+	"LOGOUT":     {anyState, 0, 0, false},
+	"ID":         {anyState, 1, 1, false},
+	"CLIENTID":   {anyState, 2, 2, false},
+
+	"STARTTLS":     {notAuthOnly, 0, 0, false},
+	"AUTHENTICATE": {notAuthOnly, 1, 2, false},
+	"LOGIN":        {notAuthOnly, 2, 2, false},
+
+	"SELECT":         {authOnly, 1, 2, false},
+	"EXAMINE":        {authOnly, 1, 2, false},
+	"CREATE":         {authOnly, 1, 2, false},
+	"DELETE":         {authOnly, 1, 1, false},
+	"RENAME":         {authOnly, 2, 2, false},
+	"SUBSCRIBE":      {authOnly, 1, 1, false},
+	"UNSUBSCRIBE":    {authOnly, 1, 1, false},
+	"LIST":           {authOnly, 2, -1, false},
+	"LSUB":           {authOnly, 2, 2, false},
+	"STATUS":         {authOnly, 2, 2, false},
+	"APPEND":         {authOnly, 2, 4, false},
+	"IDLE":           {authOnly, 0, 0, false},
+	"NAMESPACE":      {authOnly, 0, 0, false},
+	"ENABLE":         {authOnly, 1, -1, false},
+	"GETQUOTA":       {authOnly, 1, 1, false},
+	"GETQUOTAROOT":   {authOnly, 1, 1, false},
+	"UNAUTHENTICATE": {authOnly, 0, 0, false},
+	"GETACL":         {authOnly, 1, 1, false},
+	"MYRIGHTS":       {authOnly, 1, 1, false},
+	"LISTRIGHTS":     {authOnly, 2, 2, false},
+	"SETACL":         {authOnly, 3, 3, false},
+	"DELETEACL":      {authOnly, 2, 2, false},
+	"GETMETADATA":    {authOnly, 2, 3, false},
+	"SETMETADATA":    {authOnly, 2, 2, false},
+
+	"CHECK":    {selectedOnly, 0, 0, false},
+	"CLOSE":    {selectedOnly, 0, 0, false},
+	"UNSELECT": {selectedOnly, 0, 0, false},
+	"EXPUNGE":  {selectedOnly, 0, 0, false},
+	"SEARCH":   {selectedOnly, 1, -1, false},
+	"FETCH":    {selectedOnly, 2, 3, true},
+	"STORE":    {selectedOnly, 3, 4, true},
+	"COPY":     {selectedOnly, 2, 2, true},
+	"MOVE":     {selectedOnly, 2, 2, true},
+}
+
+// uidSpecs are the commands valid after UID.
+var uidSpecs = map[string]commandSpec{
+	"FETCH":   {selectedOnly, 2, 3, true},
+	"STORE":   {selectedOnly, 3, 4, true},
+	"COPY":    {selectedOnly, 2, 2, true},
+	"MOVE":    {selectedOnly, 2, 2, true},
+	"SEARCH":  {selectedOnly, 1, -1, false},
+	"EXPUNGE": {selectedOnly, 1, 1, true},
+}
+
+// Validate checks cmd against the RFC 3501 grammar for state: the tag,
+// whether the command is allowed in state, its argument count and the
+// syntax of quoted strings, lists and sequence sets. Only the first line
+// of a command with literals is checked, so arguments after a literal are
+// not counted. Commands it does not know are accepted.
+func Validate(cmd Command, state State) error {
+	if !ValidTag(cmd.Tag) {
+		return &ProtocolError{ReasonTag, "invalid tag"}
+	}
+	name := cmd.Verb
+	spec, ok := commandSpecs[cmd.Verb]
+	if cmd.Verb == "UID" {
+		name = "UID " + cmd.SubVerb
+		spec, ok = uidSpecs[cmd.SubVerb]
+		if !ok {
+			return &ProtocolError{ReasonSyntax, fmt.Sprintf("UID %s is not a UID command", orMissing(cmd.SubVerb))}
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case spec.states == notAuthOnly && state != NotAuthenticated:
+		return &ProtocolError{ReasonState, name + " not allowed after authentication"}
+	case spec.states >= authOnly && state == NotAuthenticated:
+		return &ProtocolError{ReasonState, name + " requires authentication"}
+	case spec.states == selectedOnly && state != Selected:
+		return &ProtocolError{ReasonState, name + " requires a selected mailbox"}
+	}
+
+	args, literal, err := splitArgs(commandArgs(cmd))
+	if err != nil {
+		return &ProtocolError{ReasonSyntax, name + ": " + err.Error()}
+	}
+	n := len(args)
+	if (spec.max >= 0 && n > spec.max) || (!literal && n < spec.min) {
+		return &ProtocolError{ReasonArguments, fmt.Sprintf("%s expects %s, got %d", name, argCount(spec.min, spec.max), n)}
+	}
+	if spec.seqSet && n > 0 && !(literal && n == 1) && args[0] != "$" && !IsSeqSet(args[0]) {
+		return &ProtocolError{ReasonSequenceSet, fmt.Sprintf("%s: invalid sequence set %q", name, args[0])}
+	}
+	return nil
+}
+
+// ValidTag reports whether tag is 1*<any ASTRING-CHAR except "+">.
+func ValidTag(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`(){%*"\+`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// commandArgs returns the text after the verb, or after the UID
+// subcommand, without the line ending.
+func commandArgs(cmd Command) string {
+	line := strings.TrimRight(string(cmd.Raw), "\r\n")
+	skip := 2 // tag and verb
+	if cmd.Verb == "UID" {
+		skip = 3
+	}
+	for range skip {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return ""
+		}
+		line = line[i+1:]
+	}
+	return line
+}
+
+// splitArgs splits command arguments at single spaces outside quoted
+// strings, parenthesized lists and brackets. A literal ends the line; the
+// argument holding it is the last one seen and literal is set, since more
+// may follow the literal data.
+func splitArgs(s string) (args []string, literal bool, err error) {
+	for s != "" {
+		if s[0] == ' ' {
+			return nil, false, fmt.Errorf("unexpected space")
+		}
+		end, literal, err := argEnd(s)
+		if err != nil {
+			return nil, false, err
+		}
+		args = append(args, s[:end])
+		if literal {
+			return args, true, nil
+		}
+		s = s[end:]
+		if s == "" {
+			break
+		}
+		// argEnd stops at a space.
+		s = s[1:]
+		if s == "" {
+			return nil, false, fmt.Errorf("unexpected space at end of line")
+		}
+	}
+	return args, false, nil
+}
+
+// argEnd returns the length of the argument at the start of s, and
+// whether it ends in a literal that ends the line.
+func argEnd(s string) (end int, literal bool, err error) {
+	parens, brackets := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			j, err := quotedEnd(s[i:])
+			if err != nil {
+				return 0, false, err
+			}
+			i += j - 1
+		case '(':
+			parens++
+		case ')':
+			if parens == 0 {
+				return 0, false, fmt.Errorf("unbalanced parentheses")
+			}
+			parens--
+		case '[':
+			brackets++
+		case ']':
+			if brackets > 0 {
+				brackets--
+			}
+		case '{':
+			// Lists and brackets may continue after the literal data.
+			if _, _, ok := ParseLiteral([]byte(s[i:])); !ok || strings.IndexByte(s[i:], '}') != len(s)-i-1 {
+				return 0, false, fmt.Errorf("invalid literal")
+			}
+			return len(s), true, nil
+		case ' ':
+			if parens == 0 && brackets == 0 {
+				return i, false, nil
+			}
+		default:
+			if c < ' ' || c == 0x7f {
+				return 0, false, fmt.Errorf("control character in argument")
+			}
+		}
+	}
+	switch {
+	case parens > 0:
+		return 0, false, fmt.Errorf("unbalanced parentheses")
+	case brackets > 0:
+		return 0, false, fmt.Errorf("unbalanced brackets")
+	}
+	return len(s), false, nil
+}
+
+// quotedEnd returns the length of the quoted string at the start of s.
+func quotedEnd(s string) (int, error) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return i + 1, nil
+		case '\\':
+			if i+1 >= len(s) || (s[i+1] != '"' && s[i+1] != '\\') {
+				return 0, fmt.Errorf("invalid escape in quoted string")
+			}
+			i++
+		}
+	}
+	return 0, fmt.Errorf("unterminated quoted string")
+}
+
+func argCount(min, max int) string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", n)
+	}
+	switch {
+	case max < 0:
+		return "at least " + plural(min)
+	case min == max:
+		return plural(min)
+	}
+	return fmt.Sprintf("%d to %d arguments", min, max)
+}
+
+func orMissing(s string) string {
+	if s == "" {
+		return "(missing)"
+	}
+	return s
+}
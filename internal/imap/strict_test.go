@@ -0,0 +1,94 @@
+package imap
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		line   string
+		state  State
+		reason string // "" for a valid command
+		msg    string
+	}{
+		// Valid commands.
+		{line: "a1 CAPABILITY", state: NotAuthenticated},
+		{line: "a1 LOGIN user \"pass word\"", state: NotAuthenticated},
+		{line: "a1 LOGIN {4}", state: NotAuthenticated},
+		{line: "a1 AUTHENTICATE PLAIN", state: NotAuthenticated},
+		{line: "a1 ID NIL", state: Authenticated},
+		{line: "a1 ID (\"name\" \"mutt\")", state: NotAuthenticated},
+		{line: "a1 SELECT INBOX", state: Authenticated},
+		{line: "a1 SELECT INBOX (CONDSTORE)", state: Selected},
+		{line: "a1 LIST \"\" \"*\"", state: Authenticated},
+		{line: "a1 LIST (SUBSCRIBED) \"\" * RETURN (CHILDREN)", state: Authenticated},
+		{line: "a1 STATUS \"Sent Items\" (MESSAGES UNSEEN)", state: Authenticated},
+		{line: "a1 APPEND INBOX (\\Seen) \"01-Jan-2024 00:00:00 +0000\" {5+}", state: Authenticated},
+		{line: "a1 FETCH 1:*,7 (FLAGS BODY.PEEK[HEADER.FIELDS (FROM SUBJECT)])", state: Selected},
+		{line: "a1 FETCH $ FLAGS", state: Selected},
+		{line: "a1 STORE 1 +FLAGS.SILENT (\\Deleted)", state: Selected},
+		{line: "a1 UID FETCH 100:200 (UID FLAGS) (CHANGEDSINCE 12)", state: Selected},
+		{line: "a1 UID EXPUNGE 5", state: Selected},
+		{line: "a1 SEARCH OR (SUBJECT {5}", state: Selected},
+		{line: "a1 SEARCH SUBJECT \"a \\\"quoted\\\" \\\\ word\"", state: Selected},
+		{line: "a1 XUNKNOWN whatever ((", state: NotAuthenticated},
+		{line: "a]1 NOOP", state: NotAuthenticated},
+
+		// Tags.
+		{line: "a+1 NOOP", reason: ReasonTag, msg: "invalid tag"},
+		{line: "a*1 NOOP", reason: ReasonTag, msg: "invalid tag"},
+
+		// States.
+		{line: "a1 SELECT INBOX", state: NotAuthenticated, reason: ReasonState, msg: "SELECT requires authentication"},
+		{line: "a1 LOGIN a b", state: Authenticated, reason: ReasonState, msg: "LOGIN not allowed after authentication"},
+		{line: "a1 FETCH 1 FLAGS", state: Authenticated, reason: ReasonState, msg: "FETCH requires a selected mailbox"},
+		{line: "a1 UID FETCH 1 FLAGS", state: Authenticated, reason: ReasonState, msg: "UID FETCH requires a selected mailbox"},
+		{line: "a1 UID LIST", state: Selected, reason: ReasonSyntax, msg: "UID LIST is not a UID command"},
+		{line: "a1 UID", state: Selected, reason: ReasonSyntax, msg: "UID (missing) is not a UID command"},
+
+		// Argument counts.
+		{line: "a1 NOOP now", reason: ReasonArguments, msg: "NOOP expects 0 arguments, got 1"},
+		{line: "a1 LOGIN user", reason: ReasonArguments, msg: "LOGIN expects 2 arguments, got 1"},
+		{line: "a1 SELECT", state: Authenticated, reason: ReasonArguments, msg: "SELECT expects 1 to 2 arguments, got 0"},
+		{line: "a1 SEARCH", state: Selected, reason: ReasonArguments, msg: "SEARCH expects at least 1 argument, got 0"},
+		{line: "a1 STATUS INBOX MESSAGES UNSEEN", state: Authenticated, reason: ReasonArguments, msg: "STATUS expects 2 arguments, got 3"},
+		{line: "a1 LOGIN a b {4}", reason: ReasonArguments, msg: "LOGIN expects 2 arguments, got 3"},
+
+		// Syntax.
+		{line: "a1 LOGIN  user pass", reason: ReasonSyntax, msg: "LOGIN: unexpected space"},
+		{line: "a1 LOGIN user pass ", reason: ReasonSyntax, msg: "LOGIN: unexpected space at end of line"},
+		{line: "a1 LOGIN \"user pass", reason: ReasonSyntax, msg: "LOGIN: unterminated quoted string"},
+		{line: "a1 LOGIN \"us\\er\" pass", reason: ReasonSyntax, msg: "LOGIN: invalid escape in quoted string"},
+		{line: "a1 FETCH 1 (FLAGS", state: Selected, reason: ReasonSyntax, msg: "FETCH: unbalanced parentheses"},
+		{line: "a1 FETCH 1 FLAGS)", state: Selected, reason: ReasonSyntax, msg: "FETCH: unbalanced parentheses"},
+		{line: "a1 FETCH 1 BODY[TEXT", state: Selected, reason: ReasonSyntax, msg: "FETCH: unbalanced brackets"},
+		{line: "a1 LOGIN {4} pass", reason: ReasonSyntax, msg: "LOGIN: invalid literal"},
+
+		// Sequence sets.
+		{line: "a1 FETCH 0 FLAGS", state: Selected, reason: ReasonSequenceSet, msg: "FETCH: invalid sequence set \"0\""},
+		{line: "a1 UID STORE 1:x +FLAGS (\\Seen)", state: Selected, reason: ReasonSequenceSet, msg: "UID STORE: invalid sequence set \"1:x\""},
+		{line: "a1 COPY ALL Trash", state: Selected, reason: ReasonSequenceSet, msg: "COPY: invalid sequence set \"ALL\""},
+	}
+	for _, tt := range tests {
+		cmd, err := ParseCommand([]byte(tt.line + "\r\n"))
+		if err != nil {
+			t.Fatalf("ParseCommand(%q): %v", tt.line, err)
+		}
+		err = Validate(cmd, tt.state)
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("Validate(%q) = %v, want valid", tt.line, err)
+			}
+			continue
+		}
+		var pe *ProtocolError
+		if !errors.As(err, &pe) {
+			t.Errorf("Validate(%q) = %v, want a ProtocolError", tt.line, err)
+			continue
+		}
+		if pe.Reason != tt.reason || pe.Msg != tt.msg {
+			t.Errorf("Validate(%q) = %s %q, want %s %q", tt.line, pe.Reason, pe.Msg, tt.reason, tt.msg)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Package imapclient is the small IMAP client the proxy uses on its own
+// behalf, outside client sessions: by the exporter and the JMAP and REST
+// gateways, each over its own upstream connection.
+package imapclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/proxy"
+)
+
+// ErrRefused wraps an upstream NO or BAD completion.
+var ErrRefused = errors.New("upstream refused command")
+
+// Upstream connects and authenticates to the upstream of an account. Dial
+// and Login default to proxy.DialUpstream and proxy.LoginUpstream; tests
+// replace them with fakes.
+type Upstream struct {
+	Dial  func(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error)
+	Login func(conn net.Conn, r *bufio.Reader, acct *config.AccountConfig) error
+
+	// Hosts, if set, limits the connections open to each upstream host.
+	// Each connection holds a slot until it is closed.
+	Hosts *proxy.HostLimits
+}
+
+// Connect dials the upstream of acct and logs in. Closing stop, which may
+// be nil, closes the connection and so aborts the login. It fails with
+// proxy.ErrHostLimit when the upstream host has no free slot in Hosts.
+func (u Upstream) Connect(acct *config.AccountConfig, stop <-chan struct{}) (net.Conn, *bufio.Reader, error) {
+	dial, login := u.Dial, u.Login
+	if dial == nil {
+		dial = proxy.DialUpstream
+	}
+	if login == nil {
+		login = proxy.LoginUpstream
+	}
+	release, err := u.Hosts.Acquire(acct)
+	if err != nil {
+		return nil, nil, err
+	}
+	nc, r, err := dial(acct)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	nc = &slotConn{Conn: nc, release: release}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			nc.Close()
+		case <-done:
+		}
+	}()
+	err = login(nc, r, acct)
+	close(done)
+	if err != nil {
+		nc.Close()
+		return nil, nil, err
+	}
+	return nc, r, nil
+}
+
+// slotConn is an upstream connection that releases its host slot when
+// closed.
+type slotConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *slotConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// Conn is an authenticated upstream connection.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	prefix  string
+	timeout time.Duration
+	seq     int
+}
+
+// New returns a Conn over nc and r, as returned by Upstream.Connect. Its
+// command tags are tagPrefix followed by a sequence number, and timeout
+// bounds the wait for each response.
+func New(nc net.Conn, r *bufio.Reader, tagPrefix string, timeout time.Duration) *Conn {
+	return &Conn{Conn: nc, r: r, prefix: tagPrefix, timeout: timeout}
+}
+
+// Response is an untagged response. Text holds its lines with the literals
+// cut out; Literals holds them in order.
+type Response struct {
+	Text     string
+	Literals [][]byte
+}
+
+// Command sends a command and hands each untagged response to handle,
+// which may be nil; an error from handle ends the command. A NO or BAD
+// completion is an ErrRefused.
+func (c *Conn) Command(cmd string, handle func(Response) error) error {
+	c.seq++
+	tag := c.prefix + strconv.Itoa(c.seq)
+	c.SetDeadline(time.Now().Add(c.timeout))
+	defer c.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(c, "%s %s\r\n", tag, cmd); err != nil {
+		return err
+	}
+	for {
+		r, err := c.read()
+		if err != nil {
+			return err
+		}
+		if rest, ok := strings.CutPrefix(r.Text, tag+" "); ok {
+			if status, _, _ := strings.Cut(rest, " "); !strings.EqualFold(status, "OK") {
+				return fmt.Errorf("%w: %s", ErrRefused, r.Text)
+			}
+			return nil
+		}
+		if strings.HasPrefix(r.Text, "* BYE") {
+			return errors.New("upstream: " + r.Text)
+		}
+		if handle != nil {
+			if err := handle(r); err != nil {
+				return err
+			}
+		}
+		// Large literals may take a while; each response extends the deadline.
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// read reads one response together with its literals.
+func (c *Conn) read() (Response, error) {
+	var r Response
+	var text strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return Response{}, err
+		}
+		text.WriteString(strings.TrimRight(line, "\r\n"))
+		n, _, ok := imap.ParseLiteral([]byte(line))
+		if !ok {
+			r.Text = text.String()
+			return r, nil
+		}
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(c.r, lit); err != nil {
+			return Response{}, err
+		}
+		r.Literals = append(r.Literals, lit)
+	}
+}
+
+// Examine opens folder read-only and returns its UIDVALIDITY as sent by
+// the upstream, or "" if it sent none.
+func (c *Conn) Examine(folder string) (string, error) {
+	validity := ""
+	err := c.Command("EXAMINE "+imap.Quote(folder), func(r Response) error {
+		if code, arg, ok := imap.ParseResponseCode([]byte(r.Text)); ok && code == "UIDVALIDITY" {
+			validity = arg
+		}
+		return nil
+	})
+	return validity, err
+}
+
+// Search runs a UID SEARCH in the examined folder and returns the UIDs
+// found, in the order the upstream sent them.
+func (c *Conn) Search(criteria string) ([]uint32, error) {
+	var uids []uint32
+	err := c.Command("UID SEARCH "+criteria, func(r Response) error {
+		uids = append(uids, ParseSearch(r.Text)...)
+		return nil
+	})
+	return uids, err
+}
+
+// ParseSearch returns the numbers of a "* SEARCH" response.
+func ParseSearch(text string) []uint32 {
+	fields := strings.Fields(text)
+	if len(fields) < 2 || fields[0] != "*" || !strings.EqualFold(fields[1], "SEARCH") {
+		return nil
+	}
+	var nums []uint32
+	for _, f := range fields[2:] {
+		n, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			break
+		}
+		nums = append(nums, uint32(n))
+	}
+	return nums
+}
@@ -0,0 +1,84 @@
+package imapclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestConnCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	tags := make(chan string, 2)
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		line, _ := r.ReadString('\n')
+		tag, _, _ := strings.Cut(line, " ")
+		tags <- tag
+		fmt.Fprint(server, "* 1 FETCH (UID 7 BODY[] {5}\r\nhello FLAGS (\\Seen))\r\n")
+		fmt.Fprintf(server, "%s OK done\r\n", tag)
+		line, _ = r.ReadString('\n')
+		tag, _, _ = strings.Cut(line, " ")
+		tags <- tag
+		fmt.Fprintf(server, "%s NO no such folder\r\n", tag)
+	}()
+	c := New(client, bufio.NewReader(client), "x", time.Minute)
+	var got []Response
+	if err := c.Command("UID FETCH 7 BODY.PEEK[]", func(r Response) error { got = append(got, r); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	want := []Response{{Text: "* 1 FETCH (UID 7 BODY[] {5} FLAGS (\\Seen))", Literals: [][]byte{[]byte("hello")}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("responses = %q, want %q", got, want)
+	}
+	if _, err := c.Examine("Missing"); !errors.Is(err, ErrRefused) || !strings.Contains(err.Error(), "no such folder") {
+		t.Errorf("Examine error = %v, want ErrRefused with the upstream NO", err)
+	}
+	if first, second := <-tags, <-tags; first != "x1" || second != "x2" {
+		t.Errorf("tags = %s, %s, want x1, x2", first, second)
+	}
+}
+
+func TestUpstreamConnectStop(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	stop := make(chan struct{})
+	u := Upstream{
+		Dial: func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			return client, bufio.NewReader(client), nil
+		},
+		Login: func(conn net.Conn, r *bufio.Reader, _ *config.AccountConfig) error {
+			close(stop)
+			_, err := r.ReadString('\n') // the upstream never answers
+			return err
+		},
+	}
+	if _, _, err := u.Connect(&config.AccountConfig{}, stop); err == nil {
+		t.Fatal("Connect succeeded after stop was closed")
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	tests := []struct {
+		text string
+		want []uint32
+	}{
+		{"* SEARCH 1 4 9", []uint32{1, 4, 9}},
+		{"* SEARCH", nil},
+		{"* SEARCH 2 (MODSEQ 5)", []uint32{2}},
+		{"* 3 EXISTS", nil},
+	}
+	for _, tt := range tests {
+		if got := ParseSearch(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseSearch(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Package imaptest provides a fake IMAP upstream with canned mail, for
+// tests and for "imap-proxy fakeserver". It serves the messages in Mail
+// read-only through localstore: LOGIN, LIST, STATUS, SELECT/EXAMINE, FETCH,
+// SEARCH and IDLE behave like a real server, and every change is refused.
+package imaptest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/localstore"
+)
+
+// Default credentials accepted by a Server.
+const (
+	User     = "user@example.com"
+	Password = "password"
+)
+
+// Server is a fake IMAP upstream listening on a local TCP port.
+type Server struct {
+	// Addr is the listen address, as host:port.
+	Addr string
+	// Root is the seeded maildir tree, which tests may add messages to.
+	Root string
+
+	user     string
+	password string
+	store    *localstore.Store
+	l        net.Listener
+	ownsRoot bool
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	received []string
+}
+
+// NewServer seeds a temporary directory with Mail and starts serving it on
+// a loopback port, accepting User and Password. Like httptest.NewServer it
+// panics if it cannot start; call Close when done.
+func NewServer() *Server {
+	return NewServerWith(Mail)
+}
+
+// NewServerWith is like NewServer, but serves mail instead of Mail.
+func NewServerWith(mail map[string][]Message) *Server {
+	root, err := os.MkdirTemp("", "imaptest")
+	if err != nil {
+		panic("imaptest: " + err.Error())
+	}
+	if err := SeedMail(root, mail); err != nil {
+		os.RemoveAll(root)
+		panic("imaptest: seed: " + err.Error())
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(root)
+		panic("imaptest: listen: " + err.Error())
+	}
+	s := NewListenerServer(l, root, User, Password)
+	s.ownsRoot = true
+	return s
+}
+
+// NewListenerServer serves the tree at root on l, accepting user and
+// password. An empty user accepts any credentials.
+func NewListenerServer(l net.Listener, root, user, password string) *Server {
+	s := &Server{
+		Addr:     l.Addr().String(),
+		Root:     root,
+		user:     user,
+		password: password,
+		store:    &localstore.Store{Root: root},
+		l:        l,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	if user != "" {
+		s.store.Login = func(u, p string) bool { return u == user && p == password }
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		if !s.serve(conn) {
+			return
+		}
+	}
+}
+
+// serve runs a session on conn unless the server is closed, which it
+// reports by returning false.
+func (s *Server) serve(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.store.Serve(&recorder{Conn: conn, s: s})
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	return true
+}
+
+// Close stops the listener, drops open sessions and waits for them to end.
+// A seeded temporary directory is removed.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.l.Close()
+	s.wg.Wait()
+	if s.ownsRoot {
+		os.RemoveAll(s.Root)
+	}
+}
+
+// Add writes msgs to folder, creating it if needed. Sessions see them from
+// their next SELECT or EXAMINE.
+func (s *Server) Add(folder string, msgs ...Message) error {
+	validity, err := folderValidity(filepath.Join(s.Root, filepath.FromSlash(folder), "cur"))
+	if err != nil {
+		return err
+	}
+	return writeMessages(s.Root, folder, validity, msgs)
+}
+
+// SetUIDValidity gives the messages of folder a new UIDVALIDITY, as an
+// upstream does when it rebuilds a folder.
+func (s *Server) SetUIDValidity(folder string, validity uint32) error {
+	dir := filepath.Join(s.Root, filepath.FromSlash(folder), "cur")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		m := exportName.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		name := fmt.Sprintf("%s.%d_%s", m[1], validity, m[3])
+		if err := os.Rename(filepath.Join(dir, e.Name()), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportName matches the file names written by Seed: time, UIDVALIDITY and
+// UID followed by the maildir info.
+var exportName = regexp.MustCompile(`^(\d+)\.(\d+)_(\d+\.imap-proxy.*)$`)
+
+// folderValidity returns the UIDVALIDITY of the messages in the maildir
+// directory dir, or UIDValidity if it has none.
+func folderValidity(dir string) (uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	for _, e := range entries {
+		if m := exportName.FindStringSubmatch(e.Name()); m != nil {
+			n, _ := strconv.ParseUint(m[2], 10, 32)
+			return uint32(n), nil
+		}
+	}
+	return UIDValidity, nil
+}
+
+// Received returns the commands s has received, oldest first, without
+// their tags and line endings. Literal data shows up as lines of its own.
+func (s *Server) Received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.received)
+}
+
+// recorder is a served connection that notes the lines read from it.
+type recorder struct {
+	net.Conn
+	s    *Server
+	line []byte // the start of a line not yet complete
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.line = append(r.line, p[:n]...)
+	for {
+		i := bytes.IndexByte(r.line, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(r.line[:i]), "\r")
+		r.line = r.line[i+1:]
+		_, cmd, _ := strings.Cut(line, " ")
+		r.s.mu.Lock()
+		r.s.received = append(r.s.received, cmd)
+		r.s.mu.Unlock()
+	}
+	return n, err
+}
+
+// Account returns an account that logs into s in plaintext, for use with
+// proxy.DialUpstream and a real Session.
+func (s *Server) Account(localUser, localPassword string) config.AccountConfig {
+	host, port, _ := net.SplitHostPort(s.Addr)
+	n, _ := strconv.Atoi(port)
+	return config.AccountConfig{
+		LocalUser:            localUser,
+		LocalPassword:        localPassword,
+		RemoteHost:           host,
+		RemotePort:           n,
+		RemoteUser:           s.user,
+		RemotePassword:       s.password,
+		RemoteAllowPlaintext: true,
+	}
+}
+
+// Dial starts an in-process session on a pipe and returns the client end
+// positioned after the greeting. It has the signature of proxy.DialUpstream
+// so it can replace the dialer of a Session, Exporter, Watcher or gateway.
+func (s *Server) Dial(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+	client, server := net.Pipe()
+	if !s.serve(server) {
+		client.Close()
+		return nil, nil, errors.New("imaptest: server closed")
+	}
+	r := bufio.NewReader(client)
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("imaptest: read greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		client.Close()
+		return nil, nil, fmt.Errorf("imaptest: unexpected greeting %q", greeting)
+	}
+	return client, r, nil
+}
@@ -0,0 +1,133 @@
+package imaptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exchange sends a tagged command and returns the lines up to and
+// including the tagged response.
+func exchange(t *testing.T, conn net.Conn, r *bufio.Reader, tag, cmd string) []string {
+	t.Helper()
+	fmt.Fprintf(conn, "%s %s\r\n", tag, cmd)
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, tag+" ") {
+			return lines
+		}
+	}
+}
+
+func TestServerTCP(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if greeting, _ := r.ReadString('\n'); !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("greeting = %q", greeting)
+	}
+	if got := exchange(t, conn, r, "a1", `LOGIN "user@example.com" wrong`); !strings.HasPrefix(got[0], "a1 NO") {
+		t.Errorf("bad LOGIN = %q", got)
+	}
+	acct := s.Account("reader", "secret")
+	if got := exchange(t, conn, r, "a2", fmt.Sprintf("LOGIN %q %q", acct.RemoteUser, acct.RemotePassword)); !strings.HasPrefix(got[0], "a2 OK") {
+		t.Fatalf("LOGIN = %q", got)
+	}
+	want := []string{
+		"* LIST (\\Noselect) \"/\" \"Archive\"\r\n",
+		"* LIST () \"/\" \"Archive/2023\"\r\n",
+		"* LIST () \"/\" \"INBOX\"\r\n",
+		"* LIST () \"/\" \"Sent\"\r\n",
+		"* LIST () \"/\" \"Trash\"\r\n",
+		"a3 OK LIST completed\r\n",
+	}
+	if got := exchange(t, conn, r, "a3", `LIST "" *`); !reflect.DeepEqual(got, want) {
+		t.Errorf("LIST = %q, want %q", got, want)
+	}
+}
+
+func TestServerDial(t *testing.T) {
+	s := NewServer()
+	conn, r, err := s.Dial(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	exchange(t, conn, r, "a1", `LOGIN "user@example.com" "password"`)
+	got := strings.Join(exchange(t, conn, r, "a2", "EXAMINE INBOX"), "")
+	for _, want := range []string{"* 3 EXISTS\r\n", "[UNSEEN 3]", "[UIDVALIDITY 1]", "[UIDNEXT 4]"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("EXAMINE = %q, missing %q", got, want)
+		}
+	}
+	got = strings.Join(exchange(t, conn, r, "a3", "UID FETCH 2 (FLAGS INTERNALDATE BODY.PEEK[HEADER.FIELDS (SUBJECT)])"), "")
+	if want := `* 2 FETCH (UID 2 FLAGS (\Flagged \Seen) INTERNALDATE "`; !strings.HasPrefix(got, want) || !strings.Contains(got, "Subject: Quarterly report\r\n") {
+		t.Errorf("FETCH = %q", got)
+	}
+	if got := exchange(t, conn, r, "a4", "UID SEARCH UNSEEN"); got[0] != "* SEARCH 3\r\n" {
+		t.Errorf("SEARCH = %q", got)
+	}
+
+	// Close drops the open session and refuses new ones.
+	s.Close()
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("session still open after Close")
+	}
+	if _, _, err := s.Dial(nil); err == nil {
+		t.Error("Dial succeeded after Close")
+	}
+}
+
+func TestServerWithMail(t *testing.T) {
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewServerWith(map[string][]Message{"INBOX": {{UID: 4, Date: date, Body: "Subject: a\r\n\r\n"}}})
+	defer s.Close()
+	conn, r, err := s.Dial(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	exchange(t, conn, r, "a1", `LOGIN "user@example.com" "password"`)
+	exchange(t, conn, r, "a2", "EXAMINE INBOX")
+	if got := exchange(t, conn, r, "a3", "UID SEARCH ALL"); got[0] != "* SEARCH 4\r\n" {
+		t.Errorf("SEARCH = %q", got)
+	}
+
+	if err := s.Add("INBOX", Message{UID: 9, Date: date, Body: "Subject: b\r\n\r\n"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUIDValidity("INBOX", 5); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(exchange(t, conn, r, "a4", "EXAMINE INBOX"), "")
+	if !strings.Contains(got, "* 2 EXISTS\r\n") || !strings.Contains(got, "[UIDVALIDITY 5]") {
+		t.Errorf("EXAMINE after Add and SetUIDValidity = %q", got)
+	}
+	if err := s.Add("New", Message{UID: 1, Date: date, Body: "Subject: c\r\n\r\n"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(exchange(t, conn, r, "a5", "EXAMINE New"), ""); !strings.Contains(got, "[UIDVALIDITY 1]") {
+		t.Errorf("EXAMINE of an added folder = %q", got)
+	}
+
+	want := []string{`LOGIN "user@example.com" "password"`, "EXAMINE INBOX", "UID SEARCH ALL", "EXAMINE INBOX", "EXAMINE New"}
+	if got := s.Received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Received() = %q, want %q", got, want)
+	}
+}
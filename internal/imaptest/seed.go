@@ -0,0 +1,125 @@
+package imaptest
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// UIDValidity is the UIDVALIDITY of every seeded folder.
+const UIDValidity = 1
+
+// Message is a canned message.
+type Message struct {
+	UID   uint32
+	Flags string // maildir info flags, e.g. "FS"
+	Date  time.Time
+	Body  string
+}
+
+// Mail is the canned mail written by Seed, by folder. Folder names use "/"
+// as the hierarchy delimiter.
+var Mail = map[string][]Message{
+	"INBOX": {
+		{1, "S", time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC), "From: Alice Example <alice@example.com>\r\n" +
+			"To: reader@example.com\r\n" +
+			"Subject: Welcome\r\n" +
+			"Date: Tue, 2 Jan 2024 09:00:00 +0000\r\n" +
+			"Message-ID: <welcome@example.com>\r\n" +
+			"\r\n" +
+			"This mailbox is served by the imap-proxy fake upstream.\r\n"},
+		{2, "FS", time.Date(2024, 1, 3, 14, 30, 0, 0, time.UTC), "From: Bob Example <bob@example.org>\r\n" +
+			"To: reader@example.com\r\n" +
+			"Cc: alice@example.com\r\n" +
+			"Subject: Quarterly report\r\n" +
+			"Date: Wed, 3 Jan 2024 14:30:00 +0000\r\n" +
+			"Message-ID: <report@example.org>\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"fake-boundary\"\r\n" +
+			"\r\n" +
+			"--fake-boundary\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"\r\n" +
+			"The numbers are attached.\r\n" +
+			"--fake-boundary\r\n" +
+			"Content-Type: text/csv; name=\"report.csv\"\r\n" +
+			"Content-Disposition: attachment; filename=\"report.csv\"\r\n" +
+			"\r\n" +
+			"quarter,revenue\r\n" +
+			"Q4,42\r\n" +
+			"--fake-boundary--\r\n"},
+		{3, "", time.Date(2024, 1, 4, 8, 15, 0, 0, time.UTC), "From: =?utf-8?q?J=C3=BCrgen?= <juergen@example.net>\r\n" +
+			"To: reader@example.com\r\n" +
+			"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+			"Date: Thu, 4 Jan 2024 09:15:00 +0100\r\n" +
+			"Message-ID: <greetings@example.net>\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"Unread, with a non-ASCII subject.\r\n"},
+	},
+	"Sent": {
+		{1, "S", time.Date(2024, 1, 3, 15, 0, 0, 0, time.UTC), "From: reader@example.com\r\n" +
+			"To: Bob Example <bob@example.org>\r\n" +
+			"Subject: Re: Quarterly report\r\n" +
+			"Date: Wed, 3 Jan 2024 15:00:00 +0000\r\n" +
+			"In-Reply-To: <report@example.org>\r\n" +
+			"\r\n" +
+			"Thanks!\r\n"},
+	},
+	"Archive/2023": {
+		{1, "S", time.Date(2023, 12, 24, 18, 0, 0, 0, time.UTC), "From: carol@example.com\r\n" +
+			"To: reader@example.com\r\n" +
+			"Subject: Season's greetings\r\n" +
+			"Date: Sun, 24 Dec 2023 18:00:00 +0000\r\n" +
+			"\r\n" +
+			"An old message.\r\n"},
+	},
+	"Trash": nil,
+}
+
+// Seed writes Mail to dir as a maildir tree in the layout of
+// "imap-proxy export", so the messages keep their UIDs. Existing files are
+// overwritten.
+func Seed(dir string) error {
+	return SeedMail(dir, Mail)
+}
+
+// SeedMail writes mail to dir like Seed does with Mail.
+func SeedMail(dir string, mail map[string][]Message) error {
+	for folder, msgs := range mail {
+		if err := writeMessages(dir, folder, UIDValidity, msgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMessages writes msgs to folder under dir, creating the folder.
+func writeMessages(dir, folder string, validity uint32, msgs []Message) error {
+	path := filepath.Join(dir, filepath.FromSlash(folder))
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(path, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	for _, m := range msgs {
+		name := fmt.Sprintf("%d.%d_%d.imap-proxy:2,%s", m.Date.Unix(), validity, m.UID, m.Flags)
+		file := filepath.Join(path, "cur", name)
+		if err := os.WriteFile(file, []byte(m.Body), 0o600); err != nil {
+			return err
+		}
+		if err := os.Chtimes(file, m.Date, m.Date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Folders returns the names of the seeded folders, sorted.
+func Folders() []string {
+	return slices.Sorted(maps.Keys(Mail))
+}
@@ -0,0 +1,38 @@
+package imaptest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSeed(t *testing.T) {
+	dir := t.TempDir()
+	if err := Seed(dir); err != nil {
+		t.Fatal(err)
+	}
+	// Seeding again overwrites rather than duplicating.
+	if err := Seed(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range Folders() {
+		entries, err := os.ReadDir(filepath.Join(dir, filepath.FromSlash(folder), "cur"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(Mail[folder]) {
+			t.Errorf("%s: %d files, want %d", folder, len(entries), len(Mail[folder]))
+		}
+	}
+	info, err := os.Stat(filepath.Join(dir, "INBOX", "cur", "1704292200.1_2.imap-proxy:2,FS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(Mail["INBOX"][1].Date) {
+		t.Errorf("mtime = %v, want the message date", info.ModTime())
+	}
+	if want := []string{"Archive/2023", "INBOX", "Sent", "Trash"}; !reflect.DeepEqual(Folders(), want) {
+		t.Errorf("Folders() = %q, want %q", Folders(), want)
+	}
+}
@@ -0,0 +1,425 @@
+// Package jmap serves a read-only subset of JMAP (RFC 8620, RFC 8621) over
+// HTTP: Mailbox/get, Email/query and Email/get, answered from each
+// account's upstream IMAP server. Clients authenticate with the account's
+// local credentials, go through the same login checks and limits as IMAP
+// logins, and see only what an IMAP client of the account would: folder
+// filters, visibility rules, header scrubbing and download quotas apply.
+package jmap
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imapclient"
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/proxy"
+)
+
+// Capabilities.
+const (
+	capCore = "urn:ietf:params:jmap:core"
+	capMail = "urn:ietf:params:jmap:mail"
+)
+
+const (
+	apiPath = "/jmap/api"
+	// state is reported for every object type: the gateway keeps no
+	// state and supports no /changes methods.
+	state = "0"
+
+	maxSizeRequest    = 1 << 20
+	maxCallsInRequest = 16
+	maxObjectsInGet   = 256
+)
+
+var methodCallsTotal = metrics.Default.NewCounter("imap_proxy_jmap_method_calls_total",
+	"JMAP method calls, by method and result.", "method", "result")
+
+// Server is an http.Handler serving the JMAP session resource at
+// /.well-known/jmap and the API at /jmap/api.
+type Server struct {
+	cfg     *config.Config
+	gateway *proxy.Server
+	logger  *slog.Logger
+	mux     *http.ServeMux
+
+	Upstream imapclient.Upstream
+}
+
+// New returns a Server for the accounts in cfg. Requests log in through
+// gateway, the proxy serving cfg.
+func New(cfg *config.Config, gateway *proxy.Server, logger *slog.Logger) *Server {
+	s := &Server{cfg: cfg, gateway: gateway, logger: logger, mux: http.NewServeMux()}
+	s.Upstream.Hosts = gateway.HostLimits()
+	s.mux.HandleFunc("GET /.well-known/jmap", s.session)
+	s.mux.HandleFunc("POST "+apiPath, s.api)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// login logs the request in with its basic credentials. On failure it
+// answers the request and returns nil; otherwise the caller must Close the
+// login.
+func (s *Server) login(w http.ResponseWriter, r *http.Request) *proxy.GatewayLogin {
+	login, err := s.gateway.LoginGateway(r, "jmap")
+	if err != nil {
+		err.Write(w)
+		return nil
+	}
+	return login
+}
+
+// session serves the JMAP session resource.
+func (s *Server) session(w http.ResponseWriter, r *http.Request) {
+	login := s.login(w, r)
+	if login == nil {
+		return
+	}
+	defer login.Close()
+	acct := login.Account
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	id := accountID(acct)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"capabilities": map[string]any{
+			capCore: map[string]any{
+				"maxSizeUpload":         0,
+				"maxConcurrentUpload":   1,
+				"maxSizeRequest":        maxSizeRequest,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     maxCallsInRequest,
+				"maxObjectsInGet":       maxObjectsInGet,
+				"maxObjectsInSet":       0,
+				"collationAlgorithms":   []string{},
+			},
+			capMail: map[string]any{},
+		},
+		"accounts": map[string]any{
+			id: map[string]any{
+				"name":       acct.LocalUser,
+				"isPersonal": true,
+				"isReadOnly": true,
+				"accountCapabilities": map[string]any{
+					capMail: map[string]any{
+						"maxMailboxesPerEmail":       1,
+						"maxMailboxDepth":            nil,
+						"maxSizeMailboxName":         1024,
+						"maxSizeAttachmentsPerEmail": 0,
+						"emailQuerySortOptions":      []string{"receivedAt"},
+						"mayCreateTopLevelMailbox":   false,
+					},
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{capMail: id},
+		"username":        acct.LocalUser,
+		"apiUrl":          scheme + "://" + r.Host + apiPath,
+		"state":           state,
+	})
+}
+
+// invocation is a method call or response: [name, arguments, call id].
+type invocation struct {
+	name   string
+	args   json.RawMessage
+	callID string
+}
+
+func (inv *invocation) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return errors.New("invocation must have 3 elements")
+	}
+	if err := json.Unmarshal(parts[0], &inv.name); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(parts[2], &inv.callID); err != nil {
+		return err
+	}
+	inv.args = parts[1]
+	return nil
+}
+
+func (inv invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{inv.name, inv.args, inv.callID})
+}
+
+type request struct {
+	Using       []string     `json:"using"`
+	MethodCalls []invocation `json:"methodCalls"`
+}
+
+// methodError is a JMAP method-level error, answered as an "error"
+// response to the call.
+type methodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *methodError) Error() string { return e.Type + ": " + e.Description }
+
+func invalidArguments(format string, args ...any) *methodError {
+	return &methodError{Type: "invalidArguments", Description: fmt.Sprintf(format, args...)}
+}
+
+// api serves a JMAP API request. Its method calls share one upstream
+// connection, opened by the first call that needs it.
+func (s *Server) api(w http.ResponseWriter, r *http.Request) {
+	login := s.login(w, r)
+	if login == nil {
+		return
+	}
+	defer login.Close()
+	acct := login.Account
+	var req request
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSizeRequest))
+	if err := dec.Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			requestError(w, "limit", "maxSizeRequest", "request too large")
+			return
+		}
+		requestError(w, "notRequest", "", err.Error())
+		return
+	}
+	for _, c := range req.Using {
+		if c != capCore && c != capMail {
+			requestError(w, "unknownCapability", "", "unsupported capability "+c)
+			return
+		}
+	}
+	if len(req.MethodCalls) > maxCallsInRequest {
+		requestError(w, "limit", "maxCallsInRequest", "too many method calls")
+		return
+	}
+
+	m := &methods{server: s, acct: acct, login: login, logger: s.logger.With("user", acct.LocalUser)}
+	defer m.close()
+	var responses []invocation
+	for _, call := range req.MethodCalls {
+		result, err := m.call(call, responses)
+		outcome := "ok"
+		if err != nil {
+			var merr *methodError
+			if !errors.As(err, &merr) {
+				m.logger.Error("JMAP method failed", "method", call.name, "err", err)
+				merr = &methodError{Type: "serverFail"}
+			}
+			outcome = merr.Type
+			result = merr
+		}
+		methodCallsTotal.Inc(metricMethod(call.name), outcome)
+		args, err := json.Marshal(result)
+		if err != nil {
+			args, _ = json.Marshal(&methodError{Type: "serverFail"})
+		}
+		name := call.name
+		if outcome != "ok" {
+			name = "error"
+		}
+		responses = append(responses, invocation{name: name, args: args, callID: call.callID})
+	}
+	if responses == nil {
+		responses = []invocation{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"methodResponses": responses, "sessionState": state})
+}
+
+// metricMethod bounds the method label to the supported methods.
+func metricMethod(name string) string {
+	switch name {
+	case "Mailbox/get", "Email/query", "Email/get":
+		return name
+	}
+	return "unknown"
+}
+
+// requestError answers a request-level error as RFC 7807 problem details.
+func requestError(w http.ResponseWriter, kind, limit, detail string) {
+	problem := map[string]any{
+		"type":   "urn:ietf:params:jmap:error:" + kind,
+		"status": http.StatusBadRequest,
+		"detail": detail,
+	}
+	if limit != "" {
+		problem["limit"] = limit
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// resolveReferences replaces "#name" arguments, which refer to a result of
+// an earlier call (RFC 8620 section 3.7), with the value they point to.
+func resolveReferences(args json.RawMessage, responses []invocation) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(args, &fields); err != nil {
+		return nil, invalidArguments("arguments must be an object")
+	}
+	resolved := false
+	for key, raw := range fields {
+		name, ok := strings.CutPrefix(key, "#")
+		if !ok {
+			continue
+		}
+		if _, dup := fields[name]; dup {
+			return nil, invalidArguments("both %s and #%s given", name, name)
+		}
+		var ref struct {
+			ResultOf string `json:"resultOf"`
+			Name     string `json:"name"`
+			Path     string `json:"path"`
+		}
+		if err := json.Unmarshal(raw, &ref); err != nil {
+			return nil, invalidArguments("#%s: %v", name, err)
+		}
+		value, ok := lookupResult(responses, ref.ResultOf, ref.Name, ref.Path)
+		if !ok {
+			return nil, &methodError{Type: "invalidResultReference", Description: "#" + name}
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = data
+		delete(fields, key)
+		resolved = true
+	}
+	if !resolved {
+		return args, nil
+	}
+	return json.Marshal(fields)
+}
+
+// lookupResult evaluates path against the arguments of the response to
+// callID, which must be a name response.
+func lookupResult(responses []invocation, callID, name, path string) (any, bool) {
+	for _, resp := range responses {
+		if resp.callID != callID {
+			continue
+		}
+		if resp.name != name {
+			return nil, false
+		}
+		var v any
+		if err := json.Unmarshal(resp.args, &v); err != nil {
+			return nil, false
+		}
+		if path == "" {
+			return v, true
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, false
+		}
+		return evalPointer(v, strings.Split(path[1:], "/"))
+	}
+	return nil, false
+}
+
+// evalPointer evaluates the JSON pointer tokens against v. A "*" token
+// applies the rest of the pointer to each element of an array, flattening
+// array results into one array.
+func evalPointer(v any, tokens []string) (any, bool) {
+	if len(tokens) == 0 {
+		return v, true
+	}
+	tok := strings.NewReplacer("~1", "/", "~0", "~").Replace(tokens[0])
+	switch x := v.(type) {
+	case map[string]any:
+		child, ok := x[tok]
+		if !ok {
+			return nil, false
+		}
+		return evalPointer(child, tokens[1:])
+	case []any:
+		if tok == "*" {
+			out := []any{}
+			for _, item := range x {
+				r, ok := evalPointer(item, tokens[1:])
+				if !ok {
+					return nil, false
+				}
+				if arr, isArr := r.([]any); isArr {
+					out = append(out, arr...)
+				} else {
+					out = append(out, r)
+				}
+			}
+			return out, true
+		}
+		i, err := strconv.Atoi(tok)
+		if err != nil || i < 0 || i >= len(x) {
+			return nil, false
+		}
+		return evalPointer(x[i], tokens[1:])
+	}
+	return nil, false
+}
+
+// encodeID joins parts into a JMAP id, which may only use the base64url
+// alphabet. Ids carry everything needed to find their object again.
+func encodeID(parts ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, "\x00")))
+}
+
+// decodeID splits an id made by encodeID into n parts.
+func decodeID(id string, n int) ([]string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, false
+	}
+	parts := strings.Split(string(data), "\x00")
+	return parts, len(parts) == n
+}
+
+func accountID(acct *config.AccountConfig) string {
+	return encodeID(acct.LocalUser)
+}
+
+// upstream returns the request's upstream connection, opening it first if
+// needed.
+func (m *methods) upstream() (*conn, error) {
+	if m.conn != nil {
+		return m.conn, nil
+	}
+	nc, r, err := m.server.Upstream.Connect(m.acct, nil)
+	m.login.Connected(err)
+	if errors.Is(err, proxy.ErrHostLimit) {
+		return nil, &methodError{Type: "serverUnavailable", Description: err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.conn = &conn{Conn: imapclient.New(nc, r, "j", commandTimeout)}
+	return m.conn, nil
+}
+
+// close logs out of the upstream, if a call connected to it.
+func (m *methods) close() {
+	if m.conn != nil {
+		m.conn.Command("LOGOUT", nil)
+		m.conn.Close()
+	}
+}
@@ -0,0 +1,184 @@
+package jmap
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/proxy"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{Accounts: []config.AccountConfig{{
+		LocalUser:     "reader1",
+		LocalPassword: "localpass1",
+	}}}
+}
+
+func newTestServer(cfg *config.Config) *Server {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(cfg, proxy.NewServer(cfg, logger), logger)
+}
+
+// post sends a JMAP API request as reader1 and returns the decoded
+// response.
+func post(t *testing.T, s *Server, body string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("POST", apiPath, strings.NewReader(body))
+	req.SetBasicAuth("reader1", "localpass1")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response %q: %v", rec.Body, err)
+	}
+	return rec.Code, resp
+}
+
+func TestAuthentication(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts = append(cfg.Accounts, config.AccountConfig{LocalUser: "secure", LocalPassword: "pw", RequireTLS: true})
+	s := newTestServer(cfg)
+	tests := []struct {
+		user, pass string
+		want       int
+	}{
+		{"reader1", "localpass1", http.StatusOK},
+		{"reader1", "wrong", http.StatusUnauthorized},
+		{"nobody", "localpass1", http.StatusUnauthorized},
+		{"secure", "pw", http.StatusForbidden},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/.well-known/jmap", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s/%s: status %d, want %d", tt.user, tt.pass, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.Lockout = config.LockoutConfig{MaxFailures: 2, Duration: time.Minute}
+	s := newTestServer(cfg)
+	for _, tt := range []struct {
+		pass string
+		want int
+	}{
+		{"wrong", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"localpass1", http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest("GET", "/.well-known/jmap", nil)
+		req.SetBasicAuth("reader1", tt.pass)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("password %s: status %d, want %d", tt.pass, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSessionResource(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://mail.example.com/.well-known/jmap", nil)
+	req.SetBasicAuth("reader1", "localpass1")
+	rec := httptest.NewRecorder()
+	newTestServer(testConfig()).ServeHTTP(rec, req)
+	var session struct {
+		APIURL          string            `json:"apiUrl"`
+		PrimaryAccounts map[string]string `json:"primaryAccounts"`
+		Accounts        map[string]struct {
+			IsReadOnly bool `json:"isReadOnly"`
+		} `json:"accounts"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil {
+		t.Fatal(err)
+	}
+	if session.APIURL != "http://mail.example.com/jmap/api" {
+		t.Errorf("apiUrl = %q", session.APIURL)
+	}
+	id := session.PrimaryAccounts[capMail]
+	if acct, ok := session.Accounts[id]; !ok || !acct.IsReadOnly {
+		t.Errorf("accounts = %+v, want read-only account %q", session.Accounts, id)
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	s := newTestServer(testConfig())
+	code, resp := post(t, s, `{"using":["urn:ietf:params:jmap:core","urn:example:unknown"],"methodCalls":[]}`)
+	if code != http.StatusBadRequest || resp["type"] != "urn:ietf:params:jmap:error:unknownCapability" {
+		t.Errorf("unknown capability: %d %v", code, resp)
+	}
+	code, resp = post(t, s, `{"using":[],"methodCalls":[["Email/get"]]}`)
+	if code != http.StatusBadRequest || resp["type"] != "urn:ietf:params:jmap:error:notRequest" {
+		t.Errorf("malformed call: %d %v", code, resp)
+	}
+}
+
+func TestMethodErrors(t *testing.T) {
+	s := newTestServer(testConfig())
+	acct := accountID(&s.cfg.Accounts[0])
+	_, resp := post(t, s, `{"using":[],"methodCalls":[
+		["Email/set",{},"a"],
+		["Mailbox/get",{"accountId":"other"},"b"],
+		["Email/get",{"accountId":"`+acct+`","#ids":{"resultOf":"x","name":"Email/query","path":"/ids"}},"c"]
+	]}`)
+	var got []string
+	for _, r := range resp["methodResponses"].([]any) {
+		inv := r.([]any)
+		got = append(got, inv[0].(string)+":"+inv[1].(map[string]any)["type"].(string)+":"+inv[2].(string))
+	}
+	want := []string{"error:unknownMethod:a", "error:accountNotFound:b", "error:invalidResultReference:c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("responses = %v, want %v", got, want)
+	}
+}
+
+func TestEvalPointer(t *testing.T) {
+	var v any
+	json.Unmarshal([]byte(`{"ids":["a","b"],"list":[{"id":"x","to":[1,2]},{"id":"y","to":[3]}],"a/b":1}`), &v)
+	tests := []struct {
+		path string
+		want any
+		ok   bool
+	}{
+		{"/ids", []any{"a", "b"}, true},
+		{"/ids/1", "b", true},
+		{"/list/*/id", []any{"x", "y"}, true},
+		{"/list/*/to", []any{1.0, 2.0, 3.0}, true},
+		{"/a~1b", 1.0, true},
+		{"/missing", nil, false},
+		{"/ids/5", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := evalPointer(v, strings.Split(tt.path[1:], "/"))
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("evalPointer(%q) = %v, %v; want %v, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestIDs(t *testing.T) {
+	id := encodeID("Work/Sub", "42", "7")
+	if strings.Trim(id, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		t.Errorf("id %q has characters outside the base64url alphabet", id)
+	}
+	if parts, ok := decodeID(id, 3); !ok || !reflect.DeepEqual(parts, []string{"Work/Sub", "42", "7"}) {
+		t.Errorf("decodeID = %q, %v", parts, ok)
+	}
+	if _, ok := decodeID(id, 1); ok {
+		t.Error("decodeID accepted the wrong number of parts")
+	}
+}
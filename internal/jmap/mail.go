@@ -0,0 +1,775 @@
+package jmap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/imapclient"
+	"imap-proxy/internal/proxy"
+)
+
+const (
+	// maxQueryLimit caps the ids returned by one Email/query.
+	maxQueryLimit = 256
+	// previewLength is the length, in characters, of Email previews.
+	previewLength = 256
+)
+
+// methods runs the method calls of one API request for an account.
+type methods struct {
+	server *Server
+	acct   *config.AccountConfig
+	login  *proxy.GatewayLogin
+	logger *slog.Logger
+	conn   *conn
+}
+
+// call runs one method call, resolving references to earlier responses.
+func (m *methods) call(call invocation, responses []invocation) (any, error) {
+	args, err := resolveReferences(call.args, responses)
+	if err != nil {
+		return nil, err
+	}
+	switch call.name {
+	case "Mailbox/get":
+		return m.mailboxGet(args)
+	case "Email/query":
+		return m.emailQuery(args)
+	case "Email/get":
+		return m.emailGet(args)
+	}
+	return nil, &methodError{Type: "unknownMethod", Description: call.name}
+}
+
+// decodeArgs unmarshals args into v and checks its accountId.
+func (m *methods) decodeArgs(args json.RawMessage, v any, account *string) error {
+	if err := json.Unmarshal(args, v); err != nil {
+		return invalidArguments("%v", err)
+	}
+	if *account != accountID(m.acct) {
+		return &methodError{Type: "accountNotFound"}
+	}
+	return nil
+}
+
+// mailbox is a mailbox the account may see: an upstream folder, or a
+// virtual folder selecting messages of one.
+type mailbox struct {
+	name     string
+	upstream string
+	criteria string // the virtual folder's search, or ""
+	delim    string
+	parent   string // the parent mailbox's name, or ""
+	role     string
+}
+
+func (mb *mailbox) id() string { return encodeID(mb.name) }
+
+// specialUse maps RFC 6154 mailbox attributes to JMAP roles.
+var specialUse = map[string]string{
+	`\All`: "all", `\Archive`: "archive", `\Drafts`: "drafts", `\Flagged`: "flagged",
+	`\Junk`: "junk", `\Sent`: "sent", `\Trash`: "trash",
+}
+
+// mailboxRole returns the JMAP role of a listed folder, or "".
+func mailboxRole(entry imap.ListEntry) string {
+	r := ""
+	if strings.EqualFold(entry.Mailbox, "INBOX") {
+		r = "inbox"
+	}
+	for _, f := range entry.Flags {
+		for attr, role := range specialUse {
+			if strings.EqualFold(f, attr) {
+				r = role
+			}
+		}
+	}
+	return r
+}
+
+// mailboxes lists the selectable folders the account may see, followed by
+// its virtual folders.
+func (m *methods) mailboxes() ([]*mailbox, error) {
+	c, err := m.upstream()
+	if err != nil {
+		return nil, err
+	}
+	var listed []imap.ListEntry
+	err = c.Command(`LIST "" "*"`, func(r imapclient.Response) error {
+		if entry, ok := imap.ParseListEntry([]byte(r.Text)); ok {
+			listed = append(listed, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var mbs []*mailbox
+	names := map[string]bool{}
+	for _, entry := range listed {
+		if entry.HasFlag(`\Noselect`) || entry.HasFlag(`\NonExistent`) || !m.acct.FolderAllowed(entry.Mailbox) {
+			continue
+		}
+		m.login.Listed(entry.Mailbox)
+		mb := &mailbox{name: entry.Mailbox, upstream: entry.Mailbox, delim: entry.Delimiter, role: mailboxRole(entry)}
+		if entry.Delimiter != "" {
+			if i := strings.LastIndex(mb.name, entry.Delimiter); i > 0 {
+				mb.parent = mb.name[:i]
+			}
+		}
+		mbs = append(mbs, mb)
+		names[mb.name] = true
+	}
+	// A parent the account may not see leaves its children at the top.
+	for _, mb := range mbs {
+		if !names[mb.parent] {
+			mb.parent = ""
+		}
+	}
+	for _, vf := range m.acct.VirtualFolders {
+		if m.acct.FolderAllowed(vf.Name) {
+			mbs = append(mbs, &mailbox{name: vf.Name, upstream: vf.Folder, criteria: "(" + vf.Search + ")"})
+		}
+	}
+	return mbs, nil
+}
+
+// findMailbox returns the visible mailbox with the given id.
+func (m *methods) findMailbox(id string) (*mailbox, error) {
+	parts, ok := decodeID(id, 1)
+	if !ok {
+		return nil, nil
+	}
+	mbs, err := m.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	for _, mb := range mbs {
+		if mb.name == parts[0] {
+			return mb, nil
+		}
+	}
+	return nil, nil
+}
+
+// criteria returns the search keys selecting the messages of mb the
+// account may see.
+func (m *methods) criteria(mb *mailbox) string {
+	keys := []string{"ALL"}
+	if mb.criteria != "" {
+		keys = append(keys, mb.criteria)
+	}
+	if v := proxy.VisibilityCriteria(m.acct, mb.upstream, time.Now()); v != "" {
+		keys = append(keys, v)
+	}
+	return strings.Join(keys, " ")
+}
+
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+
+	// Email/get only.
+	FetchTextBodyValues bool `json:"fetchTextBodyValues"`
+	MaxBodyValueBytes   int  `json:"maxBodyValueBytes"`
+}
+
+type getResult struct {
+	AccountID string           `json:"accountId"`
+	State     string           `json:"state"`
+	List      []map[string]any `json:"list"`
+	NotFound  []string         `json:"notFound"`
+}
+
+var mailboxProperties = []string{
+	"id", "name", "parentId", "role", "sortOrder", "totalEmails", "unreadEmails",
+	"totalThreads", "unreadThreads", "myRights", "isSubscribed",
+}
+
+func (m *methods) mailboxGet(raw json.RawMessage) (any, error) {
+	var args getArgs
+	if err := m.decodeArgs(raw, &args, &args.AccountID); err != nil {
+		return nil, err
+	}
+	props, err := properties(args.Properties, mailboxProperties, mailboxProperties)
+	if err != nil {
+		return nil, err
+	}
+	if args.IDs != nil && len(*args.IDs) > maxObjectsInGet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+	mbs, err := m.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]*mailbox{}
+	for _, mb := range mbs {
+		byID[mb.id()] = mb
+	}
+	want := make([]string, 0, len(mbs))
+	if args.IDs == nil {
+		for _, mb := range mbs {
+			want = append(want, mb.id())
+		}
+	} else {
+		want = *args.IDs
+	}
+	counts := props["totalEmails"] || props["unreadEmails"] || props["totalThreads"] || props["unreadThreads"]
+	result := &getResult{AccountID: args.AccountID, State: state, List: []map[string]any{}, NotFound: []string{}}
+	for _, id := range want {
+		mb := byID[id]
+		if mb == nil {
+			result.NotFound = append(result.NotFound, id)
+			continue
+		}
+		var total, unread int
+		if counts {
+			if total, unread, err = m.count(mb); err != nil {
+				return nil, err
+			}
+		}
+		obj := map[string]any{
+			"id":            id,
+			"name":          mb.name,
+			"parentId":      nil,
+			"role":          nil,
+			"sortOrder":     0,
+			"totalEmails":   total,
+			"unreadEmails":  unread,
+			"totalThreads":  total,
+			"unreadThreads": unread,
+			"myRights": map[string]bool{
+				"mayReadItems": true, "mayAddItems": false, "mayRemoveItems": false,
+				"maySetSeen": false, "maySetKeywords": false, "mayCreateChild": false,
+				"mayRename": false, "mayDelete": false, "maySubmit": false,
+			},
+			"isSubscribed": true,
+		}
+		if mb.parent != "" {
+			obj["parentId"] = encodeID(mb.parent)
+			obj["name"] = mb.name[len(mb.parent)+len(mb.delim):]
+		}
+		if mb.role != "" {
+			obj["role"] = mb.role
+		}
+		result.List = append(result.List, pick(obj, props))
+	}
+	return result, nil
+}
+
+// count returns the number of messages in mb and how many are unseen.
+func (m *methods) count(mb *mailbox) (total, unread int, err error) {
+	c, err := m.upstream()
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := c.examine(mb.upstream); err != nil {
+		return 0, 0, err
+	}
+	criteria := m.criteria(mb)
+	all, err := c.Search(criteria)
+	if err != nil {
+		return 0, 0, err
+	}
+	unseen, err := c.Search("UNSEEN " + criteria)
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(all), len(unseen), nil
+}
+
+type queryArgs struct {
+	AccountID string `json:"accountId"`
+	Filter    *struct {
+		InMailbox string `json:"inMailbox"`
+	} `json:"filter"`
+	Sort []struct {
+		Property    string `json:"property"`
+		IsAscending *bool  `json:"isAscending"`
+	} `json:"sort"`
+	Position       int  `json:"position"`
+	Limit          *int `json:"limit"`
+	CalculateTotal bool `json:"calculateTotal"`
+}
+
+type queryResult struct {
+	AccountID           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	IDs                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+	Limit               int      `json:"limit,omitempty"`
+}
+
+// emailQuery lists the messages of one mailbox. Messages are ordered by
+// UID, which follows their arrival, oldest first unless sorted by
+// receivedAt descending.
+func (m *methods) emailQuery(raw json.RawMessage) (any, error) {
+	var args queryArgs
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&args); err != nil {
+		// Unknown filter conditions are the likely cause.
+		if strings.Contains(err.Error(), "unknown field") {
+			return nil, &methodError{Type: "unsupportedFilter", Description: err.Error()}
+		}
+		return nil, invalidArguments("%v", err)
+	}
+	if args.AccountID != accountID(m.acct) {
+		return nil, &methodError{Type: "accountNotFound"}
+	}
+	if args.Filter == nil || args.Filter.InMailbox == "" {
+		return nil, &methodError{Type: "unsupportedFilter", Description: "filter must name inMailbox"}
+	}
+	ascending := true
+	for i, s := range args.Sort {
+		if i > 0 || s.Property != "receivedAt" {
+			return nil, &methodError{Type: "unsupportedSort", Description: "only receivedAt is supported"}
+		}
+		if s.IsAscending != nil {
+			ascending = *s.IsAscending
+		}
+	}
+	limit := maxQueryLimit
+	if args.Limit != nil {
+		if *args.Limit < 0 {
+			return nil, invalidArguments("limit must not be negative")
+		}
+		limit = min(*args.Limit, maxQueryLimit)
+	}
+
+	mb, err := m.findMailbox(args.Filter.InMailbox)
+	if err != nil {
+		return nil, err
+	}
+	result := &queryResult{AccountID: args.AccountID, QueryState: state, IDs: []string{}}
+	if args.Limit == nil || *args.Limit > maxQueryLimit {
+		result.Limit = limit
+	}
+	if mb == nil {
+		// An unknown mailbox matches nothing.
+		if args.CalculateTotal {
+			result.Total = new(int)
+		}
+		return result, nil
+	}
+	c, err := m.upstream()
+	if err != nil {
+		return nil, err
+	}
+	validity, err := c.examine(mb.upstream)
+	if err != nil {
+		return nil, err
+	}
+	m.login.Selected(mb.name)
+	uids, err := c.Search(m.criteria(mb))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(uids)
+	if !ascending {
+		slices.Reverse(uids)
+	}
+	pos := args.Position
+	if pos < 0 {
+		pos = max(len(uids)+pos, 0)
+	}
+	pos = min(pos, len(uids))
+	result.Position = pos
+	for _, uid := range uids[pos:min(pos+limit, len(uids))] {
+		result.IDs = append(result.IDs, emailID(mb, validity, uid))
+	}
+	if args.CalculateTotal {
+		total := len(uids)
+		result.Total = &total
+	}
+	return result, nil
+}
+
+func emailID(mb *mailbox, validity string, uid uint32) string {
+	return encodeID(mb.name, validity, strconv.FormatUint(uint64(uid), 10))
+}
+
+var (
+	emailProperties = []string{
+		"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+		"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+		"replyTo", "subject", "sentAt", "hasAttachment", "preview", "textBody", "bodyValues",
+	}
+	defaultEmailProperties = []string{
+		"id", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+		"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+		"replyTo", "subject", "sentAt", "preview",
+	}
+)
+
+// emailGet fetches messages by id. Each id names the mailbox it was found
+// in, and the message must still be visible there.
+func (m *methods) emailGet(raw json.RawMessage) (any, error) {
+	var args getArgs
+	if err := m.decodeArgs(raw, &args, &args.AccountID); err != nil {
+		return nil, err
+	}
+	props, err := properties(args.Properties, emailProperties, defaultEmailProperties)
+	if err != nil {
+		return nil, err
+	}
+	if args.IDs == nil {
+		return nil, &methodError{Type: "requestTooLarge", Description: "ids must be given"}
+	}
+	if len(*args.IDs) > maxObjectsInGet {
+		return nil, &methodError{Type: "requestTooLarge"}
+	}
+	needBody := props["preview"] || props["textBody"] || props["bodyValues"] || props["hasAttachment"]
+
+	result := &getResult{AccountID: args.AccountID, State: state, List: []map[string]any{}, NotFound: []string{}}
+	// Group the ids by mailbox so that each is examined once.
+	type ref struct {
+		id       string
+		validity string
+		uid      uint32
+	}
+	byMailbox := map[string][]ref{}
+	for _, id := range *args.IDs {
+		parts, ok := decodeID(id, 3)
+		if !ok {
+			result.NotFound = append(result.NotFound, id)
+			continue
+		}
+		uid, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil || uid == 0 {
+			result.NotFound = append(result.NotFound, id)
+			continue
+		}
+		byMailbox[parts[0]] = append(byMailbox[parts[0]], ref{id, parts[1], uint32(uid)})
+	}
+	if len(byMailbox) == 0 {
+		return result, nil
+	}
+	mbs, err := m.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]map[string]any{}
+	for _, name := range slices.Sorted(maps.Keys(byMailbox)) {
+		refs := byMailbox[name]
+		i := slices.IndexFunc(mbs, func(mb *mailbox) bool { return mb.name == name })
+		if i < 0 {
+			continue
+		}
+		mb := mbs[i]
+		c, err := m.upstream()
+		if err != nil {
+			return nil, err
+		}
+		validity, err := c.examine(mb.upstream)
+		if err != nil {
+			return nil, err
+		}
+		m.login.Selected(mb.name)
+		var uids []uint32
+		for _, r := range refs {
+			if r.validity == validity {
+				uids = append(uids, r.uid)
+			}
+		}
+		if len(uids) == 0 {
+			continue
+		}
+		set := imap.FormatSeqSet(uids)
+		visible, err := c.Search("UID " + set + " " + m.criteria(mb))
+		if err != nil {
+			return nil, err
+		}
+		if len(visible) == 0 {
+			continue
+		}
+		if err := m.login.CheckQuota(); err != nil {
+			return nil, &methodError{Type: "overQuota", Description: err.Error()}
+		}
+		item := "BODY.PEEK[HEADER]"
+		if needBody {
+			item = "BODY.PEEK[]"
+		}
+		err = c.Command(fmt.Sprintf("UID FETCH %s (UID FLAGS INTERNALDATE RFC822.SIZE %s)", imap.FormatSeqSet(visible), item), func(r imapclient.Response) error {
+			msg, ok := parseFetch(r)
+			if !ok || !slices.Contains(visible, msg.uid) {
+				return nil
+			}
+			m.login.Fetched(len(msg.data))
+			id := emailID(mb, validity, msg.uid)
+			found[id] = m.email(id, mb, msg, props, args)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range *args.IDs {
+		if obj, ok := found[id]; ok {
+			result.List = append(result.List, pick(obj, props))
+		} else if !slices.Contains(result.NotFound, id) {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+	return result, nil
+}
+
+// fetched is a message from a UID FETCH.
+type fetched struct {
+	uid   uint32
+	flags []string
+	date  time.Time
+	size  int64
+	data  []byte // the header, or the whole message
+}
+
+func parseFetch(r imapclient.Response) (fetched, bool) {
+	fields := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(r.Text))
+	if len(fields) < 3 || fields[0] != "*" || !strings.EqualFold(fields[2], "FETCH") || len(r.Literals) != 1 {
+		return fetched{}, false
+	}
+	msg := fetched{data: r.Literals[0]}
+	for i := 3; i+1 < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "UID":
+			n, _ := strconv.ParseUint(fields[i+1], 10, 32)
+			msg.uid = uint32(n)
+		case "RFC822.SIZE":
+			msg.size, _ = strconv.ParseInt(fields[i+1], 10, 64)
+		case "FLAGS":
+			for j := i + 2; j < len(fields) && fields[j] != ")"; j++ {
+				msg.flags = append(msg.flags, fields[j])
+			}
+		}
+	}
+	if i := strings.Index(strings.ToUpper(r.Text), `INTERNALDATE "`); i >= 0 {
+		date, _, _ := strings.Cut(r.Text[i+len(`INTERNALDATE "`):], `"`)
+		msg.date, _ = time.Parse("_2-Jan-2006 15:04:05 -0700", date)
+	}
+	return msg, msg.uid != 0
+}
+
+// keywords maps IMAP system flags to JMAP keywords.
+var keywords = map[string]string{
+	`\SEEN`: "$seen", `\FLAGGED`: "$flagged", `\ANSWERED`: "$answered", `\DRAFT`: "$draft",
+}
+
+// email builds the Email object for a fetched message, computing only the
+// body properties that were asked for.
+func (m *methods) email(id string, mb *mailbox, msg fetched, props map[string]bool, args getArgs) map[string]any {
+	data := proxy.ScrubMessage(m.acct, msg.data)
+	kw := map[string]bool{}
+	for _, f := range msg.flags {
+		if k, ok := keywords[strings.ToUpper(f)]; ok {
+			kw[k] = true
+		} else if !strings.HasPrefix(f, `\`) {
+			kw[strings.ToLower(f)] = true
+		}
+	}
+	obj := map[string]any{
+		"id":         id,
+		"blobId":     id,
+		"threadId":   id,
+		"mailboxIds": map[string]bool{mb.id(): true},
+		"keywords":   kw,
+		"size":       msg.size,
+		"receivedAt": msg.date.UTC().Format(time.RFC3339),
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		m.logger.Warn("JMAP could not parse message header", "folder", mb.upstream, "uid", msg.uid, "err", err)
+		return obj
+	}
+	h := parsed.Header
+	obj["messageId"] = messageIDs(h.Get("Message-Id"))
+	obj["inReplyTo"] = messageIDs(h.Get("In-Reply-To"))
+	obj["references"] = messageIDs(h.Get("References"))
+	for prop, name := range map[string]string{"sender": "Sender", "from": "From", "to": "To", "cc": "Cc", "bcc": "Bcc", "replyTo": "Reply-To"} {
+		obj[prop] = addresses(h.Get(name))
+	}
+	obj["subject"] = nil
+	if v := h.Get("Subject"); v != "" {
+		obj["subject"] = decodeHeader(v)
+	}
+	obj["sentAt"] = nil
+	if t, err := h.Date(); err == nil {
+		obj["sentAt"] = t.Format(time.RFC3339)
+	}
+	if !props["preview"] && !props["textBody"] && !props["bodyValues"] && !props["hasAttachment"] {
+		return obj
+	}
+
+	text, attachments := textPart(h.Get("Content-Type"), h.Get("Content-Transfer-Encoding"), parsed.Body)
+	obj["hasAttachment"] = attachments
+	preview := strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(preview) > previewLength {
+		preview = string([]rune(preview)[:previewLength])
+	}
+	obj["preview"] = preview
+	obj["textBody"] = []map[string]any{{"partId": "1", "type": "text/plain"}}
+	values := map[string]any{}
+	if args.FetchTextBodyValues {
+		value, truncated := text, false
+		if n := args.MaxBodyValueBytes; n > 0 && len(value) > n {
+			for n > 0 && !utf8.RuneStart(value[n]) {
+				n--
+			}
+			value, truncated = value[:n], true
+		}
+		values["1"] = map[string]any{"value": value, "isEncodingProblem": !utf8.ValidString(text), "isTruncated": truncated}
+	}
+	obj["bodyValues"] = values
+	return obj
+}
+
+// textPart returns the first text/plain part of a message body, decoded,
+// and whether the message has other parts with a file name.
+func textPart(contentType, encoding string, body io.Reader) (text string, attachments bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		found := false
+		for {
+			part, err := mr.NextRawPart()
+			if err != nil {
+				return text, attachments
+			}
+			if part.FileName() != "" {
+				attachments = true
+				continue
+			}
+			t, a := textPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			attachments = attachments || a
+			if !found && t != "" {
+				text, found = t, true
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", false
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, _ := io.ReadAll(body)
+	s := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if charset := strings.ToLower(params["charset"]); charset == "iso-8859-1" || charset == "latin1" {
+		var b strings.Builder
+		for _, c := range []byte(s) {
+			b.WriteRune(rune(c))
+		}
+		s = b.String()
+	}
+	return s, false
+}
+
+// messageIDs returns the message ids in a Message-ID, In-Reply-To or
+// References header, or nil when there are none.
+func messageIDs(v string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(v, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(v[start:], '>')
+		if end < 0 {
+			break
+		}
+		ids = append(ids, v[start+1:start+end])
+		v = v[start+end+1:]
+	}
+	return ids
+}
+
+type emailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+// Encoded words in charsets other than UTF-8, US-ASCII and ISO-8859-1
+// are left as they are.
+var (
+	wordDecoder   = &mime.WordDecoder{}
+	addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+)
+
+// addresses parses an address header, or returns nil when it is absent
+// or unparsable.
+func addresses(v string) []emailAddress {
+	if v == "" {
+		return nil
+	}
+	list, err := addressParser.ParseList(v)
+	if err != nil {
+		return nil
+	}
+	out := make([]emailAddress, len(list))
+	for i, a := range list {
+		out[i].Email = a.Address
+		if a.Name != "" {
+			out[i].Name = &a.Name
+		}
+	}
+	return out
+}
+
+func decodeHeader(v string) string {
+	if s, err := wordDecoder.DecodeHeader(v); err == nil {
+		return s
+	}
+	return v
+}
+
+// properties returns the requested properties as a set, checking them
+// against the supported ones. id is always included.
+func properties(requested *[]string, supported, defaults []string) (map[string]bool, error) {
+	list := defaults
+	if requested != nil {
+		list = *requested
+	}
+	props := map[string]bool{"id": true}
+	for _, p := range list {
+		if !slices.Contains(supported, p) {
+			return nil, invalidArguments("unknown property %q", p)
+		}
+		props[p] = true
+	}
+	return props, nil
+}
+
+// pick returns the requested properties of obj.
+func pick(obj map[string]any, props map[string]bool) map[string]any {
+	out := make(map[string]any, len(props))
+	for p := range props {
+		if v, ok := obj[p]; ok {
+			out[p] = v
+		}
+	}
+	return out
+}
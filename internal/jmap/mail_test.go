@@ -0,0 +1,200 @@
+package jmap
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/imaptest"
+	"imap-proxy/internal/quota"
+)
+
+var testDate = time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)
+
+// testMail is the upstream mail. Sent and INBOX/Sub are empty.
+var testMail = map[string][]imaptest.Message{
+	"INBOX": {
+		{UID: 3, Flags: "S", Date: testDate, Body: "From: Alice <alice@example.com>\r\nTo: bob@example.com\r\nSubject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n" +
+			"Date: Tue, 2 Jan 2024 09:00:00 +0100\r\nMessage-ID: <m1@example.com>\r\nX-Secret: s\r\n\r\nHello\r\n  world\r\n"},
+		{UID: 5, Date: testDate, Body: "From: spam@example.com\r\nSubject: spam\r\n\r\nbuy\r\n"},
+		{UID: 8, Date: testDate, Body: "From: carol@example.com\r\nSubject: multi\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\ncaf=C3=A9\r\n" +
+			"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=a.pdf\r\n\r\nxx\r\n--b--\r\n"},
+	},
+	"INBOX/Sub": nil,
+	"Sent":      nil,
+	"Private":   {{UID: 1, Date: testDate, Body: "Subject: private\r\n\r\nx\r\n"}},
+}
+
+func newMailServer(t *testing.T) (*Server, string, *imaptest.Server) {
+	t.Helper()
+	up := imaptest.NewServerWith(testMail)
+	t.Cleanup(up.Close)
+	acct := up.Account("reader1", "localpass1")
+	acct.BlockedFolders = []string{"Private"}
+	acct.HideFrom = []string{"spam@example.com"}
+	acct.RemoveHeaders = []string{"X-Secret"}
+	acct.VirtualFolders = []config.VirtualFolder{{Name: "Unread", Folder: "INBOX", Search: "UNSEEN"}}
+	cfg := &config.Config{Accounts: []config.AccountConfig{acct}}
+	s := newTestServer(cfg)
+	s.Upstream.Dial = up.Dial
+	return s, accountID(&cfg.Accounts[0]), up
+}
+
+// results returns the arguments of each method response, by call id.
+func results(t *testing.T, resp map[string]any) map[string]map[string]any {
+	t.Helper()
+	out := map[string]map[string]any{}
+	for _, r := range resp["methodResponses"].([]any) {
+		inv := r.([]any)
+		if inv[0] == "error" {
+			t.Errorf("call %v failed: %v", inv[2], inv[1])
+		}
+		out[inv[2].(string)] = inv[1].(map[string]any)
+	}
+	return out
+}
+
+func TestMailboxGet(t *testing.T) {
+	s, acct, _ := newMailServer(t)
+	_, resp := post(t, s, `{"using":["urn:ietf:params:jmap:mail"],"methodCalls":[["Mailbox/get",{"accountId":"`+acct+`"},"m"]]}`)
+	list := results(t, resp)["m"]["list"].([]any)
+	var got []string
+	for _, item := range list {
+		mb := item.(map[string]any)
+		got = append(got, fmt.Sprintf("%v role=%v parent=%v total=%v unread=%v", mb["name"], mb["role"], mb["parentId"] != nil, mb["totalEmails"], mb["unreadEmails"]))
+	}
+	want := []string{
+		"INBOX role=inbox parent=false total=2 unread=1",
+		"Sub role=<nil> parent=true total=0 unread=0",
+		"Sent role=<nil> parent=false total=0 unread=0",
+		"Unread role=<nil> parent=false total=1 unread=1",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("mailboxes:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestEmailQueryAndGet(t *testing.T) {
+	s, acct, up := newMailServer(t)
+	inbox := encodeID("INBOX")
+	_, resp := post(t, s, `{"using":["urn:ietf:params:jmap:mail"],"methodCalls":[
+		["Email/query",{"accountId":"`+acct+`","filter":{"inMailbox":"`+inbox+`"},"sort":[{"property":"receivedAt","isAscending":false}],"calculateTotal":true},"q"],
+		["Email/get",{"accountId":"`+acct+`","#ids":{"resultOf":"q","name":"Email/query","path":"/ids"},
+			"properties":["subject","from","keywords","sentAt","receivedAt","messageId","preview","hasAttachment","bodyValues"],"fetchTextBodyValues":true},"g"]
+	]}`)
+	res := results(t, resp)
+	ids := res["q"]["ids"].([]any)
+	if len(ids) != 2 || res["q"]["total"] != 2.0 || ids[0] != encodeID("INBOX", "1", "8") {
+		t.Fatalf("query = %v, want the two visible messages, newest first", res["q"])
+	}
+	list := res["g"]["list"].([]any)
+	if len(list) != 2 {
+		t.Fatalf("get = %v", res["g"])
+	}
+	multi, first := list[0].(map[string]any), list[1].(map[string]any)
+	if first["subject"] != "Grüße" || first["preview"] != "Hello world" || first["messageId"].([]any)[0] != "m1@example.com" {
+		t.Errorf("first message = %v", first)
+	}
+	if from := first["from"].([]any)[0].(map[string]any); from["name"] != "Alice" || from["email"] != "alice@example.com" {
+		t.Errorf("from = %v", from)
+	}
+	if kw := first["keywords"].(map[string]any); kw["$seen"] != true || len(kw) != 1 {
+		t.Errorf("keywords = %v", kw)
+	}
+	if first["sentAt"] != "2024-01-02T09:00:00+01:00" || first["receivedAt"] != "2024-01-02T09:00:00Z" {
+		t.Errorf("dates = %v, %v", first["sentAt"], first["receivedAt"])
+	}
+	body := multi["bodyValues"].(map[string]any)["1"].(map[string]any)
+	if body["value"] != "café" || multi["hasAttachment"] != true {
+		t.Errorf("multipart message = %v", multi)
+	}
+
+	for _, cmd := range up.Received() {
+		if strings.Contains(cmd, "FETCH") && (!strings.Contains(cmd, "PEEK") || strings.Contains(cmd, "5")) {
+			t.Errorf("upstream received %q", cmd)
+		}
+	}
+}
+
+func TestEmailGetQuota(t *testing.T) {
+	s, acct, _ := newMailServer(t)
+	s.cfg.Accounts[0].DailyDownloadQuotaMB = 1
+	store := quota.NewStore()
+	s.gateway.SetQuotaStore(store)
+	body := `{"using":["urn:ietf:params:jmap:mail"],"methodCalls":[
+		["Email/get",{"accountId":"` + acct + `","ids":["` + encodeID("INBOX", "1", "3") + `"],"properties":["preview"]},"g"]]}`
+	post(t, s, body)
+	if used, want := store.Used("reader1"), int64(len(testMail["INBOX"][0].Body)); used != want {
+		t.Errorf("quota used = %d, want %d", used, want)
+	}
+	store.Add("reader1", 1<<20)
+	_, resp := post(t, s, body)
+	inv := resp["methodResponses"].([]any)[0].([]any)
+	if inv[0] != "error" || inv[1].(map[string]any)["type"] != "overQuota" {
+		t.Errorf("over quota: response %v", inv)
+	}
+}
+
+func TestEmailGetHidden(t *testing.T) {
+	s, acct, _ := newMailServer(t)
+	ids := []string{
+		encodeID("INBOX", "1", "5"),   // hidden by hide_from
+		encodeID("Private", "1", "1"), // blocked folder
+		encodeID("INBOX", "2", "3"),   // stale UIDVALIDITY
+		"not-an-id",
+		encodeID("INBOX", "1", "3"),
+	}
+	_, resp := post(t, s, `{"using":[],"methodCalls":[["Email/get",{"accountId":"`+acct+`","ids":["`+strings.Join(ids, `","`)+`"],"properties":["subject"]},"g"]]}`)
+	res := results(t, resp)["g"]
+	if list := res["list"].([]any); len(list) != 1 || list[0].(map[string]any)["subject"] != "Grüße" {
+		t.Errorf("list = %v, want only the visible message", list)
+	}
+	if notFound := res["notFound"].([]any); len(notFound) != 4 {
+		t.Errorf("notFound = %v, want the other 4 ids", notFound)
+	}
+}
+
+func TestEmailScrubsHeaders(t *testing.T) {
+	s, _, _ := newMailServer(t)
+	acct := s.cfg.Accounts[0]
+	acct.RemoveHeaders = []string{"From"}
+	m := &methods{server: s, acct: &acct, logger: s.logger}
+	obj := m.email("x", &mailbox{name: "INBOX"}, fetched{uid: 3, data: []byte(testMail["INBOX"][0].Body)}, map[string]bool{}, getArgs{})
+	if from, _ := obj["from"].([]emailAddress); len(from) != 0 || obj["subject"] != "Grüße" {
+		t.Errorf("from = %v, subject = %v; want From removed", obj["from"], obj["subject"])
+	}
+}
+
+func TestEmailKeywords(t *testing.T) {
+	s, _, _ := newMailServer(t)
+	m := &methods{server: s, acct: &s.cfg.Accounts[0], logger: s.logger}
+	msg := fetched{uid: 3, flags: []string{`\Seen`, `\Answered`, `\Recent`, "$Label"}, data: []byte("Subject: x\r\n\r\n")}
+	kw := m.email("x", &mailbox{name: "INBOX"}, msg, map[string]bool{}, getArgs{})["keywords"]
+	if want := map[string]bool{"$seen": true, "$answered": true, "$label": true}; !reflect.DeepEqual(kw, want) {
+		t.Errorf("keywords = %v, want %v", kw, want)
+	}
+}
+
+func TestMailboxRole(t *testing.T) {
+	tests := []struct {
+		entry imap.ListEntry
+		want  string
+	}{
+		{imap.ListEntry{Mailbox: "INBOX"}, "inbox"},
+		{imap.ListEntry{Mailbox: "inbox"}, "inbox"},
+		{imap.ListEntry{Mailbox: "Sent", Flags: []string{`\HasNoChildren`, `\Sent`}}, "sent"},
+		{imap.ListEntry{Mailbox: "Gesendet", Flags: []string{`\sent`}}, "sent"},
+		{imap.ListEntry{Mailbox: "Sent"}, ""},
+	}
+	for _, tt := range tests {
+		if got := mailboxRole(tt.entry); got != tt.want {
+			t.Errorf("mailboxRole(%+v) = %q, want %q", tt.entry, got, tt.want)
+		}
+	}
+}
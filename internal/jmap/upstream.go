@@ -0,0 +1,32 @@
+package jmap
+
+import (
+	"time"
+
+	"imap-proxy/internal/imapclient"
+)
+
+// commandTimeout bounds the response to each upstream command.
+const commandTimeout = time.Minute
+
+// conn is an upstream IMAP connection opened for one API request.
+type conn struct {
+	*imapclient.Conn
+	examined string // the upstream folder last examined
+	validity string // its UIDVALIDITY
+}
+
+// examine opens folder read-only unless it is already open, and returns its
+// UIDVALIDITY.
+func (c *conn) examine(folder string) (string, error) {
+	if c.examined == folder {
+		return c.validity, nil
+	}
+	c.examined = ""
+	validity, err := c.Examine(folder)
+	if err != nil {
+		return "", err
+	}
+	c.examined, c.validity = folder, validity
+	return validity, nil
+}
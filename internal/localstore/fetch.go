@@ -0,0 +1,509 @@
+package localstore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// part is a node of a message's MIME structure, over the message bytes.
+type part struct {
+	header   []byte // including the blank line
+	body     []byte
+	fields   textproto.MIMEHeader
+	typ, sub string // lowercase
+	params   map[string]string
+	children []*part // of a multipart
+	msg      *part   // of a message/rfc822
+}
+
+// maxPartDepth bounds MIME nesting.
+const maxPartDepth = 20
+
+// parsePart parses an entity. defaultType applies when it has no valid
+// Content-Type, which is message/rfc822 inside multipart/digest.
+func parsePart(b []byte, defaultType string, depth int) *part {
+	p := &part{}
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		p.header, p.body = b[:i+4], b[i+4:]
+	} else if bytes.HasPrefix(b, []byte("\r\n")) {
+		p.header, p.body = b[:2], b[2:]
+	} else {
+		p.header = b
+	}
+	p.fields, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(append(slices.Clip(p.header), "\r\n"...)))).ReadMIMEHeader()
+	mediaType, params, err := mime.ParseMediaType(p.fields.Get("Content-Type"))
+	if err != nil || !strings.Contains(mediaType, "/") {
+		mediaType, params = defaultType, map[string]string{}
+		if defaultType == "text/plain" {
+			params["charset"] = "us-ascii"
+		}
+	}
+	p.typ, p.sub, _ = strings.Cut(mediaType, "/")
+	p.params = params
+	if depth >= maxPartDepth {
+		return p
+	}
+	switch {
+	case p.typ == "multipart" && params["boundary"] != "":
+		childType := "text/plain"
+		if p.sub == "digest" {
+			childType = "message/rfc822"
+		}
+		for _, b := range splitMultipart(p.body, params["boundary"]) {
+			p.children = append(p.children, parsePart(b, childType, depth+1))
+		}
+	case p.isMessage():
+		p.msg = parsePart(p.body, "text/plain", depth+1)
+	}
+	return p
+}
+
+func (p *part) isMessage() bool {
+	return p.typ == "message" && p.sub == "rfc822"
+}
+
+// splitMultipart returns the body parts between the boundary delimiter
+// lines of a multipart body. The CRLF before each delimiter belongs to the
+// delimiter.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for pos := 0; pos < len(body); {
+		end := bytes.Index(body[pos:], []byte("\n"))
+		line := body[pos:]
+		if end >= 0 {
+			line = body[pos : pos+end+1]
+		}
+		if rest, ok := bytes.CutPrefix(bytes.TrimRight(line, " \t\r\n"), delimiter); ok && (len(rest) == 0 || string(rest) == "--") {
+			if start >= 0 {
+				parts = append(parts, bytes.TrimSuffix(body[start:pos], []byte("\r\n")))
+			}
+			if string(rest) == "--" {
+				return parts
+			}
+			start = pos + len(line)
+		}
+		pos += len(line)
+	}
+	if start >= 0 && start < len(body) {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+// section is a parsed BODY[...] section specification.
+type section struct {
+	path   []int
+	spec   string   // "", HEADER, HEADER.FIELDS, HEADER.FIELDS.NOT, TEXT or MIME
+	fields []string // for HEADER.FIELDS and HEADER.FIELDS.NOT
+}
+
+// parseSection parses the text between the brackets of BODY[...].
+func parseSection(s string) (section, error) {
+	var sec section
+	for s != "" {
+		num, rest, _ := strings.Cut(s, ".")
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			break
+		}
+		if n <= 0 {
+			return sec, errSyntax
+		}
+		sec.path = append(sec.path, n)
+		s = rest
+	}
+	spec, list, hasList := strings.Cut(s, " ")
+	sec.spec = strings.ToUpper(spec)
+	switch sec.spec {
+	case "", "HEADER", "TEXT":
+		if hasList {
+			return sec, errSyntax
+		}
+	case "MIME":
+		if hasList || len(sec.path) == 0 {
+			return sec, errSyntax
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		toks, err := tokenize(list)
+		if err != nil || len(toks) != 1 || !toks[0].isList || len(toks[0].list) == 0 {
+			return sec, errSyntax
+		}
+		for _, t := range toks[0].list {
+			name, ok := t.text()
+			if !ok {
+				return sec, errSyntax
+			}
+			sec.fields = append(sec.fields, strings.ToUpper(name))
+		}
+	default:
+		return sec, errSyntax
+	}
+	return sec, nil
+}
+
+// String formats the section as it appears in the FETCH response.
+func (sec section) String() string {
+	var parts []string
+	for _, n := range sec.path {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	if sec.spec != "" {
+		spec := sec.spec
+		if sec.fields != nil {
+			spec += " (" + strings.Join(sec.fields, " ") + ")"
+		}
+		parts = append(parts, spec)
+	}
+	return strings.Join(parts, ".")
+}
+
+// extract returns the section of the message rooted at root, or nil when
+// the message has no such part.
+func (sec section) extract(whole []byte, root *part) []byte {
+	p := root
+	for i, n := range sec.path {
+		if i > 0 && p.isMessage() {
+			p = p.msg
+		}
+		switch {
+		case p.children != nil:
+			if n > len(p.children) {
+				return nil
+			}
+			p = p.children[n-1]
+		case n != 1:
+			return nil
+		}
+	}
+	msg := p
+	if len(sec.path) > 0 {
+		msg = p.msg
+	}
+	switch sec.spec {
+	case "":
+		if len(sec.path) == 0 {
+			return whole
+		}
+		return p.body
+	case "MIME":
+		return p.header
+	}
+	if msg == nil {
+		return nil
+	}
+	switch sec.spec {
+	case "HEADER":
+		return msg.header
+	case "TEXT":
+		return msg.body
+	default:
+		return filterHeader(msg.header, sec.fields, sec.spec == "HEADER.FIELDS")
+	}
+}
+
+// filterHeader returns the header lines, with their continuations, whose
+// field name is in names (keep) or not in names (!keep), followed by a
+// blank line.
+func filterHeader(header []byte, names []string, keep bool) []byte {
+	var out []byte
+	include := false
+	for len(header) > 0 {
+		line := header
+		if i := bytes.Index(header, []byte("\r\n")); i >= 0 {
+			line = header[:i+2]
+		}
+		header = header[len(line):]
+		if string(line) == "\r\n" {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			include = slices.Contains(names, strings.ToUpper(string(bytes.TrimSpace(name)))) == keep
+		}
+		if include {
+			out = append(out, line...)
+		}
+	}
+	return append(out, "\r\n"...)
+}
+
+// headerValue returns the unfolded value of a header field of p, or "".
+func (p *part) headerValue(name string) string {
+	v := p.fields.Get(name)
+	return strings.Join(strings.Fields(strings.NewReplacer("\r\n", " ", "\n", " ").Replace(v)), " ")
+}
+
+// envelope formats the ENVELOPE of a message.
+func envelope(p *part) string {
+	from := addressList(p, "From")
+	sender, replyTo := addressList(p, "Sender"), addressList(p, "Reply-To")
+	if sender == "NIL" {
+		sender = from
+	}
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return "(" + strings.Join([]string{
+		nstring(p.headerValue("Date")),
+		nstring(p.headerValue("Subject")),
+		from, sender, replyTo,
+		addressList(p, "To"), addressList(p, "Cc"), addressList(p, "Bcc"),
+		nstring(p.headerValue("In-Reply-To")),
+		nstring(p.headerValue("Message-Id")),
+	}, " ") + ")"
+}
+
+// addressList formats an address header field for ENVELOPE. Display
+// names are re-encoded as RFC 2047 words when they are not ASCII.
+func addressList(p *part, name string) string {
+	v := p.headerValue(name)
+	if v == "" {
+		return "NIL"
+	}
+	addrs, err := mail.ParseAddressList(v)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, a := range addrs {
+		local, host, _ := strings.Cut(a.Address, "@")
+		fmt.Fprintf(&b, "(%s NIL %s %s)", nstring(mime.QEncoding.Encode("utf-8", a.Name)), nstring(local), nstring(host))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// bodyStructure formats BODYSTRUCTURE, or BODY without extension data
+// when ext is false.
+func bodyStructure(p *part, ext bool) string {
+	if p.children != nil {
+		var b strings.Builder
+		b.WriteByte('(')
+		for _, c := range p.children {
+			b.WriteString(bodyStructure(c, ext))
+		}
+		b.WriteString(" " + quote(strings.ToUpper(p.sub)))
+		if ext {
+			b.WriteString(" " + paramList(p.params) + " " + disposition(p) + " NIL NIL")
+		}
+		b.WriteByte(')')
+		return b.String()
+	}
+	fields := []string{
+		quote(strings.ToUpper(p.typ)), quote(strings.ToUpper(p.sub)), paramList(p.params),
+		nstring(p.headerValue("Content-Id")), nstring(p.headerValue("Content-Description")),
+		quote(strings.ToUpper(orDefault(p.headerValue("Content-Transfer-Encoding"), "7bit"))),
+		strconv.Itoa(len(p.body)),
+	}
+	switch {
+	case p.isMessage() && p.msg != nil:
+		fields = append(fields, envelope(p.msg), bodyStructure(p.msg, ext), strconv.Itoa(bytes.Count(p.body, []byte("\n"))))
+	case p.typ == "text":
+		fields = append(fields, strconv.Itoa(bytes.Count(p.body, []byte("\n"))))
+	}
+	if ext {
+		fields = append(fields, nstring(p.headerValue("Content-Md5")), disposition(p), "NIL", "NIL")
+	}
+	return "(" + strings.Join(fields, " ") + ")"
+}
+
+// orDefault returns s, or def when s is empty.
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// paramList formats MIME parameters as a list of name/value pairs, or NIL.
+func paramList(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	var pairs []string
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		pairs = append(pairs, quote(strings.ToUpper(name)), quote(params[name]))
+	}
+	return "(" + strings.Join(pairs, " ") + ")"
+}
+
+// disposition formats a part's Content-Disposition, or NIL.
+func disposition(p *part) string {
+	d, params, err := mime.ParseMediaType(p.fields.Get("Content-Disposition"))
+	if err != nil {
+		return "NIL"
+	}
+	return "(" + quote(strings.ToUpper(d)) + " " + paramList(params) + ")"
+}
+
+// fetchItem is one requested FETCH data item.
+type fetchItem struct {
+	name    string // FLAGS, UID, BODY[...], ...
+	sec     section
+	partial bool
+	start   int
+	count   int
+}
+
+// fetchMacros expand to their items.
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+// parseFetchItems parses the data items of a FETCH. UID FETCH always
+// returns the UID.
+func parseFetchItems(t token, uid bool) ([]fetchItem, error) {
+	var atoms []string
+	switch {
+	case t.isList:
+		for _, item := range t.list {
+			if item.atom == "" {
+				return nil, errSyntax
+			}
+			atoms = append(atoms, item.atom)
+		}
+	case fetchMacros[strings.ToUpper(t.atom)] != nil:
+		atoms = fetchMacros[strings.ToUpper(t.atom)]
+	default:
+		atoms = []string{t.atom}
+	}
+	var items []fetchItem
+	if uid {
+		items = append(items, fetchItem{name: "UID"})
+	}
+	for _, a := range atoms {
+		item, err := parseFetchItem(a)
+		if err != nil {
+			return nil, err
+		}
+		if item.name != "UID" || !uid {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func parseFetchItem(a string) (fetchItem, error) {
+	upper := strings.ToUpper(a)
+	switch upper {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY", "BODYSTRUCTURE",
+		"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return fetchItem{name: upper}, nil
+	}
+	rest, ok := strings.CutPrefix(upper, "BODY.PEEK[")
+	if !ok {
+		rest, ok = strings.CutPrefix(upper, "BODY[")
+	}
+	end := strings.LastIndexByte(a, ']')
+	if !ok || end < 0 {
+		return fetchItem{}, errSyntax
+	}
+	start := len(a) - len(rest)
+	sec, err := parseSection(a[start:end])
+	if err != nil {
+		return fetchItem{}, err
+	}
+	item := fetchItem{name: "BODY", sec: sec}
+	if partial := a[end+1:]; partial != "" {
+		origin, count, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(partial, "<"), ">"), ".")
+		var err1, err2 error
+		item.start, err1 = strconv.Atoi(origin)
+		item.count, err2 = strconv.Atoi(count)
+		if !ok || !strings.HasPrefix(partial, "<") || !strings.HasSuffix(partial, ">") ||
+			err1 != nil || err2 != nil || item.start < 0 || item.count <= 0 {
+			return fetchItem{}, errSyntax
+		}
+		item.partial = true
+	}
+	item.name = "BODY[" + sec.String() + "]"
+	return item, nil
+}
+
+// needsContent reports whether any item needs the message contents.
+func needsContent(items []fetchItem, m *message) bool {
+	for _, item := range items {
+		switch item.name {
+		case "UID", "FLAGS", "INTERNALDATE":
+		case "RFC822.SIZE":
+			if m.size < 0 {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// fetchResponse formats the data items of m for a FETCH response.
+func fetchResponse(m *message, items []fetchItem) (string, error) {
+	var content []byte
+	var root *part
+	if needsContent(items, m) {
+		var err error
+		if content, err = m.content(); err != nil {
+			return "", err
+		}
+		root = parsePart(content, "text/plain", 0)
+	}
+	var out []string
+	for _, item := range items {
+		var value string
+		switch item.name {
+		case "UID":
+			value = strconv.FormatUint(uint64(m.uid), 10)
+		case "FLAGS":
+			value = "(" + strings.Join(m.flags, " ") + ")"
+		case "INTERNALDATE":
+			value = `"` + m.date.Format("02-Jan-2006 15:04:05 -0700") + `"`
+		case "RFC822.SIZE":
+			size, err := m.rfc822Size()
+			if err != nil {
+				return "", err
+			}
+			value = strconv.FormatInt(size, 10)
+		case "ENVELOPE":
+			value = envelope(root)
+		case "BODY":
+			value = bodyStructure(root, false)
+		case "BODYSTRUCTURE":
+			value = bodyStructure(root, true)
+		case "RFC822":
+			value = literal(content)
+		case "RFC822.HEADER":
+			value = literal(root.header)
+		case "RFC822.TEXT":
+			value = literal(root.body)
+		default:
+			data := item.sec.extract(content, root)
+			name := item.name
+			if item.partial {
+				name += "<" + strconv.Itoa(item.start) + ">"
+				data = data[min(item.start, len(data)):]
+				data = data[:min(item.count, len(data))]
+			}
+			out = append(out, name+" "+literal(data))
+			continue
+		}
+		out = append(out, item.name+" "+value)
+	}
+	return strings.Join(out, " "), nil
+}
+
+// literal formats data as an IMAP literal.
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
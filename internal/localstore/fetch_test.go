@@ -0,0 +1,114 @@
+package localstore
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const multipartMessage = "From: =?utf-8?q?J=C3=BCrgen?= <j@example.com>\r\n" +
+	"To: a@example.com, \"B\" <b@example.org>\r\n" +
+	"Subject: report\r\n" +
+	"Date: Tue, 2 Jan 2024 09:00:00 +0100\r\n" +
+	"Message-ID: <m1@example.com>\r\n" +
+	"Content-Type: multipart/mixed; boundary=b1\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"hello\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: inner\r\n" +
+	"\r\n" +
+	"inner body\r\n" +
+	"--b1--\r\n"
+
+func TestSectionExtract(t *testing.T) {
+	root := parsePart([]byte(multipartMessage), "text/plain", 0)
+	tests := []struct {
+		section, want string
+	}{
+		{"1", "hello"},
+		{"1.MIME", "Content-Type: text/plain; charset=utf-8\r\n\r\n"},
+		{"2.HEADER", "Subject: inner\r\n\r\n"},
+		{"2.TEXT", "inner body"},
+		{"2.1", "inner body"},
+		{"HEADER.FIELDS (SUBJECT message-id)", "Subject: report\r\nMessage-ID: <m1@example.com>\r\n\r\n"},
+		{"3", ""},
+	}
+	for _, tt := range tests {
+		sec, err := parseSection(tt.section)
+		if err != nil {
+			t.Errorf("parseSection(%q): %v", tt.section, err)
+			continue
+		}
+		if got := string(sec.extract([]byte(multipartMessage), root)); got != tt.want {
+			t.Errorf("BODY[%s] = %q, want %q", tt.section, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"0", "MIME", "HEADER.FIELDS", "BOGUS", "TEXT (A)"} {
+		if _, err := parseSection(bad); err == nil {
+			t.Errorf("parseSection(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestFetchResponse(t *testing.T) {
+	m := &message{
+		uid:   7,
+		flags: []string{`\Seen`},
+		date:  time.Date(2024, 1, 2, 10, 0, 0, 0, time.FixedZone("", 3600)),
+		size:  -1,
+		read:  func() ([]byte, error) { return []byte(multipartMessage), nil },
+	}
+	tok, _ := tokenize("(FLAGS INTERNALDATE RFC822.SIZE BODY.PEEK[1]<1.3> ENVELOPE)")
+	items, err := parseFetchItems(tok[0], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := fetchResponse(m, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `UID 7 FLAGS (\Seen) INTERNALDATE "02-Jan-2024 10:00:00 +0100" RFC822.SIZE 360 BODY[1]<1> {3}` + "\r\nell " +
+		`ENVELOPE ("Tue, 2 Jan 2024 09:00:00 +0100" "report" ` +
+		`(("=?utf-8?q?J=C3=BCrgen?=" NIL "j" "example.com")) (("=?utf-8?q?J=C3=BCrgen?=" NIL "j" "example.com")) ` +
+		`(("=?utf-8?q?J=C3=BCrgen?=" NIL "j" "example.com")) ((NIL NIL "a" "example.com")("B" NIL "b" "example.org")) ` +
+		`NIL NIL NIL "<m1@example.com>")`
+	if got != want {
+		t.Errorf("response:\n%s\nwant:\n%s", got, want)
+	}
+	if len(multipartMessage) != 360 {
+		t.Fatalf("test message is %d bytes", len(multipartMessage))
+	}
+}
+
+func TestBodyStructure(t *testing.T) {
+	root := parsePart([]byte(multipartMessage), "text/plain", 0)
+	got := bodyStructure(root, false)
+	want := `(("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 5 0)` +
+		`("MESSAGE" "RFC822" NIL NIL NIL "7BIT" 28 (NIL "inner" NIL NIL NIL NIL NIL NIL NIL NIL) ("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 10 0) 2) "MIXED")`
+	if got != want {
+		t.Errorf("BODY:\n%s\nwant:\n%s", got, want)
+	}
+	if ext := bodyStructure(root, true); !strings.HasSuffix(ext, `"MIXED" ("BOUNDARY" "b1") NIL NIL NIL)`) {
+		t.Errorf("BODYSTRUCTURE = %s", ext)
+	}
+}
+
+func TestParseFetchItems(t *testing.T) {
+	tok, _ := tokenize("FAST")
+	items, err := parseFetchItems(tok[0], false)
+	if err != nil || len(items) != 3 || items[2].name != "RFC822.SIZE" {
+		t.Errorf("FAST = %+v, %v", items, err)
+	}
+	for _, bad := range []string{"BOGUS", "BODY[1]<5>", "BODY[1]<1.0>", "BODY[X]"} {
+		tok, _ := tokenize(bad)
+		if _, err := parseFetchItems(tok[0], false); err == nil {
+			t.Errorf("parseFetchItems(%q) succeeded", bad)
+		}
+	}
+}
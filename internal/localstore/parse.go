@@ -0,0 +1,290 @@
+package localstore
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"imap-proxy/internal/imap"
+)
+
+// maxLiteral bounds literals in client commands. Nothing the store accepts
+// needs a large one.
+const maxLiteral = 64 << 10
+
+var errSyntax = errors.New("syntax error")
+
+// mutf7 is the base64 variant of modified UTF-7, before "/" is replaced
+// by ",".
+var mutf7 = base64.StdEncoding.WithPadding(base64.NoPadding)
+
+// token is a command argument: an atom, a string, or a parenthesized list.
+type token struct {
+	atom   string
+	str    string
+	isStr  bool
+	list   []token
+	isList bool
+}
+
+// text returns an atom or string argument as a string.
+func (t token) text() (string, bool) {
+	if t.isList {
+		return "", false
+	}
+	if t.isStr {
+		return t.str, true
+	}
+	return t.atom, t.atom != ""
+}
+
+// readCommand reads one command line together with its literals. Sync
+// literals are acknowledged with a continuation request on w.
+func readCommand(r *bufio.Reader, w *bufio.Writer) ([]byte, error) {
+	var cmd []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, errors.New("command line too long")
+		}
+		if err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, line...)
+		n, nonSync, ok := imap.ParseLiteral(line)
+		if !ok {
+			return cmd, nil
+		}
+		if n > maxLiteral {
+			if nonSync {
+				io.CopyN(io.Discard, r, n)
+			}
+			return nil, fmt.Errorf("literal of %d bytes too large", n)
+		}
+		if !nonSync {
+			w.WriteString("+ Ready\r\n")
+			if err := w.Flush(); err != nil {
+				return nil, err
+			}
+		}
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(r, lit); err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, lit...)
+	}
+}
+
+// tokenize splits the arguments of a command into tokens. Literals are
+// expected inline, as readCommand returns them.
+func tokenize(s string) ([]token, error) {
+	p := &parser{s: strings.TrimRight(s, "\r\n")}
+	toks, err := p.list(false)
+	if err != nil {
+		return nil, err
+	}
+	return toks, nil
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+// list parses tokens up to the end of input, or up to a closing
+// parenthesis when nested.
+func (p *parser) list(nested bool) ([]token, error) {
+	var toks []token
+	for {
+		for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+			p.pos++
+		}
+		if p.pos == len(p.s) {
+			if nested {
+				return nil, errSyntax
+			}
+			return toks, nil
+		}
+		switch c := p.s[p.pos]; c {
+		case ')':
+			if !nested {
+				return nil, errSyntax
+			}
+			p.pos++
+			return toks, nil
+		case '(':
+			p.pos++
+			sub, err := p.list(true)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{list: sub, isList: true})
+		case '"':
+			str, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{str: str, isStr: true})
+		case '{':
+			str, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{str: str, isStr: true})
+		default:
+			toks = append(toks, token{atom: p.atom()})
+		}
+	}
+}
+
+func (p *parser) quoted() (string, error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		switch c := p.s[p.pos]; c {
+		case '\\':
+			p.pos++
+			if p.pos == len(p.s) {
+				return "", errSyntax
+			}
+			b.WriteByte(p.s[p.pos])
+		case '"':
+			p.pos++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errSyntax
+}
+
+func (p *parser) literal() (string, error) {
+	end := strings.Index(p.s[p.pos:], "}\r\n")
+	if end < 0 {
+		return "", errSyntax
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(p.s[p.pos+1:p.pos+end], "+"))
+	if err != nil || n < 0 {
+		return "", errSyntax
+	}
+	start := p.pos + end + 3
+	if start+n > len(p.s) {
+		return "", errSyntax
+	}
+	p.pos = start + n
+	return p.s[start:p.pos], nil
+}
+
+// atom reads up to the next space or parenthesis. Brackets are read as a
+// unit so that BODY[HEADER.FIELDS (FROM)]<0.10> is one atom.
+func (p *parser) atom() string {
+	start, depth := p.pos, 0
+	for ; p.pos < len(p.s); p.pos++ {
+		switch p.s[p.pos] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ' ', '(', ')':
+			if depth <= 0 {
+				return p.s[start:p.pos]
+			}
+		}
+	}
+	return p.s[start:]
+}
+
+// quote formats s as an IMAP string: quoted when possible, otherwise a
+// literal.
+func quote(s string) string {
+	for i := range len(s) {
+		if c := s[i]; c == '\r' || c == '\n' || c >= 0x80 || c == 0 {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// nstring is quote, or NIL for an empty string.
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
+
+// encodeMailbox encodes a UTF-8 folder name in IMAP's modified UTF-7
+// (RFC 3501 section 5.1.3).
+func encodeMailbox(name string) string {
+	var b strings.Builder
+	var pending []rune
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		var buf []byte
+		for _, u := range utf16.Encode(pending) {
+			buf = append(buf, byte(u>>8), byte(u))
+		}
+		b.WriteByte('&')
+		b.WriteString(strings.ReplaceAll(mutf7.EncodeToString(buf), "/", ","))
+		b.WriteByte('-')
+		pending = nil
+	}
+	for _, r := range name {
+		if r >= 0x20 && r <= 0x7e {
+			flush()
+			if r == '&' {
+				b.WriteString("&-")
+			} else {
+				b.WriteRune(r)
+			}
+			continue
+		}
+		pending = append(pending, r)
+	}
+	flush()
+	return b.String()
+}
+
+// decodeMailbox decodes a modified UTF-7 folder name. Names that are not
+// valid modified UTF-7 are returned unchanged.
+func decodeMailbox(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '&' {
+			b.WriteByte(name[i])
+			continue
+		}
+		end := strings.IndexByte(name[i:], '-')
+		if end < 0 {
+			return name
+		}
+		enc := name[i+1 : i+end]
+		i += end
+		if enc == "" {
+			b.WriteByte('&')
+			continue
+		}
+		buf, err := mutf7.DecodeString(strings.ReplaceAll(enc, ",", "/"))
+		if err != nil || len(buf)%2 != 0 {
+			return name
+		}
+		units := make([]uint16, len(buf)/2)
+		for j := range units {
+			units[j] = uint16(buf[2*j])<<8 | uint16(buf[2*j+1])
+		}
+		for _, r := range utf16.Decode(units) {
+			if r == utf8.RuneError {
+				return name
+			}
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
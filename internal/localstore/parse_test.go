@@ -0,0 +1,88 @@
+package localstore
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	toks, err := tokenize(`1:* (UID BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.10>) "a \"b\"" {3}` + "\r\nx y NIL\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []token{
+		{atom: "1:*"},
+		{isList: true, list: []token{{atom: "UID"}, {atom: "BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.10>"}}},
+		{str: `a "b"`, isStr: true},
+		{str: "x y", isStr: true},
+		{atom: "NIL"},
+	}
+	if !reflect.DeepEqual(toks, want) {
+		t.Errorf("tokens = %+v\nwant %+v", toks, want)
+	}
+	for _, bad := range []string{"(a", "a)", `"open`, "{5}\r\nab"} {
+		if _, err := tokenize(bad); err == nil {
+			t.Errorf("tokenize(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	in := "a1 LOGIN {4}\r\nuser {4+}\r\npass\r\na2 NOOP\r\n"
+	r := bufio.NewReader(strings.NewReader(in))
+	var out strings.Builder
+	w := bufio.NewWriter(&out)
+	cmd, err := readCommand(r, w)
+	if err != nil || string(cmd) != "a1 LOGIN {4}\r\nuser {4+}\r\npass\r\n" {
+		t.Fatalf("command = %q, %v", cmd, err)
+	}
+	if out.String() != "+ Ready\r\n" {
+		t.Errorf("continuations = %q, want one for the sync literal", out.String())
+	}
+	if cmd, _ := readCommand(r, w); string(cmd) != "a2 NOOP\r\n" {
+		t.Errorf("next command = %q", cmd)
+	}
+
+	r = bufio.NewReader(strings.NewReader("a1 APPEND INBOX {1000000}\r\n"))
+	if _, err := readCommand(r, w); err == nil {
+		t.Error("oversized literal accepted")
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"plain", `"plain"`},
+		{`a"b\c`, `"a\"b\\c"`},
+		{"Grüße", "{7}\r\nGrüße"},
+	}
+	for _, tt := range tests {
+		if got := quote(tt.in); got != tt.want {
+			t.Errorf("quote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if nstring("") != "NIL" {
+		t.Error(`nstring("") is not NIL`)
+	}
+}
+
+func TestMailboxNames(t *testing.T) {
+	tests := []struct{ utf8, mutf7 string }{
+		{"INBOX", "INBOX"},
+		{"Entwürfe", "Entw&APw-rfe"},
+		{"A&B", "A&-B"},
+		{"日本語", "&ZeVnLIqe-"},
+	}
+	for _, tt := range tests {
+		if got := encodeMailbox(tt.utf8); got != tt.mutf7 {
+			t.Errorf("encodeMailbox(%q) = %q, want %q", tt.utf8, got, tt.mutf7)
+		}
+		if got := decodeMailbox(tt.mutf7); got != tt.utf8 {
+			t.Errorf("decodeMailbox(%q) = %q, want %q", tt.mutf7, got, tt.utf8)
+		}
+	}
+	if got := decodeMailbox("bad&name"); got != "bad&name" {
+		t.Errorf("invalid name decoded to %q", got)
+	}
+}
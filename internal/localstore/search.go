@@ -0,0 +1,329 @@
+package localstore
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/imap"
+)
+
+// errBadCharset is returned for a SEARCH CHARSET other than UTF-8 or
+// US-ASCII.
+var errBadCharset = errors.New("unsupported charset")
+
+// candidate is a message being matched by a search.
+type candidate struct {
+	msg     *message
+	seq     uint32
+	last    uint32 // highest sequence number
+	lastUID uint32
+
+	content []byte // loaded on first use
+	root    *part
+	err     error
+}
+
+// load reads and parses the message once.
+func (c *candidate) load() *part {
+	if c.root == nil && c.err == nil {
+		c.content, c.err = c.msg.content()
+		if c.err == nil {
+			c.root = parsePart(c.content, "text/plain", 0)
+		}
+	}
+	return c.root
+}
+
+// matcher matches one search key.
+type matcher func(c *candidate) bool
+
+// parseSearch parses search keys into a matcher that requires all of
+// them. A leading CHARSET is accepted for UTF-8 and US-ASCII.
+func parseSearch(toks []token) (matcher, error) {
+	if len(toks) >= 2 && strings.EqualFold(toks[0].atom, "CHARSET") {
+		cs, _ := toks[1].text()
+		if !strings.EqualFold(cs, "UTF-8") && !strings.EqualFold(cs, "US-ASCII") {
+			return nil, errBadCharset
+		}
+		toks = toks[2:]
+	}
+	p := &searchParser{toks: toks}
+	var keys []matcher
+	for len(p.toks) > 0 {
+		m, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, m)
+	}
+	if len(keys) == 0 {
+		return nil, errSyntax
+	}
+	return all(keys), nil
+}
+
+func all(keys []matcher) matcher {
+	return func(c *candidate) bool {
+		for _, k := range keys {
+			if !k(c) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+type searchParser struct {
+	toks []token
+}
+
+func (p *searchParser) next() (token, error) {
+	if len(p.toks) == 0 {
+		return token{}, errSyntax
+	}
+	t := p.toks[0]
+	p.toks = p.toks[1:]
+	return t, nil
+}
+
+func (p *searchParser) str() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	s, ok := t.text()
+	if !ok {
+		return "", errSyntax
+	}
+	return s, nil
+}
+
+func (p *searchParser) date() (time.Time, error) {
+	s, err := p.str()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse("_2-Jan-2006", strings.TrimLeft(s, " "))
+}
+
+func (p *searchParser) number() (int64, error) {
+	s, err := p.str()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// flagKeys are the search keys that test a flag, and whether it must be
+// set.
+var flagKeys = map[string]struct {
+	flag string
+	set  bool
+}{
+	"ANSWERED":   {`\Answered`, true},
+	"DELETED":    {`\Deleted`, true},
+	"DRAFT":      {`\Draft`, true},
+	"FLAGGED":    {`\Flagged`, true},
+	"SEEN":       {`\Seen`, true},
+	"UNANSWERED": {`\Answered`, false},
+	"UNDELETED":  {`\Deleted`, false},
+	"UNDRAFT":    {`\Draft`, false},
+	"UNFLAGGED":  {`\Flagged`, false},
+	"UNSEEN":     {`\Seen`, false},
+}
+
+// headerKeys are the search keys that match a header field.
+var headerKeys = map[string]string{
+	"BCC":     "Bcc",
+	"CC":      "Cc",
+	"FROM":    "From",
+	"SUBJECT": "Subject",
+	"TO":      "To",
+}
+
+func (p *searchParser) key() (matcher, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.isList {
+		sub := &searchParser{toks: t.list}
+		var keys []matcher
+		for len(sub.toks) > 0 {
+			m, err := sub.key()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, m)
+		}
+		if len(keys) == 0 {
+			return nil, errSyntax
+		}
+		return all(keys), nil
+	}
+	name := strings.ToUpper(t.atom)
+	if f, ok := flagKeys[name]; ok {
+		return func(c *candidate) bool { return c.msg.hasFlag(f.flag) == f.set }, nil
+	}
+	if field, ok := headerKeys[name]; ok {
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return headerMatcher(field, s), nil
+	}
+	switch name {
+	case "ALL":
+		return func(*candidate) bool { return true }, nil
+	case "NEW", "RECENT":
+		// Nothing is recent in a snapshot.
+		return func(*candidate) bool { return false }, nil
+	case "OLD":
+		return func(*candidate) bool { return true }, nil
+	case "KEYWORD", "UNKEYWORD":
+		kw, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool { return c.msg.hasFlag(kw) == (name == "KEYWORD") }, nil
+	case "HEADER":
+		field, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		return headerMatcher(field, s), nil
+	case "BODY", "TEXT":
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		needle := []byte(strings.ToLower(s))
+		return func(c *candidate) bool {
+			root := c.load()
+			if root == nil {
+				return false
+			}
+			data := root.body
+			if name == "TEXT" {
+				data = c.content
+			}
+			return bytes.Contains(bytes.ToLower(data), needle)
+		}, nil
+	case "BEFORE", "ON", "SINCE":
+		d, err := p.date()
+		if err != nil {
+			return nil, errSyntax
+		}
+		return func(c *candidate) bool { return compareDate(c.msg.date, d, name) }, nil
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		d, err := p.date()
+		if err != nil {
+			return nil, errSyntax
+		}
+		return func(c *candidate) bool {
+			root := c.load()
+			if root == nil {
+				return false
+			}
+			sent, err := mail.ParseDate(root.headerValue("Date"))
+			return err == nil && compareDate(sent, d, strings.TrimPrefix(name, "SENT"))
+		}, nil
+	case "LARGER", "SMALLER":
+		n, err := p.number()
+		if err != nil {
+			return nil, errSyntax
+		}
+		return func(c *candidate) bool {
+			size, err := c.msg.rfc822Size()
+			if err != nil {
+				return false
+			}
+			if name == "LARGER" {
+				return size > n
+			}
+			return size < n
+		}, nil
+	case "NOT":
+		m, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool { return !m(c) }, nil
+	case "OR":
+		a, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		b, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		return func(c *candidate) bool { return a(c) || b(c) }, nil
+	case "UID":
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		set, err := imap.ParseSeqSet(s)
+		if err != nil {
+			return nil, errSyntax
+		}
+		return func(c *candidate) bool { return set.Contains(c.msg.uid, c.lastUID) }, nil
+	}
+	set, err := imap.ParseSeqSet(t.atom)
+	if err != nil {
+		return nil, errSyntax
+	}
+	return func(c *candidate) bool { return set.Contains(c.seq, c.last) }, nil
+}
+
+// compareDate compares the dates of t and d, ignoring the time of day
+// and t's time zone, as IMAP date searches do.
+func compareDate(t, d time.Time, op string) bool {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch op {
+	case "BEFORE":
+		return day.Before(d)
+	case "ON":
+		return day.Equal(d)
+	default:
+		return !day.Before(d)
+	}
+}
+
+// headerMatcher matches messages whose header field contains s, ignoring
+// case, after decoding RFC 2047 words. An empty s matches any message
+// that has the field.
+func headerMatcher(field, s string) matcher {
+	needle := strings.ToLower(s)
+	return func(c *candidate) bool {
+		root := c.load()
+		if root == nil {
+			return false
+		}
+		values, ok := root.fields[textproto.CanonicalMIMEHeaderKey(field)]
+		if !ok {
+			return false
+		}
+		dec := &mime.WordDecoder{}
+		for _, v := range values {
+			if d, err := dec.DecodeHeader(v); err == nil {
+				v = d
+			}
+			if strings.Contains(strings.ToLower(v), needle) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,81 @@
+package localstore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearch(t *testing.T) {
+	msgs := []*message{
+		{uid: 3, flags: []string{`\Seen`}, date: time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC),
+			read: func() ([]byte, error) {
+				return []byte("From: \"Alice\" <alice@example.com>\r\nSubject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n\r\nquarterly numbers\r\n"), nil
+			}},
+		{uid: 5, flags: []string{`\Flagged`}, date: time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC),
+			read: func() ([]byte, error) {
+				return []byte("From: bob@example.org\r\nSubject: lunch\r\nDate: Wed, 31 Jan 2024 12:00:00 +0000\r\n\r\nnoon?\r\n"), nil
+			}},
+	}
+	for _, m := range msgs {
+		m.size = -1
+	}
+	tests := []struct {
+		criteria string
+		want     []uint32 // UIDs
+	}{
+		{"ALL", []uint32{3, 5}},
+		{"UNSEEN", []uint32{5}},
+		{"FLAGGED SEEN", nil},
+		{`NOT FROM "alice"`, []uint32{5}},
+		{`SUBJECT grüße`, []uint32{3}},
+		{`HEADER Date ""`, []uint32{5}},
+		{"BODY QUARTERLY", []uint32{3}},
+		{`TEXT "example.org"`, []uint32{5}},
+		{"SINCE 1-Feb-2024", []uint32{5}},
+		{"BEFORE 1-Feb-2024", []uint32{3}},
+		{"ON 1-Jan-2024", []uint32{3}},
+		{"SENTBEFORE 1-Feb-2024", []uint32{5}},
+		{"OR SEEN FLAGGED", []uint32{3, 5}},
+		{"UID 4:*", []uint32{5}},
+		{"2", []uint32{5}},
+		{"LARGER 90", []uint32{3}},
+		{"(SEEN) (ALL)", []uint32{3}},
+		{"CHARSET UTF-8 KEYWORD $Junk", nil},
+		{"RECENT", nil},
+	}
+	for _, tt := range tests {
+		toks, err := tokenize(tt.criteria)
+		if err != nil {
+			t.Fatal(err)
+		}
+		match, err := parseSearch(toks)
+		if err != nil {
+			t.Errorf("parseSearch(%q): %v", tt.criteria, err)
+			continue
+		}
+		var got []uint32
+		for i, m := range msgs {
+			if match(&candidate{msg: m, seq: uint32(i + 1), last: 2, lastUID: 5}) {
+				got = append(got, m.uid)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SEARCH %s = %v, want %v", tt.criteria, got, tt.want)
+		}
+	}
+}
+
+func TestParseSearchErrors(t *testing.T) {
+	for _, bad := range []string{"", "FROM", "SINCE yesterday", "OR SEEN", "()", "BOGUS", "LARGER x"} {
+		toks, _ := tokenize(bad)
+		if _, err := parseSearch(toks); err == nil {
+			t.Errorf("parseSearch(%q) succeeded", bad)
+		}
+	}
+	toks, _ := tokenize("CHARSET ISO-8859-1 ALL")
+	if _, err := parseSearch(toks); !errors.Is(err, errBadCharset) {
+		t.Errorf("unknown charset: err = %v, want errBadCharset", err)
+	}
+}
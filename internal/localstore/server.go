@@ -0,0 +1,446 @@
+package localstore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+// capabilities are advertised in the greeting and after LOGIN.
+const capabilities = "IMAP4rev1 LITERAL+ IDLE NAMESPACE UNSELECT ID"
+
+// Serve runs an IMAP session for the tree at root on conn until the client
+// logs out or the connection fails, then closes conn. Any LOGIN succeeds;
+// access control is the proxy's business. Every folder is read-only.
+func Serve(conn net.Conn, root string) {
+	(&Store{Root: root}).Serve(conn)
+}
+
+// Store serves the maildir/mbox tree at Root.
+type Store struct {
+	Root string
+	// Login checks LOGIN credentials. When nil, any LOGIN succeeds.
+	Login func(user, password string) bool
+}
+
+// Serve runs an IMAP session on conn like the package-level Serve, checking
+// credentials with st.Login.
+func (st *Store) Serve(conn net.Conn) {
+	defer conn.Close()
+	s := &session{
+		root:  st.Root,
+		login: st.Login,
+		r:     bufio.NewReaderSize(conn, 64<<10),
+		w:     bufio.NewWriter(conn),
+	}
+	s.w.WriteString("* OK [CAPABILITY " + capabilities + "] imap-proxy local store ready\r\n")
+	if s.w.Flush() != nil {
+		return
+	}
+	for {
+		line, err := readCommand(s.r, s.w)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(s.w, "* BYE %s\r\n", err)
+				s.w.Flush()
+			}
+			return
+		}
+		done := s.dispatch(string(line))
+		if s.w.Flush() != nil || done {
+			return
+		}
+	}
+}
+
+// session is the state of one connection.
+type session struct {
+	root   string
+	login  func(user, password string) bool
+	r      *bufio.Reader
+	w      *bufio.Writer
+	authed bool
+	mb     *mailbox // selected mailbox, or nil
+}
+
+// dispatch runs one command and reports whether the session is over.
+func (s *session) dispatch(line string) bool {
+	tag, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	verb, args, _ := strings.Cut(rest, " ")
+	verb = strings.ToUpper(verb)
+	if tag == "" || verb == "" {
+		fmt.Fprintf(s.w, "%s BAD missing command\r\n", orDefault(tag, "*"))
+		return false
+	}
+	uid := false
+	if verb == "UID" {
+		uid = true
+		verb, args, _ = strings.Cut(args, " ")
+		verb = strings.ToUpper(verb)
+	}
+	toks, err := tokenize(args)
+	if err != nil {
+		fmt.Fprintf(s.w, "%s BAD %v\r\n", tag, err)
+		return false
+	}
+
+	switch {
+	case verb == "CAPABILITY" && !uid:
+		s.w.WriteString("* CAPABILITY " + capabilities + "\r\n")
+	case verb == "NOOP" && !uid, verb == "CHECK" && !uid && s.mb != nil:
+	case verb == "LOGOUT" && !uid:
+		s.w.WriteString("* BYE logging out\r\n")
+		fmt.Fprintf(s.w, "%s OK LOGOUT completed\r\n", tag)
+		return true
+	case verb == "ID" && !uid:
+		s.w.WriteString("* ID (\"name\" \"imap-proxy local store\")\r\n")
+	case verb == "LOGIN" && !uid && !s.authed:
+		if len(toks) != 2 {
+			fmt.Fprintf(s.w, "%s BAD LOGIN expects a user name and password\r\n", tag)
+			return false
+		}
+		if s.login != nil {
+			user, _ := toks[0].text()
+			pass, _ := toks[1].text()
+			if !s.login(user, pass) {
+				fmt.Fprintf(s.w, "%s NO [AUTHENTICATIONFAILED] invalid credentials\r\n", tag)
+				return false
+			}
+		}
+		s.authed = true
+		fmt.Fprintf(s.w, "%s OK [CAPABILITY %s] LOGIN completed\r\n", tag, capabilities)
+		return false
+	case !s.authed:
+		fmt.Fprintf(s.w, "%s BAD %s not available before LOGIN\r\n", tag, verb)
+		return false
+	case verb == "IDLE" && !uid:
+		return s.idle(tag)
+	case (verb == "SELECT" || verb == "EXAMINE") && !uid:
+		s.selectFolder(tag, verb, toks)
+		return false
+	case (verb == "LIST" || verb == "LSUB") && !uid:
+		s.list(tag, verb, toks)
+		return false
+	case verb == "STATUS" && !uid:
+		s.status(tag, toks)
+		return false
+	case verb == "NAMESPACE" && !uid:
+		s.w.WriteString("* NAMESPACE ((\"\" \"/\")) NIL NIL\r\n")
+	case verb == "ENABLE" && !uid:
+		s.w.WriteString("* ENABLED\r\n")
+	case readOnlyVerbs[verb]:
+		fmt.Fprintf(s.w, "%s NO [CANNOT] the local store is read-only\r\n", tag)
+		return false
+	case s.mb == nil:
+		fmt.Fprintf(s.w, "%s BAD %s not available without a selected folder\r\n", tag, verb)
+		return false
+	case (verb == "CLOSE" || verb == "UNSELECT") && !uid:
+		s.mb = nil
+	case verb == "FETCH":
+		s.fetch(tag, uid, toks)
+		return false
+	case verb == "SEARCH":
+		s.search(tag, uid, toks)
+		return false
+	default:
+		fmt.Fprintf(s.w, "%s BAD unknown command\r\n", tag)
+		return false
+	}
+	fmt.Fprintf(s.w, "%s OK %s completed\r\n", tag, verb)
+	return false
+}
+
+// readOnlyVerbs are refused because they would change the store.
+var readOnlyVerbs = map[string]bool{
+	"APPEND": true, "COPY": true, "CREATE": true, "DELETE": true, "EXPUNGE": true,
+	"MOVE": true, "RENAME": true, "STORE": true, "SUBSCRIBE": true, "UNSUBSCRIBE": true,
+}
+
+// idle waits for DONE. The store is a snapshot, so nothing is announced.
+func (s *session) idle(tag string) bool {
+	s.w.WriteString("+ idling\r\n")
+	if s.w.Flush() != nil {
+		return true
+	}
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return true
+	}
+	if !strings.EqualFold(strings.TrimRight(line, "\r\n"), "DONE") {
+		fmt.Fprintf(s.w, "%s BAD expected DONE\r\n", tag)
+		return false
+	}
+	fmt.Fprintf(s.w, "%s OK IDLE terminated\r\n", tag)
+	return false
+}
+
+// findFolder returns the folder with the given client-supplied name.
+func (s *session) findFolder(name string) (folder, error) {
+	name = decodeMailbox(name)
+	folders, err := listFolders(s.root)
+	if err != nil {
+		return folder{}, err
+	}
+	for _, f := range folders {
+		if f.name == name || (f.name == "INBOX" && strings.EqualFold(name, "INBOX")) {
+			return f, nil
+		}
+	}
+	return folder{}, errNoFolder
+}
+
+func (s *session) selectFolder(tag, verb string, toks []token) {
+	s.mb = nil
+	name, ok := "", len(toks) >= 1
+	if ok {
+		name, ok = toks[0].text()
+	}
+	if !ok {
+		fmt.Fprintf(s.w, "%s BAD %s expects a folder name\r\n", tag, verb)
+		return
+	}
+	f, err := s.findFolder(name)
+	if err != nil {
+		fmt.Fprintf(s.w, "%s NO [NONEXISTENT] %v\r\n", tag, err)
+		return
+	}
+	mb, err := openFolder(f)
+	if err != nil {
+		fmt.Fprintf(s.w, "%s NO [SERVERBUG] cannot read folder\r\n", tag)
+		return
+	}
+	s.mb = mb
+	s.w.WriteString("* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n")
+	s.w.WriteString("* OK [PERMANENTFLAGS ()] read-only\r\n")
+	fmt.Fprintf(s.w, "* %d EXISTS\r\n* 0 RECENT\r\n", len(mb.msgs))
+	for i, m := range mb.msgs {
+		if !m.hasFlag(`\Seen`) {
+			fmt.Fprintf(s.w, "* OK [UNSEEN %d] first unseen\r\n", i+1)
+			break
+		}
+	}
+	fmt.Fprintf(s.w, "* OK [UIDVALIDITY %d] UIDs valid\r\n", mb.uidValidity)
+	fmt.Fprintf(s.w, "* OK [UIDNEXT %d] predicted next UID\r\n", mb.uidNext())
+	fmt.Fprintf(s.w, "%s OK [READ-ONLY] %s completed\r\n", tag, verb)
+}
+
+// list answers LIST and LSUB; every folder counts as subscribed. Selection
+// and return options of an extended LIST are ignored.
+func (s *session) list(tag, verb string, toks []token) {
+	if len(toks) > 0 && toks[0].isList {
+		toks = toks[1:]
+	}
+	if len(toks) < 2 {
+		fmt.Fprintf(s.w, "%s BAD %s expects a reference and a pattern\r\n", tag, verb)
+		return
+	}
+	ref, _ := toks[0].text()
+	var patterns []string
+	if toks[1].isList {
+		for _, t := range toks[1].list {
+			p, _ := t.text()
+			patterns = append(patterns, p)
+		}
+	} else {
+		p, _ := toks[1].text()
+		patterns = []string{p}
+	}
+	if len(patterns) == 1 && patterns[0] == "" {
+		fmt.Fprintf(s.w, "* %s (\\Noselect) \"/\" \"\"\r\n", verb)
+		fmt.Fprintf(s.w, "%s OK %s completed\r\n", tag, verb)
+		return
+	}
+	folders, err := listFolders(s.root)
+	if err != nil {
+		fmt.Fprintf(s.w, "%s NO [SERVERBUG] cannot read folders\r\n", tag)
+		return
+	}
+	// Parents of nested folders that are not folders themselves are
+	// listed as \Noselect.
+	type entry struct {
+		name     string
+		noselect bool
+	}
+	var entries []entry
+	known := map[string]bool{}
+	for _, f := range folders {
+		known[f.name] = true
+	}
+	for _, f := range folders {
+		for parent := path.Dir(f.name); parent != "."; parent = path.Dir(parent) {
+			if !known[parent] {
+				known[parent] = true
+				entries = append(entries, entry{parent, true})
+			}
+		}
+		entries = append(entries, entry{f.name, false})
+	}
+	for _, e := range entries {
+		enc := encodeMailbox(e.name)
+		for _, p := range patterns {
+			if !listMatch(decodeMailbox(ref+p), e.name) {
+				continue
+			}
+			flags := ""
+			if e.noselect {
+				flags = `\Noselect`
+			}
+			fmt.Fprintf(s.w, "* %s (%s) \"/\" %s\r\n", verb, flags, quote(enc))
+			break
+		}
+	}
+	fmt.Fprintf(s.w, "%s OK %s completed\r\n", tag, verb)
+}
+
+// listMatch matches a LIST pattern, where * matches anything and % matches
+// anything but the hierarchy delimiter. INBOX matches case-insensitively.
+func listMatch(pattern, name string) bool {
+	if len(pattern) >= 5 && strings.EqualFold(pattern[:5], "INBOX") && (len(pattern) == 5 || pattern[5:6] == delim) {
+		pattern = "INBOX" + pattern[5:]
+	}
+	return wildcardMatch(pattern, name)
+}
+
+func wildcardMatch(pattern, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(name); i++ {
+			if wildcardMatch(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	case '%':
+		for i := 0; i <= len(name); i++ {
+			if wildcardMatch(pattern[1:], name[i:]) {
+				return true
+			}
+			if i < len(name) && name[i:i+1] == delim {
+				return false
+			}
+		}
+		return false
+	}
+	return name != "" && name[0] == pattern[0] && wildcardMatch(pattern[1:], name[1:])
+}
+
+func (s *session) status(tag string, toks []token) {
+	name, ok := "", len(toks) == 2 && toks[1].isList
+	if ok {
+		name, ok = toks[0].text()
+	}
+	if !ok {
+		fmt.Fprintf(s.w, "%s BAD STATUS expects a folder name and item list\r\n", tag)
+		return
+	}
+	f, err := s.findFolder(name)
+	if err != nil {
+		fmt.Fprintf(s.w, "%s NO [NONEXISTENT] %v\r\n", tag, err)
+		return
+	}
+	mb, err := openFolder(f)
+	if err != nil {
+		fmt.Fprintf(s.w, "%s NO [SERVERBUG] cannot read folder\r\n", tag)
+		return
+	}
+	var items []string
+	for _, t := range toks[1].list {
+		item := strings.ToUpper(t.atom)
+		var n int
+		switch item {
+		case "MESSAGES":
+			n = len(mb.msgs)
+		case "RECENT":
+		case "UIDNEXT":
+			n = int(mb.uidNext())
+		case "UIDVALIDITY":
+			n = int(mb.uidValidity)
+		case "UNSEEN":
+			n = mb.unseen()
+		default:
+			fmt.Fprintf(s.w, "%s BAD unknown STATUS item %s\r\n", tag, t.atom)
+			return
+		}
+		items = append(items, item+" "+strconv.Itoa(n))
+	}
+	fmt.Fprintf(s.w, "* STATUS %s (%s)\r\n", quote(encodeMailbox(f.name)), strings.Join(items, " "))
+	fmt.Fprintf(s.w, "%s OK STATUS completed\r\n", tag)
+}
+
+// selected returns the messages of the selected mailbox in set, with
+// their sequence numbers.
+func (s *session) selected(set imap.SeqSet, uid bool) (msgs []*message, seqs []uint32) {
+	last := uint32(len(s.mb.msgs))
+	lastUID := s.mb.uidNext() - 1
+	for i, m := range s.mb.msgs {
+		seq := uint32(i + 1)
+		if (uid && set.Contains(m.uid, lastUID)) || (!uid && set.Contains(seq, last)) {
+			msgs = append(msgs, m)
+			seqs = append(seqs, seq)
+		}
+	}
+	return msgs, seqs
+}
+
+func (s *session) search(tag string, uid bool, toks []token) {
+	match, err := parseSearch(toks)
+	if errors.Is(err, errBadCharset) {
+		fmt.Fprintf(s.w, "%s NO [BADCHARSET (UTF-8 US-ASCII)] unsupported charset\r\n", tag)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(s.w, "%s BAD invalid search criteria\r\n", tag)
+		return
+	}
+	s.w.WriteString("* SEARCH")
+	last, lastUID := uint32(len(s.mb.msgs)), s.mb.uidNext()-1
+	for i, m := range s.mb.msgs {
+		c := &candidate{msg: m, seq: uint32(i + 1), last: last, lastUID: lastUID}
+		if match(c) {
+			n := c.seq
+			if uid {
+				n = m.uid
+			}
+			fmt.Fprintf(s.w, " %d", n)
+		}
+	}
+	s.w.WriteString("\r\n")
+	fmt.Fprintf(s.w, "%s OK SEARCH completed\r\n", tag)
+}
+
+func (s *session) fetch(tag string, uid bool, toks []token) {
+	if len(toks) != 2 {
+		fmt.Fprintf(s.w, "%s BAD FETCH expects a sequence set and items\r\n", tag)
+		return
+	}
+	set, err := imap.ParseSeqSet(toks[0].atom)
+	if err != nil {
+		fmt.Fprintf(s.w, "%s BAD invalid sequence set\r\n", tag)
+		return
+	}
+	items, err := parseFetchItems(toks[1], uid)
+	if err != nil {
+		fmt.Fprintf(s.w, "%s BAD invalid FETCH items\r\n", tag)
+		return
+	}
+	msgs, seqs := s.selected(set, uid)
+	for i, m := range msgs {
+		resp, err := fetchResponse(m, items)
+		if err != nil {
+			fmt.Fprintf(s.w, "%s NO [SERVERBUG] cannot read message\r\n", tag)
+			return
+		}
+		fmt.Fprintf(s.w, "* %d FETCH (%s)\r\n", seqs[i], resp)
+	}
+	fmt.Fprintf(s.w, "%s OK FETCH completed\r\n", tag)
+}
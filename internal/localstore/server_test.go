@@ -0,0 +1,162 @@
+package localstore
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// client drives a Serve session over a pipe.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialStore(t *testing.T, root string) *client {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	go Serve(serverConn, root)
+	t.Cleanup(func() { clientConn.Close() })
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &client{t: t, conn: clientConn, r: bufio.NewReader(clientConn)}
+	if greeting := c.line(); !strings.HasPrefix(greeting, "* OK [CAPABILITY IMAP4rev1 ") {
+		t.Fatalf("greeting = %q", greeting)
+	}
+	return c
+}
+
+func (c *client) line() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return line
+}
+
+// cmd sends a tagged command and returns everything up to and including
+// the tagged response.
+func (c *client) cmd(tag, command string) string {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(tag + " " + command + "\r\n")); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+	var out strings.Builder
+	for {
+		line := c.line()
+		out.WriteString(line)
+		if strings.HasPrefix(line, tag+" ") {
+			return out.String()
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	root := t.TempDir()
+	makeMaildir(t, filepath.Join(root, "INBOX"))
+	makeMaildir(t, filepath.Join(root, "Archive", "2023"))
+	writeFile(t, filepath.Join(root, "INBOX", "cur", "1700000001.a.host:2,S"),
+		"From: alice@example.com\nSubject: hello\n\nfirst\n")
+	writeFile(t, filepath.Join(root, "INBOX", "new", "1700000002.b.host"),
+		"From: bob@example.org\nSubject: again\n\nsecond\n")
+
+	c := dialStore(t, root)
+	if got := c.cmd("a0", "SELECT INBOX"); !strings.HasPrefix(got, "a0 BAD") {
+		t.Errorf("SELECT before LOGIN = %q", got)
+	}
+	if got := c.cmd("a1", `LOGIN "any" {3+}`+"\r\nany"); !strings.HasPrefix(got, "a1 OK") {
+		t.Fatalf("LOGIN = %q", got)
+	}
+
+	if got := c.cmd("a2", `LIST "" %`); got != "* LIST (\\Noselect) \"/\" \"Archive\"\r\n* LIST () \"/\" \"INBOX\"\r\na2 OK LIST completed\r\n" {
+		t.Errorf("LIST %% = %q", got)
+	}
+	if got := c.cmd("a3", `LIST "" Archive/*`); got != "* LIST () \"/\" \"Archive/2023\"\r\na3 OK LIST completed\r\n" {
+		t.Errorf("LIST Archive/* = %q", got)
+	}
+
+	got := c.cmd("a4", "EXAMINE inbox")
+	for _, want := range []string{"* 2 EXISTS\r\n", "* OK [UNSEEN 2]", "* OK [UIDNEXT 3]", "a4 OK [READ-ONLY]"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("EXAMINE = %q, missing %q", got, want)
+		}
+	}
+
+	got = c.cmd("a5", "UID FETCH 2 (FLAGS BODY.PEEK[HEADER.FIELDS (SUBJECT)])")
+	if want := "* 2 FETCH (UID 2 FLAGS () BODY[HEADER.FIELDS (SUBJECT)] {18}\r\nSubject: again\r\n\r\n)\r\na5 OK FETCH completed\r\n"; got != want {
+		t.Errorf("UID FETCH = %q, want %q", got, want)
+	}
+	if got := c.cmd("a6", `SEARCH NOT FROM "alice"`); got != "* SEARCH 2\r\na6 OK SEARCH completed\r\n" {
+		t.Errorf("SEARCH = %q", got)
+	}
+	if got := c.cmd("a7", `STORE 1 +FLAGS (\Deleted)`); !strings.HasPrefix(got, "a7 NO [CANNOT]") {
+		t.Errorf("STORE = %q", got)
+	}
+	if got := c.cmd("a8", `STATUS "Archive/2023" (MESSAGES UIDNEXT)`); !strings.HasPrefix(got, "* STATUS \"Archive/2023\" (MESSAGES 0 UIDNEXT 1)\r\n") {
+		t.Errorf("STATUS = %q", got)
+	}
+	if got := c.cmd("a9", "SELECT Missing"); !strings.HasPrefix(got, "a9 NO [NONEXISTENT]") {
+		t.Errorf("SELECT Missing = %q", got)
+	}
+
+	c.conn.Write([]byte("b1 IDLE\r\n"))
+	if got := c.line(); got != "+ idling\r\n" {
+		t.Fatalf("IDLE = %q", got)
+	}
+	c.conn.Write([]byte("DONE\r\n"))
+	if got := c.line(); got != "b1 OK IDLE terminated\r\n" {
+		t.Errorf("DONE = %q", got)
+	}
+
+	if got := c.cmd("b2", "LOGOUT"); got != "* BYE logging out\r\nb2 OK LOGOUT completed\r\n" {
+		t.Errorf("LOGOUT = %q", got)
+	}
+	if _, err := c.r.ReadString('\n'); err == nil {
+		t.Error("connection still open after LOGOUT")
+	}
+}
+
+func TestListMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "Archive/2023", true},
+		{"%", "Archive/2023", false},
+		{"%", "Archive", true},
+		{"Archive/%", "Archive/2023", true},
+		{"inbox", "INBOX", true},
+		{"Inbox/%", "INBOX/Sub", true},
+		{"inboxes", "INBOX", false},
+		{"A*3", "Archive/2023", true},
+	}
+	for _, tt := range tests {
+		if got := listMatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("listMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStoreLogin(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	st := &Store{Root: t.TempDir(), Login: func(user, password string) bool { return user == "u" && password == "p" }}
+	go st.Serve(serverConn)
+	t.Cleanup(func() { clientConn.Close() })
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &client{t: t, conn: clientConn, r: bufio.NewReader(clientConn)}
+	c.line() // greeting
+
+	if got := c.cmd("a1", "LOGIN u wrong"); got != "a1 NO [AUTHENTICATIONFAILED] invalid credentials\r\n" {
+		t.Errorf("bad LOGIN = %q", got)
+	}
+	if got := c.cmd("a2", "LIST \"\" *"); !strings.HasPrefix(got, "a2 BAD") {
+		t.Errorf("LIST after failed LOGIN = %q", got)
+	}
+	if got := c.cmd("a3", `LOGIN "u" "p"`); !strings.HasPrefix(got, "a3 OK") {
+		t.Errorf("LOGIN = %q", got)
+	}
+}
@@ -0,0 +1,457 @@
+// Package localstore serves a maildir or mbox tree on disk over IMAP,
+// read-only, so an account's upstream can be an archive instead of a mail
+// server. The layout is the one the export subcommand writes: one maildir
+// directory or <name>.mbox file per folder, nested one directory per
+// hierarchy level. A root that is itself a maildir is served as INBOX,
+// with Maildir++ ".Sub.Folder" directories beside it, and a root that is
+// a file is served as an mbox INBOX.
+package localstore
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// delim is the hierarchy delimiter of served folder names.
+const delim = "/"
+
+// folder is a folder found under the root.
+type folder struct {
+	name string // UTF-8, with delim between levels
+	path string
+	mbox bool
+}
+
+// errNoFolder is returned for a folder that does not exist.
+var errNoFolder = errors.New("no such folder")
+
+// listFolders returns the folders under root, sorted by name.
+func listFolders(root string) ([]folder, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []folder{{name: "INBOX", path: root, mbox: true}}, nil
+	}
+	var folders []folder
+	if isMaildir(root) {
+		folders = append(folders, folder{name: "INBOX", path: root})
+	}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		base := d.Name()
+		switch {
+		case rel == ".":
+			return nil
+		case d.IsDir() && strings.HasPrefix(base, "."):
+			// Maildir++ subfolders live directly under a maildir root.
+			if filepath.Dir(rel) == "." && isMaildir(root) && isMaildir(path) {
+				name := strings.ReplaceAll(strings.TrimPrefix(base, "."), ".", delim)
+				folders = append(folders, folder{name: name, path: path})
+			}
+			return filepath.SkipDir
+		case d.IsDir() && (base == "cur" || base == "new" || base == "tmp") && isMaildir(filepath.Dir(path)):
+			return filepath.SkipDir
+		case d.IsDir() && isMaildir(path):
+			folders = append(folders, folder{name: folderName(rel), path: path})
+		case !d.IsDir() && strings.HasSuffix(base, ".mbox"):
+			folders = append(folders, folder{name: folderName(strings.TrimSuffix(rel, ".mbox")), path: path, mbox: true})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(folders, func(a, b folder) int { return cmp.Compare(a.name, b.name) })
+	return slices.CompactFunc(folders, func(a, b folder) bool { return a.name == b.name }), nil
+}
+
+// folderName turns a path relative to the root into a folder name.
+func folderName(rel string) string {
+	name := filepath.ToSlash(rel)
+	if first, rest, found := strings.Cut(name, delim); strings.EqualFold(first, "INBOX") {
+		name = "INBOX"
+		if found {
+			name += delim + rest
+		}
+	}
+	return name
+}
+
+func isMaildir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && info.IsDir()
+}
+
+// message is one message of an opened mailbox.
+type message struct {
+	uid   uint32
+	flags []string
+	date  time.Time // INTERNALDATE
+
+	// read returns the message with CRLF line endings.
+	read func() ([]byte, error)
+	size int64 // of the CRLF form, or -1 until read
+}
+
+// content reads the message and records its size.
+func (m *message) content() ([]byte, error) {
+	b, err := m.read()
+	if err == nil {
+		m.size = int64(len(b))
+	}
+	return b, err
+}
+
+// rfc822Size returns the size of the message in CRLF form.
+func (m *message) rfc822Size() (int64, error) {
+	if m.size < 0 {
+		if _, err := m.content(); err != nil {
+			return 0, err
+		}
+	}
+	return m.size, nil
+}
+
+func (m *message) hasFlag(flag string) bool {
+	return slices.ContainsFunc(m.flags, func(f string) bool { return strings.EqualFold(f, flag) })
+}
+
+// mailbox is an opened folder: a snapshot of its messages in UID order.
+type mailbox struct {
+	name        string
+	uidValidity uint32
+	msgs        []*message
+}
+
+// uidNext returns the UID the next message would get.
+func (mb *mailbox) uidNext() uint32 {
+	if len(mb.msgs) == 0 {
+		return 1
+	}
+	return mb.msgs[len(mb.msgs)-1].uid + 1
+}
+
+// unseen returns the number of messages without \Seen.
+func (mb *mailbox) unseen() int {
+	n := 0
+	for _, m := range mb.msgs {
+		if !m.hasFlag(`\Seen`) {
+			n++
+		}
+	}
+	return n
+}
+
+// openFolder loads the messages of f.
+func openFolder(f folder) (*mailbox, error) {
+	if f.mbox {
+		return openMbox(f)
+	}
+	return openMaildir(f)
+}
+
+// maildirFlags maps maildir info letters to system flags.
+var maildirFlags = map[byte]string{
+	'D': `\Draft`,
+	'F': `\Flagged`,
+	'R': `\Answered`,
+	'S': `\Seen`,
+	'T': `\Deleted`,
+}
+
+// exportName matches the unique part of a maildir file name written by
+// the export subcommand, which carries the upstream UIDVALIDITY and UID.
+var exportName = regexp.MustCompile(`^\d+\.(\d+)_(\d+)\.imap-proxy$`)
+
+// openMaildir loads a maildir. Files written by the export subcommand keep
+// their upstream UIDs and UIDVALIDITY. Otherwise UIDs follow the order of
+// the file names and UIDVALIDITY is derived from them, so it changes
+// whenever the folder's contents do.
+func openMaildir(f folder) (*mailbox, error) {
+	type file struct {
+		path, unique string
+		flags        []string
+		date         time.Time
+	}
+	var files []file
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(f.path, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			unique, infoPart, _ := strings.Cut(e.Name(), ":")
+			var flags []string
+			if letters, ok := strings.CutPrefix(infoPart, "2,"); ok {
+				for i := range len(letters) {
+					if flag, ok := maildirFlags[letters[i]]; ok {
+						flags = append(flags, flag)
+					}
+				}
+			}
+			files = append(files, file{filepath.Join(f.path, sub, e.Name()), unique, flags, info.ModTime()})
+		}
+	}
+	slices.SortFunc(files, func(a, b file) int { return cmp.Compare(a.unique, b.unique) })
+
+	mb := &mailbox{name: f.name}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.unique)
+	}
+	uids := exportUIDs(names)
+	if uids == nil {
+		h := crc32.NewIEEE()
+		io.WriteString(h, f.name)
+		for _, file := range files {
+			io.WriteString(h, "\x00"+file.unique)
+		}
+		mb.uidValidity = max(h.Sum32(), 1)
+	} else {
+		mb.uidValidity = uids[len(uids)-1]
+		uids = uids[:len(uids)-1]
+	}
+	for i, file := range files {
+		uid := uint32(i + 1)
+		if uids != nil {
+			uid = uids[i]
+		}
+		mb.msgs = append(mb.msgs, &message{
+			uid:   uid,
+			flags: file.flags,
+			date:  file.date,
+			size:  -1,
+			read: func() ([]byte, error) {
+				b, err := os.ReadFile(file.path)
+				return crlf(b), err
+			},
+		})
+	}
+	slices.SortFunc(mb.msgs, func(a, b *message) int { return cmp.Compare(a.uid, b.uid) })
+	return mb, nil
+}
+
+// exportUIDs returns the UIDs in maildir file names written by the export
+// subcommand, followed by their common UIDVALIDITY. It returns nil unless
+// every name is of that form with the same UIDVALIDITY and distinct UIDs.
+func exportUIDs(names []string) []uint32 {
+	if len(names) == 0 {
+		return nil
+	}
+	var uids []uint32
+	var validity string
+	seen := map[uint32]bool{}
+	for _, name := range names {
+		m := exportName.FindStringSubmatch(name)
+		if m == nil || (validity != "" && m[1] != validity) {
+			return nil
+		}
+		validity = m[1]
+		uid, err := strconv.ParseUint(m[2], 10, 32)
+		if err != nil || uid == 0 || seen[uint32(uid)] {
+			return nil
+		}
+		seen[uint32(uid)] = true
+		uids = append(uids, uint32(uid))
+	}
+	v, err := strconv.ParseUint(validity, 10, 32)
+	if err != nil || v == 0 {
+		return nil
+	}
+	return append(uids, uint32(v))
+}
+
+// openMbox loads an mbox (mboxo or mboxrd). UIDs number the messages in
+// file order and UIDVALIDITY is derived from their From_ lines and sizes.
+// Flags come from the Status and X-Status headers.
+func openMbox(f folder) (*mailbox, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	mb := &mailbox{name: f.name}
+	h := crc32.NewIEEE()
+	io.WriteString(h, f.name)
+
+	type span struct {
+		start, end int64
+		date       time.Time
+		flags      []string
+	}
+	var (
+		spans    []span
+		cur      *span
+		inHeader bool
+		offset   int64
+		prevLine []byte
+	)
+	finish := func(end int64) {
+		if cur == nil {
+			return
+		}
+		// The blank line before the next From_ line is a separator.
+		if bytes.Equal(prevLine, []byte("\n")) || bytes.Equal(prevLine, []byte("\r\n")) {
+			end -= int64(len(prevLine))
+		}
+		cur.end = max(end, cur.start)
+		fmt.Fprintf(h, "\x00%d", cur.end-cur.start)
+		spans = append(spans, *cur)
+		cur = nil
+	}
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if from, ok := bytes.CutPrefix(line, []byte("From ")); ok && (offset == 0 || isBlank(prevLine)) {
+				finish(offset)
+				h.Write(line)
+				cur = &span{start: offset + int64(len(line)), date: fromLineDate(from)}
+				inHeader = true
+			} else if cur != nil && inHeader {
+				if isBlank(line) {
+					inHeader = false
+				} else {
+					cur.flags = append(cur.flags, statusFlags(line)...)
+				}
+			}
+			offset += int64(len(line))
+			prevLine = line
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	finish(offset)
+	mb.uidValidity = max(h.Sum32(), 1)
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range spans {
+		if s.date.IsZero() {
+			s.date = info.ModTime()
+		}
+		mb.msgs = append(mb.msgs, &message{
+			uid:   uint32(i + 1),
+			flags: slices.Compact(s.flags),
+			date:  s.date,
+			size:  -1,
+			read: func() ([]byte, error) {
+				b := make([]byte, s.end-s.start)
+				file, err := os.Open(f.path)
+				if err != nil {
+					return nil, err
+				}
+				defer file.Close()
+				if _, err := file.ReadAt(b, s.start); err != nil {
+					return nil, err
+				}
+				return crlf(unquoteFrom(b)), nil
+			},
+		})
+	}
+	return mb, nil
+}
+
+func isBlank(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// fromLineDate parses the date at the end of a From_ line, after the
+// "From " prefix.
+func fromLineDate(from []byte) time.Time {
+	_, date, _ := bytes.Cut(bytes.TrimRight(from, "\r\n"), []byte(" "))
+	for _, layout := range []string{time.ANSIC, "Mon Jan _2 15:04:05 2006 -0700", "Mon Jan _2 15:04:05 MST 2006"} {
+		if t, err := time.Parse(layout, strings.TrimSpace(string(date))); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// statusFlags returns the flags recorded in a Status or X-Status header
+// line, as written by mutt and other mbox clients.
+func statusFlags(line []byte) []string {
+	name, value, ok := bytes.Cut(line, []byte(":"))
+	if !ok {
+		return nil
+	}
+	letters := map[byte]string{}
+	switch strings.ToLower(string(name)) {
+	case "status":
+		letters = map[byte]string{'R': `\Seen`}
+	case "x-status":
+		letters = map[byte]string{'A': `\Answered`, 'F': `\Flagged`, 'D': `\Deleted`, 'T': `\Draft`}
+	}
+	var flags []string
+	for _, c := range bytes.TrimSpace(value) {
+		if flag, ok := letters[c]; ok {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+// unquoteFrom undoes mboxrd quoting: one '>' is removed from lines that
+// match ">+From ".
+func unquoteFrom(b []byte) []byte {
+	var out bytes.Buffer
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+		}
+		b = b[len(line):]
+		if len(line) > 0 && line[0] == '>' && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			line = line[1:]
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+// crlf converts bare LF line endings to CRLF.
+func crlf(b []byte) []byte {
+	n := bytes.Count(b, []byte("\n")) - bytes.Count(b, []byte("\r\n"))
+	if n == 0 {
+		return b
+	}
+	out := make([]byte, 0, len(b)+n)
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,160 @@
+package localstore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeFile creates path and its parent directories.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func makeMaildir(t *testing.T, dir string) {
+	t.Helper()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListFolders(t *testing.T) {
+	root := t.TempDir()
+	makeMaildir(t, filepath.Join(root, "inbox"))
+	makeMaildir(t, filepath.Join(root, "Archive", "2023"))
+	writeFile(t, filepath.Join(root, "Lists", "go.mbox"), "")
+	writeFile(t, filepath.Join(root, ".export-maildir.json"), "{}")
+
+	folders, err := listFolders(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range folders {
+		got = append(got, f.name)
+	}
+	if want := []string{"Archive/2023", "INBOX", "Lists/go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("folders = %q, want %q", got, want)
+	}
+}
+
+func TestListFoldersMaildirPlusPlus(t *testing.T) {
+	root := t.TempDir()
+	makeMaildir(t, root)
+	makeMaildir(t, filepath.Join(root, ".Sent"))
+	makeMaildir(t, filepath.Join(root, ".Archive.2023"))
+	folders, err := listFolders(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range folders {
+		got = append(got, f.name)
+	}
+	if want := []string{"Archive/2023", "INBOX", "Sent"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("folders = %q, want %q", got, want)
+	}
+
+	file := filepath.Join(t.TempDir(), "mail")
+	writeFile(t, file, "")
+	if folders, _ := listFolders(file); len(folders) != 1 || folders[0].name != "INBOX" || !folders[0].mbox {
+		t.Errorf("file root: folders = %+v, want an mbox INBOX", folders)
+	}
+}
+
+func TestOpenMaildir(t *testing.T) {
+	dir := t.TempDir()
+	makeMaildir(t, dir)
+	writeFile(t, filepath.Join(dir, "cur", "1700000002.b.host:2,RS"), "Subject: two\n\nbody\n")
+	writeFile(t, filepath.Join(dir, "new", "1700000001.a.host"), "Subject: one\r\n\r\nbody\r\n")
+	mb, err := openFolder(folder{name: "INBOX", path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mb.msgs) != 2 || mb.msgs[0].uid != 1 || mb.msgs[1].uid != 2 {
+		t.Fatalf("messages = %+v", mb.msgs)
+	}
+	if got := mb.msgs[1].flags; !reflect.DeepEqual(got, []string{`\Answered`, `\Seen`}) {
+		t.Errorf("flags = %q", got)
+	}
+	body, err := mb.msgs[1].content()
+	if err != nil || string(body) != "Subject: two\r\n\r\nbody\r\n" {
+		t.Errorf("content = %q, %v; want CRLF line endings", body, err)
+	}
+	if mb.unseen() != 1 || mb.uidNext() != 3 {
+		t.Errorf("unseen = %d, uidnext = %d", mb.unseen(), mb.uidNext())
+	}
+
+	// Adding a message changes UIDVALIDITY, since UIDs may have moved.
+	before := mb.uidValidity
+	writeFile(t, filepath.Join(dir, "new", "1700000000.c.host"), "Subject: zero\n\n")
+	if mb, _ := openFolder(folder{name: "INBOX", path: dir}); mb.uidValidity == before {
+		t.Error("UIDVALIDITY unchanged after adding a message")
+	}
+}
+
+func TestOpenMaildirExportNames(t *testing.T) {
+	dir := t.TempDir()
+	makeMaildir(t, dir)
+	writeFile(t, filepath.Join(dir, "cur", "1700000000.42_7.imap-proxy:2,S"), "a\n")
+	writeFile(t, filepath.Join(dir, "cur", "1600000000.42_12.imap-proxy:2,"), "b\n")
+	mb, err := openFolder(folder{name: "INBOX", path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mb.uidValidity != 42 || mb.msgs[0].uid != 7 || mb.msgs[1].uid != 12 || mb.uidNext() != 13 {
+		t.Errorf("uidvalidity %d, uids %d %d; want the exported ones", mb.uidValidity, mb.msgs[0].uid, mb.msgs[1].uid)
+	}
+}
+
+func TestOpenMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "INBOX.mbox")
+	writeFile(t, path, "From a@example.com Mon Jan  2 10:00:00 2006\n"+
+		"Subject: one\nStatus: RO\nX-Status: F\n\n>From the start\n>>From quoted\n\n"+
+		"From b@example.com Tue Jan  3 10:00:00 2006\nSubject: two\n\nFrom: not a separator\n")
+	mb, err := openFolder(folder{name: "INBOX", path: path, mbox: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mb.msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(mb.msgs))
+	}
+	first, _ := mb.msgs[0].content()
+	if want := "Subject: one\r\nStatus: RO\r\nX-Status: F\r\n\r\nFrom the start\r\n>From quoted\r\n"; string(first) != want {
+		t.Errorf("first = %q, want %q", first, want)
+	}
+	if got := mb.msgs[0].flags; !reflect.DeepEqual(got, []string{`\Seen`, `\Flagged`}) {
+		t.Errorf("flags = %q", got)
+	}
+	if want := time.Date(2006, 1, 3, 10, 0, 0, 0, time.UTC); !mb.msgs[1].date.Equal(want) {
+		t.Errorf("date = %v, want %v", mb.msgs[1].date, want)
+	}
+	second, _ := mb.msgs[1].content()
+	if want := "Subject: two\r\n\r\nFrom: not a separator\r\n"; string(second) != want {
+		t.Errorf("second = %q, want %q", second, want)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"a\nb\n", "a\r\nb\r\n"},
+		{"a\r\nb\n", "a\r\nb\r\n"},
+		{"\n", "\r\n"},
+		{"a", "a"},
+	}
+	for _, tt := range tests {
+		if got := string(crlf([]byte(tt.in))); got != tt.want {
+			t.Errorf("crlf(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Package metrics implements a minimal registry of counters and gauges
+// exposed in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the process-wide registry used by the proxy.
+var Default = NewRegistry()
+
+// Registry holds a set of metric families.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+type family struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+	fn     func() float64 // set for gauge funcs; no labels
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func (r *Registry) register(name, help, kind string, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		return f
+	}
+	f := &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*sample),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (f *family) add(delta float64, lvs []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(lvs).value += delta
+}
+
+func (f *family) set(v float64, lvs []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(lvs).value = v
+}
+
+// get returns the sample for the label values; f.mu must be held.
+func (f *family) get(lvs []string) *sample {
+	if len(lvs) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s: got %d label values, want %d", f.name, len(lvs), len(f.labels)))
+	}
+	key := strings.Join(lvs, "\xff")
+	s, ok := f.values[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), lvs...)}
+		f.values[key] = s
+	}
+	return s
+}
+
+func (f *family) value(lvs []string) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.values[strings.Join(lvs, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// Counter is a monotonically increasing metric with optional labels.
+type Counter struct{ f *family }
+
+// NewCounter registers (or returns the existing) counter with the given name.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{f: r.register(name, help, "counter", labels)}
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *Counter) Inc(labelValues ...string) { c.f.add(1, labelValues) }
+
+// Add increments the counter for the given label values by delta.
+func (c *Counter) Add(delta float64, labelValues ...string) { c.f.add(delta, labelValues) }
+
+// Value returns the current value for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 { return c.f.value(labelValues) }
+
+// Gauge is a metric that can go up and down, with optional labels.
+type Gauge struct{ f *family }
+
+// NewGauge registers (or returns the existing) gauge with the given name.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{f: r.register(name, help, "gauge", labels)}
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) { g.f.set(v, labelValues) }
+
+// Add adds delta to the gauge for the given label values.
+func (g *Gauge) Add(delta float64, labelValues ...string) { g.f.add(delta, labelValues) }
+
+// Inc increments the gauge for the given label values by one.
+func (g *Gauge) Inc(labelValues ...string) { g.f.add(1, labelValues) }
+
+// Dec decrements the gauge for the given label values by one.
+func (g *Gauge) Dec(labelValues ...string) { g.f.add(-1, labelValues) }
+
+// Value returns the current value for the given label values.
+func (g *Gauge) Value(labelValues ...string) float64 { return g.f.value(labelValues) }
+
+// NewGaugeFunc registers an unlabeled gauge whose value is computed by fn
+// at collection time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	f := r.register(name, help, "gauge", nil)
+	f.mu.Lock()
+	f.fn = fn
+	f.mu.Unlock()
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	fams := make([]*family, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		fams = append(fams, r.families[name])
+	}
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range fams {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+
+		f.mu.Lock()
+		if f.fn != nil {
+			fmt.Fprintf(&b, "%s %s\n", f.name, formatValue(f.fn()))
+			f.mu.Unlock()
+			continue
+		}
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.values[k]
+			b.WriteString(f.name)
+			if len(f.labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range f.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=%q", l, s.labelValues[i])
+				}
+				b.WriteByte('}')
+			}
+			fmt.Fprintf(&b, " %s\n", formatValue(s.value))
+		}
+		f.mu.Unlock()
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Handler returns an http.Handler serving the registry in text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterAndGauge(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A test counter.", "verb")
+	c.Inc("FETCH")
+	c.Add(2, "FETCH")
+	c.Inc("LIST")
+
+	g := r.NewGauge("test_active", "A test gauge.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	if got := c.Value("FETCH"); got != 3 {
+		t.Errorf("counter FETCH = %v, want 3", got)
+	}
+	if got := g.Value(); got != 1 {
+		t.Errorf("gauge = %v, want 1", got)
+	}
+
+	// Registering the same name again returns the same family.
+	if got := r.NewCounter("test_total", "ignored", "verb").Value("LIST"); got != 1 {
+		t.Errorf("re-registered counter LIST = %v, want 1", got)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("b_total", "Counter b.", "verb").Inc("NOOP")
+	r.NewGauge("a_info", "Info a.", "version").Set(1, "1.0")
+	r.NewGaugeFunc("c_func", "Func c.", func() float64 { return 42 })
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	want := `# HELP a_info Info a.
+# TYPE a_info gauge
+a_info{version="1.0"} 1
+# HELP b_total Counter b.
+# TYPE b_total counter
+b_total{verb="NOOP"} 1
+# HELP c_func Func c.
+# TYPE c_func gauge
+c_func 42
+`
+	if b.String() != want {
+		t.Errorf("WriteText:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestLabelCountMismatchPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("x_total", "x", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on label count mismatch")
+		}
+	}()
+	c.Inc("only-one")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("h_total", "h").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "h_total 1") {
+		t.Errorf("unexpected body: %q", rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
@@ -0,0 +1,304 @@
+// Package nats publishes messages to a NATS server using the core text
+// protocol. It implements only what the proxy needs: connecting (with
+// optional TLS and user/password or token authentication), publishing,
+// answering server PINGs and reconnecting.
+package nats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultBuffer is the number of messages held while the server is
+	// unreachable when no buffer size is given.
+	DefaultBuffer = 1000
+
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 10 * time.Second
+	minBackoff   = time.Second
+	maxBackoff   = 30 * time.Second
+)
+
+// Publisher sends messages to a NATS server in the background. Publish
+// never blocks: messages are queued, and while the server is unreachable
+// the publisher reconnects with backoff and holds up to its buffer size of
+// messages, dropping newer ones.
+type Publisher struct {
+	url *url.URL
+
+	// OnError is called when the server cannot be reached or rejects the
+	// connection (once per outage), and when messages were dropped. It may
+	// be nil and must be set before the first Publish.
+	OnError func(error)
+
+	mu      sync.Mutex // guards closed and sends on queue
+	closed  bool
+	queue   chan message
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Int64
+
+	// sleep waits between reconnection attempts; tests replace it.
+	sleep func(time.Duration, <-chan struct{})
+}
+
+type message struct {
+	subject string
+	data    []byte
+}
+
+// ParseURL checks a NATS server URL: nats://host[:port] or tls://host[:port],
+// optionally with user:password or a token as user information. The port
+// defaults to 4222.
+func ParseURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("nats: unsupported scheme %q (want nats or tls)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("nats: missing host")
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return u, nil
+}
+
+// NewPublisher returns a publisher for the server at rawURL (see ParseURL)
+// holding up to buffer messages. Close stops it.
+func NewPublisher(rawURL string, buffer int) (*Publisher, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	p := &Publisher{
+		url:   u,
+		queue: make(chan message, buffer),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		sleep: sleepOrStop,
+	}
+	go p.run()
+	return p, nil
+}
+
+// Publish queues data for subject.
+func (p *Publisher) Publish(subject string, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.queue <- message{subject, data}:
+	default:
+		p.dropped.Add(1)
+	}
+}
+
+// Close sends the queued messages if the server is reachable and stops the
+// publisher. Messages published after Close are discarded.
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+		close(p.stop)
+	}
+	p.mu.Unlock()
+	<-p.done
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+	var c *conn
+	defer func() {
+		if c != nil {
+			c.close()
+		}
+	}()
+	backoff := minBackoff
+	failing := false
+	for m := range p.queue {
+		for {
+			var err error
+			if c == nil {
+				c, err = p.connect()
+			}
+			if err == nil {
+				if err = c.publish(m); err != nil {
+					c.close()
+					c = nil
+				}
+			}
+			if err == nil {
+				break
+			}
+			if !failing {
+				p.fail(fmt.Errorf("nats: %s: %w", p.url.Host, err))
+				failing = true
+			}
+			select {
+			case <-p.stop:
+				// Closing; the server is unreachable, so give up.
+				return
+			default:
+			}
+			p.sleep(backoff, p.stop)
+			backoff = min(backoff*2, maxBackoff)
+		}
+		failing = false
+		backoff = minBackoff
+		if n := p.dropped.Swap(0); n > 0 {
+			p.fail(fmt.Errorf("nats: dropped %d messages while the buffer was full", n))
+		}
+	}
+}
+
+func (p *Publisher) fail(err error) {
+	if p.OnError != nil {
+		p.OnError(err)
+	}
+}
+
+// sleepOrStop waits for d or until stop is closed.
+func sleepOrStop(d time.Duration, stop <-chan struct{}) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-stop:
+	}
+}
+
+// conn is one connection to the server. A reader goroutine answers PINGs
+// and records -ERR responses, which end the connection.
+type conn struct {
+	nc net.Conn
+
+	mu  sync.Mutex // serializes writes
+	err atomic.Pointer[error]
+}
+
+// connect dials the server, reads its INFO, upgrades to TLS for tls://
+// URLs, authenticates and waits for the PONG that confirms the CONNECT.
+func (p *Publisher) connect() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", p.url.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(dialTimeout))
+	r := bufio.NewReader(nc)
+	info, err := r.ReadString('\n')
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("read INFO: %w", err)
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		nc.Close()
+		return nil, fmt.Errorf("unexpected greeting %q", strings.TrimRight(info, "\r\n"))
+	}
+	if p.url.Scheme == "tls" {
+		tc := tls.Client(nc, &tls.Config{ServerName: p.url.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		nc = tc
+		r = bufio.NewReader(nc)
+	}
+
+	opts := map[string]any{"verbose": false, "pedantic": false, "name": "imap-proxy", "lang": "go"}
+	if u := p.url.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			opts["user"], opts["pass"] = u.Username(), pass
+		} else {
+			opts["auth_token"] = u.Username()
+		}
+	}
+	b, _ := json.Marshal(opts)
+	if _, err := fmt.Fprintf(nc, "CONNECT %s\r\nPING\r\n", b); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("send CONNECT: %w", err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("read CONNECT response: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			nc.Close()
+			return nil, fmt.Errorf("server refused connection: %s", line)
+		}
+	}
+	nc.SetDeadline(time.Time{})
+
+	c := &conn{nc: nc}
+	go c.read(r)
+	return c, nil
+}
+
+// read handles what the server sends after the handshake.
+func (c *conn) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.setErr(err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			c.write("PONG\r\n")
+		case strings.HasPrefix(line, "-ERR"):
+			c.setErr(fmt.Errorf("server error: %s", line))
+			c.nc.Close()
+			return
+		}
+	}
+}
+
+func (c *conn) setErr(err error) {
+	c.err.CompareAndSwap(nil, &err)
+}
+
+func (c *conn) write(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.nc.Write([]byte(s))
+	return err
+}
+
+// publish sends m, failing if the connection has already ended.
+func (c *conn) publish(m message) error {
+	if err := c.err.Load(); err != nil {
+		return *err
+	}
+	return c.write(fmt.Sprintf("PUB %s %d\r\n%s\r\n", m.subject, len(m.data), m.data))
+}
+
+func (c *conn) close() {
+	c.nc.Close()
+}
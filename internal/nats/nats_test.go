@@ -0,0 +1,216 @@
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type published struct {
+	subject, data string
+}
+
+// fakeServer is a minimal NATS server. Each connection's CONNECT options
+// are sent on connects and each message on msgs. If refuse is set, the
+// CONNECT is answered with -ERR.
+type fakeServer struct {
+	ln       net.Listener
+	connects chan map[string]any
+	msgs     chan published
+	conns    chan net.Conn
+	pongs    chan struct{}
+	refuse   bool
+}
+
+func newFakeServer(t *testing.T, refuse bool) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		ln: ln, refuse: refuse,
+		connects: make(chan map[string]any, 10), msgs: make(chan published, 100),
+		conns: make(chan net.Conn, 10), pongs: make(chan struct{}, 10),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- c
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) url() string { return "nats://" + s.ln.Addr().String() }
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	fmt.Fprint(c, "INFO {\"server_id\":\"fake\"}\r\n")
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, args, _ := strings.Cut(line, " ")
+		switch verb {
+		case "CONNECT":
+			var opts map[string]any
+			json.Unmarshal([]byte(args), &opts)
+			s.connects <- opts
+			if s.refuse {
+				fmt.Fprint(c, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PING":
+			fmt.Fprint(c, "PONG\r\n")
+		case "PONG":
+			s.pongs <- struct{}{}
+		case "PUB":
+			subject, size, _ := strings.Cut(args, " ")
+			n, _ := strconv.Atoi(size)
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			s.msgs <- published{subject, string(data[:n])}
+		}
+	}
+}
+
+func next[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+		var zero T
+		return zero
+	}
+}
+
+func TestPublish(t *testing.T) {
+	srv := newFakeServer(t, false)
+	p, err := NewPublisher(strings.Replace(srv.url(), "nats://", "nats://alice:secret@", 1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.OnError = func(err error) { t.Errorf("OnError: %v", err) }
+	p.Publish("imap-proxy.mail.new", []byte(`{"user":"a"}`))
+	p.Publish("imap-proxy.session.end", []byte("two\r\nlines"))
+
+	opts := next(t, srv.connects)
+	if opts["user"] != "alice" || opts["pass"] != "secret" || opts["verbose"] != false {
+		t.Errorf("CONNECT options = %v", opts)
+	}
+	if m := next(t, srv.msgs); m != (published{"imap-proxy.mail.new", `{"user":"a"}`}) {
+		t.Errorf("first message = %+v", m)
+	}
+	if m := next(t, srv.msgs); m != (published{"imap-proxy.session.end", "two\r\nlines"}) {
+		t.Errorf("second message = %+v", m)
+	}
+
+	// The publisher answers the server's PINGs.
+	fmt.Fprint(next(t, srv.conns), "PING\r\n")
+	next(t, srv.pongs)
+
+	p.Close()
+	p.Publish("late", nil) // discarded, must not panic
+}
+
+func TestPublishToken(t *testing.T) {
+	srv := newFakeServer(t, false)
+	p, err := NewPublisher(strings.Replace(srv.url(), "nats://", "nats://s3cr3t@", 1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.Publish("x", nil)
+	if opts := next(t, srv.connects); opts["auth_token"] != "s3cr3t" || opts["user"] != nil {
+		t.Errorf("CONNECT options = %v", opts)
+	}
+}
+
+func TestPublishRefused(t *testing.T) {
+	srv := newFakeServer(t, true)
+	p, err := NewPublisher(srv.url(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 10)
+	p.OnError = func(err error) { errs <- err }
+	p.sleep = func(time.Duration, <-chan struct{}) {}
+	p.Publish("x", []byte("1"))
+	if err := next(t, errs); !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("error = %v", err)
+	}
+	p.Close()
+}
+
+func TestPublishReconnects(t *testing.T) {
+	srv := newFakeServer(t, false)
+	p, err := NewPublisher(srv.url(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.sleep = func(time.Duration, <-chan struct{}) { time.Sleep(time.Millisecond) }
+	defer p.Close()
+
+	p.Publish("first", nil)
+	next(t, srv.msgs)
+	next(t, srv.conns).Close()
+
+	// Messages written before the publisher notices the closed connection
+	// are lost, so keep publishing until one arrives on the new connection.
+	deadline := time.After(5 * time.Second)
+	for {
+		p.Publish("again", nil)
+		select {
+		case m := <-srv.msgs:
+			if m.subject != "again" {
+				t.Fatalf("message = %+v", m)
+			}
+			return
+		case <-deadline:
+			t.Fatal("no message after the server dropped the connection")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		raw, wantHost, wantErr string
+	}{
+		{raw: "nats://nats.example.com", wantHost: "nats.example.com:4222"},
+		{raw: "tls://u:p@nats.example.com:4443", wantHost: "nats.example.com:4443"},
+		{raw: "http://nats.example.com", wantErr: "scheme"},
+		{raw: "nats://", wantErr: "host"},
+	}
+	for _, tt := range tests {
+		u, err := ParseURL(tt.raw)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseURL(%q) err = %v, want %q", tt.raw, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || u.Host != tt.wantHost {
+			t.Errorf("ParseURL(%q) = %v, %v, want host %s", tt.raw, u, err, tt.wantHost)
+		}
+	}
+}
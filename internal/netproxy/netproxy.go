@@ -0,0 +1,271 @@
+// Package netproxy dials TCP connections through a SOCKS5 (RFC 1928) or
+// HTTP CONNECT proxy.
+package netproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Dialer connects to targets through a proxy.
+type Dialer struct {
+	url *url.URL
+	// Forward dials the proxy itself. It defaults to a net.Dialer.
+	Forward func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// New returns a Dialer for a proxy URL of the form
+// scheme://[user:password@]host:port, where scheme is "socks5" (target
+// names resolved locally), "socks5h" (resolved by the proxy) or "http"
+// (CONNECT).
+func New(rawURL string) (*Dialer, error) {
+	u, err := Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	return &Dialer{url: u, Forward: d.DialContext}, nil
+}
+
+// Parse validates a proxy URL.
+func Parse(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("proxy url: %w", err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("proxy url: unsupported scheme %q (want socks5, socks5h or http)", u.Scheme)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("proxy url: %q must include host and port", u.Redacted())
+	}
+	return u, nil
+}
+
+// DialContext connects to addr (host:port) through the proxy. The context
+// deadline, if any, also bounds the proxy handshake.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("proxy: unsupported network %q", network)
+	}
+	conn, err := d.Forward(ctx, "tcp", d.url.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s: %w", d.url.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// Interrupt the handshake if ctx is canceled while it is blocked.
+	raw := conn
+	stop := context.AfterFunc(ctx, func() { raw.SetDeadline(time.Unix(1, 0)) })
+
+	if d.url.Scheme == "http" {
+		var c net.Conn
+		if c, err = d.connect(conn, addr); err == nil {
+			conn = c
+		}
+	} else {
+		err = d.socks5(ctx, conn, addr)
+	}
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		// The connection deadline is the context's, and the handshake can
+		// hit it a moment before the context reports it.
+		if deadline, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(deadline) {
+			<-ctx.Done()
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("proxy %s: %w", d.url.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect performs an HTTP CONNECT handshake.
+func (d *Dialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.url.User; u != nil {
+		pass, _ := u.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	// The target may speak first (IMAP greeting), so keep anything the
+	// reader already buffered.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// SOCKS5 protocol constants.
+const (
+	socksVersion      = 0x05
+	socksAuthNone     = 0x00
+	socksAuthPass     = 0x02
+	socksNoAcceptable = 0xFF
+	socksCmdConnect   = 0x01
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+)
+
+var socksReplies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5 performs a SOCKS5 CONNECT handshake, with username/password
+// authentication (RFC 1929) when the URL carries credentials.
+func (d *Dialer) socks5(ctx context.Context, conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	if d.url.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return err
+		}
+		host = ips[0].IP.String()
+	}
+
+	method := byte(socksAuthNone)
+	if d.url.User != nil {
+		method = socksAuthPass
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", reply[0])
+	}
+	if reply[1] == socksNoAcceptable || reply[1] != method {
+		return errors.New("no acceptable authentication method")
+	}
+	if method == socksAuthPass {
+		user := d.url.User.Username()
+		pass, _ := d.url.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("username or password too long")
+		}
+		b := []byte{0x01, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(pass)))
+		b = append(b, pass...)
+		if _, err := conn.Write(b); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socksAtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socksAtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %q", host)
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		if msg, ok := socksReplies[head[1]]; ok {
+			return fmt.Errorf("connect %s: %s", addr, msg)
+		}
+		return fmt.Errorf("connect %s: reply code %d", addr, head[1])
+	}
+	// Discard the bound address.
+	var skip int
+	switch head[3] {
+	case socksAtypIPv4:
+		skip = net.IPv4len
+	case socksAtypIPv6:
+		skip = net.IPv6len
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("unknown address type %d in reply", head[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip+2))
+	return err
+}
+
+// bufferedConn is a net.Conn whose reads drain r first.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestServerDeniedNetwork(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	cfg := &config.Config{Server: config.ServerConfig{DeniedNetworks: []string{"127.0.0.0/8"}}}
+	srv := NewServer(cfg, slog.New(slog.DiscardHandler))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if line != "* BYE access denied\r\n" {
+		t.Fatalf("expected BYE, got %q", line)
+	}
+}
+
+func TestSessionAccountNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientIP string
+		wantOK   bool
+	}{
+		{name: "allowed subnet", clientIP: "10.20.30.40", wantOK: true},
+		{name: "other subnet", clientIP: "192.0.2.1", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Accounts[0].AllowedNetworks = []string{"10.20.0.0/16"}
+			env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) { s.clientIP = tt.clientIP })
+			defer env.clientConn.Close()
+			env.readLine(t) // greeting
+
+			env.send(t, "A001 LOGIN reader1 localpass1\r\n")
+			if tt.wantOK {
+				env.drainUpstream(t)
+			}
+			line := env.readLine(t)
+			if got := strings.HasPrefix(line, "A001 OK"); got != tt.wantOK {
+				t.Fatalf("LOGIN response %q, want ok=%v", line, tt.wantOK)
+			}
+			if !tt.wantOK && line != "A001 NO LOGIN failed\r\n" {
+				t.Errorf("denied login should look like any failure, got %q", line)
+			}
+		})
+	}
+}
+
+// Correct credentials from a disallowed network must not tell the client
+// the password was right, for instance by clearing earlier failures.
+func TestDeniedNetworkKeepsLockout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].AllowedNetworks = []string{"10.20.0.0/16"}
+	cfg.Server.Lockout = config.LockoutConfig{MaxFailures: 2, Duration: time.Minute}
+	sh := newShared()
+	login := func(clientIP, pass string) string {
+		env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+			s.shared = sh
+			s.clientIP = clientIP
+		})
+		defer env.clientConn.Close()
+		env.readLine(t) // greeting
+		env.send(t, "A001 LOGIN reader1 "+pass+"\r\n")
+		return env.readLine(t)
+	}
+
+	if line := login("10.20.30.40", "wrong"); line != "A001 NO LOGIN failed\r\n" {
+		t.Fatalf("first failure: %q", line)
+	}
+	if line := login("192.0.2.1", "localpass1"); line != "A001 NO LOGIN failed\r\n" {
+		t.Fatalf("denied network: %q", line)
+	}
+	if line := login("10.20.30.40", "wrong"); line != "A001 NO LOGIN failed\r\n" {
+		t.Fatalf("second failure: %q", line)
+	}
+	if locked, _ := sh.lockout.locked("reader1"); !locked {
+		t.Error("account not locked: the login from the denied network reset its failures")
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"imap-proxy/internal/config"
+)
+
+// accountLogs holds the log level and destination overrides of accounts.
+type accountLogs struct {
+	mu       sync.Mutex
+	accounts map[string]*accountLog // by local user
+}
+
+// accountLog is one account's override. Sessions hold it through their
+// logger, so level changes apply to sessions in progress.
+type accountLog struct {
+	level atomic.Pointer[slog.Level] // nil: the level of the destination
+	file  slog.Handler               // nil: the main log
+}
+
+func newAccountLogs() *accountLogs {
+	return &accountLogs{accounts: make(map[string]*accountLog)}
+}
+
+// get returns the override of acct, opening its log_file on first use.
+// A log file that cannot be opened is reported to logger and the main
+// log is used instead.
+func (l *accountLogs) get(acct *config.AccountConfig, logger *slog.Logger) *accountLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.accounts[acct.LocalUser]
+	if ok {
+		return a
+	}
+	a = &accountLog{}
+	if acct.LogLevel != "" {
+		level, _ := config.ParseLogLevel(acct.LogLevel) // checked by config.Load
+		a.level.Store(&level)
+	}
+	if acct.LogFile != "" {
+		// The file stays open for the life of the process.
+		f, err := os.OpenFile(acct.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			logger.Error("cannot open account log file, using the main log", "user", acct.LocalUser, "err", err)
+		} else {
+			a.file = slog.NewTextHandler(f, nil)
+		}
+	}
+	l.accounts[acct.LocalUser] = a
+	return a
+}
+
+// logger returns the logger for a session of acct, based on logger.
+func (l *accountLogs) logger(acct *config.AccountConfig, logger *slog.Logger) *slog.Logger {
+	a := l.get(acct, logger)
+	h := a.file
+	if h == nil {
+		h = logger.Handler()
+	}
+	return slog.New(&levelHandler{level: &a.level, h: h})
+}
+
+// levelHandler applies an account's or a session's level override to h.
+// It relies on h filtering by level only in Enabled, as slog's own
+// handlers do.
+type levelHandler struct {
+	level *atomic.Pointer[slog.Level] // holds nil when not overridden
+	h     slog.Handler
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if override := h.level.Load(); override != nil {
+		return level >= *override
+	}
+	return h.h.Enabled(ctx, level)
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.h.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, h: h.h.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, h: h.h.WithGroup(name)}
+}
+
+// LogLevelHandler serves the log level of the account named by the {user}
+// path value: GET returns it ("default" when the account follows its log
+// destination) and PUT sets it from the request body, a level such as
+// "debug" or "default". Changes apply to running sessions immediately and
+// last until the process restarts.
+func (s *Server) LogLevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acct := s.config.LookupUser(r.PathValue("user"))
+		if acct == nil {
+			http.Error(w, "unknown account", http.StatusNotFound)
+			return
+		}
+		a := s.shared.accountLogs.get(acct, s.logger)
+		serveLogLevel(w, r, &a.level, func(name string) {
+			s.logger.Info("account log level changed", "user", acct.LocalUser, "level", name)
+		})
+	})
+}
+
+// serveLogLevel serves GET and PUT of the level override held by level.
+// After a PUT, changed is called with the name of the new level.
+func serveLogLevel(w http.ResponseWriter, r *http.Request, level *atomic.Pointer[slog.Level], changed func(name string)) {
+	if r.Method == http.MethodPut {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(string(body))
+		if name == "default" {
+			level.Store(nil)
+		} else {
+			l, err := config.ParseLogLevel(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			level.Store(&l)
+		}
+		changed(name)
+	}
+	name := "default"
+	if l := level.Load(); l != nil {
+		name = strings.ToLower(l.String())
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, name)
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestAccountLogsLevel(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logs := newAccountLogs()
+	noisy := &config.AccountConfig{LocalUser: "noisy", LogLevel: "debug"}
+	quiet := &config.AccountConfig{LocalUser: "quiet", LogLevel: "warn"}
+	plain := &config.AccountConfig{LocalUser: "plain"}
+
+	logs.logger(noisy, base).With("user", "noisy").Debug("noisy debug")
+	logs.logger(quiet, base).Info("quiet info")
+	logs.logger(plain, base).Debug("plain debug")
+	logs.logger(plain, base).Info("plain info")
+
+	got := buf.String()
+	if !strings.Contains(got, `msg="noisy debug" user=noisy`) {
+		t.Errorf("debug line of a debug account missing from %q", got)
+	}
+	for _, msg := range []string{"quiet info", "plain debug"} {
+		if strings.Contains(got, msg) {
+			t.Errorf("%q logged below the account level: %q", msg, got)
+		}
+	}
+	if !strings.Contains(got, "plain info") {
+		t.Errorf("info line of an account without override missing from %q", got)
+	}
+}
+
+func TestAccountLogsFile(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(slog.NewTextHandler(&buf, nil))
+	path := filepath.Join(t.TempDir(), "noisy.log")
+	acct := &config.AccountConfig{LocalUser: "noisy", LogLevel: "debug", LogFile: path}
+
+	newAccountLogs().logger(acct, base).Debug("to the account file")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "to the account file") {
+		t.Errorf("account log file = %q", data)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("main log = %q, want nothing", buf.String())
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	cfg := testConfig()
+	srv := NewServer(cfg, testLogger())
+	mux := http.NewServeMux()
+	mux.Handle("GET /accounts/{user}/log-level", srv.LogLevelHandler())
+	mux.Handle("PUT /accounts/{user}/log-level", srv.LogLevelHandler())
+
+	do := func(method, user, body string) (int, string) {
+		req := httptest.NewRequest(method, "/accounts/"+user+"/log-level", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	tests := []struct {
+		method, user, body string
+		wantCode           int
+		wantBody           string
+	}{
+		{"GET", "reader1", "", http.StatusOK, "default"},
+		{"PUT", "reader1", "DEBUG\n", http.StatusOK, "debug"},
+		{"GET", "reader1", "", http.StatusOK, "debug"},
+		{"PUT", "reader1", "loud", http.StatusBadRequest, `unknown log level "loud"`},
+		{"PUT", "reader1", "default", http.StatusOK, "default"},
+		{"GET", "nobody", "", http.StatusNotFound, "unknown account"},
+	}
+	for _, tt := range tests {
+		code, body := do(tt.method, tt.user, tt.body)
+		if code != tt.wantCode || body != tt.wantBody {
+			t.Errorf("%s %s %q = %d %q, want %d %q", tt.method, tt.user, tt.body, code, body, tt.wantCode, tt.wantBody)
+		}
+	}
+
+	// Sessions in progress follow the change.
+	var buf bytes.Buffer
+	logger := srv.shared.accountLogs.logger(&cfg.Accounts[0], slog.New(slog.NewTextHandler(&buf, nil)))
+	logger.Debug("before")
+	do("PUT", "reader1", "debug")
+	logger.Debug("after")
+	if got := buf.String(); strings.Contains(got, "before") || !strings.Contains(got, "after") {
+		t.Errorf("log = %q, want only the line after the change", got)
+	}
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+// RFC 4314 rights the proxy lets a client exercise: lookup and read
+// everywhere, plus what applyWritableOverride allows in writable folders
+// (STORE of \Seen, \Deleted and other flags, and APPEND) and append-only
+// folders (APPEND).
+const (
+	readOnlyRights   = "lr"
+	appendOnlyRights = "lri"
+	writableRights   = "lrswit"
+)
+
+// restrictRights rewrites the rights in an ACL or MYRIGHTS response so that
+// ACL-aware clients only offer what the proxy permits for the mailbox.
+// Rights the upstream did not grant are never added. Other lines are
+// returned unchanged.
+func (s *Session) restrictRights(line string) string {
+	rewritten, ok := imap.RewriteRights([]byte(line), func(mailbox, rights string) string {
+		allowed := readOnlyRights
+		if s.folderWritable(mailbox) {
+			allowed = writableRights
+		} else if s.folderAppendable(mailbox) {
+			allowed = appendOnlyRights
+		}
+		return strings.Map(func(r rune) rune {
+			if strings.ContainsRune(allowed, r) {
+				return r
+			}
+			return -1
+		}, rights)
+	})
+	if !ok {
+		return line
+	}
+	return string(rewritten)
+}
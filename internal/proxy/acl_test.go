@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestACLRightsRestricted(t *testing.T) {
+	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
+		a.WritableFolders = []string{"Drafts"}
+		a.AppendFolders = []string{"Scans"}
+		a.BlockedFolders = []string{"Spam"}
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	tests := []struct {
+		cmd, want string
+	}{
+		{"A2 MYRIGHTS INBOX\r\n", "* MYRIGHTS INBOX lr\r\n"},
+		{"A3 MYRIGHTS Drafts\r\n", "* MYRIGHTS Drafts lrswit\r\n"},
+		{"A4 GETACL INBOX\r\n", "* ACL INBOX reader1 lr anyone lr\r\n"},
+		{"A5 GETACL Drafts\r\n", "* ACL Drafts reader1 lrswit anyone lr\r\n"},
+		{"A8 MYRIGHTS Scans\r\n", "* MYRIGHTS Scans lri\r\n"},
+	}
+	for _, tt := range tests {
+		env.send(t, tt.cmd)
+		env.drainUpstream(t)
+		tag, _, _ := strings.Cut(tt.cmd, " ")
+		lines := env.readUntilTagged(t, tag)
+		if len(lines) != 2 || lines[0] != tt.want {
+			t.Errorf("%q: response = %q, want %q first", tt.cmd, lines, tt.want)
+		}
+	}
+
+	env.send(t, "A6 SETACL INBOX fred lrswi\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A6 NO") {
+		t.Errorf("SETACL = %q, want NO", line)
+	}
+	env.send(t, "A7 MYRIGHTS Spam\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A7 NO") {
+		t.Errorf("MYRIGHTS of a blocked folder = %q, want NO", line)
+	}
+	env.noUpstream(t)
+}
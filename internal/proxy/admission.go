@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/ratelimit"
+)
+
+var (
+	connectionsShedTotal = metrics.Default.NewCounter("imap_proxy_connections_shed_total",
+		"Connections closed right after accept because the server was saturated.", "reason")
+	unauthenticatedGauge = metrics.Default.NewGauge("imap_proxy_connections_unauthenticated",
+		"Connections that have been accepted but have not logged in yet.")
+)
+
+// shedWriteTimeout bounds the BYE written to a shed connection so a client
+// that never reads cannot stall the accept loop.
+const shedWriteTimeout = time.Second
+
+// admission decides, right after accept, whether a new connection may be
+// served. It is consulted on the accept loop and must stay cheap.
+type admission struct {
+	now func() time.Time
+
+	rate            *ratelimit.Bucket // nil when accept_rate is unset
+	maxUnauth       int64             // zero means unlimited
+	unauthenticated atomic.Int64
+}
+
+func newAdmission(sc config.ServerConfig) *admission {
+	a := &admission{now: time.Now, maxUnauth: int64(sc.MaxUnauthenticated)}
+	if sc.AcceptRate > 0 {
+		burst := float64(sc.AcceptBurst)
+		if burst <= 0 {
+			burst = math.Max(1, math.Ceil(sc.AcceptRate))
+		}
+		a.rate = ratelimit.NewBucket(sc.AcceptRate, burst)
+	}
+	return a
+}
+
+// admit reports whether a new connection may proceed. On success the
+// connection counts as unauthenticated until release is called; otherwise
+// reason names the limit that was hit.
+func (a *admission) admit() (release func(), reason string) {
+	if a.rate != nil && !a.rate.AllowAt(a.now(), 1) {
+		return nil, "rate"
+	}
+	if n := a.unauthenticated.Add(1); a.maxUnauth > 0 && n > a.maxUnauth {
+		a.unauthenticated.Add(-1)
+		return nil, "unauthenticated"
+	}
+	unauthenticatedGauge.Inc()
+	var once atomic.Bool
+	return func() {
+		if once.CompareAndSwap(false, true) {
+			a.unauthenticated.Add(-1)
+			unauthenticatedGauge.Dec()
+		}
+	}, ""
+}
+
+// shed refuses conn with a BYE and closes it.
+func shed(conn net.Conn, reason string, proto clientProtocol) {
+	connectionsShedTotal.Inc(reason)
+	conn.SetWriteDeadline(time.Now().Add(shedWriteTimeout))
+	fmt.Fprint(conn, proto.goodbye("UNAVAILABLE", "server busy, try again later"))
+	conn.Close()
+}
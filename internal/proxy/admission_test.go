@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestAdmissionRate(t *testing.T) {
+	a := newAdmission(config.ServerConfig{AcceptRate: 2, AcceptBurst: 2})
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		release, reason := a.admit()
+		if release == nil {
+			t.Fatalf("connection %d shed (%s), want admitted within burst", i, reason)
+		}
+		release()
+	}
+	if release, reason := a.admit(); release != nil || reason != "rate" {
+		t.Fatalf("admit after burst = (%v, %q), want shed for rate", release != nil, reason)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if release, _ := a.admit(); release == nil {
+		t.Fatal("admit after refill was shed")
+	}
+}
+
+func TestAdmissionMaxUnauthenticated(t *testing.T) {
+	a := newAdmission(config.ServerConfig{MaxUnauthenticated: 2})
+	r1, _ := a.admit()
+	r2, _ := a.admit()
+	if r1 == nil || r2 == nil {
+		t.Fatal("connections within the cap were shed")
+	}
+	if release, reason := a.admit(); release != nil || reason != "unauthenticated" {
+		t.Fatalf("admit over cap = (%v, %q), want shed for unauthenticated", release != nil, reason)
+	}
+	r1()
+	r1() // releasing twice must not free a second slot
+	r3, _ := a.admit()
+	if r3 == nil {
+		t.Fatal("admit after release was shed")
+	}
+	if release, _ := a.admit(); release != nil {
+		t.Fatal("double release freed an extra slot")
+	}
+}
+
+func TestServerShedsUnauthenticated(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	cfg := &config.Config{Server: config.ServerConfig{MaxUnauthenticated: 1}}
+	srv := NewServer(cfg, slog.New(slog.DiscardHandler))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	dial := func() (net.Conn, string) {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 2*time.Second)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn, line
+	}
+
+	first, line := dial()
+	if line != "* OK imap-proxy ready\r\n" {
+		t.Fatalf("first connection got %q, want greeting", line)
+	}
+	second, line := dial()
+	second.Close()
+	if line != "* BYE [UNAVAILABLE] server busy, try again later\r\n" {
+		t.Fatalf("second connection got %q, want BYE", line)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.admit.unauthenticated.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slot not released after client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, line := dial()
+	third.Close()
+	if line != "* OK imap-proxy ready\r\n" {
+		t.Fatalf("connection after release got %q, want greeting", line)
+	}
+}
+
+func TestLoginReleasesUnauthenticated(t *testing.T) {
+	released := make(chan struct{}, 1)
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+		s.releaseUnauth = func() { released <- struct{}{} }
+	})
+	defer env.clientConn.Close()
+	env.readLine(t) // greeting
+
+	env.send(t, "A001 LOGIN reader1 localpass1\r\n")
+	env.drainUpstream(t)
+	if line := env.readLine(t); line != "A001 OK LOGIN completed\r\n" {
+		t.Fatalf("LOGIN response %q", line)
+	}
+	select {
+	case <-released:
+	default:
+		t.Fatal("successful LOGIN did not release the unauthenticated slot")
+	}
+}
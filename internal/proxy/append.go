@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+// maxMailboxLiteral bounds an APPEND mailbox name sent as a literal.
+const maxMailboxLiteral = 1024
+
+// inlineAppendMailbox reads the mailbox name of an APPEND sent as a
+// literal and returns the command's first line with the name as a quoted
+// string instead, so that folder rules see it and it is forwarded like any
+// other APPEND. The flag list, date-time and message literal that follow
+// are kept exactly as the client sent them. line is returned unchanged if
+// the mailbox is not a literal. A non-empty reply means the APPEND is
+// refused with it; the client's literals have then been consumed.
+func (s *Session) inlineAppendMailbox(cmd imap.Command, line string) (inlined, reply string, err error) {
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(parts) < 3 || !strings.HasPrefix(parts[2], "{") || strings.Contains(parts[2], " ") {
+		return line, "", nil
+	}
+	n, nonSync, ok := imap.ParseLiteral([]byte(parts[2]))
+	if !ok {
+		return line, "", nil
+	}
+	if n > maxMailboxLiteral {
+		return "", fmt.Sprintf("%s NO mailbox name too long\r\n", cmd.Tag), s.discardLiterals(line)
+	}
+	if !nonSync {
+		fmt.Fprint(s.clientConn, "+ Ready for literal data\r\n")
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(s.clientR, buf); err != nil {
+		return "", "", err
+	}
+	rest, err := s.readLine(s.clientR)
+	if err != nil {
+		return "", "", err
+	}
+	mailbox := string(buf)
+	if mailbox == "" || strings.ContainsAny(mailbox, "\x00\r\n") {
+		return "", fmt.Sprintf("%s BAD invalid mailbox name\r\n", cmd.Tag), s.discardLiterals(rest)
+	}
+	return parts[0] + " " + parts[1] + " " + imap.Quote(mailbox) + rest, "", nil
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+)
+
+// newAppendEnv starts a session with Sent writable whose upstream answers
+// synchronizing literals with a continuation and reports each command on
+// received in full, literal data included. setup runs as for
+// newIntegrationEnvWithConfig.
+func newAppendEnv(t *testing.T, setup ...func(*Session)) *integrationEnv {
+	t.Helper()
+	received := make(chan string, 100)
+	cfg := testConfig()
+	cfg.Accounts[0].WritableFolders = []string{"Sent", "Sent Items"}
+	env := newIntegrationEnvWithConfig(t, cfg, append([]func(*Session){func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					tag, _, _ := strings.Cut(line, " ")
+					full := line
+					for {
+						n, nonSync, ok := imap.ParseLiteral([]byte(line))
+						if !ok {
+							break
+						}
+						if !nonSync {
+							fmt.Fprint(upServer, "+ Ready\r\n")
+						}
+						data := make([]byte, n)
+						if _, err := io.ReadFull(sr, data); err != nil {
+							return
+						}
+						if line, err = sr.ReadString('\n'); err != nil {
+							return
+						}
+						full += string(data) + line
+					}
+					received <- full
+					if strings.Contains(line, " LOGOUT") {
+						fmt.Fprintf(upServer, "* BYE logging out\r\n%s OK completed\r\n", tag)
+						return
+					}
+					fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	}}, setup...)...)
+	env.received = received
+	return env
+}
+
+func TestAppendArgumentsPreserved(t *testing.T) {
+	const msg = "Subject: sent\r\n\r\nbody\r\n"
+	date := `"14-Jul-2024 09:30:00 +0200"`
+	tests := []struct {
+		name string
+		// send is what the client sends after the tag; continued, if set,
+		// follows a "+" continuation.
+		send, continued string
+		want            string // the command the upstream receives, after the tag
+	}{
+		{
+			name: "flags and date",
+			send: fmt.Sprintf(`APPEND Sent (\Seen \Flagged) %s {%d+}`+"\r\n"+msg+"\r\n", date, len(msg)),
+			want: fmt.Sprintf(`APPEND Sent (\Seen \Flagged) %s {%d+}`+"\r\n"+msg+"\r\n", date, len(msg)),
+		},
+		{
+			name:      "quoted mailbox, synchronizing literal",
+			send:      fmt.Sprintf(`APPEND "Sent Items" (\Seen) %s {%d}`+"\r\n", date, len(msg)),
+			continued: msg + "\r\n",
+			want:      fmt.Sprintf(`APPEND "Sent Items" (\Seen) %s {%d}`+"\r\n"+msg+"\r\n", date, len(msg)),
+		},
+		{
+			name: "date without flags",
+			send: fmt.Sprintf(`APPEND Sent %s {%d+}`+"\r\n"+msg+"\r\n", date, len(msg)),
+			want: fmt.Sprintf(`APPEND Sent %s {%d+}`+"\r\n"+msg+"\r\n", date, len(msg)),
+		},
+		{
+			name: "mailbox as literal",
+			send: fmt.Sprintf("APPEND {4+}\r\nSent (\\Seen) %s {%d+}\r\n%s\r\n", date, len(msg), msg),
+			want: fmt.Sprintf(`APPEND "Sent" (\Seen) %s {%d+}`+"\r\n"+msg+"\r\n", date, len(msg)),
+		},
+		{
+			name:      "mailbox as synchronizing literal",
+			send:      "APPEND {10}\r\n",
+			continued: fmt.Sprintf("Sent Items () %s {%d+}\r\n%s\r\n", date, len(msg), msg),
+			want:      fmt.Sprintf(`APPEND "Sent Items" () %s {%d+}`+"\r\n"+msg+"\r\n", date, len(msg)),
+		},
+	}
+	env := newAppendEnv(t)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := fmt.Sprintf("A%03d", i+2)
+			env.send(t, tag+" "+tt.send)
+			if tt.continued != "" {
+				if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+					t.Fatalf("want a continuation, got %q", line)
+				}
+				env.send(t, tt.continued)
+			}
+			got := <-env.received
+			if want := tag + " " + tt.want; got != want {
+				t.Errorf("upstream got %q\nwant %q", got, want)
+			}
+			if line := env.readLine(t); !strings.HasPrefix(line, tag+" OK") {
+				t.Errorf("response = %q, want OK", line)
+			}
+		})
+	}
+}
+
+func TestAppendMailboxLiteralFolderRules(t *testing.T) {
+	env := newAppendEnv(t)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	// A literal mailbox name is subject to writable_folders like any other.
+	msg := "Subject: x\r\n\r\nx\r\n"
+	env.send(t, fmt.Sprintf("A002 APPEND {5+}\r\nINBOX {%d+}\r\n%s\r\n", len(msg), msg))
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 NO") {
+		t.Fatalf("APPEND to INBOX = %q, want NO", line)
+	}
+
+	env.send(t, "A003 APPEND {2000}\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A003 NO") {
+		t.Fatalf("oversized mailbox literal = %q, want NO", line)
+	}
+	env.noUpstream(t)
+
+	env.send(t, "A004 NOOP\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A004 OK") {
+		t.Errorf("session out of step after refusals: %q", line)
+	}
+}
+
+func TestParseOneArgEscapes(t *testing.T) {
+	got, rest, err := parseOneArg(`"a\\b \"c\"" tail`)
+	if err != nil || got != `a\b "c"` || rest != " tail" {
+		t.Errorf("parseOneArg = %q, %q, %v", got, rest, err)
+	}
+	if got, _, _ := parseOneArg(imap.Quote(`x\"y`)); got != `x\"y` {
+		t.Errorf("round trip = %q", got)
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"sync"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/quota"
+)
+
+var appendsRefusedTotal = metrics.Default.NewCounter("imap_proxy_appends_refused_total",
+	"APPEND commands refused by max_append_size_mb (size), daily_append_limit (count) or daily_append_quota_mb (bytes).", "reason")
+
+// Reasons for refusing an APPEND.
+const (
+	appendTooBig     = "size"
+	appendCountLimit = "count"
+	appendBytesLimit = "bytes"
+)
+
+// appendCounters counts each account's APPENDs and appended bytes per UTC
+// day, across all of its sessions.
+type appendCounters struct {
+	mu    sync.Mutex
+	count *quota.Store
+	bytes *quota.Store
+}
+
+func newAppendCounters() *appendCounters {
+	return &appendCounters{count: quota.NewStore(), bytes: quota.NewStore()}
+}
+
+// reserve counts an APPEND of size bytes by user if it stays within
+// maxCount messages and maxBytes bytes for the day (zero means unlimited).
+// Otherwise it returns the limit that would be exceeded.
+func (c *appendCounters) reserve(user string, size int64, maxCount int, maxBytes int64) (reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if maxCount > 0 && c.count.Used(user) >= int64(maxCount) {
+		return appendCountLimit
+	}
+	if maxBytes > 0 && c.bytes.Used(user)+size > maxBytes {
+		return appendBytesLimit
+	}
+	c.count.Add(user, 1)
+	c.bytes.Add(user, size)
+	return ""
+}
+
+// appendRefusal checks an APPEND allowed into a writable or append-only
+// folder against the account's append limits, given the command's first
+// line. It returns the response code and text for refusing it, or "" to
+// let it through, in which case the APPEND is counted. The message size
+// is that of the literal ending the line.
+func (s *Session) appendRefusal(line string) (code, text string) {
+	acct := s.account
+	maxSize, maxCount, maxBytes := acct.MaxAppendSize(), acct.DailyAppendLimit, acct.DailyAppendQuota()
+	if maxSize <= 0 && maxCount <= 0 && maxBytes <= 0 {
+		return "", ""
+	}
+	size, _, _ := imap.ParseLiteral([]byte(line))
+	var reason string
+	if maxSize > 0 && size > maxSize {
+		reason = appendTooBig
+	} else {
+		reason = s.shared.appends.reserve(acct.LocalUser, size, maxCount, maxBytes)
+	}
+	switch reason {
+	case "":
+		return "", ""
+	case appendTooBig:
+		code, text = "TOOBIG", "message too large"
+	case appendCountLimit:
+		code, text = "LIMIT", "daily append limit reached"
+	default:
+		code, text = "LIMIT", "daily append quota exceeded"
+	}
+	appendsRefusedTotal.Inc(reason)
+	s.logger.Warn("APPEND refused", "reason", reason, "size", size)
+	return code, text
+}
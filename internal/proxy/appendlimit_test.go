@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestAppendCountersReserve(t *testing.T) {
+	c := newAppendCounters()
+	if r := c.reserve("reader1", 400, 2, 1000); r != "" {
+		t.Fatalf("first APPEND refused: %s", r)
+	}
+	if r := c.reserve("reader1", 700, 2, 1000); r != appendBytesLimit {
+		t.Errorf("APPEND over the byte quota = %q, want %q", r, appendBytesLimit)
+	}
+	if r := c.reserve("reader1", 600, 2, 1000); r != "" {
+		t.Fatalf("APPEND filling the quota refused: %s", r)
+	}
+	if r := c.reserve("reader1", 0, 2, 0); r != appendCountLimit {
+		t.Errorf("third APPEND = %q, want %q", r, appendCountLimit)
+	}
+	if r := c.reserve("reader2", 1000, 2, 1000); r != "" {
+		t.Errorf("other account refused: %s", r)
+	}
+}
+
+// appendMessage sends an APPEND of body to folder with a non-synchronizing
+// literal and returns the tagged response. The command is written from
+// another goroutine, since a refusal is answered before the literal is
+// read.
+func appendMessage(t *testing.T, env *integrationEnv, tag, folder, body string, wantForwarded bool) string {
+	t.Helper()
+	sent := make(chan error, 1)
+	go func() {
+		_, err := fmt.Fprintf(env.clientConn, "%s APPEND %s {%d+}\r\n%s\r\n", tag, folder, len(body), body)
+		sent <- err
+	}()
+	if wantForwarded {
+		env.expectUpstream(t, "APPEND")
+	}
+	resp := env.readLine(t)
+	if err := <-sent; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	return resp
+}
+
+func TestAppendTooBig(t *testing.T) {
+	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
+		a.AppendFolders = []string{"Scans"}
+		a.MaxAppendSizeMB = 1
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+	before := appendsRefusedTotal.Value(appendTooBig)
+
+	big := strings.Repeat("x", 1<<20+1)
+	if resp := appendMessage(t, env, "A002", "Scans", big, false); !strings.HasPrefix(resp, "A002 NO [TOOBIG]") {
+		t.Fatalf("oversized APPEND = %q, want NO [TOOBIG]", resp)
+	}
+	env.noUpstream(t)
+	if got := appendsRefusedTotal.Value(appendTooBig) - before; got != 1 {
+		t.Errorf("size refusals = %v, want 1", got)
+	}
+
+	// The refused literal was consumed, so the session stays in step.
+	if resp := appendMessage(t, env, "A003", "Scans", "Subject: ok\r\n\r\nok\r\n", true); !strings.HasPrefix(resp, "A003 OK") {
+		t.Errorf("APPEND within the limit = %q, want OK", resp)
+	}
+}
+
+func TestAppendTooBigSynchronizing(t *testing.T) {
+	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
+		a.WritableFolders = []string{"Drafts"}
+		a.MaxAppendSizeMB = 1
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, fmt.Sprintf("A002 APPEND Drafts {%d}\r\n", 2<<20))
+	if resp := env.readLine(t); !strings.HasPrefix(resp, "A002 NO [TOOBIG]") {
+		t.Fatalf("oversized APPEND = %q, want NO [TOOBIG] instead of a continuation", resp)
+	}
+	env.noUpstream(t)
+}
+
+func TestAppendDailyLimit(t *testing.T) {
+	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
+		a.AppendFolders = []string{"Scans"}
+		a.DailyAppendLimit = 2
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	for i := range 2 {
+		tag := fmt.Sprintf("A%03d", i+2)
+		if resp := appendMessage(t, env, tag, "Scans", "Subject: scan\r\n\r\n.\r\n", true); !strings.HasPrefix(resp, tag+" OK") {
+			t.Fatalf("APPEND %d = %q, want OK", i, resp)
+		}
+	}
+	if resp := appendMessage(t, env, "A004", "Scans", "Subject: scan\r\n\r\n.\r\n", false); !strings.HasPrefix(resp, "A004 NO [LIMIT]") {
+		t.Fatalf("third APPEND = %q, want NO [LIMIT]", resp)
+	}
+	env.noUpstream(t)
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var foldersCreatedTotal = metrics.Default.NewCounter("imap_proxy_folders_created_total",
+	"Writable or append folders created upstream for an APPEND, by result: ok or failed.", "result")
+
+// autoCreates reports whether an APPEND to the client's mailbox creates the
+// mailbox upstream if it is missing: the account sets auto_create_folders,
+// the mailbox is writable or an append folder, and it has not been seen
+// to exist in this session.
+func (s *Session) autoCreates(mailbox string) bool {
+	return s.account.AutoCreateFolders && mailbox != "" && s.folderAppendable(mailbox) && !s.appended[mailbox]
+}
+
+// appendCreating forwards line, an APPEND to the client's mailbox, holding
+// its message so that it can be sent again. If the upstream answers NO
+// [TRYCREATE], the mailbox is created with an internal CREATE and the
+// APPEND retried; the client only sees the final completion.
+func (s *Session) appendCreating(cmd imap.Command, line []byte, mailbox string) error {
+	n, nonSync, ok := imap.ParseLiteral(line)
+	if !ok {
+		return s.forwardWithLiterals(line)
+	}
+	msg, err := s.holdMessage(n, !nonSync)
+	if err != nil {
+		return err
+	}
+	defer s.memory.free(len(msg.data))
+	if _, _, ok := imap.ParseLiteral([]byte(msg.rest)); ok {
+		// MULTIAPPEND: only one message is held for a retry.
+		fmt.Fprintf(s.clientConn, "%s NO [CANNOT] one message per APPEND\r\n", cmd.Tag)
+		return s.discardLiterals(msg.rest)
+	}
+
+	args := strings.TrimPrefix(string(line), cmd.Tag)
+	tag := s.nextInternalTag()
+	completion, err := s.appendHeld(tag, tag+args, msg)
+	if err != nil {
+		return err
+	}
+	if tryCreate(tag, completion) {
+		upstreamCmd, _ := imap.ParseCommand(line)
+		upstreamMailbox := extractAppendMailbox(upstreamCmd)
+		created := s.nextInternalTag()
+		_, reply, err := s.roundTrip(created, fmt.Appendf(nil, "%s CREATE %s\r\n", created, imap.Quote(upstreamMailbox)))
+		if err != nil {
+			return err
+		}
+		if completedOK(created, reply) {
+			foldersCreatedTotal.Inc("ok")
+			s.logger.Info("created folder for APPEND", "folder", mailbox)
+			tag = s.nextInternalTag()
+			if completion, err = s.appendHeld(tag, tag+args, msg); err != nil {
+				return err
+			}
+		} else {
+			foldersCreatedTotal.Inc("failed")
+			s.logger.Warn("failed to create folder for APPEND", "folder", mailbox, "response", strings.TrimRight(reply, "\r\n"))
+		}
+	}
+	if completedOK(tag, completion) {
+		if s.appended == nil {
+			s.appended = make(map[string]bool)
+		}
+		s.appended[mailbox] = true
+	}
+	return s.writeClient(cmd.Tag + strings.TrimPrefix(completion, tag))
+}
+
+// appendHeld sends head, an internally tagged APPEND announcing msg, with
+// the message and returns its tagged completion. For a synchronizing
+// literal it waits for the upstream's continuation, which is not relayed.
+func (s *Session) appendHeld(tag, head string, msg *heldMessage) (string, error) {
+	ic := &internalCmd{tag: tag, continuation: msg.sync, done: make(chan string, 1)}
+	s.internal.Store(ic)
+	err := func() error {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		s.deadline.expect()
+		if !msg.sync {
+			_, err := (&net.Buffers{[]byte(head), msg.data, []byte(msg.rest)}).WriteTo(s.upstreamConn)
+			return err
+		}
+		if _, err := io.WriteString(s.upstreamConn, head); err != nil {
+			return err
+		}
+		select {
+		case reply := <-ic.done:
+			if !strings.HasPrefix(reply, "+") {
+				// Answered without waiting for the message.
+				ic.done <- reply
+				return nil
+			}
+		case <-s.stopped:
+			return errSessionClosed
+		}
+		ic = &internalCmd{tag: tag, done: make(chan string, 1)}
+		s.internal.Store(ic)
+		_, err := (&net.Buffers{msg.data, []byte(msg.rest)}).WriteTo(s.upstreamConn)
+		s.deadline.resume()
+		return err
+	}()
+	if err != nil {
+		s.internal.CompareAndSwap(ic, nil)
+		return "", err
+	}
+	select {
+	case completion := <-ic.done:
+		return completion, nil
+	case <-s.stopped:
+		return "", errSessionClosed
+	}
+}
+
+// tryCreate reports whether completion is a NO [TRYCREATE] for tag, the
+// upstream's hint that the mailbox does not exist but could be created.
+func tryCreate(tag, completion string) bool {
+	status, text, _ := strings.Cut(strings.TrimPrefix(completion, tag+" "), " ")
+	return strings.EqualFold(status, "NO") && len(text) >= 11 && strings.EqualFold(text[:11], "[TRYCREATE]")
+}
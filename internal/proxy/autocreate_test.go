@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+)
+
+// newAutoCreateEnv starts a session with Drop as an append folder whose
+// upstream only has INBOX. It answers an APPEND to a missing mailbox with
+// NO [TRYCREATE], before asking for a synchronizing literal, and creates
+// mailboxes other than "Denied" on CREATE. Every command is reported on
+// received without its literal data.
+func newAutoCreateEnv(t *testing.T, autoCreate bool) *integrationEnv {
+	t.Helper()
+	received := make(chan string, 100)
+	cfg := testConfig()
+	cfg.Accounts[0].AppendFolders = []string{"Drop", "Denied"}
+	cfg.Accounts[0].AutoCreateFolders = autoCreate
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				exists := map[string]bool{"INBOX": true}
+				sr := bufio.NewReader(upServer)
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					received <- strings.TrimRight(line, "\r\n")
+					cmd, _ := imap.ParseCommand([]byte(line))
+					mailbox := extractCommandMailbox(cmd)
+					switch cmd.Verb {
+					case "APPEND":
+						n, nonSync, _ := imap.ParseLiteral([]byte(line))
+						if !exists[mailbox] && !nonSync {
+							fmt.Fprintf(upServer, "%s NO [TRYCREATE] no such mailbox\r\n", cmd.Tag)
+							continue
+						}
+						if !nonSync {
+							fmt.Fprint(upServer, "+ Ready\r\n")
+						}
+						if _, err := io.CopyN(io.Discard, sr, n); err != nil {
+							return
+						}
+						sr.ReadString('\n')
+						if !exists[mailbox] {
+							fmt.Fprintf(upServer, "%s NO [TRYCREATE] no such mailbox\r\n", cmd.Tag)
+							continue
+						}
+						fmt.Fprintf(upServer, "%s OK [APPENDUID 1 1] APPEND completed\r\n", cmd.Tag)
+					case "CREATE":
+						if mailbox == "Denied" {
+							fmt.Fprintf(upServer, "%s NO [NOPERM] not allowed\r\n", cmd.Tag)
+							continue
+						}
+						exists[mailbox] = true
+						fmt.Fprintf(upServer, "%s OK CREATE completed\r\n", cmd.Tag)
+					default:
+						fmt.Fprintf(upServer, "%s OK completed\r\n", cmd.Tag)
+					}
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	return env
+}
+
+func TestAutoCreateFolderOnAppend(t *testing.T) {
+	const msg = "Subject: scan\r\n\r\nbody\r\n"
+	tests := []struct {
+		name string
+		sync bool
+	}{
+		{"synchronizing literal", true},
+		{"non-synchronizing literal", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newAutoCreateEnv(t, true)
+			defer env.clientConn.Close()
+			env.login(t)
+			before := foldersCreatedTotal.Value("ok")
+
+			if tt.sync {
+				env.send(t, fmt.Sprintf("A002 APPEND Drop {%d}\r\n", len(msg)))
+				if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+					t.Fatalf("want a continuation, got %q", line)
+				}
+				env.send(t, msg+"\r\n")
+			} else {
+				env.send(t, fmt.Sprintf("A002 APPEND Drop {%d+}\r\n%s\r\n", len(msg), msg))
+			}
+			env.expectUpstream(t, " APPEND Drop")
+			if cmd := env.expectUpstream(t, " CREATE"); !strings.HasPrefix(cmd, "proxyv") || !strings.HasSuffix(cmd, ` CREATE "Drop"`) {
+				t.Errorf("create = %q, want an internal CREATE of Drop", cmd)
+			}
+			env.expectUpstream(t, " APPEND Drop")
+			if line := env.readLine(t); line != "A002 OK [APPENDUID 1 1] APPEND completed\r\n" {
+				t.Fatalf("response = %q, want the retried APPEND's completion", line)
+			}
+			if got := foldersCreatedTotal.Value("ok") - before; got != 1 {
+				t.Errorf("folders created = %v, want 1", got)
+			}
+
+			// The folder is known to exist now, so the next APPEND is
+			// forwarded as sent.
+			env.send(t, fmt.Sprintf("A003 APPEND Drop {%d+}\r\n%s\r\n", len(msg), msg))
+			env.expectUpstream(t, "A003 APPEND Drop")
+			if line := env.readLine(t); !strings.HasPrefix(line, "A003 OK") {
+				t.Fatalf("response = %q", line)
+			}
+		})
+	}
+}
+
+func TestAutoCreateFolderFails(t *testing.T) {
+	env := newAutoCreateEnv(t, true)
+	defer env.clientConn.Close()
+	env.login(t)
+	before := foldersCreatedTotal.Value("failed")
+
+	env.send(t, "A002 APPEND Denied {4+}\r\nbody\r\n")
+	env.expectUpstream(t, " APPEND Denied")
+	env.expectUpstream(t, " CREATE")
+	if line := env.readLine(t); line != "A002 NO [TRYCREATE] no such mailbox\r\n" {
+		t.Fatalf("response = %q, want the APPEND's failure", line)
+	}
+	env.noUpstream(t)
+	if got := foldersCreatedTotal.Value("failed") - before; got != 1 {
+		t.Errorf("failed creations = %v, want 1", got)
+	}
+}
+
+func TestAutoCreateFoldersOff(t *testing.T) {
+	env := newAutoCreateEnv(t, false)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 APPEND Drop {4}\r\n")
+	env.expectUpstream(t, "A002 APPEND Drop")
+	if line := env.readLine(t); line != "A002 NO [TRYCREATE] no such mailbox\r\n" {
+		t.Fatalf("response = %q", line)
+	}
+	env.noUpstream(t)
+}
+
+func TestTryCreate(t *testing.T) {
+	tests := []struct {
+		completion string
+		want       bool
+	}{
+		{"proxyv1 NO [TRYCREATE] no such mailbox\r\n", true},
+		{"proxyv1 no [trycreate] no such mailbox\r\n", true},
+		{"proxyv1 NO [NOPERM] denied\r\n", false},
+		{"proxyv1 OK done\r\n", false},
+		{"proxyv2 NO [TRYCREATE] other tag\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := tryCreate("proxyv1", tt.completion); got != tt.want {
+			t.Errorf("tryCreate(%q) = %v, want %v", tt.completion, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/ratelimit"
+)
+
+var throttleDelaySeconds = metrics.Default.NewCounter("imap_proxy_throttle_delay_seconds_total",
+	"Time upstream-to-client writes were delayed by bandwidth limits.", "scope")
+
+// kbpsToBytes converts a rate in kilobits per second to bytes per second.
+func kbpsToBytes(kbps int) float64 {
+	return float64(kbps) * 1000 / 8
+}
+
+// newKbpsBucket returns a bucket for kbps that allows one second's worth of
+// data as a burst, or nil when kbps is not positive.
+func newKbpsBucket(kbps int) *ratelimit.Bucket {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := kbpsToBytes(kbps)
+	return ratelimit.NewBucket(rate, rate)
+}
+
+// bandwidthLimits holds the buckets shared by all sessions of an account.
+type bandwidthLimits struct {
+	mu      sync.Mutex
+	buckets map[string]*accountBucket
+}
+
+type accountBucket struct {
+	kbps   int
+	bucket *ratelimit.Bucket
+}
+
+func newBandwidthLimits() *bandwidthLimits {
+	return &bandwidthLimits{buckets: make(map[string]*accountBucket)}
+}
+
+// bucket returns the account-wide bucket for user, or nil when kbps is not
+// positive. The bucket is rebuilt if the configured rate changes.
+func (l *bandwidthLimits) bucket(user string, kbps int) *ratelimit.Bucket {
+	if kbps <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[user]
+	if !ok || b.kbps != kbps {
+		b = &accountBucket{kbps: kbps, bucket: newKbpsBucket(kbps)}
+		l.buckets[user] = b
+	}
+	return b.bucket
+}
+
+// throttledWriter delays writes so they stay within the session and account
+// buckets. A wait is cut short when stop is closed.
+type throttledWriter struct {
+	w       io.Writer
+	session *ratelimit.Bucket // may be nil
+	account *ratelimit.Bucket // may be nil
+	stop    <-chan struct{}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	now := time.Now()
+	var wait time.Duration
+	scope := ""
+	if t.session != nil {
+		if d := t.session.Reserve(now, float64(len(p))); d > wait {
+			wait, scope = d, "session"
+		}
+	}
+	if t.account != nil {
+		if d := t.account.Reserve(now, float64(len(p))); d > wait {
+			wait, scope = d, "account"
+		}
+	}
+	if wait > 0 {
+		throttleDelaySeconds.Add(wait.Seconds(), scope)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-t.stop:
+			timer.Stop()
+			return 0, net.ErrClosed
+		}
+	}
+	return t.w.Write(p)
+}
+
+// clientWriter returns the writer for upstream-to-client traffic, throttled
+// when the account has a bandwidth limit and delayed when its chaos mode
+// has client latency.
+func (s *Session) clientWriter(stop <-chan struct{}) io.Writer {
+	var w io.Writer = s.clientConn
+	if cfg := s.account.Chaos; cfg.ClientLatency > 0 || cfg.ClientJitter > 0 {
+		w = newChaosWriter(w, cfg, stop)
+	}
+	sessionBucket := newKbpsBucket(s.account.SessionMaxKbps)
+	accountBucket := s.shared.bandwidth.bucket(s.account.LocalUser, s.account.MaxKbps)
+	if sessionBucket == nil && accountBucket == nil {
+		return w
+	}
+	return &throttledWriter{w: w, session: sessionBucket, account: accountBucket, stop: stop}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestThrottledWriterDelays(t *testing.T) {
+	var buf bytes.Buffer
+	w := &throttledWriter{w: &buf, session: newKbpsBucket(80), stop: make(chan struct{})} // 10000 B/s
+
+	start := time.Now()
+	if _, err := w.Write(make([]byte, 10000)); err != nil { // within burst
+		t.Fatalf("Write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("write within burst took %v", elapsed)
+	}
+	if _, err := w.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("write over burst returned after %v, want about 100ms", elapsed)
+	}
+	if buf.Len() != 11000 {
+		t.Fatalf("wrote %d bytes, want 11000", buf.Len())
+	}
+}
+
+func TestThrottledWriterStop(t *testing.T) {
+	stop := make(chan struct{})
+	w := &throttledWriter{w: &bytes.Buffer{}, account: newKbpsBucket(8), stop: stop} // 1000 B/s
+	w.Write(make([]byte, 1000))
+
+	close(stop)
+	start := time.Now()
+	if _, err := w.Write(make([]byte, 10000)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Write after stop = %v, want net.ErrClosed", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stopped write blocked for %v", elapsed)
+	}
+}
+
+func TestBandwidthLimitsShared(t *testing.T) {
+	l := newBandwidthLimits()
+	if l.bucket("alice", 0) != nil {
+		t.Fatal("bucket for unlimited account is not nil")
+	}
+	a := l.bucket("alice", 100)
+	if a == nil || l.bucket("alice", 100) != a {
+		t.Fatal("sessions of the same account must share a bucket")
+	}
+	if l.bucket("bob", 100) == a {
+		t.Fatal("different accounts share a bucket")
+	}
+	if l.bucket("alice", 200) == a {
+		t.Fatal("bucket not rebuilt after the rate changed")
+	}
+}
+
+func TestClientWriterUnthrottled(t *testing.T) {
+	s := &Session{shared: newShared(), account: &testConfig().Accounts[0]}
+	if _, ok := s.clientWriter(nil).(*throttledWriter); ok {
+		t.Fatal("account without limits got a throttled writer")
+	}
+	s.account.SessionMaxKbps = 64
+	if _, ok := s.clientWriter(nil).(*throttledWriter); !ok {
+		t.Fatal("account with session_max_kbps got an unthrottled writer")
+	}
+}
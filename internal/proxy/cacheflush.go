@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var cacheFlushesTotal = metrics.Default.NewCounter("imap_proxy_cache_flushes_total",
+	"Cache entries removed through the admin API or X-PROXY FLUSHCACHE, by cache: capabilities, dns, srv or tls_sessions.", "cache")
+
+// flushUpstreamCaches removes what the process-wide caches hold about the
+// upstream of acct and returns the names of the caches that had entries.
+// Other accounts on the same upstream share these entries and lose them
+// too.
+func flushUpstreamCaches(acct *config.AccountConfig) []string {
+	upstream := upstreamKey(acct)
+	var flushed []string
+	note := func(cache string, ok bool) {
+		if ok {
+			cacheFlushesTotal.Inc(cache)
+			flushed = append(flushed, cache)
+		}
+	}
+	note("capabilities", upstreamCaps.forget(upstream))
+	hosts := []string{acct.RemoteHost}
+	if acct.RemoteSRVDomain != "" {
+		targets := upstreamSRV.forget(acct.RemoteSRVDomain)
+		note("srv", len(targets) > 0)
+		hosts = targets
+	}
+	dns := false
+	for _, host := range hosts {
+		if host != "" && upstreamHosts.forget(host) {
+			dns = true
+		}
+	}
+	note("dns", dns)
+	note("tls_sessions", upstreamSessions.forget(upstream))
+	return flushed
+}
+
+// CacheHandler serves DELETE /accounts/{user}/caches, which flushes the
+// cached capabilities, DNS answers and TLS sessions of the account's
+// upstream so that the next connection starts afresh. The response lists
+// the caches that held entries, one per line.
+func (s *Server) CacheHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acct := s.config.LookupUser(r.PathValue("user"))
+		if acct == nil {
+			http.Error(w, "unknown account", http.StatusNotFound)
+			return
+		}
+		flushed := flushUpstreamCaches(acct)
+		s.logger.Info("upstream caches flushed", "user", acct.LocalUser, "upstream", upstreamKey(acct), "caches", flushed)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, cache := range flushed {
+			fmt.Fprintln(w, cache)
+		}
+	})
+}
+
+// handleXProxy answers an X-PROXY command, which the proxy handles itself
+// and never forwards. X-PROXY FLUSHCACHE flushes the upstream caches of
+// the session's account like CacheHandler, for accounts with
+// allow_cache_flush; the caches that held entries are listed in an
+// untagged X-PROXY FLUSHED response.
+func (s *Session) handleXProxy(cmd imap.Command) {
+	args := strings.Fields(string(cmd.Raw))[2:]
+	if len(args) != 1 || !strings.EqualFold(args[0], "FLUSHCACHE") {
+		fmt.Fprintf(s.clientConn, "%s BAD X-PROXY expects FLUSHCACHE\r\n", cmd.Tag)
+		return
+	}
+	if !s.account.AllowCacheFlush {
+		s.logger.Warn("X-PROXY FLUSHCACHE refused: not allowed for account")
+		fmt.Fprintf(s.clientConn, "%s NO [NOPERM] cache flush not permitted for this account\r\n", cmd.Tag)
+		return
+	}
+	flushed := flushUpstreamCaches(s.account)
+	s.logger.Info("upstream caches flushed", "upstream", s.upstream, "caches", flushed, "via", "X-PROXY")
+	fmt.Fprintf(s.clientConn, "* X-PROXY FLUSHED (%s)\r\n", strings.Join(flushed, " "))
+	fmt.Fprintf(s.clientConn, "%s OK X-PROXY FLUSHCACHE completed\r\n", cmd.Tag)
+}
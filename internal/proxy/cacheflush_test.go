@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheHandler(t *testing.T) {
+	origHosts, origSRV := upstreamHosts, upstreamSRV
+	t.Cleanup(func() { upstreamHosts, upstreamSRV = origHosts, origSRV })
+	lookups := 0
+	upstreamHosts = newHostCache(func(context.Context, string) ([]string, time.Duration, error) {
+		lookups++
+		return []string{"192.0.2.10"}, time.Hour, nil
+	})
+	upstreamSRV = newSRVCache(func(context.Context, string, string, string) ([]*net.SRV, time.Duration, error) {
+		return []*net.SRV{{Target: "srv-target.example.", Port: 993}}, time.Hour, nil
+	})
+
+	cfg := testConfig()
+	cfg.Accounts[0].RemoteHost = "flush.example.com"
+	srvAcct := cfg.Accounts[0]
+	srvAcct.LocalUser, srvAcct.RemoteHost, srvAcct.RemoteSRVDomain = "reader2", "", "srv.example.com"
+	cfg.Accounts = append(cfg.Accounts, srvAcct)
+	srv := NewServer(cfg, testLogger())
+	mux := http.NewServeMux()
+	mux.Handle("DELETE /accounts/{user}/caches", srv.CacheHandler())
+	flush := func(user string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("DELETE", "/accounts/"+user+"/caches", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	acct := &cfg.Accounts[0]
+	upstreamCaps.storeAuth(upstreamKey(acct), capabilitySet{"IMAP4REV1": true})
+	upstreamSessions.get(sessionCacheKey(acct, acct.RemoteHost))
+	upstreamHosts.resolve(acct.RemoteHost)
+
+	if code, body := flush("reader1"); code != http.StatusOK || body != "capabilities\ndns\ntls_sessions\n" {
+		t.Fatalf("flush = %d %q", code, body)
+	}
+	if _, ok := upstreamCaps.auth(upstreamKey(acct)); ok {
+		t.Error("capabilities still cached")
+	}
+	upstreamHosts.resolve(acct.RemoteHost)
+	if lookups != 2 {
+		t.Errorf("lookups = %d, want the flushed host looked up again", lookups)
+	}
+	if code, body := flush("reader1"); code != http.StatusOK || body != "dns\n" {
+		t.Errorf("second flush = %d %q, want only the new DNS answer", code, body)
+	}
+
+	// SRV accounts lose the SRV answer and the address of its target.
+	upstreamSRV.resolve("imaps", "srv.example.com")
+	upstreamHosts.resolve("srv-target.example")
+	if code, body := flush("reader2"); code != http.StatusOK || body != "srv\ndns\n" {
+		t.Errorf("SRV flush = %d %q", code, body)
+	}
+
+	if code, body := flush("nobody"); code != http.StatusNotFound || strings.TrimSpace(body) != "unknown account" {
+		t.Errorf("unknown account = %d %q", code, body)
+	}
+}
+
+func TestXProxyFlushCache(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		allow bool
+		want  []string
+	}{
+		{"allowed", true, []string{"* X-PROXY FLUSHED (capabilities", "A2 OK X-PROXY FLUSHCACHE completed"}},
+		{"not allowed", false, []string{"A2 NO [NOPERM] cache flush not permitted for this account"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Accounts[0].AllowCacheFlush = tt.allow
+			env := newIntegrationEnvWithConfig(t, cfg)
+			defer env.clientConn.Close()
+			env.login(t)
+			key := upstreamKey(&cfg.Accounts[0])
+			upstreamCaps.storeAuth(key, capabilitySet{"IMAP4REV1": true})
+			t.Cleanup(func() { upstreamCaps.forget(key) })
+
+			env.send(t, "A1 X-PROXY RELOAD\r\n")
+			if line := env.readLine(t); line != "A1 BAD X-PROXY expects FLUSHCACHE\r\n" {
+				t.Errorf("unknown subcommand: %q", line)
+			}
+			env.send(t, "A2 x-proxy flushcache\r\n")
+			for _, want := range tt.want {
+				if line := env.readLine(t); !strings.HasPrefix(line, want) {
+					t.Errorf("got %q, want %q", line, want)
+				}
+			}
+			env.noUpstream(t)
+			if _, cached := upstreamCaps.auth(key); cached == tt.allow {
+				t.Errorf("capabilities cached = %v after the flush", cached)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import "strings"
+
+// preAuthCapabilities returns the capability list offered before LOGIN,
+// built from what this session can actually do. No AUTH= mechanisms are
+// listed because the proxy only implements LOGIN.
+func (s *Session) preAuthCapabilities() string {
+	caps := []string{"IMAP4rev1", "IDLE"}
+	if s.allUpstreamsSupport("LITERAL+") {
+		caps = append(caps, "LITERAL+")
+	}
+	caps = append(caps, "ID", "CLIENTID")
+	if s.tlsConfig != nil && !s.tlsActive {
+		caps = append(caps, "STARTTLS")
+		if loginRequiresTLS(s.config) {
+			caps = append(caps, "LOGINDISABLED")
+		}
+	}
+	return strings.Join(caps, " ")
+}
+
+// allUpstreamsSupport reports whether no configured upstream is known to
+// lack capability name. Non-synchronizing literals, for one, are passed
+// through after LOGIN, so the proxy may only offer LITERAL+ to a client
+// before it knows the account if every upstream accepts them. Like
+// upstreamSupports, it assumes support until an upstream says otherwise.
+func (s *Session) allUpstreamsSupport(name string) bool {
+	for i := range s.config.Accounts {
+		acct := &s.config.Accounts[i]
+		if caps, ok := upstreamCaps.auth(upstreamKey(acct)); ok && !caps.has(name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestPreAuthCapabilities(t *testing.T) {
+	noLiteralPlus := config.AccountConfig{RemoteHost: "noliteralplus.example.com", RemotePort: 993}
+	caps, _ := parseCapabilities("* CAPABILITY IMAP4rev1 IDLE")
+	upstreamCaps.storeAuth(upstreamKey(&noLiteralPlus), caps)
+
+	plain := config.AccountConfig{RemoteHost: "mail.example.com", RemotePort: 993}
+	tlsOnly := config.AccountConfig{RemoteHost: "mail.example.com", RemotePort: 993, RequireTLS: true}
+	tests := []struct {
+		name      string
+		accounts  []config.AccountConfig
+		tlsConfig *tls.Config
+		tlsActive bool
+		want      string
+	}{
+		{"plaintext only", []config.AccountConfig{plain}, nil, false, "IMAP4rev1 IDLE LITERAL+ ID CLIENTID"},
+		{"STARTTLS offered", []config.AccountConfig{plain, tlsOnly}, &tls.Config{}, false, "IMAP4rev1 IDLE LITERAL+ ID CLIENTID STARTTLS"},
+		{"every account requires TLS", []config.AccountConfig{tlsOnly}, &tls.Config{}, false, "IMAP4rev1 IDLE LITERAL+ ID CLIENTID STARTTLS LOGINDISABLED"},
+		{"after STARTTLS", []config.AccountConfig{tlsOnly}, &tls.Config{}, true, "IMAP4rev1 IDLE LITERAL+ ID CLIENTID"},
+		{"upstream without LITERAL+", []config.AccountConfig{plain, noLiteralPlus}, nil, false, "IMAP4rev1 IDLE ID CLIENTID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Session{config: &config.Config{Accounts: tt.accounts}, tlsConfig: tt.tlsConfig, tlsActive: tt.tlsActive}
+			if got := s.preAuthCapabilities(); got != tt.want {
+				t.Errorf("preAuthCapabilities() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capabilityCacheTTL bounds how long learned upstream capabilities are
+// trusted without being seen again.
+const capabilityCacheTTL = time.Hour
+
+// capabilitySet is a set of upper-case capability names.
+type capabilitySet map[string]bool
+
+// has reports whether the set contains name (case-insensitive).
+func (cs capabilitySet) has(name string) bool {
+	return cs[strings.ToUpper(name)]
+}
+
+// String returns the capabilities space-separated, in sorted order.
+func (cs capabilitySet) String() string {
+	return strings.Join(slices.Sorted(maps.Keys(cs)), " ")
+}
+
+// parseCapabilities extracts the capability list from an untagged
+// CAPABILITY response, or from a [CAPABILITY ...] response code directly
+// after an OK or PREAUTH status, as servers put in their greeting and LOGIN
+// completion. Only those positions are recognized, so text such as a FETCH
+// envelope containing "[CAPABILITY" is never mistaken for one.
+func parseCapabilities(line string) (capabilitySet, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	var list string
+	if len(line) > len("* CAPABILITY ") && strings.EqualFold(line[:len("* CAPABILITY ")], "* CAPABILITY ") {
+		list = line[len("* CAPABILITY "):]
+	} else {
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 3 {
+			return nil, false
+		}
+		status, text := strings.ToUpper(parts[1]), parts[2]
+		const code = "[CAPABILITY "
+		if status != "OK" && status != "PREAUTH" ||
+			len(text) < len(code) || !strings.EqualFold(text[:len(code)], code) {
+			return nil, false
+		}
+		end := strings.IndexByte(text, ']')
+		if end < 0 {
+			return nil, false
+		}
+		list = text[len(code):end]
+	}
+	caps := make(capabilitySet)
+	for _, c := range strings.Fields(list) {
+		caps[strings.ToUpper(c)] = true
+	}
+	return caps, len(caps) > 0
+}
+
+// capabilityCache remembers what each upstream advertised in its greeting
+// and after LOGIN, so feature-dependent decisions need no extra CAPABILITY
+// round trip. It is filled passively from responses the proxy sees anyway.
+type capabilityCache struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*capabilityEntry
+}
+
+type capabilityEntry struct {
+	greeting, auth     capabilitySet
+	greetingAt, authAt time.Time
+}
+
+// upstreamCaps is the process-wide cache, keyed by upstreamKey.
+var upstreamCaps = newCapabilityCache()
+
+func newCapabilityCache() *capabilityCache {
+	return &capabilityCache{now: time.Now, entries: make(map[string]*capabilityEntry)}
+}
+
+func (c *capabilityCache) entry(upstream string) *capabilityEntry {
+	e, ok := c.entries[upstream]
+	if !ok {
+		e = &capabilityEntry{}
+		c.entries[upstream] = e
+	}
+	return e
+}
+
+// storeGreeting records the capabilities an upstream advertised before login.
+func (c *capabilityCache) storeGreeting(upstream string, caps capabilitySet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(upstream)
+	e.greeting, e.greetingAt = caps, c.now()
+}
+
+// storeAuth records the capabilities an upstream advertised after login.
+func (c *capabilityCache) storeAuth(upstream string, caps capabilitySet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(upstream)
+	e.auth, e.authAt = caps, c.now()
+}
+
+// greeting returns the cached pre-login capabilities of upstream.
+func (c *capabilityCache) greeting(upstream string) (capabilitySet, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[upstream]
+	if !ok || e.greeting == nil || c.now().Sub(e.greetingAt) >= capabilityCacheTTL {
+		return nil, false
+	}
+	return e.greeting, true
+}
+
+// auth returns the cached post-login capabilities of upstream.
+func (c *capabilityCache) auth(upstream string) (capabilitySet, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[upstream]
+	if !ok || e.auth == nil || c.now().Sub(e.authAt) >= capabilityCacheTTL {
+		return nil, false
+	}
+	return e.auth, true
+}
+
+// upstreamSupports reports whether the session's upstream is known to
+// support capability name after login. Unknown capabilities are assumed
+// supported, so decisions only change once the upstream has said otherwise.
+func (s *Session) upstreamSupports(name string) bool {
+	caps, ok := upstreamCaps.auth(s.upstream)
+	return !ok || caps.has(name)
+}
+
+// forget removes the capabilities cached for upstream and reports whether
+// there were any.
+func (c *capabilityCache) forget(upstream string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[upstream]
+	delete(c.entries, upstream)
+	return ok
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		line string
+		want string // sorted capabilities, "" for none
+	}{
+		{"* CAPABILITY IMAP4rev1 IDLE LITERAL+\r\n", "IDLE IMAP4REV1 LITERAL+"},
+		{"* capability imap4rev1 idle\r\n", "IDLE IMAP4REV1"},
+		{"* OK [CAPABILITY IMAP4rev1 STARTTLS AUTH=PLAIN] Dovecot ready.\r\n", "AUTH=PLAIN IMAP4REV1 STARTTLS"},
+		{"proxy0 OK [CAPABILITY IMAP4rev1 IDLE COMPRESS=DEFLATE] Logged in\r\n", "COMPRESS=DEFLATE IDLE IMAP4REV1"},
+		{"* PREAUTH [CAPABILITY IMAP4rev1] ready\r\n", "IMAP4REV1"},
+		{"* OK IMAP ready\r\n", ""},
+		{"A1 NO [CAPABILITY IMAP4rev1] nope\r\n", ""},
+		{"* OK [CAPABILITY IMAP4rev1 unterminated\r\n", ""},
+		{`* 1 FETCH (ENVELOPE ("d" "OK [CAPABILITY IDLE] subject"))` + "\r\n", ""},
+		{"* CAPABILITY \r\n", ""},
+	}
+	for _, tt := range tests {
+		caps, ok := parseCapabilities(tt.line)
+		got := ""
+		if ok {
+			got = caps.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseCapabilities(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestCapabilityCache(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	c := newCapabilityCache()
+	c.now = func() time.Time { return now }
+
+	if _, ok := c.auth("h:993"); ok {
+		t.Fatal("empty cache returned capabilities")
+	}
+	greeting, _ := parseCapabilities("* OK [CAPABILITY IMAP4rev1 STARTTLS] ready")
+	auth, _ := parseCapabilities("* CAPABILITY IMAP4rev1 IDLE")
+	c.storeGreeting("h:993", greeting)
+	c.storeAuth("h:993", auth)
+
+	if caps, ok := c.greeting("h:993"); !ok || !caps.has("starttls") {
+		t.Errorf("greeting = %v, %v", caps, ok)
+	}
+	if caps, ok := c.auth("h:993"); !ok || !caps.has("IDLE") || caps.has("STARTTLS") {
+		t.Errorf("auth = %v, %v", caps, ok)
+	}
+	if _, ok := c.auth("other:993"); ok {
+		t.Error("capabilities leaked to another upstream")
+	}
+
+	now = now.Add(capabilityCacheTTL)
+	if _, ok := c.auth("h:993"); ok {
+		t.Error("expired auth capabilities returned")
+	}
+	if _, ok := c.greeting("h:993"); ok {
+		t.Error("expired greeting capabilities returned")
+	}
+}
+
+func TestDialAndLoginCacheCapabilities(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "* OK [CAPABILITY IMAP4rev1 LOGINDISABLED STARTTLS AUTH=PLAIN SASL-IR] ready\r\n")
+		bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprint(conn, "proxy0 OK [CAPABILITY IMAP4rev1 IDLE LITERAL+] Logged in\r\n")
+	}()
+
+	acct := &config.AccountConfig{RemoteHost: "127.0.0.1", RemotePort: ln.Addr().(*net.TCPAddr).Port}
+	conn, r, err := dialUpstream(acct, nil, "")
+	if err != nil {
+		t.Fatalf("dialUpstream: %v", err)
+	}
+	defer conn.Close()
+	if err := LoginUpstream(conn, r, acct); err != nil {
+		t.Fatalf("LoginUpstream: %v", err)
+	}
+
+	key := upstreamKey(acct)
+	if caps, ok := upstreamCaps.greeting(key); !ok || !caps.has("LOGINDISABLED") {
+		t.Errorf("greeting capabilities = %v, %v", caps, ok)
+	}
+	if caps, ok := upstreamCaps.auth(key); !ok || !caps.has("LITERAL+") {
+		t.Errorf("auth capabilities = %v, %v", caps, ok)
+	}
+}
+
+func TestIdleRefusedWithoutUpstreamSupport(t *testing.T) {
+	cfg := testConfig()
+	// A host of its own keeps this test's capabilities away from others.
+	cfg.Accounts[0].RemoteHost = "noidle.example.com"
+
+	upClient, upServer := net.Pipe()
+	received := make(chan string, 10)
+	go func() {
+		defer upServer.Close()
+		r := bufio.NewReader(upServer)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			received <- strings.TrimRight(line, "\r\n")
+			tag, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			if strings.EqualFold(rest, "CAPABILITY") {
+				fmt.Fprint(upServer, "* CAPABILITY IMAP4rev1 LITERAL+\r\n")
+			}
+			fmt.Fprintf(upServer, "%s OK done\r\n", tag)
+		}
+	}()
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	env.login(t)
+
+	if _, ok := upstreamCaps.auth(upstreamKey(&cfg.Accounts[0])); ok {
+		t.Fatal("capabilities cached although the upstream advertised none")
+	}
+	env.send(t, "A002 CAPABILITY\r\n")
+	env.expectUpstream(t, "CAPABILITY")
+	if line := env.readLine(t); !strings.HasPrefix(line, "* CAPABILITY") {
+		t.Fatalf("CAPABILITY response = %q", line)
+	}
+	env.readLine(t) // A002 OK
+
+	// The relayed CAPABILITY response showed no IDLE, so IDLE is refused
+	// without reaching the upstream.
+	env.send(t, "A003 IDLE\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A003 NO IDLE not supported") {
+		t.Fatalf("IDLE response = %q", line)
+	}
+	env.noUpstream(t)
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var chaosFaultsTotal = metrics.Default.NewCounter("imap_proxy_chaos_faults_total",
+	"Faults injected into upstream connections by chaos mode.", "fault")
+
+// errChaosDisconnect is returned by a chaosConn that dropped its connection.
+var errChaosDisconnect = errors.New("chaos: connection dropped")
+
+// chaosLine is the untagged response inserted by untagged_probability. An
+// unknown response code is legal and must be ignored by clients.
+const chaosLine = "* OK [CHAOS] imap-proxy chaos mode\r\n"
+
+// chaosConn injects the faults of a ChaosConfig into what is read from the
+// upstream. It reads whole response lines so that untagged responses and
+// disconnects fall between responses, never inside one or its literals.
+type chaosConn struct {
+	net.Conn
+	cfg   config.ChaosConfig
+	r     *bufio.Reader
+	rand  func() float64
+	sleep func(time.Duration)
+
+	pending []byte // data waiting to be returned by Read
+	literal int64  // literal bytes to pass through before the next line
+	started bool   // the greeting has been read; nothing goes before it
+}
+
+func newChaosConn(conn net.Conn, cfg config.ChaosConfig) *chaosConn {
+	return &chaosConn{Conn: conn, cfg: cfg, r: bufio.NewReader(conn), rand: rand.Float64, sleep: time.Sleep}
+}
+
+func (c *chaosConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if err := c.fill(); err != nil {
+			return 0, err
+		}
+		// Latency is added per line or literal chunk, not per fragment.
+		if d := c.cfg.Latency + time.Duration(c.rand()*float64(c.cfg.Jitter)); d > 0 {
+			chaosFaultsTotal.Inc("latency")
+			c.sleep(d)
+		}
+	}
+	n := min(len(p), len(c.pending))
+	if c.roll(c.cfg.FragmentProbability) {
+		chaosFaultsTotal.Inc("fragment")
+		n = min(n, 1+int(c.rand()*8))
+	}
+	n = copy(p, c.pending[:n])
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// fill reads the next response line, or the next chunk of a literal, into
+// pending, deciding which faults to inject before it.
+func (c *chaosConn) fill() error {
+	if c.literal > 0 {
+		buf := make([]byte, min(c.literal, 32<<10))
+		n, err := c.r.Read(buf)
+		c.literal -= int64(n)
+		c.pending = buf[:n]
+		if n > 0 {
+			return nil
+		}
+		return err
+	}
+	line, err := c.r.ReadBytes('\n')
+	if len(line) == 0 {
+		return err
+	}
+	c.pending = line
+	if line[len(line)-1] != '\n' {
+		// Partial line before an error; the error follows on the next read.
+		return nil
+	}
+	if c.roll(c.cfg.DisconnectProbability) {
+		chaosFaultsTotal.Inc("disconnect")
+		c.pending = nil
+		c.Conn.Close()
+		return errChaosDisconnect
+	}
+	if c.started && c.roll(c.cfg.UntaggedProbability) {
+		chaosFaultsTotal.Inc("untagged")
+		c.pending = append([]byte(chaosLine), line...)
+	}
+	c.started = true
+	if n, _, ok := imap.ParseLiteral(line); ok {
+		c.literal = n
+	}
+	return nil
+}
+
+// roll reports true with probability p.
+func (c *chaosConn) roll(p float64) bool {
+	return p > 0 && c.rand() < p
+}
+
+// chaosWriter delays each write to the client by the client latency and
+// jitter of a ChaosConfig. A wait is cut short when stop is closed.
+type chaosWriter struct {
+	w    io.Writer
+	cfg  config.ChaosConfig
+	rand func() float64
+	stop <-chan struct{}
+}
+
+func newChaosWriter(w io.Writer, cfg config.ChaosConfig, stop <-chan struct{}) *chaosWriter {
+	return &chaosWriter{w: w, cfg: cfg, rand: rand.Float64, stop: stop}
+}
+
+func (c *chaosWriter) Write(p []byte) (int, error) {
+	if d := c.cfg.ClientLatency + time.Duration(c.rand()*float64(c.cfg.ClientJitter)); d > 0 {
+		chaosFaultsTotal.Inc("client_latency")
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-c.stop:
+			timer.Stop()
+			return 0, net.ErrClosed
+		}
+	}
+	return c.w.Write(p)
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imaptest"
+)
+
+// chaosPipe returns a chaosConn reading what the returned function writes
+// as the upstream, with randomness fixed at r.
+func chaosPipe(t *testing.T, cfg config.ChaosConfig, r float64) (*chaosConn, func(string)) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	c := newChaosConn(client, cfg)
+	c.rand = func() float64 { return r }
+	c.sleep = func(time.Duration) {}
+	return c, func(s string) {
+		go func() {
+			server.Write([]byte(s))
+			server.Close()
+		}()
+	}
+}
+
+func TestChaosUntagged(t *testing.T) {
+	c, send := chaosPipe(t, config.ChaosConfig{UntaggedProbability: 0.5}, 0)
+	send("* OK ready\r\n* 1 FETCH (BODY[] {9}\r\nx\r\n* OK\r\n)\r\na1 OK done\r\n")
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "* OK ready\r\n" +
+		chaosLine + "* 1 FETCH (BODY[] {9}\r\nx\r\n* OK\r\n" +
+		chaosLine + ")\r\n" +
+		chaosLine + "a1 OK done\r\n"
+	if string(got) != want {
+		t.Errorf("read %q\nwant %q", got, want)
+	}
+}
+
+func TestChaosFragmentAndLatency(t *testing.T) {
+	c, send := chaosPipe(t, config.ChaosConfig{FragmentProbability: 1, Latency: time.Second, Jitter: time.Second}, 0.5)
+	var slept []time.Duration
+	c.sleep = func(d time.Duration) { slept = append(slept, d) }
+	data := "* OK ready\r\na1 OK " + strings.Repeat("x", 40) + "\r\n"
+	send(data)
+	var got []byte
+	buf := make([]byte, 100)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			break
+		}
+		if n > 5 {
+			t.Fatalf("read %d bytes, want at most 5 at rand 0.5", n)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != data {
+		t.Errorf("read %q, want %q", got, data)
+	}
+	// One delay per line, not per fragment.
+	if len(slept) != 2 || slept[0] != 1500*time.Millisecond {
+		t.Errorf("slept %v, want 1.5s twice", slept)
+	}
+}
+
+func TestChaosDisconnect(t *testing.T) {
+	c, send := chaosPipe(t, config.ChaosConfig{DisconnectProbability: 0.1}, 0)
+	send("* OK ready\r\n")
+	if _, err := c.Read(make([]byte, 10)); !errors.Is(err, errChaosDisconnect) {
+		t.Fatalf("Read err = %v, want errChaosDisconnect", err)
+	}
+	if _, err := c.Conn.Write([]byte("a1 NOOP\r\n")); err == nil {
+		t.Error("underlying connection still open")
+	}
+
+	c, send = chaosPipe(t, config.ChaosConfig{DisconnectProbability: 0.1}, 0.5)
+	send("* OK ready\r\n")
+	if got, err := io.ReadAll(c); err != nil || string(got) != "* OK ready\r\n" {
+		t.Errorf("read %q, %v; want no disconnect above the probability", got, err)
+	}
+}
+
+func TestDialUpstreamChaos(t *testing.T) {
+	s := imaptest.NewServer()
+	defer s.Close()
+	acct := s.Account("reader1", "")
+	acct.Chaos = config.ChaosConfig{UntaggedProbability: 1, FragmentProbability: 1}
+	conn, r, err := DialUpstream(&acct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := LoginUpstream(conn, r, &acct); err != nil {
+		t.Fatalf("LoginUpstream through chaos: %v", err)
+	}
+	conn.Write([]byte("a1 NOOP\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	lines := []string{}
+	for len(lines) < 2 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if lines[0] != chaosLine || lines[1] != "a1 OK NOOP completed\r\n" {
+		t.Errorf("NOOP = %q", lines)
+	}
+}
+
+func TestChaosWriterLatency(t *testing.T) {
+	var buf strings.Builder
+	stop := make(chan struct{})
+	w := newChaosWriter(&buf, config.ChaosConfig{ClientLatency: 20 * time.Millisecond, ClientJitter: time.Second}, stop)
+	w.rand = func() float64 { return 0.01 }
+	before := chaosFaultsTotal.Value("client_latency")
+	start := time.Now()
+	if _, err := io.WriteString(w, "a1 OK done\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("write took %v, want at least latency plus jitter share (30ms)", d)
+	}
+	if buf.String() != "a1 OK done\r\n" {
+		t.Errorf("wrote %q", buf.String())
+	}
+	if got := chaosFaultsTotal.Value("client_latency") - before; got != 1 {
+		t.Errorf("client_latency faults = %v, want 1", got)
+	}
+
+	// Closing stop ends a pending wait.
+	w.cfg.ClientLatency = time.Hour
+	close(stop)
+	if _, err := io.WriteString(w, "a2 OK\r\n"); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after stop err = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestIntegrationChaosClientLatency(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].Chaos = config.ChaosConfig{ClientLatency: 50 * time.Millisecond}
+	if cfg.Accounts[0].Chaos.UpstreamEnabled() {
+		t.Fatal("client latency alone should leave the upstream connection alone")
+	}
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	start := time.Now()
+	env.send(t, "A002 NOOP\r\n")
+	env.expectUpstream(t, "NOOP")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("NOOP = %q", line)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("response after %v, want the client latency of 50ms", d)
+	}
+}
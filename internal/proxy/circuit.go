@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+// defaultBreakerCooldown applies when circuit_breaker.cooldown is zero.
+const defaultBreakerCooldown = 30 * time.Second
+
+var (
+	circuitOpenedTotal = metrics.Default.NewCounter("imap_proxy_circuit_breaker_opened_total",
+		"Times an upstream circuit breaker opened after consecutive failures.", "upstream")
+	circuitRejectedTotal = metrics.Default.NewCounter("imap_proxy_circuit_breaker_rejected_total",
+		"Logins failed fast because the upstream circuit breaker was open.", "upstream")
+)
+
+// circuitBreakers tracks consecutive dial and login failures per upstream.
+// After cfg.FailureThreshold failures the breaker opens and logins to that
+// upstream fail immediately for the cooldown. Then a single trial login is
+// let through: success closes the breaker, failure reopens it.
+type circuitBreakers struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int       // consecutive failures while closed
+	openUntil time.Time // zero when closed
+	trial     bool      // a half-open trial attempt is in flight
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{now: time.Now, entries: make(map[string]*breakerState)}
+}
+
+// upstreamKey identifies the upstream an account connects to.
+func upstreamKey(acct *config.AccountConfig) string {
+	if acct.UpstreamPath != "" {
+		return "path:" + acct.UpstreamPath
+	}
+	if acct.RemoteSRVDomain != "" {
+		return "srv:" + acct.RemoteSRVDomain
+	}
+	return net.JoinHostPort(acct.RemoteHost, fmt.Sprintf("%d", acct.RemotePort))
+}
+
+// allow reports whether a login to upstream may proceed. Every allowed
+// attempt must be followed by success or failure.
+func (b *circuitBreakers) allow(upstream string, cfg config.CircuitBreakerConfig) bool {
+	if cfg.FailureThreshold <= 0 {
+		return true
+	}
+	now := b.now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.entries[upstream]
+	if !ok || st.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(st.openUntil) || st.trial {
+		circuitRejectedTotal.Inc(upstream)
+		return false
+	}
+	st.trial = true
+	return true
+}
+
+// failure records a failed dial or login and reports whether the breaker
+// opened as a result.
+func (b *circuitBreakers) failure(upstream string, cfg config.CircuitBreakerConfig) bool {
+	if cfg.FailureThreshold <= 0 {
+		return false
+	}
+	cooldown := cfg.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	now := b.now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.entries[upstream]
+	if !ok {
+		st = &breakerState{}
+		b.entries[upstream] = st
+	}
+	if st.trial {
+		st.trial = false
+		st.openUntil = now.Add(cooldown)
+		circuitOpenedTotal.Inc(upstream)
+		return true
+	}
+	st.failures++
+	if st.openUntil.IsZero() && st.failures >= cfg.FailureThreshold {
+		st.openUntil = now.Add(cooldown)
+		circuitOpenedTotal.Inc(upstream)
+		return true
+	}
+	return false
+}
+
+// success closes the breaker for upstream.
+func (b *circuitBreakers) success(upstream string) {
+	b.mu.Lock()
+	delete(b.entries, upstream)
+	b.mu.Unlock()
+}
+
+// cancel ends an allowed attempt that never reached the upstream, so a
+// half-open trial can be retried by the next login.
+func (b *circuitBreakers) cancel(upstream string) {
+	b.mu.Lock()
+	if st, ok := b.entries[upstream]; ok {
+		st.trial = false
+	}
+	b.mu.Unlock()
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	b := newCircuitBreakers()
+	b.now = func() time.Time { return now }
+	cfg := config.CircuitBreakerConfig{FailureThreshold: 3, Cooldown: time.Minute}
+	const up = "mail.example.com:993"
+
+	for i := 1; i <= 2; i++ {
+		if !b.allow(up, cfg) {
+			t.Fatalf("attempt %d rejected before threshold", i)
+		}
+		if b.failure(up, cfg) {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+	}
+	b.allow(up, cfg)
+	if !b.failure(up, cfg) {
+		t.Fatal("breaker did not open at the threshold")
+	}
+	if b.allow(up, cfg) {
+		t.Fatal("open breaker allowed a login")
+	}
+	if !b.allow("other.example.com:993", cfg) {
+		t.Fatal("breaker affected another upstream")
+	}
+
+	// After the cooldown exactly one trial is let through.
+	now = now.Add(time.Minute)
+	if !b.allow(up, cfg) {
+		t.Fatal("trial rejected after cooldown")
+	}
+	if b.allow(up, cfg) {
+		t.Fatal("second login allowed while the trial is in flight")
+	}
+	// A failed trial reopens the breaker immediately.
+	if !b.failure(up, cfg) {
+		t.Fatal("failed trial did not reopen the breaker")
+	}
+	if b.allow(up, cfg) {
+		t.Fatal("reopened breaker allowed a login")
+	}
+
+	// A successful trial closes it.
+	now = now.Add(time.Minute)
+	if !b.allow(up, cfg) {
+		t.Fatal("trial rejected after second cooldown")
+	}
+	b.success(up)
+	for i := 0; i < 3; i++ {
+		if !b.allow(up, cfg) {
+			t.Fatal("closed breaker rejected a login")
+		}
+	}
+}
+
+func TestCircuitBreakersCancel(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	b := newCircuitBreakers()
+	b.now = func() time.Time { return now }
+	cfg := config.CircuitBreakerConfig{FailureThreshold: 1}
+	const up = "mail.example.com:993"
+
+	b.allow(up, cfg)
+	b.failure(up, cfg)
+	now = now.Add(defaultBreakerCooldown)
+	if !b.allow(up, cfg) {
+		t.Fatal("trial rejected after the default cooldown")
+	}
+	b.cancel(up)
+	if !b.allow(up, cfg) {
+		t.Fatal("canceled trial was not released")
+	}
+}
+
+func TestCircuitBreakersDisabled(t *testing.T) {
+	b := newCircuitBreakers()
+	var cfg config.CircuitBreakerConfig
+	for i := 0; i < 10; i++ {
+		if !b.allow("h:1", cfg) {
+			t.Fatal("disabled breaker rejected a login")
+		}
+		if b.failure("h:1", cfg) {
+			t.Fatal("disabled breaker opened")
+		}
+	}
+}
+
+func TestUpstreamKey(t *testing.T) {
+	tests := []struct {
+		acct config.AccountConfig
+		want string
+	}{
+		{config.AccountConfig{RemoteHost: "mail.example.com", RemotePort: 993}, "mail.example.com:993"},
+		{config.AccountConfig{RemoteHost: "2001:db8::1", RemotePort: 143}, "[2001:db8::1]:143"},
+		{config.AccountConfig{RemoteSRVDomain: "example.com"}, "srv:example.com"},
+	}
+	for _, tt := range tests {
+		if got := upstreamKey(&tt.acct); got != tt.want {
+			t.Errorf("upstreamKey(%+v) = %q, want %q", tt.acct, got, tt.want)
+		}
+	}
+}
+
+func TestLoginCircuitBreaker(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.CircuitBreaker = config.CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Hour}
+	sh := newShared()
+	dials := 0
+	failingDial := func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+		dials++
+		return nil, nil, errors.New("connection refused")
+	}
+
+	login := func() string {
+		env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+			s.shared = sh
+			s.dialUpstream = failingDial
+		})
+		env.readLine(t) // greeting
+		env.send(t, "A001 LOGIN reader1 localpass1\r\n")
+		return env.readLine(t)
+	}
+
+	for i := 0; i < 2; i++ {
+		if line := login(); !strings.HasPrefix(line, "A001 NO [UNAVAILABLE] upstream unreachable") {
+			t.Fatalf("login %d = %q, want dial failure", i+1, line)
+		}
+	}
+	if line := login(); !strings.Contains(line, "NO [UNAVAILABLE] upstream temporarily unavailable") {
+		t.Fatalf("login with open breaker = %q", line)
+	}
+	if dials != 2 {
+		t.Errorf("dials = %d, want 2 (open breaker must not dial)", dials)
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var clientPolicyMatchesTotal = metrics.Default.NewCounter("imap_proxy_client_policy_matches_total",
+	"Sessions that matched a client software policy.", "action")
+
+// recordClientID remembers the parameters of a client's ID command.
+func (s *Session) recordClientID(cmd imap.Command) {
+	params, ok := imap.ParseIDParams(cmd.Raw)
+	if !ok {
+		s.logger.Debug("ignoring malformed ID parameters")
+		return
+	}
+	s.clientID = params
+	s.logger.Info("client identified", "name", params["name"], "version", params["version"])
+}
+
+// clientAllowed applies acct's client policies to the identified client
+// software. It logs matches and reports whether the client may proceed.
+func (s *Session) clientAllowed(acct *config.AccountConfig) bool {
+	name, version := s.clientID["name"], s.clientID["version"]
+	p := acct.ClientPolicy(name, version)
+	if p == nil {
+		return true
+	}
+	clientPolicyMatchesTotal.Inc(p.Action)
+	if p.Action == config.ClientPolicyReject {
+		s.logger.Warn("client software rejected by policy", "user", acct.LocalUser, "client_name", name, "client_version", version)
+		return false
+	}
+	s.logger.Warn("client software matched warning policy", "user", acct.LocalUser, "client_name", name, "client_version", version)
+	return true
+}
+
+// handleClientID answers a CLIENTID command locally in either state. The
+// identifier is only logged: the upstream sees the account's configured
+// upstream_clientid, if any, never the client's.
+func (s *Session) handleClientID(cmd imap.Command) {
+	idType, value, ok := imap.ParseClientIDArgs(cmd.Raw)
+	if !ok {
+		fmt.Fprintf(s.clientConn, "%s BAD CLIENTID expects a type and a value\r\n", cmd.Tag)
+		return
+	}
+	s.logger.Info("client sent CLIENTID", "type", idType, "value", value)
+	fmt.Fprintf(s.clientConn, "%s OK CLIENTID completed\r\n", cmd.Tag)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+func clientPolicyConfig() *config.Config {
+	cfg := testConfig()
+	cfg.Accounts[0].ClientPolicies = []config.ClientPolicy{
+		{Name: "BadLib", Version: "1.*", Action: config.ClientPolicyReject},
+		{Name: "OldMail", Action: config.ClientPolicyWarn},
+	}
+	return cfg
+}
+
+func TestClientPolicyAtLogin(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		wantOK bool
+	}{
+		{name: "rejected version", id: `("name" "BadLib" "version" "1.2")`, wantOK: false},
+		{name: "newer version", id: `("name" "BadLib" "version" "2.0")`, wantOK: true},
+		{name: "warned", id: `("name" "OldMail" "version" "3")`, wantOK: true},
+		{name: "no match", id: "NIL", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []audit.Event
+			env := newIntegrationEnvWithConfig(t, clientPolicyConfig(), func(s *Session) {
+				s.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) { events = append(events, ev) }))
+			})
+			defer env.clientConn.Close()
+			env.readLine(t) // greeting
+
+			env.send(t, "A1 ID "+tt.id+"\r\n")
+			env.readUntilTagged(t, "A1")
+			env.send(t, "A2 LOGIN reader1 localpass1\r\n")
+			if tt.wantOK {
+				env.drainUpstream(t)
+			}
+			line := env.readLine(t)
+			if got := strings.HasPrefix(line, "A2 OK"); got != tt.wantOK {
+				t.Fatalf("LOGIN response %q, want ok=%v", line, tt.wantOK)
+			}
+			if !tt.wantOK && line != "A2 NO client software not permitted for this account\r\n" {
+				t.Errorf("unexpected rejection %q", line)
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d audit events, want 1", len(events))
+			}
+			if strings.HasPrefix(tt.id, "(") && events[0].Fields["client_name"] == "" {
+				t.Errorf("audit event lacks client_name: %v", events[0].Fields)
+			}
+		})
+	}
+}
+
+func TestClientPolicyAfterLogin(t *testing.T) {
+	env := newIntegrationEnvWithConfig(t, clientPolicyConfig())
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A2 ID (\"name\" \"OldMail\")\r\n")
+	env.readUntilTagged(t, "A2")
+
+	env.send(t, "A3 ID (\"name\" \"BadLib\" \"version\" \"1.0\")\r\n")
+	lines := env.readUntilTagged(t, "A3")
+	env.noUpstream(t)
+	if line := env.readLine(t); line != "* BYE client software not permitted for this account\r\n" {
+		t.Fatalf("after rejected ID got %q (preceded by %q), want BYE", line, lines)
+	}
+}
+
+func TestClientIDAnsweredLocally(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.clientConn.Close()
+	env.readLine(t) // greeting
+
+	env.send(t, "A1 CLIENTID UDID 0123abcd\r\n")
+	if line := env.readLine(t); line != "A1 OK CLIENTID completed\r\n" {
+		t.Fatalf("pre-auth CLIENTID = %q", line)
+	}
+	env.send(t, "A2 CLIENTID UDID\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A2 BAD") {
+		t.Fatalf("CLIENTID without a value = %q, want BAD", line)
+	}
+
+	env.send(t, "A3 LOGIN reader1 localpass1\r\n")
+	env.drainUpstream(t)
+	if line := env.readLine(t); !strings.HasPrefix(line, "A3 OK") {
+		t.Fatalf("LOGIN = %q", line)
+	}
+	env.send(t, "A4 CLIENTID TOKENID \"abc def\"\r\n")
+	if line := env.readLine(t); line != "A4 OK CLIENTID completed\r\n" {
+		t.Fatalf("post-auth CLIENTID = %q", line)
+	}
+	env.noUpstream(t)
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var idleUpdatesCoalescedTotal = metrics.Default.NewCounter("imap_proxy_idle_updates_coalesced_total",
+	"EXISTS and RECENT updates dropped because a later count superseded them during IDLE.")
+
+// coalescer buffers mailbox size updates for a client in IDLE and relays
+// them in batches, so that bursts of deliveries or expunges wake the client
+// once per interval instead of once per message.
+type coalescer struct {
+	interval time.Duration
+	flush    func()        // called by the timer when the interval elapses
+	mem      *memoryBudget // accounts for pending lines
+
+	mu      sync.Mutex
+	pending []string
+	timer   *time.Timer
+}
+
+// add buffers an update and starts the flush timer if it is not running.
+func (c *coalescer) add(line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, line)
+	c.mem.hold(len(line))
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.interval, c.flush)
+	}
+}
+
+// take returns the buffered updates with superseded counts removed and
+// resets the buffer.
+func (c *coalescer) take() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+	for _, line := range c.pending {
+		c.mem.free(len(line))
+	}
+	lines := compactUpdates(c.pending)
+	idleUpdatesCoalescedTotal.Add(float64(len(c.pending) - len(lines)))
+	c.pending = nil
+	return lines
+}
+
+// compactUpdates keeps every EXPUNGE in order, since each one renumbers the
+// messages after it, and between them keeps only the last EXISTS and the
+// last RECENT. An EXISTS before an EXPUNGE is never dropped, because the
+// EXPUNGE may refer to a message it announced.
+func compactUpdates(lines []string) []string {
+	var out []string
+	var exists, recent string
+	endRun := func() {
+		if exists != "" {
+			out = append(out, exists)
+		}
+		if recent != "" {
+			out = append(out, recent)
+		}
+		exists, recent = "", ""
+	}
+	for _, line := range lines {
+		_, kind, _ := imap.ParseMessageData([]byte(line))
+		switch kind {
+		case "EXISTS":
+			exists = line
+		case "RECENT":
+			recent = line
+		default:
+			endRun()
+			out = append(out, line)
+		}
+	}
+	endRun()
+	return out
+}
+
+// isSizeUpdate reports whether line is an EXISTS, RECENT or EXPUNGE response.
+func isSizeUpdate(line string) bool {
+	_, _, ok := imap.ParseMessageData([]byte(line))
+	return ok
+}
+
+// lockedWriter serializes writes to the client from the upstream reader and
+// the coalescer's flush timer. Lock is held across a response line and its
+// literal so that a flush never splits them.
+type lockedWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) { return l.w.Write(p) }
+
+// flushPending writes lines held back by the keepalive and the coalescer
+// ahead of the next relayed response; out must be locked.
+func (s *Session) flushPending(out io.Writer) error {
+	if err := s.flushCoalesced(out); err != nil {
+		return err
+	}
+	return s.flushKeepalive(out)
+}
+
+// flushCoalesced writes buffered IDLE updates to out; out must be locked.
+func (s *Session) flushCoalesced(out io.Writer) error {
+	if s.coalesce == nil {
+		return nil
+	}
+	for _, line := range s.coalesce.take() {
+		if _, err := io.WriteString(out, line); err != nil {
+			return err
+		}
+		s.countDownload(len(line))
+		s.usage.relayed(line, len(line))
+	}
+	return nil
+}
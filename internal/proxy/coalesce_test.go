@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestCompactUpdates(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			name: "exists run",
+			in:   []string{"* 5 EXISTS\r\n", "* 6 EXISTS\r\n", "* 7 EXISTS\r\n"},
+			want: []string{"* 7 EXISTS\r\n"},
+		},
+		{
+			name: "exists and recent",
+			in:   []string{"* 5 EXISTS\r\n", "* 1 RECENT\r\n", "* 6 EXISTS\r\n", "* 2 RECENT\r\n"},
+			want: []string{"* 6 EXISTS\r\n", "* 2 RECENT\r\n"},
+		},
+		{
+			name: "expunges kept in order",
+			in:   []string{"* 3 EXPUNGE\r\n", "* 3 EXPUNGE\r\n", "* 1 EXPUNGE\r\n"},
+			want: []string{"* 3 EXPUNGE\r\n", "* 3 EXPUNGE\r\n", "* 1 EXPUNGE\r\n"},
+		},
+		{
+			name: "exists before expunge preserved",
+			in:   []string{"* 8 EXISTS\r\n", "* 9 EXISTS\r\n", "* 9 EXPUNGE\r\n", "* 8 EXISTS\r\n", "* 9 EXISTS\r\n"},
+			want: []string{"* 9 EXISTS\r\n", "* 9 EXPUNGE\r\n", "* 9 EXISTS\r\n"},
+		},
+		{
+			name: "empty",
+			in:   nil,
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compactUpdates(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compactUpdates(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// newBurstEnv starts a session whose upstream answers IDLE with a
+// continuation followed by the given untagged lines.
+func newBurstEnv(t *testing.T, interval time.Duration, burst ...string) *integrationEnv {
+	t.Helper()
+	cfg := testConfig()
+	cfg.Server.IdleCoalesceInterval = interval
+	received := make(chan string, 100)
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				var idleTag string
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					received <- line
+					if line == "DONE" {
+						fmt.Fprintf(upServer, "%s OK IDLE terminated\r\n", idleTag)
+						continue
+					}
+					tag, verb, _ := strings.Cut(line, " ")
+					if verb == "IDLE" {
+						idleTag = tag
+						fmt.Fprint(upServer, "+ idling\r\n")
+						for _, u := range burst {
+							fmt.Fprint(upServer, u)
+						}
+						continue
+					}
+					fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	return env
+}
+
+func TestIdleUpdatesCoalesced(t *testing.T) {
+	env := newBurstEnv(t, 50*time.Millisecond,
+		"* 5 EXISTS\r\n", "* 1 RECENT\r\n", "* 6 EXISTS\r\n", "* 2 RECENT\r\n", "* 7 EXISTS\r\n")
+	defer env.clientConn.Close()
+	env.login(t)
+
+	before := idleUpdatesCoalescedTotal.Value()
+	env.send(t, "A002 IDLE\r\n")
+	env.expectUpstream(t, "A002 IDLE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got: %q", line)
+	}
+	if line := env.readLine(t); line != "* 7 EXISTS\r\n" {
+		t.Fatalf("first update = %q, want the last EXISTS", line)
+	}
+	if line := env.readLine(t); line != "* 2 RECENT\r\n" {
+		t.Fatalf("second update = %q, want the last RECENT", line)
+	}
+	if got := idleUpdatesCoalescedTotal.Value(); got < before+3 {
+		t.Errorf("coalesced counter = %v, want at least %v", got, before+3)
+	}
+
+	env.send(t, "DONE\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("expected IDLE completion, got: %q", line)
+	}
+}
+
+func TestIdleUpdatesFlushedBeforeCompletion(t *testing.T) {
+	// The interval never elapses; DONE's completion must flush the buffer.
+	env := newBurstEnv(t, time.Hour, "* 3 EXPUNGE\r\n", "* 8 EXISTS\r\n", "* 9 EXISTS\r\n")
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 IDLE\r\n")
+	env.expectUpstream(t, "A002 IDLE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got: %q", line)
+	}
+	// Give the burst time to reach the proxy before ending the IDLE.
+	time.Sleep(50 * time.Millisecond)
+	env.send(t, "DONE\r\n")
+	lines := env.readUntilTagged(t, "A002")
+	want := []string{"* 3 EXPUNGE\r\n", "* 9 EXISTS\r\n"}
+	if len(lines) != 3 || !reflect.DeepEqual(lines[:2], want) || !strings.HasPrefix(lines[2], "A002 OK") {
+		t.Fatalf("response = %q, want %q then the completion", lines, want)
+	}
+}
+
+func TestIdleUpdatesNotCoalescedByDefault(t *testing.T) {
+	env := newBurstEnv(t, 0, "* 5 EXISTS\r\n", "* 6 EXISTS\r\n")
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 IDLE\r\n")
+	env.expectUpstream(t, "A002 IDLE")
+	for _, want := range []string{"+ idling\r\n", "* 5 EXISTS\r\n", "* 6 EXISTS\r\n"} {
+		if line := env.readLine(t); line != want {
+			t.Fatalf("got %q, want %q", line, want)
+		}
+	}
+	env.send(t, "DONE\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("expected IDLE completion, got: %q", line)
+	}
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+// defaultResponseTimeout is how long the upstream may stay silent while a
+// forwarded command awaits its response before the session is closed.
+const defaultResponseTimeout = 2 * time.Minute
+
+var upstreamUnresponsiveTotal = metrics.Default.NewCounter("imap_proxy_upstream_unresponsive_total",
+	"Sessions closed because the upstream stopped responding to a command.")
+
+var responsesAbortedTotal = metrics.Default.NewCounter("imap_proxy_upstream_responses_aborted_total",
+	"Sessions closed in the middle of an upstream response with literals, by reason: stalled or too_large.", "reason")
+
+// errLiteralTooLarge ends a session whose upstream announces a literal
+// larger than the account's max_response_literal_mb.
+var errLiteralTooLarge = errors.New("upstream literal too large")
+
+// responseDeadline arms a read deadline on the upstream connection while
+// commands are awaiting their tagged response, and clears it otherwise, so
+// that a dead upstream is detected without timing out IDLE or quiet
+// sessions. Each line or literal chunk from the upstream extends it.
+// From the first literal of a response to its end, literalTimeout applies
+// instead, whether or not a command is outstanding, so that an upstream
+// stalling halfway through a response is detected even in IDLE.
+type responseDeadline struct {
+	conn           net.Conn
+	timeout        time.Duration
+	literalTimeout time.Duration // zero leaves responses with literals to timeout
+
+	mu          sync.Mutex
+	pending     int       // forwarded commands without a tagged response
+	waiting     bool      // the upstream sent "+" and is waiting on the client
+	lastSent    time.Time // when the most recent command was forwarded
+	midResponse bool      // a response with literals is being read
+}
+
+// expect records a command about to be forwarded. It must be called before
+// the command is written, so its response cannot arrive first.
+func (d *responseDeadline) expect() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending++
+	d.waiting = false
+	d.lastSent = time.Now()
+	d.arm()
+}
+
+// quietFor reports whether no command is outstanding and none has been
+// forwarded for at least dur.
+func (d *responseDeadline) quietFor(dur time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending == 0 && !d.waiting && time.Since(d.lastSent) >= dur
+}
+
+// resume re-arms the deadline after the client sent data the upstream was
+// waiting for, such as literal bytes.
+func (d *responseDeadline) resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.waiting = false
+	d.arm()
+}
+
+// received updates the deadline after a line from the upstream.
+func (d *responseDeadline) received(line string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(line, "+"):
+		d.waiting = true
+	case strings.HasPrefix(line, "*"):
+	default:
+		if d.pending > 0 {
+			d.pending--
+		}
+	}
+	d.arm()
+}
+
+// reset moves the deadline to a replacement upstream connection and
+// forgets commands that were outstanding on the old one.
+func (d *responseDeadline) reset(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conn = conn
+	d.pending = 0
+	d.waiting = false
+	d.midResponse = false
+	d.arm()
+}
+
+// progress extends an armed deadline while a literal is being read.
+func (d *responseDeadline) progress() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.arm()
+}
+
+// literal arms the literal timeout while a literal, and the rest of the
+// response after it, is being read. Every chunk read extends it.
+func (d *responseDeadline) literal() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.midResponse = true
+	d.arm()
+}
+
+// responseDone ends a response that had literals.
+func (d *responseDeadline) responseDone() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.midResponse {
+		d.midResponse = false
+		d.arm()
+	}
+}
+
+// stalled reports whether a response with literals is being read, so that
+// an expired deadline means the upstream stalled in the middle of it.
+func (d *responseDeadline) stalled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.midResponse && d.literalTimeout > 0
+}
+
+// arm sets or clears the read deadline; d.mu must be held.
+func (d *responseDeadline) arm() {
+	switch {
+	case d.midResponse && d.literalTimeout > 0:
+		d.conn.SetReadDeadline(time.Now().Add(d.literalTimeout))
+	case d.pending > 0 && !d.waiting:
+		d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	default:
+		d.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// progressReader calls onRead after every successful read.
+type progressReader struct {
+	r      io.Reader
+	onRead func()
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.onRead()
+	}
+	return n, err
+}
+
+// responseTimeout returns the account's response timeout or the default.
+func responseTimeout(acct *config.AccountConfig) time.Duration {
+	if acct.ResponseTimeout > 0 {
+		return acct.ResponseTimeout
+	}
+	return defaultResponseTimeout
+}
+
+// literalTimeout returns the account's literal timeout, which defaults to
+// its response timeout.
+func literalTimeout(acct *config.AccountConfig) time.Duration {
+	if acct.LiteralTimeout > 0 {
+		return acct.LiteralTimeout
+	}
+	return responseTimeout(acct)
+}
+
+// literalTooLarge reports whether the upstream may not send a literal of n
+// bytes to the account.
+func literalTooLarge(acct *config.AccountConfig, n int64) bool {
+	return acct.MaxResponseLiteralMB > 0 && n > int64(acct.MaxResponseLiteralMB)<<20
+}
+
+// upstreamReadFailed handles the end of the upstream stream. Unless the
+// session is already ending, the client is told with a BYE before the
+// session closes, so that it reconnects promptly. After the upstream's own
+// BYE, that is the one upstream_notices lets through.
+// Callers in the middle of relaying a literal pass io.Discard for out, since
+// the client would take a BYE for literal data.
+func (s *Session) upstreamReadFailed(out io.Writer, err error) {
+	if errors.Is(err, errMemoryLimit) {
+		s.memoryExceeded(out, "upstream")
+		return
+	}
+	var bye *upstreamByeError
+	if errors.As(err, &bye) {
+		io.WriteString(out, bye.bye)
+		return
+	}
+	if errors.Is(err, errLiteralTooLarge) {
+		s.logger.Warn("upstream literal too large, closing session", "max_response_literal_mb", s.account.MaxResponseLiteralMB)
+		responsesAbortedTotal.Inc("too_large")
+		io.WriteString(out, "* BYE [LIMIT] upstream response too large\r\n")
+		return
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && s.deadline.stalled() {
+		s.logger.Warn("upstream stalled in the middle of a response, closing session", "timeout", s.deadline.literalTimeout)
+		responsesAbortedTotal.Inc("stalled")
+		io.WriteString(out, "* BYE upstream server not responding\r\n")
+		return
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		s.logger.Warn("upstream stopped responding, closing session", "timeout", s.deadline.timeout)
+		upstreamUnresponsiveTotal.Inc()
+		io.WriteString(out, "* BYE upstream server not responding\r\n")
+		return
+	}
+	if err != io.EOF {
+		s.logger.Debug("read from upstream failed", "err", err)
+	}
+	select {
+	case <-s.stopped:
+		return // the proxy closed the connection
+	default:
+	}
+	if s.loggingOut.Load() {
+		return
+	}
+	s.logger.Warn("upstream connection lost, closing session")
+	io.WriteString(out, "* BYE [UNAVAILABLE] upstream connection lost\r\n")
+}
+
+// isBye reports whether line is an untagged BYE response.
+func isBye(line string) bool {
+	return len(line) >= 5 && strings.EqualFold(line[:5], "* BYE")
+}
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+// deadlineConn records whether a read deadline is armed.
+type deadlineConn struct {
+	net.Conn
+	armed bool
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.armed = !t.IsZero()
+	return nil
+}
+
+func TestResponseDeadline(t *testing.T) {
+	type step struct {
+		event string // expect, resume, progress, or an upstream line
+		armed bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"command and response", []step{
+			{"expect", true},
+			{"* 1 EXISTS\r\n", true},
+			{"A1 OK done\r\n", false},
+		}},
+		{"pipelined commands", []step{
+			{"expect", true},
+			{"expect", true},
+			{"A1 OK done\r\n", true},
+			{"A2 OK done\r\n", false},
+		}},
+		{"untagged while quiet", []step{
+			{"* 3 EXISTS\r\n", false},
+			{"progress", false},
+		}},
+		{"idle", []step{
+			{"expect", true},
+			{"+ idling\r\n", false},
+			{"* 4 EXISTS\r\n", false},
+			{"resume", true},
+			{"A1 OK IDLE terminated\r\n", false},
+		}},
+		{"synchronizing literal", []step{
+			{"expect", true},
+			{"+ Ready\r\n", false},
+			{"resume", true},
+			{"progress", true},
+			{"A1 OK APPEND completed\r\n", false},
+		}},
+		{"stray tagged response", []step{
+			{"A9 BAD unexpected\r\n", false},
+			{"expect", true},
+		}},
+		{"literal while quiet", []step{
+			{"* 3 FETCH (BODY[] {10}\r\n", false},
+			{"literal", true},
+			{"progress", true},
+			{"done", false},
+		}},
+		{"literal in a response", []step{
+			{"expect", true},
+			{"literal", true},
+			{"done", true},
+			{"A1 OK FETCH completed\r\n", false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &deadlineConn{}
+			d := &responseDeadline{conn: conn, timeout: time.Minute, literalTimeout: time.Minute}
+			for i, st := range tt.steps {
+				switch st.event {
+				case "literal":
+					d.literal()
+				case "done":
+					d.responseDone()
+				case "expect":
+					d.expect()
+				case "resume":
+					d.resume()
+				case "progress":
+					d.progress()
+				default:
+					d.received(st.event)
+				}
+				if conn.armed != st.armed {
+					t.Fatalf("step %d (%q): armed = %v, want %v", i, st.event, conn.armed, st.armed)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseTimeoutDefault(t *testing.T) {
+	if got := responseTimeout(&config.AccountConfig{}); got != defaultResponseTimeout {
+		t.Errorf("default = %v, want %v", got, defaultResponseTimeout)
+	}
+	if got := responseTimeout(&config.AccountConfig{ResponseTimeout: time.Second}); got != time.Second {
+		t.Errorf("configured = %v, want 1s", got)
+	}
+}
+
+func TestLiteralTimeoutDefault(t *testing.T) {
+	if got := literalTimeout(&config.AccountConfig{ResponseTimeout: time.Second}); got != time.Second {
+		t.Errorf("default = %v, want the response timeout", got)
+	}
+	if got := literalTimeout(&config.AccountConfig{LiteralTimeout: 5 * time.Second}); got != 5*time.Second {
+		t.Errorf("configured = %v, want 5s", got)
+	}
+}
+
+// newStallingUpstreamEnv starts a session whose upstream accepts LOGIN,
+// sends partial and then reads commands without ever answering them.
+func newStallingUpstreamEnv(t *testing.T, modify func(*config.AccountConfig), partial string) *integrationEnv {
+	t.Helper()
+	cfg := testConfig()
+	modify(&cfg.Accounts[0])
+	received := make(chan string, 100)
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				line, err := sr.ReadString('\n')
+				if err != nil {
+					return
+				}
+				received <- strings.TrimRight(line, "\r\n")
+				fmt.Fprint(upServer, "proxy0 OK LOGIN completed\r\n"+partial)
+				for {
+					if _, err := sr.ReadString('\n'); err != nil {
+						return
+					}
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	return env
+}
+
+func TestUpstreamStallsMidResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		partial string // sent by the upstream before it stalls
+	}{
+		{"in a literal", "* 1 FETCH (BODY[] {100}\r\n0123456789"},
+		{"after a literal", "* 1 FETCH (BODY[] {3}\r\nabc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No command is outstanding, and the response timeout is long.
+			env := newStallingUpstreamEnv(t, func(a *config.AccountConfig) {
+				a.ResponseTimeout = time.Minute
+				a.LiteralTimeout = 100 * time.Millisecond
+			}, tt.partial)
+			defer env.clientConn.Close()
+			env.login(t)
+			before := responsesAbortedTotal.Value("stalled")
+
+			// The client gets what was sent and then loses the connection,
+			// without a BYE that it would take for part of the response.
+			got, err := io.ReadAll(env.clientR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.partial {
+				t.Errorf("client got %q, want %q", got, tt.partial)
+			}
+			if got := responsesAbortedTotal.Value("stalled") - before; got != 1 {
+				t.Errorf("stalled responses = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestUpstreamLiteralTooLarge(t *testing.T) {
+	env := newStallingUpstreamEnv(t, func(a *config.AccountConfig) {
+		a.MaxResponseLiteralMB = 1
+	}, fmt.Sprintf("* 1 FETCH (BODY[] {%d}\r\n", 1<<20+1))
+	defer env.clientConn.Close()
+	env.login(t)
+	before := responsesAbortedTotal.Value("too_large")
+
+	got, err := io.ReadAll(env.clientR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "* BYE [LIMIT] upstream response too large\r\n" {
+		t.Errorf("client got %q, want only a BYE", got)
+	}
+	if got := responsesAbortedTotal.Value("too_large") - before; got != 1 {
+		t.Errorf("too_large aborts = %v, want 1", got)
+	}
+}
+
+// newSilentUpstreamEnv starts a session whose upstream accepts LOGIN and
+// then reads commands without ever answering them.
+func newSilentUpstreamEnv(t *testing.T, timeout time.Duration) *integrationEnv {
+	t.Helper()
+	cfg := testConfig()
+	cfg.Accounts[0].ResponseTimeout = timeout
+	received := make(chan string, 100)
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				line, err := sr.ReadString('\n')
+				if err != nil {
+					return
+				}
+				received <- strings.TrimRight(line, "\r\n")
+				fmt.Fprint(upServer, "proxy0 OK LOGIN completed\r\n")
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					received <- strings.TrimRight(line, "\r\n")
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	return env
+}
+
+func TestUnresponsiveUpstreamClosesSession(t *testing.T) {
+	env := newSilentUpstreamEnv(t, 100*time.Millisecond)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	before := upstreamUnresponsiveTotal.Value()
+	env.send(t, "A002 NOOP\r\n")
+	env.expectUpstream(t, "NOOP")
+
+	if line := env.readLine(t); !strings.HasPrefix(line, "* BYE upstream server not responding") {
+		t.Fatalf("expected BYE, got: %q", line)
+	}
+	if _, err := env.clientR.ReadString('\n'); err == nil {
+		t.Fatal("expected the connection to close")
+	}
+	if got := upstreamUnresponsiveTotal.Value(); got != before+1 {
+		t.Errorf("unresponsive counter = %v, want %v", got, before+1)
+	}
+}
+
+func TestQuietUpstreamWithoutCommandIsKept(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].ResponseTimeout = 100 * time.Millisecond
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	// No command is outstanding, so silence is expected.
+	time.Sleep(300 * time.Millisecond)
+	env.send(t, "A002 NOOP\r\n")
+	env.drainUpstream(t)
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("unexpected response: %q", line)
+	}
+}
+
+func TestResponseTimeoutIgnoresIdle(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].ResponseTimeout = 100 * time.Millisecond
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 IDLE\r\n")
+	env.expectUpstream(t, "IDLE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got: %q", line)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	env.send(t, "DONE\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("expected IDLE completion, got: %q", line)
+	}
+}
+
+func TestLostUpstreamClosesSession(t *testing.T) {
+	tests := []struct {
+		name string
+		bye  string // sent by the upstream before closing
+		want string
+	}{
+		{"dropped", "", "* BYE [UNAVAILABLE] upstream connection lost\r\n"},
+		{"upstream BYE", "* BYE shutting down\r\n", "* BYE shutting down\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan string, 10)
+			env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+				s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+					upClient, upServer := net.Pipe()
+					go func() {
+						defer upServer.Close()
+						sr := bufio.NewReader(upServer)
+						line, _ := sr.ReadString('\n')
+						received <- strings.TrimRight(line, "\r\n")
+						fmt.Fprint(upServer, "proxy0 OK LOGIN completed\r\n")
+						sr.ReadString('\n')
+						fmt.Fprint(upServer, tt.bye)
+					}()
+					return upClient, bufio.NewReader(upClient), nil
+				}
+			})
+			defer env.clientConn.Close()
+			env.received = received
+			env.login(t)
+
+			env.send(t, "A002 NOOP\r\n")
+			if line := env.readLine(t); line != tt.want {
+				t.Fatalf("expected %q, got: %q", tt.want, line)
+			}
+			if line, err := env.clientR.ReadString('\n'); err == nil {
+				t.Fatalf("session continued without an upstream, got: %q", line)
+			}
+		})
+	}
+}
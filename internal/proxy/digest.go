@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var blockedDigestsTotal = metrics.Default.NewCounter("imap_proxy_blocked_digests_total",
+	"Blocked command digests APPENDed to blocked_digest_folder, by result: ok or failed.", "result")
+
+// defaultBlockedDigestInterval is how often digests are sent when
+// blocked_digest_interval is unset.
+const defaultBlockedDigestInterval = 24 * time.Hour
+
+// digestTimeout bounds the delivery of one digest, from dial to LOGOUT.
+const digestTimeout = time.Minute
+
+const (
+	// maxDigestEntries is how many distinct commands and folders a digest
+	// lists per account; further ones are counted in the otherAttempts row.
+	maxDigestEntries = 100
+	// maxDigestFolder is how much of a folder name a digest keeps.
+	maxDigestFolder = 200
+)
+
+// otherAttempts collects the refused commands beyond maxDigestEntries.
+var otherAttempts = blockedAttempt{verb: "(other)"}
+
+// blockedAttempt is a kind of refused command in a digest: the command and
+// the folder it was aimed at, if known.
+type blockedAttempt struct {
+	verb   string
+	folder string
+}
+
+// blockedDigests collects the commands refused for accounts that have a
+// blocked_digest_folder, until their next digest is sent. The folders come
+// from clients, so each account keeps at most maxDigestEntries of them.
+// Attempts are only kept in memory and those not yet sent are lost when
+// the process exits.
+type blockedDigests struct {
+	mu       sync.Mutex
+	attempts map[string]map[blockedAttempt]int // by local user
+	since    map[string]time.Time              // first attempt not yet sent
+}
+
+func newBlockedDigests() *blockedDigests {
+	return &blockedDigests{attempts: make(map[string]map[blockedAttempt]int), since: make(map[string]time.Time)}
+}
+
+// record counts a refused command of user.
+func (d *blockedDigests) record(user string, a blockedAttempt, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := d.attempts[user]
+	if m == nil {
+		m = make(map[blockedAttempt]int)
+		d.attempts[user] = m
+		d.since[user] = at
+	}
+	if len(a.folder) > maxDigestFolder {
+		a.folder = strings.ToValidUTF8(a.folder[:maxDigestFolder], "") + "..."
+	}
+	addAttempt(m, a, 1)
+}
+
+// addAttempt adds n attempts of a to m, folding them into otherAttempts
+// once m holds maxDigestEntries other entries.
+func addAttempt(m map[blockedAttempt]int, a blockedAttempt, n int) {
+	entries := len(m)
+	if _, ok := m[otherAttempts]; ok {
+		entries--
+	}
+	if _, ok := m[a]; !ok && entries >= maxDigestEntries {
+		a = otherAttempts
+	}
+	m[a] += n
+}
+
+// pending returns how many accounts have attempts not yet sent.
+func (d *blockedDigests) pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.attempts)
+}
+
+// take removes and returns the attempts recorded for user and the time of
+// the first one.
+func (d *blockedDigests) take(user string) (map[blockedAttempt]int, time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, since := d.attempts[user], d.since[user]
+	delete(d.attempts, user)
+	delete(d.since, user)
+	return m, since
+}
+
+// restore puts back attempts taken for a digest that could not be sent, so
+// that the next digest includes them.
+func (d *blockedDigests) restore(user string, attempts map[blockedAttempt]int, since time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := d.attempts[user]
+	if m == nil {
+		d.attempts[user] = attempts
+		d.since[user] = since
+		return
+	}
+	for a, n := range attempts {
+		addAttempt(m, a, n)
+	}
+	if since.Before(d.since[user]) {
+		d.since[user] = since
+	}
+}
+
+// noteBlocked records cmd, just refused, for the account's next digest.
+// Commands on messages count against the selected folder.
+func (s *Session) noteBlocked(cmd imap.Command) {
+	if s.account.BlockedDigestFolder == "" {
+		return
+	}
+	a := blockedAttempt{verb: commandVerb(cmd), folder: s.selectedFolder}
+	if slices.Contains(mailboxArgs(cmd), 0) {
+		a.folder = extractCommandMailbox(cmd)
+	}
+	s.shared.digests.record(s.account.LocalUser, a, time.Now())
+}
+
+// runBlockedDigests sends every account with a blocked_digest_folder the
+// commands refused for it, every blocked_digest_interval, until stop is
+// closed. Accounts with nothing refused get no message.
+func (s *Server) runBlockedDigests(stop <-chan struct{}) {
+	interval := s.config.Server.BlockedDigestInterval
+	if interval <= 0 {
+		interval = defaultBlockedDigestInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			if n := s.shared.digests.pending(); n > 0 {
+				s.logger.Warn("blocked command digests not sent before shutdown are lost", "accounts", n)
+			}
+			return
+		case <-ticker.C:
+			s.sendBlockedDigests()
+		}
+	}
+}
+
+// sendBlockedDigests sends the pending digest of every account once.
+func (s *Server) sendBlockedDigests() {
+	for i := range s.config.Accounts {
+		acct := &s.config.Accounts[i]
+		if acct.BlockedDigestFolder == "" {
+			continue
+		}
+		attempts, since := s.shared.digests.take(acct.LocalUser)
+		if len(attempts) == 0 {
+			continue
+		}
+		msg := blockedDigestMessage(acct, attempts, since, time.Now())
+		if err := s.deliverDigest(acct, msg); err != nil {
+			s.logger.Warn("failed to deliver blocked command digest", "user", acct.LocalUser, "folder", acct.BlockedDigestFolder, "err", err)
+			blockedDigestsTotal.Inc("failed")
+			s.shared.digests.restore(acct.LocalUser, attempts, since)
+			continue
+		}
+		blockedDigestsTotal.Inc("ok")
+		s.logger.Info("delivered blocked command digest", "user", acct.LocalUser, "folder", acct.BlockedDigestFolder)
+	}
+}
+
+// deliverDigest APPENDs msg to the account's blocked_digest_folder on its
+// upstream. A missing folder is created first if the account sets
+// auto_create_folders.
+func (s *Server) deliverDigest(acct *config.AccountConfig, msg string) error {
+	release, err := s.shared.hosts.Acquire(acct)
+	if err != nil {
+		return err
+	}
+	defer release()
+	dial := s.digestDial
+	if dial == nil {
+		dial = DialUpstream
+	}
+	conn, r, err := dial(acct)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := LoginUpstream(conn, r, acct); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(digestTimeout))
+
+	folder := acct.BlockedDigestFolder
+	if acct.InboxAlias != "" && strings.EqualFold(folder, "INBOX") {
+		folder = acct.InboxAlias
+	}
+	appendDigest := func() error {
+		cmd := fmt.Sprintf("%s APPEND %s {%d}\r\n", loginTag, imap.Quote(folder), len(msg))
+		return upstreamCommand(conn, r, acct, "append", cmd, []string{msg})
+	}
+	err = appendDigest()
+	var refused *refusedError
+	if err != nil && acct.AutoCreateFolders && errors.As(err, &refused) && strings.Contains(strings.ToUpper(refused.msg), " NO [TRYCREATE]") {
+		if err := upstreamCommand(conn, r, acct, "create", loginTag+" CREATE "+imap.Quote(folder)+"\r\n", nil); err != nil {
+			foldersCreatedTotal.Inc("failed")
+			return err
+		}
+		foldersCreatedTotal.Inc("ok")
+		err = appendDigest()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(conn, loginTag+" LOGOUT\r\n")
+	return nil
+}
+
+// blockedDigestMessage formats attempts, refused for acct since since, as
+// a plain text message dated now, most frequent first.
+func blockedDigestMessage(acct *config.AccountConfig, attempts map[blockedAttempt]int, since, now time.Time) string {
+	keys := make([]blockedAttempt, 0, len(attempts))
+	total := 0
+	for a, n := range attempts {
+		keys = append(keys, a)
+		total += n
+	}
+	slices.SortFunc(keys, func(a, b blockedAttempt) int {
+		if attempts[a] != attempts[b] {
+			return attempts[b] - attempts[a]
+		}
+		if a.verb != b.verb {
+			return strings.Compare(a.verb, b.verb)
+		}
+		return strings.Compare(a.folder, b.folder)
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: IMAP proxy <postmaster@invalid>\r\n")
+	fmt.Fprintf(&b, "Subject: %d blocked commands for %s\r\n", total, sanitizeHeader(acct.LocalUser))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <blocked-digest.%d@imap-proxy.invalid>\r\n", now.UnixNano())
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "The proxy refused these commands for %s\r\nbetween %s and %s.\r\n\r\n", acct.LocalUser,
+		since.Format(time.RFC1123Z), now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "%7s  %-12s  %s\r\n", "Count", "Command", "Folder")
+	for _, a := range keys {
+		folder := a.folder
+		if folder == "" {
+			folder = "-"
+		}
+		fmt.Fprintf(&b, "%7d  %-12s  %s\r\n", attempts[a], a.verb, folder)
+	}
+	return b.String()
+}
+
+// sanitizeHeader keeps a header field value on one line.
+func sanitizeHeader(v string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestBlockedDigestsTakeRestore(t *testing.T) {
+	d := newBlockedDigests()
+	t0 := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	d.record("alice", blockedAttempt{"STORE", "INBOX"}, t0)
+	d.record("alice", blockedAttempt{"STORE", "INBOX"}, t0.Add(time.Minute))
+
+	attempts, since := d.take("alice")
+	if attempts[blockedAttempt{"STORE", "INBOX"}] != 2 || !since.Equal(t0) {
+		t.Fatalf("take = %v, %v", attempts, since)
+	}
+	if again, _ := d.take("alice"); len(again) != 0 {
+		t.Fatalf("second take = %v, want nothing", again)
+	}
+
+	// A digest that failed is merged with attempts recorded since.
+	d.record("alice", blockedAttempt{"DELETE", "Archive"}, t0.Add(time.Hour))
+	d.restore("alice", attempts, since)
+	attempts, since = d.take("alice")
+	if len(attempts) != 2 || attempts[blockedAttempt{"STORE", "INBOX"}] != 2 || !since.Equal(t0) {
+		t.Errorf("after restore: %v, %v", attempts, since)
+	}
+}
+
+func TestBlockedDigestsCapped(t *testing.T) {
+	d := newBlockedDigests()
+	now := time.Now()
+	for i := range maxDigestEntries + 50 {
+		d.record("alice", blockedAttempt{"DELETE", fmt.Sprintf("junk%d", i)}, now)
+	}
+	d.record("alice", blockedAttempt{"DELETE", "junk0"}, now)
+	d.record("alice", blockedAttempt{"DELETE", strings.Repeat("x", 10000)}, now)
+
+	attempts, since := d.take("alice")
+	if len(attempts) != maxDigestEntries+1 {
+		t.Fatalf("%d entries, want %d and the overflow row", len(attempts), maxDigestEntries)
+	}
+	if attempts[otherAttempts] != 51 || attempts[blockedAttempt{"DELETE", "junk0"}] != 2 {
+		t.Errorf("other = %d, junk0 = %d; want 51 and 2", attempts[otherAttempts], attempts[blockedAttempt{"DELETE", "junk0"}])
+	}
+
+	// Restoring a failed digest keeps the cap.
+	d.record("alice", blockedAttempt{"STORE", "INBOX"}, now)
+	d.restore("alice", attempts, since)
+	if again, _ := d.take("alice"); len(again) != maxDigestEntries+1 || again[otherAttempts] != 52 {
+		t.Errorf("after restore: %d entries, other = %d", len(again), again[otherAttempts])
+	}
+
+	d.record("bob", blockedAttempt{"DELETE", strings.Repeat("x", 10000)}, now)
+	for a := range d.attempts["bob"] {
+		if len(a.folder) != maxDigestFolder+3 {
+			t.Errorf("folder kept %d bytes, want it cut to %d", len(a.folder), maxDigestFolder)
+		}
+	}
+}
+
+func TestBlockedDigestMessage(t *testing.T) {
+	acct := &config.AccountConfig{LocalUser: "alice"}
+	since := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	msg := blockedDigestMessage(acct, map[blockedAttempt]int{
+		{"STORE", "INBOX"}:    3,
+		{"DELETE", "Archive"}: 1,
+		{"EXPUNGE", ""}:       3,
+	}, since, since.Add(24*time.Hour))
+
+	header, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header/body separator in %q", msg)
+	}
+	if !strings.Contains(header, "Subject: 7 blocked commands for alice\r\n") {
+		t.Errorf("header = %q", header)
+	}
+	want := "      3  EXPUNGE       -\r\n" +
+		"      3  STORE         INBOX\r\n" +
+		"      1  DELETE        Archive\r\n"
+	if !strings.HasSuffix(body, want) {
+		t.Errorf("body = %q, want it to end with %q", body, want)
+	}
+}
+
+// serveDigestUpstream is a fake upstream for digest delivery. It answers
+// the first APPEND with NO [TRYCREATE] when tryCreate is set, and sends
+// each appended message to received.
+func serveDigestUpstream(conn net.Conn, tryCreate bool, received chan<- string) {
+	defer conn.Close()
+	sr := bufio.NewReader(conn)
+	for {
+		line, err := sr.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		verb, _, _ := strings.Cut(rest, " ")
+		switch strings.ToUpper(verb) {
+		case "APPEND":
+			if tryCreate {
+				tryCreate = false
+				fmt.Fprintf(conn, "%s NO [TRYCREATE] no such mailbox\r\n", tag)
+				continue
+			}
+			var n int
+			fmt.Sscanf(rest[strings.LastIndex(rest, "{"):], "{%d}", &n)
+			fmt.Fprint(conn, "+ go ahead\r\n")
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(sr, msg); err != nil {
+				return
+			}
+			sr.ReadString('\n')
+			received <- string(msg)
+			fmt.Fprintf(conn, "%s OK APPEND completed\r\n", tag)
+		case "CREATE":
+			received <- strings.TrimRight(line, "\r\n")
+			fmt.Fprintf(conn, "%s OK CREATE completed\r\n", tag)
+		case "LOGOUT":
+			fmt.Fprintf(conn, "* BYE logging out\r\n%s OK LOGOUT completed\r\n", tag)
+			return
+		default:
+			fmt.Fprintf(conn, "%s OK completed\r\n", tag)
+		}
+	}
+}
+
+func TestSendBlockedDigests(t *testing.T) {
+	tests := []struct {
+		name       string
+		autoCreate bool
+		tryCreate  bool
+		wantCreate bool
+		wantOK     bool
+	}{
+		{name: "existing folder", wantOK: true},
+		{name: "created folder", autoCreate: true, tryCreate: true, wantCreate: true, wantOK: true},
+		{name: "missing folder", tryCreate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Accounts[0].WritableFolders = []string{"Proxy"}
+			cfg.Accounts[0].BlockedDigestFolder = "Proxy/Reports"
+			cfg.Accounts[0].AutoCreateFolders = tt.autoCreate
+			srv := NewServer(cfg, testLogger())
+			received := make(chan string, 10)
+			srv.digestDial = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+				client, server := net.Pipe()
+				go serveDigestUpstream(server, tt.tryCreate, received)
+				return client, bufio.NewReader(client), nil
+			}
+			srv.shared.digests.record("reader1", blockedAttempt{"STORE", "INBOX"}, time.Now())
+			before := blockedDigestsTotal.Value("ok")
+
+			srv.sendBlockedDigests()
+
+			if tt.wantCreate {
+				if got := <-received; got != `proxy0 CREATE "Proxy/Reports"` {
+					t.Errorf("create = %q", got)
+				}
+			}
+			pending, _ := srv.shared.digests.take("reader1")
+			if !tt.wantOK {
+				if len(pending) != 1 {
+					t.Errorf("undelivered attempts = %v, want them kept", pending)
+				}
+				return
+			}
+			select {
+			case msg := <-received:
+				if !strings.Contains(msg, "      1  STORE         INBOX\r\n") {
+					t.Errorf("digest = %q", msg)
+				}
+			default:
+				t.Fatal("no digest appended")
+			}
+			if len(pending) != 0 {
+				t.Errorf("delivered attempts still pending: %v", pending)
+			}
+			if got := blockedDigestsTotal.Value("ok") - before; got != 1 {
+				t.Errorf("delivered digests counted = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestBlockedCommandsNoted(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].AppendFolders = []string{"Reports"}
+	cfg.Accounts[0].BlockedDigestFolder = "Reports"
+	var sess *Session
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) { sess = s })
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 DELETE Archive\r\n")
+	env.readUntilTagged(t, "A002")
+	env.send(t, "A003 SELECT INBOX\r\n")
+	env.drainUpstream(t)
+	env.readUntilTagged(t, "A003")
+	env.send(t, "A004 EXPUNGE\r\n")
+	env.readUntilTagged(t, "A004")
+
+	attempts, _ := sess.shared.digests.take("reader1")
+	want := map[blockedAttempt]int{{"DELETE", "Archive"}: 1, {"EXPUNGE", "INBOX"}: 1}
+	if len(attempts) != len(want) {
+		t.Fatalf("attempts = %v, want %v", attempts, want)
+	}
+	for a, n := range want {
+		if attempts[a] != n {
+			t.Errorf("attempts[%v] = %d, want %d", a, attempts[a], n)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+var dnsLookupsTotal = metrics.Default.NewCounter("imap_proxy_dns_lookups_total",
+	"Upstream host name lookups, by result: resolved, stale (failed, cached addresses used) or failed.", "result")
+
+// hostLookupFunc resolves a host name to its addresses, returning them
+// along with the smallest record TTL (zero if unknown).
+type hostLookupFunc func(ctx context.Context, host string) ([]string, time.Duration, error)
+
+// hostCache caches upstream address lookups for their TTL, so reconnect
+// storms do not hammer the resolver. Like srvCache, it keeps using an
+// expired entry if a refresh fails, so a DNS flap does not fail dials to
+// an upstream that is still reachable.
+type hostCache struct {
+	lookup hostLookupFunc
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]hostEntry
+}
+
+type hostEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// upstreamHosts is the process-wide cache used by dialUpstream.
+var upstreamHosts = newHostCache(lookupHostWithTTL)
+
+func newHostCache(lookup hostLookupFunc) *hostCache {
+	return &hostCache{lookup: lookup, now: time.Now, entries: make(map[string]hostEntry)}
+}
+
+// forget removes the addresses cached for host and reports whether there
+// were any.
+func (c *hostCache) forget(host string) bool {
+	key := strings.ToLower(host)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	delete(c.entries, key)
+	return ok
+}
+
+// resolve returns the addresses of host. IP addresses are returned as they
+// are.
+func (c *hostCache) resolve(host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	key := strings.ToLower(host)
+	now := c.now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	addrs, ttl, err := c.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses")
+	}
+	if err != nil {
+		if ok {
+			dnsLookupsTotal.Inc("stale")
+			return e.addrs, nil
+		}
+		dnsLookupsTotal.Inc("failed")
+		return nil, fmt.Errorf("lookup %s: %w", host, err)
+	}
+	dnsLookupsTotal.Inc("resolved")
+
+	if ttl <= 0 {
+		ttl = dnsDefaultTTL
+	}
+	e = hostEntry{addrs: addrs, expires: now.Add(max(ttl, dnsMinTTL))}
+	c.mu.Lock()
+	c.entries[key] = e
+	c.mu.Unlock()
+	return e.addrs, nil
+}
+
+// lookupHostWithTTL resolves host with the pure-Go resolver and recovers
+// the TTL of its A and AAAA records, as lookupSRVWithTTL does for SRV.
+func lookupHostWithTTL(ctx context.Context, host string) ([]string, time.Duration, error) {
+	rec := &dnsRecorder{}
+	addrs, err := rec.resolver().LookupHost(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return addrs, rec.minTTL(dnsTypeA, dnsTypeAAAA), nil
+}
+
+// dialPinned dials acct's upstream, connecting to the session's pinned
+// address, if any, instead of resolving the host name again. The
+// connection is recorded if server.record.upstream_dir applies to acct.
+func (s *Session) dialPinned(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+	return dialUpstreamWrapped(acct, nil, s.pinnedIP, s.upstreamRecorder(acct))
+}
+
+// remoteIP returns the IP address conn is connected to, or "" if it is
+// not a TCP connection.
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestHostCache(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	calls := 0
+	var fail bool
+	c := newHostCache(func(_ context.Context, host string) ([]string, time.Duration, error) {
+		calls++
+		if fail {
+			return nil, 0, errors.New("dns down")
+		}
+		if host != "Mail.Example.com" {
+			t.Errorf("lookup(%q)", host)
+		}
+		return []string{fmt.Sprintf("192.0.2.%d", calls), "2001:db8::1"}, 2 * time.Minute, nil
+	})
+	c.now = func() time.Time { return now }
+
+	resolve := func(wantFirst string, wantCalls int) {
+		t.Helper()
+		addrs, err := c.resolve("Mail.Example.com")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if len(addrs) != 2 || addrs[0] != wantFirst {
+			t.Errorf("resolve = %v, want %s first", addrs, wantFirst)
+		}
+		if calls != wantCalls {
+			t.Errorf("lookups = %d, want %d", calls, wantCalls)
+		}
+	}
+
+	resolve("192.0.2.1", 1)
+	now = now.Add(time.Minute)
+	resolve("192.0.2.1", 1) // cached within the TTL
+	now = now.Add(2 * time.Minute)
+	resolve("192.0.2.2", 2) // expired, looked up again
+
+	// A failed refresh keeps serving the expired entry.
+	fail = true
+	now = now.Add(time.Hour)
+	resolve("192.0.2.2", 3)
+
+	// Without a cached entry the failure is returned.
+	if _, err := c.resolve("other.example"); err == nil {
+		t.Error("resolve(other.example) succeeded, want error")
+	}
+}
+
+func TestHostCacheTTLBounds(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	var ttl time.Duration
+	calls := 0
+	c := newHostCache(func(context.Context, string) ([]string, time.Duration, error) {
+		calls++
+		return []string{"192.0.2.1"}, ttl, nil
+	})
+	c.now = func() time.Time { return now }
+
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		valid time.Duration
+	}{
+		{"short ttl uses minimum", 1 * time.Second, dnsMinTTL},
+		{"unknown ttl uses default", 0, dnsDefaultTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl = tt.ttl
+			c.entries = make(map[string]hostEntry)
+			calls = 0
+			c.resolve("mail.example.com")
+			now = now.Add(tt.valid - time.Second)
+			c.resolve("mail.example.com")
+			if calls != 1 {
+				t.Errorf("lookups before expiry = %d, want 1", calls)
+			}
+			now = now.Add(2 * time.Second)
+			c.resolve("mail.example.com")
+			if calls != 2 {
+				t.Errorf("lookups after expiry = %d, want 2", calls)
+			}
+		})
+	}
+}
+
+func TestHostCacheIPLiteral(t *testing.T) {
+	c := newHostCache(func(context.Context, string) ([]string, time.Duration, error) {
+		t.Error("IP address looked up")
+		return nil, 0, errors.New("unexpected")
+	})
+	for _, ip := range []string{"127.0.0.1", "::1"} {
+		addrs, err := c.resolve(ip)
+		if err != nil || !slices.Equal(addrs, []string{ip}) {
+			t.Errorf("resolve(%q) = %v, %v", ip, addrs, err)
+		}
+	}
+}
+
+func TestHostCacheNoAddresses(t *testing.T) {
+	c := newHostCache(func(context.Context, string) ([]string, time.Duration, error) {
+		return nil, time.Minute, nil
+	})
+	if _, err := c.resolve("mail.example.com"); err == nil {
+		t.Error("resolve with no addresses succeeded, want error")
+	}
+}
+
+// listenGreeting accepts connections on a local listener and greets each.
+func listenGreeting(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "* OK ready\r\n")
+			conn.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialUpstreamResolvesThroughCache(t *testing.T) {
+	port := listenGreeting(t)
+	orig := upstreamHosts
+	t.Cleanup(func() { upstreamHosts = orig })
+	var looked []string
+	upstreamHosts = newHostCache(func(_ context.Context, host string) ([]string, time.Duration, error) {
+		looked = append(looked, host)
+		// The first address refuses connections, so the second is tried.
+		return []string{"::1", "127.0.0.1"}, time.Minute, nil
+	})
+	acct := &config.AccountConfig{RemoteHost: "mail.test", RemotePort: port, RemoteAllowPlaintext: true}
+	for range 2 {
+		conn, _, err := dialUpstream(acct, nil, "")
+		if err != nil {
+			t.Fatalf("dialUpstream: %v", err)
+		}
+		if got := remoteIP(conn); got != "127.0.0.1" {
+			t.Errorf("connected to %s, want 127.0.0.1", got)
+		}
+		conn.Close()
+	}
+	if !slices.Equal(looked, []string{"mail.test"}) {
+		t.Errorf("lookups = %v, want one for mail.test", looked)
+	}
+}
+
+func TestDialUpstreamPinnedIP(t *testing.T) {
+	port := listenGreeting(t)
+	orig := upstreamHosts
+	t.Cleanup(func() { upstreamHosts = orig })
+	upstreamHosts = newHostCache(func(context.Context, string) ([]string, time.Duration, error) {
+		t.Error("pinned dial looked up the host name")
+		return nil, 0, errors.New("unexpected")
+	})
+	acct := &config.AccountConfig{RemoteHost: "mail.test", RemotePort: port, RemoteAllowPlaintext: true, PinUpstreamIP: true}
+	s := &Session{pinnedIP: "127.0.0.1", config: &config.Config{}}
+	conn, _, err := s.dialPinned(acct)
+	if err != nil {
+		t.Fatalf("dialPinned: %v", err)
+	}
+	conn.Close()
+}
+
+func TestRemoteIP(t *testing.T) {
+	port := listenGreeting(t)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if got := remoteIP(conn); got != "127.0.0.1" {
+		t.Errorf("remoteIP(tcp) = %q, want 127.0.0.1", got)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if got := remoteIP(a); got != "" {
+		t.Errorf("remoteIP(pipe) = %q, want empty", got)
+	}
+}
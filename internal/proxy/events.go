@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/imap"
+)
+
+// EventPublisher publishes a message on a subject without blocking.
+// *nats.Publisher implements it.
+type EventPublisher interface {
+	Publish(subject string, data []byte)
+}
+
+// SetEventPublisher publishes session and new-mail events through p, on
+// subjects starting with prefix. It must be called before Serve.
+func (s *Server) SetEventPublisher(p EventPublisher, prefix string) {
+	s.shared.events = &eventBus{publisher: p, prefix: prefix}
+}
+
+// eventBus is where a Server's sessions publish their events.
+type eventBus struct {
+	publisher EventPublisher
+	prefix    string
+}
+
+// Published event types and the subjects, below the prefix, they use.
+const (
+	eventSessionStart = "session_start"
+	eventSessionEnd   = "session_end"
+	eventNewMail      = "new_mail"
+)
+
+var eventSubjects = map[string]string{
+	eventSessionStart: "session.start",
+	eventSessionEnd:   "session.end",
+	eventNewMail:      "mail.new",
+}
+
+// busEvent is the JSON body of a published event. Folder, Count and Total
+// describe new mail: Count messages arrived in Folder, which now holds
+// Total. DurationSeconds is set on session_end.
+type busEvent struct {
+	Time            time.Time `json:"time"`
+	Type            string    `json:"type"`
+	User            string    `json:"user"`
+	ClientIP        string    `json:"client_ip,omitempty"`
+	Folder          string    `json:"folder,omitempty"`
+	Count           int       `json:"count,omitempty"`
+	Total           int       `json:"total,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty"`
+}
+
+// publish sends ev for the logged-in account, if events are enabled.
+func (s *Session) publish(ev busEvent) {
+	bus := s.shared.events
+	if bus == nil || s.account == nil {
+		return
+	}
+	ev.Time = time.Now()
+	ev.User = s.account.LocalUser
+	ev.ClientIP = s.clientIP
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	bus.publisher.Publish(bus.prefix+"."+eventSubjects[ev.Type], b)
+}
+
+// openingMailbox is a forwarded SELECT or EXAMINE awaiting its tagged
+// response.
+type openingMailbox struct {
+	tag    string
+	folder string
+}
+
+// noteMailboxOpen records a SELECT or EXAMINE so that trackNewMail can
+// tell the mailbox's initial EXISTS from new mail. It must be called
+// before the command is forwarded.
+func (s *Session) noteMailboxOpen(cmd imap.Command) {
+	if s.shared.events == nil || (cmd.Verb != "SELECT" && cmd.Verb != "EXAMINE") {
+		return
+	}
+	s.opening.Store(&openingMailbox{tag: cmd.Tag, folder: extractCommandMailbox(cmd)})
+}
+
+// trackNewMail publishes a new_mail event when an EXISTS response grows
+// the open mailbox. Called from the upstream→client goroutine for every
+// response line, before s.mailbox sees it.
+func (s *Session) trackNewMail(line string) {
+	if s.shared.events == nil {
+		return
+	}
+	if o := s.opening.Load(); o != nil {
+		// Until the mailbox is open, EXISTS reports its size, not arrivals.
+		if strings.HasPrefix(line, o.tag+" ") {
+			s.opening.CompareAndSwap(o, nil)
+			s.openFolder = ""
+			if _, status, _ := strings.Cut(line, " "); strings.HasPrefix(strings.ToUpper(status), "OK") {
+				s.openFolder = o.folder
+			}
+		}
+		return
+	}
+	if n, kind, ok := imap.ParseMessageData([]byte(line)); ok && kind == "EXISTS" {
+		s.newMail(n)
+	}
+}
+
+// newMail publishes a new_mail event if the open mailbox grew to n
+// messages.
+func (s *Session) newMail(n int) {
+	if s.openFolder == "" || n <= s.mailbox.exists {
+		return
+	}
+	s.publish(busEvent{Type: eventNewMail, Folder: s.openFolder, Count: n - s.mailbox.exists, Total: n})
+}
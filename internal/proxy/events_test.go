@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+type publishedEvent struct {
+	subject string
+	event   busEvent
+}
+
+// fakePublisher records published events.
+type fakePublisher chan publishedEvent
+
+func (p fakePublisher) Publish(subject string, data []byte) {
+	var ev busEvent
+	json.Unmarshal(data, &ev)
+	p <- publishedEvent{subject, ev}
+}
+
+func (p fakePublisher) next(t *testing.T) publishedEvent {
+	t.Helper()
+	select {
+	case ev := <-p:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event published")
+		return publishedEvent{}
+	}
+}
+
+// newEventsEnv starts a session publishing to pub whose upstream reports
+// 3 messages when a mailbox is opened and answers every NOOP with the given
+// untagged lines.
+func newEventsEnv(t *testing.T, pub fakePublisher, untagged ...string) *integrationEnv {
+	t.Helper()
+	received := make(chan string, 100)
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+		s.shared.events = &eventBus{publisher: pub, prefix: "test"}
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					received <- line
+					tag, rest, _ := strings.Cut(line, " ")
+					verb, _, _ := strings.Cut(rest, " ")
+					switch verb {
+					case "SELECT", "EXAMINE":
+						fmt.Fprint(upServer, "* 3 EXISTS\r\n")
+					case "NOOP":
+						for _, u := range untagged {
+							fmt.Fprint(upServer, u)
+						}
+					case "LOGOUT":
+						fmt.Fprintf(upServer, "* BYE logging out\r\n%s OK completed\r\n", tag)
+						return
+					}
+					fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	return env
+}
+
+func TestEventsPublished(t *testing.T) {
+	pub := make(fakePublisher, 10)
+	env := newEventsEnv(t, pub, "* 5 EXISTS\r\n")
+	defer env.clientConn.Close()
+	env.login(t)
+
+	ev := pub.next(t)
+	if ev.subject != "test.session.start" || ev.event.Type != eventSessionStart || ev.event.User != "reader1" {
+		t.Fatalf("first event = %+v, want session_start for reader1", ev)
+	}
+
+	// The EXISTS in the SELECT response is the mailbox size, not new mail.
+	env.send(t, "A002 SELECT INBOX\r\n")
+	env.readUntilTagged(t, "A002")
+	env.send(t, "A003 NOOP\r\n")
+	env.readUntilTagged(t, "A003")
+	ev = pub.next(t)
+	if ev.subject != "test.mail.new" || ev.event.Folder != "INBOX" || ev.event.Count != 2 || ev.event.Total != 5 {
+		t.Fatalf("event = %+v, want new_mail of 2 in INBOX, 5 total", ev)
+	}
+
+	env.send(t, "A004 LOGOUT\r\n")
+	env.readUntilTagged(t, "A004")
+	if ev = pub.next(t); ev.subject != "test.session.end" || ev.event.Type != eventSessionEnd {
+		t.Fatalf("event = %+v, want session_end", ev)
+	}
+}
+
+func TestEventsNoNewMailWithoutGrowth(t *testing.T) {
+	pub := make(fakePublisher, 10)
+	env := newEventsEnv(t, pub, "* 3 EXISTS\r\n")
+	defer env.clientConn.Close()
+	env.login(t)
+	pub.next(t) // session_start
+
+	// Untagged data outside a selected mailbox is not new mail either.
+	env.send(t, "A002 NOOP\r\n")
+	env.readUntilTagged(t, "A002")
+	env.send(t, "A003 SELECT INBOX\r\n")
+	env.readUntilTagged(t, "A003")
+	env.send(t, "A004 NOOP\r\n")
+	env.readUntilTagged(t, "A004")
+	select {
+	case ev := <-pub:
+		t.Fatalf("unexpected event %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
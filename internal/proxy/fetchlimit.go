@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var fetchesLimitedTotal = metrics.Default.NewCounter("imap_proxy_fetch_limited_total",
+	"FETCH commands for more messages than max_fetch_messages, by action taken.", "action")
+
+// contentSections are the FETCH items, up to their section, that download
+// message content.
+var contentSections = []string{"BODY[", "BODY.PEEK[", "BINARY[", "BINARY.PEEK["}
+
+// fetchesContent reports whether FETCH items download message content, as
+// opposed to flags, envelopes or header fields, which clients routinely
+// fetch for a whole mailbox.
+func fetchesContent(items string) bool {
+	tokens := strings.FieldsFunc(strings.ToUpper(items), func(r rune) bool {
+		return r == ' ' || r == '(' || r == ')' || r == '\r' || r == '\n'
+	})
+	for _, tok := range tokens {
+		if tok == "RFC822" || tok == "RFC822.TEXT" {
+			return true
+		}
+		for _, prefix := range contentSections {
+			if section, ok := strings.CutPrefix(tok, prefix); ok {
+				section, _, _ = strings.Cut(section, "]")
+				if !strings.Contains(section, "HEADER") && !strings.HasSuffix(section, "MIME") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// setSize returns the number of messages a set can name at most. It
+// reports false if the set refers to "*", whose value the proxy does not
+// know.
+func setSize(set imap.SeqSet) (uint64, bool) {
+	var n uint64
+	for _, r := range set {
+		if r.Start == 0 || r.Stop == 0 {
+			return 0, false
+		}
+		n += uint64(max(r.Start, r.Stop)-min(r.Start, r.Stop)) + 1
+	}
+	return n, true
+}
+
+// fetchCommand is a FETCH or UID FETCH of message content.
+type fetchCommand struct {
+	tag   string
+	verb  string // "FETCH" or "UID FETCH" as sent by the client
+	uid   bool
+	set   string
+	items string // including the line ending
+}
+
+// parseContentFetch returns cmd as a fetchCommand if it is a FETCH of
+// message content without literals.
+func parseContentFetch(cmd imap.Command, line []byte) (fetchCommand, bool) {
+	uid := cmd.Verb == "UID"
+	if cmd.Verb != "FETCH" && !(uid && cmd.SubVerb == "FETCH") {
+		return fetchCommand{}, false
+	}
+	if _, _, hasLiteral := imap.ParseLiteral(line); hasLiteral {
+		return fetchCommand{}, false
+	}
+	fields := 2
+	if uid {
+		fields = 3
+	}
+	parts := strings.SplitN(string(line), " ", fields+2)
+	if len(parts) < fields+2 || !imap.IsSeqSet(parts[fields]) || !fetchesContent(parts[fields+1]) {
+		return fetchCommand{}, false
+	}
+	return fetchCommand{
+		tag:   cmd.Tag,
+		verb:  strings.Join(parts[1:fields], " "),
+		uid:   uid,
+		set:   parts[fields],
+		items: parts[fields+1],
+	}, true
+}
+
+// searchSet returns the messages in set, or in set and matching the
+// extra search keys, as message numbers or UIDs like the FETCH.
+func (s *Session) searchSet(f fetchCommand, set, keys string) ([]uint32, error) {
+	criteria := set
+	if f.uid {
+		criteria = "UID " + set
+	}
+	if keys != "" {
+		criteria += " " + keys
+	}
+	nums, err := s.search(f.uid, criteria)
+	slices.Sort(nums)
+	return nums, err
+}
+
+// forwardLimited forwards a command upstream, enforcing the account's
+// max_fetch_messages and max_message_size_mb on FETCHes of message
+// content. Sets that may exceed the message limit are resolved with an
+// internal SEARCH first, so sparse UID ranges are not refused needlessly.
+func (s *Session) forwardLimited(cmd imap.Command, line []byte) error {
+	f, ok := parseContentFetch(cmd, line)
+	if !ok {
+		return s.forwardWithLiterals(line)
+	}
+	sets, err := s.fetchBatches(f)
+	if err != nil || len(sets) == 0 {
+		return err
+	}
+	if len(sets) == 1 && s.account.MaxMessageSize() <= 0 {
+		return s.forwardWithLiterals(line)
+	}
+	for _, set := range sets {
+		status, err := s.fetchSized(f, set)
+		if err != nil {
+			return err
+		}
+		if status != "" {
+			return s.writeClient(f.tag + " " + status)
+		}
+	}
+	return s.writeClient(fmt.Sprintf("%s OK %s completed\r\n", f.tag, f.verb))
+}
+
+// fetchBatches applies max_fetch_messages to f. It returns the sets to
+// fetch one after the other, or none if it refused the FETCH itself.
+func (s *Session) fetchBatches(f fetchCommand) ([]string, error) {
+	limit := s.account.MaxFetchMessages
+	if limit <= 0 {
+		return []string{f.set}, nil
+	}
+	set, err := imap.ParseSeqSet(f.set)
+	if err != nil {
+		return []string{f.set}, nil
+	}
+	if n, bounded := setSize(set); bounded && n <= uint64(limit) {
+		return []string{f.set}, nil
+	}
+	nums, err := s.searchSet(f, f.set, "")
+	if err != nil {
+		// Let the upstream answer the FETCH itself.
+		s.logger.Debug("failed to size FETCH", "err", err)
+		return []string{f.set}, nil
+	}
+	if len(nums) <= limit {
+		return []string{f.set}, nil
+	}
+
+	s.logger.Warn("FETCH over message limit", "verb", f.verb, "messages", len(nums), "limit", limit,
+		"action", s.account.FetchLimitAction)
+	fetchesLimitedTotal.Inc(s.account.FetchLimitAction)
+	if s.account.FetchLimitAction != config.FetchLimitChunk {
+		return nil, s.writeClient(fmt.Sprintf("%s NO [LIMIT] %s would return %d messages, the limit is %d\r\n",
+			f.tag, f.verb, len(nums), limit))
+	}
+	var sets []string
+	for batch := range slices.Chunk(nums, limit) {
+		sets = append(sets, imap.FormatSeqSet(batch))
+	}
+	return sets, nil
+}
+
+// fetchItems runs f for set under an internal tag. It returns the status
+// to complete the client's command with if the upstream did not answer OK.
+func (s *Session) fetchItems(f fetchCommand, set, items string) (string, error) {
+	tag := s.nextInternalTag()
+	_, completion, err := s.roundTrip(tag, fmt.Appendf(nil, "%s %s %s %s", tag, f.verb, set, items))
+	if err != nil || completedOK(tag, completion) {
+		return "", err
+	}
+	return strings.TrimPrefix(completion, tag+" "), nil
+}
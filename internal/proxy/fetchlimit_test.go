@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+)
+
+func TestFetchesContent(t *testing.T) {
+	tests := []struct {
+		items string
+		want  bool
+	}{
+		{"(FLAGS UID)\r\n", false},
+		{"FULL\r\n", false},
+		{"(UID BODY.PEEK[HEADER.FIELDS (FROM SUBJECT)])\r\n", false},
+		{"(BODY.PEEK[HEADER] RFC822.SIZE)\r\n", false},
+		{"(BODY[1.MIME])\r\n", false},
+		{"BODY[]\r\n", true},
+		{"(UID body.peek[])\r\n", true},
+		{"(BODY[TEXT]<0.100>)\r\n", true},
+		{"(BINARY.PEEK[2])\r\n", true},
+		{"RFC822\r\n", true},
+		{"(RFC822.TEXT)\r\n", true},
+	}
+	for _, tt := range tests {
+		if got := fetchesContent(tt.items); got != tt.want {
+			t.Errorf("fetchesContent(%q) = %v, want %v", tt.items, got, tt.want)
+		}
+	}
+}
+
+func TestSetSize(t *testing.T) {
+	tests := []struct {
+		set     string
+		want    uint64
+		bounded bool
+	}{
+		{"7", 1, true},
+		{"1:10,20", 11, true},
+		{"10:1", 10, true},
+		{"1:*", 0, false},
+		{"*", 0, false},
+	}
+	for _, tt := range tests {
+		set, err := imap.ParseSeqSet(tt.set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, bounded := setSize(set); got != tt.want || bounded != tt.bounded {
+			t.Errorf("setSize(%q) = %d, %v; want %d, %v", tt.set, got, bounded, tt.want, tt.bounded)
+		}
+	}
+}
+
+func TestFetchLimitRejected(t *testing.T) {
+	env := newViewEnv(t, func(acct *config.AccountConfig) {
+		acct.MaxFetchMessages = 2
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 FETCH 1:* (FLAGS)\r\n")
+	env.expectUpstream(t, "A002 FETCH 1:* (FLAGS)")
+	env.readUntilTagged(t, "A002")
+
+	env.send(t, "A003 FETCH 4:5 BODY.PEEK[]\r\n")
+	env.expectUpstream(t, "A003 FETCH 4:5")
+	env.readUntilTagged(t, "A003")
+
+	env.send(t, "A004 FETCH 1:* BODY.PEEK[]\r\n")
+	env.expectUpstream(t, "SEARCH 1:*")
+	if line := env.readLine(t); line != "A004 NO [LIMIT] FETCH would return 5 messages, the limit is 2\r\n" {
+		t.Fatalf("got %q, want the limit refusal", line)
+	}
+	env.noUpstream(t)
+}
+
+func TestFetchLimitChunked(t *testing.T) {
+	env := newViewEnv(t, func(acct *config.AccountConfig) {
+		acct.MaxFetchMessages = 2
+		acct.FetchLimitAction = config.FetchLimitChunk
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 FETCH 1:* (UID BODY.PEEK[])\r\n")
+	lines := env.readUntilTagged(t, "A002")
+	want := []string{
+		"* 1 FETCH (UID 10)\r\n", "* 2 FETCH (UID 11)\r\n", "* 3 FETCH (UID 12)\r\n",
+		"* 4 FETCH (UID 13)\r\n", "* 5 FETCH (UID 14)\r\n", "A002 OK FETCH completed\r\n",
+	}
+	if strings.Join(lines, "") != strings.Join(want, "") {
+		t.Fatalf("FETCH response = %q, want %q", lines, want)
+	}
+	env.expectUpstream(t, "SEARCH 1:*")
+	env.expectUpstream(t, "FETCH 1:2 (UID BODY.PEEK[])")
+	env.expectUpstream(t, "FETCH 3:4 (UID BODY.PEEK[])")
+	env.expectUpstream(t, "FETCH 5 (UID BODY.PEEK[])")
+	env.noUpstream(t)
+}
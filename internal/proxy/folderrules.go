@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+var folderRuleHitsTotal = metrics.Default.NewCounter("imap_proxy_folder_rule_hits_total",
+	"Matches of allowed_folders, blocked_folders, writable_folders and append_folders entries, by where they were applied (list, select, write).",
+	"account", "list", "rule", "use")
+
+// Uses of folder rules, for folderRuleHitsTotal.
+const (
+	ruleUseList   = "list"   // LIST/LSUB response filtering
+	ruleUseSelect = "select" // SELECT, EXAMINE, STATUS and APPEND access checks
+	ruleUseWrite  = "write"  // writable_folders and append_folders overrides
+)
+
+// initFolderRuleMetrics exports every configured folder rule with a zero
+// count, so that rules which never match show up as such.
+func initFolderRuleMetrics(cfg *config.Config) {
+	for i := range cfg.Accounts {
+		acct := &cfg.Accounts[i]
+		list, rules := folderFilter(acct)
+		for _, rule := range rules {
+			folderRuleHitsTotal.Add(0, acct.LocalUser, list, rule, ruleUseList)
+			folderRuleHitsTotal.Add(0, acct.LocalUser, list, rule, ruleUseSelect)
+		}
+		for _, rule := range acct.WritableFolders {
+			folderRuleHitsTotal.Add(0, acct.LocalUser, "writable", rule, ruleUseWrite)
+		}
+		for _, rule := range acct.AppendFolders {
+			folderRuleHitsTotal.Add(0, acct.LocalUser, "append", rule, ruleUseWrite)
+		}
+	}
+}
+
+// folderFilter returns the name and entries of the account's folder
+// filter list; config validation allows at most one of them.
+func folderFilter(acct *config.AccountConfig) (list string, rules []string) {
+	if len(acct.AllowedFolders) > 0 {
+		return "allowed", acct.AllowedFolders
+	}
+	return "blocked", acct.BlockedFolders
+}
+
+// folderVisible reports whether the folder filter lets the client see
+// mailbox, counting the rule that decided it.
+func (s *Session) folderVisible(mailbox, use string) bool {
+	list, rules := folderFilter(s.account)
+	if rule, ok := config.MatchingFolderRule(mailbox, rules); ok {
+		folderRuleHitsTotal.Inc(s.account.LocalUser, list, rule, use)
+	}
+	return s.account.FolderAllowed(mailbox)
+}
+
+// folderWritable reports whether mailbox is one of the account's writable
+// folders, counting the rule that allowed it.
+func (s *Session) folderWritable(mailbox string) bool {
+	rule, ok := config.MatchingFolderRule(mailbox, s.account.WritableFolders)
+	if ok {
+		folderRuleHitsTotal.Inc(s.account.LocalUser, "writable", rule, ruleUseWrite)
+	}
+	return ok
+}
+
+// folderAppendable reports whether the client may APPEND to mailbox: it is
+// a writable folder or one of the account's append-only folders. The rule
+// that allowed it is counted.
+func (s *Session) folderAppendable(mailbox string) bool {
+	if s.folderWritable(mailbox) {
+		return true
+	}
+	rule, ok := config.MatchingFolderRule(mailbox, s.account.AppendFolders)
+	if ok {
+		folderRuleHitsTotal.Inc(s.account.LocalUser, "append", rule, ruleUseWrite)
+	}
+	return ok
+}
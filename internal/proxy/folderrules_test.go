@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+func TestFolderRuleHits(t *testing.T) {
+	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
+		a.AllowedFolders = []string{"INBOX", "Archive", "Archive/2024"}
+		a.WritableFolders = []string{"Archive"}
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	hits := func(list, rule, use string) float64 {
+		return folderRuleHitsTotal.Value("reader1", list, rule, use)
+	}
+	type series struct{ list, rule, use string }
+	tests := []struct {
+		s    series
+		want float64
+	}{
+		{series{"allowed", "INBOX", ruleUseList}, 1},
+		{series{"allowed", "Archive", ruleUseList}, 2}, // Archive and Archive/2024
+		{series{"allowed", "Archive/2024", ruleUseList}, 0},
+		{series{"allowed", "Archive", ruleUseSelect}, 1},
+		{series{"writable", "Archive", ruleUseWrite}, 1},
+	}
+	before := make(map[series]float64)
+	for _, tt := range tests {
+		before[tt.s] = hits(tt.s.list, tt.s.rule, tt.s.use)
+	}
+
+	env.send(t, "A002 LIST \"\" *\r\n")
+	env.drainUpstream(t)
+	env.readUntilTagged(t, "A002")
+	env.send(t, "A003 SELECT Archive\r\n")
+	env.expectUpstream(t, "A003 SELECT Archive")
+	env.readUntilTagged(t, "A003")
+
+	for _, tt := range tests {
+		if got := hits(tt.s.list, tt.s.rule, tt.s.use) - before[tt.s]; got != tt.want {
+			t.Errorf("hits %v = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestInitFolderRuleMetrics(t *testing.T) {
+	cfg := &config.Config{Accounts: []config.AccountConfig{{
+		LocalUser:       "rules-init",
+		BlockedFolders:  []string{"Spam"},
+		WritableFolders: []string{"Drafts"},
+	}}}
+	initFolderRuleMetrics(cfg)
+
+	var b strings.Builder
+	metrics.Default.WriteText(&b)
+	for _, want := range []string{
+		`imap_proxy_folder_rule_hits_total{account="rules-init",list="blocked",rule="Spam",use="list"} 0`,
+		`imap_proxy_folder_rule_hits_total{account="rules-init",list="blocked",rule="Spam",use="select"} 0`,
+		`imap_proxy_folder_rule_hits_total{account="rules-init",list="writable",rule="Drafts",use="write"} 0`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+// GatewayError is a gateway request refused by LoginGateway or by the
+// account's download quota, with the HTTP status to answer it with.
+type GatewayError struct {
+	Status int
+	Text   string
+}
+
+func (e *GatewayError) Error() string { return e.Text }
+
+// Write answers the request with the error. A 401 carries a Basic
+// authentication challenge.
+func (e *GatewayError) Write(w http.ResponseWriter) {
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="imap-proxy"`)
+	}
+	http.Error(w, e.Text, e.Status)
+}
+
+// ErrQuotaExceeded refuses a download by an account that has used up its
+// daily download quota.
+var ErrQuotaExceeded = &GatewayError{http.StatusTooManyRequests, "daily download quota exceeded"}
+
+var errUnauthorized = &GatewayError{http.StatusUnauthorized, "unauthorized"}
+
+// GatewayLogin is an HTTP gateway request logged in as an account. It
+// holds one of the account's sessions, counted against max_sessions and
+// max_connections like an IMAP session, until Close.
+type GatewayLogin struct {
+	Account *config.AccountConfig
+
+	srv      *Server
+	client   *loginClient
+	upstream string // circuit breaker key
+	release  func()
+	reported bool // the upstream attempt was reported to the breaker
+	usage    usageTracker
+}
+
+// LoginGateway logs in the client of an HTTP gateway with the request's
+// basic credentials. via names the gateway, such as "rest", in audit
+// events and logs. The request goes through the same checks as an IMAP
+// LOGIN: the source IP's ban and the server's network and country lists,
+// the account's lockout, TLS, network and country rules, failure
+// accounting toward bans and lockout, honeypot accounts, the upstream's
+// circuit breaker and the session limits. A failed login is answered
+// after auth_failure_delay. The upstream connection takes its slot under
+// max_connections_per_host from HostLimits, like every other one.
+//
+// On success the caller must report its upstream connection attempt with
+// Connected, and call Close when done with the request.
+func (s *Server) LoginGateway(r *http.Request, via string) (*GatewayLogin, *GatewayError) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	logger := s.logger.With("via", via)
+	var (
+		country  string
+		resolved bool
+	)
+	c := &loginClient{
+		config: s.config,
+		shared: s.shared,
+		logger: logger,
+		ip:     ip,
+		tls:    r.TLS != nil,
+		country: func() string {
+			if !resolved {
+				country, resolved = s.shared.lookupCountry(ip), true
+			}
+			return country
+		},
+	}
+	c.record = func(ev audit.Event) {
+		ev.ClientIP = ip
+		if ev.Fields == nil {
+			ev.Fields = make(map[string]string, 2)
+		}
+		ev.Fields["via"] = via
+		if country := c.country(); country != "" {
+			ev.Fields["country"] = country
+		}
+		s.shared.audit.Record(ev)
+	}
+
+	if refusal := c.admit(); refusal != nil {
+		return nil, s.gatewayRefusal(refusal)
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, errUnauthorized
+	}
+	acct, refusal := c.authenticate(user, pass)
+	if refusal != nil {
+		return nil, s.gatewayRefusal(refusal)
+	}
+	s.shared.lockout.success(user)
+
+	upstream := upstreamKey(acct)
+	if !s.shared.breakers.allow(upstream, s.config.Server.CircuitBreaker) {
+		logger.Warn("gateway request rejected: upstream circuit breaker open", "user", user, "upstream", upstream)
+		return nil, &GatewayError{http.StatusServiceUnavailable, "upstream temporarily unavailable, try again later"}
+	}
+	release, scope := s.shared.limits.acquire(acct.LocalUser,
+		s.config.Server.MaxConnections, acct.MaxSessions, s.config.Server.LimitQueueTimeout)
+	if release == nil {
+		s.shared.breakers.cancel(upstream)
+		logger.Warn("gateway request rejected: session limit reached", "user", user, "scope", scope)
+		return nil, &GatewayError{http.StatusTooManyRequests, "too many sessions"}
+	}
+	c.record(audit.Event{Type: audit.LoginSuccess, User: user})
+	return &GatewayLogin{Account: acct, srv: s, client: c, upstream: upstream, release: release}, nil
+}
+
+// gatewayRefusal turns a login refusal into a gateway error, delaying
+// failed logins like IMAP does.
+func (s *Server) gatewayRefusal(r *loginRefusal) *GatewayError {
+	if r.failed {
+		if d := s.config.Server.AuthFailureDelay; d > 0 {
+			time.Sleep(d)
+		}
+		return errUnauthorized
+	}
+	status := r.status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	return &GatewayError{status, r.text}
+}
+
+// Connected reports the outcome of connecting and logging in to the
+// account's upstream to its circuit breaker. An upstream that refused
+// the login is healthy, and one not tried for ErrHostLimit is not judged.
+func (g *GatewayLogin) Connected(err error) {
+	if g.reported {
+		return
+	}
+	g.reported = true
+	if errors.Is(err, ErrHostLimit) {
+		g.srv.shared.breakers.cancel(g.upstream)
+		return
+	}
+	var refused *refusedError
+	if err == nil || errors.As(err, &refused) {
+		g.srv.shared.breakers.success(g.upstream)
+		return
+	}
+	if g.srv.shared.breakers.failure(g.upstream, g.srv.config.Server.CircuitBreaker) {
+		g.client.logger.Warn("upstream circuit breaker opened", "upstream", g.upstream)
+	}
+}
+
+// Listed records that folder was listed, for access reporting.
+func (g *GatewayLogin) Listed(folder string) { g.usage.listed(folder) }
+
+// Selected records that folder was opened; downloads are attributed to
+// it until the next Selected.
+func (g *GatewayLogin) Selected(folder string) { g.usage.selected(folder) }
+
+// CheckQuota returns ErrQuotaExceeded if the account has used up its
+// daily download quota, so that nothing more may be fetched today.
+func (g *GatewayLogin) CheckQuota() error {
+	limit := g.Account.DailyDownloadQuota()
+	if limit > 0 && g.srv.shared.quota.Used(g.Account.LocalUser) >= limit {
+		quotaRejectionsTotal.Inc()
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Fetched charges a message of n bytes served to the client against the
+// account's daily quota and records it for access reporting.
+func (g *GatewayLogin) Fetched(n int) {
+	if n > 0 && g.Account.DailyDownloadQuota() > 0 {
+		g.srv.shared.quota.Add(g.Account.LocalUser, int64(n))
+	}
+	g.usage.fetched(n)
+}
+
+// Close releases the session and records the folders used.
+func (g *GatewayLogin) Close() {
+	if !g.reported {
+		g.srv.shared.breakers.cancel(g.upstream)
+		g.reported = true
+	}
+	g.release()
+	for _, ev := range g.usage.events(g.Account.LocalUser) {
+		g.client.record(ev)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+func gatewayRequest(user, pass string) *http.Request {
+	r := httptest.NewRequest("GET", "/accounts/"+user+"/folders", nil)
+	r.SetBasicAuth(user, pass)
+	return r
+}
+
+func TestLoginGatewayLockout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.Lockout = config.LockoutConfig{MaxFailures: 2}
+	srv := NewServer(cfg, testLogger())
+	var events []audit.Event
+	srv.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) { events = append(events, ev) }))
+
+	for range 2 {
+		if _, err := srv.LoginGateway(gatewayRequest("reader1", "wrong"), "rest"); err == nil || err.Status != http.StatusUnauthorized {
+			t.Fatalf("wrong password: %v", err)
+		}
+	}
+	_, err := srv.LoginGateway(gatewayRequest("reader1", "localpass1"), "rest")
+	if err == nil || err.Status != http.StatusTooManyRequests {
+		t.Fatalf("locked account: %v, want 429", err)
+	}
+	var locked bool
+	for _, ev := range events {
+		if ev.Fields["via"] != "rest" || ev.ClientIP != "192.0.2.1" {
+			t.Errorf("event = %+v, want via rest from the request's address", ev)
+		}
+		locked = locked || ev.Type == audit.AccountLocked
+	}
+	if !locked {
+		t.Errorf("events = %+v, want account_locked", events)
+	}
+}
+
+func TestLoginGatewayRequiresTLS(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].RequireTLS = true
+	srv := NewServer(cfg, testLogger())
+	r := gatewayRequest("reader1", "localpass1")
+	if _, err := srv.LoginGateway(r, "rest"); err == nil || err.Status != http.StatusForbidden {
+		t.Fatalf("plaintext request: %v, want 403", err)
+	}
+	r.TLS = &tls.ConnectionState{}
+	g, err := srv.LoginGateway(r, "rest")
+	if err != nil {
+		t.Fatalf("TLS request: %v", err)
+	}
+	g.Close()
+}
+
+func TestLoginGatewaySessionLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].MaxSessions = 1
+	srv := NewServer(cfg, testLogger())
+	g, err := srv.LoginGateway(gatewayRequest("reader1", "localpass1"), "jmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.LoginGateway(gatewayRequest("reader1", "localpass1"), "jmap"); err == nil || err.Status != http.StatusTooManyRequests {
+		t.Fatalf("second request: %v, want 429", err)
+	}
+	g.Connected(nil)
+	g.Close()
+	g, err = srv.LoginGateway(gatewayRequest("reader1", "localpass1"), "jmap")
+	if err != nil {
+		t.Fatalf("after Close: %v", err)
+	}
+	g.Close()
+}
+
+func TestGatewayLoginQuotaAndUsage(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].DailyDownloadQuotaMB = 1
+	srv := NewServer(cfg, testLogger())
+	var events []audit.Event
+	srv.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) { events = append(events, ev) }))
+
+	g, gerr := srv.LoginGateway(gatewayRequest("reader1", "localpass1"), "rest")
+	if gerr != nil {
+		t.Fatal(gerr)
+	}
+	g.Connected(nil)
+	g.Selected("INBOX")
+	if err := g.CheckQuota(); err != nil {
+		t.Fatalf("CheckQuota = %v", err)
+	}
+	g.Fetched(1 << 20)
+	if err := g.CheckQuota(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("CheckQuota over quota = %v", err)
+	}
+	g.Close()
+	ev := events[len(events)-1]
+	if ev.Type != audit.FolderUsage || ev.Fields["folder"] != "INBOX" || ev.Fields["messages"] != "1" || ev.Fields["bytes"] != "1048576" {
+		t.Errorf("usage event = %+v", ev)
+	}
+}
+
+func TestLoginGatewayHoneypot(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts = append(cfg.Accounts, config.AccountConfig{LocalUser: "admin", LocalPassword: "admin", Honeypot: true})
+	srv := NewServer(cfg, testLogger())
+	var events []audit.Event
+	srv.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) { events = append(events, ev) }))
+	before := honeypotLoginsTotal.Value("admin")
+
+	if _, err := srv.LoginGateway(gatewayRequest("admin", "admin"), "jmap"); err == nil || err.Status != http.StatusUnauthorized {
+		t.Fatalf("honeypot login: %v, want 401", err)
+	}
+	if len(events) != 1 || events[0].Type != audit.HoneypotLogin || events[0].Fields["via"] != "jmap" || events[0].Fields["password_matched"] != "true" {
+		t.Errorf("events = %+v, want one honeypot_login via jmap", events)
+	}
+	if got := honeypotLoginsTotal.Value("admin"); got != before+1 {
+		t.Errorf("honeypot logins counted = %v, want %v", got, before+1)
+	}
+}
@@ -0,0 +1,21 @@
+package proxy
+
+// CountryLookup resolves a client IP to an ISO 3166-1 alpha-2 country code,
+// returning "" when unknown. *geoip.DB implements it.
+type CountryLookup interface {
+	Country(ip string) string
+}
+
+// SetCountryLookup enables country-based access restrictions and country
+// tagging of auth events. It must be called before Serve.
+func (s *Server) SetCountryLookup(geo CountryLookup) {
+	s.shared.geo = geo
+}
+
+// lookupCountry returns the client's country, or "" when no lookup is configured.
+func (sh *shared) lookupCountry(ip string) string {
+	if sh.geo == nil {
+		return ""
+	}
+	return sh.geo.Country(ip)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+// mapLookup is a CountryLookup backed by a map.
+type mapLookup map[string]string
+
+func (m mapLookup) Country(ip string) string { return m[ip] }
+
+func TestServerDeniedCountry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	cfg := &config.Config{Server: config.ServerConfig{DeniedCountries: []string{"XX"}}}
+	srv := NewServer(cfg, slog.New(slog.DiscardHandler))
+	srv.SetCountryLookup(mapLookup{"127.0.0.1": "XX"})
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if line != "* BYE access denied\r\n" {
+		t.Fatalf("expected BYE, got %q", line)
+	}
+}
+
+func TestSessionAccountCountries(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientIP string
+		wantOK   bool
+	}{
+		{name: "allowed country", clientIP: "10.0.0.1", wantOK: true},
+		{name: "other country", clientIP: "10.0.0.2", wantOK: false},
+		{name: "unknown country", clientIP: "10.0.0.3", wantOK: false},
+	}
+	geo := mapLookup{"10.0.0.1": "DE", "10.0.0.2": "US"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Accounts[0].AllowedCountries = []string{"DE"}
+			var events []audit.Event
+			env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+				s.clientIP = tt.clientIP
+				s.shared.geo = geo
+				s.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) { events = append(events, ev) }))
+			})
+			defer env.clientConn.Close()
+			env.readLine(t) // greeting
+
+			env.send(t, "A001 LOGIN reader1 localpass1\r\n")
+			if tt.wantOK {
+				env.drainUpstream(t)
+			}
+			line := env.readLine(t)
+			if got := strings.HasPrefix(line, "A001 OK"); got != tt.wantOK {
+				t.Fatalf("LOGIN response %q, want ok=%v", line, tt.wantOK)
+			}
+			if !tt.wantOK && line != "A001 NO LOGIN failed\r\n" {
+				t.Errorf("denied login should look like any failure, got %q", line)
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d audit events, want 1", len(events))
+			}
+			if got := events[0].Fields["country"]; got != geo[tt.clientIP] {
+				t.Errorf("audit country = %q, want %q", got, geo[tt.clientIP])
+			}
+		})
+	}
+}
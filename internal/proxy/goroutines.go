@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/metrics"
+)
+
+// Relay directions, as used in the goroutine metrics.
+const (
+	relayClientToUpstream = "client_to_upstream"
+	relayUpstreamToClient = "upstream_to_client"
+)
+
+var (
+	relayGoroutinesGauge = metrics.Default.NewGauge("imap_proxy_session_goroutines",
+		"Session relay goroutines currently running, by direction.", "direction")
+	relayGoroutinesStartedTotal = metrics.Default.NewCounter("imap_proxy_session_goroutines_started_total",
+		"Session relay goroutines started, by direction.", "direction")
+	relayGoroutinesFinishedTotal = metrics.Default.NewCounter("imap_proxy_session_goroutines_finished_total",
+		"Session relay goroutines finished, by direction.", "direction")
+	relayGoroutinesLingeringTotal = metrics.Default.NewCounter("imap_proxy_session_goroutines_lingering_total",
+		"Upstream→client goroutines still running 30s after their session ended.")
+)
+
+// relayLingerTimeout is how long the upstream→client goroutine may take to
+// finish once its session has closed both connections.
+const relayLingerTimeout = 30 * time.Second
+
+// relayMonitorInterval is how often a Server compares the running relay
+// goroutines of both directions.
+var relayMonitorInterval = time.Minute
+
+// relayDivergenceSamples is how many consecutive samples must find the
+// directions apart before the monitor warns. Sessions starting or ending
+// between the two goroutines account for short differences.
+const relayDivergenceSamples = 3
+
+// relayTracker counts the relay goroutines of a Server's sessions. Every
+// session in post-auth runs one goroutine in each direction, so the running
+// counts of both directions only differ while a session starts or ends. A
+// difference that persists means a goroutine outlived its session.
+type relayTracker struct {
+	mu       sync.Mutex
+	running  map[string]int
+	diverged int  // consecutive samples with differing counts
+	warned   bool // the current divergence was logged
+}
+
+func newRelayTracker() *relayTracker {
+	return &relayTracker{running: make(map[string]int)}
+}
+
+// started records a relay goroutine starting in direction dir.
+func (r *relayTracker) started(dir string) {
+	r.mu.Lock()
+	r.running[dir]++
+	r.mu.Unlock()
+	relayGoroutinesStartedTotal.Inc(dir)
+	relayGoroutinesGauge.Inc(dir)
+}
+
+// finished records the end of a relay goroutine started in direction dir.
+func (r *relayTracker) finished(dir string) {
+	r.mu.Lock()
+	r.running[dir]--
+	r.mu.Unlock()
+	relayGoroutinesFinishedTotal.Inc(dir)
+	relayGoroutinesGauge.Dec(dir)
+}
+
+// counts returns the running goroutines in each direction.
+func (r *relayTracker) counts() (clientToUpstream, upstreamToClient int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running[relayClientToUpstream], r.running[relayUpstreamToClient]
+}
+
+// sample compares the directions once and reports whether a divergence
+// has just lasted relayDivergenceSamples samples, so that each divergence
+// is reported once.
+func (r *relayTracker) sample() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running[relayClientToUpstream] == r.running[relayUpstreamToClient] {
+		r.diverged = 0
+		r.warned = false
+		return false
+	}
+	r.diverged++
+	if r.diverged < relayDivergenceSamples || r.warned {
+		return false
+	}
+	r.warned = true
+	return true
+}
+
+// runRelayMonitor samples the relay tracker every relayMonitorInterval
+// and warns when the directions stay apart. It returns when stop is closed.
+func (s *Server) runRelayMonitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(relayMonitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if s.shared.relays.sample() {
+				c2u, u2c := s.shared.relays.counts()
+				s.logger.Warn("session relay goroutines diverge, possible goroutine leak",
+					relayClientToUpstream, c2u, relayUpstreamToClient, u2c)
+			}
+		}
+	}
+}
+
+// waitRelay waits for the upstream→client goroutine to close done after
+// the session has closed its connections, warning if it lingers beyond
+// timeout.
+func waitRelay(logger *slog.Logger, done <-chan struct{}, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	logger.Warn("upstream relay goroutine still running after the session ended", "waited", timeout)
+	relayGoroutinesLingeringTotal.Inc()
+	<-done
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestRelayTrackerSample(t *testing.T) {
+	r := newRelayTracker()
+	r.started(relayClientToUpstream)
+	r.started(relayUpstreamToClient)
+	if r.sample() {
+		t.Fatal("balanced directions reported as diverging")
+	}
+
+	// The client→upstream goroutine finished, the other one did not.
+	r.finished(relayClientToUpstream)
+	for i := 1; i < relayDivergenceSamples; i++ {
+		if r.sample() {
+			t.Fatalf("sample %d: reported before %d samples", i, relayDivergenceSamples)
+		}
+	}
+	if !r.sample() {
+		t.Fatal("persistent divergence not reported")
+	}
+	if r.sample() {
+		t.Fatal("divergence reported twice")
+	}
+
+	r.finished(relayUpstreamToClient)
+	if r.sample() {
+		t.Fatal("recovered directions reported as diverging")
+	}
+	if c2u, u2c := r.counts(); c2u != 0 || u2c != 0 {
+		t.Errorf("counts = %d, %d, want 0, 0", c2u, u2c)
+	}
+}
+
+func TestWaitRelayLingering(t *testing.T) {
+	before := relayGoroutinesLingeringTotal.Value()
+	done := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(done) })
+	waitRelay(testLogger(), done, 10*time.Millisecond)
+	if got := relayGoroutinesLingeringTotal.Value() - before; got != 1 {
+		t.Errorf("lingering = %v, want 1", got)
+	}
+
+	closed := make(chan struct{})
+	close(closed)
+	waitRelay(testLogger(), closed, 10*time.Millisecond)
+	if got := relayGoroutinesLingeringTotal.Value() - before; got != 1 {
+		t.Errorf("lingering after a prompt finish = %v, want 1", got)
+	}
+}
+
+// waitRelays waits until n relay goroutines run in each direction for the
+// sessions sharing r. On a timeout it fails the test with a dump of all
+// goroutines, so that a leaked relay shows where it is blocked.
+func waitRelays(t *testing.T, r *relayTracker, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c2u, u2c := r.counts()
+		if c2u == n && u2c == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("relay goroutines: client_to_upstream=%d upstream_to_client=%d, want %d\n%s", c2u, u2c, n, buf)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRelayGoroutinesFinish(t *testing.T) {
+	received := make(chan string, 10)
+	lostUpstream := func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				line, _ := sr.ReadString('\n')
+				received <- line
+				upServer.Write([]byte("proxy0 OK LOGIN completed\r\n"))
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	}
+	tests := []struct {
+		name  string
+		setup func(*Session)
+		// received, if set, replaces the env's channel of upstream
+		// commands, for a setup that dials its own upstream.
+		received chan string
+		end      func(*testing.T, *integrationEnv)
+	}{
+		{"logout", func(*Session) {}, nil, func(t *testing.T, env *integrationEnv) {
+			env.send(t, "A002 LOGOUT\r\n")
+			env.readUntilTagged(t, "A002")
+		}},
+		{"client disconnect", func(*Session) {}, nil, func(t *testing.T, env *integrationEnv) {
+			env.clientConn.Close()
+		}},
+		{"client disconnect in IDLE", func(*Session) {}, nil, func(t *testing.T, env *integrationEnv) {
+			env.send(t, "A002 IDLE\r\n")
+			if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+				t.Fatalf("expected continuation, got: %q", line)
+			}
+			env.clientConn.Close()
+		}},
+		{"lost upstream", lostUpstream, received, func(t *testing.T, env *integrationEnv) {
+			if line := env.readLine(t); !strings.HasPrefix(line, "* BYE") {
+				t.Fatalf("expected BYE, got: %q", line)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sess *Session
+			env := newIntegrationEnvWithConfig(t, testConfig(), tt.setup, func(s *Session) { sess = s })
+			if tt.received != nil {
+				env.received = tt.received
+			}
+			defer env.clientConn.Close()
+			env.login(t)
+			waitRelays(t, sess.shared.relays, 1)
+			tt.end(t, env)
+			waitRelays(t, sess.shared.relays, 0)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"os"
+	"sync"
+
+	"imap-proxy/internal/buildinfo"
+)
+
+// hostname is the local host name for greeting_hostname, looked up once.
+var hostname = sync.OnceValue(func() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+})
+
+// greeting returns the untagged OK that opens an IMAP session.
+func (s *Session) greeting() string {
+	srv := &s.config.Server
+	text := srv.Greeting
+	if text == "" {
+		text = "imap-proxy ready"
+		if srv.HideProductName {
+			text = "IMAP server ready"
+		}
+	}
+	if srv.GreetingHostname {
+		text = hostname() + " " + text
+	}
+	if srv.GreetingVersion {
+		text += " (" + buildinfo.Version + ")"
+	}
+	if srv.GreetingCapabilities {
+		text = "[CAPABILITY " + s.preAuthCapabilities() + "] " + text
+	}
+	return "* OK " + text
+}
+
+// pop3Greeting returns the +OK that opens a POP3 session.
+func (s *Session) pop3Greeting() string {
+	srv := &s.config.Server
+	text := "imap-proxy POP3 ready"
+	if srv.HideProductName {
+		text = "POP3 server ready"
+	}
+	if srv.GreetingHostname {
+		text = hostname() + " " + text
+	}
+	if srv.GreetingVersion {
+		text += " (" + buildinfo.Version + ")"
+	}
+	return "+OK " + text
+}
+
+// byeLogout is the untagged BYE sent in response to LOGOUT.
+func (s *Session) byeLogout() string {
+	if s.config.Server.HideProductName {
+		return "* BYE logging out\r\n"
+	}
+	return "* BYE imap-proxy logging out\r\n"
+}
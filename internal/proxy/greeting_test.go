@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/buildinfo"
+	"imap-proxy/internal/config"
+)
+
+func TestGreeting(t *testing.T) {
+	host := hostname()
+	tests := []struct {
+		name string
+		srv  config.ServerConfig
+		want string
+		pop3 string
+	}{
+		{"default", config.ServerConfig{}, "* OK imap-proxy ready", "+OK imap-proxy POP3 ready"},
+		{"custom text", config.ServerConfig{Greeting: "Example Corp mail"}, "* OK Example Corp mail", "+OK imap-proxy POP3 ready"},
+		{"hostname", config.ServerConfig{GreetingHostname: true},
+			"* OK " + host + " imap-proxy ready", "+OK " + host + " imap-proxy POP3 ready"},
+		{"version", config.ServerConfig{GreetingVersion: true},
+			"* OK imap-proxy ready (" + buildinfo.Version + ")", "+OK imap-proxy POP3 ready (" + buildinfo.Version + ")"},
+		{"capabilities", config.ServerConfig{GreetingCapabilities: true, Greeting: "ready"},
+			"* OK [CAPABILITY IMAP4rev1 IDLE LITERAL+ ID CLIENTID] ready", "+OK imap-proxy POP3 ready"},
+		{"hidden product", config.ServerConfig{HideProductName: true}, "* OK IMAP server ready", "+OK POP3 server ready"},
+		{"hidden product with hostname", config.ServerConfig{HideProductName: true, GreetingHostname: true},
+			"* OK " + host + " IMAP server ready", "+OK " + host + " POP3 server ready"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Session{config: &config.Config{Server: tt.srv}}
+			if got := s.greeting(); got != tt.want {
+				t.Errorf("greeting = %q, want %q", got, tt.want)
+			}
+			if got := s.pop3Greeting(); got != tt.pop3 {
+				t.Errorf("POP3 greeting = %q, want %q", got, tt.pop3)
+			}
+		})
+	}
+}
+
+func TestSessionHideProductName(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.HideProductName = true
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	go NewSession(proxyConn, cfg, testLogger()).Run()
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(clientConn)
+
+	var got []string
+	read := func(n int) {
+		for range n {
+			line, err := readLine(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, line)
+		}
+	}
+	read(1)
+	fmt.Fprint(clientConn, "a1 ID NIL\r\n")
+	read(2)
+	fmt.Fprint(clientConn, "a2 LOGOUT\r\n")
+	read(2)
+	want := "* OK IMAP server ready\r\n* ID NIL\r\na1 OK ID completed\r\n* BYE logging out\r\na2 OK LOGOUT completed\r\n"
+	if strings.Join(got, "") != want {
+		t.Errorf("session = %q, want %q", strings.Join(got, ""), want)
+	}
+
+	p := &pop3Session{Session: &Session{config: cfg}}
+	if got := p.signOff(); strings.Contains(got, "imap-proxy") {
+		t.Errorf("POP3 sign-off %q names the product", got)
+	}
+}
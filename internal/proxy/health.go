@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/proxyproto"
+)
+
+// HealthCheck connects to the proxy listening on listenAddr, reads the
+// greeting, and logs out. An unspecified listen host (e.g. ":143" or
+// "0.0.0.0:143") is checked via loopback. With proxyHeader set, the
+// connection starts with a PROXY protocol LOCAL header, as a listener with
+// proxy_protocol requires.
+func HealthCheck(listenAddr string, timeout time.Duration, proxyHeader bool) error {
+	addr, err := loopbackAddr(listenAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return fmt.Errorf("healthcheck: dial %s: %w", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if proxyHeader {
+		if _, err := conn.Write(proxyproto.LocalHeader()); err != nil {
+			return fmt.Errorf("healthcheck: send PROXY header: %w", err)
+		}
+	}
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("healthcheck: read greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return fmt.Errorf("healthcheck: unexpected greeting: %s", strings.TrimRight(greeting, "\r\n"))
+	}
+
+	fmt.Fprint(conn, "hc1 LOGOUT\r\n")
+	return nil
+}
+
+// loopbackAddr maps a listen address with an empty or unspecified host to
+// the matching loopback address.
+func loopbackAddr(listenAddr string) (string, error) {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", fmt.Errorf("healthcheck: invalid listen address %q: %w", listenAddr, err)
+	}
+	switch {
+	case host == "":
+		host = "127.0.0.1"
+	case net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified():
+		if net.ParseIP(host).To4() != nil {
+			host = "127.0.0.1"
+		} else {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
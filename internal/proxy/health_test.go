@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := NewServer(&config.Config{}, slog.Default())
+	go srv.Serve(l)
+	defer srv.Close()
+
+	if err := HealthCheck(l.Addr().String(), 2*time.Second, false); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+}
+
+func TestHealthCheckProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := NewServer(&config.Config{Server: config.ServerConfig{ProxyProtocol: true}}, slog.New(slog.DiscardHandler))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	if err := HealthCheck(l.Addr().String(), 2*time.Second, true); err != nil {
+		t.Fatalf("HealthCheck with PROXY header: %v", err)
+	}
+	if err := HealthCheck(l.Addr().String(), 500*time.Millisecond, false); err == nil {
+		t.Fatal("expected the listener to refuse a check without a PROXY header")
+	}
+}
+
+func TestHealthCheckBadGreeting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("* BYE go away\r\n"))
+	}()
+
+	if err := HealthCheck(l.Addr().String(), 2*time.Second, false); err == nil {
+		t.Fatal("expected error for BYE greeting")
+	}
+}
+
+func TestHealthCheckNoListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	if err := HealthCheck(addr, 500*time.Millisecond, false); err == nil {
+		t.Fatal("expected error when nothing is listening")
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: ":143", want: "127.0.0.1:143"},
+		{in: "0.0.0.0:143", want: "127.0.0.1:143"},
+		{in: "[::]:143", want: "[::1]:143"},
+		{in: "10.0.0.5:1143", want: "10.0.0.5:1143"},
+		{in: "localhost:143", want: "localhost:143"},
+		{in: "nope", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := loopbackAddr(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
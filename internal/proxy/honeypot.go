@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"strconv"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+var honeypotLoginsTotal = metrics.Default.NewCounter("imap_proxy_honeypot_logins_total",
+	"LOGIN attempts as honeypot accounts.", "user")
+
+// honeypotLogin handles a LOGIN as a honeypot account. It always fails like
+// a wrong password, but is logged with everything known about the client
+// and recorded as a honeypot_login event for audit.alert_webhook. It
+// counts toward the source IP's rate limit, but never locks the account,
+// so that every later attempt is reported too.
+func (c *loginClient) honeypotLogin(acct *config.AccountConfig, pass string) *loginRefusal {
+	// Take as long as a real login would before failing.
+	c.config.Authenticate(acct.LocalUser, pass)
+	matched := subtle.ConstantTimeCompare([]byte(pass), []byte(acct.LocalPassword)) == 1
+
+	honeypotLoginsTotal.Inc(acct.LocalUser)
+	attrs := append([]any{"user", acct.LocalUser, "client", c.ip, "country", c.country(),
+		"tls", c.tls, "password_matched", matched}, c.logAttrs...)
+	c.logger.Warn("LOGIN as honeypot account", attrs...)
+	c.record(audit.Event{
+		Type: audit.HoneypotLogin, User: acct.LocalUser,
+		Fields: map[string]string{
+			"password_matched": strconv.FormatBool(matched),
+			"tls":              strconv.FormatBool(c.tls),
+		},
+	})
+	if c.shared.ipLimits.loginFailed(c.ip, c.config.Server.RateLimit) {
+		c.logger.Warn("source IP banned after repeated login failures", "client", c.ip)
+	}
+	return loginFailed
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+func TestHoneypotLogin(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.Lockout = config.LockoutConfig{MaxFailures: 1}
+	cfg.Accounts = append(cfg.Accounts, config.AccountConfig{LocalUser: "admin", LocalPassword: "admin", Honeypot: true})
+
+	tests := []struct {
+		name        string
+		pass        string
+		wantMatched string
+	}{
+		{name: "right password", pass: "admin", wantMatched: "true"},
+		{name: "wrong password", pass: "secret", wantMatched: "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var events []audit.Event
+			env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+				s.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) {
+					mu.Lock()
+					events = append(events, ev)
+					mu.Unlock()
+				}))
+			})
+			defer env.clientConn.Close()
+			env.readLine(t) // greeting
+
+			env.send(t, "A1 ID (\"name\" \"Scanner\" \"version\" \"1\")\r\n")
+			env.readUntilTagged(t, "A1")
+			// Repeated attempts fail alike: the account is never locked.
+			for _, tag := range []string{"A2", "A3"} {
+				env.send(t, tag+" LOGIN admin "+tt.pass+"\r\n")
+				if line := env.readLine(t); line != tag+" NO LOGIN failed\r\n" {
+					t.Fatalf("LOGIN response %q", line)
+				}
+			}
+			env.noUpstream(t)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(events) != 2 {
+				t.Fatalf("got %d audit events, want 2: %+v", len(events), events)
+			}
+			ev := events[0]
+			if ev.Type != audit.HoneypotLogin || ev.User != "admin" {
+				t.Errorf("event = %+v", ev)
+			}
+			if ev.Fields["password_matched"] != tt.wantMatched || ev.Fields["tls"] != "false" || ev.Fields["client_name"] != "Scanner" {
+				t.Errorf("event fields = %v", ev.Fields)
+			}
+		})
+	}
+}
+
+func TestHoneypotIgnoredForLoginDisabled(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].RequireTLS = true
+	cfg.Accounts = append(cfg.Accounts, config.AccountConfig{LocalUser: "admin", Honeypot: true})
+	if !loginRequiresTLS(cfg) {
+		t.Error("loginRequiresTLS = false; a honeypot account should not count")
+	}
+}
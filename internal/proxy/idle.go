@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/metrics"
+)
+
+// idleRefreshInterval is how often a long client IDLE is restarted toward
+// the upstream. RFC 2177 lets servers drop clients that stay idle for 30
+// minutes, so the proxy re-issues IDLE shortly before that.
+var idleRefreshInterval = 29 * time.Minute
+
+var idleRefreshesTotal = metrics.Default.NewCounter("imap_proxy_idle_refreshes_total",
+	"IDLE commands re-issued to the upstream to stay within the 30-minute limit.")
+
+// idleRelay tracks one client IDLE relayed to the upstream. It serializes
+// writes from the client and the refresh timer, and records which upstream
+// responses to a refresh must be hidden from the client.
+type idleRelay struct {
+	s        *Session
+	tag      string
+	interval time.Duration
+
+	mu    sync.Mutex // serializes writes to the upstream
+	done  bool       // the client sent DONE, or the relay was stopped
+	ended bool       // DONE was forwarded to the upstream
+	timer *time.Timer
+
+	// hideMu is separate from mu so that the upstream reader never waits
+	// for a write, which may itself wait for the reader.
+	hideMu  sync.Mutex
+	hideTag int // tagged completions of refreshed IDLEs to drop
+	hideCon int // "+" continuations of re-issued IDLEs to drop
+}
+
+// start forwards the client's IDLE line and schedules the first refresh.
+func (r *idleRelay) start(line string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.deadline.expect()
+	if _, err := fmt.Fprint(r.s.upstreamConn, line); err != nil {
+		return err
+	}
+	r.timer = time.AfterFunc(r.interval, r.refresh)
+	return nil
+}
+
+// refresh ends the current upstream IDLE and immediately starts a new one
+// with the client's tag.
+func (r *idleRelay) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	r.hideMu.Lock()
+	r.hideTag++
+	r.hideCon++
+	r.hideMu.Unlock()
+	r.s.deadline.expect()
+	if _, err := fmt.Fprintf(r.s.upstreamConn, "DONE\r\n%s IDLE\r\n", r.tag); err != nil {
+		r.s.logger.Debug("IDLE refresh failed", "err", err)
+		return
+	}
+	r.s.logger.Debug("refreshed upstream IDLE")
+	idleRefreshesTotal.Inc()
+	r.timer.Reset(r.interval)
+}
+
+// forward relays a line from the client, which ends the IDLE when it is
+// DONE. It reports whether the IDLE is over.
+func (r *idleRelay) forward(line string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	done := strings.EqualFold(strings.TrimRight(line, "\r\n"), "DONE")
+	if done {
+		r.done = true
+		r.timer.Stop()
+	}
+	if _, err := fmt.Fprint(r.s.upstreamConn, line); err != nil {
+		return done, err
+	}
+	if done {
+		r.ended = true
+		r.s.deadline.resume()
+	}
+	return done, nil
+}
+
+// upstreamIdling reports whether the upstream is still in the IDLE, which
+// happens when the client disconnects without sending DONE.
+func (r *idleRelay) upstreamIdling() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.ended
+}
+
+// stop cancels any pending refresh.
+func (r *idleRelay) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// hide reports whether an upstream line answers a refresh and must not be
+// relayed to the client.
+func (r *idleRelay) hide(line string) bool {
+	r.hideMu.Lock()
+	defer r.hideMu.Unlock()
+	switch {
+	case r.hideTag > 0 && strings.HasPrefix(line, r.tag+" "):
+		r.hideTag--
+		return true
+	case r.hideCon > 0 && r.hideTag < r.hideCon && strings.HasPrefix(line, "+"):
+		r.hideCon--
+		return true
+	}
+	return false
+}
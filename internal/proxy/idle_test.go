@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleRefreshIsTransparent(t *testing.T) {
+	defer func(d time.Duration) { idleRefreshInterval = d }(idleRefreshInterval)
+	idleRefreshInterval = 50 * time.Millisecond
+
+	env := newIntegrationEnv(t)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	before := idleRefreshesTotal.Value()
+	env.send(t, "A002 IDLE\r\n")
+	env.expectUpstream(t, "A002 IDLE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got: %q", line)
+	}
+
+	// Two refreshes: each ends the upstream IDLE and starts a new one.
+	for range 2 {
+		env.expectUpstream(t, "A002 IDLE")
+	}
+
+	env.send(t, "DONE\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("expected IDLE completion, got: %q", line)
+	}
+	if got := idleRefreshesTotal.Value(); got < before+2 {
+		t.Errorf("refresh counter = %v, want at least %v", got, before+2)
+	}
+
+	// No refresh responses may be left over for the client.
+	env.send(t, "A003 NOOP\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A003 OK") {
+		t.Fatalf("expected NOOP completion, got: %q", line)
+	}
+}
+
+func TestIdleRelayHide(t *testing.T) {
+	r := &idleRelay{tag: "A1", hideTag: 1, hideCon: 1}
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"* 3 EXISTS\r\n", false},
+		{"+ idling\r\n", false}, // the refreshed IDLE has not completed yet
+		{"A1 OK IDLE terminated\r\n", true},
+		{"* 4 EXISTS\r\n", false},
+		{"+ idling\r\n", true},
+		{"+ idling\r\n", false},
+		{"A1 OK IDLE terminated\r\n", false},
+	}
+	for i, tt := range tests {
+		if got := r.hide(tt.line); got != tt.want {
+			t.Errorf("step %d: hide(%q) = %v, want %v", i, tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"slices"
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+// mailboxArgs returns the positions, counted from 0 after the command name
+// (and after the UID prefix's command), of the mailbox arguments of cmd
+// that refer to INBOX in the client's view. LIST and LSUB are not
+// rewritten: their responses are (see unaliasInbox).
+func mailboxArgs(cmd imap.Command) []int {
+	switch cmd.Verb {
+	case "SELECT", "EXAMINE", "STATUS", "APPEND", "SUBSCRIBE", "UNSUBSCRIBE",
+		"CREATE", "DELETE", "GETACL", "MYRIGHTS", "LISTRIGHTS", "GETQUOTAROOT":
+		return []int{0}
+	case "RENAME":
+		return []int{0, 1}
+	case "COPY", "MOVE":
+		return []int{1}
+	case "UID":
+		if cmd.SubVerb == "COPY" || cmd.SubVerb == "MOVE" {
+			return []int{1}
+		}
+	}
+	return nil
+}
+
+// aliasInbox rewrites the INBOX arguments of line, the first line of cmd,
+// to the account's inbox_alias, so that the upstream sees the mailbox
+// that stands in for INBOX. Arguments sent as literals are not rewritten.
+func (s *Session) aliasInbox(cmd imap.Command, line []byte) []byte {
+	alias := s.account.InboxAlias
+	positions := mailboxArgs(cmd)
+	if alias == "" || len(positions) == 0 {
+		return line
+	}
+	text := strings.TrimRight(string(line), "\r\n")
+	eol := string(line[len(text):])
+	// Skip the tag and command name, and the command after UID.
+	words := 2
+	if cmd.Verb == "UID" {
+		words = 3
+	}
+	fields := strings.SplitN(text, " ", words+1)
+	if len(fields) <= words {
+		return line
+	}
+	rest := fields[words]
+
+	var b strings.Builder
+	b.WriteString(text[:len(text)-len(rest)])
+	for arg := 0; rest != "" && rest[0] != '{' && rest[0] != '('; {
+		if rest[0] == ' ' {
+			b.WriteByte(' ')
+			rest = rest[1:]
+			continue
+		}
+		token, after, err := parseOneArg(rest)
+		if err != nil {
+			return line
+		}
+		raw := strings.TrimSuffix(rest[:len(rest)-len(after)], " ")
+		if strings.EqualFold(token, "INBOX") && slices.Contains(positions, arg) {
+			b.WriteString(imap.Quote(alias))
+		} else {
+			b.WriteString(raw)
+		}
+		rest = rest[len(raw):]
+		arg++
+	}
+	b.WriteString(rest)
+	b.WriteString(eol)
+	return []byte(b.String())
+}
+
+// unaliasResponses are the untagged responses that start with a mailbox
+// name.
+var unaliasResponses = []string{"STATUS", "ACL", "MYRIGHTS", "LISTRIGHTS", "QUOTAROOT", "METADATA"}
+
+// unaliasInbox translates an untagged response from the upstream's mailbox
+// names to the client's. Responses naming the inbox_alias mailbox name INBOX
+// instead. In LIST and LSUB, the upstream's own INBOX stands in for the
+// alias, which is hidden: that way INBOX is listed wherever a pattern
+// matches it. It reports false for a line that is not relayed.
+func (s *Session) unaliasInbox(line string) (string, bool) {
+	alias := s.account.InboxAlias
+	if alias == "" || !strings.HasPrefix(line, "* ") {
+		return line, true
+	}
+	if entry, ok := imap.ParseListEntry([]byte(line)); ok {
+		return line, entry.Mailbox != alias
+	}
+	text := strings.TrimRight(line, "\r\n")
+	kind, args, ok := strings.Cut(text[2:], " ")
+	if !ok || args == "" || !slices.ContainsFunc(unaliasResponses, func(k string) bool { return strings.EqualFold(k, kind) }) {
+		return line, true
+	}
+	token, after, err := parseOneArg(args)
+	if err != nil || token != alias {
+		return line, true
+	}
+	if after != "" && !strings.HasPrefix(after, " ") {
+		// An unquoted name consumed the space after it.
+		after = " " + after
+	}
+	return text[:len(text)-len(args)] + "INBOX" + after + line[len(text):], true
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"testing"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+)
+
+func TestAliasInbox(t *testing.T) {
+	s := &Session{account: &config.AccountConfig{InboxAlias: "Shared/Team"}}
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"A1 SELECT INBOX\r\n", "A1 SELECT \"Shared/Team\"\r\n"},
+		{"A1 EXAMINE \"inbox\"\r\n", "A1 EXAMINE \"Shared/Team\"\r\n"},
+		{"A1 STATUS INBOX (MESSAGES UNSEEN)\r\n", "A1 STATUS \"Shared/Team\" (MESSAGES UNSEEN)\r\n"},
+		{"A1 APPEND INBOX (\\Seen) {5}\r\n", "A1 APPEND \"Shared/Team\" (\\Seen) {5}\r\n"},
+		{"A1 COPY 1:3 INBOX\r\n", "A1 COPY 1:3 \"Shared/Team\"\r\n"},
+		{"A1 UID MOVE 7 \"INBOX\"\r\n", "A1 UID MOVE 7 \"Shared/Team\"\r\n"},
+		{"A1 COPY 1 Archive\r\n", "A1 COPY 1 Archive\r\n"},
+		{"A1 SELECT INBOX/Sub\r\n", "A1 SELECT INBOX/Sub\r\n"},
+		{"A1 LIST \"\" INBOX\r\n", "A1 LIST \"\" INBOX\r\n"},
+		{"A1 FETCH 1 (FLAGS)\r\n", "A1 FETCH 1 (FLAGS)\r\n"},
+		{"A1 SELECT {5}\r\n", "A1 SELECT {5}\r\n"},
+	}
+	for _, tt := range tests {
+		cmd, err := imap.ParseCommand([]byte(tt.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(s.aliasInbox(cmd, []byte(tt.line))); got != tt.want {
+			t.Errorf("aliasInbox(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	s.account.InboxAlias = ""
+	cmd, _ := imap.ParseCommand([]byte("A1 SELECT INBOX\r\n"))
+	if got := string(s.aliasInbox(cmd, cmd.Raw)); got != "A1 SELECT INBOX\r\n" {
+		t.Errorf("without an alias = %q", got)
+	}
+}
+
+func TestUnaliasInbox(t *testing.T) {
+	s := &Session{account: &config.AccountConfig{InboxAlias: "Shared/Team"}}
+	tests := []struct {
+		line    string
+		want    string
+		relayed bool
+	}{
+		{"* STATUS \"Shared/Team\" (MESSAGES 3)\r\n", "* STATUS INBOX (MESSAGES 3)\r\n", true},
+		{"* STATUS Shared/Team (MESSAGES 3)\r\n", "* STATUS INBOX (MESSAGES 3)\r\n", true},
+		{"* MYRIGHTS \"Shared/Team\" lr\r\n", "* MYRIGHTS INBOX lr\r\n", true},
+		{"* QUOTAROOT Shared/Team\r\n", "* QUOTAROOT INBOX\r\n", true},
+		{"* STATUS Archive (MESSAGES 3)\r\n", "* STATUS Archive (MESSAGES 3)\r\n", true},
+		{"* LIST (\\HasNoChildren) \"/\" \"Shared/Team\"\r\n", "", false},
+		{"* LSUB () \"/\" Shared/Team\r\n", "", false},
+		{"* LIST (\\HasNoChildren) \"/\" INBOX\r\n", "* LIST (\\HasNoChildren) \"/\" INBOX\r\n", true},
+		{"* LIST () \"/\" \"Shared/Team/Sub\"\r\n", "* LIST () \"/\" \"Shared/Team/Sub\"\r\n", true},
+		{"* 3 EXISTS\r\n", "* 3 EXISTS\r\n", true},
+		{"A1 OK done\r\n", "A1 OK done\r\n", true},
+	}
+	for _, tt := range tests {
+		got, relayed := s.unaliasInbox(tt.line)
+		if relayed != tt.relayed || relayed && got != tt.want {
+			t.Errorf("unaliasInbox(%q) = %q, %v, want %q, %v", tt.line, got, relayed, tt.want, tt.relayed)
+		}
+	}
+}
+
+func TestIntegrationInboxAlias(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].InboxAlias = "Shared/Team"
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 SELECT INBOX\r\n")
+	env.expectUpstream(t, "A002 EXAMINE \"Shared/Team\"")
+	if line := env.readLine(t); line != "A002 OK completed\r\n" {
+		t.Fatalf("response = %q", line)
+	}
+}
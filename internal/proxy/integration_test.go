@@ -26,6 +26,13 @@ type integrationEnv struct {
 // All commands received by the upstream are sent to the received channel.
 func newIntegrationEnv(t *testing.T) *integrationEnv {
 	t.Helper()
+	return newIntegrationEnvWithConfig(t, testConfig())
+}
+
+// newIntegrationEnvWithConfig is like newIntegrationEnv but runs the session
+// with the given config. Each setup func is applied to the session before it starts.
+func newIntegrationEnvWithConfig(t *testing.T, cfg *config.Config, setup ...func(*Session)) *integrationEnv {
+	t.Helper()
 
 	clientConn, proxyConn := net.Pipe()
 	upClient, upServer := net.Pipe()
@@ -90,7 +97,6 @@ func newIntegrationEnv(t *testing.T) *integrationEnv {
 		}
 	}()
 
-	cfg := testConfig()
 	sess := NewSession(proxyConn, cfg, testLogger())
 	sess.dialUpstream = func(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error) {
 		r := bufio.NewReader(upClient)
@@ -100,8 +106,11 @@ func newIntegrationEnv(t *testing.T) *integrationEnv {
 		}
 		return upClient, r, nil
 	}
+	for _, fn := range setup {
+		fn(sess)
+	}
 
-	go sess.Run()
+	runSession(t, sess)
 
 	env := &integrationEnv{
 		clientConn: clientConn,
@@ -115,6 +124,26 @@ func newIntegrationEnv(t *testing.T) *integrationEnv {
 	return env
 }
 
+// runSession runs sess in the background until the test ends, then closes
+// its connections and waits for Run to return, so that no session outlives
+// the test that started it.
+func runSession(t *testing.T, sess *Session) {
+	t.Helper()
+	ran := make(chan struct{})
+	go func() {
+		defer close(ran)
+		sess.Run()
+	}()
+	t.Cleanup(func() {
+		sess.terminate()
+		select {
+		case <-ran:
+		case <-time.After(5 * time.Second):
+			t.Error("session still running after the test")
+		}
+	})
+}
+
 // login reads the greeting, sends LOGIN, and verifies success.
 func (e *integrationEnv) login(t *testing.T) {
 	t.Helper()
@@ -285,6 +314,14 @@ func newFolderFilterEnv(t *testing.T, modify func(*config.AccountConfig)) *integ
 				consumeLiteral()
 				fmt.Fprintf(upServer, "%s OK APPEND completed\r\n", tag)
 
+			case strings.Contains(upper, " MYRIGHTS "):
+				mailbox := trimmed[strings.LastIndexByte(trimmed, ' ')+1:]
+				fmt.Fprintf(upServer, "* MYRIGHTS %s lrswipkxtea\r\n%s OK MYRIGHTS completed\r\n", mailbox, tag)
+
+			case strings.Contains(upper, " GETACL "):
+				mailbox := trimmed[strings.LastIndexByte(trimmed, ' ')+1:]
+				fmt.Fprintf(upServer, "* ACL %s reader1 lrswipkxtea anyone lr\r\n%s OK GETACL completed\r\n", mailbox, tag)
+
 			case strings.Contains(upper, " LOGOUT"):
 				fmt.Fprintf(upServer, "* BYE server logging out\r\n")
 				fmt.Fprintf(upServer, "%s OK LOGOUT completed\r\n", tag)
@@ -310,7 +347,7 @@ func newFolderFilterEnv(t *testing.T, modify func(*config.AccountConfig)) *integ
 		return upClient, r, nil
 	}
 
-	go sess.Run()
+	runSession(t, sess)
 
 	env := &integrationEnv{
 		clientConn: clientConn,
@@ -720,6 +757,26 @@ func TestIntegrationSelectWritableFolder(t *testing.T) {
 	}
 }
 
+func TestIntegrationWritableFolderGlob(t *testing.T) {
+	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
+		a.WritableFolders = []string{"Drafts", "Shared/Inbound/*"}
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 SELECT Shared/Inbound/Acme\r\n")
+	if upCmd := env.expectUpstream(t, "A002"); !strings.Contains(upCmd, "SELECT Shared/Inbound/Acme") {
+		t.Fatalf("SELECT of a folder matching a glob should pass through, got: %q", upCmd)
+	}
+	env.readLine(t) // OK
+
+	env.send(t, "A003 SELECT Shared/Outbound\r\n")
+	if upCmd := env.expectUpstream(t, "A003"); !strings.Contains(upCmd, "EXAMINE Shared/Outbound") {
+		t.Fatalf("SELECT of a folder outside the glob should be rewritten, got: %q", upCmd)
+	}
+	env.readLine(t) // OK
+}
+
 func TestIntegrationSelectNonWritableStillRewritten(t *testing.T) {
 	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
 		a.WritableFolders = []string{"Drafts"}
@@ -842,6 +899,37 @@ func TestIntegrationAppendToNonWritableFolder(t *testing.T) {
 	env.noUpstream(t)
 }
 
+func TestIntegrationAppendOnlyFolder(t *testing.T) {
+	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
+		a.AppendFolders = []string{"Scans"}
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	msgBody := "Subject: scan\r\n\r\n%PDF\r\n"
+	env.send(t, fmt.Sprintf("A002 APPEND Scans {%d+}\r\n%s\r\n", len(msgBody), msgBody))
+	env.expectUpstream(t, "APPEND")
+	if resp := env.readLine(t); !strings.Contains(resp, "A002 OK") {
+		t.Fatalf("expected APPEND OK for append-only folder, got: %q", resp)
+	}
+
+	// SELECT is still rewritten to EXAMINE, and nothing can be altered.
+	env.send(t, "A003 SELECT Scans\r\n")
+	if upCmd := env.expectUpstream(t, "EXAMINE"); !strings.Contains(upCmd, "EXAMINE Scans") {
+		t.Fatalf("append-only SELECT should be rewritten to EXAMINE, got: %q", upCmd)
+	}
+	env.readLine(t) // OK
+
+	for i, cmd := range []string{"STORE 1 +FLAGS (\\Deleted)", "UID STORE 1 +FLAGS (\\Seen)", "EXPUNGE", "COPY 1 Scans"} {
+		tag := fmt.Sprintf("B%03d", i+1)
+		env.send(t, fmt.Sprintf("%s %s\r\n", tag, cmd))
+		if resp := env.readLine(t); !strings.Contains(resp, tag+" NO") {
+			t.Errorf("expected %s blocked in append-only folder, got: %q", cmd, resp)
+		}
+	}
+	env.noUpstream(t)
+}
+
 func TestIntegrationWritableFolderOtherCommandsStillBlocked(t *testing.T) {
 	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
 		a.WritableFolders = []string{"Drafts"}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/ratelimit"
+)
+
+var (
+	ipRateLimitedTotal = metrics.Default.NewCounter("imap_proxy_ip_rate_limited_total",
+		"Connections or logins refused because the source IP was rate limited or banned.", "reason")
+	ipBansTotal = metrics.Default.NewCounter("imap_proxy_ip_bans_total",
+		"Temporary source IP bans issued.", "reason")
+)
+
+// ipSweepInterval is how often idle per-IP entries are pruned.
+const ipSweepInterval = time.Minute
+
+// ipLimiter tracks connection and failed-login rates per source IP and
+// issues temporary bans when either bucket runs dry.
+type ipLimiter struct {
+	now func() time.Time
+	// onBan, if set, is called for each ban issued. It runs with l.mu
+	// held, so it must return quickly.
+	onBan func(ip, reason string, d time.Duration)
+	// state, if set, holds the counters and bans instead of entries.
+	state *sharedState
+
+	mu        sync.Mutex
+	entries   map[string]*ipEntry
+	lastSweep time.Time
+}
+
+type ipEntry struct {
+	conns       *ratelimit.Bucket
+	fails       *ratelimit.Bucket
+	bannedUntil time.Time
+}
+
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{now: time.Now, entries: make(map[string]*ipEntry)}
+}
+
+// entry returns the entry for ip, creating it on first use; l.mu must be held.
+func (l *ipLimiter) entry(ip string, rl config.RateLimitConfig, now time.Time) *ipEntry {
+	if now.Sub(l.lastSweep) >= ipSweepInterval {
+		l.sweep(now)
+	}
+	e, ok := l.entries[ip]
+	if !ok {
+		e = &ipEntry{
+			conns: newPerMinuteBucket(rl.ConnectionsPerMinute, rl.ConnectionBurst),
+			fails: newPerMinuteBucket(rl.FailedLoginsPerMinute, rl.FailedLoginBurst),
+		}
+		l.entries[ip] = e
+	}
+	return e
+}
+
+// sweep drops entries that are unbanned and fully refilled, since a fresh
+// entry would behave identically; l.mu must be held.
+func (l *ipLimiter) sweep(now time.Time) {
+	for ip, e := range l.entries {
+		if now.Before(e.bannedUntil) {
+			continue
+		}
+		if (e.conns == nil || e.conns.Full(now)) && (e.fails == nil || e.fails.Full(now)) {
+			delete(l.entries, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// allowConnection records a new connection from ip and reports whether it
+// may proceed.
+func (l *ipLimiter) allowConnection(ip string, rl config.RateLimitConfig) bool {
+	if rl.ConnectionsPerMinute <= 0 && rl.FailedLoginsPerMinute <= 0 {
+		return true
+	}
+	now := l.now()
+	if l.state != nil {
+		if allowed, ok := l.sharedAllowConnection(ip, rl, now); ok {
+			return allowed
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.entry(ip, rl, now)
+	if now.Before(e.bannedUntil) {
+		ipRateLimitedTotal.Inc("banned")
+		return false
+	}
+	if e.conns != nil && !e.conns.AllowAt(now, 1) {
+		ipRateLimitedTotal.Inc("connections")
+		l.ban(ip, e, rl, now, "connections")
+		return false
+	}
+	return true
+}
+
+// banned reports whether ip is currently banned.
+func (l *ipLimiter) banned(ip string) bool {
+	now := l.now()
+	if l.state != nil {
+		ttl, err := l.state.store.TTL(l.state.key("ban", ip))
+		if !l.state.failed(err) {
+			return ttl > 0
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[ip]
+	return ok && now.Before(e.bannedUntil)
+}
+
+// loginFailed records a failed LOGIN from ip and reports whether it caused
+// (or the IP already has) a ban.
+func (l *ipLimiter) loginFailed(ip string, rl config.RateLimitConfig) bool {
+	if rl.FailedLoginsPerMinute <= 0 {
+		return false
+	}
+	now := l.now()
+	if l.state != nil {
+		if banned, ok := l.sharedLoginFailed(ip, rl, now); ok {
+			return banned
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.entry(ip, rl, now)
+	if now.Before(e.bannedUntil) {
+		return true
+	}
+	if !e.fails.AllowAt(now, 1) {
+		ipRateLimitedTotal.Inc("failed_logins")
+		return l.ban(ip, e, rl, now, "failed_logins")
+	}
+	return false
+}
+
+// ban marks ip's entry e as banned for rl.BanDuration; l.mu must be held.
+// It reports whether a ban was issued.
+func (l *ipLimiter) ban(ip string, e *ipEntry, rl config.RateLimitConfig, now time.Time, reason string) bool {
+	if rl.BanDuration <= 0 {
+		return false
+	}
+	e.bannedUntil = now.Add(rl.BanDuration)
+	ipBansTotal.Inc(reason)
+	if l.onBan != nil {
+		l.onBan(ip, reason, rl.BanDuration)
+	}
+	return true
+}
+
+// newPerMinuteBucket returns a bucket refilling perMinute tokens per minute,
+// or nil if perMinute is not positive. burst defaults to perMinute.
+func newPerMinuteBucket(perMinute float64, burst int) *ratelimit.Bucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = max(perMinute, 1)
+	}
+	return ratelimit.NewBucket(perMinute/60, b)
+}
+
+// clientIP returns the host part of conn's remote address.
+func clientIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
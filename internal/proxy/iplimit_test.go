@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+func TestIPLimiterConnections(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newIPLimiter()
+	l.now = func() time.Time { return now }
+	rl := config.RateLimitConfig{ConnectionsPerMinute: 60, ConnectionBurst: 2, BanDuration: time.Minute}
+
+	for i := 0; i < 2; i++ {
+		if !l.allowConnection("192.0.2.1", rl) {
+			t.Fatalf("connection %d should be allowed", i)
+		}
+	}
+	if l.allowConnection("192.0.2.1", rl) {
+		t.Fatal("third connection should be refused")
+	}
+	if !l.banned("192.0.2.1") {
+		t.Fatal("IP should be banned after exhausting its bucket")
+	}
+	if !l.allowConnection("192.0.2.2", rl) {
+		t.Fatal("other IPs must not be affected")
+	}
+
+	// Still banned after the bucket would have refilled.
+	now = now.Add(30 * time.Second)
+	if l.allowConnection("192.0.2.1", rl) {
+		t.Fatal("connection during ban should be refused")
+	}
+
+	now = now.Add(31 * time.Second)
+	if !l.allowConnection("192.0.2.1", rl) {
+		t.Fatal("connection after ban expiry should be allowed")
+	}
+}
+
+func TestIPLimiterFailedLogins(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newIPLimiter()
+	l.now = func() time.Time { return now }
+	rl := config.RateLimitConfig{FailedLoginsPerMinute: 1, FailedLoginBurst: 3, BanDuration: 10 * time.Minute}
+
+	for i := 0; i < 3; i++ {
+		if l.loginFailed("192.0.2.1", rl) {
+			t.Fatalf("failure %d should not ban yet", i)
+		}
+	}
+	if !l.loginFailed("192.0.2.1", rl) {
+		t.Fatal("fourth failure should ban")
+	}
+	if l.allowConnection("192.0.2.1", rl) {
+		t.Fatal("banned IP should not be allowed to connect")
+	}
+
+	now = now.Add(11 * time.Minute)
+	if l.banned("192.0.2.1") {
+		t.Fatal("ban should have expired")
+	}
+}
+
+func TestIPLimiterOnBan(t *testing.T) {
+	l := newIPLimiter()
+	var bans []string
+	l.onBan = func(ip, reason string, d time.Duration) {
+		bans = append(bans, fmt.Sprintf("%s %s %v", ip, reason, d))
+	}
+	rl := config.RateLimitConfig{ConnectionsPerMinute: 1, ConnectionBurst: 1, BanDuration: time.Minute}
+	for range 3 {
+		l.allowConnection("192.0.2.1", rl)
+	}
+	// Connections refused during the ban do not ban again.
+	if want := []string{"192.0.2.1 connections 1m0s"}; strings.Join(bans, ",") != strings.Join(want, ",") {
+		t.Errorf("bans = %v, want %v", bans, want)
+	}
+}
+
+func TestIPLimiterDisabled(t *testing.T) {
+	l := newIPLimiter()
+	for i := 0; i < 100; i++ {
+		if !l.allowConnection("192.0.2.1", config.RateLimitConfig{}) {
+			t.Fatal("zero config should not limit")
+		}
+		if l.loginFailed("192.0.2.1", config.RateLimitConfig{}) {
+			t.Fatal("zero config should not ban")
+		}
+	}
+}
+
+func TestIPLimiterSweep(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newIPLimiter()
+	l.now = func() time.Time { return now }
+	rl := config.RateLimitConfig{ConnectionsPerMinute: 60}
+
+	l.allowConnection("192.0.2.1", rl)
+	now = now.Add(2 * time.Minute)
+	l.allowConnection("192.0.2.2", rl)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries["192.0.2.1"]; ok {
+		t.Error("idle entry should have been swept")
+	}
+	if _, ok := l.entries["192.0.2.2"]; !ok {
+		t.Error("fresh entry missing")
+	}
+}
+
+func TestServerRateLimitAndProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	cfg := &config.Config{Server: config.ServerConfig{
+		ProxyProtocol: true,
+		RateLimit:     config.RateLimitConfig{ConnectionsPerMinute: 1, ConnectionBurst: 1, BanDuration: time.Minute},
+	}}
+	srv := NewServer(cfg, slog.New(slog.DiscardHandler))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	connect := func(src string) string {
+		t.Helper()
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 2*time.Second)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "PROXY TCP4 %s 127.0.0.1 40000 143\r\n", src)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return line
+	}
+
+	if line := connect("192.0.2.1"); !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("first connection: %q", line)
+	}
+	if line := connect("192.0.2.1"); !strings.HasPrefix(line, "* BYE [UNAVAILABLE]") {
+		t.Fatalf("second connection from same IP should be refused, got %q", line)
+	}
+	// The limit is keyed on the PROXY source, not the socket peer (127.0.0.1).
+	if line := connect("192.0.2.2"); !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("connection from other proxied IP: %q", line)
+	}
+}
+
+func TestSessionBannedAfterFailedLogins(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.RateLimit = config.RateLimitConfig{FailedLoginsPerMinute: 1, FailedLoginBurst: 2, BanDuration: time.Minute}
+	var mu sync.Mutex
+	var bans []audit.Event
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ev.Type == audit.IPBanned {
+				bans = append(bans, ev)
+			}
+		}))
+	})
+	defer env.clientConn.Close()
+	env.readLine(t) // greeting
+
+	for i := 0; i < 3; i++ {
+		env.send(t, fmt.Sprintf("A%d LOGIN reader1 wrong\r\n", i))
+		if line := env.readLine(t); !strings.Contains(line, "NO LOGIN failed") {
+			t.Fatalf("attempt %d: %q", i, line)
+		}
+	}
+
+	// Even correct credentials are refused while banned.
+	env.send(t, "A9 LOGIN reader1 localpass1\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A9 NO [UNAVAILABLE]") {
+		t.Fatalf("expected ban response, got %q", line)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bans) != 1 || bans[0].ClientIP == "" || bans[0].Fields["reason"] != "failed_logins" || bans[0].Fields["banned_for"] != "1m0s" {
+		t.Errorf("ip_banned events = %+v", bans)
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+// upstreamKeepaliveInterval is how long the upstream may go without a
+// command before the proxy sends a NOOP of its own, so that upstream
+// autologout timers do not end sessions whose client is quiet but alive.
+// Accounts may set their own noop_interval.
+var upstreamKeepaliveInterval = 5 * time.Minute
+
+var upstreamKeepalivesTotal = metrics.Default.NewCounter("imap_proxy_upstream_keepalives_total",
+	"NOOP commands sent to the upstream to keep quiet sessions alive.")
+
+// keepalive sends internally tagged NOOPs to the upstream and keeps their
+// responses out of the client stream. Untagged data the NOOP produces, such
+// as EXISTS or EXPUNGE, is held back until the client's next response so
+// the client never sees it outside of a command.
+type keepalive struct {
+	mem *memoryBudget // accounts for held lines
+
+	mu   sync.Mutex
+	seq  int
+	tag  string   // tag of the NOOP in flight, or ""
+	held []string // untagged lines received while the NOOP was in flight
+}
+
+// next returns the tag for a new NOOP and marks it in flight.
+func (k *keepalive) next() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.seq++
+	k.tag = internalTag("k", k.seq)
+	return k.tag
+}
+
+// intercept reports whether an upstream line belongs to a keepalive NOOP
+// and must not be relayed now. Lines carrying a literal are never held.
+func (k *keepalive) intercept(line string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.tag == "" {
+		return false
+	}
+	if strings.HasPrefix(line, k.tag+" ") {
+		k.tag = ""
+		return true
+	}
+	if _, _, hasLiteral := imap.ParseLiteral([]byte(line)); hasLiteral || !strings.HasPrefix(line, "* ") {
+		return false
+	}
+	k.held = append(k.held, line)
+	k.mem.hold(len(line))
+	return true
+}
+
+// release returns and clears the held lines once the NOOP has completed.
+func (k *keepalive) release() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.tag != "" || len(k.held) == 0 {
+		return nil
+	}
+	held := k.held
+	k.held = nil
+	for _, line := range held {
+		k.mem.free(len(line))
+	}
+	return held
+}
+
+// abandon forgets a NOOP whose connection was lost, so that lines it
+// held are released with the next response.
+func (k *keepalive) abandon() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.tag = ""
+}
+
+// flushKeepalive writes untagged lines held back from a keepalive NOOP.
+func (s *Session) flushKeepalive(out io.Writer) error {
+	for _, line := range s.keepalive.release() {
+		if _, err := io.WriteString(out, line); err != nil {
+			return err
+		}
+		s.countDownload(len(line))
+		s.usage.relayed(line, len(line))
+	}
+	return nil
+}
+
+// keepaliveSchedule returns the account's NOOP interval and jitter. The
+// interval is zero when the account disables keepalives.
+func (s *Session) keepaliveSchedule() (interval, jitter time.Duration) {
+	switch {
+	case s.account.DisableNoop:
+		return 0, 0
+	case s.account.NoopInterval > 0:
+		return s.account.NoopInterval, s.account.NoopJitter
+	}
+	return s.keepaliveInterval, s.account.NoopJitter
+}
+
+// jittered returns interval extended by a random duration up to jitter.
+func jittered(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + rand.N(jitter+1)
+}
+
+// runKeepalive sends a NOOP whenever the upstream has had no command for
+// interval plus a random part of jitter, drawn anew after every NOOP, the
+// session is not in IDLE and nothing is outstanding. It returns when done
+// is closed, or at once when interval is zero.
+func (s *Session) runKeepalive(interval, jitter time.Duration, done <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(interval/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	wait := jittered(interval, jitter)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sent, err := s.sendKeepalive(wait)
+			if err != nil {
+				s.logger.Debug("upstream keepalive failed", "err", err)
+				return
+			}
+			if sent {
+				wait = jittered(interval, jitter)
+			}
+		}
+	}
+}
+
+// sendKeepalive sends one NOOP if the session has been quiet for interval,
+// and reports whether it did.
+func (s *Session) sendKeepalive(interval time.Duration) (bool, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.idling.Load() || !s.deadline.quietFor(interval) {
+		return false, nil
+	}
+	s.deadline.expect()
+	if _, err := fmt.Fprintf(s.upstreamConn, "%s NOOP\r\n", s.keepalive.next()); err != nil {
+		return false, err
+	}
+	upstreamKeepalivesTotal.Inc()
+	return true, nil
+}
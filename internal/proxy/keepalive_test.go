@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestKeepaliveIntercept(t *testing.T) {
+	var k keepalive
+	if k.intercept("* 1 EXISTS\r\n") {
+		t.Fatal("line intercepted without a NOOP in flight")
+	}
+	tag := k.next()
+	if tag != "proxyk1" {
+		t.Fatalf("tag = %q, want proxyk1", tag)
+	}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"* 4 EXISTS\r\n", true},
+		{"* 1 FETCH (BODY[] {5}\r\n", false}, // literals are relayed directly
+		{"* 2 EXPUNGE\r\n", true},
+		{"A1 OK done\r\n", false},
+		{"proxyk1 OK NOOP completed\r\n", true},
+		{"* 5 EXISTS\r\n", false}, // the NOOP has completed
+	}
+	for i, tt := range tests {
+		if i == 4 {
+			if held := k.release(); held != nil {
+				t.Fatalf("released %q while the NOOP was in flight", held)
+			}
+		}
+		if got := k.intercept(tt.line); got != tt.want {
+			t.Errorf("step %d: intercept(%q) = %v, want %v", i, tt.line, got, tt.want)
+		}
+	}
+	held := k.release()
+	if len(held) != 2 || held[0] != "* 4 EXISTS\r\n" || held[1] != "* 2 EXPUNGE\r\n" {
+		t.Errorf("released %q", held)
+	}
+	if held := k.release(); held != nil {
+		t.Errorf("released %q twice", held)
+	}
+}
+
+// newKeepaliveEnv starts a session whose upstream answers every NOOP with
+// the given untagged lines before the tagged completion.
+func newKeepaliveEnv(t *testing.T, untagged ...string) *integrationEnv {
+	t.Helper()
+	received := make(chan string, 100)
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					received <- line
+					tag, verb, _ := strings.Cut(line, " ")
+					if verb == "NOOP" {
+						for _, u := range untagged {
+							fmt.Fprint(upServer, u)
+						}
+					}
+					fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	return env
+}
+
+func TestKeepaliveNoopHiddenFromClient(t *testing.T) {
+	defer func(d time.Duration) { upstreamKeepaliveInterval = d }(upstreamKeepaliveInterval)
+	upstreamKeepaliveInterval = 50 * time.Millisecond
+
+	env := newKeepaliveEnv(t, "* 3 EXPUNGE\r\n", "* 9 EXISTS\r\n")
+	defer env.clientConn.Close()
+	env.login(t)
+
+	before := upstreamKeepalivesTotal.Value()
+	if cmd := env.expectUpstream(t, "NOOP"); !strings.HasPrefix(cmd, "proxyk") {
+		t.Fatalf("keepalive = %q, want an internally tagged NOOP", cmd)
+	}
+
+	// The NOOP's untagged data is delivered with the client's next command,
+	// and its tagged completion never is.
+	env.send(t, "A002 LIST \"\" \"*\"\r\n")
+	lines := env.readUntilTagged(t, "A002")
+	if len(lines) < 3 || lines[0] != "* 3 EXPUNGE\r\n" || lines[1] != "* 9 EXISTS\r\n" {
+		t.Fatalf("response = %q, want held untagged lines first", lines)
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "proxyk") {
+			t.Fatalf("keepalive completion relayed to client: %q", lines)
+		}
+	}
+	if got := upstreamKeepalivesTotal.Value(); got < before+1 {
+		t.Errorf("keepalive counter = %v, want at least %v", got, before+1)
+	}
+}
+
+func TestKeepaliveSkipsIdle(t *testing.T) {
+	defer func(d time.Duration) { upstreamKeepaliveInterval = d }(upstreamKeepaliveInterval)
+	upstreamKeepaliveInterval = 50 * time.Millisecond
+
+	env := newIntegrationEnv(t)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 IDLE\r\n")
+	env.expectUpstream(t, "A002 IDLE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got: %q", line)
+	}
+	time.Sleep(200 * time.Millisecond)
+	env.noUpstream(t)
+
+	env.send(t, "DONE\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("expected IDLE completion, got: %q", line)
+	}
+}
+
+func TestKeepaliveSchedule(t *testing.T) {
+	tests := []struct {
+		name         string
+		acct         config.AccountConfig
+		wantInterval time.Duration
+		wantJitter   time.Duration
+	}{
+		{"default", config.AccountConfig{}, 5 * time.Minute, 0},
+		{"configured", config.AccountConfig{NoopInterval: time.Minute, NoopJitter: 10 * time.Second}, time.Minute, 10 * time.Second},
+		{"jitter only", config.AccountConfig{NoopJitter: time.Second}, 5 * time.Minute, time.Second},
+		{"disabled", config.AccountConfig{NoopInterval: time.Minute, DisableNoop: true}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Session{account: &tt.acct, keepaliveInterval: 5 * time.Minute}
+			interval, jitter := s.keepaliveSchedule()
+			if interval != tt.wantInterval || jitter != tt.wantJitter {
+				t.Errorf("schedule = %v, %v, want %v, %v", interval, jitter, tt.wantInterval, tt.wantJitter)
+			}
+		})
+	}
+}
+
+func TestJittered(t *testing.T) {
+	if got := jittered(time.Minute, 0); got != time.Minute {
+		t.Errorf("without jitter = %v, want 1m", got)
+	}
+	for range 100 {
+		if got := jittered(time.Minute, time.Second); got < time.Minute || got > time.Minute+time.Second {
+			t.Fatalf("jittered = %v, want between 1m and 1m1s", got)
+		}
+	}
+}
+
+func TestKeepaliveAccountInterval(t *testing.T) {
+	// The default would not send a NOOP during the test.
+	cfg := testConfig()
+	cfg.Accounts[0].NoopInterval = 50 * time.Millisecond
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	if cmd := env.expectUpstream(t, "NOOP"); !strings.HasPrefix(cmd, "proxyk") {
+		t.Fatalf("keepalive = %q, want an internally tagged NOOP", cmd)
+	}
+}
+
+func TestKeepaliveDisabled(t *testing.T) {
+	defer func(d time.Duration) { upstreamKeepaliveInterval = d }(upstreamKeepaliveInterval)
+	upstreamKeepaliveInterval = 50 * time.Millisecond
+
+	cfg := testConfig()
+	cfg.Accounts[0].DisableNoop = true
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	time.Sleep(200 * time.Millisecond)
+	env.noUpstream(t)
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var largeMessagesTotal = metrics.Default.NewCounter("imap_proxy_large_message_fetches_total",
+	"Messages over max_message_size_mb whose content FETCH was cut short or refused, by action.", "action")
+
+// fetchSized fetches f for set, keeping messages larger than the account's
+// max_message_size_mb from being downloaded in full. It returns the status
+// to complete the client's command with if it did not succeed.
+func (s *Session) fetchSized(f fetchCommand, set string) (string, error) {
+	limit := s.account.MaxMessageSize()
+	if limit <= 0 {
+		return s.fetchItems(f, set, f.items)
+	}
+	larger := fmt.Sprintf("LARGER %d", limit)
+	large, err := s.searchSet(f, set, larger)
+	if err != nil {
+		s.logger.Debug("failed to find large messages", "err", err)
+		return s.fetchItems(f, set, f.items)
+	}
+	if len(large) == 0 {
+		return s.fetchItems(f, set, f.items)
+	}
+
+	s.logger.Warn("FETCH of large messages", "verb", f.verb, "messages", len(large),
+		"limit_mb", s.account.MaxMessageSizeMB, "action", s.account.LargeMessageAction)
+	largeMessagesTotal.Add(float64(len(large)), s.account.LargeMessageAction)
+	if s.account.LargeMessageAction == config.LargeMessageReject {
+		return fmt.Sprintf("NO [TOOBIG] %d messages are larger than %d MB\r\n", len(large), s.account.MaxMessageSizeMB), nil
+	}
+
+	small, err := s.searchSet(f, set, "NOT "+larger)
+	if err != nil {
+		return "", err
+	}
+	if len(small) > 0 {
+		if status, err := s.fetchItems(f, imap.FormatSeqSet(small), f.items); status != "" || err != nil {
+			return status, err
+		}
+	}
+	return s.fetchItems(f, imap.FormatSeqSet(large), partialItems(f.items, limit))
+}
+
+// partialItems rewrites FETCH items so that no content item returns more
+// than n bytes: whole sections get a <0.n> partial, longer partials are
+// shortened, and RFC822 and RFC822.TEXT become the equivalent BODY
+// sections. Header and MIME sections are left alone.
+func partialItems(items string, n int64) string {
+	upper := strings.ToUpper(items)
+	var b strings.Builder
+	for i := 0; i < len(items); {
+		if i > 0 && items[i-1] != ' ' && items[i-1] != '(' {
+			b.WriteByte(items[i])
+			i++
+			continue
+		}
+		if end, ok := atomEnd(upper, i, "RFC822.TEXT"); ok {
+			fmt.Fprintf(&b, "BODY[TEXT]<0.%d>", n)
+			i = end
+			continue
+		}
+		if end, ok := atomEnd(upper, i, "RFC822"); ok {
+			fmt.Fprintf(&b, "BODY[]<0.%d>", n)
+			i = end
+			continue
+		}
+		prefix := ""
+		for _, p := range contentSections {
+			if strings.HasPrefix(upper[i:], p) {
+				prefix = p
+			}
+		}
+		closing := strings.IndexByte(items[i:], ']')
+		if prefix == "" || closing < 0 {
+			b.WriteByte(items[i])
+			i++
+			continue
+		}
+		j := i + closing + 1
+		section := upper[i+len(prefix) : j-1]
+		b.WriteString(items[i:j])
+		i = j
+		if strings.Contains(section, "HEADER") || strings.HasSuffix(section, "MIME") {
+			continue
+		}
+		origin, length, end, ok := parsePartial(items, i)
+		if !ok {
+			fmt.Fprintf(&b, "<0.%d>", n)
+			continue
+		}
+		fmt.Fprintf(&b, "<%d.%d>", origin, min(length, n))
+		i = end
+	}
+	return b.String()
+}
+
+// atomEnd reports whether the atom starting at upper[i] is name and
+// returns where it ends.
+func atomEnd(upper string, i int, name string) (int, bool) {
+	if !strings.HasPrefix(upper[i:], name) {
+		return 0, false
+	}
+	end := i + len(name)
+	if end < len(upper) && !strings.ContainsRune(" )\r\n", rune(upper[end])) {
+		return 0, false
+	}
+	return end, true
+}
+
+// parsePartial parses a <origin.length> partial starting at items[i].
+func parsePartial(items string, i int) (origin, length int64, end int, ok bool) {
+	if i >= len(items) || items[i] != '<' {
+		return 0, 0, 0, false
+	}
+	closing := strings.IndexByte(items[i:], '>')
+	if closing < 0 {
+		return 0, 0, 0, false
+	}
+	o, l, found := strings.Cut(items[i+1:i+closing], ".")
+	origin, oErr := strconv.ParseInt(o, 10, 64)
+	length, lErr := strconv.ParseInt(l, 10, 64)
+	if !found || oErr != nil || lErr != nil {
+		return 0, 0, 0, false
+	}
+	return origin, length, i + closing + 1, true
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestPartialItems(t *testing.T) {
+	tests := []struct {
+		items string
+		want  string
+	}{
+		{"BODY[]\r\n", "BODY[]<0.100>\r\n"},
+		{"(UID BODY.PEEK[] FLAGS)\r\n", "(UID BODY.PEEK[]<0.100> FLAGS)\r\n"},
+		{"(BODY.PEEK[2]<0.5000>)\r\n", "(BODY.PEEK[2]<0.100>)\r\n"},
+		{"(BODY.PEEK[TEXT]<40.50>)\r\n", "(BODY.PEEK[TEXT]<40.50>)\r\n"},
+		{"(BODY.PEEK[HEADER.FIELDS (FROM)] BINARY[1])\r\n", "(BODY.PEEK[HEADER.FIELDS (FROM)] BINARY[1]<0.100>)\r\n"},
+		{"(RFC822 RFC822.SIZE)\r\n", "(BODY[]<0.100> RFC822.SIZE)\r\n"},
+		{"rfc822.text\r\n", "BODY[TEXT]<0.100>\r\n"},
+		{"(FLAGS RFC822.HEADER)\r\n", "(FLAGS RFC822.HEADER)\r\n"},
+	}
+	for _, tt := range tests {
+		if got := partialItems(tt.items, 100); got != tt.want {
+			t.Errorf("partialItems(%q) = %q, want %q", tt.items, got, tt.want)
+		}
+	}
+}
+
+func TestLargeMessagesPartial(t *testing.T) {
+	env := newViewEnv(t, func(acct *config.AccountConfig) {
+		acct.MaxMessageSizeMB = 1
+		acct.LargeMessageAction = config.LargeMessagePartial
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	// The fake upstream reports every message as large.
+	env.send(t, "A002 FETCH 1:2 (BODY.PEEK[])\r\n")
+	lines := env.readUntilTagged(t, "A002")
+	if last := lines[len(lines)-1]; last != "A002 OK FETCH completed\r\n" {
+		t.Fatalf("FETCH response = %q", lines)
+	}
+	env.expectUpstream(t, "SEARCH 1:2 LARGER 1048576")
+	env.expectUpstream(t, "SEARCH 1:2 NOT LARGER 1048576")
+	env.expectUpstream(t, "FETCH 1:5 (BODY.PEEK[]<0.1048576>)")
+	env.noUpstream(t)
+
+	// Header fetches are not affected.
+	env.send(t, "A003 FETCH 1:2 (BODY.PEEK[HEADER])\r\n")
+	env.expectUpstream(t, "A003 FETCH 1:2 (BODY.PEEK[HEADER])")
+	env.readUntilTagged(t, "A003")
+}
+
+func TestLargeMessagesRejected(t *testing.T) {
+	env := newViewEnv(t, func(acct *config.AccountConfig) {
+		acct.MaxMessageSizeMB = 1
+		acct.LargeMessageAction = config.LargeMessageReject
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 UID FETCH 10:20 BODY[]\r\n")
+	env.expectUpstream(t, "UID SEARCH UID 10:20 LARGER 1048576")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 NO [TOOBIG]") {
+		t.Fatalf("got %q, want NO [TOOBIG]", line)
+	}
+	env.noUpstream(t)
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+var (
+	activeSessionsGauge = metrics.Default.NewGauge("imap_proxy_sessions_active",
+		"Authenticated sessions currently holding an upstream connection.")
+	limitRejectionsTotal = metrics.Default.NewCounter("imap_proxy_limit_rejections_total",
+		"Logins rejected because a concurrency limit was reached.", "scope")
+)
+
+// sessionLimits counts authenticated sessions globally and per account.
+type sessionLimits struct {
+	mu        sync.Mutex
+	total     int
+	perUser   map[string]int
+	releasedC chan struct{} // closed and replaced whenever a slot is released
+}
+
+func newSessionLimits() *sessionLimits {
+	return &sessionLimits{
+		perUser:   make(map[string]int),
+		releasedC: make(chan struct{}),
+	}
+}
+
+// acquire reserves a session slot for user. maxTotal and maxUser of zero
+// mean unlimited. If no slot is free, acquire waits up to wait for one to
+// be released. It returns a release func, or the scope ("global" or
+// "account") of the limit that was hit.
+func (l *sessionLimits) acquire(user string, maxTotal, maxUser int, wait time.Duration) (release func(), scope string) {
+	deadline := time.Now().Add(wait)
+	for {
+		l.mu.Lock()
+		switch {
+		case maxTotal > 0 && l.total >= maxTotal:
+			scope = "global"
+		case maxUser > 0 && l.perUser[user] >= maxUser:
+			scope = "account"
+		default:
+			l.total++
+			l.perUser[user]++
+			l.mu.Unlock()
+			activeSessionsGauge.Inc()
+			var once sync.Once
+			return func() { once.Do(func() { l.release(user) }) }, ""
+		}
+		released := l.releasedC
+		l.mu.Unlock()
+
+		if !waitRelease(released, deadline) {
+			limitRejectionsTotal.Inc(scope)
+			return nil, scope
+		}
+	}
+}
+
+// waitRelease waits for released to be closed until deadline. It reports
+// false if the deadline passed first.
+func waitRelease(released <-chan struct{}, deadline time.Time) bool {
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return false
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-released:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *sessionLimits) release(user string) {
+	l.mu.Lock()
+	l.total--
+	l.perUser[user]--
+	if l.perUser[user] <= 0 {
+		delete(l.perUser, user)
+	}
+	close(l.releasedC)
+	l.releasedC = make(chan struct{})
+	l.mu.Unlock()
+	activeSessionsGauge.Dec()
+}
+
+// count returns the number of sessions held globally and by user.
+func (l *sessionLimits) count(user string) (total, forUser int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total, l.perUser[user]
+}
+
+// ErrHostLimit is returned by HostLimits.Acquire when the upstream host
+// has max_connections_per_host connections open and none was closed
+// within limit_queue_timeout.
+var ErrHostLimit = errors.New("too many connections to the upstream host")
+
+// HostLimits caps concurrent connections to each upstream host at
+// max_connections_per_host. IMAP and POP3 sessions, the HTTP gateways,
+// blocked command digests, backups, export and watch all take a slot for
+// every upstream connection they open. A nil *HostLimits does not limit.
+type HostLimits struct {
+	max  int
+	wait time.Duration
+
+	mu        sync.Mutex
+	perHost   map[string]int
+	releasedC chan struct{} // closed and replaced whenever a slot is released
+}
+
+// NewHostLimits returns the limits set by sc's max_connections_per_host
+// and limit_queue_timeout.
+func NewHostLimits(sc config.ServerConfig) *HostLimits {
+	return &HostLimits{
+		max:       sc.MaxConnectionsPerHost,
+		wait:      sc.LimitQueueTimeout,
+		perHost:   make(map[string]int),
+		releasedC: make(chan struct{}),
+	}
+}
+
+// Acquire reserves a connection to the upstream host of acct, waiting up
+// to limit_queue_timeout for one to be released. It returns a func that
+// releases the slot, or ErrHostLimit. Local upstreams are not limited.
+func (l *HostLimits) Acquire(acct *config.AccountConfig) (release func(), err error) {
+	host := upstreamHost(acct)
+	if l == nil || l.max <= 0 || host == "" {
+		return func() {}, nil
+	}
+	deadline := time.Now().Add(l.wait)
+	for {
+		l.mu.Lock()
+		if l.perHost[host] < l.max {
+			l.perHost[host]++
+			l.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { l.release(host) }) }, nil
+		}
+		released := l.releasedC
+		l.mu.Unlock()
+
+		if !waitRelease(released, deadline) {
+			limitRejectionsTotal.Inc("host")
+			return nil, ErrHostLimit
+		}
+	}
+}
+
+func (l *HostLimits) release(host string) {
+	l.mu.Lock()
+	if l.perHost[host]--; l.perHost[host] <= 0 {
+		delete(l.perHost, host)
+	}
+	close(l.releasedC)
+	l.releasedC = make(chan struct{})
+	l.mu.Unlock()
+}
+
+// HostLimits returns the server's per-host connection limits, for
+// upstream connections opened outside its sessions.
+func (s *Server) HostLimits() *HostLimits {
+	return s.shared.hosts
+}
+
+// upstreamHost returns the host whose connections max_connections_per_host
+// counts: remote_host (any port) or remote_srv_domain. Local upstreams
+// have none.
+func upstreamHost(acct *config.AccountConfig) string {
+	switch {
+	case acct.UpstreamPath != "":
+		return ""
+	case acct.RemoteSRVDomain != "":
+		return acct.RemoteSRVDomain
+	default:
+		return strings.ToLower(acct.RemoteHost)
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestSessionLimitsAcquire(t *testing.T) {
+	tests := []struct {
+		name      string
+		held      []string // users already holding a slot
+		user      string
+		maxTotal  int
+		maxUser   int
+		wantScope string
+	}{
+		{name: "unlimited", held: []string{"a", "a", "b"}, user: "a"},
+		{name: "global free", held: []string{"a"}, user: "b", maxTotal: 2},
+		{name: "global full", held: []string{"a", "b"}, user: "c", maxTotal: 2, wantScope: "global"},
+		{name: "account free", held: []string{"a", "b"}, user: "b", maxUser: 2},
+		{name: "account full", held: []string{"b", "b"}, user: "b", maxUser: 2, wantScope: "account"},
+		{name: "other account unaffected", held: []string{"b", "b"}, user: "a", maxUser: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newSessionLimits()
+			for _, u := range tt.held {
+				if rel, _ := l.acquire(u, 0, 0, 0); rel == nil {
+					t.Fatal("setup acquire failed")
+				}
+			}
+			rel, scope := l.acquire(tt.user, tt.maxTotal, tt.maxUser, 0)
+			if scope != tt.wantScope {
+				t.Fatalf("scope = %q, want %q", scope, tt.wantScope)
+			}
+			if (rel == nil) != (tt.wantScope != "") {
+				t.Fatalf("release func = %v, want nil only when rejected", rel != nil)
+			}
+		})
+	}
+}
+
+func TestHostLimits(t *testing.T) {
+	l := NewHostLimits(config.ServerConfig{MaxConnectionsPerHost: 1})
+	a := &config.AccountConfig{RemoteHost: "imap.example.com", RemotePort: 993}
+	b := &config.AccountConfig{RemoteHost: "IMAP.example.com", RemotePort: 143}
+	rel, err := l.Acquire(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(b); !errors.Is(err, ErrHostLimit) {
+		t.Fatalf("second connection to the host: err = %v, want ErrHostLimit", err)
+	}
+	if _, err := l.Acquire(&config.AccountConfig{RemoteHost: "imap.example.net"}); err != nil {
+		t.Fatal("another host should be unaffected")
+	}
+	if _, err := l.Acquire(&config.AccountConfig{UpstreamPath: "/srv/mail"}); err != nil {
+		t.Fatal("a local upstream should not be limited")
+	}
+	rel()
+	rel() // idempotent
+	if _, err := l.Acquire(b); err != nil {
+		t.Fatal("acquire after release should succeed")
+	}
+	var unlimited *HostLimits
+	if _, err := unlimited.Acquire(a); err != nil {
+		t.Fatal("a nil HostLimits should not limit")
+	}
+}
+
+func TestUpstreamHost(t *testing.T) {
+	tests := []struct {
+		acct config.AccountConfig
+		want string
+	}{
+		{config.AccountConfig{RemoteHost: "IMAP.example.com", RemotePort: 993}, "imap.example.com"},
+		{config.AccountConfig{RemoteSRVDomain: "example.com"}, "example.com"},
+		{config.AccountConfig{UpstreamPath: "/srv/mail"}, ""},
+	}
+	for _, tt := range tests {
+		if got := upstreamHost(&tt.acct); got != tt.want {
+			t.Errorf("upstreamHost(%+v) = %q, want %q", tt.acct, got, tt.want)
+		}
+	}
+}
+
+func TestIntegrationMaxConnectionsPerHost(t *testing.T) {
+	cfg := testConfig()
+	second := cfg.Accounts[0]
+	second.LocalUser, second.LocalPassword = "reader2", "localpass2"
+	cfg.Accounts = append(cfg.Accounts, second)
+	cfg.Server.MaxConnectionsPerHost = 1
+	sh := newShared()
+	sh.hosts = NewHostLimits(cfg.Server)
+	withShared := func(s *Session) { s.shared = sh }
+
+	first := newIntegrationEnvWithConfig(t, cfg, withShared)
+	defer first.clientConn.Close()
+	first.login(t)
+
+	other := newIntegrationEnvWithConfig(t, cfg, withShared)
+	defer other.clientConn.Close()
+	other.readLine(t) // greeting
+	other.send(t, "A001 LOGIN reader2 localpass2\r\n")
+	if line := other.readLine(t); line != "A001 NO [LIMIT] too many sessions\r\n" {
+		t.Fatalf("expected NO [LIMIT] for a second account on the same host, got: %q", line)
+	}
+}
+
+func TestSessionLimitsRelease(t *testing.T) {
+	l := newSessionLimits()
+	rel, _ := l.acquire("a", 1, 0, 0)
+	if r, _ := l.acquire("b", 1, 0, 0); r != nil {
+		t.Fatal("second acquire should fail at max_connections=1")
+	}
+	rel()
+	rel() // idempotent
+	if total, _ := l.count("a"); total != 0 {
+		t.Fatalf("total after release = %d, want 0", total)
+	}
+	if r, _ := l.acquire("b", 1, 0, 0); r == nil {
+		t.Fatal("acquire after release should succeed")
+	}
+}
+
+func TestSessionLimitsQueue(t *testing.T) {
+	l := newSessionLimits()
+	rel, _ := l.acquire("a", 0, 1, 0)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rel()
+	}()
+
+	start := time.Now()
+	r, scope := l.acquire("a", 0, 1, 2*time.Second)
+	if r == nil {
+		t.Fatalf("queued acquire rejected with scope %q", scope)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("acquire returned after %v, expected to wait for release", waited)
+	}
+
+	start = time.Now()
+	if r, _ := l.acquire("a", 0, 1, 50*time.Millisecond); r != nil {
+		t.Fatal("acquire should time out while slot is held")
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("timed out after %v, expected ~50ms", waited)
+	}
+}
+
+func TestIntegrationMaxSessionsPerAccount(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].MaxSessions = 1
+	sh := newShared()
+	withShared := func(s *Session) { s.shared = sh }
+
+	first := newIntegrationEnvWithConfig(t, cfg, withShared)
+	defer first.clientConn.Close()
+	first.login(t)
+
+	second := newIntegrationEnvWithConfig(t, cfg, withShared)
+	defer second.clientConn.Close()
+	second.readLine(t) // greeting
+	second.send(t, "A001 LOGIN reader1 localpass1\r\n")
+	if line := second.readLine(t); line != "A001 NO [LIMIT] too many sessions\r\n" {
+		t.Fatalf("expected NO [LIMIT], got: %q", line)
+	}
+
+	// Logging out the first session frees the slot.
+	first.send(t, "A002 LOGOUT\r\n")
+	first.readUntilTagged(t, "A002")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, n := sh.limits.count("reader1"); n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot not released after LOGOUT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second.send(t, "A002 LOGIN reader1 localpass1\r\n")
+	second.drainUpstream(t)
+	if line := second.readLine(t); !strings.Contains(line, "A002 OK LOGIN") {
+		t.Fatalf("expected LOGIN OK after release, got: %q", line)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+// Lockout defaults applied when the corresponding config value is zero.
+const (
+	defaultLockoutDuration    = time.Minute
+	defaultLockoutMaxDuration = time.Hour
+)
+
+var accountLockoutsTotal = metrics.Default.NewCounter("imap_proxy_account_lockouts_total",
+	"Accounts temporarily locked after repeated failed logins.")
+
+// accountLockout tracks consecutive failed logins per username. It is keyed
+// on the name the client sent, whether or not the account exists, so that
+// lockout behaviour does not reveal which usernames are valid. Since any
+// client can make up names, the state for a name expires once it has been
+// neither locked nor failed for the maximum lock duration, and expired
+// entries are swept.
+type accountLockout struct {
+	now func() time.Time
+	// state, if set, holds the failure counts and locks instead of entries.
+	state *sharedState
+
+	mu        sync.Mutex
+	entries   map[string]*lockState
+	lastSweep time.Time
+}
+
+type lockState struct {
+	failures    int       // consecutive failures since the last lock or success
+	lockouts    int       // consecutive lockouts since the last success
+	lockedUntil time.Time // zero when not locked
+	expires     time.Time // when the entry may be forgotten
+}
+
+func newAccountLockout() *accountLockout {
+	return &accountLockout{now: time.Now, entries: make(map[string]*lockState)}
+}
+
+// locked reports whether user is currently locked and until when.
+func (l *accountLockout) locked(user string) (bool, time.Time) {
+	now := l.now()
+	if l.state != nil {
+		if locked, until, ok := l.sharedLocked(user, now); ok {
+			return locked, until
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.entries[user]
+	if !ok || !now.Before(st.lockedUntil) {
+		return false, time.Time{}
+	}
+	return true, st.lockedUntil
+}
+
+// failure records a failed login for user. When the failure reaches
+// lc.MaxFailures it locks the account and returns the lock duration, which
+// doubles with each consecutive lockout up to lc.MaxDuration.
+func (l *accountLockout) failure(user string, lc config.LockoutConfig) time.Duration {
+	if lc.MaxFailures <= 0 {
+		return 0
+	}
+	if l.state != nil {
+		if d, ok := l.sharedFailure(user, lc); ok {
+			return d
+		}
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= ipSweepInterval {
+		l.sweep(now)
+	}
+	st, ok := l.entries[user]
+	if !ok || !now.Before(st.expires) {
+		st = &lockState{}
+		l.entries[user] = st
+	}
+	st.failures++
+	st.expires = now.Add(lockoutMaxDuration(lc))
+	if st.failures < lc.MaxFailures {
+		return 0
+	}
+
+	d := lockoutDuration(lc, st.lockouts)
+	st.failures = 0
+	st.lockouts++
+	st.lockedUntil = now.Add(d)
+	st.expires = st.lockedUntil.Add(lockoutMaxDuration(lc))
+	accountLockoutsTotal.Inc()
+	return d
+}
+
+// sweep drops expired entries, since a fresh entry would behave
+// identically; l.mu must be held.
+func (l *accountLockout) sweep(now time.Time) {
+	for user, st := range l.entries {
+		if !now.Before(st.expires) {
+			delete(l.entries, user)
+		}
+	}
+	l.lastSweep = now
+}
+
+// lockoutDuration is how long an account is locked after lockouts
+// previous consecutive lockouts.
+func lockoutDuration(lc config.LockoutConfig, lockouts int) time.Duration {
+	base := lc.Duration
+	if base <= 0 {
+		base = defaultLockoutDuration
+	}
+	maxDur := lockoutMaxDuration(lc)
+	d := base
+	for i := 0; i < lockouts && d < maxDur; i++ {
+		d *= 2
+	}
+	return min(d, maxDur)
+}
+
+// lockoutMaxDuration is the longest lock, which is also how long failures
+// and lockouts are remembered after the last of them.
+func lockoutMaxDuration(lc config.LockoutConfig) time.Duration {
+	if lc.MaxDuration <= 0 {
+		return defaultLockoutMaxDuration
+	}
+	return lc.MaxDuration
+}
+
+// success clears all failure state for user.
+func (l *accountLockout) success(user string) {
+	if l.state != nil {
+		l.sharedSuccess(user)
+	}
+	l.mu.Lock()
+	delete(l.entries, user)
+	l.mu.Unlock()
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+func TestAccountLockoutBackoff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newAccountLockout()
+	l.now = func() time.Time { return now }
+	lc := config.LockoutConfig{MaxFailures: 3, Duration: time.Minute, MaxDuration: 5 * time.Minute}
+
+	wantDurations := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for round, want := range wantDurations {
+		for i := 0; i < 2; i++ {
+			if d := l.failure("reader1", lc); d != 0 {
+				t.Fatalf("round %d failure %d locked early (%v)", round, i, d)
+			}
+		}
+		if d := l.failure("reader1", lc); d != want {
+			t.Fatalf("round %d lock duration = %v, want %v", round, d, want)
+		}
+		if locked, until := l.locked("reader1"); !locked || !until.Equal(now.Add(want)) {
+			t.Fatalf("round %d: locked=%v until=%v", round, locked, until)
+		}
+		now = now.Add(want)
+		if locked, _ := l.locked("reader1"); locked {
+			t.Fatalf("round %d: still locked after expiry", round)
+		}
+	}
+
+	// Success resets the backoff.
+	l.success("reader1")
+	for i := 0; i < 2; i++ {
+		l.failure("reader1", lc)
+	}
+	if d := l.failure("reader1", lc); d != time.Minute {
+		t.Fatalf("lock duration after success = %v, want 1m", d)
+	}
+}
+
+func TestAccountLockoutDefaultsAndDisabled(t *testing.T) {
+	l := newAccountLockout()
+	if d := l.failure("x", config.LockoutConfig{}); d != 0 {
+		t.Fatalf("disabled lockout locked for %v", d)
+	}
+	if d := l.failure("x", config.LockoutConfig{MaxFailures: 1}); d != defaultLockoutDuration {
+		t.Fatalf("default duration = %v, want %v", d, defaultLockoutDuration)
+	}
+}
+
+func TestSessionAccountLockout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.Lockout = config.LockoutConfig{MaxFailures: 2, Duration: time.Minute}
+
+	var mu sync.Mutex
+	var events []audit.Event
+	sh := newShared()
+	sh.audit = audit.New(audit.SinkFunc(func(ev audit.Event) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}))
+
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) { s.shared = sh })
+	defer env.clientConn.Close()
+	env.readLine(t) // greeting
+
+	for i := 0; i < 2; i++ {
+		env.send(t, fmt.Sprintf("A%d LOGIN reader1 wrong\r\n", i))
+		if line := env.readLine(t); !strings.Contains(line, "NO LOGIN failed") {
+			t.Fatalf("attempt %d: %q", i, line)
+		}
+	}
+
+	env.send(t, "A9 LOGIN reader1 localpass1\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A9 NO [UNAVAILABLE] account temporarily locked") {
+		t.Fatalf("expected lockout, got %q", line)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	want := []string{audit.LoginFailure, audit.LoginFailure, audit.AccountLocked}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Fatalf("audit events = %v, want %v", types, want)
+	}
+	if events[2].User != "reader1" || events[2].Fields["locked_for"] != "1m0s" {
+		t.Errorf("unexpected lock event: %+v", events[2])
+	}
+}
+
+func TestAccountLockoutExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newAccountLockout()
+	l.now = func() time.Time { return now }
+	lc := config.LockoutConfig{MaxFailures: 2, Duration: time.Minute, MaxDuration: 10 * time.Minute}
+
+	// A lone failure is forgotten after max_duration.
+	l.failure("reader1", lc)
+	now = now.Add(10 * time.Minute)
+	if d := l.failure("reader1", lc); d != 0 {
+		t.Fatalf("failure after the window locked for %v", d)
+	}
+
+	// So is the lockout backoff, counted from the end of the lock.
+	if d := l.failure("reader1", lc); d != time.Minute {
+		t.Fatalf("lock duration = %v, want 1m", d)
+	}
+	now = now.Add(time.Minute + 10*time.Minute)
+	l.failure("reader1", lc)
+	if d := l.failure("reader1", lc); d != time.Minute {
+		t.Fatalf("lock duration after the window = %v, want 1m", d)
+	}
+
+	// Expired names are swept, whoever made them up.
+	for i := range 100 {
+		l.failure(fmt.Sprintf("guess%d", i), lc)
+	}
+	now = now.Add(time.Minute + 10*time.Minute)
+	l.failure("reader2", lc)
+	if n := len(l.entries); n != 1 {
+		t.Errorf("entries after sweep = %d, want 1", n)
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+)
+
+// loginClient is a client attempting to log in: an IMAP or POP3 session,
+// or a request to one of the HTTP gateways. The checks on it are the same
+// whichever way the client came in.
+type loginClient struct {
+	config  *config.Config
+	shared  *shared
+	logger  *slog.Logger
+	ip      string
+	tls     bool              // the client connection is encrypted
+	country func() string     // the client's country, looked up on first use
+	record  func(audit.Event) // records an audit event with the client's details
+	// logAttrs are logged with a honeypot login besides the address and
+	// country, e.g. the client software from ID.
+	logAttrs []any
+}
+
+// loginClient returns the login checks for the session's client.
+func (s *Session) loginClient() *loginClient {
+	return &loginClient{
+		config:   s.config,
+		shared:   s.shared,
+		logger:   s.logger,
+		ip:       s.clientIP,
+		tls:      s.tlsActive,
+		country:  s.country,
+		record:   s.recordAudit,
+		logAttrs: []any{"client_name", s.clientID["name"], "client_version", s.clientID["version"]},
+	}
+}
+
+// loginRefusal describes why login refused a client.
+type loginRefusal struct {
+	// failed marks a refusal that must look like wrong credentials; it is
+	// answered after the configured failure delay.
+	failed bool
+	code   string // IMAP response code such as UNAVAILABLE, or ""
+	text   string
+	// status is the HTTP status the gateways answer with; 0 means 503.
+	status int
+}
+
+var loginFailed = &loginRefusal{failed: true, text: "LOGIN failed", status: http.StatusUnauthorized}
+
+// admit checks whether the client may attempt a login at all.
+func (c *loginClient) admit() *loginRefusal {
+	if !c.config.Server.IPAllowed(c.ip) || !c.config.Server.CountryAllowed(c.country()) {
+		c.logger.Warn("LOGIN refused: source IP not allowed", "client", c.ip, "country", c.country())
+		return loginFailed
+	}
+	if c.shared.ipLimits.banned(c.ip) {
+		c.logger.Warn("LOGIN refused: source IP banned", "client", c.ip)
+		return &loginRefusal{code: "UNAVAILABLE", text: "too many failed logins, try again later", status: http.StatusTooManyRequests}
+	}
+	return nil
+}
+
+// authenticate checks user and pass and the account's lockout, TLS,
+// network and country rules. Failures count toward the source IP's rate
+// limit and the account's lockout. A successful login does not reset the
+// lockout; the caller does that once it has accepted the client.
+func (c *loginClient) authenticate(user, pass string) (*config.AccountConfig, *loginRefusal) {
+	acct := c.config.LookupUser(user)
+	if acct != nil && acct.Honeypot {
+		return nil, c.honeypotLogin(acct, pass)
+	}
+	if locked, until := c.shared.lockout.locked(user); locked {
+		c.logger.Warn("LOGIN refused: account locked", "user", user, "until", until)
+		return nil, &loginRefusal{code: "UNAVAILABLE", text: "account temporarily locked, try again later", status: http.StatusTooManyRequests}
+	}
+
+	// A plaintext LOGIN to an account that requires TLS is refused before
+	// the password is checked, so that it is never verified unencrypted.
+	// When no account takes plaintext logins, LOGINDISABLED has told the
+	// client so, and every user gets the same refusal.
+	if !c.tls && (acct != nil && acct.RequireTLS || loginRequiresTLS(c.config)) {
+		c.logger.Warn("LOGIN refused: account requires TLS", "user", user)
+		c.record(audit.Event{
+			Type: audit.LoginFailure, User: user,
+			Fields: map[string]string{"reason": "tls required"},
+		})
+		return nil, &loginRefusal{code: "PRIVACYREQUIRED", text: "TLS required for this account, use STARTTLS", status: http.StatusForbidden}
+	}
+
+	// Logins from a disallowed network or country fail like any other
+	// login before the password is checked, so they learn nothing about it,
+	// and do not count toward lockout.
+	if acct != nil {
+		if refusal := c.checkSource(acct); refusal != nil {
+			return nil, refusal
+		}
+	}
+
+	// Unknown users and wrong passwords get identical responses and timing;
+	// only the log distinguishes them.
+	acct, ok := c.config.Authenticate(user, pass)
+	if !ok {
+		reason := "wrong password"
+		if acct == nil {
+			reason = "unknown user"
+		}
+		c.logger.Warn("LOGIN failed", "user", user, "reason", reason)
+		c.failed(user, reason)
+		return nil, loginFailed
+	}
+	return acct, nil
+}
+
+// checkSource applies the network and country rules of acct to the
+// client. A refused client gets the same response as a wrong password.
+func (c *loginClient) checkSource(acct *config.AccountConfig) *loginRefusal {
+	if !acct.IPAllowed(c.ip) {
+		c.logger.Warn("LOGIN refused: source IP not allowed for account", "user", acct.LocalUser, "client", c.ip)
+		c.record(audit.Event{
+			Type: audit.LoginFailure, User: acct.LocalUser,
+			Fields: map[string]string{"reason": "network not allowed"},
+		})
+		return loginFailed
+	}
+	if acct.HasCountryFilter() && !acct.CountryAllowed(c.country()) {
+		c.logger.Warn("LOGIN refused: country not allowed for account", "user", acct.LocalUser, "country", c.country())
+		c.record(audit.Event{
+			Type: audit.LoginFailure, User: acct.LocalUser,
+			Fields: map[string]string{"reason": "country not allowed"},
+		})
+		return loginFailed
+	}
+	return nil
+}
+
+// failed counts a failed local authentication against the client's
+// source IP and the attempted username.
+func (c *loginClient) failed(user, reason string) {
+	c.record(audit.Event{
+		Type: audit.LoginFailure, User: user,
+		Fields: map[string]string{"reason": reason},
+	})
+	if c.shared.ipLimits.loginFailed(c.ip, c.config.Server.RateLimit) {
+		c.logger.Warn("source IP banned after repeated login failures", "client", c.ip)
+	}
+	if d := c.shared.lockout.failure(user, c.config.Server.Lockout); d > 0 {
+		c.logger.Warn("account locked after repeated login failures", "user", user, "duration", d)
+		c.record(audit.Event{
+			Type: audit.AccountLocked, User: user,
+			Fields: map[string]string{"locked_for": d.String()},
+		})
+	}
+}
+
+// loginRequiresTLS reports whether every account refuses LOGIN over an
+// unencrypted connection, so that LOGIN cannot succeed before STARTTLS.
+// Honeypot accounts, which never log in, do not count.
+func loginRequiresTLS(cfg *config.Config) bool {
+	for i := range cfg.Accounts {
+		if acct := &cfg.Accounts[i]; !acct.RequireTLS && !acct.Honeypot {
+			return false
+		}
+	}
+	return len(cfg.Accounts) > 0
+}
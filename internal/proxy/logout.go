@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// upstreamLogoutTimeout bounds how long a session waits for the upstream
+// to close the connection after LOGOUT.
+var upstreamLogoutTimeout = time.Second
+
+// logoutUpstream ends the upstream session with LOGOUT once the client has
+// logged out or disconnected, and waits up to upstreamLogoutTimeout for the
+// upstream's BYE and close (signalled by done), so that upstreams do not
+// see an abrupt disconnect. Responses are no longer relayed to the client.
+// It must be called from the client goroutine.
+func (s *Session) logoutUpstream(done <-chan struct{}) {
+	select {
+	case <-done:
+		return // the upstream connection is already gone
+	default:
+	}
+	s.loggingOut.Store(true)
+
+	cmd := s.nextInternalTag() + " LOGOUT\r\n"
+	if relay := s.idle.Load(); relay != nil && relay.upstreamIdling() {
+		cmd = "DONE\r\n" + cmd
+	}
+	s.writeMu.Lock()
+	s.mu.Lock()
+	conn := s.upstreamConn
+	s.mu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(upstreamLogoutTimeout))
+	_, err := fmt.Fprint(conn, cmd)
+	s.writeMu.Unlock()
+	if err != nil {
+		s.logger.Debug("upstream LOGOUT failed", "err", err)
+		return
+	}
+
+	timer := time.NewTimer(upstreamLogoutTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		s.logger.Debug("upstream did not close the connection after LOGOUT")
+	}
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLogoutUpstream(t *testing.T) {
+	env := newFolderFilterEnv(t, nil)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 LOGOUT\r\n")
+	lines := env.readUntilTagged(t, "A002")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "* BYE") || !strings.HasPrefix(lines[1], "A002 OK") {
+		t.Fatalf("LOGOUT response = %q", lines)
+	}
+	env.expectUpstream(t, "proxyv1 LOGOUT")
+
+	// The upstream's BYE and completion are not relayed.
+	if line, err := env.clientR.ReadString('\n'); err != io.EOF {
+		t.Errorf("after LOGOUT read %q, %v, want EOF", line, err)
+	}
+}
+
+func TestLogoutUpstreamOnDisconnect(t *testing.T) {
+	env := newIntegrationEnv(t)
+	env.login(t)
+
+	env.send(t, "A002 IDLE\r\n")
+	env.expectUpstream(t, "A002 IDLE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got: %q", line)
+	}
+	env.clientConn.Close()
+
+	// The fake upstream drops everything but DONE while idling, so LOGOUT
+	// only arrives if the IDLE was ended first.
+	env.expectUpstream(t, "proxyv1 LOGOUT")
+}
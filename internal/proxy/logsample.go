@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+)
+
+// commandLog logs forwarded commands at debug level, thinned out as
+// configured in server.log_sampling. It belongs to the client→upstream
+// goroutine.
+type commandLog struct {
+	every    int
+	interval time.Duration
+	now      func() time.Time
+
+	seen  map[string]int // per verb, for sampling
+	count map[string]int // per verb since the last summary
+	since time.Time
+}
+
+// logForwarded records a forwarded command and logs it if it is sampled.
+// Nothing is counted while debug logging is off.
+func (s *Session) logForwarded(verb string, args ...any) {
+	if !s.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	c := &s.commandLog
+	if c.seen == nil {
+		ls := s.config.Server.LogSampling
+		c.every, c.interval = max(ls.Every, 1), ls.SummaryInterval
+		if c.now == nil {
+			c.now = time.Now
+		}
+		c.seen, c.count, c.since = make(map[string]int), make(map[string]int), c.now()
+	}
+	c.count[verb]++
+	if c.seen[verb]%c.every == 0 {
+		s.logger.Debug("forwarded command", append([]any{"verb", verb}, args...)...)
+	}
+	c.seen[verb]++
+	if c.interval > 0 && c.now().Sub(c.since) >= c.interval {
+		s.logCommandSummary()
+	}
+}
+
+// logCommandSummary logs how many commands of each kind were forwarded
+// since the last summary.
+func (s *Session) logCommandSummary() {
+	c := &s.commandLog
+	if len(c.count) == 0 {
+		return
+	}
+	now := c.now()
+	args := []any{"interval", now.Sub(c.since).Round(time.Second)}
+	for _, verb := range slices.Sorted(maps.Keys(c.count)) {
+		args = append(args, verb, c.count[verb])
+	}
+	s.logger.Debug("forwarded command summary", args...)
+	clear(c.count)
+	c.since = now
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+func TestLogForwardedSampling(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := testConfig()
+	cfg.Server.LogSampling = config.LogSamplingConfig{Every: 3, SummaryInterval: time.Minute}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &Session{
+		config:     cfg,
+		logger:     slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		commandLog: commandLog{now: func() time.Time { return now }},
+	}
+
+	for range 7 {
+		s.logForwarded("FETCH")
+	}
+	s.logForwarded("NOOP")
+	if got := strings.Count(buf.String(), `msg="forwarded command" verb=FETCH`); got != 3 {
+		t.Errorf("logged %d of 7 FETCHes, want 3 (1 in 3):\n%s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), "verb=NOOP") {
+		t.Errorf("first NOOP not logged:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "summary") {
+		t.Fatalf("summary before the interval:\n%s", buf.String())
+	}
+
+	now = now.Add(time.Minute)
+	buf.Reset()
+	s.logForwarded("FETCH")
+	if want := `msg="forwarded command summary" interval=1m0s FETCH=8 NOOP=1`; !strings.Contains(buf.String(), want) {
+		t.Errorf("summary = %q, want %q", buf.String(), want)
+	}
+
+	// The session's final summary covers what the last one did not.
+	now = now.Add(10 * time.Second)
+	s.logForwarded("UID FETCH")
+	buf.Reset()
+	s.logCommandSummary()
+	if want := `msg="forwarded command summary" interval=10s "UID FETCH"=1`; !strings.Contains(buf.String(), want) {
+		t.Errorf("final summary = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestLogForwardedDebugOff(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Session{config: testConfig(), logger: slog.New(slog.NewTextHandler(&buf, nil))}
+	s.logForwarded("FETCH")
+	s.logCommandSummary()
+	if buf.Len() != 0 || s.commandLog.count != nil {
+		t.Errorf("debug off: logged %q, counted %v", buf.String(), s.commandLog.count)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"imap-proxy/internal/metrics"
+)
+
+var sessionMemoryExceededTotal = metrics.Default.NewCounter("imap_proxy_session_memory_exceeded_total",
+	"Sessions closed for exceeding max_session_memory_mb, by the side that sent the data: client or upstream.", "side")
+
+// errMemoryLimit reports data that would take a session over its memory
+// limit.
+var errMemoryLimit = errors.New("session memory limit exceeded")
+
+// memoryBudget accounts for the bytes a session holds in buffered lines,
+// read-ahead literals and queued responses, against max_session_memory_mb.
+// Literals relayed as a stream are not buffered and do not count. A nil
+// budget is unlimited.
+type memoryBudget struct {
+	limit int64 // zero means unlimited
+	used  atomic.Int64
+}
+
+// hold adds n bytes to the session's usage and reports whether it is still
+// within the limit. The bytes are held either way; free gives them back.
+func (m *memoryBudget) hold(n int) bool {
+	if m == nil {
+		return true
+	}
+	used := m.used.Add(int64(n))
+	return m.limit == 0 || used <= m.limit
+}
+
+// free gives back n bytes taken with hold.
+func (m *memoryBudget) free(n int) {
+	if m != nil {
+		m.used.Add(-int64(n))
+	}
+}
+
+// over reports whether the bytes held exceed the limit.
+func (m *memoryBudget) over() bool {
+	return m != nil && m.limit > 0 && m.used.Load() > m.limit
+}
+
+// available returns how many more bytes may be held, or -1 if there is no
+// limit.
+func (m *memoryBudget) available() int64 {
+	if m == nil || m.limit == 0 {
+		return -1
+	}
+	return max(m.limit-m.used.Load(), 0)
+}
+
+// readLine reads a line from r like ReadString('\n'), but fails with
+// errMemoryLimit as soon as the line would not fit in what is left of the
+// session's memory limit, rather than buffering it whole.
+func (s *Session) readLine(r *bufio.Reader) (string, error) {
+	avail := s.memory.available()
+	if avail < 0 {
+		return r.ReadString('\n')
+	}
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if int64(len(line)+len(frag)) > avail {
+			return "", errMemoryLimit
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// memoryExceeded ends the session with a BYE, written to w, after side
+// sent more than it may buffer.
+func (s *Session) memoryExceeded(w io.Writer, side string) {
+	s.logMemoryExceeded(side)
+	io.WriteString(w, "* BYE [LIMIT] session memory limit exceeded\r\n")
+}
+
+func (s *Session) logMemoryExceeded(side string) {
+	s.logger.Warn("session memory limit exceeded, closing session", "side", side, "limit", s.memory.limit)
+	sessionMemoryExceededTotal.Inc(side)
+}
+
+// endOnMemoryLimit ends the session with a BYE, written to w, if err
+// reports client data over the memory limit.
+func (s *Session) endOnMemoryLimit(w io.Writer, err error) {
+	if errors.Is(err, errMemoryLimit) {
+		s.memoryExceeded(w, "client")
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	m := &memoryBudget{limit: 10}
+	if !m.hold(6) || m.available() != 4 {
+		t.Fatalf("after hold(6): available = %d", m.available())
+	}
+	if m.hold(6) || !m.over() {
+		t.Fatal("hold beyond the limit succeeded")
+	}
+	m.free(6)
+	if m.over() || m.available() != 4 {
+		t.Fatalf("after free(6): over = %v, available = %d", m.over(), m.available())
+	}
+
+	var unlimited *memoryBudget
+	if !unlimited.hold(1<<40) || unlimited.over() || unlimited.available() != -1 {
+		t.Error("nil budget is limited")
+	}
+}
+
+func TestReadLineLimit(t *testing.T) {
+	s := &Session{}
+	s.memory.limit = 64
+	s.memory.hold(16)
+
+	r := bufio.NewReaderSize(strings.NewReader("A1 NOOP\r\n"+strings.Repeat("x", 100)+"\r\n"), 16)
+	if line, err := s.readLine(r); err != nil || line != "A1 NOOP\r\n" {
+		t.Fatalf("readLine() = %q, %v", line, err)
+	}
+	if _, err := s.readLine(r); err != errMemoryLimit {
+		t.Fatalf("readLine() of a long line: err = %v, want errMemoryLimit", err)
+	}
+}
+
+func memoryLimitConfig() *config.Config {
+	cfg := testConfig()
+	cfg.Server.MaxSessionMemoryMB = 1
+	return cfg
+}
+
+func TestMemoryLimitClientLine(t *testing.T) {
+	env := newIntegrationEnvWithConfig(t, memoryLimitConfig())
+	defer env.clientConn.Close()
+	env.readLine(t) // greeting
+
+	before := sessionMemoryExceededTotal.Value("client")
+	go fmt.Fprintf(env.clientConn, "A1 LOGIN %s x\r\n", strings.Repeat("u", 2<<20))
+	if line := env.readLine(t); line != "* BYE [LIMIT] session memory limit exceeded\r\n" {
+		t.Fatalf("response = %q, want BYE [LIMIT]", line)
+	}
+	if got := sessionMemoryExceededTotal.Value("client"); got != before+1 {
+		t.Errorf("counter = %v, want %v", got, before+1)
+	}
+}
+
+func TestMemoryLimitUpstreamLine(t *testing.T) {
+	received := make(chan string, 100)
+	env := newIntegrationEnvWithConfig(t, memoryLimitConfig(), func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					received <- line
+					tag, verb, _ := strings.Cut(line, " ")
+					if verb == "NOOP" {
+						fmt.Fprintf(upServer, "* OK %s\r\n", strings.Repeat("x", 2<<20))
+					}
+					fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	defer env.clientConn.Close()
+	env.login(t)
+
+	before := sessionMemoryExceededTotal.Value("upstream")
+	env.send(t, "A002 NOOP\r\n")
+	if line := env.readLine(t); line != "* BYE [LIMIT] session memory limit exceeded\r\n" {
+		t.Fatalf("response = %q, want BYE [LIMIT]", line)
+	}
+	if got := sessionMemoryExceededTotal.Value("upstream"); got != before+1 {
+		t.Errorf("counter = %v, want %v", got, before+1)
+	}
+}
+
+func TestMemoryLimitHeldLines(t *testing.T) {
+	var s Session
+	s.memory.limit = 20
+	s.keepalive.mem = &s.memory
+	s.keepalive.next()
+	s.keepalive.intercept("* 1 EXISTS\r\n")
+	s.keepalive.intercept("* 2 EXISTS\r\n")
+	if !s.memory.over() {
+		t.Fatal("held keepalive lines not counted")
+	}
+	s.keepalive.intercept("proxyk1 OK done\r\n")
+	s.keepalive.release()
+	if s.memory.used.Load() != 0 {
+		t.Errorf("used = %d after release, want 0", s.memory.used.Load())
+	}
+
+	c := &coalescer{interval: 1 << 40, mem: &s.memory, flush: func() {}}
+	c.add("* 3 EXISTS\r\n")
+	c.add("* 4 EXISTS\r\n")
+	if !s.memory.over() {
+		t.Fatal("coalesced lines not counted")
+	}
+	c.take()
+	if s.memory.used.Load() != 0 {
+		t.Errorf("used = %d after take, want 0", s.memory.used.Load())
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+// extractMetadataMailbox returns the mailbox of an RFC 5464 GETMETADATA
+// command, skipping its optional parenthesized options, as in
+// "tag GETMETADATA (DEPTH 1) INBOX /shared/color". An empty result stands
+// for server metadata or an unparseable command.
+func extractMetadataMailbox(cmd imap.Command) string {
+	raw := strings.TrimRight(string(cmd.Raw), "\r\n")
+	parts := strings.SplitN(raw, " ", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	args := parts[2]
+	if strings.HasPrefix(args, "(") {
+		end := strings.IndexByte(args, ')')
+		if end < 0 {
+			return ""
+		}
+		args = strings.TrimLeft(args[end+1:], " ")
+	}
+	if args == "" {
+		return ""
+	}
+	mailbox, _, err := parseOneArg(args)
+	if err != nil {
+		return ""
+	}
+	return mailbox
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+)
+
+func TestExtractMetadataMailbox(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"A1 GETMETADATA INBOX /private/comment\r\n", "INBOX"},
+		{"A1 GETMETADATA (DEPTH infinity) \"Shared Box\" (/shared/color /private/color)\r\n", "Shared Box"},
+		{"A1 GETMETADATA \"\" /shared/admin\r\n", ""},
+		{"A1 GETMETADATA (MAXSIZE 1024\r\n", ""},
+	}
+	for _, tt := range tests {
+		cmd, err := imap.ParseCommand([]byte(tt.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := extractMetadataMailbox(cmd); got != tt.want {
+			t.Errorf("extractMetadataMailbox(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	const metadata = "* METADATA INBOX (/private/comment {11}\r\nhello world /shared/color {7}\r\n#ff0000)\r\n"
+	received := make(chan string, 100)
+	cfg := testConfig()
+	cfg.Accounts[0].BlockedFolders = []string{"Spam"}
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					received <- line
+					tag, rest, _ := strings.Cut(line, " ")
+					if strings.HasPrefix(rest, "GETMETADATA") {
+						fmt.Fprint(upServer, metadata)
+					}
+					fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	defer env.clientConn.Close()
+	env.login(t)
+
+	// Values sent as literals reach the client intact.
+	env.send(t, "A002 GETMETADATA INBOX (/private/comment /shared/color)\r\n")
+	env.expectUpstream(t, "A002 GETMETADATA")
+	var got strings.Builder
+	for _, line := range env.readUntilTagged(t, "A002") {
+		got.WriteString(line)
+	}
+	if want := metadata + "A002 OK completed\r\n"; got.String() != want {
+		t.Errorf("GETMETADATA response = %q, want %q", got.String(), want)
+	}
+
+	// SETMETADATA is refused along with all of its literals.
+	env.send(t, "A003 SETMETADATA INBOX (/private/comment {5+}\r\nhello /shared/color {7+}\r\n#00ff00)\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A003 NO") {
+		t.Fatalf("SETMETADATA = %q, want NO", line)
+	}
+	env.send(t, "A004 GETMETADATA (DEPTH 1) Spam /private/comment\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A004 NO") {
+		t.Fatalf("GETMETADATA of a blocked folder = %q, want NO", line)
+	}
+	env.send(t, "A005 NOOP\r\n")
+	env.expectUpstream(t, "A005 NOOP")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A005 OK") {
+		t.Fatalf("NOOP after SETMETADATA = %q", line)
+	}
+}
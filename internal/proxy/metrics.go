@@ -0,0 +1,14 @@
+package proxy
+
+import (
+	"imap-proxy/internal/buildinfo"
+	"imap-proxy/internal/metrics"
+)
+
+var buildInfoGauge = metrics.Default.NewGauge("imap_proxy_build_info",
+	"Build information about the running binary; the value is always 1.",
+	"version", "commit", "goversion")
+
+func init() {
+	buildInfoGauge.Set(1, buildinfo.Version, buildinfo.CommitHash(), buildinfo.GoVersion())
+}
@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/buildinfo"
+	"imap-proxy/internal/metrics"
+)
+
+func TestBuildInfoMetric(t *testing.T) {
+	if got := buildInfoGauge.Value(buildinfo.Version, buildinfo.CommitHash(), buildinfo.GoVersion()); got != 1 {
+		t.Fatalf("build_info = %v, want 1", got)
+	}
+
+	var b strings.Builder
+	metrics.Default.WriteText(&b)
+	if !strings.Contains(b.String(), `imap_proxy_build_info{version="`+buildinfo.Version+`"`) {
+		t.Errorf("build_info missing from exposition:\n%s", b.String())
+	}
+}
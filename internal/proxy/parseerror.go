@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+// rejectUnparseable answers a line that is not a command with
+// "BAD [PARSE]", tagged if the line starts with a valid tag, and discards
+// its non-synchronizing literals so the next line read is the client's
+// next command. A synchronizing literal is never sent because the client
+// does not get its continuation. The line is not forwarded upstream.
+func (s *Session) rejectUnparseable(line string, parseErr error) error {
+	tag, _, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+	if !imap.ValidTag(tag) {
+		tag = "*"
+	}
+	s.logger.Info("unparseable command", "err", parseErr)
+	fmt.Fprintf(s.clientConn, "%s BAD [PARSE] %s\r\n", tag, parseErr)
+	return s.discardLiterals(line)
+}
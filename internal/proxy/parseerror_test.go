@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectUnparseablePreAuth(t *testing.T) {
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	go NewSession(proxyConn, testConfig(), testLogger()).Run()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(clientConn)
+	readLine(r) // greeting
+
+	tests := []struct {
+		send string
+		want string
+	}{
+		{"\r\n", "* BAD [PARSE] empty command line"},
+		{"a1\r\n", "a1 BAD [PARSE] missing command name after the tag"},
+		{"a+2 \r\n", "* BAD [PARSE] missing command name after the tag"},
+		{" junk {5+}\r\nhello\r\n", "* BAD [PARSE] command line starts with a space instead of a tag"},
+		{"a3 NOOP\r\n", "a3 OK"},
+	}
+	for _, tt := range tests {
+		if _, err := clientConn.Write([]byte(tt.send)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readLine(r)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.send, err)
+		}
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.send, got, tt.want)
+		}
+	}
+}
+
+func TestRejectUnparseablePostAuth(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002\r\n")
+	if got := env.readLine(t); got != "A002 BAD [PARSE] missing command name after the tag\r\n" {
+		t.Errorf("got %q", got)
+	}
+	env.send(t, " garbage {8+}\r\n")
+	if got := env.readLine(t); !strings.HasPrefix(got, "* BAD [PARSE] command line starts with a space") {
+		t.Errorf("got %q", got)
+	}
+	env.send(t, "A003 X\r\n\r\n") // literal data and the rest of the line
+	env.noUpstream(t)
+
+	// The literal was skipped: the next command is the client's A004,
+	// not the literal data.
+	env.send(t, "A004 NOOP\r\n")
+	env.expectUpstream(t, "A004 NOOP")
+	if got := env.readLine(t); !strings.HasPrefix(got, "A004 OK") {
+		t.Errorf("after resync got %q, want A004 OK", got)
+	}
+}
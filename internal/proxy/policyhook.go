@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var policyDecisionsTotal = metrics.Default.NewCounter("imap_proxy_policy_hook_decisions_total",
+	"Decisions of the policy hook: allow, block, rewrite, or error when it failed or answered nonsense.", "decision")
+
+// maxPolicyResponse bounds the decision read from the hook.
+const maxPolicyResponse = 64 << 10
+
+// policyRequest is what the policy hook decides on.
+type policyRequest struct {
+	User     string `json:"user"`
+	ClientIP string `json:"client_ip,omitempty"`
+	Folder   string `json:"folder,omitempty"` // selected folder
+	Tag      string `json:"tag"`
+	Verb     string `json:"verb"`    // e.g. "FETCH" or "UID FETCH"
+	Command  string `json:"command"` // as it would be forwarded, without CRLF
+
+	// APPEND only. Message is base64 in JSON; it is omitted unless
+	// include_message is set and the message fits max_message_kb.
+	Mailbox        string `json:"mailbox,omitempty"`
+	MessageSize    int64  `json:"message_size,omitempty"`
+	Message        []byte `json:"message,omitempty"`
+	MessageOmitted bool   `json:"message_omitted,omitempty"`
+}
+
+// policyDecision is the hook's answer.
+type policyDecision struct {
+	Action  string `json:"action"`            // "allow", "block" or "rewrite"
+	Command string `json:"command,omitempty"` // rewrite: the new command, without tag and CRLF
+	Reason  string `json:"reason,omitempty"`  // block: text of the NO response
+}
+
+// askPolicyHook sends req to the hook configured in hc and returns its
+// decision.
+func askPolicyHook(hc config.PolicyHookConfig, req policyRequest) (policyDecision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return policyDecision{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	var out []byte
+	if hc.URL != "" {
+		hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, hc.URL, bytes.NewReader(body))
+		if err != nil {
+			return policyDecision{}, err
+		}
+		hreq.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(hreq)
+		if err != nil {
+			return policyDecision{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return policyDecision{}, fmt.Errorf("policy hook: %s", resp.Status)
+		}
+		if out, err = io.ReadAll(io.LimitReader(resp.Body, maxPolicyResponse)); err != nil {
+			return policyDecision{}, err
+		}
+	} else {
+		cmd := exec.CommandContext(ctx, hc.Command[0], hc.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if out, err = cmd.Output(); err != nil {
+			return policyDecision{}, fmt.Errorf("exec %s: %w: %s", hc.Command[0], err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	}
+	var d policyDecision
+	if err := json.Unmarshal(out, &d); err != nil {
+		return policyDecision{}, fmt.Errorf("policy hook: decision: %w", err)
+	}
+	switch {
+	case d.Action != "allow" && d.Action != "block" && d.Action != "rewrite":
+		return policyDecision{}, fmt.Errorf("policy hook: unknown action %q", d.Action)
+	case d.Action == "rewrite" && d.Command == "":
+		return policyDecision{}, fmt.Errorf("policy hook: rewrite without a command")
+	case strings.ContainsAny(d.Command+d.Reason, "\r\n\x00"):
+		return policyDecision{}, fmt.Errorf("policy hook: decision spans lines")
+	}
+	return d, nil
+}
+
+// heldMessage is an APPEND message the proxy read from the client so that
+// the policy hook could see it.
+type heldMessage struct {
+	data []byte
+	rest string // the line after the literal
+	sync bool   // the client sent a synchronizing literal
+}
+
+// checkPolicy consults the policy hook, if it covers cmd, about line, the
+// command about to be forwarded. It returns the command to forward, which
+// the hook may have rewritten, or handled when the command has been
+// answered, or forwarded along with a message the hook inspected.
+func (s *Session) checkPolicy(cmd imap.Command, line string) (imap.Command, string, bool, error) {
+	hc := s.config.Server.PolicyHook
+	verb := commandVerb(cmd)
+	if !hc.Covers(verb) {
+		return cmd, line, false, nil
+	}
+	req := policyRequest{
+		User: s.account.LocalUser, ClientIP: s.clientIP, Folder: s.selectedFolder,
+		Tag: cmd.Tag, Verb: verb, Command: strings.TrimRight(line, "\r\n"),
+	}
+	var msg *heldMessage
+	if cmd.Verb == "APPEND" {
+		req.Mailbox = extractAppendMailbox(cmd)
+		if n, nonSync, ok := imap.ParseLiteral([]byte(line)); ok {
+			req.MessageSize = n
+			switch {
+			case hc.IncludeMessage && n <= hc.MaxMessage():
+				var err error
+				if msg, err = s.holdMessage(n, !nonSync); err != nil {
+					return cmd, "", true, err
+				}
+				defer s.memory.free(len(msg.data))
+				if _, _, ok := imap.ParseLiteral([]byte(msg.rest)); ok {
+					// MULTIAPPEND: only one message is held for the hook.
+					fmt.Fprintf(s.clientConn, "%s NO [CANNOT] one message per APPEND\r\n", cmd.Tag)
+					return cmd, "", true, s.discardLiterals(msg.rest)
+				}
+				req.Message = msg.data
+			case hc.IncludeMessage:
+				req.MessageOmitted = true
+			}
+		}
+	}
+
+	d, err := askPolicyHook(hc, req)
+	if err == nil && d.Action == "rewrite" {
+		var rewritten imap.Command
+		if rewritten, err = s.checkRewrite(cmd, line, d.Command); err != nil {
+			err = fmt.Errorf("policy hook: %w", err)
+		} else {
+			policyDecisionsTotal.Inc(d.Action)
+			s.logger.Info("command rewritten by policy hook", "verb", verb)
+			// The rewritten command replaces any literals of the original.
+			return rewritten, cmd.Tag + " " + d.Command + "\r\n", false, s.discardLiterals(line)
+		}
+	}
+	if err != nil {
+		policyDecisionsTotal.Inc("error")
+		s.logger.Warn("policy hook failed", "verb", verb, "err", err)
+		if hc.FailOpen {
+			d = policyDecision{Action: "allow"}
+		} else {
+			d = policyDecision{Action: "block", Reason: "[UNAVAILABLE] policy check failed"}
+		}
+	} else {
+		policyDecisionsTotal.Inc(d.Action)
+	}
+
+	if d.Action == "block" {
+		s.refuseCommand(cmd, "policy_hook", d.Reason)
+		if msg != nil {
+			return cmd, "", true, nil
+		}
+		return cmd, "", true, s.discardLiterals(line)
+	}
+	if msg != nil {
+		s.logForwarded(verb)
+		return cmd, "", true, s.forwardMessage(cmd.Tag, string(s.aliasInbox(cmd, []byte(line))), msg)
+	}
+	return cmd, line, false, nil
+}
+
+// refuseCommand answers cmd with NO and the reason given by the policy hook
+// or filter script named by, or a generic one, and records it as blocked.
+func (s *Session) refuseCommand(cmd imap.Command, by, reason string) {
+	s.stats.blocked++
+	s.logger.Warn("command blocked", "verb", commandVerb(cmd), "by", by, "reason", reason)
+	s.noteBlocked(cmd)
+	s.recordAudit(audit.Event{
+		Type: audit.CommandBlocked, User: s.account.LocalUser,
+		Fields: map[string]string{"verb": commandVerb(cmd), "by": by},
+	})
+	if reason == "" {
+		reason = "command refused by policy"
+	}
+	fmt.Fprintf(s.clientConn, "%s NO %s\r\n", cmd.Tag, reason)
+}
+
+// checkRewrite checks the command text that a policy hook or filter script
+// rewrote line, the command cmd is about to be forwarded as, to: it must
+// have the same verb and no literals, and pass the filter and folder rules
+// on its own. An APPEND cannot be rewritten, since its message would be
+// lost.
+func (s *Session) checkRewrite(cmd imap.Command, line, text string) (imap.Command, error) {
+	if cmd.Verb == "APPEND" {
+		return cmd, fmt.Errorf("APPEND cannot be rewritten")
+	}
+	forwarded, err := imap.ParseCommand([]byte(line))
+	if err != nil {
+		return cmd, err
+	}
+	rewrittenLine := cmd.Tag + " " + text + "\r\n"
+	rewritten, err := imap.ParseCommand([]byte(rewrittenLine))
+	if err != nil {
+		return cmd, fmt.Errorf("rewritten command: %w", err)
+	}
+	if commandVerb(rewritten) != commandVerb(forwarded) {
+		return cmd, fmt.Errorf("rewrite changes %s to %s", commandVerb(forwarded), commandVerb(rewritten))
+	}
+	if _, _, ok := imap.ParseLiteral([]byte(rewrittenLine)); ok {
+		return cmd, fmt.Errorf("rewritten command has a literal")
+	}
+	if s.applyWritableOverride(rewritten, imap.Filter(rewritten)).Action != imap.Allow || s.folderBlocked(rewritten) {
+		return cmd, fmt.Errorf("rewritten command is not allowed")
+	}
+	return rewritten, nil
+}
+
+// holdMessage reads an APPEND message literal of n bytes from the client,
+// asking for it first if it is synchronizing, and the rest of the command
+// line after it. The message counts against the session's memory until
+// the caller frees it.
+func (s *Session) holdMessage(n int64, sync bool) (*heldMessage, error) {
+	if !s.memory.hold(int(n)) {
+		s.memory.free(int(n))
+		return nil, errMemoryLimit
+	}
+	if sync {
+		fmt.Fprint(s.clientConn, "+ Ready for literal data\r\n")
+	}
+	msg := &heldMessage{data: make([]byte, n), sync: sync}
+	if _, err := io.ReadFull(s.clientR, msg.data); err != nil {
+		s.memory.free(int(n))
+		return nil, err
+	}
+	rest, err := s.readLine(s.clientR)
+	if err != nil {
+		s.memory.free(int(n))
+		return nil, err
+	}
+	msg.rest = rest
+	return msg, nil
+}
+
+// forwardMessage forwards an APPEND whose message the proxy already holds.
+// head is the command line announcing the message literal. For a
+// synchronizing literal it waits for the upstream's continuation, which
+// is not relayed, since the client had one from the proxy; if the
+// upstream answers with a tagged response instead, that goes to the
+// client.
+func (s *Session) forwardMessage(tag, head string, msg *heldMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.deadline.expect()
+	if !msg.sync {
+		_, err := (&net.Buffers{[]byte(head), msg.data, []byte(msg.rest)}).WriteTo(s.upstreamConn)
+		return err
+	}
+	ic := &internalCmd{tag: tag, continuation: true, done: make(chan string, 1)}
+	s.internal.Store(ic)
+	if _, err := io.WriteString(s.upstreamConn, head); err != nil {
+		s.internal.CompareAndSwap(ic, nil)
+		return err
+	}
+	var reply string
+	select {
+	case reply = <-ic.done:
+	case <-s.stopped:
+		return errSessionClosed
+	}
+	if !strings.HasPrefix(reply, "+") {
+		return s.writeClient(reply)
+	}
+	_, err := (&net.Buffers{msg.data, []byte(msg.rest)}).WriteTo(s.upstreamConn)
+	s.deadline.resume()
+	return err
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+// policyServer starts an HTTP policy hook that answers with decide and
+// reports each request on the returned channel.
+func policyServer(t *testing.T, decide func(policyRequest) policyDecision) (string, <-chan policyRequest) {
+	t.Helper()
+	requests := make(chan policyRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req policyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests <- req
+		json.NewEncoder(w).Encode(decide(req))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, requests
+}
+
+func policyHookConfig(url string, commands ...string) config.PolicyHookConfig {
+	return config.PolicyHookConfig{URL: url, Commands: commands, Timeout: 5 * time.Second, MaxMessageKB: 1024}
+}
+
+func TestAskPolicyHookExec(t *testing.T) {
+	dir := t.TempDir()
+	seen := filepath.Join(dir, "request.json")
+	hc := config.PolicyHookConfig{
+		Command: []string{"sh", "-c", `cat > "$0"; echo '{"action":"block","reason":"not today"}'`, seen},
+		Timeout: 5 * time.Second,
+	}
+	d, err := askPolicyHook(hc, policyRequest{User: "reader1", Tag: "A1", Verb: "FETCH", Command: "A1 FETCH 1 FLAGS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Action != "block" || d.Reason != "not today" {
+		t.Errorf("decision = %+v", d)
+	}
+	data, err := os.ReadFile(seen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req policyRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.User != "reader1" || req.Verb != "FETCH" {
+		t.Errorf("hook got %s (%v)", data, err)
+	}
+
+	hc.Command = []string{"sh", "-c", "echo broken >&2; exit 3"}
+	if _, err := askPolicyHook(hc, policyRequest{}); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("failing hook err = %v, want its stderr", err)
+	}
+}
+
+func TestAskPolicyHookBadAnswers(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{"server error", http.StatusInternalServerError, `{"action":"allow"}`},
+		{"not json", http.StatusOK, "allow"},
+		{"unknown action", http.StatusOK, `{"action":"permit"}`},
+		{"rewrite without command", http.StatusOK, `{"action":"rewrite"}`},
+		{"multi-line reason", http.StatusOK, `{"action":"block","reason":"no\r\n* BYE"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+			if d, err := askPolicyHook(policyHookConfig(srv.URL), policyRequest{}); err == nil {
+				t.Errorf("decision = %+v, want an error", d)
+			}
+		})
+	}
+}
+
+func TestIntegrationPolicyHook(t *testing.T) {
+	url, requests := policyServer(t, func(req policyRequest) policyDecision {
+		switch {
+		case strings.Contains(req.Command, "FETCH 13 "):
+			return policyDecision{Action: "block", Reason: "message 13 is off limits"}
+		case strings.Contains(req.Command, "FETCH 1:*"):
+			return policyDecision{Action: "rewrite", Command: "FETCH 1:10 (FLAGS)"}
+		case strings.Contains(req.Command, "FETCH 2:*"):
+			return policyDecision{Action: "rewrite", Command: "STORE 1 +FLAGS (\\Deleted)"}
+		}
+		return policyDecision{Action: "allow"}
+	})
+	cfg := testConfig()
+	cfg.Server.PolicyHook = policyHookConfig(url, "SELECT", "FETCH")
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	// The hook sees the command as the filter would forward it.
+	env.send(t, "A002 SELECT INBOX\r\n")
+	env.expectUpstream(t, "A002 EXAMINE INBOX")
+	env.readUntilTagged(t, "A002")
+	if req := <-requests; req.Verb != "SELECT" || req.Command != "A002 EXAMINE INBOX" {
+		t.Errorf("hook request = %+v", req)
+	}
+
+	// Commands not listed are not sent to the hook.
+	env.send(t, "A003 UID FETCH 7 (FLAGS)\r\n")
+	env.expectUpstream(t, "UID FETCH")
+	env.readUntilTagged(t, "A003")
+
+	before := policyDecisionsTotal.Value("block")
+	env.send(t, "A004 FETCH 13 (BODY.PEEK[])\r\n")
+	if line := env.readLine(t); line != "A004 NO message 13 is off limits\r\n" {
+		t.Errorf("blocked FETCH = %q", line)
+	}
+	env.noUpstream(t)
+	if got := policyDecisionsTotal.Value("block") - before; got != 1 {
+		t.Errorf("block decisions = %v, want 1", got)
+	}
+	req := <-requests
+	if req.User != "reader1" || req.Folder != "INBOX" || req.Verb != "FETCH" || req.Tag != "A004" {
+		t.Errorf("hook request = %+v", req)
+	}
+
+	env.send(t, "A006 FETCH 1:* (FLAGS)\r\n")
+	if got := env.expectUpstream(t, "FETCH"); got != "A006 FETCH 1:10 (FLAGS)" {
+		t.Errorf("upstream got %q, want the rewritten command", got)
+	}
+	env.readUntilTagged(t, "A006")
+	<-requests
+
+	// A rewrite into a command the proxy would refuse fails closed.
+	env.send(t, "A007 FETCH 2:* (FLAGS)\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A007 NO [UNAVAILABLE]") {
+		t.Errorf("unsafe rewrite = %q, want NO [UNAVAILABLE]", line)
+	}
+	env.noUpstream(t)
+}
+
+func TestIntegrationPolicyHookUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	for _, failOpen := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fail_open=%v", failOpen), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Server.PolicyHook = policyHookConfig(srv.URL, "SELECT", "EXAMINE")
+			cfg.Server.PolicyHook.FailOpen = failOpen
+			env := newIntegrationEnvWithConfig(t, cfg)
+			defer env.clientConn.Close()
+			env.login(t)
+			before := policyDecisionsTotal.Value("error")
+
+			env.send(t, "A002 SELECT INBOX\r\n")
+			if failOpen {
+				env.expectUpstream(t, "EXAMINE INBOX")
+				env.readUntilTagged(t, "A002")
+			} else {
+				if line := env.readLine(t); line != "A002 NO [UNAVAILABLE] policy check failed\r\n" {
+					t.Errorf("SELECT = %q", line)
+				}
+				env.noUpstream(t)
+			}
+			if got := policyDecisionsTotal.Value("error") - before; got != 1 {
+				t.Errorf("errors = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestIntegrationPolicyHookAppendMessage(t *testing.T) {
+	url, requests := policyServer(t, func(req policyRequest) policyDecision {
+		if strings.Contains(string(req.Message), "CONFIDENTIAL") {
+			return policyDecision{Action: "block", Reason: "[CANNOT] message looks confidential"}
+		}
+		return policyDecision{Action: "allow"}
+	})
+	env := newAppendEnv(t, func(s *Session) {
+		s.config.Server.PolicyHook = policyHookConfig(url, "APPEND")
+		s.config.Server.PolicyHook.IncludeMessage = true
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	const secret = "Subject: plans\r\n\r\nCONFIDENTIAL\r\n"
+	env.send(t, fmt.Sprintf("A002 APPEND Sent {%d+}\r\n%s\r\n", len(secret), secret))
+	if line := env.readLine(t); line != "A002 NO [CANNOT] message looks confidential\r\n" {
+		t.Errorf("APPEND = %q", line)
+	}
+	env.noUpstream(t)
+	if req := <-requests; req.Mailbox != "Sent" || string(req.Message) != secret || req.MessageSize != int64(len(secret)) {
+		t.Errorf("hook request = %+v", req)
+	}
+
+	// A synchronizing literal is asked for by the proxy, and the upstream's
+	// continuation is not relayed.
+	env.send(t, fmt.Sprintf("A003 APPEND Sent (\\Seen) {%d}\r\n", len(secret)))
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("want a continuation, got %q", line)
+	}
+	env.send(t, secret+"\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A003 NO [CANNOT]") {
+		t.Errorf("APPEND = %q, want NO", line)
+	}
+	env.noUpstream(t)
+	<-requests
+
+	const plain = "Subject: hi\r\n\r\nhello\r\n"
+	for _, tt := range []struct{ tag, sync string }{{"A004", "+"}, {"A005", ""}} {
+		head := fmt.Sprintf("%s APPEND Sent (\\Seen) {%d%s}\r\n", tt.tag, len(plain), tt.sync)
+		env.send(t, head)
+		if tt.sync == "" {
+			if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+				t.Fatalf("want a continuation, got %q", line)
+			}
+		}
+		env.send(t, plain+"\r\n")
+		if got, want := <-env.received, head+plain+"\r\n"; got != want {
+			t.Errorf("upstream got %q\nwant %q", got, want)
+		}
+		if line := env.readLine(t); !strings.HasPrefix(line, tt.tag+" OK") {
+			t.Errorf("APPEND = %q, want OK", line)
+		}
+		<-requests
+	}
+
+	// The session is still in step.
+	env.send(t, "A006 NOOP\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A006 OK") {
+		t.Errorf("NOOP = %q", line)
+	}
+}
+
+func TestIntegrationPolicyHookOmitsLargeMessage(t *testing.T) {
+	url, requests := policyServer(t, func(policyRequest) policyDecision {
+		return policyDecision{Action: "allow"}
+	})
+	env := newAppendEnv(t, func(s *Session) {
+		s.config.Server.PolicyHook = policyHookConfig(url, "APPEND")
+		s.config.Server.PolicyHook.IncludeMessage = true
+		s.config.Server.PolicyHook.MaxMessageKB = 1
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	big := strings.Repeat("x", 2048)
+	env.send(t, fmt.Sprintf("A002 APPEND Sent {%d+}\r\n%s\r\n", len(big), big))
+	env.expectUpstream(t, "APPEND Sent")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Errorf("APPEND = %q, want OK", line)
+	}
+	if req := <-requests; !req.MessageOmitted || req.Message != nil || req.MessageSize != 2048 {
+		t.Errorf("hook request = %+v", req)
+	}
+}
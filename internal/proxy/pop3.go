@@ -0,0 +1,528 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var pop3CommandsTotal = metrics.Default.NewCounter("imap_proxy_pop3_commands_total",
+	"Commands received from POP3 clients, by command.", "command")
+
+// pop3IdleTimeout closes POP3 connections that send nothing for this long,
+// the minimum autologout timer allowed by RFC 1939.
+const pop3IdleTimeout = 10 * time.Minute
+
+// pop3Commands are the commands counted by name; anything else is counted
+// as "unknown".
+var pop3Commands = map[string]bool{
+	"CAPA": true, "USER": true, "PASS": true, "STLS": true, "QUIT": true,
+	"STAT": true, "LIST": true, "UIDL": true, "RETR": true, "TOP": true,
+	"DELE": true, "NOOP": true, "RSET": true,
+}
+
+var (
+	errInboxHidden = errors.New("INBOX is not visible to the account")
+	// errRefused wraps an upstream NO or BAD; the connection is still usable.
+	errRefused = errors.New("upstream refused command")
+)
+
+// pop3Session serves a POP3 client. Login, access rules and session limits
+// are those of an IMAP session; after login the INBOX is read over the
+// upstream IMAP connection. The maildrop is never changed: DELE is always
+// refused and messages are fetched with BODY.PEEK.
+type pop3Session struct {
+	*Session
+
+	user        string // from USER, awaiting PASS
+	tagSeq      int    // tags upstream commands
+	uidValidity string
+	msgs        []pop3Message // the visible INBOX messages, by UID
+}
+
+// pop3Message is a message in the maildrop. Its size is the upstream
+// RFC822.SIZE, which header scrubbing may make slightly too large.
+type pop3Message struct {
+	uid  uint32
+	size int64
+}
+
+// pop3Response is an untagged upstream response, with the literal it
+// carried, if any.
+type pop3Response struct {
+	line    string
+	literal []byte
+}
+
+// pop3ResponseCode translates an IMAP response code from a refusal into the
+// RFC 2449 response code prefix for a -ERR reply.
+func pop3ResponseCode(code string) string {
+	switch code {
+	case "UNAVAILABLE", "LIMIT":
+		return "[SYS/TEMP] "
+	case "PRIVACYREQUIRED":
+		return "[AUTH] "
+	}
+	return ""
+}
+
+func (p *pop3Session) run() {
+	defer p.shared.sessions.add(p.trace)()
+	defer func() { p.clientConn.Close() }()
+	defer func() {
+		if p.releaseSlot != nil {
+			p.releaseSlot()
+		}
+	}()
+	defer func() {
+		if p.upstreamConn != nil {
+			p.upstreamConn.Close()
+		}
+	}()
+
+	if _, err := fmt.Fprint(p.clientConn, p.pop3Greeting()+"\r\n"); err != nil {
+		p.logger.Error("failed to send greeting", "err", err)
+		return
+	}
+	p.state = StateNotAuth
+
+	for {
+		p.clientConn.SetReadDeadline(time.Now().Add(pop3IdleTimeout))
+		line, err := p.readLine(p.clientR)
+		if errors.Is(err, errMemoryLimit) {
+			p.logMemoryExceeded("client")
+			p.reply("-ERR [SYS/TEMP] line too long")
+			return
+		}
+		if err != nil {
+			p.logger.Info("POP3 client disconnected", "err", err)
+			return
+		}
+		verb, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		verb = strings.ToUpper(verb)
+		if pop3Commands[verb] {
+			pop3CommandsTotal.Inc(verb)
+		} else {
+			pop3CommandsTotal.Inc("unknown")
+		}
+		var ok bool
+		if p.state == StateNotAuth {
+			ok = p.authorization(verb, arg)
+		} else {
+			ok = p.transaction(verb, arg)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// authorization handles a command before login. It reports whether the
+// session continues.
+func (p *pop3Session) authorization(verb, arg string) bool {
+	switch verb {
+	case "CAPA":
+		p.capabilities()
+	case "USER":
+		if arg == "" {
+			p.reply("-ERR missing user name")
+			break
+		}
+		p.user = arg
+		p.reply("+OK send PASS")
+	case "PASS":
+		// The password is the rest of the line and may contain spaces.
+		return p.pass(arg)
+	case "STLS":
+		if p.tlsConfig == nil || p.tlsActive {
+			p.reply("-ERR STLS not available")
+			break
+		}
+		// Anything pipelined after STLS was sent in the clear and must not
+		// be interpreted as if it arrived over TLS.
+		if p.clientR.Buffered() > 0 {
+			p.logger.Warn("closing connection: data pipelined after STLS")
+			p.reply("-ERR unexpected data after STLS")
+			return false
+		}
+		p.reply("+OK begin TLS negotiation")
+		if !p.upgradeTLS() {
+			return false
+		}
+		p.user = ""
+	case "QUIT":
+		p.reply(p.signOff())
+		return false
+	default:
+		p.reply("-ERR command not available before login")
+	}
+	return true
+}
+
+// pass logs in as the user named by USER and opens the INBOX.
+func (p *pop3Session) pass(pass string) bool {
+	if p.user == "" {
+		p.reply("-ERR send USER first")
+		return true
+	}
+	user := p.user
+	p.user = ""
+	r := p.loginClient().admit()
+	if r == nil {
+		r = p.login(user, pass)
+	}
+	if r != nil {
+		if r.failed {
+			p.delayFailure()
+			p.reply("-ERR [AUTH] authentication failed")
+		} else {
+			p.reply("-ERR %s%s", pop3ResponseCode(r.code), r.text)
+		}
+		return true
+	}
+	if err := p.openInbox(); err != nil {
+		if errors.Is(err, errInboxHidden) {
+			p.logger.Warn("POP3 login refused: INBOX not visible")
+			p.reply("-ERR maildrop not available")
+		} else {
+			p.logger.Error("POP3 failed to open INBOX", "err", err)
+			p.reply("-ERR [SYS/TEMP] maildrop not available, try again later")
+		}
+		return false
+	}
+	var total int64
+	for _, m := range p.msgs {
+		total += m.size
+	}
+	p.reply("+OK maildrop has %d messages (%d octets)", len(p.msgs), total)
+	return true
+}
+
+// transaction handles a command after login. It reports whether the
+// session continues.
+func (p *pop3Session) transaction(verb, arg string) bool {
+	args := strings.Fields(arg)
+	switch verb {
+	case "CAPA":
+		p.capabilities()
+	case "STAT":
+		var total int64
+		for _, m := range p.msgs {
+			total += m.size
+		}
+		p.reply("+OK %d %d", len(p.msgs), total)
+	case "LIST", "UIDL":
+		line := func(n int) string {
+			m := p.msgs[n-1]
+			if verb == "LIST" {
+				return fmt.Sprintf("%d %d", n, m.size)
+			}
+			return fmt.Sprintf("%d %s.%d", n, p.uidValidity, m.uid)
+		}
+		if len(args) == 0 {
+			lines := make([]string, len(p.msgs))
+			for i := range p.msgs {
+				lines[i] = line(i + 1)
+			}
+			p.replyLines(fmt.Sprintf("+OK %d messages", len(p.msgs)), lines)
+			break
+		}
+		if n, ok := p.message(args[0]); ok {
+			p.reply("+OK %s", line(n))
+		}
+	case "RETR", "TOP":
+		return p.retrieve(verb, args)
+	case "DELE":
+		p.reply("-ERR maildrop is read-only")
+	case "NOOP", "RSET":
+		p.reply("+OK")
+	case "QUIT":
+		// Nothing was marked deleted, so there is no update to apply.
+		p.reply(p.signOff())
+		return false
+	default:
+		p.reply("-ERR command not recognized")
+	}
+	return true
+}
+
+// retrieve answers RETR n or TOP n lines.
+func (p *pop3Session) retrieve(verb string, args []string) bool {
+	want := 1
+	if verb == "TOP" {
+		want = 2
+	}
+	if len(args) != want {
+		p.reply("-ERR syntax error")
+		return true
+	}
+	n, ok := p.message(args[0])
+	if !ok {
+		return true
+	}
+	top := -1
+	if verb == "TOP" {
+		lines, err := strconv.Atoi(args[1])
+		if err != nil || lines < 0 {
+			p.reply("-ERR invalid line count")
+			return true
+		}
+		top = lines
+	}
+	if limit := p.account.DailyDownloadQuota(); limit > 0 && p.shared.quota.Used(p.account.LocalUser) >= limit {
+		quotaRejectionsTotal.Inc()
+		p.logger.Warn("POP3 download refused: daily quota exceeded", "limit", limit)
+		p.reply("-ERR [SYS/TEMP] daily download quota exceeded")
+		return true
+	}
+
+	uid := p.msgs[n-1].uid
+	resps, err := p.command(fmt.Sprintf("UID FETCH %d (UID BODY.PEEK[])", uid))
+	if errors.Is(err, errMemoryLimit) {
+		p.logMemoryExceeded("upstream")
+		p.reply("-ERR [SYS/TEMP] message too large for this session")
+		return false
+	}
+	if err != nil {
+		p.logger.Error("POP3 fetch failed", "uid", uid, "err", err)
+		p.reply("-ERR [SYS/TEMP] message not available")
+		return errors.Is(err, errRefused)
+	}
+	var body []byte
+	for _, r := range resps {
+		if r.literal != nil && fetchUID(r.line) == uid {
+			body = r.literal
+		}
+	}
+	if body == nil {
+		p.reply("-ERR message no longer available")
+		return true
+	}
+	body = ScrubMessage(p.account, body)
+	if top >= 0 {
+		body = topLines(body, top)
+	}
+	p.countDownload(len(body))
+	p.replyLines(fmt.Sprintf("+OK %d octets", len(body)), messageLines(body))
+	return true
+}
+
+// message parses a message number argument, answering -ERR when it does
+// not name a message in the maildrop.
+func (p *pop3Session) message(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(p.msgs) {
+		p.reply("-ERR no such message")
+		return 0, false
+	}
+	return n, true
+}
+
+// signOff is the reply to QUIT.
+func (p *pop3Session) signOff() string {
+	if p.config.Server.HideProductName {
+		return "+OK signing off"
+	}
+	return "+OK imap-proxy signing off"
+}
+
+func (p *pop3Session) capabilities() {
+	caps := []string{"TOP", "UIDL", "USER", "RESP-CODES", "AUTH-RESP-CODE"}
+	if p.state == StateNotAuth && p.tlsConfig != nil && !p.tlsActive {
+		caps = append(caps, "STLS")
+	}
+	if !p.config.Server.HideProductName {
+		caps = append(caps, "IMPLEMENTATION imap-proxy")
+	}
+	p.replyLines("+OK capability list follows", caps)
+}
+
+// openInbox examines the upstream INBOX and loads the visible messages
+// as the maildrop.
+func (p *pop3Session) openInbox() error {
+	if !p.account.FolderAllowed("INBOX") {
+		return errInboxHidden
+	}
+	resps, err := p.command("EXAMINE INBOX")
+	if err != nil {
+		return err
+	}
+	for _, r := range resps {
+		if code, arg, ok := imap.ParseResponseCode([]byte(r.line)); ok && code == "UIDVALIDITY" {
+			p.uidValidity = arg
+		}
+	}
+
+	var visible []uint32
+	criteria := VisibilityCriteria(p.account, "INBOX", time.Now())
+	if criteria != "" {
+		resps, err := p.command("UID SEARCH " + criteria)
+		if err != nil {
+			return err
+		}
+		for _, r := range resps {
+			if isSearchResult(r.line) {
+				nums, _ := parseSearchResult(r.line)
+				visible = append(visible, nums...)
+			}
+		}
+	}
+
+	resps, err = p.command("UID FETCH 1:* (UID RFC822.SIZE)")
+	if err != nil {
+		return err
+	}
+	p.msgs = nil
+	for _, r := range resps {
+		uid := fetchUID(r.line)
+		size, ok := fetchNumber(r.line, "RFC822.SIZE")
+		if uid == 0 || !ok {
+			continue
+		}
+		if criteria != "" && !slices.Contains(visible, uid) {
+			continue
+		}
+		p.msgs = append(p.msgs, pop3Message{uid: uid, size: int64(size)})
+	}
+	slices.SortFunc(p.msgs, func(a, b pop3Message) int { return cmp.Compare(a.uid, b.uid) })
+	p.msgs = slices.CompactFunc(p.msgs, func(a, b pop3Message) bool { return a.uid == b.uid })
+	return nil
+}
+
+// command sends cmd to the upstream and returns its untagged responses
+// once it completes with OK. The responses, literals included, count
+// toward the session's memory limit while they are read.
+func (p *pop3Session) command(cmd string) ([]pop3Response, error) {
+	p.tagSeq++
+	tag := internalTag("p", p.tagSeq)
+	p.upstreamConn.SetDeadline(time.Now().Add(responseTimeout(p.account)))
+	defer p.upstreamConn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(p.upstreamConn, "%s %s\r\n", tag, cmd); err != nil {
+		return nil, err
+	}
+	var resps []pop3Response
+	held := 0
+	defer func() { p.memory.free(held) }()
+	for {
+		line, err := p.readLine(p.upstreamR)
+		if err != nil {
+			return nil, err
+		}
+		held += len(line)
+		if !p.memory.hold(len(line)) {
+			return nil, errMemoryLimit
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			if !completedOK(tag, line) {
+				return nil, fmt.Errorf("%w: %s", errRefused, strings.TrimRight(line, "\r\n"))
+			}
+			return resps, nil
+		}
+		r := pop3Response{line: line}
+		// A literal is followed by the rest of the response, which may
+		// carry further literals; only FETCH bodies are kept.
+		for {
+			n, _, ok := imap.ParseLiteral([]byte(line))
+			if !ok {
+				break
+			}
+			held += int(n)
+			if !p.memory.hold(int(n)) {
+				return nil, errMemoryLimit
+			}
+			lit := make([]byte, n)
+			if _, err := io.ReadFull(p.upstreamR, lit); err != nil {
+				return nil, err
+			}
+			r.literal = lit
+			if line, err = p.readLine(p.upstreamR); err != nil {
+				return nil, err
+			}
+			held += len(line)
+			if !p.memory.hold(len(line)) {
+				return nil, errMemoryLimit
+			}
+			r.line += line
+		}
+		resps = append(resps, r)
+	}
+}
+
+func (p *pop3Session) reply(format string, args ...any) {
+	fmt.Fprintf(p.clientConn, format+"\r\n", args...)
+}
+
+// replyLines sends a multi-line response: the status line, the lines with
+// a leading "." doubled, and the terminating ".".
+func (p *pop3Session) replyLines(status string, lines []string) {
+	var b bytes.Buffer
+	b.WriteString(status + "\r\n")
+	for _, l := range lines {
+		if strings.HasPrefix(l, ".") {
+			b.WriteByte('.')
+		}
+		b.WriteString(l + "\r\n")
+	}
+	b.WriteString(".\r\n")
+	p.clientConn.Write(b.Bytes())
+}
+
+// messageLines splits a message into lines without their line endings.
+func messageLines(msg []byte) []string {
+	s := strings.TrimSuffix(string(msg), "\n")
+	if s == "" {
+		return nil
+	}
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	return lines
+}
+
+// topLines returns the header of msg and the first n lines of its body.
+func topLines(msg []byte, n int) []byte {
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end < 0 {
+		return msg
+	}
+	end += 4
+	for ; n > 0 && end < len(msg); n-- {
+		i := bytes.IndexByte(msg[end:], '\n')
+		if i < 0 {
+			return msg
+		}
+		end += i + 1
+	}
+	return msg[:end]
+}
+
+// fetchUID returns the UID in a FETCH response, or 0.
+func fetchUID(line string) uint32 {
+	uid, _ := fetchNumber(line, "UID")
+	return uid
+}
+
+// fetchNumber returns the number following item in a FETCH response.
+func fetchNumber(line, item string) (uint32, bool) {
+	fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(line))
+	if len(fields) < 3 || !strings.EqualFold(fields[2], "FETCH") {
+		return 0, false
+	}
+	for i := 3; i+1 < len(fields); i++ {
+		if strings.EqualFold(fields[i], item) {
+			n, err := strconv.ParseUint(fields[i+1], 10, 32)
+			return uint32(n), err == nil
+		}
+	}
+	return 0, false
+}
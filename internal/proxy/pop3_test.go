@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+// fakePOP3Upstream serves an INBOX of the given messages, keyed by UID, to
+// a POP3 session. Searches match only the UIDs in visible.
+func fakePOP3Upstream(msgs map[uint32]string, visible []uint32, received chan<- string) func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+	return func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+		upClient, upServer := net.Pipe()
+		go func() {
+			defer upServer.Close()
+			sr := bufio.NewReader(upServer)
+			for {
+				line, err := sr.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\r\n")
+				received <- line
+				tag, cmd, _ := strings.Cut(line, " ")
+				switch {
+				case strings.HasPrefix(cmd, "EXAMINE"):
+					fmt.Fprintf(upServer, "* %d EXISTS\r\n* OK [UIDVALIDITY 42] ok\r\n", len(msgs))
+				case strings.HasPrefix(cmd, "UID SEARCH"):
+					fmt.Fprint(upServer, "* SEARCH")
+					for _, uid := range visible {
+						fmt.Fprintf(upServer, " %d", uid)
+					}
+					fmt.Fprint(upServer, "\r\n")
+				case strings.HasPrefix(cmd, "UID FETCH 1:*"):
+					seq := 1
+					for _, uid := range []uint32{3, 5, 9} {
+						if body, ok := msgs[uid]; ok {
+							fmt.Fprintf(upServer, "* %d FETCH (UID %d RFC822.SIZE %d)\r\n", seq, uid, len(body))
+							seq++
+						}
+					}
+				case strings.HasPrefix(cmd, "UID FETCH"):
+					var uid uint32
+					fmt.Sscanf(cmd, "UID FETCH %d", &uid)
+					if body, ok := msgs[uid]; ok {
+						fmt.Fprintf(upServer, "* 1 FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", uid, len(body), body)
+					}
+				}
+				fmt.Fprintf(upServer, "%s OK done\r\n", tag)
+			}
+		}()
+		return upClient, bufio.NewReader(upClient), nil
+	}
+}
+
+type pop3Env struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	received chan string
+}
+
+func newPOP3Env(t *testing.T, cfg *config.Config, msgs map[uint32]string, visible []uint32) *pop3Env {
+	t.Helper()
+	clientConn, proxyConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	received := make(chan string, 100)
+	sess := NewSession(proxyConn, cfg, testLogger())
+	sess.dialUpstream = fakePOP3Upstream(msgs, visible, received)
+	// LoginUpstream is not stubbed; the fake answers its LOGIN with OK.
+	go (&pop3Session{Session: sess}).run()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	env := &pop3Env{conn: clientConn, r: bufio.NewReader(clientConn), received: received}
+	if got := env.readLine(t); got != "+OK imap-proxy POP3 ready" {
+		t.Fatalf("greeting = %q", got)
+	}
+	return env
+}
+
+func (e *pop3Env) readLine(t *testing.T) string {
+	t.Helper()
+	line, err := e.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// cmd sends a command and returns the status line and, for multi-line
+// responses, the lines up to the terminating ".".
+func (e *pop3Env) cmd(t *testing.T, line string, multi bool) (string, []string) {
+	t.Helper()
+	fmt.Fprintf(e.conn, "%s\r\n", line)
+	status := e.readLine(t)
+	if !multi || !strings.HasPrefix(status, "+OK") {
+		return status, nil
+	}
+	var lines []string
+	for {
+		l := e.readLine(t)
+		if l == "." {
+			return status, lines
+		}
+		lines = append(lines, l)
+	}
+}
+
+func TestPOP3Session(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].HideFrom = []string{"spam@example.com"}
+	cfg.Accounts[0].RemoveHeaders = []string{"X-Spam"}
+	msgs := map[uint32]string{
+		3: "Subject: a\r\nX-Spam: yes\r\n\r\n.leading dot\r\nline 2\r\nline 3\r\n",
+		5: "Subject: hidden\r\n\r\nx\r\n",
+		9: "Subject: b\r\n\r\nbody\r\n",
+	}
+	env := newPOP3Env(t, cfg, msgs, []uint32{3, 9})
+
+	if status, _ := env.cmd(t, "STAT", false); !strings.HasPrefix(status, "-ERR") {
+		t.Errorf("STAT before login = %q, want -ERR", status)
+	}
+	if status, _ := env.cmd(t, "USER reader1", false); status != "+OK send PASS" {
+		t.Fatalf("USER = %q", status)
+	}
+	if status, _ := env.cmd(t, "PASS localpass1", false); !strings.HasPrefix(status, "+OK maildrop has 2 messages") {
+		t.Fatalf("PASS = %q", status)
+	}
+
+	if status, _ := env.cmd(t, "STAT", false); status != fmt.Sprintf("+OK 2 %d", len(msgs[3])+len(msgs[9])) {
+		t.Errorf("STAT = %q", status)
+	}
+	if _, lines := env.cmd(t, "UIDL", true); strings.Join(lines, "|") != "1 42.3|2 42.9" {
+		t.Errorf("UIDL = %q", lines)
+	}
+	if status, _ := env.cmd(t, "LIST 2", false); status != fmt.Sprintf("+OK 2 %d", len(msgs[9])) {
+		t.Errorf("LIST 2 = %q", status)
+	}
+	if status, _ := env.cmd(t, "LIST 3", false); status != "-ERR no such message" {
+		t.Errorf("LIST 3 = %q", status)
+	}
+
+	status, lines := env.cmd(t, "RETR 1", true)
+	if want := "Subject: a||..leading dot|line 2|line 3"; strings.Join(lines, "|") != want {
+		t.Errorf("RETR 1 = %q %q, want the scrubbed, dot-stuffed message", status, lines)
+	}
+	if _, lines := env.cmd(t, "TOP 1 1", true); strings.Join(lines, "|") != "Subject: a||..leading dot" {
+		t.Errorf("TOP 1 1 = %q", lines)
+	}
+	if status, _ := env.cmd(t, "DELE 1", false); status != "-ERR maildrop is read-only" {
+		t.Errorf("DELE = %q", status)
+	}
+	if status, _ := env.cmd(t, "QUIT", false); !strings.HasPrefix(status, "+OK") {
+		t.Errorf("QUIT = %q", status)
+	}
+
+	var cmds []string
+	for len(env.received) > 0 {
+		cmds = append(cmds, <-env.received)
+	}
+	for _, c := range cmds {
+		if strings.Contains(c, "STORE") || strings.Contains(c, "EXPUNGE") || (strings.Contains(c, "BODY[]") && !strings.Contains(c, "PEEK")) {
+			t.Errorf("upstream received %q, which changes the mailbox", c)
+		}
+	}
+}
+
+func TestPOP3LoginRefused(t *testing.T) {
+	cfg := testConfig()
+	env := newPOP3Env(t, cfg, nil, nil)
+	if status, _ := env.cmd(t, "PASS localpass1", false); status != "-ERR send USER first" {
+		t.Errorf("PASS without USER = %q", status)
+	}
+	env.cmd(t, "USER reader1", false)
+	if status, _ := env.cmd(t, "PASS wrong", false); status != "-ERR [AUTH] authentication failed" {
+		t.Errorf("PASS with wrong password = %q", status)
+	}
+	if _, caps := env.cmd(t, "CAPA", true); !strings.Contains(strings.Join(caps, " "), "UIDL") {
+		t.Errorf("CAPA = %q", caps)
+	}
+}
+
+func TestPOP3InboxHidden(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].BlockedFolders = []string{"INBOX"}
+	env := newPOP3Env(t, cfg, nil, nil)
+	env.cmd(t, "USER reader1", false)
+	if status, _ := env.cmd(t, "PASS localpass1", false); status != "-ERR maildrop not available" {
+		t.Errorf("PASS = %q", status)
+	}
+	if _, err := env.r.ReadString('\n'); err == nil {
+		t.Error("connection still open after INBOX refused")
+	}
+}
+
+func TestTopLines(t *testing.T) {
+	msg := []byte("A: 1\r\n\r\none\r\ntwo\r\n")
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "A: 1\r\n\r\n"},
+		{1, "A: 1\r\n\r\none\r\n"},
+		{5, "A: 1\r\n\r\none\r\ntwo\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(topLines(msg, tt.n)); got != tt.want {
+			t.Errorf("topLines(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPOP3Goodbye(t *testing.T) {
+	if got := protoPOP3.goodbye("UNAVAILABLE", "server busy"); got != "-ERR [SYS/TEMP] server busy\r\n" {
+		t.Errorf("POP3 goodbye = %q", got)
+	}
+	if got := protoIMAP.goodbye("UNAVAILABLE", "server busy"); got != "* BYE [UNAVAILABLE] server busy\r\n" {
+		t.Errorf("IMAP goodbye = %q", got)
+	}
+}
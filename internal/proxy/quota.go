@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/quota"
+)
+
+var quotaRejectionsTotal = metrics.Default.NewCounter("imap_proxy_quota_rejections_total",
+	"FETCH commands refused because the account exceeded its daily download quota.")
+
+// SetQuotaStore replaces the in-memory download quota counters, typically
+// with a persistent store. It must be called before Serve.
+func (s *Server) SetQuotaStore(store *quota.Store) {
+	s.shared.quota = store
+}
+
+// countDownload charges n bytes served to the client against the account's
+// daily quota. Accounts without a quota are not tracked.
+func (s *Session) countDownload(n int) {
+	if n > 0 && s.account.DailyDownloadQuota() > 0 {
+		s.shared.quota.Add(s.account.LocalUser, int64(n))
+	}
+}
+
+// quotaExceeded reports whether cmd is a FETCH that must be refused because
+// the account has used up its daily download quota.
+func (s *Session) quotaExceeded(cmd imap.Command) bool {
+	limit := s.account.DailyDownloadQuota()
+	if limit <= 0 {
+		return false
+	}
+	if cmd.Verb != "FETCH" && !(cmd.Verb == "UID" && cmd.SubVerb == "FETCH") {
+		return false
+	}
+	return s.shared.quota.Used(s.account.LocalUser) >= limit
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"imap-proxy/internal/quota"
+)
+
+func TestDownloadQuota(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].DailyDownloadQuotaMB = 1
+	store := quota.NewStore()
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) { s.shared.quota = store })
+	defer env.clientConn.Close()
+	env.login(t)
+
+	// Under quota: FETCH is forwarded and the response is counted.
+	env.send(t, "A002 FETCH 1 BODY[]\r\n")
+	env.expectUpstream(t, "FETCH")
+	if line := env.readLine(t); line != "A002 OK completed\r\n" {
+		t.Fatalf("FETCH response %q", line)
+	}
+	want := int64(len("A002 OK completed\r\n"))
+	deadline := time.Now().Add(2 * time.Second)
+	for store.Used("reader1") != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Used = %d, want %d", store.Used("reader1"), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Exhaust the quota: FETCH and UID FETCH are refused locally.
+	store.Add("reader1", 1<<20)
+	for _, tt := range []struct{ cmd, want string }{
+		{"A003 FETCH 1 BODY[]\r\n", "A003 NO [LIMIT] quota exceeded\r\n"},
+		{"A004 UID FETCH 1 BODY[]\r\n", "A004 NO [LIMIT] quota exceeded\r\n"},
+	} {
+		env.send(t, tt.cmd)
+		if line := env.readLine(t); line != tt.want {
+			t.Fatalf("response %q, want %q", line, tt.want)
+		}
+	}
+	env.noUpstream(t)
+
+	// Other commands still work.
+	env.send(t, "A005 NOOP\r\n")
+	env.expectUpstream(t, "NOOP")
+	if line := env.readLine(t); line != "A005 OK completed\r\n" {
+		t.Fatalf("NOOP response %q", line)
+	}
+}
+
+func TestDownloadQuotaUnlimitedNotTracked(t *testing.T) {
+	store := quota.NewStore()
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) { s.shared.quota = store })
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 FETCH 1 BODY[]\r\n")
+	env.expectUpstream(t, "FETCH")
+	env.readLine(t)
+	env.send(t, "A003 NOOP\r\n")
+	env.expectUpstream(t, "NOOP")
+	env.readLine(t)
+	if got := store.Used("reader1"); got != 0 {
+		t.Fatalf("Used = %d for an account without a quota, want 0", got)
+	}
+}
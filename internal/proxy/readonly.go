@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+// defaultReadOnlyAlert is the ALERT text when read_only_alert_text is unset.
+const defaultReadOnlyAlert = "This mailbox is read-only via proxy"
+
+// readOnlySelect is a SELECT that the proxy turned into EXAMINE and that
+// awaits its tagged response.
+type readOnlySelect struct {
+	tag    string
+	folder string
+}
+
+// noteReadOnlySelect arranges for an ALERT ahead of the tagged response to
+// cmd, a SELECT that was rewritten to EXAMINE. It must be called before
+// the command is forwarded.
+func (s *Session) noteReadOnlySelect(cmd imap.Command) {
+	if !s.config.Server.ReadOnlyAlert || cmd.Verb != "SELECT" {
+		return
+	}
+	folder := extractCommandMailbox(cmd)
+	if strings.EqualFold(folder, "INBOX") {
+		folder = "INBOX"
+	}
+	s.readOnlySelect.Store(&readOnlySelect{tag: cmd.Tag, folder: folder})
+}
+
+// writeReadOnlyAlert writes the read-only ALERT to out if line completes
+// the pending read-only SELECT successfully and the folder has not been
+// alerted in this session. Called from the upstream→client goroutine
+// with out locked.
+func (s *Session) writeReadOnlyAlert(out io.Writer, line string) error {
+	sel := s.readOnlySelect.Load()
+	if sel == nil || !strings.HasPrefix(line, sel.tag+" ") {
+		return nil
+	}
+	s.readOnlySelect.CompareAndSwap(sel, nil)
+	if _, status, _ := strings.Cut(line, " "); !strings.HasPrefix(strings.ToUpper(status), "OK") || s.alerted[sel.folder] {
+		return nil
+	}
+	if s.alerted == nil {
+		s.alerted = map[string]bool{}
+	}
+	s.alerted[sel.folder] = true
+	text := s.config.Server.ReadOnlyAlertText
+	if text == "" {
+		text = defaultReadOnlyAlert
+	}
+	_, err := io.WriteString(out, "* OK [ALERT] "+text+"\r\n")
+	return err
+}
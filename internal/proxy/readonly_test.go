@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/imap"
+)
+
+// readOnlyAlerts counts the ALERT lines in a response.
+func readOnlyAlerts(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, "* OK [ALERT]") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReadOnlyAlert(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.ReadOnlyAlert = true
+	cfg.Accounts[0].WritableFolders = []string{"Drafts"}
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 SELECT INBOX\r\n")
+	env.drainUpstream(t)
+	lines := env.readUntilTagged(t, "A002")
+	if len(lines) != 2 || lines[0] != "* OK [ALERT] This mailbox is read-only via proxy\r\n" {
+		t.Fatalf("first SELECT INBOX = %q, want the ALERT before the tagged OK", lines)
+	}
+
+	env.send(t, "A003 SELECT inbox\r\n")
+	env.drainUpstream(t)
+	if lines := env.readUntilTagged(t, "A003"); readOnlyAlerts(lines) != 0 {
+		t.Errorf("second SELECT INBOX = %q, want no ALERT", lines)
+	}
+
+	env.send(t, "A004 SELECT Drafts\r\n")
+	env.drainUpstream(t)
+	if lines := env.readUntilTagged(t, "A004"); readOnlyAlerts(lines) != 0 {
+		t.Errorf("SELECT of a writable folder = %q, want no ALERT", lines)
+	}
+
+	env.send(t, "A005 EXAMINE Sent\r\n")
+	env.drainUpstream(t)
+	if lines := env.readUntilTagged(t, "A005"); readOnlyAlerts(lines) != 0 {
+		t.Errorf("EXAMINE = %q, want no ALERT", lines)
+	}
+
+	env.send(t, "A006 SELECT Sent\r\n")
+	env.drainUpstream(t)
+	if lines := env.readUntilTagged(t, "A006"); readOnlyAlerts(lines) != 1 {
+		t.Errorf("first SELECT Sent = %q, want an ALERT", lines)
+	}
+}
+
+func TestReadOnlyAlertText(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.ReadOnlyAlert = true
+	cfg.Server.ReadOnlyAlertText = "Archive access is read-only"
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 SELECT INBOX\r\n")
+	env.drainUpstream(t)
+	if got := env.readLine(t); got != "* OK [ALERT] Archive access is read-only\r\n" {
+		t.Errorf("ALERT = %q", got)
+	}
+}
+
+func TestReadOnlyAlertOff(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 SELECT INBOX\r\n")
+	env.drainUpstream(t)
+	if lines := env.readUntilTagged(t, "A002"); readOnlyAlerts(lines) != 0 {
+		t.Errorf("SELECT without read_only_alert = %q, want no ALERT", lines)
+	}
+}
+
+func TestWriteReadOnlyAlertFailedSelect(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.ReadOnlyAlert = true
+	s := &Session{config: cfg}
+	s.noteReadOnlySelect(imap.Command{Tag: "a1", Verb: "SELECT", Raw: []byte("a1 SELECT Missing\r\n")})
+
+	var b strings.Builder
+	for _, line := range []string{"* 0 EXISTS\r\n", "a1 NO no such mailbox\r\n"} {
+		if err := s.writeReadOnlyAlert(&b, line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.Len() != 0 || s.readOnlySelect.Load() != nil || s.alerted["Missing"] {
+		t.Errorf("failed SELECT wrote %q, want no ALERT and the folder not marked", b.String())
+	}
+
+	// A later successful SELECT of the folder still gets its ALERT.
+	s.noteReadOnlySelect(imap.Command{Tag: "a2", Verb: "SELECT", Raw: []byte("a2 SELECT Missing\r\n")})
+	if err := s.writeReadOnlyAlert(&b, "a2 OK [READ-ONLY] done\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "* OK [ALERT]") {
+		t.Errorf("retried SELECT wrote %q, want an ALERT", b.String())
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+// resumeTag tags the command that re-opens the mailbox on a replacement
+// upstream connection.
+const resumeTag = internalTagPrefix + "r1"
+
+var idleReconnectsTotal = metrics.Default.NewCounter("imap_proxy_idle_reconnects_total",
+	"Upstream connections replaced while the client was in IDLE.")
+
+// mailboxState follows the size and UIDVALIDITY of the selected mailbox as
+// reported by the upstream. It is only used by the upstream reader.
+type mailboxState struct {
+	exists      int
+	uidValidity string
+}
+
+// update applies an untagged response from the upstream.
+func (m *mailboxState) update(line string) {
+	if !strings.HasPrefix(line, "* ") {
+		return
+	}
+	if n, kind, ok := imap.ParseMessageData([]byte(line)); ok {
+		switch kind {
+		case "EXISTS":
+			m.exists = n
+		case "EXPUNGE":
+			m.exists = max(m.exists-1, 0)
+		}
+		return
+	}
+	if code, arg, ok := imap.ParseResponseCode([]byte(line)); ok && code == "UIDVALIDITY" {
+		m.uidValidity = arg
+	}
+}
+
+// resumeIdle replaces a lost upstream connection while the client is in
+// IDLE. It logs in again, re-opens the selected mailbox and re-issues the
+// client's IDLE, so the client only sees an EXISTS for messages that
+// arrived in between. It reports false if the session must end instead,
+// such as when messages were expunged or UIDVALIDITY changed, which the
+// client cannot learn about without a resync.
+func (s *Session) resumeIdle(out *lockedWriter, stopped <-chan struct{}, cause error) bool {
+	relay := s.idle.Load()
+	if relay == nil || !s.idling.Load() {
+		return false
+	}
+	select {
+	case <-stopped:
+		return false
+	default:
+	}
+
+	// Holding both locks keeps DONE, refreshes and keepalives off the
+	// connection until it has been replaced.
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if relay.done || relay.timer == nil {
+		return false
+	}
+
+	s.logger.Info("upstream connection lost during IDLE, reconnecting", "err", cause)
+	conn, r, err := s.dialUpstream(s.account)
+	if err != nil {
+		s.logger.Warn("IDLE reconnect failed", "err", err)
+		return false
+	}
+	next, err := s.reopenMailbox(conn, r)
+	if err != nil {
+		conn.Close()
+		s.logger.Warn("IDLE reconnect failed", "err", err)
+		return false
+	}
+	if s.selectedFolder != "" && (next.exists < s.mailbox.exists ||
+		s.mailbox.uidValidity != "" && next.uidValidity != s.mailbox.uidValidity) {
+		conn.Close()
+		s.logger.Warn("mailbox changed while reconnecting during IDLE, closing session",
+			"folder", s.selectedFolder, "exists", next.exists, "was", s.mailbox.exists)
+		return false
+	}
+
+	s.mu.Lock()
+	select {
+	case <-stopped:
+		s.mu.Unlock()
+		conn.Close()
+		return false
+	default:
+	}
+	old := s.upstreamConn
+	s.upstreamConn = conn
+	s.mu.Unlock()
+	old.Close()
+	s.upstreamR = r
+	s.deadline.reset(conn)
+	s.keepalive.abandon()
+	relay.hideMu.Lock()
+	relay.hideTag = 0 // refreshes on the old connection will never complete
+	relay.hideCon = 1 // the client already has its continuation
+	relay.hideMu.Unlock()
+
+	s.deadline.expect()
+	if _, err := fmt.Fprintf(conn, "%s IDLE\r\n", relay.tag); err != nil {
+		s.logger.Warn("IDLE reconnect failed", "err", err)
+		return false
+	}
+	relay.timer.Reset(relay.interval)
+	idleReconnectsTotal.Inc()
+	s.logger.Info("upstream connection restored during IDLE")
+
+	if s.selectedFolder != "" && next.exists > s.mailbox.exists {
+		s.newMail(next.exists)
+		s.mailbox.exists = next.exists
+		if err := s.replayExists(out, next.exists); err != nil {
+			s.logger.Debug("write to client failed", "err", err)
+			return false
+		}
+	}
+	return true
+}
+
+// reopenMailbox logs in on a replacement upstream connection and re-opens
+// the selected mailbox with the access the filter grants, returning its
+// state.
+func (s *Session) reopenMailbox(conn net.Conn, r *bufio.Reader) (mailboxState, error) {
+	var m mailboxState
+	if err := LoginUpstream(conn, r, s.account); err != nil {
+		return m, err
+	}
+	if s.selectedFolder == "" {
+		return m, nil
+	}
+	verb := "EXAMINE"
+	if s.account.FolderWritable(s.selectedFolder) {
+		verb = "SELECT"
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout(s.account)))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(conn, "%s %s %s\r\n", resumeTag, verb, imap.Quote(s.selectedFolder)); err != nil {
+		return m, fmt.Errorf("%s: send command: %w", strings.ToLower(verb), err)
+	}
+	for {
+		line, err := s.readLine(r)
+		if err != nil {
+			return m, fmt.Errorf("%s: read response: %w", strings.ToLower(verb), err)
+		}
+		if rest, ok := strings.CutPrefix(line, resumeTag+" "); ok {
+			if status, _, _ := strings.Cut(rest, " "); !strings.EqualFold(status, "OK") {
+				return m, fmt.Errorf("%s: upstream: %s", strings.ToLower(verb), strings.TrimRight(rest, "\r\n"))
+			}
+			return m, nil
+		}
+		m.update(line)
+	}
+}
+
+// replayExists tells the client about messages that arrived while the
+// upstream was reconnecting.
+func (s *Session) replayExists(out *lockedWriter, n int) error {
+	line := fmt.Sprintf("* %d EXISTS\r\n", n)
+	if s.coalesce != nil {
+		s.coalesce.add(line)
+		return nil
+	}
+	out.Lock()
+	defer out.Unlock()
+	if err := s.flushPending(out); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, line); err != nil {
+		return err
+	}
+	s.countDownload(len(line))
+	s.usage.relayed(line, len(line))
+	return nil
+}
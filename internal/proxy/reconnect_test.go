@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestMailboxStateUpdate(t *testing.T) {
+	var m mailboxState
+	for _, line := range []string{
+		"* 5 EXISTS\r\n",
+		"* OK [UIDVALIDITY 42] UIDs valid\r\n",
+		"* 2 RECENT\r\n",
+		"* 3 EXPUNGE\r\n",
+		"* 1 FETCH (FLAGS (\\Seen))\r\n",
+		"A1 OK [READ-ONLY] done\r\n",
+	} {
+		m.update(line)
+	}
+	if m.exists != 4 || m.uidValidity != "42" {
+		t.Errorf("state = %+v, want 4 messages with UIDVALIDITY 42", m)
+	}
+}
+
+// fakeMailbox is what one connection of a reconnecting fake upstream
+// reports for EXAMINE. With drop set, the connection closes once IDLE has
+// started, after sending bye if set.
+type fakeMailbox struct {
+	exists      int
+	uidValidity string
+	drop        bool
+	bye         string
+}
+
+// newReconnectEnv starts a session whose upstream serves one connection
+// per mailbox, in order.
+func newReconnectEnv(t *testing.T, mailboxes ...fakeMailbox) *integrationEnv {
+	t.Helper()
+	received := make(chan string, 100)
+	dials := 0
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			if dials == len(mailboxes) {
+				return nil, nil, fmt.Errorf("no more upstream connections")
+			}
+			mb := mailboxes[dials]
+			dials++
+			upClient, upServer := net.Pipe()
+			go serveFakeMailbox(upServer, mb, received)
+			r := bufio.NewReader(upClient)
+			if _, err := r.ReadString('\n'); err != nil {
+				return nil, nil, err
+			}
+			return upClient, r, nil
+		}
+	})
+	env.received = received
+	return env
+}
+
+func serveFakeMailbox(conn net.Conn, mb fakeMailbox, received chan<- string) {
+	defer conn.Close()
+	sr := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK Fake IMAP server ready\r\n")
+	for {
+		line, err := sr.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		received <- line
+		tag, rest, _ := strings.Cut(line, " ")
+		verb, _, _ := strings.Cut(rest, " ")
+		switch strings.ToUpper(verb) {
+		case "EXAMINE":
+			fmt.Fprintf(conn, "* %d EXISTS\r\n* OK [UIDVALIDITY %s] UIDs valid\r\n%s OK [READ-ONLY] done\r\n",
+				mb.exists, mb.uidValidity, tag)
+		case "IDLE":
+			fmt.Fprint(conn, "+ idling\r\n")
+			if mb.drop {
+				if mb.bye != "" {
+					fmt.Fprint(conn, mb.bye)
+				}
+				return
+			}
+			if _, err := sr.ReadString('\n'); err != nil {
+				return
+			}
+			received <- "DONE"
+			fmt.Fprintf(conn, "%s OK IDLE terminated\r\n", tag)
+		case "LOGOUT":
+			fmt.Fprintf(conn, "* BYE logging out\r\n%s OK LOGOUT completed\r\n", tag)
+			return
+		default:
+			fmt.Fprintf(conn, "%s OK completed\r\n", tag)
+		}
+	}
+}
+
+// startIdle examines INBOX and enters IDLE.
+func startIdle(t *testing.T, env *integrationEnv) {
+	t.Helper()
+	env.login(t)
+	env.send(t, "A002 EXAMINE INBOX\r\n")
+	env.expectUpstream(t, "A002 EXAMINE")
+	env.readUntilTagged(t, "A002")
+	env.send(t, "A003 IDLE\r\n")
+	env.expectUpstream(t, "A003 IDLE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got: %q", line)
+	}
+}
+
+func TestIdleResumedAfterUpstreamDrop(t *testing.T) {
+	tests := []struct {
+		name   string
+		next   fakeMailbox
+		replay []string
+	}{
+		{"unchanged", fakeMailbox{exists: 5, uidValidity: "7"}, nil},
+		{"new messages", fakeMailbox{exists: 8, uidValidity: "7"}, []string{"* 8 EXISTS\r\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newReconnectEnv(t, fakeMailbox{exists: 5, uidValidity: "7", drop: true}, tt.next)
+			defer env.clientConn.Close()
+			before := idleReconnectsTotal.Value()
+			startIdle(t, env)
+
+			env.expectUpstream(t, "proxy0 LOGIN")
+			env.expectUpstream(t, resumeTag+" EXAMINE \"INBOX\"")
+			env.expectUpstream(t, "A003 IDLE")
+			for _, want := range tt.replay {
+				if line := env.readLine(t); line != want {
+					t.Fatalf("got %q, want %q", line, want)
+				}
+			}
+
+			// The re-issued IDLE's continuation is not relayed, so the next
+			// line is the completion.
+			env.send(t, "DONE\r\n")
+			env.expectUpstream(t, "DONE")
+			if line := env.readLine(t); !strings.HasPrefix(line, "A003 OK") {
+				t.Fatalf("expected IDLE completion, got: %q", line)
+			}
+			if got := idleReconnectsTotal.Value(); got != before+1 {
+				t.Errorf("reconnect counter = %v, want %v", got, before+1)
+			}
+
+			env.send(t, "A004 NOOP\r\n")
+			env.expectUpstream(t, "A004 NOOP")
+			if line := env.readLine(t); !strings.HasPrefix(line, "A004 OK") {
+				t.Fatalf("expected NOOP completion, got: %q", line)
+			}
+		})
+	}
+}
+
+func TestIdleResumedAfterUpstreamBye(t *testing.T) {
+	env := newReconnectEnv(t, fakeMailbox{exists: 5, uidValidity: "7", drop: true, bye: "* BYE autologout\r\n"},
+		fakeMailbox{exists: 5, uidValidity: "7"})
+	defer env.clientConn.Close()
+	startIdle(t, env)
+
+	env.expectUpstream(t, "proxy0 LOGIN")
+	env.expectUpstream(t, resumeTag+" EXAMINE \"INBOX\"")
+	env.expectUpstream(t, "A003 IDLE")
+
+	// The BYE is not relayed: the next line is the IDLE completion.
+	env.send(t, "DONE\r\n")
+	env.expectUpstream(t, "DONE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A003 OK") {
+		t.Fatalf("expected IDLE completion, got: %q", line)
+	}
+}
+
+func TestIdleNotResumedWhenMailboxChanged(t *testing.T) {
+	tests := []struct {
+		name string
+		next fakeMailbox
+	}{
+		{"expunged", fakeMailbox{exists: 4, uidValidity: "7"}},
+		{"uidvalidity", fakeMailbox{exists: 5, uidValidity: "8"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newReconnectEnv(t, fakeMailbox{exists: 5, uidValidity: "7", drop: true}, tt.next)
+			defer env.clientConn.Close()
+			startIdle(t, env)
+
+			expectUpstreamLost(t, env)
+		})
+	}
+}
+
+func TestIdleNotResumedWhenReconnectFails(t *testing.T) {
+	env := newReconnectEnv(t, fakeMailbox{exists: 5, uidValidity: "7", drop: true})
+	defer env.clientConn.Close()
+	startIdle(t, env)
+
+	expectUpstreamLost(t, env)
+}
+
+// expectUpstreamLost checks that the client is told about the lost
+// upstream and the session ends.
+func expectUpstreamLost(t *testing.T, env *integrationEnv) {
+	t.Helper()
+	if line := env.readLine(t); line != "* BYE [UNAVAILABLE] upstream connection lost\r\n" {
+		t.Fatalf("expected BYE, got: %q", line)
+	}
+	if line, err := env.clientR.ReadString('\n'); err == nil {
+		t.Fatalf("session continued without an upstream, got: %q", line)
+	}
+}
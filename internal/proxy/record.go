@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bufio"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+
+	"imap-proxy/internal/buildinfo"
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/transcript"
+)
+
+// startRecording wraps the client connection in a transcript recorder when
+// server.record is configured. It is called before the greeting so the
+// transcript holds the whole session.
+func (s *Session) startRecording() {
+	dir := s.config.Server.Record.Dir
+	if dir == "" {
+		return
+	}
+	rec, err := transcript.Create(dir, s.clientConn.RemoteAddr().String(), buildinfo.Version)
+	if err != nil {
+		s.logger.Error("failed to start session transcript", "err", err)
+		return
+	}
+	s.recorder = rec
+	s.mu.Lock()
+	s.clientConn = rec.Wrap(s.clientConn)
+	s.mu.Unlock()
+	s.clientR = bufio.NewReader(s.clientConn)
+}
+
+// finishRecording closes the transcript, or deletes it when recording is
+// limited to accounts the session did not log in as. A session that
+// switched accounts with UNAUTHENTICATE is labelled with the last one.
+func (s *Session) finishRecording() {
+	if s.recorder == nil {
+		return
+	}
+	var user string
+	if n := len(s.loggedInAs); n > 0 {
+		user = s.loggedInAs[n-1]
+	}
+	if accounts := s.config.Server.Record.Accounts; len(accounts) > 0 &&
+		!slices.ContainsFunc(s.loggedInAs, func(u string) bool { return slices.Contains(accounts, u) }) {
+		if err := s.recorder.Discard(); err != nil {
+			s.logger.Warn("failed to delete session transcript", "err", err)
+		}
+		return
+	}
+	if err := s.recorder.Close(user); err != nil {
+		s.logger.Warn("failed to write session transcript", "path", s.recorder.Path(), "err", err)
+		return
+	}
+	s.logger.Debug("session transcript written", "path", s.recorder.Path())
+}
+
+// upstreamRecorder returns a wrapper that records an upstream connection
+// of acct into a fixture file when server.record.upstream_dir is set and
+// its accounts, if any, include acct. It returns nil otherwise.
+func (s *Session) upstreamRecorder(acct *config.AccountConfig) func(net.Conn) net.Conn {
+	rc := s.config.Server.Record
+	if rc.UpstreamDir == "" || len(rc.Accounts) > 0 && !slices.Contains(rc.Accounts, acct.LocalUser) {
+		return nil
+	}
+	return func(conn net.Conn) net.Conn {
+		rec, err := transcript.Create(rc.UpstreamDir, conn.RemoteAddr().String(), buildinfo.Version)
+		if err != nil {
+			s.logger.Error("failed to start upstream fixture", "err", err)
+			return conn
+		}
+		return &recordedUpstream{Conn: rec.WrapUpstream(conn), rec: rec, user: acct.LocalUser, logger: s.logger}
+	}
+}
+
+// recordedUpstream is an upstream connection whose fixture is finished
+// when it is closed.
+type recordedUpstream struct {
+	net.Conn
+	rec    *transcript.Recorder
+	user   string
+	logger *slog.Logger
+	once   sync.Once
+}
+
+func (c *recordedUpstream) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if err := c.rec.Close(c.user); err != nil {
+			c.logger.Warn("failed to write upstream fixture", "path", c.rec.Path(), "err", err)
+			return
+		}
+		c.logger.Debug("upstream fixture written", "path", c.rec.Path())
+	})
+	return err
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imaptest"
+	"imap-proxy/internal/transcript"
+)
+
+// recordedSession runs a session against an imaptest upstream with
+// recording configured by rc, sends cmds and waits for the session to end.
+func recordedSession(t *testing.T, rc config.RecordConfig, cmds ...string) *config.Config {
+	t.Helper()
+	up := imaptest.NewServer()
+	t.Cleanup(up.Close)
+	cfg := testConfig()
+	cfg.Accounts[0] = up.Account("reader1", "localpass1")
+	cfg.Server.Record = rc
+
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		NewSession(proxyConn, cfg, testLogger()).Run()
+		close(done)
+	}()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(clientConn)
+	readLine(r) // greeting
+	for i, cmd := range cmds {
+		tag := fmt.Sprintf("a%d", i+1)
+		fmt.Fprintf(clientConn, "%s %s\r\n", tag, cmd)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+			if strings.HasPrefix(line, tag+" ") {
+				break
+			}
+		}
+	}
+	clientConn.Close()
+	<-done
+	return cfg
+}
+
+// readTranscripts returns the events of each transcript in dir.
+func readTranscripts(t *testing.T, dir string) [][]transcript.Event {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all [][]transcript.Event
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("localpass1")) {
+			t.Errorf("%s contains the LOGIN password", name)
+		}
+		events, err := transcript.Read(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, events)
+	}
+	return all
+}
+
+func TestSessionRecording(t *testing.T) {
+	dir := t.TempDir()
+	cfg := recordedSession(t, config.RecordConfig{Dir: dir}, "LOGIN reader1 localpass1", "SELECT INBOX", "FETCH 1:* (FLAGS)", "LOGOUT")
+	files := readTranscripts(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("%d transcripts, want 1", len(files))
+	}
+	events := files[0]
+	if events[0].Kind != transcript.KindStart || events[len(events)-1].Kind != transcript.KindEnd {
+		t.Fatalf("transcript not framed by start and end: %+v", events)
+	}
+	if user := events[len(events)-1].User; user != "reader1" {
+		t.Errorf("end user = %q, want reader1", user)
+	}
+	var login string
+	for _, e := range events {
+		if e.Kind == transcript.KindClient && strings.Contains(e.Text, "LOGIN") {
+			login = e.Text
+		}
+	}
+	if login != "a1 LOGIN [REDACTED] [REDACTED]\r\n" {
+		t.Errorf("recorded LOGIN = %q", login)
+	}
+
+	// Replaying against the same mail reproduces the session.
+	cfg.Server.Record = config.RecordConfig{}
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	go NewSession(proxyConn, cfg, testLogger()).Run()
+	rp := &transcript.Replayer{User: "reader1", Password: "localpass1", Timeout: 5 * time.Second}
+	diffs, err := rp.Run(clientConn, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("replay differs: %+v", diffs)
+	}
+}
+
+func TestSessionRecordingAccounts(t *testing.T) {
+	dir := t.TempDir()
+	recordedSession(t, config.RecordConfig{Dir: dir, Accounts: []string{"someone-else"}}, "LOGIN reader1 localpass1", "LOGOUT")
+	if files := readTranscripts(t, dir); len(files) != 0 {
+		t.Errorf("%d transcripts kept for an account not in record.accounts", len(files))
+	}
+	recordedSession(t, config.RecordConfig{Dir: dir, Accounts: []string{"reader1"}}, "LOGIN reader1 localpass1", "LOGOUT")
+	if files := readTranscripts(t, dir); len(files) != 1 {
+		t.Errorf("%d transcripts, want 1 for a listed account", len(files))
+	}
+}
+
+func TestSessionRecordingSTARTTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverTLS, clientTLS := generateTestTLSConfigs(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(&config.Config{Server: config.ServerConfig{Record: config.RecordConfig{Dir: dir}}}, slog.New(slog.DiscardHandler))
+	srv.SetTLSConfig(serverTLS)
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	readLineConn(t, r) // greeting
+	conn.Write([]byte("A1 STARTTLS\r\n"))
+	readLineConn(t, r)
+	tc := tls.Client(conn, clientTLS)
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tc.Write([]byte("A2 NOOP\r\n"))
+	readLineConn(t, bufio.NewReader(tc))
+	tc.Close()
+
+	// The transcript is complete once the session has ended.
+	var files [][]transcript.Event
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		files = readTranscripts(t, dir)
+		if len(files) == 1 && len(files[0]) > 0 && files[0][len(files[0])-1].Kind == transcript.KindEnd {
+			break
+		}
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d transcripts, want 1", len(files))
+	}
+	var client []string
+	for _, e := range files[0] {
+		if e.Kind == transcript.KindClient {
+			client = append(client, string(e.Data()))
+		}
+	}
+	if want := []string{"A1 STARTTLS\r\n", "A2 NOOP\r\n"}; strings.Join(client, "") != strings.Join(want, "") {
+		t.Errorf("recorded client commands %q, want %q", client, want)
+	}
+}
+
+// withFixture makes a session dial a pipe served by fixture instead of
+// the account's upstream. A command the fixture does not expect fails the
+// test; errors once the test is over, when its cleanup closes the
+// session, do not.
+func withFixture(t *testing.T, fixture *transcript.Fixture) func(*Session) {
+	return func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			conn, server := net.Pipe()
+			go func() {
+				if err := fixture.Serve(server); err != nil && t.Context().Err() == nil {
+					t.Errorf("fixture: %v", err)
+				}
+				server.Close()
+			}()
+			r := bufio.NewReader(conn)
+			if _, err := r.ReadString('\n'); err != nil {
+				return nil, nil, err
+			}
+			return conn, r, nil
+		}
+	}
+}
+
+func TestUpstreamFixture(t *testing.T) {
+	clientDir, upstreamDir := t.TempDir(), t.TempDir()
+	cfg := recordedSession(t, config.RecordConfig{Dir: clientDir, UpstreamDir: upstreamDir},
+		"LOGIN reader1 localpass1", "SELECT INBOX", "FETCH 1:* (FLAGS)", "LOGOUT")
+	fixtures := readTranscripts(t, upstreamDir)
+	if len(fixtures) != 1 {
+		t.Fatalf("%d upstream fixtures, want 1", len(fixtures))
+	}
+	upstream := fixtures[0]
+	if end := upstream[len(upstream)-1]; end.Kind != transcript.KindEnd || end.User != "reader1" {
+		t.Fatalf("fixture does not end with the account: %+v", end)
+	}
+	var commands []string
+	for _, e := range upstream {
+		switch {
+		case e.Kind == transcript.KindClient:
+			commands = append(commands, string(e.Data()))
+		case e.Kind == transcript.KindServer && len(commands) == 0 && !strings.HasPrefix(e.Text, "* OK"):
+			t.Errorf("fixture does not start with the greeting: %q", e.Text)
+		}
+	}
+	if len(commands) == 0 || commands[0] != "proxy0 LOGIN [REDACTED] [REDACTED]\r\n" {
+		t.Errorf("recorded upstream commands %q, want the LOGIN first and redacted", commands)
+	}
+
+	// With the fixture as its upstream, the proxy answers the client's
+	// session exactly as it did against the real one.
+	cfg.Server.Record = config.RecordConfig{}
+	env := newIntegrationEnvWithConfig(t, cfg, withFixture(t, transcript.NewFixture(upstream)))
+	defer env.clientConn.Close()
+	rp := &transcript.Replayer{User: "reader1", Password: "localpass1", Timeout: 5 * time.Second}
+	diffs, err := rp.Run(env.clientConn, readTranscripts(t, clientDir)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("session against the fixture differs: %+v", diffs)
+	}
+}
+
+func TestUpstreamFixtureAccounts(t *testing.T) {
+	dir := t.TempDir()
+	recordedSession(t, config.RecordConfig{UpstreamDir: dir, Accounts: []string{"someone-else"}}, "LOGIN reader1 localpass1", "LOGOUT")
+	if files := readTranscripts(t, dir); len(files) != 0 {
+		t.Errorf("%d upstream fixtures for an account not in record.accounts", len(files))
+	}
+}
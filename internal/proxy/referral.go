@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"strings"
+
+	"imap-proxy/internal/metrics"
+)
+
+var referralsStrippedTotal = metrics.Default.NewCounter("imap_proxy_referrals_stripped_total",
+	"RFC 2193 REFERRAL response codes removed from upstream responses.", "upstream")
+
+// referralCapabilities are the RFC 2193 capabilities that tell a client it
+// may be referred to another server.
+var referralCapabilities = []string{"MAILBOX-REFERRALS", "LOGIN-REFERRALS"}
+
+// stripReferral removes a [REFERRAL url] response code from a relayed
+// status response, so that a client is never told to connect to a backend
+// directly, around the proxy. The rest of the response is kept. Referrals
+// are not followed.
+func (s *Session) stripReferral(line string) string {
+	stripped, urls, ok := withoutReferral(line)
+	if !ok {
+		return line
+	}
+	referralsStrippedTotal.Inc(s.upstream)
+	s.logger.Warn("removed referral from upstream response", "referral", urls)
+	return stripped
+}
+
+// withoutReferral returns line without its [REFERRAL ...] response code and
+// the referral URLs, if line is a status response carrying one. A response
+// left without text gets a generic one, since resp-text may not be empty.
+func withoutReferral(line string) (string, string, bool) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 3 {
+		return line, "", false
+	}
+	switch strings.ToUpper(parts[1]) {
+	case "OK", "NO", "BAD", "BYE", "PREAUTH":
+	default:
+		return line, "", false
+	}
+	const code = "[REFERRAL "
+	text := parts[2]
+	if len(text) < len(code) || !strings.EqualFold(text[:len(code)], code) {
+		return line, "", false
+	}
+	// URLs may hold bracketed IPv6 hosts, so the code ends at the bracket
+	// that balances its opening one.
+	end, depth := -1, 0
+	for i := 0; i < len(text) && end < 0; i++ {
+		switch text[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return line, "", false
+	}
+	urls := strings.TrimSpace(text[len(code):end])
+	rest := strings.TrimLeft(text[end+1:], " ")
+	if strings.TrimRight(rest, "\r\n") == "" {
+		rest = "mailbox is not available through this proxy\r\n"
+	}
+	return parts[0] + " " + parts[1] + " " + rest, urls, true
+}
+
+// withoutReferralCapabilities removes referralCapabilities from a CAPABILITY
+// response or response code in line. Other lines are returned unchanged.
+func withoutReferralCapabilities(line string) string {
+	lower := strings.ToLower(line)
+	start := -1
+	end := len(strings.TrimRight(line, "\r\n"))
+	if strings.HasPrefix(lower, "* capability ") {
+		start = len("* capability ")
+	} else if i := strings.Index(lower, "[capability "); i >= 0 {
+		start = i + len("[capability ")
+		j := strings.IndexByte(line[start:], ']')
+		if j < 0 {
+			return line
+		}
+		end = start + j
+	}
+	if start < 0 {
+		return line
+	}
+	var kept []string
+	for _, c := range strings.Fields(line[start:end]) {
+		referral := false
+		for _, name := range referralCapabilities {
+			if strings.EqualFold(c, name) {
+				referral = true
+			}
+		}
+		if !referral {
+			kept = append(kept, c)
+		}
+	}
+	return line[:start] + strings.Join(kept, " ") + line[end:]
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithoutReferral(t *testing.T) {
+	tests := []struct {
+		line, want, urls string
+	}{
+		{"A1 NO [REFERRAL imap://;AUTH=*@backend.example.com/shared] Remote mailbox\r\n",
+			"A1 NO Remote mailbox\r\n", "imap://;AUTH=*@backend.example.com/shared"},
+		{"* ok [referral IMAP://[2001:db8::1]/INBOX] moved\r\n",
+			"* ok moved\r\n", "IMAP://[2001:db8::1]/INBOX"},
+		{"A2 NO [REFERRAL imap://a/x imap://b/x]\r\n",
+			"A2 NO mailbox is not available through this proxy\r\n", "imap://a/x imap://b/x"},
+		{"A3 OK [READ-ONLY] done\r\n", "A3 OK [READ-ONLY] done\r\n", ""},
+		{"* 1 FETCH (BODY[] {5}\r\n", "* 1 FETCH (BODY[] {5}\r\n", ""},
+		{"A4 NO [REFERRAL imap://unterminated\r\n", "A4 NO [REFERRAL imap://unterminated\r\n", ""},
+	}
+	for _, tt := range tests {
+		got, urls, ok := withoutReferral(tt.line)
+		if got != tt.want || urls != tt.urls || ok != (tt.urls != "") {
+			t.Errorf("withoutReferral(%q) = %q, %q, %v, want %q, %q", tt.line, got, urls, ok, tt.want, tt.urls)
+		}
+	}
+}
+
+func TestWithoutReferralCapabilities(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"* CAPABILITY IMAP4rev1 MAILBOX-REFERRALS IDLE login-referrals\r\n", "* CAPABILITY IMAP4rev1 IDLE\r\n"},
+		{"A1 OK [CAPABILITY IMAP4rev1 LOGIN-REFERRALS] Logged in\r\n", "A1 OK [CAPABILITY IMAP4rev1] Logged in\r\n"},
+		{"* CAPABILITY IMAP4rev1 IDLE\r\n", "* CAPABILITY IMAP4rev1 IDLE\r\n"},
+	}
+	for _, tt := range tests {
+		if got := withoutReferralCapabilities(tt.line); got != tt.want {
+			t.Errorf("withoutReferralCapabilities(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestReferralsNotRelayed(t *testing.T) {
+	env := newKeepaliveEnv(t,
+		"* CAPABILITY IMAP4rev1 MAILBOX-REFERRALS\r\n",
+		"* NO [REFERRAL imap://backend.example.com/INBOX] try elsewhere\r\n",
+	)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	before := referralsStrippedTotal.Value("mail.example.com:993")
+	env.send(t, "A002 NOOP\r\n")
+	lines := env.readUntilTagged(t, "A002")
+	for _, line := range lines {
+		if strings.Contains(strings.ToUpper(line), "REFERRAL") {
+			t.Errorf("referral relayed to client: %q", line)
+		}
+	}
+	if len(lines) != 3 || lines[1] != "* NO try elsewhere\r\n" {
+		t.Errorf("response = %q, want the referral's text kept", lines)
+	}
+	if got := referralsStrippedTotal.Value("mail.example.com:993") - before; got != 1 {
+		t.Errorf("referrals stripped = %v, want 1", got)
+	}
+}
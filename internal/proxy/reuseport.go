@@ -0,0 +1,17 @@
+package proxy
+
+import (
+	"context"
+	"net"
+)
+
+// Listen opens a TCP listener on addr. With reusePort, SO_REUSEPORT is set
+// first, so that several proxy processes can listen on the same address
+// and the kernel spreads new connections across them.
+func Listen(addr string, reusePort bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
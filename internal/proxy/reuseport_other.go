@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package proxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortSupported reports whether Listen can set SO_REUSEPORT here.
+const reusePortSupported = false
+
+func reusePortControl(string, string, syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	if !reusePortSupported {
+		if _, err := Listen("127.0.0.1:0", true); err == nil {
+			t.Fatal("Listen with reusePort succeeded on an unsupported platform")
+		}
+		t.Skip("SO_REUSEPORT not supported")
+	}
+	first, err := Listen("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.Addr().String()
+
+	second, err := Listen(addr, true)
+	if err != nil {
+		t.Fatalf("second listener with SO_REUSEPORT: %v", err)
+	}
+	second.Close()
+
+	if l, err := Listen(addr, false); err == nil {
+		l.Close()
+		t.Fatal("listener without SO_REUSEPORT bound an address in use")
+	}
+}
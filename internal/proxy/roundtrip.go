@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+var errSessionClosed = errors.New("session closed")
+
+// internalCmd is a command whose responses the upstream reader hands to a
+// waiting client goroutine instead of relaying them, so that the proxy can
+// inspect or rewrite them first.
+type internalCmd struct {
+	tag   string
+	lines []string    // captured SEARCH results; read after done
+	done  chan string // receives the tagged completion
+	// continuation makes a "+" continuation complete the command too, for
+	// a literal the proxy sends itself.
+	continuation bool
+}
+
+// route reports whether an upstream line belongs to the command: its
+// tagged completion, a continuation it waits for, or a SEARCH result.
+func (c *internalCmd) route(line string) (captured, completed bool) {
+	if strings.HasPrefix(line, c.tag+" ") || c.continuation && strings.HasPrefix(line, "+") {
+		return true, true
+	}
+	if !strings.HasPrefix(line, "* ") {
+		return false, false
+	}
+	if _, _, hasLiteral := imap.ParseLiteral([]byte(line)); hasLiteral || !isSearchResult(line) {
+		return false, false
+	}
+	c.lines = append(c.lines, line)
+	return true, false
+}
+
+// isSearchResult reports whether line is an untagged SEARCH response.
+func isSearchResult(line string) bool {
+	kind, _, _ := strings.Cut(strings.TrimRight(line[2:], "\r\n"), " ")
+	return strings.EqualFold(kind, "SEARCH")
+}
+
+// nextInternalTag returns a tag for a command the proxy sends on its own
+// behalf from the client goroutine.
+func (s *Session) nextInternalTag() string {
+	s.internalSeq++
+	return internalTag("v", s.internalSeq)
+}
+
+// roundTrip forwards line, tagged with tag, and waits for its tagged
+// completion. It returns the SEARCH results received on the way; other
+// responses are relayed as usual. It must be called from the client
+// goroutine.
+func (s *Session) roundTrip(tag string, line []byte) ([]string, string, error) {
+	ic := &internalCmd{tag: tag, done: make(chan string, 1)}
+	s.internal.Store(ic)
+	if err := s.forwardWithLiterals(line); err != nil {
+		s.internal.CompareAndSwap(ic, nil)
+		return nil, "", err
+	}
+	select {
+	case completion := <-ic.done:
+		return ic.lines, completion, nil
+	case <-s.stopped:
+		return nil, "", errSessionClosed
+	}
+}
+
+// searchUIDs runs an internal UID SEARCH and returns the UIDs found.
+func (s *Session) searchUIDs(criteria string) ([]uint32, error) {
+	return s.search(true, criteria)
+}
+
+// search runs an internal SEARCH, or UID SEARCH when uid is set, and
+// returns the message numbers or UIDs found.
+func (s *Session) search(uid bool, criteria string) ([]uint32, error) {
+	tag := s.nextInternalTag()
+	verb := "SEARCH"
+	if uid {
+		verb = "UID SEARCH"
+	}
+	lines, completion, err := s.roundTrip(tag, fmt.Appendf(nil, "%s %s %s\r\n", tag, verb, criteria))
+	if err != nil {
+		return nil, err
+	}
+	if !completedOK(tag, completion) {
+		return nil, fmt.Errorf("upstream: %s", strings.TrimRight(completion, "\r\n"))
+	}
+	var found []uint32
+	for _, line := range lines {
+		nums, _ := parseSearchResult(line)
+		found = append(found, nums...)
+	}
+	return found, nil
+}
+
+// completedOK reports whether completion is an OK for tag.
+func completedOK(tag, completion string) bool {
+	status, _, _ := strings.Cut(strings.TrimPrefix(completion, tag+" "), " ")
+	return strings.EqualFold(status, "OK")
+}
+
+// parseSearchResult returns the numbers in an untagged SEARCH response.
+// Anything after them, such as a CONDSTORE (MODSEQ n), is returned as rest.
+func parseSearchResult(line string) (nums []uint32, rest string) {
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	i := 2
+	for ; i < len(fields); i++ {
+		n, err := imap.ParseSeqSet(fields[i])
+		if err != nil || len(n) != 1 || n[0].Start == 0 || n[0].Start != n[0].Stop {
+			break
+		}
+		nums = append(nums, n[0].Start)
+	}
+	if i < len(fields) {
+		rest = strings.Join(fields[i:], " ")
+	}
+	return nums, rest
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInternalCmdRoute(t *testing.T) {
+	tests := []struct {
+		line      string
+		captured  bool
+		completed bool
+	}{
+		{"* SEARCH 1 2 3\r\n", true, false},
+		{"* search\r\n", true, false},
+		{"* 3 EXISTS\r\n", false, false},
+		{"* 1 FETCH (BODY[] {5}\r\n", false, false},
+		{"A1 OK done\r\n", false, false},
+		{"proxyv1 OK done\r\n", true, true},
+		{"proxyv10 OK done\r\n", false, false},
+	}
+	for _, tt := range tests {
+		ic := &internalCmd{tag: "proxyv1"}
+		captured, completed := ic.route(tt.line)
+		if captured != tt.captured || completed != tt.completed {
+			t.Errorf("route(%q) = %v, %v; want %v, %v", tt.line, captured, completed, tt.captured, tt.completed)
+		}
+	}
+}
+
+func TestParseSearchResult(t *testing.T) {
+	tests := []struct {
+		line string
+		nums []uint32
+		rest string
+	}{
+		{"* SEARCH\r\n", nil, ""},
+		{"* SEARCH 4 9 2\r\n", []uint32{4, 9, 2}, ""},
+		{"* SEARCH 1 3 (MODSEQ 917)\r\n", []uint32{1, 3}, "(MODSEQ 917)"},
+	}
+	for _, tt := range tests {
+		nums, rest := parseSearchResult(tt.line)
+		if !reflect.DeepEqual(nums, tt.nums) || rest != tt.rest {
+			t.Errorf("parseSearchResult(%q) = %v, %q; want %v, %q", tt.line, nums, rest, tt.nums, tt.rest)
+		}
+	}
+}
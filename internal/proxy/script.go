@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var scriptErrorsTotal = metrics.Default.NewCounter("imap_proxy_filter_script_errors_total",
+	"Calls into filter scripts that failed, timed out or returned nonsense, by hook: on_command or on_response.", "hook")
+
+// Limits of a filter script's Lua state. Time is bounded per call by
+// script_timeout.
+const (
+	scriptCallStackSize   = 200
+	scriptRegistrySize    = 1024
+	scriptRegistryMaxSize = 64 * 1024
+	scriptMaxString       = 1 << 20 // longest string.rep result
+)
+
+// compiledScripts caches compiled filter scripts by path. A script is
+// compiled again when its file changes.
+var compiledScripts = struct {
+	sync.Mutex
+	m map[string]compiledScript
+}{m: make(map[string]compiledScript)}
+
+type compiledScript struct {
+	modTime time.Time
+	size    int64
+	proto   *lua.FunctionProto
+}
+
+// compileScript returns the compiled script at path.
+func compileScript(path string) (*lua.FunctionProto, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	compiledScripts.Lock()
+	defer compiledScripts.Unlock()
+	if c, ok := compiledScripts.m[path]; ok && c.modTime.Equal(fi.ModTime()) && c.size == fi.Size() {
+		return c.proto, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+	compiledScripts.m[path] = compiledScript{modTime: fi.ModTime(), size: fi.Size(), proto: proto}
+	return proto, nil
+}
+
+// filterScript is a session's instance of its account's filter script.
+// The client and upstream goroutines both call into it, one at a time.
+type filterScript struct {
+	mu         sync.Mutex
+	L          *lua.LState
+	timeout    time.Duration
+	onCommand  *lua.LFunction
+	onResponse *lua.LFunction
+}
+
+// newFilterScript loads the account's filter_script into a fresh Lua state
+// with only the base, string, table and math libraries, and runs its top
+// level. It returns nil when the account has no script.
+func newFilterScript(acct *config.AccountConfig, logger *slog.Logger) (*filterScript, error) {
+	if acct.FilterScript == "" {
+		return nil, nil
+	}
+	proto, err := compileScript(acct.FilterScript)
+	if err != nil {
+		return nil, err
+	}
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallStackSize,
+		RegistrySize:    scriptRegistrySize,
+		RegistryMaxSize: scriptRegistryMaxSize,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{{lua.BaseLibName, lua.OpenBase}, {lua.TabLibName, lua.OpenTable}, {lua.StringLibName, lua.OpenString}, {lua.MathLibName, lua.OpenMath}} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Nothing may reach the file system or load code at run time.
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage", "newproxy", "_printregs"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		args := make([]string, L.GetTop())
+		for i := range args {
+			args[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		logger.Info("filter script", "output", strings.Join(args, "\t"))
+		return 0
+	}))
+	strlib := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	rep := strlib.RawGetString("rep").(*lua.LFunction)
+	strlib.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		if int64(len(L.CheckString(1)))*int64(L.CheckInt(2)) > scriptMaxString {
+			L.RaiseError("string.rep: result too long")
+		}
+		return rep.GFunction(L)
+	}))
+
+	fs := &filterScript{L: L, timeout: acct.ScriptTimeout}
+	if err := fs.call(L.NewFunctionFromProto(proto), 0); err != nil {
+		L.Close()
+		return nil, err
+	}
+	fs.onCommand, _ = L.GetGlobal("on_command").(*lua.LFunction)
+	fs.onResponse, _ = L.GetGlobal("on_response").(*lua.LFunction)
+	if fs.onCommand == nil && fs.onResponse == nil {
+		L.Close()
+		return nil, fmt.Errorf("%s defines neither on_command nor on_response", acct.FilterScript)
+	}
+	return fs, nil
+}
+
+// call calls fn with args within the script's timeout and leaves nret
+// results on the stack. The caller holds mu or owns the state.
+func (fs *filterScript) call(fn *lua.LFunction, nret int, args ...lua.LValue) error {
+	ctx, cancel := context.WithTimeout(context.Background(), fs.timeout)
+	defer cancel()
+	fs.L.SetContext(ctx)
+	defer fs.L.RemoveContext()
+	return fs.L.CallByParam(lua.P{Fn: fn, NRet: nret, Protect: true}, args...)
+}
+
+// command calls on_command with a table describing cmd: its tag, verb,
+// the line as it would be forwarded, the user and the selected folder. The
+// script returns nothing or "allow", "block" and an optional reason, or
+// "rewrite" and a new command without tag.
+func (fs *filterScript) command(cmd imap.Command, line, user, folder string) (action, text string, err error) {
+	if fs == nil || fs.onCommand == nil {
+		return "allow", "", nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	L := fs.L
+	t := L.NewTable()
+	t.RawSetString("tag", lua.LString(cmd.Tag))
+	t.RawSetString("verb", lua.LString(commandVerb(cmd)))
+	t.RawSetString("line", lua.LString(strings.TrimRight(line, "\r\n")))
+	t.RawSetString("user", lua.LString(user))
+	t.RawSetString("folder", lua.LString(folder))
+	if err := fs.call(fs.onCommand, 2, t); err != nil {
+		return "", "", err
+	}
+	ret, arg := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	if ret == lua.LNil {
+		return "allow", "", nil
+	}
+	if ret.Type() != lua.LTString || arg != lua.LNil && arg.Type() != lua.LTString {
+		return "", "", fmt.Errorf("on_command returned %s, %s", ret.Type(), arg.Type())
+	}
+	action, text = ret.String(), ""
+	if arg != lua.LNil {
+		text = arg.String()
+	}
+	switch {
+	case action != "allow" && action != "block" && action != "rewrite":
+		return "", "", fmt.Errorf("on_command returned unknown action %q", action)
+	case action == "rewrite" && text == "":
+		return "", "", fmt.Errorf("on_command returned rewrite without a command")
+	case strings.ContainsAny(text, "\r\n\x00"):
+		return "", "", fmt.Errorf("on_command returned text spanning lines")
+	}
+	return action, text, nil
+}
+
+// response calls on_response with an untagged response line, without its
+// CRLF. The script returns nothing to relay it unchanged, a replacement
+// line, or false to drop it. A replacement must announce the same literal
+// as the original, if any.
+func (fs *filterScript) response(line string) (string, bool, error) {
+	if fs == nil || fs.onResponse == nil {
+		return line, true, nil
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	L := fs.L
+	trimmed := strings.TrimRight(line, "\r\n")
+	if err := fs.call(fs.onResponse, 1, lua.LString(trimmed)); err != nil {
+		return line, true, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	switch {
+	case ret == lua.LNil:
+		return line, true, nil
+	case ret == lua.LFalse:
+		return "", false, nil
+	case ret.Type() != lua.LTString:
+		return line, true, fmt.Errorf("on_response returned %s", ret.Type())
+	}
+	replaced := ret.String()
+	if !strings.HasPrefix(replaced, "* ") || strings.ContainsAny(replaced, "\r\n\x00") {
+		return line, true, fmt.Errorf("on_response must return a single untagged line")
+	}
+	n, nonSync, ok := imap.ParseLiteral([]byte(trimmed))
+	if m, mNonSync, mOK := imap.ParseLiteral([]byte(replaced)); mOK != ok || m != n || mNonSync != nonSync {
+		return line, true, fmt.Errorf("on_response changed the response's literal")
+	}
+	return replaced + "\r\n", true, nil
+}
+
+// checkScript runs the account's on_command on line, the command cmd is
+// about to be forwarded as. Like checkPolicy, it returns the command to
+// forward or handled when it has been answered. A script that fails
+// refuses the command.
+func (s *Session) checkScript(cmd imap.Command, line string) (imap.Command, string, bool, error) {
+	if s.script == nil {
+		return cmd, line, false, nil
+	}
+	action, text, err := s.script.command(cmd, line, s.account.LocalUser, s.selectedFolder)
+	if err == nil && action == "rewrite" {
+		var rewritten imap.Command
+		if rewritten, err = s.checkRewrite(cmd, line, text); err != nil {
+			err = fmt.Errorf("on_command: %w", err)
+		} else {
+			s.logger.Info("command rewritten by filter script", "verb", commandVerb(cmd))
+			return rewritten, cmd.Tag + " " + text + "\r\n", false, s.discardLiterals(line)
+		}
+	}
+	if err != nil {
+		scriptErrorsTotal.Inc("on_command")
+		s.logger.Warn("filter script failed", "hook", "on_command", "err", err)
+		action, text = "block", "[UNAVAILABLE] filter script failed"
+	}
+	if action == "block" {
+		s.refuseCommand(cmd, "filter_script", text)
+		return cmd, "", true, s.discardLiterals(line)
+	}
+	return cmd, line, false, nil
+}
+
+// scriptResponse runs the account's on_response on an untagged response
+// relayed to the client. It returns the line to relay, or false to drop
+// it. A script that fails leaves the line unchanged.
+func (s *Session) scriptResponse(line string) (string, bool) {
+	if s.script == nil || !strings.HasPrefix(line, "* ") {
+		return line, true
+	}
+	kept, ok, err := s.script.response(line)
+	if err != nil {
+		scriptErrorsTotal.Inc("on_response")
+		s.logger.Warn("filter script failed", "hook", "on_response", "err", err)
+	}
+	return kept, ok
+}
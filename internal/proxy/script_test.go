@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+)
+
+// writeScript writes a filter script and returns an account running it.
+func writeScript(t *testing.T, src string) *config.AccountConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "filter.lua")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &config.AccountConfig{LocalUser: "reader1", FilterScript: path, ScriptTimeout: 100 * time.Millisecond}
+}
+
+const testScript = `
+function on_command(cmd)
+  if cmd.verb == "FETCH" and cmd.folder == "Payroll" then
+    return "block", "[NOPERM] not during audits"
+  end
+  if cmd.verb == "SEARCH" and not string.find(cmd.line, "UNDELETED", 1, true) then
+    return "rewrite", "SEARCH UNDELETED " .. string.sub(cmd.line, #cmd.tag + 9)
+  end
+end
+
+function on_response(line)
+  if string.find(line, "^%* OK %[ALERT%]") then
+    return false
+  end
+  if string.find(line, "^%* FLAGS ") then
+    return (string.gsub(line, " \\Flagged", ""))
+  end
+end
+`
+
+func TestFilterScriptCommand(t *testing.T) {
+	fs, err := newFilterScript(writeScript(t, testScript), testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		line, folder string
+		action, text string
+	}{
+		{"a1 FETCH 1 (FLAGS)\r\n", "INBOX", "allow", ""},
+		{"a2 FETCH 1 (FLAGS)\r\n", "Payroll", "block", "[NOPERM] not during audits"},
+		{"a3 SEARCH FROM boss\r\n", "INBOX", "rewrite", "SEARCH UNDELETED FROM boss"},
+		{"a4 SEARCH UNDELETED\r\n", "INBOX", "allow", ""},
+	}
+	for _, tt := range tests {
+		cmd, err := imap.ParseCommand([]byte(tt.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		action, text, err := fs.command(cmd, tt.line, "reader1", tt.folder)
+		if err != nil || action != tt.action || text != tt.text {
+			t.Errorf("%q in %s = %q, %q, %v; want %q, %q", tt.line, tt.folder, action, text, err, tt.action, tt.text)
+		}
+	}
+}
+
+func TestFilterScriptResponse(t *testing.T) {
+	fs, err := newFilterScript(writeScript(t, testScript), testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		line, want string
+		keep       bool
+	}{
+		{"* 3 EXISTS\r\n", "* 3 EXISTS\r\n", true},
+		{"* OK [ALERT] maintenance tonight\r\n", "", false},
+		{"* FLAGS (\\Seen \\Flagged)\r\n", "* FLAGS (\\Seen)\r\n", true},
+	}
+	for _, tt := range tests {
+		got, keep, err := fs.response(tt.line)
+		if err != nil || got != tt.want || keep != tt.keep {
+			t.Errorf("response(%q) = %q, %v, %v; want %q, %v", tt.line, got, keep, err, tt.want, tt.keep)
+		}
+	}
+}
+
+func TestFilterScriptErrors(t *testing.T) {
+	tests := []struct {
+		name, src string
+		loadErr   string // error from newFilterScript; otherwise on_command must fail
+	}{
+		{"syntax", "function on_command(", "filter.lua"},
+		{"no hooks", "x = 1", "neither on_command nor on_response"},
+		{"top-level loop", "while true do end", "context deadline exceeded"},
+		{"no file access", "dofile('/etc/passwd')", "attempt to call a non-function"},
+		{"no io", "io.open('/etc/passwd')", "attempt to index a non-table"},
+		{"endless", "function on_command(cmd) while true do end end", ""},
+		{"huge string", "function on_command(cmd) return 'block', string.rep('x', 1e9) end", ""},
+		{"unknown action", "function on_command(cmd) return 'permit' end", ""},
+		{"multi-line reason", "function on_command(cmd) return 'block', 'no\\r\\n* BYE' end", ""},
+		{"rewrite without command", "function on_command(cmd) return 'rewrite' end", ""},
+	}
+	cmd, _ := imap.ParseCommand([]byte("a1 NOOP\r\n"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			fs, err := newFilterScript(writeScript(t, tt.src), testLogger())
+			if tt.loadErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.loadErr) {
+					t.Fatalf("load err = %v, want %q", err, tt.loadErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action, text, err := fs.command(cmd, "a1 NOOP\r\n", "reader1", ""); err == nil {
+				t.Errorf("on_command = %q, %q; want an error", action, text)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestFilterScriptResponseLiteral(t *testing.T) {
+	fs, err := newFilterScript(writeScript(t, `function on_response(line) return (string.gsub(line, "{%d+}$", "{1}")) end`), testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "* 1 FETCH (BODY[] {42}\r\n"
+	if got, keep, err := fs.response(line); err == nil || got != line || !keep {
+		t.Errorf("response = %q, %v, %v; want the line unchanged and an error", got, keep, err)
+	}
+}
+
+func TestIntegrationFilterScript(t *testing.T) {
+	cfg := testConfig()
+	acct := writeScript(t, `
+function on_command(cmd)
+  if cmd.verb == "STATUS" then return "block" end
+  if cmd.verb == "SELECT" then return "rewrite", "EXAMINE Archive" end
+end
+`)
+	cfg.Accounts[0].FilterScript, cfg.Accounts[0].ScriptTimeout = acct.FilterScript, acct.ScriptTimeout
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+	before := scriptErrorsTotal.Value("on_command")
+
+	env.send(t, "A002 STATUS INBOX (MESSAGES)\r\n")
+	if line := env.readLine(t); line != "A002 NO command refused by policy\r\n" {
+		t.Errorf("STATUS = %q", line)
+	}
+	env.noUpstream(t)
+
+	// The script sees SELECT as the EXAMINE it is forwarded as.
+	env.send(t, "A003 SELECT INBOX\r\n")
+	if got := env.expectUpstream(t, "A003"); got != "A003 EXAMINE Archive" {
+		t.Errorf("upstream got %q", got)
+	}
+	env.readUntilTagged(t, "A003")
+
+	if got := scriptErrorsTotal.Value("on_command") - before; got != 0 {
+		t.Errorf("script errors = %v", got)
+	}
+}
+
+func TestIntegrationFilterScriptResponses(t *testing.T) {
+	script := writeScript(t, `
+function on_response(line)
+  if string.find(line, '"Spam"', 1, true) then return false end
+  -- A rename cannot reveal a folder the account does not see.
+  return (string.gsub(line, '"Drafts"', '"Trash"'))
+end
+`)
+	env := newFolderFilterEnv(t, func(a *config.AccountConfig) {
+		a.BlockedFolders = []string{"Trash"}
+		a.FilterScript, a.ScriptTimeout = script.FilterScript, script.ScriptTimeout
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 LIST \"\" *\r\n")
+	env.drainUpstream(t)
+	var folders []string
+	for _, line := range env.readUntilTagged(t, "A002") {
+		if strings.HasPrefix(line, "* LIST") {
+			folders = append(folders, line)
+		}
+	}
+	if len(folders) != 4 {
+		t.Fatalf("folders = %q, want 4", folders)
+	}
+	for _, f := range folders {
+		if strings.Contains(f, `"Spam"`) || strings.Contains(f, `"Trash"`) || strings.Contains(f, `"Drafts"`) {
+			t.Errorf("folder listed: %s", f)
+		}
+	}
+}
+
+func TestIntegrationFilterScriptLoadFailure(t *testing.T) {
+	cfg := testConfig()
+	acct := writeScript(t, "function on_command(")
+	cfg.Accounts[0].FilterScript, cfg.Accounts[0].ScriptTimeout = acct.FilterScript, acct.ScriptTimeout
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.readLine(t)
+	env.send(t, "A001 LOGIN reader1 localpass1\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A001 NO [UNAVAILABLE]") {
+		t.Errorf("LOGIN = %q, want NO [UNAVAILABLE]", line)
+	}
+	env.noUpstream(t)
+}
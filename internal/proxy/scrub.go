@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+var headersScrubbedTotal = metrics.Default.NewCounter("imap_proxy_headers_scrubbed_total",
+	"Header fields removed or redacted from fetched message headers.")
+
+// redactedValue replaces the value of a redacted header field.
+const redactedValue = "[redacted]"
+
+// headerScrubber removes or redacts configured header fields in the
+// message headers returned by FETCH.
+type headerScrubber struct {
+	remove map[string]bool // lower-case field names
+	redact map[string]bool
+}
+
+// newHeaderScrubber returns a scrubber for the account, or nil when it has
+// no header rules.
+func newHeaderScrubber(acct *config.AccountConfig) *headerScrubber {
+	if !acct.ScrubsHeaders() {
+		return nil
+	}
+	h := &headerScrubber{remove: map[string]bool{}, redact: map[string]bool{}}
+	for _, name := range acct.RemoveHeaders {
+		h.remove[strings.ToLower(name)] = true
+	}
+	for _, name := range acct.RedactHeaders {
+		h.redact[strings.ToLower(name)] = true
+	}
+	return h
+}
+
+// ScrubMessage applies the account's remove_headers and redact_headers to
+// the header of a complete message, for tools that copy messages outside a
+// session.
+func ScrubMessage(acct *config.AccountConfig, msg []byte) []byte {
+	if h := newHeaderScrubber(acct); h != nil {
+		return h.scrub(msg)
+	}
+	return msg
+}
+
+// scrub returns the header block with the configured fields removed or
+// redacted. Folded continuation lines belong to the field they follow.
+// Anything after the blank line ending the header is kept as it is.
+func (h *headerScrubber) scrub(header []byte) []byte {
+	out := make([]byte, 0, len(header))
+	drop := false // the current field is being removed or redacted
+	for rest := header; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			out = append(out, line...)
+			out = append(out, rest...)
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if !drop {
+				out = append(out, line...)
+			}
+			continue
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		field := strings.ToLower(string(bytes.TrimRight(name, " \t")))
+		switch {
+		case h.remove[field]:
+			drop = true
+			headersScrubbedTotal.Inc()
+		case h.redact[field]:
+			drop = true
+			headersScrubbedTotal.Inc()
+			eol := line[len(bytes.TrimRight(line, "\r\n")):]
+			out = fmt.Appendf(out, "%s: %s%s", name, redactedValue, eol)
+		default:
+			drop = false
+			out = append(out, line...)
+		}
+	}
+	return out
+}
+
+// headerLiteral reports whether the literal announced at the end of an
+// upstream FETCH response line holds message headers: an RFC822.HEADER or
+// a BODY[...HEADER] or BODY[...HEADER.FIELDS (...)] item. Partial fetches
+// are excluded because their data may end inside a field.
+func headerLiteral(line string) bool {
+	data := strings.TrimRight(line, "\r\n")
+	open := strings.LastIndexByte(data, '{')
+	if open < 0 || !strings.HasSuffix(data, "}") {
+		return false
+	}
+	item := strings.ToUpper(strings.TrimRight(data[:open], " "))
+	if strings.HasSuffix(item, "RFC822.HEADER") {
+		return true
+	}
+	if !strings.HasSuffix(item, "]") {
+		return false
+	}
+	start := strings.LastIndex(item, "BODY[")
+	if start < 0 {
+		return false
+	}
+	section := item[start+len("BODY[") : len(item)-1]
+	section, _, _ = strings.Cut(section, " ")
+	return section == "HEADER" || strings.HasSuffix(section, ".HEADER") ||
+		strings.HasSuffix(section, "HEADER.FIELDS") || strings.HasSuffix(section, "HEADER.FIELDS.NOT")
+}
+
+// withLiteralSize returns line with the size of its trailing literal
+// replaced by n.
+func withLiteralSize(line string, n int) string {
+	data := strings.TrimRight(line, "\r\n")
+	open := strings.LastIndexByte(data, '{')
+	return fmt.Sprintf("%s{%d}%s", data[:open], n, line[len(data):])
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestHeaderScrub(t *testing.T) {
+	h := newHeaderScrubber(&config.AccountConfig{
+		RemoveHeaders: []string{"X-Spam-Status", "Received"},
+		RedactHeaders: []string{"delivered-to"},
+	})
+	header := "Received: from a\r\n\tby b\r\n" +
+		"From: alice@example.com\r\n" +
+		"Delivered-To: bob@example.com\r\n" +
+		"X-Spam-Status: No, score=-1\r\n  tests=NONE\r\n" +
+		"Subject: hi\r\n" +
+		"\r\n" +
+		"X-Spam-Status: in the body\r\n"
+	want := "From: alice@example.com\r\n" +
+		"Delivered-To: [redacted]\r\n" +
+		"Subject: hi\r\n" +
+		"\r\n" +
+		"X-Spam-Status: in the body\r\n"
+	if got := string(h.scrub([]byte(header))); got != want {
+		t.Errorf("scrub = %q, want %q", got, want)
+	}
+
+	if newHeaderScrubber(&config.AccountConfig{}) != nil {
+		t.Error("scrubber created for an account without header rules")
+	}
+}
+
+func TestHeaderLiteral(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"* 1 FETCH (BODY[HEADER] {42}\r\n", true},
+		{"* 1 FETCH (UID 7 RFC822.HEADER {42}\r\n", true},
+		{"* 1 FETCH (body[header.fields (FROM TO)] {42}\r\n", true},
+		{"* 1 FETCH (BODY[HEADER.FIELDS.NOT (X-SPAM)] {42}\r\n", true},
+		{"* 1 FETCH (BODY[2.HEADER] {42}\r\n", true},
+		{" BODY[HEADER] {42}\r\n", true}, // after an earlier literal
+		{"* 1 FETCH (BODY[HEADER]<0> {42}\r\n", false},
+		{"* 1 FETCH (BODY[] {42}\r\n", false},
+		{"* 1 FETCH (BODY[TEXT] {42}\r\n", false},
+		{"* 1 FETCH (BODY[1.MIME] {42}\r\n", false},
+		{"* 1 FETCH (RFC822.SIZE 42)\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := headerLiteral(tt.line); got != tt.want {
+			t.Errorf("headerLiteral(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestWithLiteralSize(t *testing.T) {
+	if got := withLiteralSize("* 1 FETCH (BODY[HEADER] {42}\r\n", 7); got != "* 1 FETCH (BODY[HEADER] {7}\r\n" {
+		t.Errorf("withLiteralSize = %q", got)
+	}
+}
+
+func TestIntegrationHeadersScrubbed(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].RemoveHeaders = []string{"X-Spam-Status"}
+	received := make(chan string, 100)
+	header := "From: a@example.com\r\nX-Spam-Status: Yes\r\n\r\n"
+	body := "hello\r\n"
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go func() {
+				defer upServer.Close()
+				sr := bufio.NewReader(upServer)
+				for {
+					line, err := sr.ReadString('\n')
+					if err != nil {
+						return
+					}
+					received <- strings.TrimRight(line, "\r\n")
+					tag, _, _ := strings.Cut(line, " ")
+					if strings.Contains(line, "FETCH") {
+						fmt.Fprintf(upServer, "* 1 FETCH (BODY[TEXT] {%d}\r\n%s BODY[HEADER] {%d}\r\n%s)\r\n",
+							len(body), body, len(header), header)
+					}
+					fmt.Fprintf(upServer, "%s OK done\r\n", tag)
+				}
+			}()
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	env.login(t)
+
+	env.send(t, "A1 FETCH 1 (BODY.PEEK[TEXT] BODY.PEEK[HEADER])\r\n")
+	env.expectUpstream(t, "A1 FETCH")
+	want := "From: a@example.com\r\n\r\n"
+	wantResp := fmt.Sprintf("* 1 FETCH (BODY[TEXT] {%d}\r\n%s BODY[HEADER] {%d}\r\n%s)\r\nA1 OK done\r\n",
+		len(body), body, len(want), want)
+	got := make([]byte, len(wantResp))
+	if _, err := io.ReadFull(env.clientR, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != wantResp {
+		t.Errorf("FETCH response = %q, want %q", got, wantResp)
+	}
+}
+
+func TestScrubMessage(t *testing.T) {
+	msg := []byte("X-Spam-Status: Yes\r\nSubject: hi\r\n\r\nX-Spam-Status: body\r\n")
+	acct := &config.AccountConfig{RemoveHeaders: []string{"X-Spam-Status"}}
+	if got := string(ScrubMessage(acct, msg)); got != "Subject: hi\r\n\r\nX-Spam-Status: body\r\n" {
+		t.Errorf("ScrubMessage = %q", got)
+	}
+	if got := ScrubMessage(&config.AccountConfig{}, msg); string(got) != string(msg) {
+		t.Errorf("ScrubMessage without rules = %q", got)
+	}
+}
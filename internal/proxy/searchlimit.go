@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var searchesRefusedTotal = metrics.Default.NewCounter("imap_proxy_searches_refused_total",
+	"SEARCH, SORT and THREAD commands refused by search_blocked_keys or max_search_keys, by reason.", "reason")
+
+// Reasons for refusing a search.
+const (
+	searchKeyBlocked = "blocked_key"
+	searchTooComplex = "too_complex"
+)
+
+// searchRefusal checks a SEARCH, SORT or THREAD command against the
+// account's search restrictions. It returns the reason and the response
+// text for refusing it, or "" to let it through. Only the command's first
+// line is inspected, so keys following a literal argument are not seen.
+func (s *Session) searchRefusal(cmd imap.Command, line string) (reason, text string) {
+	blocked, limit := s.account.SearchBlockedKeys, s.account.MaxSearchKeys
+	if len(blocked) == 0 && limit <= 0 {
+		return "", ""
+	}
+	verb, fields := cmd.Verb, 2
+	if verb == "UID" {
+		verb, fields = cmd.SubVerb, 3
+	}
+	if verb != "SEARCH" && verb != "SORT" && verb != "THREAD" {
+		return "", ""
+	}
+	parts := strings.SplitN(line, " ", fields+1)
+	if len(parts) <= fields {
+		return "", ""
+	}
+
+	keys := 0
+	skip := 0   // arguments of the previous key still to pass
+	group := -1 // depth at which a skipped parenthesized group ends
+	depth := 0  // parenthesis nesting
+	switch verb {
+	case "SORT":
+		group, skip = 0, 1 // the sort criteria, then the charset
+	case "THREAD":
+		skip = 2 // the algorithm and the charset
+	}
+	args := parts[fields]
+	for _, tok := range searchTokens(args) {
+		text := args[tok.start:tok.end]
+		upper := strings.ToUpper(text)
+		switch {
+		case text == "(":
+			depth++
+			continue
+		case text == ")":
+			depth--
+			if depth == group {
+				group = -1
+			}
+			continue
+		case group >= 0:
+			continue
+		case skip > 0:
+			skip--
+			continue
+		case upper == "RETURN":
+			group = depth
+			continue
+		case upper == "CHARSET":
+			skip = 1
+			continue
+		}
+		if slices.Contains(blocked, upper) {
+			return searchKeyBlocked, fmt.Sprintf("search key %s not permitted", upper)
+		}
+		if upper == "OR" || upper == "NOT" {
+			continue
+		}
+		keys++
+		skip = searchKeyArgs[upper]
+	}
+	if limit > 0 && keys > limit {
+		return searchTooComplex, fmt.Sprintf("search too complex: %d keys, the limit is %d", keys, limit)
+	}
+	return "", ""
+}
+
+// discardLiterals consumes the non-synchronizing literals of a refused
+// command together with the rest of the command, so that they are not
+// taken for commands. A client sending a synchronizing literal waits for
+// a continuation that never comes and stops at the tagged response.
+func (s *Session) discardLiterals(line string) error {
+	for {
+		n, nonSync, ok := imap.ParseLiteral([]byte(line))
+		if !ok || !nonSync {
+			return nil
+		}
+		if _, err := io.CopyN(io.Discard, s.clientR, n); err != nil {
+			return err
+		}
+		next, err := s.readLine(s.clientR)
+		if err != nil {
+			return err
+		}
+		line = next
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"testing"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+)
+
+func TestSearchRefusal(t *testing.T) {
+	s := &Session{account: &config.AccountConfig{SearchBlockedKeys: []string{"TEXT", "BODY"}, MaxSearchKeys: 3}}
+	tests := []struct {
+		line   string
+		reason string
+	}{
+		{"A1 SEARCH UNSEEN SINCE 1-Jan-2024\r\n", ""},
+		{"A1 UID SEARCH TEXT \"invoice\"\r\n", searchKeyBlocked},
+		{"A1 SEARCH OR SEEN (NOT body x)\r\n", searchKeyBlocked},
+		{"A1 SEARCH SUBJECT \"TEXT\" FROM body\r\n", ""}, // arguments are not keys
+		{"A1 SEARCH CHARSET UTF-8 HEADER X-Text text\r\n", ""},
+		{"A1 SEARCH OR OR FROM a FROM b OR FROM c FROM d\r\n", searchTooComplex},
+		{"A1 SEARCH RETURN (MIN MAX COUNT ALL) 1:* SEEN\r\n", ""},
+		{"A1 SORT (ARRIVAL) UTF-8 FROM a TO b\r\n", ""},
+		{"A1 UID SORT (DATE) UTF-8 TEXT x\r\n", searchKeyBlocked},
+		{"A1 THREAD REFERENCES UTF-8 SEEN FROM a TO b CC c\r\n", searchTooComplex},
+		{"A1 FETCH 1 BODY[TEXT]\r\n", ""},
+	}
+	for _, tt := range tests {
+		cmd, err := imap.ParseCommand([]byte(tt.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason, _ := s.searchRefusal(cmd, tt.line); reason != tt.reason {
+			t.Errorf("searchRefusal(%q) = %q, want %q", tt.line, reason, tt.reason)
+		}
+	}
+
+	s.account = &config.AccountConfig{}
+	cmd, _ := imap.ParseCommand([]byte("A1 SEARCH TEXT x\r\n"))
+	if reason, _ := s.searchRefusal(cmd, "A1 SEARCH TEXT x\r\n"); reason != "" {
+		t.Errorf("searchRefusal without limits = %q", reason)
+	}
+}
+
+func TestIntegrationSearchRefused(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].SearchBlockedKeys = []string{"BODY"}
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A1 SEARCH BODY {7+}\r\nA2 NOOP FROM x\r\n")
+	if line := env.readLine(t); line != "A1 NO [LIMIT] search key BODY not permitted\r\n" {
+		t.Fatalf("got %q, want the refusal", line)
+	}
+	env.noUpstream(t)
+
+	env.send(t, "A3 NOOP\r\n")
+	env.expectUpstream(t, "A3 NOOP")
+	if line := env.readLine(t); line != "A3 OK completed\r\n" {
+		t.Fatalf("got %q", line)
+	}
+}
@@ -1,44 +1,158 @@
 package proxy
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 	"sync"
+	"time"
 
+	"imap-proxy/internal/audit"
 	"imap-proxy/internal/config"
+	"imap-proxy/internal/proxyproto"
 )
 
+// proxyHeaderTimeout bounds how long a new connection may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
 // Server listens for incoming client connections and spawns sessions.
 type Server struct {
-	config   *config.Config
-	mu       sync.Mutex
-	listener net.Listener
-	logger   *slog.Logger
+	config    *config.Config
+	mu        sync.Mutex
+	listeners []net.Listener
+	logger    *slog.Logger
+	shared    *shared
+	admit     *admission
+	tlsConfig *tls.Config // nil disables STARTTLS and implicit TLS
+
+	// digestDial allows tests to inject a fake upstream for blocked
+	// command digests; nil uses DialUpstream.
+	digestDial func(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error)
 }
 
 // NewServer creates a new Server with the given config and logger.
 func NewServer(cfg *config.Config, logger *slog.Logger) *Server {
+	sh := newShared()
+	sh.hosts = NewHostLimits(cfg.Server)
+	sh.audit = audit.New(audit.SlogSink{Logger: logger})
+	initFolderRuleMetrics(cfg)
 	return &Server{
 		config: cfg,
 		logger: logger,
+		shared: sh,
+		admit:  newAdmission(cfg.Server),
 	}
 }
 
-// ListenAndServe binds a TCP listener on cfg.Server.Listen and starts accepting connections.
+// AddAuditSink sends audit events to sink in addition to the log. It must
+// be called before Serve.
+func (s *Server) AddAuditSink(sink audit.Sink) {
+	s.shared.audit = s.shared.audit.With(sink)
+}
+
+// ListenAndServe binds a TCP listener on cfg.Server.Listen and, when
+// configured, an implicit TLS listener on cfg.Server.TLSListen and a POP3
+// listener on cfg.Server.POP3Listen, and accepts connections until Close
+// is called. The listeners set SO_REUSEPORT if cfg.Server.ReusePort is
+// set.
 func (s *Server) ListenAndServe() error {
-	l, err := net.Listen("tcp", s.config.Server.Listen)
-	if err != nil {
-		return err
+	if s.config.Server.TLSListen != "" && s.tlsConfig == nil {
+		return errors.New("tls_listen requires a TLS certificate")
+	}
+	listeners := []struct {
+		addr  string
+		serve func(net.Listener) error
+	}{
+		{s.config.Server.Listen, s.Serve},
+		{s.config.Server.TLSListen, s.ServeTLS},
+		{s.config.Server.POP3Listen, s.ServePOP3},
+	}
+	var (
+		ls     []net.Listener
+		serves []func(net.Listener) error
+	)
+	for _, ln := range listeners {
+		if ln.addr == "" {
+			continue
+		}
+		l, err := Listen(ln.addr, s.config.Server.ReusePort)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return err
+		}
+		ls = append(ls, l)
+		serves = append(serves, ln.serve)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.runRelayMonitor(stop)
+	if slices.ContainsFunc(s.config.Accounts, func(a config.AccountConfig) bool { return a.BlockedDigestFolder != "" }) {
+		go s.runBlockedDigests(stop)
+	}
+	errCh := make(chan error, len(ls))
+	for i, l := range ls {
+		go func() { errCh <- serves[i](l) }()
+	}
+	err := <-errCh
+	s.Close()
+	for range len(ls) - 1 {
+		if err2 := <-errCh; err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// clientProtocol is the protocol a listener speaks.
+type clientProtocol int
+
+const (
+	protoIMAP clientProtocol = iota
+	protoPOP3
+)
+
+// goodbye formats a final refusal before the connection is closed. code
+// is an IMAP response code such as UNAVAILABLE, or "".
+func (p clientProtocol) goodbye(code, text string) string {
+	if p == protoPOP3 {
+		return "-ERR " + pop3ResponseCode(code) + text + "\r\n"
+	}
+	if code != "" {
+		text = "[" + code + "] " + text
 	}
-	s.listener = l
-	return s.Serve(l)
+	return "* BYE " + text + "\r\n"
 }
 
 // Serve accepts connections on the provided listener, spawning a session goroutine per connection.
 func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, false, protoIMAP)
+}
+
+// ServeTLS is like Serve but expects clients to start with a TLS handshake
+// (implicit TLS, as on port 993). SetTLSConfig must have been called.
+func (s *Server) ServeTLS(l net.Listener) error {
+	if s.tlsConfig == nil {
+		return errors.New("ServeTLS: no TLS config")
+	}
+	return s.serve(l, true, protoIMAP)
+}
+
+// ServePOP3 is like Serve for POP3 clients, which get read-only access to
+// the INBOX of their account.
+func (s *Server) ServePOP3(l net.Listener) error {
+	return s.serve(l, false, protoPOP3)
+}
+
+func (s *Server) serve(l net.Listener, implicitTLS bool, proto clientProtocol) error {
 	s.mu.Lock()
-	s.listener = l
+	s.listeners = append(s.listeners, l)
 	s.mu.Unlock()
 	for {
 		conn, err := l.Accept()
@@ -49,19 +163,146 @@ func (s *Server) Serve(l net.Listener) error {
 			}
 			return err
 		}
-		s.logger.Info("new connection", "client", conn.RemoteAddr())
-		sess := NewSession(conn, s.config, s.logger)
-		go sess.Run()
+		release, reason := s.admit.admit()
+		if release == nil {
+			s.logger.Warn("connection shed: server saturated", "client", conn.RemoteAddr(), "reason", reason)
+			shed(conn, reason, proto)
+			continue
+		}
+		go s.handleConn(conn, implicitTLS, proto, release)
+	}
+}
+
+// handleConn applies connection-level admission checks and runs a session.
+// releaseUnauth is called once the client logs in or the connection ends.
+func (s *Server) handleConn(conn net.Conn, implicitTLS bool, proto clientProtocol, releaseUnauth func()) {
+	defer releaseUnauth()
+	if err := tuneConn(conn, s.config.Server.ClientSocket); err != nil {
+		s.logger.Warn("failed to apply client socket options", "client", conn.RemoteAddr(), "err", err)
+	}
+	if s.config.Server.ProxyProtocol {
+		pc, err := proxyproto.ReadHeader(conn, proxyHeaderTimeout)
+		if err != nil {
+			s.logger.Warn("rejecting connection without valid PROXY header", "client", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+		conn = pc
+	}
+
+	ip := clientIP(conn)
+	if !s.allowConn(conn, ip, proto) {
+		return
+	}
+
+	if implicitTLS {
+		tc := tls.Server(conn, s.tlsConfig)
+		tc.SetDeadline(time.Now().Add(clientHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			s.logger.Info("client TLS handshake failed", "client", ip, "err", err)
+			conn.Close()
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+
+	sess := NewSession(conn, s.config, s.logger)
+	sess.logger.Info("new connection", "client", conn.RemoteAddr(), "tls", implicitTLS, "pop3", proto == protoPOP3)
+	sess.shared = s.shared
+	sess.tlsConfig = s.tlsConfig
+	sess.tlsActive = implicitTLS
+	sess.releaseUnauth = releaseUnauth
+	if proto == protoPOP3 {
+		(&pop3Session{Session: sess}).run()
+		return
+	}
+	sess.Run()
+}
+
+// allowConn applies the server access lists, country filter and per-IP
+// rate limit to a new connection from ip. A refused connection is told
+// why and closed.
+func (s *Server) allowConn(conn net.Conn, ip string, proto clientProtocol) bool {
+	if code, text := s.checkConn(ip); text != "" {
+		fmt.Fprint(conn, proto.goodbye(code, text))
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// checkConn applies the server access lists, country filter and per-IP
+// rate limit to a new connection from ip. It returns "" if the connection
+// may proceed, or the response code and text to refuse it with.
+func (s *Server) checkConn(ip string) (code, text string) {
+	if !s.config.Server.IPAllowed(ip) {
+		s.logger.Warn("connection refused: source IP not allowed", "client", ip)
+		return "", "access denied"
+	}
+	if s.shared.geo != nil {
+		if country := s.shared.lookupCountry(ip); !s.config.Server.CountryAllowed(country) {
+			s.logger.Warn("connection refused: country not allowed", "client", ip, "country", country)
+			return "", "access denied"
+		}
 	}
+	if !s.shared.ipLimits.allowConnection(ip, s.config.Server.RateLimit) {
+		s.logger.Warn("connection refused: source IP rate limited", "client", ip)
+		return "UNAVAILABLE", "too many connections, try again later"
+	}
+	return "", ""
+}
+
+// LimitListener returns a listener that applies the server access lists,
+// country filter and per-IP rate limit to the connections accepted by l,
+// as for IMAP connections. It is meant for the HTTP listener; refused
+// connections are closed without a response.
+func (s *Server) LimitListener(l net.Listener) net.Listener {
+	return &limitListener{Listener: l, srv: s}
+}
+
+type limitListener struct {
+	net.Listener
+	srv *Server
 }
 
-// Close shuts down the listener, causing Serve/ListenAndServe to return.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if _, text := l.srv.checkConn(clientIP(conn)); text == "" {
+			return &checkedConn{conn}, nil
+		}
+		conn.Close()
+	}
+}
+
+// checkedConn is a connection a limitListener admitted.
+type checkedConn struct{ net.Conn }
+
+// connChecked reports whether conn, or the connection under its TLS
+// layer, was admitted by a limitListener.
+func connChecked(conn net.Conn) bool {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	_, ok := conn.(*checkedConn)
+	return ok
+}
+
+// Close shuts down the listeners, causing Serve/ListenAndServe to return.
 func (s *Server) Close() error {
 	s.mu.Lock()
-	l := s.listener
+	ls := s.listeners
+	s.listeners = nil
 	s.mu.Unlock()
-	if l != nil {
-		return l.Close()
+	var err error
+	for _, l := range ls {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
-	return nil
+	return err
 }
@@ -2,15 +2,22 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/buildinfo"
 	"imap-proxy/internal/config"
 	"imap-proxy/internal/imap"
+	"imap-proxy/internal/transcript"
 )
 
 // SessionState represents the current state of an IMAP session.
@@ -32,10 +39,89 @@ type Session struct {
 	upstreamR    *bufio.Reader
 	state        SessionState
 	account      *config.AccountConfig
+	upstream     string // upstreamKey of account, set at LOGIN
 	config       *config.Config
 	logger       *slog.Logger
+	connLogger   *slog.Logger  // logger before LOGIN, restored by UNAUTHENTICATE
+	baseLogger   *slog.Logger  // the Server's logger, which account loggers build on
+	trace        *sessionTrace // state the admin API can change while the session runs
+	loggedInAs   []string      // local users logged in as, in order
 
-	selectedFolder string // current mailbox from SELECT/EXAMINE
+	selectedFolder string       // current mailbox from SELECT/EXAMINE
+	mailbox        mailboxState // upstream view of the selected mailbox
+
+	// deadline detects an upstream that stops responding; set in runPostAuth.
+	deadline *responseDeadline
+	// writeMu keeps keepalive NOOPs from being written in the middle of a
+	// relayed command or its literals.
+	writeMu           sync.Mutex
+	keepalive         keepalive
+	memory            memoryBudget
+	keepaliveInterval time.Duration // upstreamKeepaliveInterval when the session started
+	// coalesce batches size updates to clients in IDLE; nil when disabled.
+	coalesce *coalescer
+
+	// view translates message numbers in the selected folder when the
+	// account hides messages; nil otherwise.
+	view        atomic.Pointer[view]
+	internal    atomic.Pointer[internalCmd] // internal command awaiting its response
+	internalSeq int                         // tags internal commands; client goroutine only
+
+	// out serializes writes to the client; stopped is closed when the
+	// session ends. Both are set in runPostAuth.
+	out     *lockedWriter
+	stopped <-chan struct{}
+
+	// mu guards clientConn, upstreamConn and logger for access from the watchdog.
+	mu           sync.Mutex
+	lastActivity atomic.Int64              // unix nanos of the last client read or write
+	idling       atomic.Bool               // true while relaying IDLE
+	idle         atomic.Pointer[idleRelay] // the most recent IDLE relayed
+	loggingOut   atomic.Bool               // the proxy has sent LOGOUT upstream
+
+	shared      *shared
+	clientIP    string
+	releaseSlot func() // releases the session limit slot held after LOGIN
+
+	// releaseUnauth, when set, stops counting the connection as
+	// unauthenticated; it is called after a successful LOGIN.
+	releaseUnauth func()
+
+	clientID map[string]string // parameters from the client's ID command
+	usage    usageTracker      // per-folder activity for folder_usage events
+	stats    sessionStats      // totals for the session_summary event
+
+	// readOnlySelect is the SELECT awaiting a read_only_alert; alerted holds
+	// the folders alerted so far and belongs to the upstream→client goroutine.
+	readOnlySelect atomic.Pointer[readOnlySelect]
+	alerted        map[string]bool
+
+	// opening is the SELECT or EXAMINE awaiting its response when events
+	// are published; openFolder, the mailbox it opened, belongs to the
+	// upstream→client goroutine.
+	opening    atomic.Pointer[openingMailbox]
+	openFolder string
+
+	commandLog commandLog
+
+	// appended holds the folders APPENDs succeeded in, which need not be
+	// created; client goroutine only.
+	appended map[string]bool
+
+	// script is the account's filter script; nil when it has none.
+	script *filterScript
+
+	tlsConfig *tls.Config // enables STARTTLS when set
+	tlsActive bool        // the client connection is encrypted
+
+	recorder *transcript.Recorder // writes the session transcript; nil when not recording
+
+	clientCountry   string // resolved lazily by country()
+	countryResolved bool
+
+	// pinnedIP is the upstream address reconnects use when the account sets
+	// pin_upstream_ip; set at LOGIN.
+	pinnedIP string
 
 	// dialUpstream allows tests to inject a fake dialer.
 	dialUpstream func(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error)
@@ -43,66 +129,125 @@ type Session struct {
 
 // NewSession creates a new Session for the given client connection.
 func NewSession(clientConn net.Conn, cfg *config.Config, logger *slog.Logger) *Session {
-	return &Session{
-		clientConn:   clientConn,
-		clientR:      bufio.NewReader(clientConn),
-		state:        StateGreeting,
-		config:       cfg,
-		logger:       logger,
-		dialUpstream: DialUpstream,
+	s := &Session{
+		state:      StateGreeting,
+		config:     cfg,
+		baseLogger: logger,
+		shared:     newShared(),
+
+		keepaliveInterval: upstreamKeepaliveInterval,
 	}
+	s.shared.hosts = NewHostLimits(cfg.Server)
+	s.memory.limit = cfg.Server.SessionMemoryLimit()
+	s.keepalive.mem = &s.memory
+	s.dialUpstream = s.dialPinned
+	// All relayed bytes pass through the client connection, so tracking it
+	// is enough to detect progress in both directions.
+	s.clientIP = clientIP(clientConn)
+	s.trace = &sessionTrace{id: newSessionID(), client: clientConn.RemoteAddr().String(), started: time.Now()}
+	s.logger = s.traced(logger)
+	s.clientConn = &activityConn{Conn: clientConn, last: &s.lastActivity, stats: &s.stats}
+	s.clientR = bufio.NewReader(s.clientConn)
+	s.stats.start = time.Now()
+	s.lastActivity.Store(s.stats.start.UnixNano())
+	return s
 }
 
 // Run executes the session lifecycle: greeting, pre-auth, post-auth, teardown.
 func (s *Session) Run() {
-	defer s.clientConn.Close()
+	defer s.shared.sessions.add(s.trace)()
+	s.startRecording()
+	defer s.finishRecording()
+	defer func() { s.clientConn.Close() }()
+	defer func() {
+		if s.releaseSlot != nil {
+			s.releaseSlot()
+		}
+	}()
+
+	if timeout := s.config.Server.StuckSessionTimeout; timeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go s.runWatchdog(timeout, done)
+	}
 
 	// 1. Send greeting.
-	if _, err := fmt.Fprint(s.clientConn, "* OK imap-proxy ready\r\n"); err != nil {
+	if _, err := fmt.Fprint(s.clientConn, s.greeting()+"\r\n"); err != nil {
 		s.logger.Error("failed to send greeting", "err", err)
 		return
 	}
 	s.state = StateNotAuth
 
 	// 2. Pre-auth loop.
+	for s.runPreAuth() {
+		// 3. Post-auth: bidirectional proxy, until the client logs out,
+		// disconnects or returns to pre-auth with UNAUTHENTICATE.
+		if !s.runPostAuth() {
+			return
+		}
+	}
+}
+
+// runPreAuth handles commands in the not-authenticated state until LOGIN
+// succeeds. It reports false if the session ended instead.
+func (s *Session) runPreAuth() bool {
 	for s.state == StateNotAuth {
-		line, err := s.clientR.ReadString('\n')
+		line, err := s.readLine(s.clientR)
 		if err != nil {
+			if errors.Is(err, errMemoryLimit) {
+				s.memoryExceeded(s.clientConn, "client")
+				return false
+			}
 			s.logger.Info("client disconnected in pre-auth", "err", err)
-			return
+			return false
 		}
 
 		cmd, parseErr := imap.ParseCommand([]byte(line))
 		if parseErr != nil {
-			// Can't parse → try to extract a tag for the BAD response.
-			tag := extractTag(line)
-			fmt.Fprintf(s.clientConn, "%s BAD command not recognized\r\n", tag)
+			if err := s.rejectUnparseable(line, parseErr); err != nil {
+				return false
+			}
+			continue
+		}
+		if rejected, err := s.rejectInvalid(cmd, line); err != nil {
+			return false
+		} else if rejected {
 			continue
 		}
+		s.stats.command(commandVerb(cmd))
 
 		switch cmd.Verb {
 		case "CAPABILITY":
-			fmt.Fprintf(s.clientConn, "* CAPABILITY IMAP4rev1 IDLE LITERAL+\r\n")
+			fmt.Fprintf(s.clientConn, "* CAPABILITY %s\r\n", s.preAuthCapabilities())
 			fmt.Fprintf(s.clientConn, "%s OK CAPABILITY completed\r\n", cmd.Tag)
 
 		case "NOOP":
 			fmt.Fprintf(s.clientConn, "%s OK NOOP completed\r\n", cmd.Tag)
 
 		case "LOGOUT":
-			fmt.Fprintf(s.clientConn, "* BYE imap-proxy logging out\r\n")
+			fmt.Fprint(s.clientConn, s.byeLogout())
 			fmt.Fprintf(s.clientConn, "%s OK LOGOUT completed\r\n", cmd.Tag)
-			return
+			return false
+
+		case "STARTTLS":
+			if !s.handleStartTLS(cmd) {
+				return false
+			}
 
 		case "LOGIN":
 			s.handleLogin(cmd)
 
+		case "ID":
+			s.handleID(cmd)
+
+		case "CLIENTID":
+			s.handleClientID(cmd)
+
 		default:
 			fmt.Fprintf(s.clientConn, "%s BAD command not recognized\r\n", cmd.Tag)
 		}
 	}
-
-	// 3. Post-auth: bidirectional proxy.
-	s.runPostAuth()
+	return true
 }
 
 // handleLogin processes a LOGIN command during pre-auth.
@@ -113,156 +258,636 @@ func (s *Session) handleLogin(cmd imap.Command) {
 	// Find the args portion: skip "tag LOGIN "
 	parts := strings.SplitN(raw, " ", 3)
 	if len(parts) < 3 {
-		fmt.Fprintf(s.clientConn, "%s NO LOGIN failed\r\n", cmd.Tag)
+		s.failLogin(cmd.Tag)
 		return
 	}
 	args := parts[2] // everything after "tag LOGIN"
 
-	user, pass, err := parseLoginArgs(args)
-	if err != nil {
-		s.logger.Warn("LOGIN parse error", "err", err)
-		fmt.Fprintf(s.clientConn, "%s NO LOGIN failed\r\n", cmd.Tag)
+	// The arguments are read even if the login is refused, so that any
+	// literals in them are consumed.
+	user, pass, err := s.readLoginArgs(args)
+	r := s.loginClient().admit()
+	if r == nil {
+		if err != nil {
+			s.logger.Warn("LOGIN parse error", "err", err)
+			r = loginFailed
+		} else {
+			r = s.login(user, pass)
+		}
+	}
+	if r != nil {
+		s.refuseLogin(cmd.Tag, r)
 		return
 	}
+	fmt.Fprintf(s.clientConn, "%s OK LOGIN completed\r\n", cmd.Tag)
+}
 
-	acct := s.config.LookupUser(user)
-	if acct == nil {
-		s.logger.Warn("LOGIN unknown user", "user", user)
-		fmt.Fprintf(s.clientConn, "%s NO LOGIN failed\r\n", cmd.Tag)
+// refuseLogin answers a LOGIN refused by admit or login.
+func (s *Session) refuseLogin(tag string, r *loginRefusal) {
+	if r.failed {
+		s.failLogin(tag)
 		return
 	}
+	text := r.text
+	if r.code != "" {
+		text = "[" + r.code + "] " + text
+	}
+	fmt.Fprintf(s.clientConn, "%s NO %s\r\n", tag, text)
+}
 
-	if acct.LocalPassword != pass {
-		s.logger.Warn("LOGIN wrong password", "user", user)
-		fmt.Fprintf(s.clientConn, "%s NO LOGIN failed\r\n", cmd.Tag)
-		return
+// login authenticates the client as user, applies the account's access
+// rules and logs into the upstream. On success the session is
+// authenticated and holds the upstream connection; otherwise it returns
+// why the client was refused.
+func (s *Session) login(user, pass string) *loginRefusal {
+	acct, r := s.loginClient().authenticate(user, pass)
+	if r != nil {
+		return r
+	}
+
+	if !s.clientAllowed(acct) {
+		s.recordAudit(audit.Event{
+			Type: audit.LoginFailure, User: user,
+			Fields: map[string]string{"reason": "client policy"},
+		})
+		return &loginRefusal{text: "client software not permitted for this account"}
+	}
+	s.shared.lockout.success(user)
+
+	script, err := newFilterScript(acct, s.logger.With("user", user))
+	if err != nil {
+		s.logger.Error("LOGIN refused: filter script failed to load", "user", user, "err", err)
+		return &loginRefusal{code: "UNAVAILABLE", text: "account temporarily unavailable"}
+	}
+
+	upstream := upstreamKey(acct)
+	breakerCfg := s.config.Server.CircuitBreaker
+	if !s.shared.breakers.allow(upstream, breakerCfg) {
+		s.logger.Warn("LOGIN rejected: upstream circuit breaker open", "user", user, "upstream", upstream)
+		return &loginRefusal{code: "UNAVAILABLE", text: "upstream temporarily unavailable, try again later"}
+	}
+
+	release, scope := s.shared.limits.acquire(acct.LocalUser,
+		s.config.Server.MaxConnections, acct.MaxSessions, s.config.Server.LimitQueueTimeout)
+	if release != nil {
+		releaseSession := release
+		releaseHost, err := s.shared.hosts.Acquire(acct)
+		if err != nil {
+			releaseSession()
+			release, scope = nil, "host"
+		} else {
+			release = func() { releaseHost(); releaseSession() }
+		}
+	}
+	if release == nil {
+		// No upstream attempt was made, so this says nothing about its health.
+		s.shared.breakers.cancel(upstream)
+		s.logger.Warn("LOGIN rejected: session limit reached", "user", user, "scope", scope)
+		return &loginRefusal{code: "LIMIT", text: "too many sessions"}
 	}
 
 	conn, reader, dialErr := s.dialUpstream(acct)
 	if dialErr != nil {
+		release()
+		s.upstreamFailed(upstream, breakerCfg)
 		s.logger.Error("upstream dial failed", "err", dialErr)
-		fmt.Fprintf(s.clientConn, "%s NO LOGIN failed\r\n", cmd.Tag)
-		return
+		return &loginRefusal{code: "UNAVAILABLE", text: dialFailureReason(dialErr)}
+	}
+
+	if acct.RemoteInsecureSkipVerify && acct.UpstreamTLS() {
+		s.logger.Warn("upstream certificate not verified (remote_insecure_skip_verify)", "user", user)
+	}
+	if !acct.UpstreamTLS() && acct.UpstreamPath == "" {
+		s.logger.Warn("upstream connection is plaintext (remote_allow_plaintext)", "user", user)
+	}
+	if acct.Chaos.Enabled() {
+		s.logger.Warn("chaos mode is injecting faults into the session", "user", user)
 	}
 
 	if loginErr := LoginUpstream(conn, reader, acct); loginErr != nil {
+		release()
 		s.logger.Error("upstream login failed", "err", loginErr)
 		conn.Close()
-		fmt.Fprintf(s.clientConn, "%s NO LOGIN failed\r\n", cmd.Tag)
-		return
+		// A rejected LOGIN means the upstream itself is healthy.
+		var refused *refusedError
+		if errors.As(loginErr, &refused) {
+			s.shared.breakers.success(upstream)
+		} else {
+			s.upstreamFailed(upstream, breakerCfg)
+		}
+		var netErr net.Error
+		if errors.As(loginErr, &netErr) && netErr.Timeout() {
+			return &loginRefusal{code: "UNAVAILABLE", text: "upstream timed out"}
+		}
+		return &loginRefusal{text: "LOGIN failed"}
 	}
+	s.shared.breakers.success(upstream)
+	s.releaseSlot = release
 
+	s.mu.Lock()
 	s.upstreamConn = conn
+	s.connLogger = s.logger
+	s.logger = s.traced(s.shared.accountLogs.logger(acct, s.baseLogger)).With("user", user)
+	s.mu.Unlock()
+	s.trace.user.Store(&acct.LocalUser)
+	s.loggedInAs = append(s.loggedInAs, acct.LocalUser)
 	s.upstreamR = reader
 	s.account = acct
+	s.upstream = upstream
+	s.script = script
+	if acct.PinUpstreamIP {
+		s.pinnedIP = remoteIP(conn)
+	}
 	s.state = StateAuth
-	s.logger = s.logger.With("user", user)
+	if s.releaseUnauth != nil {
+		s.releaseUnauth()
+	}
 	s.logger.Info("login successful")
-	fmt.Fprintf(s.clientConn, "%s OK LOGIN completed\r\n", cmd.Tag)
+	if caps, ok := upstreamCaps.auth(upstream); ok {
+		s.logger.Debug("upstream capabilities", "caps", caps.String())
+	}
+	s.recordAudit(audit.Event{Type: audit.LoginSuccess, User: user})
+	return nil
+}
+
+// upstreamFailed records a dial or login failure against upstream's
+// circuit breaker.
+func (s *Session) upstreamFailed(upstream string, cfg config.CircuitBreakerConfig) {
+	if s.shared.breakers.failure(upstream, cfg) {
+		s.logger.Warn("upstream circuit breaker opened", "upstream", upstream)
+	}
+}
+
+// recordAudit fills in the client address, plus the country and client
+// software when known, and records ev.
+func (s *Session) recordAudit(ev audit.Event) {
+	ev.ClientIP = s.clientIP
+	extra := map[string]string{
+		"country":        s.country(),
+		"client_name":    s.clientID["name"],
+		"client_version": s.clientID["version"],
+	}
+	for k, v := range extra {
+		if v == "" {
+			continue
+		}
+		if ev.Fields == nil {
+			ev.Fields = make(map[string]string, len(extra))
+		}
+		ev.Fields[k] = v
+	}
+	s.shared.audit.Record(ev)
+}
+
+// country returns the client's country, looking it up on first use.
+func (s *Session) country() string {
+	if !s.countryResolved {
+		s.clientCountry = s.shared.lookupCountry(s.clientIP)
+		s.countryResolved = true
+	}
+	return s.clientCountry
+}
+
+// failLogin answers a failed local authentication after the configured
+// failure delay.
+func (s *Session) failLogin(tag string) {
+	s.delayFailure()
+	fmt.Fprintf(s.clientConn, "%s NO LOGIN failed\r\n", tag)
+}
+
+// delayFailure waits the configured auth_failure_delay.
+func (s *Session) delayFailure() {
+	if d := s.config.Server.AuthFailureDelay; d > 0 {
+		time.Sleep(d)
+	}
 }
 
-// runPostAuth runs the bidirectional proxy after authentication.
-func (s *Session) runPostAuth() {
+// handleID answers an RFC 2971 ID command with the proxy's own identity.
+func (s *Session) handleID(cmd imap.Command) {
+	s.recordClientID(cmd)
+	if s.config.Server.HideProductName {
+		fmt.Fprintf(s.clientConn, "* ID NIL\r\n%s OK ID completed\r\n", cmd.Tag)
+		return
+	}
+	fmt.Fprintf(s.clientConn, "* ID (\"name\" \"imap-proxy\" \"version\" %s)\r\n%s OK ID completed\r\n",
+		imap.Quote(buildinfo.Version), cmd.Tag)
+}
+
+// runPostAuth runs the bidirectional proxy after authentication. It
+// reports true if the client sent UNAUTHENTICATE and the session is back in
+// the not-authenticated state.
+func (s *Session) runPostAuth() bool {
 	var once sync.Once
+	var keepClient atomic.Bool // the client sent UNAUTHENTICATE and stays
+	stopped := make(chan struct{})
 	cleanup := func() {
 		once.Do(func() {
-			s.clientConn.Close()
+			close(stopped)
+			if !keepClient.Load() {
+				s.clientConn.Close()
+			}
+			// The upstream connection may be replaced during IDLE.
+			s.mu.Lock()
 			s.upstreamConn.Close()
+			s.mu.Unlock()
 		})
 	}
 	defer cleanup()
+	s.publish(busEvent{Type: eventSessionStart})
 
 	done := make(chan struct{})
+	out := &lockedWriter{w: s.clientWriter(stopped)}
+	s.out, s.stopped = out, stopped
+	if interval := s.config.Server.IdleCoalesceInterval; interval > 0 {
+		s.coalesce = &coalescer{interval: interval, mem: &s.memory, flush: func() {
+			out.Lock()
+			defer out.Unlock()
+			if err := s.flushCoalesced(out); err != nil {
+				s.logger.Debug("write to client failed", "err", err)
+			}
+		}}
+	}
+	s.deadline = &responseDeadline{conn: s.upstreamConn, timeout: responseTimeout(s.account),
+		literalTimeout: literalTimeout(s.account), lastSent: time.Now()}
+	literalR := &progressReader{r: s.upstreamR, onRead: s.deadline.literal}
+	scrubber := newHeaderScrubber(s.account)
 
 	// Upstream→Client goroutine: line-based reading with optional LIST/LSUB filtering.
+	s.shared.relays.started(relayUpstreamToClient)
 	go func() {
 		defer func() {
 			cleanup()
+			s.shared.relays.finished(relayUpstreamToClient)
 			close(done)
 		}()
+		continued := false // the line continues a response after a literal
+		dropping := false  // the continued response is not relayed
+		heldHeader := 0    // bytes of read-ahead header literal held
 		for {
-			line, err := s.upstreamR.ReadString('\n')
+			line, err := s.readLine(s.upstreamR)
 			if len(line) > 0 {
-				filtered := false
-				if s.account.HasFolderFilter() {
-					if mailbox, ok := imap.ParseListResponse([]byte(line)); ok {
-						if !s.account.FolderAllowed(mailbox) {
-							filtered = true
+				s.traceWire("upstream", line)
+				if continued {
+					s.deadline.progress()
+				} else {
+					s.deadline.received(line)
+					s.trackNewMail(line)
+					s.mailbox.update(line)
+				}
+				if caps, ok := parseCapabilities(line); ok {
+					upstreamCaps.storeAuth(s.upstream, caps)
+					if !continued {
+						line = withoutReferralCapabilities(line)
+						if !caps["UNAUTHENTICATE"] {
+							line = withUnauthenticate(line)
+						}
+					}
+				}
+				hidden := false // an alias entry or a dropped alert
+				if !continued {
+					line = s.stripReferral(line)
+					line = s.restrictRights(line)
+					var relayed bool
+					line, relayed = s.unaliasInbox(line)
+					hidden = !relayed
+					if !s.loggingOut.Load() && isAlert(line) {
+						line, relayed = s.handleUpstreamAlert(line)
+						hidden = hidden || !relayed
+					}
+				}
+				// A BYE the proxy did not ask for ends the session, unless
+				// an IDLE can carry on over a new connection.
+				if !continued && !s.loggingOut.Load() && isBye(line) {
+					byeErr := s.handleUpstreamBye(line)
+					if s.resumeIdle(out, stopped, byeErr) {
+						literalR.r = s.upstreamR
+						continue
+					}
+					out.Lock()
+					s.upstreamReadFailed(out, byeErr)
+					out.Unlock()
+					return
+				}
+				if ic := s.internal.Load(); ic != nil && !continued && err == nil {
+					if captured, completed := ic.route(line); captured {
+						if completed {
+							s.internal.CompareAndSwap(ic, nil)
+							ic.done <- line
 						}
+						continue
+					}
+				}
+				// Nothing is relayed once the proxy has sent LOGOUT, nor the
+				// rest of a response dropped before one of its literals.
+				filtered := s.loggingOut.Load() || continued && dropping || hidden
+				if !filtered && !continued && s.usesViews() {
+					// A hidden response keeps its line so that its literal
+					// is still recognized and skipped.
+					if visible, hidden := s.visibleResponse(line); hidden {
+						filtered = true
+					} else {
+						line = visible
+					}
+				}
+				if !filtered && !continued {
+					if kept, ok := s.scriptResponse(line); ok {
+						line = kept
+					} else {
+						// Its literal, if any, is still skipped.
+						filtered = true
 					}
 				}
+				if filtered {
+					// Concerns hidden messages and the proxy's LOGOUT only.
+				} else if relay := s.idle.Load(); relay != nil && relay.hide(line) {
+					filtered = true
+				} else if !continued && s.keepalive.intercept(line) {
+					filtered = true
+				} else if !continued && s.coalesce != nil && s.idling.Load() && isSizeUpdate(line) {
+					s.coalesce.add(line)
+					filtered = true
+				} else if mailbox, ok := imap.ParseListResponse([]byte(line)); ok {
+					if s.account.HasFolderFilter() && !s.folderVisible(mailbox, ruleUseList) {
+						filtered = true
+					} else {
+						s.usage.listed(mailbox)
+					}
+				}
+				// Lines held back for later count toward the memory limit.
+				if s.memory.over() {
+					out.Lock()
+					s.upstreamReadFailed(out, errMemoryLimit)
+					out.Unlock()
+					return
+				}
+				if n, _, ok := imap.ParseLiteral([]byte(line)); ok && literalTooLarge(s.account, n) {
+					var bye io.Writer = out
+					if continued && !dropping {
+						// The client is in the middle of the response.
+						bye = io.Discard
+					}
+					out.Lock()
+					s.upstreamReadFailed(bye, errLiteralTooLarge)
+					out.Unlock()
+					return
+				}
+
+				// Header literals are read ahead so that the line can
+				// announce their scrubbed size.
+				var header []byte
+				if !filtered && scrubber != nil && headerLiteral(line) {
+					n, _, _ := imap.ParseLiteral([]byte(line))
+					ok := s.memory.hold(int(n))
+					heldHeader = int(n)
+					if !ok {
+						out.Lock()
+						s.upstreamReadFailed(out, errMemoryLimit)
+						out.Unlock()
+						return
+					}
+					header = make([]byte, n)
+					s.deadline.literal()
+					if _, rErr := io.ReadFull(literalR, header); rErr != nil {
+						out.Lock()
+						s.upstreamReadFailed(out, rErr)
+						out.Unlock()
+						return
+					}
+					header = scrubber.scrub(header)
+					line = withLiteralSize(line, len(header))
+				}
 
+				// The client writer stays locked until any literal has been
+				// relayed, so a coalesced flush cannot split the response.
+				out.Lock()
 				if !filtered {
-					if _, wErr := io.WriteString(s.clientConn, line); wErr != nil {
+					if fErr := s.flushPending(out); fErr != nil {
+						out.Unlock()
+						s.logger.Debug("write to client failed", "err", fErr)
+						return
+					}
+					if !continued {
+						if aErr := s.writeReadOnlyAlert(out, line); aErr != nil {
+							out.Unlock()
+							s.logger.Debug("write to client failed", "err", aErr)
+							return
+						}
+					}
+					if _, wErr := io.WriteString(out, line); wErr != nil {
+						out.Unlock()
 						s.logger.Debug("write to client failed", "err", wErr)
 						return
 					}
+					s.countDownload(len(line))
+					s.usage.relayed(line, len(line))
 				}
 
 				// Handle server-side literals.
 				n, _, hasLiteral := imap.ParseLiteral([]byte(line))
-				if hasLiteral {
-					if filtered {
-						if _, dErr := io.CopyN(io.Discard, s.upstreamR, n); dErr != nil {
+				continued = hasLiteral
+				dropping = filtered && hasLiteral
+				if !hasLiteral {
+					s.deadline.responseDone()
+				} else {
+					s.deadline.literal()
+					if header != nil {
+						_, wErr := out.Write(header)
+						s.memory.free(heldHeader)
+						if wErr != nil {
+							out.Unlock()
+							s.logger.Debug("write to client failed", "err", wErr)
+							return
+						}
+						s.countDownload(len(header))
+						s.usage.relayed("", len(header))
+					} else if filtered {
+						if _, dErr := io.CopyN(io.Discard, literalR, n); dErr != nil {
+							s.upstreamReadFailed(out, dErr)
+							out.Unlock()
 							return
 						}
 					} else {
-						if _, cErr := io.CopyN(s.clientConn, s.upstreamR, n); cErr != nil {
-							s.logger.Debug("copy upstream literal failed", "err", cErr)
+						copied, cErr := io.CopyN(out, literalR, n)
+						s.countDownload(int(copied))
+						s.usage.relayed("", int(copied))
+						if cErr != nil {
+							// The client is in the middle of the literal.
+							s.upstreamReadFailed(io.Discard, cErr)
+							out.Unlock()
 							return
 						}
 					}
 				}
+				out.Unlock()
 			}
 			if err != nil {
-				if err != io.EOF {
-					s.logger.Debug("read from upstream failed", "err", err)
+				// A connection lost between responses during IDLE is
+				// replaced without the client noticing.
+				if len(line) == 0 && !continued && !errors.Is(err, errMemoryLimit) && s.resumeIdle(out, stopped, err) {
+					literalR.r = s.upstreamR
+					continue
+				}
+				var bye io.Writer = out
+				if continued && !dropping {
+					// The client is in the middle of a response.
+					bye = io.Discard
 				}
+				out.Lock()
+				s.upstreamReadFailed(bye, err)
+				out.Unlock()
 				return
 			}
 		}
 	}()
 
+	keepaliveDone := make(chan struct{})
+	go func() {
+		defer close(keepaliveDone)
+		interval, jitter := s.keepaliveSchedule()
+		s.runKeepalive(interval, jitter, stopped)
+	}()
+
 	// Client→Upstream goroutine (runs in current goroutine).
-	s.clientToUpstream()
+	s.shared.relays.started(relayClientToUpstream)
+	unauthTag := s.clientToUpstream()
+	s.shared.relays.finished(relayClientToUpstream)
+	keepClient.Store(unauthTag != "")
+	s.logCommandSummary()
+	s.logoutUpstream(done)
 	cleanup()
-	<-done
+	waitRelay(s.logger, done, relayLingerTimeout)
+	s.recordUsage()
+	s.recordSessionSummary()
+	s.publish(busEvent{Type: eventSessionEnd, DurationSeconds: time.Since(s.stats.start).Seconds()})
+	if unauthTag == "" {
+		return false
+	}
+	<-keepaliveDone
+	s.unauthenticate()
+	_, err := fmt.Fprintf(s.clientConn, "%s OK UNAUTHENTICATE completed\r\n", unauthTag)
+	return err == nil
 }
 
-// clientToUpstream reads commands from the client, filters them, and forwards to upstream.
-func (s *Session) clientToUpstream() {
+// clientToUpstream reads commands from the client, filters them, and forwards
+// to upstream. It returns the tag of an UNAUTHENTICATE command, or "" when the
+// session is over.
+func (s *Session) clientToUpstream() (unauthTag string) {
 	for {
-		line, err := s.clientR.ReadString('\n')
+		line, err := s.readLine(s.clientR)
 		if err != nil {
 			if err != io.EOF {
 				s.logger.Debug("read from client failed", "err", err)
 			}
-			return
+			s.endOnMemoryLimit(s.out, err)
+			return ""
 		}
+		s.traceWire("client", line)
 
 		cmd, parseErr := imap.ParseCommand([]byte(line))
 		if parseErr != nil {
-			// Forward unparseable lines as-is (could be continuation data).
-			if _, wErr := fmt.Fprint(s.upstreamConn, line); wErr != nil {
-				return
+			// Literal data and IDLE's DONE are read where they are
+			// expected, so this is junk from a confused client.
+			if err := s.rejectUnparseable(line, parseErr); err != nil {
+				return ""
 			}
 			continue
 		}
+		if rejected, err := s.rejectInvalid(cmd, line); err != nil {
+			return ""
+		} else if rejected {
+			continue
+		}
+		if rejected, err := s.rejectReservedTag(cmd, line); err != nil {
+			return ""
+		} else if rejected {
+			continue
+		}
+		s.stats.command(commandVerb(cmd))
+
+		if cmd.Verb == "APPEND" {
+			inlined, reply, err := s.inlineAppendMailbox(cmd, line)
+			if err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
+			}
+			if reply != "" {
+				fmt.Fprint(s.clientConn, reply)
+				continue
+			}
+			if inlined != line {
+				line = inlined
+				cmd, _ = imap.ParseCommand([]byte(line))
+			}
+		}
 
 		// Handle IDLE specially.
 		if cmd.Verb == "IDLE" {
-			if err := s.handleIdle(line); err != nil {
+			if !s.upstreamSupports("IDLE") {
+				fmt.Fprintf(s.clientConn, "%s NO IDLE not supported by upstream server\r\n", cmd.Tag)
+				continue
+			}
+			// New messages are only classified between commands.
+			if s.view.Load() != nil {
+				fmt.Fprintf(s.clientConn, "%s NO IDLE not available for folders with hidden messages\r\n", cmd.Tag)
+				continue
+			}
+			if err := s.handleIdle(cmd, line); err != nil {
 				s.logger.Debug("IDLE handling error", "err", err)
-				return
+				s.endOnMemoryLimit(s.out, err)
+				return ""
 			}
 			continue
 		}
 
-		// Handle LOGOUT in post-auth: respond locally and let cleanup close upstream.
+		// Handle LOGOUT in post-auth: respond locally and let runPostAuth
+		// log out of the upstream.
 		if cmd.Verb == "LOGOUT" {
-			fmt.Fprintf(s.clientConn, "* BYE imap-proxy logging out\r\n")
+			fmt.Fprint(s.clientConn, s.byeLogout())
 			fmt.Fprintf(s.clientConn, "%s OK LOGOUT completed\r\n", cmd.Tag)
-			return
+			return ""
+		}
+
+		// UNAUTHENTICATE is answered once runPostAuth has left the upstream.
+		if cmd.Verb == "UNAUTHENTICATE" {
+			return cmd.Tag
+		}
+
+		if cmd.Verb == "CLIENTID" {
+			s.handleClientID(cmd)
+			continue
+		}
+
+		if cmd.Verb == "X-PROXY" {
+			s.handleXProxy(cmd)
+			continue
+		}
+
+		// Handle ID locally so the proxy identifies itself rather than the upstream.
+		if cmd.Verb == "ID" {
+			s.handleID(cmd)
+			if !s.clientAllowed(s.account) {
+				fmt.Fprint(s.clientConn, "* BYE client software not permitted for this account\r\n")
+				return ""
+			}
+			continue
+		}
+
+		if s.quotaExceeded(cmd) {
+			s.logger.Warn("FETCH refused: daily download quota exceeded")
+			quotaRejectionsTotal.Inc()
+			fmt.Fprintf(s.clientConn, "%s NO [LIMIT] quota exceeded\r\n", cmd.Tag)
+			continue
+		}
+
+		if reason, text := s.searchRefusal(cmd, line); reason != "" {
+			s.logger.Warn("search refused", "verb", commandVerb(cmd), "reason", reason)
+			searchesRefusedTotal.Inc(reason)
+			fmt.Fprintf(s.clientConn, "%s NO [LIMIT] %s\r\n", cmd.Tag, text)
+			if err := s.discardLiterals(line); err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
+			}
+			continue
 		}
 
 		result := imap.Filter(cmd)
@@ -271,31 +896,84 @@ func (s *Session) clientToUpstream() {
 		switch result.Action {
 		case imap.Allow:
 			if s.folderBlocked(cmd) {
+				s.stats.blocked++
 				fmt.Fprintf(s.clientConn, "%s NO folder not available\r\n", cmd.Tag)
 				continue
 			}
-			if err := s.forwardWithLiterals([]byte(line)); err != nil {
-				return
+			if cmd.Verb == "APPEND" {
+				if code, text := s.appendRefusal(line); code != "" {
+					fmt.Fprintf(s.clientConn, "%s NO [%s] %s\r\n", cmd.Tag, code, text)
+					if err := s.discardLiterals(line); err != nil {
+						s.endOnMemoryLimit(s.out, err)
+						return ""
+					}
+					continue
+				}
+			}
+			var handled bool
+			var err error
+			if cmd, line, handled, err = s.checkScript(cmd, line); err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
+			} else if handled {
+				continue
+			}
+			if cmd, line, handled, err = s.checkPolicy(cmd, line); err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
+			} else if handled {
+				continue
+			}
+			s.logForwarded(commandVerb(cmd))
+			s.noteMailboxOpen(cmd)
+			if err := s.forward(cmd, []byte(line)); err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
 			}
 			s.trackSelectedFolder(cmd)
 
 		case imap.Block:
+			s.stats.blocked++
 			s.logger.Warn("blocked command", "verb", cmd.Verb)
+			s.noteBlocked(cmd)
+			s.recordAudit(audit.Event{
+				Type: audit.CommandBlocked, User: s.account.LocalUser,
+				Fields: map[string]string{"verb": commandVerb(cmd)},
+			})
 			fmt.Fprint(s.clientConn, result.RejectMsg)
-			// If there's a non-synchronizing literal, consume and discard it.
-			n, nonSync, ok := imap.ParseLiteral([]byte(line))
-			if ok && nonSync {
-				io.CopyN(io.Discard, s.clientR, n)
+			// Non-synchronizing literals, such as SETMETADATA values, are
+			// consumed so the next line read is the client's next command.
+			if err := s.discardLiterals(line); err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
 			}
 
 		case imap.Rewrite:
 			if s.folderBlocked(cmd) {
+				s.stats.blocked++
 				fmt.Fprintf(s.clientConn, "%s NO folder not available\r\n", cmd.Tag)
 				continue
 			}
-			s.logger.Debug("rewritten command", "verb", cmd.Verb)
-			if err := s.forwardWithLiterals(result.Rewritten); err != nil {
-				return
+			cmd, rewritten, handled, err := s.checkScript(cmd, string(result.Rewritten))
+			if err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
+			} else if handled {
+				continue
+			}
+			cmd, rewritten, handled, err = s.checkPolicy(cmd, rewritten)
+			if err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
+			} else if handled {
+				continue
+			}
+			s.logForwarded(commandVerb(cmd), "rewritten", true)
+			s.noteReadOnlySelect(cmd)
+			s.noteMailboxOpen(cmd)
+			if err := s.forward(cmd, []byte(rewritten)); err != nil {
+				s.endOnMemoryLimit(s.out, err)
+				return ""
 			}
 			s.trackSelectedFolder(cmd)
 		}
@@ -303,9 +981,21 @@ func (s *Session) clientToUpstream() {
 }
 
 // handleIdle handles the IDLE command exchange.
-func (s *Session) handleIdle(line string) error {
-	// Forward IDLE to upstream.
-	if _, err := fmt.Fprint(s.upstreamConn, line); err != nil {
+func (s *Session) handleIdle(cmd imap.Command, line string) error {
+	s.idling.Store(true)
+	defer s.idling.Store(false)
+
+	// Forward IDLE to upstream. Its "+" continuation suspends the response
+	// deadline until DONE is sent. The relay re-issues IDLE periodically and
+	// stays registered afterwards, so that late answers to a refresh are
+	// still hidden from the client.
+	relay := &idleRelay{s: s, tag: cmd.Tag, interval: idleRefreshInterval}
+	s.idle.Store(relay)
+	defer relay.stop()
+	s.writeMu.Lock()
+	err := relay.start(line)
+	s.writeMu.Unlock()
+	if err != nil {
 		return err
 	}
 
@@ -313,20 +1003,34 @@ func (s *Session) handleIdle(line string) error {
 	// and any untagged responses (e.g. * N EXISTS) to the client.
 	// We only need to wait for DONE from client and forward it.
 	for {
-		clientLine, err := s.clientR.ReadString('\n')
+		clientLine, err := s.readLine(s.clientR)
 		if err != nil {
 			return err
 		}
-		// Forward to upstream.
-		if _, wErr := fmt.Fprint(s.upstreamConn, clientLine); wErr != nil {
-			return wErr
+		done, err := relay.forward(clientLine)
+		if err != nil || done {
+			return err
 		}
-		// Check if this is DONE (case-insensitive).
-		trimmed := strings.TrimRight(clientLine, "\r\n")
-		if strings.EqualFold(trimmed, "DONE") {
-			return nil
+	}
+}
+
+// forward sends a filtered command upstream.
+func (s *Session) forward(cmd imap.Command, line []byte) error {
+	line = s.aliasInbox(cmd, line)
+	if cmd.Verb == "APPEND" {
+		if mailbox := extractAppendMailbox(cmd); s.autoCreates(mailbox) {
+			return s.appendCreating(cmd, line, mailbox)
+		}
+	}
+	if len(s.account.VirtualFolders) > 0 {
+		if handled, err := s.forwardVirtual(cmd, line); handled {
+			return err
 		}
 	}
+	if s.usesViews() {
+		return s.forwardVisible(cmd, line)
+	}
+	return s.forwardLimited(cmd, line)
 }
 
 // forwardWithLiterals forwards a line to upstream and handles any literal data.
@@ -334,6 +1038,9 @@ func (s *Session) handleIdle(line string) error {
 // continuation to the client. For non-synchronizing literals, the client sends
 // data immediately. In both cases, we copy N bytes from client to upstream.
 func (s *Session) forwardWithLiterals(line []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.deadline.expect()
 	for {
 		n, _, hasLiteral := imap.ParseLiteral(line)
 
@@ -349,9 +1056,10 @@ func (s *Session) forwardWithLiterals(line []byte) error {
 		if _, err := io.CopyN(s.upstreamConn, s.clientR, n); err != nil {
 			return err
 		}
+		s.deadline.resume()
 
 		// Read next line (may be another literal continuation).
-		nextLine, err := s.clientR.ReadString('\n')
+		nextLine, err := s.readLine(s.clientR)
 		if err != nil {
 			return err
 		}
@@ -365,14 +1073,20 @@ func (s *Session) trackSelectedFolder(cmd imap.Command) {
 	switch cmd.Verb {
 	case "SELECT", "EXAMINE":
 		s.selectedFolder = extractCommandMailbox(cmd)
+		s.usage.selected(s.selectedFolder)
+		s.recordAudit(audit.Event{
+			Type: audit.FolderAccess, User: s.account.LocalUser,
+			Fields: map[string]string{"verb": cmd.Verb, "folder": s.selectedFolder},
+		})
 	}
 }
 
 // applyWritableOverride checks if a Block or Rewrite result should be
 // overridden because the target folder is writable. Only STORE, UID STORE,
-// APPEND, and SELECT are eligible for override.
+// APPEND, and SELECT are eligible for override; append-only folders only
+// allow APPEND.
 func (s *Session) applyWritableOverride(cmd imap.Command, result imap.FilterResult) imap.FilterResult {
-	if s.account == nil || len(s.account.WritableFolders) == 0 {
+	if s.account == nil || (len(s.account.WritableFolders) == 0 && len(s.account.AppendFolders) == 0) {
 		return result
 	}
 
@@ -380,23 +1094,23 @@ func (s *Session) applyWritableOverride(cmd imap.Command, result imap.FilterResu
 	case imap.Block:
 		switch {
 		case cmd.Verb == "STORE":
-			if s.account.FolderWritable(s.selectedFolder) {
+			if s.folderWritable(s.selectedFolder) {
 				return imap.FilterResult{Action: imap.Allow}
 			}
 		case cmd.Verb == "UID" && cmd.SubVerb == "STORE":
-			if s.account.FolderWritable(s.selectedFolder) {
+			if s.folderWritable(s.selectedFolder) {
 				return imap.FilterResult{Action: imap.Allow}
 			}
 		case cmd.Verb == "APPEND":
 			mailbox := extractAppendMailbox(cmd)
-			if mailbox != "" && s.account.FolderWritable(mailbox) {
+			if mailbox != "" && s.folderAppendable(mailbox) {
 				return imap.FilterResult{Action: imap.Allow}
 			}
 		}
 	case imap.Rewrite:
 		if cmd.Verb == "SELECT" {
 			mailbox := extractCommandMailbox(cmd)
-			if mailbox != "" && s.account.FolderWritable(mailbox) {
+			if mailbox != "" && s.folderWritable(mailbox) {
 				return imap.FilterResult{Action: imap.Allow}
 			}
 		}
@@ -412,18 +1126,24 @@ func (s *Session) folderBlocked(cmd imap.Command) bool {
 		return false
 	}
 	switch cmd.Verb {
-	case "SELECT", "EXAMINE", "STATUS":
+	case "SELECT", "EXAMINE", "STATUS", "GETACL", "MYRIGHTS", "LISTRIGHTS":
 		mailbox := extractCommandMailbox(cmd)
 		if mailbox == "" {
 			return false
 		}
-		return !s.account.FolderAllowed(mailbox)
+		return !s.folderVisible(mailbox, ruleUseSelect)
 	case "APPEND":
 		mailbox := extractAppendMailbox(cmd)
 		if mailbox == "" {
 			return false
 		}
-		return !s.account.FolderAllowed(mailbox)
+		return !s.folderVisible(mailbox, ruleUseSelect)
+	case "GETMETADATA":
+		mailbox := extractMetadataMailbox(cmd)
+		if mailbox == "" {
+			return false
+		}
+		return !s.folderVisible(mailbox, ruleUseSelect)
 	default:
 		return false
 	}
@@ -450,6 +1170,57 @@ func extractCommandMailbox(cmd imap.Command) string {
 	return mailbox
 }
 
+// maxLoginLiteral bounds a user name or password sent as a literal.
+const maxLoginLiteral = 1024
+
+// readLoginArgs parses the arguments to a LOGIN command, reading those
+// sent as literals from the client. A literal over maxLoginLiteral is
+// refused: a synchronizing one is never continued and the data of a
+// non-synchronizing one is discarded, so the client stays in step.
+func (s *Session) readLoginArgs(args string) (user, pass string, err error) {
+	if _, _, ok := imap.ParseLiteral([]byte(args)); !ok {
+		return parseLoginArgs(args)
+	}
+	var values []string
+	for {
+		args = strings.TrimLeft(args, " ")
+		if args == "" {
+			break
+		}
+		n, nonSync, ok := imap.ParseLiteral([]byte(args))
+		if !ok || args[0] != '{' || strings.Contains(args, " ") {
+			var v string
+			if v, args, err = parseOneArg(args); err != nil {
+				return "", "", err
+			}
+			values = append(values, v)
+			continue
+		}
+		if n > maxLoginLiteral {
+			if nonSync {
+				s.discardLiterals(args)
+			}
+			return "", "", fmt.Errorf("literal of %d bytes exceeds %d", n, maxLoginLiteral)
+		}
+		if !nonSync {
+			fmt.Fprint(s.clientConn, "+ Ready for literal data\r\n")
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(s.clientR, buf); err != nil {
+			return "", "", err
+		}
+		values = append(values, string(buf))
+		if args, err = s.readLine(s.clientR); err != nil {
+			return "", "", err
+		}
+		args = strings.TrimRight(args, "\r\n")
+	}
+	if len(values) != 2 {
+		return "", "", fmt.Errorf("LOGIN expects 2 arguments, got %d", len(values))
+	}
+	return values[0], values[1], nil
+}
+
 // parseLoginArgs parses the arguments to a LOGIN command.
 // Handles: user pass, "user" "pass", "user with spaces" pass, etc.
 func parseLoginArgs(args string) (user, pass string, err error) {
@@ -484,8 +1255,8 @@ func parseOneArg(s string) (token, rest string, err error) {
 		var b strings.Builder
 		i := 1
 		for i < len(s) {
-			if s[i] == '\\' && i+1 < len(s) && s[i+1] == '"' {
-				b.WriteByte('"')
+			if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				b.WriteByte(s[i+1])
 				i += 2
 				continue
 			}
@@ -506,6 +1277,15 @@ func parseOneArg(s string) (token, rest string, err error) {
 	return s[:idx], s[idx+1:], nil
 }
 
+// commandVerb returns the command name, including the UID prefix for UID
+// commands (e.g. "UID STORE").
+func commandVerb(cmd imap.Command) string {
+	if cmd.Verb == "UID" && cmd.SubVerb != "" {
+		return "UID " + cmd.SubVerb
+	}
+	return cmd.Verb
+}
+
 // extractTag tries to get a tag from a raw line for error responses.
 func extractTag(line string) string {
 	line = strings.TrimSpace(line)
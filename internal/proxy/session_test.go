@@ -6,11 +6,15 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/buildinfo"
 	"imap-proxy/internal/config"
+	"imap-proxy/internal/imaptest"
 )
 
 func testConfig() *config.Config {
@@ -130,62 +134,19 @@ func TestSessionLogout(t *testing.T) {
 	}
 }
 
-// fakeUpstream creates a fake upstream IMAP server on one end of a net.Pipe.
-// It returns the client-side conn+reader and runs the server in a goroutine.
-// The server sends a greeting, accepts LOGIN, responds OK.
-func fakeUpstream(t *testing.T) (net.Conn, *bufio.Reader) {
-	t.Helper()
-	upClient, upServer := net.Pipe()
-
-	go func() {
-		defer upServer.Close()
-		sr := bufio.NewReader(upServer)
-		// Send greeting.
-		fmt.Fprint(upServer, "* OK Fake IMAP ready\r\n")
-		// Read LOGIN.
-		line, err := sr.ReadString('\n')
-		if err != nil {
-			return
-		}
-		if strings.Contains(strings.ToUpper(line), "LOGIN") {
-			fmt.Fprint(upServer, "proxy0 OK LOGIN completed\r\n")
-		} else {
-			fmt.Fprint(upServer, "proxy0 NO unexpected command\r\n")
-		}
-		// After login, echo everything back with "OK" for simplicity.
-		for {
-			line, err := sr.ReadString('\n')
-			if err != nil {
-				return
-			}
-			// Extract tag from the forwarded command.
-			parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
-			tag := parts[0]
-			fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
-		}
-	}()
-
-	return upClient, bufio.NewReader(upClient)
-}
-
-// loginSession creates a session with a fake upstream injected, sends LOGIN, and returns
-// the client conn and reader positioned after the LOGIN OK response.
-func loginSession(t *testing.T) (net.Conn, *bufio.Reader, *Session) {
+// loginSession creates a session with an imaptest upstream injected, sends
+// LOGIN, and returns the client conn and reader positioned after the LOGIN
+// OK response.
+func loginSession(t *testing.T) (net.Conn, *bufio.Reader, *Session, *imaptest.Server) {
 	t.Helper()
+	up := imaptest.NewServer()
+	t.Cleanup(up.Close)
 	clientConn, proxyConn := net.Pipe()
 
 	cfg := testConfig()
+	cfg.Accounts[0].RemoteUser, cfg.Accounts[0].RemotePassword = imaptest.User, imaptest.Password
 	sess := NewSession(proxyConn, cfg, testLogger())
-
-	// Inject fake upstream dialer.
-	sess.dialUpstream = func(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error) {
-		conn, reader := fakeUpstream(t)
-		// Consume the greeting, like real DialUpstream does.
-		if _, err := reader.ReadString('\n'); err != nil {
-			return nil, nil, err
-		}
-		return conn, reader, nil
-	}
+	sess.dialUpstream = up.Dial
 
 	go sess.Run()
 
@@ -212,11 +173,25 @@ func loginSession(t *testing.T) (net.Conn, *bufio.Reader, *Session) {
 		t.Fatalf("expected LOGIN OK, got: %q", line)
 	}
 
-	return clientConn, r, sess
+	return clientConn, r, sess, up
+}
+
+// readTagged reads up to the response tagged tag and returns it.
+func readTagged(t *testing.T, r *bufio.Reader, tag string) string {
+	t.Helper()
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", tag, err)
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return line
+		}
+	}
 }
 
 func TestSessionLoginSuccess(t *testing.T) {
-	clientConn, _, _ := loginSession(t)
+	clientConn, _, _, _ := loginSession(t)
 	clientConn.Close()
 }
 
@@ -264,7 +239,7 @@ func TestSessionLoginUnknownUser(t *testing.T) {
 }
 
 func TestSessionPostAuthLogout(t *testing.T) {
-	clientConn, r, _ := loginSession(t)
+	clientConn, r, _, _ := loginSession(t)
 	defer clientConn.Close()
 
 	fmt.Fprint(clientConn, "A002 LOGOUT\r\n")
@@ -286,7 +261,7 @@ func TestSessionPostAuthLogout(t *testing.T) {
 }
 
 func TestSessionBlockedCommand(t *testing.T) {
-	clientConn, r, _ := loginSession(t)
+	clientConn, r, _, _ := loginSession(t)
 	defer clientConn.Close()
 
 	// Send STORE (blocked command).
@@ -302,139 +277,42 @@ func TestSessionBlockedCommand(t *testing.T) {
 }
 
 func TestSessionSelectRewrite(t *testing.T) {
-	// We need a custom fake upstream that captures what it receives.
-	clientConn, proxyConn := net.Pipe()
+	clientConn, r, _, up := loginSession(t)
 	defer clientConn.Close()
 
-	upClient, upServer := net.Pipe()
-	received := make(chan string, 10)
-
-	go func() {
-		defer upServer.Close()
-		sr := bufio.NewReader(upServer)
-		// Send greeting.
-		fmt.Fprint(upServer, "* OK Fake IMAP ready\r\n")
-		// Read LOGIN.
-		line, _ := sr.ReadString('\n')
-		if strings.Contains(strings.ToUpper(line), "LOGIN") {
-			fmt.Fprint(upServer, "proxy0 OK LOGIN completed\r\n")
-		}
-		// Read and record commands.
-		for {
-			line, err := sr.ReadString('\n')
-			if err != nil {
-				return
-			}
-			received <- line
-			parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
-			tag := parts[0]
-			fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
-		}
-	}()
-
-	cfg := testConfig()
-	sess := NewSession(proxyConn, cfg, testLogger())
-	sess.dialUpstream = func(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error) {
-		r := bufio.NewReader(upClient)
-		// Consume the greeting, like real DialUpstream does.
-		r.ReadString('\n')
-		return upClient, r, nil
-	}
-
-	go sess.Run()
-
-	r := bufio.NewReader(clientConn)
-	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-
-	readLine(r) // greeting
-	fmt.Fprint(clientConn, "A001 LOGIN reader1 localpass1\r\n")
-	readLine(r) // LOGIN OK
-
-	// Send SELECT INBOX.
 	fmt.Fprint(clientConn, "A002 SELECT INBOX\r\n")
-
-	// Read what upstream received.
-	select {
-	case got := <-received:
-		if !strings.Contains(got, "EXAMINE") {
-			t.Fatalf("expected EXAMINE upstream, got: %q", got)
-		}
-		if strings.Contains(got, "SELECT") {
-			t.Fatalf("SELECT should have been rewritten, got: %q", got)
-		}
-	case <-time.After(2 * time.Second):
-		t.Fatal("timeout waiting for upstream command")
+	if line := readTagged(t, r, "A002"); !strings.Contains(line, "OK") {
+		t.Fatalf("expected OK from upstream, got: %q", line)
 	}
 
-	// Read OK response forwarded from upstream to client.
-	line, _ := readLine(r)
-	if !strings.Contains(line, "OK") {
-		t.Fatalf("expected OK from upstream, got: %q", line)
+	got := up.Received()
+	if !slices.ContainsFunc(got, func(cmd string) bool { return strings.HasPrefix(cmd, "EXAMINE") }) {
+		t.Fatalf("expected EXAMINE upstream, got: %q", got)
+	}
+	if slices.ContainsFunc(got, func(cmd string) bool { return strings.HasPrefix(cmd, "SELECT") }) {
+		t.Fatalf("SELECT should have been rewritten, got: %q", got)
 	}
 }
 
 func TestSessionAllowedCommand(t *testing.T) {
-	// Custom upstream that captures commands.
-	clientConn, proxyConn := net.Pipe()
+	clientConn, r, _, up := loginSession(t)
 	defer clientConn.Close()
 
-	upClient, upServer := net.Pipe()
-	received := make(chan string, 10)
-
-	go func() {
-		defer upServer.Close()
-		sr := bufio.NewReader(upServer)
-		fmt.Fprint(upServer, "* OK Fake IMAP ready\r\n")
-		line, _ := sr.ReadString('\n')
-		if strings.Contains(strings.ToUpper(line), "LOGIN") {
-			fmt.Fprint(upServer, "proxy0 OK LOGIN completed\r\n")
-		}
-		for {
-			line, err := sr.ReadString('\n')
-			if err != nil {
-				return
-			}
-			received <- line
-			parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2)
-			tag := parts[0]
-			fmt.Fprintf(upServer, "%s OK completed\r\n", tag)
-		}
-	}()
-
-	cfg := testConfig()
-	sess := NewSession(proxyConn, cfg, testLogger())
-	sess.dialUpstream = func(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error) {
-		r := bufio.NewReader(upClient)
-		// Consume the greeting, like real DialUpstream does.
-		r.ReadString('\n')
-		return upClient, r, nil
-	}
-
-	go sess.Run()
-
-	r := bufio.NewReader(clientConn)
-	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-
-	readLine(r) // greeting
-	fmt.Fprint(clientConn, "A001 LOGIN reader1 localpass1\r\n")
-	readLine(r) // LOGIN OK
+	fmt.Fprint(clientConn, "A002 SELECT INBOX\r\n")
+	readTagged(t, r, "A002")
 
 	// Send FETCH (allowed).
-	fmt.Fprint(clientConn, "A002 FETCH 1 (FLAGS)\r\n")
-
-	select {
-	case got := <-received:
-		if !strings.Contains(got, "FETCH") {
-			t.Fatalf("expected FETCH upstream, got: %q", got)
-		}
-	case <-time.After(2 * time.Second):
-		t.Fatal("timeout waiting for upstream command")
-	}
-
+	fmt.Fprint(clientConn, "A003 FETCH 1 (FLAGS)\r\n")
 	line, _ := readLine(r)
-	if !strings.Contains(line, "OK") {
+	if line != "* 1 FETCH (FLAGS (\\Seen))\r\n" {
+		t.Fatalf("expected the upstream FETCH response, got: %q", line)
+	}
+	if line := readTagged(t, r, "A003"); !strings.Contains(line, "OK") {
 		t.Fatalf("expected OK, got: %q", line)
 	}
+	if got := up.Received(); !slices.Contains(got, "FETCH 1 (FLAGS)") {
+		t.Fatalf("expected FETCH upstream, got: %q", got)
+	}
 }
 
 func TestParseLoginArgs(t *testing.T) {
@@ -513,3 +391,169 @@ func TestParseLoginArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestSessionGreetingVersion(t *testing.T) {
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+
+	cfg := testConfig()
+	cfg.Server.GreetingVersion = true
+	sess := NewSession(proxyConn, cfg, testLogger())
+	go sess.Run()
+
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := readLine(bufio.NewReader(clientConn))
+	if err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	want := "* OK imap-proxy ready (" + buildinfo.Version + ")\r\n"
+	if line != want {
+		t.Fatalf("greeting = %q, want %q", line, want)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+
+	sess := NewSession(proxyConn, testConfig(), testLogger())
+	go sess.Run()
+
+	r := bufio.NewReader(clientConn)
+	clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	readLine(r) // greeting
+
+	fmt.Fprint(clientConn, `A001 ID ("name" "client")`+"\r\n")
+	line1, _ := readLine(r)
+	if !strings.HasPrefix(line1, `* ID ("name" "imap-proxy" "version" "`+buildinfo.Version+`")`) {
+		t.Fatalf("unexpected ID response: %q", line1)
+	}
+	line2, _ := readLine(r)
+	if line2 != "A001 OK ID completed\r\n" {
+		t.Fatalf("unexpected OK: %q", line2)
+	}
+}
+
+func TestSessionPostAuthIDHandledLocally(t *testing.T) {
+	clientConn, r, _, _ := loginSession(t)
+	defer clientConn.Close()
+
+	fmt.Fprint(clientConn, "A002 ID NIL\r\n")
+	line1, _ := readLine(r)
+	if !strings.HasPrefix(line1, `* ID ("name" "imap-proxy"`) {
+		t.Fatalf("unexpected ID response: %q", line1)
+	}
+	line2, _ := readLine(r)
+	if line2 != "A002 OK ID completed\r\n" {
+		t.Fatalf("unexpected OK: %q", line2)
+	}
+}
+
+func TestSessionLoginFailureUniform(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.AuthFailureDelay = 50 * time.Millisecond
+
+	attempt := func(login string) (string, time.Duration) {
+		clientConn, proxyConn := net.Pipe()
+		defer clientConn.Close()
+		go NewSession(proxyConn, cfg, testLogger()).Run()
+
+		r := bufio.NewReader(clientConn)
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		readLine(r) // greeting
+
+		start := time.Now()
+		fmt.Fprint(clientConn, "A001 LOGIN "+login+"\r\n")
+		line, _ := readLine(r)
+		return line, time.Since(start)
+	}
+
+	unknownResp, unknownDur := attempt("nobody localpass1")
+	wrongResp, wrongDur := attempt("reader1 wrongpass")
+
+	if unknownResp != wrongResp {
+		t.Errorf("responses differ: unknown user %q, wrong password %q", unknownResp, wrongResp)
+	}
+	if unknownDur < cfg.Server.AuthFailureDelay || wrongDur < cfg.Server.AuthFailureDelay {
+		t.Errorf("failure delay not applied: unknown %v, wrong %v", unknownDur, wrongDur)
+	}
+}
+
+func TestSessionAuditsFolderAccessAndBlockedCommands(t *testing.T) {
+	events := make(chan audit.Event, 10)
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+		s.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) { events <- ev }))
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+	<-events // login_success
+
+	env.send(t, "A2 SELECT INBOX\r\n")
+	env.drainUpstream(t)
+	env.readUntilTagged(t, "A2")
+	env.send(t, "A3 UID EXPUNGE 1\r\n")
+	env.readUntilTagged(t, "A3")
+
+	want := []audit.Event{
+		{Type: audit.FolderAccess, User: "reader1", Fields: map[string]string{"verb": "SELECT", "folder": "INBOX"}},
+		{Type: audit.CommandBlocked, User: "reader1", Fields: map[string]string{"verb": "UID EXPUNGE"}},
+	}
+	for _, w := range want {
+		select {
+		case ev := <-events:
+			if ev.Type != w.Type || ev.User != w.User || fmt.Sprint(ev.Fields) != fmt.Sprint(w.Fields) {
+				t.Errorf("event = %+v, want %+v", ev, w)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %s event", w.Type)
+		}
+	}
+}
+
+func TestSessionLoginLiterals(t *testing.T) {
+	tests := []struct {
+		name string
+		send []string // written in order by the client
+		want []string
+	}{
+		{
+			name: "synchronizing",
+			send: []string{"A001 LOGIN {7}\r\n", "reader1 {10}\r\n", "localpass1\r\n"},
+			want: []string{"+ ", "+ ", "A001 OK LOGIN"},
+		},
+		{
+			name: "non-synchronizing",
+			send: []string{"A001 LOGIN {7+}\r\nreader1 \"localpass1\"\r\n"},
+			want: []string{"A001 OK LOGIN"},
+		},
+		{
+			name: "oversized synchronizing",
+			send: []string{"A001 LOGIN {5000}\r\n", "A002 NOOP\r\n"},
+			want: []string{"A001 NO LOGIN failed", "A002 OK"},
+		},
+		{
+			name: "oversized non-synchronizing",
+			send: []string{"A001 LOGIN {2000+}\r\n" + strings.Repeat("x", 2000) + " pass\r\nA002 NOOP\r\n"},
+			want: []string{"A001 NO LOGIN failed", "A002 OK"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newIntegrationEnv(t)
+			defer env.clientConn.Close()
+			env.readLine(t) // greeting
+			go func() {
+				for _, s := range tt.send {
+					if _, err := fmt.Fprint(env.clientConn, s); err != nil {
+						return
+					}
+				}
+			}()
+			for _, want := range tt.want {
+				if got := env.readLine(t); !strings.HasPrefix(got, want) {
+					t.Fatalf("got %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
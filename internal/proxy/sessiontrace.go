@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"imap-proxy/internal/transcript"
+)
+
+// sessionTrace is the part of a session that the admin API can see and
+// change while the session runs.
+type sessionTrace struct {
+	id      string
+	client  string
+	started time.Time
+	user    atomic.Pointer[string]     // local user logged in as; nil before LOGIN
+	level   atomic.Pointer[slog.Level] // nil: the level of the session's log
+	wire    atomic.Bool                // log the IMAP lines exchanged
+}
+
+// newSessionID returns a random identifier for a session.
+func newSessionID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// sessionRegistry holds the sessions of a Server that are running.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionTrace // by ID
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*sessionTrace)}
+}
+
+// add registers t until the returned function is called.
+func (r *sessionRegistry) add(t *sessionTrace) (remove func()) {
+	r.mu.Lock()
+	r.sessions[t.id] = t
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		delete(r.sessions, t.id)
+		r.mu.Unlock()
+	}
+}
+
+// get returns the running session with the given ID, or nil.
+func (r *sessionRegistry) get(id string) *sessionTrace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// list returns the running sessions, oldest first.
+func (r *sessionRegistry) list() []*sessionTrace {
+	r.mu.Lock()
+	all := make([]*sessionTrace, 0, len(r.sessions))
+	for _, t := range r.sessions {
+		all = append(all, t)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(all, func(a, b *sessionTrace) int {
+		if c := a.started.Compare(b.started); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+	return all
+}
+
+// traced returns logger with the session's level override applied and
+// its ID added to every record.
+func (s *Session) traced(logger *slog.Logger) *slog.Logger {
+	return slog.New(&levelHandler{level: &s.trace.level, h: logger.Handler()}).With("session", s.trace.id)
+}
+
+// traceWire logs line, read from side ("client" or "upstream"), when the
+// wire trace of the session is on. The record goes to the session's log at
+// debug level whatever the level of that log, and credentials in client
+// commands are redacted.
+func (s *Session) traceWire(side, line string) {
+	if !s.trace.wire.Load() {
+		return
+	}
+	if side == "client" {
+		line = redactCredentials(line)
+	}
+	r := slog.NewRecord(time.Now(), slog.LevelDebug, "wire", 0)
+	r.AddAttrs(slog.String("side", side), slog.String("line", strings.TrimRight(line, "\r\n")))
+	s.logger.Handler().Handle(context.Background(), r)
+}
+
+// redactCredentials hides the arguments of LOGIN and the initial response
+// of AUTHENTICATE in a client command line, as transcripts do.
+func redactCredentials(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return line
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "LOGIN":
+		return fields[0] + " LOGIN " + transcript.Redacted + " " + transcript.Redacted
+	case "AUTHENTICATE":
+		if len(fields) > 3 {
+			return fields[0] + " AUTHENTICATE " + fields[2] + " " + transcript.Redacted
+		}
+	}
+	return line
+}
+
+// SessionsHandler serves GET /sessions, which lists the running sessions,
+// one per line: ID, local user ("-" before LOGIN), client address and
+// start time, separated by tabs.
+func (s *Server) SessionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, t := range s.shared.sessions.list() {
+			user := "-"
+			if u := t.user.Load(); u != nil {
+				user = *u
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.id, user, t.client, t.started.UTC().Format(time.RFC3339))
+		}
+	})
+}
+
+// SessionLogLevelHandler serves the log level of the running session named
+// by the {id} path value, like LogLevelHandler does for accounts. A level
+// set here takes precedence over the account's and ends with the session.
+func (s *Server) SessionLogLevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := s.shared.sessions.get(r.PathValue("id"))
+		if t == nil {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		serveLogLevel(w, r, &t.level, func(name string) {
+			s.logger.Info("session log level changed", "session", t.id, "level", name)
+		})
+	})
+}
+
+// WireTraceHandler serves the wire trace of the running session named by
+// the {id} path value: GET returns "on" or "off" and PUT sets it from the
+// request body. While it is on, the session logs every command line from
+// the client and every response line from the upstream; literals are not
+// logged.
+func (s *Server) WireTraceHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := s.shared.sessions.get(r.PathValue("id"))
+		if t == nil {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPut {
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			switch name := strings.TrimSpace(string(body)); name {
+			case "on", "off":
+				t.wire.Store(name == "on")
+				s.logger.Info("session wire trace changed", "session", t.id, "trace", name)
+			default:
+				http.Error(w, fmt.Sprintf("wire trace must be %q or %q", "on", "off"), http.StatusBadRequest)
+				return
+			}
+		}
+		name := "off"
+		if t.wire.Load() {
+			name = "on"
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, name)
+	})
+}
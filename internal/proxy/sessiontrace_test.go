@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactCredentials(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"A1 LOGIN alice secret\r\n", "A1 LOGIN [REDACTED] [REDACTED]"},
+		{"A1 login {5}\r\n", "A1 LOGIN [REDACTED] [REDACTED]"},
+		{"A2 AUTHENTICATE PLAIN AGFsaWNlAHNlY3JldA==\r\n", "A2 AUTHENTICATE PLAIN [REDACTED]"},
+		{"A2 AUTHENTICATE PLAIN\r\n", "A2 AUTHENTICATE PLAIN\r\n"},
+		{"A3 SELECT INBOX\r\n", "A3 SELECT INBOX\r\n"},
+	}
+	for _, tt := range tests {
+		if got := redactCredentials(tt.line); got != tt.want {
+			t.Errorf("redactCredentials(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSessionTraceHandlers(t *testing.T) {
+	cfg := testConfig()
+	srv := NewServer(cfg, testLogger())
+	mux := http.NewServeMux()
+	mux.Handle("GET /sessions", srv.SessionsHandler())
+	mux.Handle("GET /sessions/{id}/log-level", srv.SessionLogLevelHandler())
+	mux.Handle("PUT /sessions/{id}/log-level", srv.SessionLogLevelHandler())
+	mux.Handle("GET /sessions/{id}/wire-trace", srv.WireTraceHandler())
+	mux.Handle("PUT /sessions/{id}/wire-trace", srv.WireTraceHandler())
+	do := func(method, path, body string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+
+	// The session logs at info level; buf is read once it has ended.
+	var buf bytes.Buffer
+	var sess *Session
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		sess = s
+		s.shared = srv.shared
+		s.baseLogger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		s.logger = s.traced(s.baseLogger)
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	id := sess.trace.id
+	_, list := do("GET", "/sessions", "")
+	if fields := strings.Split(list, "\t"); len(fields) != 4 || fields[0] != id || fields[1] != "reader1" {
+		t.Fatalf("sessions = %q", list)
+	}
+	path := "/sessions/" + id
+	tests := []struct {
+		method, path, body string
+		wantCode           int
+		wantBody           string
+	}{
+		{"GET", path + "/wire-trace", "", http.StatusOK, "off"},
+		{"PUT", path + "/wire-trace", "loud", http.StatusBadRequest, `wire trace must be "on" or "off"`},
+		{"PUT", path + "/wire-trace", "on\n", http.StatusOK, "on"},
+		{"PUT", path + "/log-level", "debug", http.StatusOK, "debug"},
+		{"GET", path + "/log-level", "", http.StatusOK, "debug"},
+		{"GET", "/sessions/nope/wire-trace", "", http.StatusNotFound, "unknown session"},
+		{"PUT", "/sessions/nope/log-level", "debug", http.StatusNotFound, "unknown session"},
+	}
+	for _, tt := range tests {
+		if code, body := do(tt.method, tt.path, tt.body); code != tt.wantCode || body != tt.wantBody {
+			t.Errorf("%s %s %q = %d %q, want %d %q", tt.method, tt.path, tt.body, code, body, tt.wantCode, tt.wantBody)
+		}
+	}
+
+	env.send(t, "A002 NOOP\r\n")
+	env.readUntilTagged(t, "A002")
+	env.send(t, "A003 LOGOUT\r\n")
+	env.readUntilTagged(t, "A003")
+	for deadline := time.Now().Add(5 * time.Second); srv.shared.sessions.get(id) != nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("session still registered after LOGOUT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	log := buf.String()
+	for _, want := range []string{
+		`msg=wire session=` + id + ` user=reader1 side=client line="A002 NOOP"`,
+		`msg=wire session=` + id + ` user=reader1 side=upstream line="A002 OK completed"`,
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %q:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "msg=wire session="+id+" side=client") {
+		t.Errorf("pre-auth lines traced:\n%s", log)
+	}
+	if !strings.Contains(log, `level=DEBUG msg="forwarded command"`) {
+		t.Errorf("no debug records after the session level was lowered:\n%s", log)
+	}
+	if _, list := do("GET", "/sessions", ""); list != "" {
+		t.Errorf("sessions after LOGOUT = %q", list)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"time"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/quota"
+)
+
+// shared holds state that all sessions of a Server have in common.
+type shared struct {
+	limits      *sessionLimits
+	hosts       *HostLimits // nil does not limit
+	ipLimits    *ipLimiter
+	lockout     *accountLockout
+	audit       *audit.Recorder // nil discards events
+	geo         CountryLookup   // nil disables country lookups
+	quota       downloadQuota
+	appends     *appendCounters
+	bandwidth   *bandwidthLimits
+	breakers    *circuitBreakers
+	accountLogs *accountLogs
+	events      *eventBus // nil disables published events
+	relays      *relayTracker
+	digests     *blockedDigests
+	sessions    *sessionRegistry
+}
+
+func newShared() *shared {
+	sh := &shared{
+		limits:      newSessionLimits(),
+		ipLimits:    newIPLimiter(),
+		lockout:     newAccountLockout(),
+		quota:       quota.NewStore(),
+		appends:     newAppendCounters(),
+		bandwidth:   newBandwidthLimits(),
+		breakers:    newCircuitBreakers(),
+		accountLogs: newAccountLogs(),
+		relays:      newRelayTracker(),
+		digests:     newBlockedDigests(),
+		sessions:    newSessionRegistry(),
+	}
+	sh.ipLimits.onBan = func(ip, reason string, d time.Duration) {
+		sh.audit.Record(audit.Event{
+			Type: audit.IPBanned, ClientIP: ip,
+			Fields: map[string]string{"reason": reason, "banned_for": d.String()},
+		})
+	}
+	return sh
+}
@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/quota"
+)
+
+var sharedStateErrorsTotal = metrics.Default.NewCounter("imap_proxy_shared_state_errors_total",
+	"Shared state store operations that failed; the instance fell back to its local counters.")
+
+const (
+	// sharedStateWarnInterval limits how often store failures are logged.
+	sharedStateWarnInterval = time.Minute
+	// sharedStateRetryInterval is how long the store is left alone after a
+	// failure, so that connections and logins fall back to the local
+	// counters at once instead of each waiting for the store to time out.
+	sharedStateRetryInterval = 5 * time.Second
+	// Expiry of the shared keys. Rate windows last a minute; lockout and
+	// quota counters outlive the state they describe by a comfortable
+	// margin.
+	sharedWindowTTL  = 2 * time.Minute
+	sharedLockoutTTL = 24 * time.Hour
+	sharedQuotaTTL   = 48 * time.Hour
+	// sharedQuotaFlushBytes is how many downloaded bytes an instance
+	// accumulates per account before adding them to the shared counter.
+	sharedQuotaFlushBytes = 256 << 10
+)
+
+// SharedStore is a key-value store of expiring integer counters shared by
+// several proxy instances. *redis.Client implements it.
+type SharedStore interface {
+	IncrBy(key string, n int64, ttl time.Duration) (int64, error)
+	Get(key string) (int64, error)
+	Set(key string, v int64, ttl time.Duration) error
+	TTL(key string) (time.Duration, error)
+	Del(keys ...string) error
+}
+
+// SetSharedState keeps source IP rate limits and bans, account lockouts
+// and download quotas in store, under keys starting with prefix, so that
+// they apply across every instance using the same store. If the store
+// fails, each instance falls back to its own counters. It must be called
+// before Serve. After a store failure the store is left alone for a few
+// seconds.
+func (s *Server) SetSharedState(store SharedStore, prefix string) {
+	st := &sharedState{store: &backoffStore{store: store, now: time.Now}, prefix: prefix, logger: s.logger}
+	s.shared.ipLimits.state = st
+	s.shared.lockout.state = st
+	s.shared.quota = newSharedQuota(st, s.shared.quota)
+}
+
+// errSharedStoreBackoff is returned instead of trying a store that failed
+// within the last sharedStateRetryInterval.
+var errSharedStoreBackoff = errors.New("shared state store failed recently, not retried yet")
+
+// backoffStore is a SharedStore that stops sending operations to store
+// for sharedStateRetryInterval after one fails. Then a single operation is
+// let through to probe it, and the rest fail at once until it succeeds.
+type backoffStore struct {
+	store SharedStore
+	now   func() time.Time
+
+	mu      sync.Mutex
+	failing bool
+	probing bool      // an operation is trying the failing store
+	retryAt time.Time // when the failing store may be tried again
+}
+
+// begin reports whether an operation may go to the store.
+func (b *backoffStore) begin() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.failing {
+		return nil
+	}
+	if b.probing || b.now().Before(b.retryAt) {
+		return errSharedStoreBackoff
+	}
+	b.probing = true
+	return nil
+}
+
+// done records the outcome of an operation begun with begin.
+func (b *backoffStore) done(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	b.failing = err != nil
+	if b.failing {
+		b.retryAt = b.now().Add(sharedStateRetryInterval)
+	}
+	return err
+}
+
+func (b *backoffStore) IncrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	if err := b.begin(); err != nil {
+		return 0, err
+	}
+	v, err := b.store.IncrBy(key, n, ttl)
+	return v, b.done(err)
+}
+
+func (b *backoffStore) Get(key string) (int64, error) {
+	if err := b.begin(); err != nil {
+		return 0, err
+	}
+	v, err := b.store.Get(key)
+	return v, b.done(err)
+}
+
+func (b *backoffStore) Set(key string, v int64, ttl time.Duration) error {
+	if err := b.begin(); err != nil {
+		return err
+	}
+	return b.done(b.store.Set(key, v, ttl))
+}
+
+func (b *backoffStore) TTL(key string) (time.Duration, error) {
+	if err := b.begin(); err != nil {
+		return 0, err
+	}
+	v, err := b.store.TTL(key)
+	return v, b.done(err)
+}
+
+func (b *backoffStore) Del(keys ...string) error {
+	if err := b.begin(); err != nil {
+		return err
+	}
+	return b.done(b.store.Del(keys...))
+}
+
+// sharedState wraps a SharedStore, namespacing keys and turning failures
+// into a metric and an occasional warning.
+type sharedState struct {
+	store  SharedStore
+	prefix string
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	lastWarn time.Time
+}
+
+func (st *sharedState) key(parts ...string) string {
+	k := st.prefix
+	for _, p := range parts {
+		k += ":" + p
+	}
+	return k
+}
+
+// failed records a store error and reports whether err is non-nil.
+func (st *sharedState) failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	sharedStateErrorsTotal.Inc()
+	st.mu.Lock()
+	warn := time.Since(st.lastWarn) >= sharedStateWarnInterval
+	if warn {
+		st.lastWarn = time.Now()
+	}
+	st.mu.Unlock()
+	if warn && st.logger != nil {
+		st.logger.Warn("shared state store failed, using local counters", "err", err)
+	}
+	return true
+}
+
+// windowKey returns the key counting events of kind from ip in the
+// calendar minute containing now.
+func (st *sharedState) windowKey(kind, ip string, now time.Time) string {
+	return st.key(kind, ip, strconv.FormatInt(now.Unix()/60, 10))
+}
+
+// windowLimit is how many events a fixed one-minute window admits: the
+// burst, or the per-minute rate if that is larger.
+func windowLimit(perMinute float64, burst int) int64 {
+	return int64(max(math.Ceil(perMinute), float64(burst), 1))
+}
+
+// sharedAllowConnection is allowConnection against the shared store. ok is
+// false if the store failed.
+func (l *ipLimiter) sharedAllowConnection(ip string, rl config.RateLimitConfig, now time.Time) (allowed, ok bool) {
+	st := l.state
+	ttl, err := st.store.TTL(st.key("ban", ip))
+	if st.failed(err) {
+		return false, false
+	}
+	if ttl > 0 {
+		ipRateLimitedTotal.Inc("banned")
+		return false, true
+	}
+	if rl.ConnectionsPerMinute <= 0 {
+		return true, true
+	}
+	n, err := st.store.IncrBy(st.windowKey("conn", ip, now), 1, sharedWindowTTL)
+	if st.failed(err) {
+		return false, false
+	}
+	if n > windowLimit(rl.ConnectionsPerMinute, rl.ConnectionBurst) {
+		ipRateLimitedTotal.Inc("connections")
+		l.sharedBan(ip, rl, "connections")
+		return false, true
+	}
+	return true, true
+}
+
+// sharedLoginFailed is loginFailed against the shared store. ok is false
+// if the store failed.
+func (l *ipLimiter) sharedLoginFailed(ip string, rl config.RateLimitConfig, now time.Time) (banned, ok bool) {
+	st := l.state
+	ttl, err := st.store.TTL(st.key("ban", ip))
+	if st.failed(err) {
+		return false, false
+	}
+	if ttl > 0 {
+		return true, true
+	}
+	n, err := st.store.IncrBy(st.windowKey("fail", ip, now), 1, sharedWindowTTL)
+	if st.failed(err) {
+		return false, false
+	}
+	if n > windowLimit(rl.FailedLoginsPerMinute, rl.FailedLoginBurst) {
+		ipRateLimitedTotal.Inc("failed_logins")
+		return l.sharedBan(ip, rl, "failed_logins"), true
+	}
+	return false, true
+}
+
+// sharedBan bans ip in the shared store for rl.BanDuration. It reports
+// whether a ban was issued.
+func (l *ipLimiter) sharedBan(ip string, rl config.RateLimitConfig, reason string) bool {
+	if rl.BanDuration <= 0 {
+		return false
+	}
+	if l.state.failed(l.state.store.Set(l.state.key("ban", ip), 1, rl.BanDuration)) {
+		return false
+	}
+	ipBansTotal.Inc(reason)
+	if l.onBan != nil {
+		l.onBan(ip, reason, rl.BanDuration)
+	}
+	return true
+}
+
+// sharedLocked is locked against the shared store. ok is false if the
+// store failed.
+func (l *accountLockout) sharedLocked(user string, now time.Time) (locked bool, until time.Time, ok bool) {
+	st := l.state
+	ttl, err := st.store.TTL(st.key("lockout", "until", user))
+	if st.failed(err) {
+		return false, time.Time{}, false
+	}
+	if ttl <= 0 {
+		return false, time.Time{}, true
+	}
+	return true, now.Add(ttl), true
+}
+
+// sharedFailure is failure against the shared store. ok is false if the
+// store failed.
+func (l *accountLockout) sharedFailure(user string, lc config.LockoutConfig) (d time.Duration, ok bool) {
+	st := l.state
+	failKey := st.key("lockout", "fail", user)
+	n, err := st.store.IncrBy(failKey, 1, sharedLockoutTTL)
+	if st.failed(err) {
+		return 0, false
+	}
+	if n < int64(lc.MaxFailures) {
+		return 0, true
+	}
+	if st.failed(st.store.Del(failKey)) {
+		return 0, false
+	}
+	lockouts, err := st.store.IncrBy(st.key("lockout", "count", user), 1, sharedLockoutTTL)
+	if st.failed(err) {
+		return 0, false
+	}
+	d = lockoutDuration(lc, int(lockouts-1))
+	if st.failed(st.store.Set(st.key("lockout", "until", user), 1, d)) {
+		return 0, false
+	}
+	accountLockoutsTotal.Inc()
+	return d, true
+}
+
+// sharedSuccess clears user's lockout state in the shared store.
+func (l *accountLockout) sharedSuccess(user string) {
+	st := l.state
+	st.failed(st.store.Del(st.key("lockout", "fail", user), st.key("lockout", "count", user), st.key("lockout", "until", user)))
+}
+
+// downloadQuota counts bytes downloaded per account per day.
+// *quota.Store and *sharedQuota implement it.
+type downloadQuota interface {
+	Add(user string, n int64) int64
+	Used(user string) int64
+}
+
+// sharedQuota keeps daily download counters in the shared store. To avoid a
+// round trip per response line, bytes are added to the shared counter once
+// sharedQuotaFlushBytes have accumulated or when the usage is checked. The
+// local store keeps counting too and answers when the shared store fails.
+type sharedQuota struct {
+	state *sharedState
+	local downloadQuota
+	now   func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]int64
+}
+
+func newSharedQuota(st *sharedState, local downloadQuota) *sharedQuota {
+	if local == nil {
+		local = quota.NewStore()
+	}
+	return &sharedQuota{state: st, local: local, now: time.Now, pending: make(map[string]int64)}
+}
+
+func (q *sharedQuota) key(user string) string {
+	return q.state.key("quota", q.now().UTC().Format("2006-01-02"), user)
+}
+
+// Add records n bytes downloaded by user and returns the local total.
+func (q *sharedQuota) Add(user string, n int64) int64 {
+	total := q.local.Add(user, n)
+	q.mu.Lock()
+	q.pending[user] += n
+	flush := q.pending[user] >= sharedQuotaFlushBytes
+	q.mu.Unlock()
+	if flush {
+		q.flush(user)
+	}
+	return total
+}
+
+// Used returns the bytes user downloaded today across all instances.
+func (q *sharedQuota) Used(user string) int64 {
+	if used, ok := q.flush(user); ok {
+		return used
+	}
+	if used, err := q.state.store.Get(q.key(user)); !q.state.failed(err) {
+		return used
+	}
+	return q.local.Used(user)
+}
+
+// flush adds user's pending bytes to the shared counter and returns the
+// new total. ok is false if nothing was pending or the store failed, in
+// which case the bytes stay pending.
+func (q *sharedQuota) flush(user string) (used int64, ok bool) {
+	q.mu.Lock()
+	n := q.pending[user]
+	delete(q.pending, user)
+	q.mu.Unlock()
+	if n == 0 {
+		return 0, false
+	}
+	used, err := q.state.store.IncrBy(q.key(user), n, sharedQuotaTTL)
+	if q.state.failed(err) {
+		q.mu.Lock()
+		q.pending[user] += n
+		q.mu.Unlock()
+		return 0, false
+	}
+	return used, true
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/quota"
+)
+
+// fakeSharedStore is an in-memory SharedStore on a test clock. While down
+// is set, every operation fails.
+type fakeSharedStore struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	values  map[string]int64
+	expires map[string]time.Time
+	down    bool
+	ops     int
+}
+
+func newFakeSharedStore(now func() time.Time) *fakeSharedStore {
+	return &fakeSharedStore{now: now, values: make(map[string]int64), expires: make(map[string]time.Time)}
+}
+
+var errStoreDown = errors.New("store down")
+
+// begin expires keys and counts the operation; f.mu must be held.
+func (f *fakeSharedStore) begin() error {
+	f.ops++
+	if f.down {
+		return errStoreDown
+	}
+	for k, exp := range f.expires {
+		if !f.now().Before(exp) {
+			delete(f.values, k)
+			delete(f.expires, k)
+		}
+	}
+	return nil
+}
+
+func (f *fakeSharedStore) IncrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(); err != nil {
+		return 0, err
+	}
+	if _, ok := f.values[key]; !ok {
+		f.expires[key] = f.now().Add(ttl)
+	}
+	f.values[key] += n
+	return f.values[key], nil
+}
+
+func (f *fakeSharedStore) Get(key string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(); err != nil {
+		return 0, err
+	}
+	return f.values[key], nil
+}
+
+func (f *fakeSharedStore) Set(key string, v int64, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(); err != nil {
+		return err
+	}
+	f.values[key] = v
+	f.expires[key] = f.now().Add(ttl)
+	return nil
+}
+
+func (f *fakeSharedStore) TTL(key string) (time.Duration, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(); err != nil {
+		return 0, err
+	}
+	if _, ok := f.values[key]; !ok {
+		return 0, nil
+	}
+	return f.expires[key].Sub(f.now()), nil
+}
+
+func (f *fakeSharedStore) Del(keys ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.begin(); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		delete(f.values, k)
+		delete(f.expires, k)
+	}
+	return nil
+}
+
+func (f *fakeSharedStore) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+// sharedInstances returns n servers' shared state, all backed by store.
+func sharedInstances(t *testing.T, store SharedStore, now func() time.Time, n int) []*shared {
+	t.Helper()
+	var out []*shared
+	for range n {
+		srv := NewServer(testConfig(), slog.New(slog.DiscardHandler))
+		srv.SetSharedState(store, "test")
+		srv.shared.ipLimits.now = now
+		srv.shared.lockout.now = now
+		srv.shared.quota.(*sharedQuota).now = now
+		srv.shared.lockout.state.store.(*backoffStore).now = now
+		out = append(out, srv.shared)
+	}
+	return out
+}
+
+func TestSharedIPLimitsAcrossInstances(t *testing.T) {
+	now := time.Unix(6000, 0)
+	clock := func() time.Time { return now }
+	store := newFakeSharedStore(clock)
+	insts := sharedInstances(t, store, clock, 2)
+	rl := config.RateLimitConfig{ConnectionsPerMinute: 2, BanDuration: 5 * time.Minute}
+
+	if !insts[0].ipLimits.allowConnection("192.0.2.1", rl) || !insts[1].ipLimits.allowConnection("192.0.2.1", rl) {
+		t.Fatal("connections within the limit should be allowed")
+	}
+	if insts[0].ipLimits.allowConnection("192.0.2.1", rl) {
+		t.Fatal("third connection across instances should be refused")
+	}
+	if !insts[1].ipLimits.banned("192.0.2.1") {
+		t.Fatal("ban should be visible to the other instance")
+	}
+	if !insts[1].ipLimits.allowConnection("192.0.2.2", rl) {
+		t.Fatal("other IPs must not be affected")
+	}
+
+	now = now.Add(5 * time.Minute)
+	if !insts[1].ipLimits.allowConnection("192.0.2.1", rl) {
+		t.Fatal("connection after ban expiry should be allowed")
+	}
+}
+
+func TestSharedFailedLoginsAcrossInstances(t *testing.T) {
+	now := time.Unix(6000, 0)
+	clock := func() time.Time { return now }
+	insts := sharedInstances(t, newFakeSharedStore(clock), clock, 3)
+	rl := config.RateLimitConfig{FailedLoginsPerMinute: 1, FailedLoginBurst: 2, BanDuration: time.Minute}
+
+	for i := 0; i < 2; i++ {
+		if insts[i].ipLimits.loginFailed("192.0.2.1", rl) {
+			t.Fatalf("failure %d should not ban yet", i)
+		}
+	}
+	if !insts[2].ipLimits.loginFailed("192.0.2.1", rl) {
+		t.Fatal("third failure across instances should ban")
+	}
+	if insts[0].ipLimits.allowConnection("192.0.2.1", rl) {
+		t.Fatal("banned IP should be refused by every instance")
+	}
+
+	// A new minute starts a new window once the ban is over.
+	now = now.Add(time.Minute)
+	if insts[0].ipLimits.loginFailed("192.0.2.1", rl) {
+		t.Fatal("failure in a new window should not ban")
+	}
+}
+
+func TestSharedLockoutAcrossInstances(t *testing.T) {
+	now := time.Unix(6000, 0)
+	clock := func() time.Time { return now }
+	insts := sharedInstances(t, newFakeSharedStore(clock), clock, 2)
+	lc := config.LockoutConfig{MaxFailures: 2, Duration: time.Minute, MaxDuration: 3 * time.Minute}
+
+	for round, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		if d := insts[0].lockout.failure("reader1", lc); d != 0 {
+			t.Fatalf("round %d: locked early (%v)", round, d)
+		}
+		if d := insts[1].lockout.failure("reader1", lc); d != want {
+			t.Fatalf("round %d: lock duration = %v, want %v", round, d, want)
+		}
+		if locked, until := insts[0].lockout.locked("reader1"); !locked || !until.Equal(now.Add(want)) {
+			t.Fatalf("round %d: other instance sees locked=%v until=%v", round, locked, until)
+		}
+		now = now.Add(want)
+		if locked, _ := insts[0].lockout.locked("reader1"); locked {
+			t.Fatalf("round %d: still locked after expiry", round)
+		}
+	}
+
+	insts[1].lockout.success("reader1")
+	insts[0].lockout.failure("reader1", lc)
+	if d := insts[0].lockout.failure("reader1", lc); d != time.Minute {
+		t.Errorf("after success, lock duration = %v, want the backoff reset", d)
+	}
+}
+
+func TestSharedQuotaAcrossInstances(t *testing.T) {
+	now := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := newFakeSharedStore(clock)
+	insts := sharedInstances(t, store, clock, 2)
+
+	insts[0].quota.Add("reader1", 100)
+	store.mu.Lock()
+	ops := store.ops
+	store.mu.Unlock()
+	if ops != 0 {
+		t.Errorf("small download sent %d store operations, want it batched", ops)
+	}
+	insts[0].quota.Add("reader1", sharedQuotaFlushBytes)
+	if got := insts[1].quota.Used("reader1"); got != sharedQuotaFlushBytes+100 {
+		t.Errorf("other instance Used = %d, want %d", got, sharedQuotaFlushBytes+100)
+	}
+
+	insts[1].quota.Add("reader1", 50)
+	if got := insts[1].quota.Used("reader1"); got != sharedQuotaFlushBytes+150 {
+		t.Errorf("Used after pending bytes = %d, want %d", got, sharedQuotaFlushBytes+150)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if got := insts[0].quota.Used("reader1"); got != 0 {
+		t.Errorf("Used on a new day = %d, want 0", got)
+	}
+}
+
+func TestSharedStateFallsBackWhenStoreFails(t *testing.T) {
+	now := time.Unix(6000, 0)
+	clock := func() time.Time { return now }
+	store := newFakeSharedStore(clock)
+	insts := sharedInstances(t, store, clock, 1)
+	sh := insts[0]
+	store.setDown(true)
+	before := sharedStateErrorsTotal.Value()
+
+	rl := config.RateLimitConfig{ConnectionsPerMinute: 60, ConnectionBurst: 1, BanDuration: time.Minute}
+	if !sh.ipLimits.allowConnection("192.0.2.1", rl) {
+		t.Fatal("first connection should be allowed by the local limiter")
+	}
+	if sh.ipLimits.allowConnection("192.0.2.1", rl) {
+		t.Fatal("local limiter should still enforce the burst")
+	}
+
+	lc := config.LockoutConfig{MaxFailures: 1, Duration: time.Minute}
+	if d := sh.lockout.failure("reader1", lc); d != time.Minute {
+		t.Fatalf("local lockout duration = %v, want 1m", d)
+	}
+	if locked, _ := sh.lockout.locked("reader1"); !locked {
+		t.Fatal("local lockout should apply")
+	}
+
+	sh.quota.Add("reader1", 10)
+	if got := sh.quota.Used("reader1"); got != 10 {
+		t.Errorf("Used = %d, want the local count", got)
+	}
+	if sharedStateErrorsTotal.Value() <= before {
+		t.Error("store errors not counted")
+	}
+	// Only the first operation tried the failed store.
+	if store.ops != 1 {
+		t.Errorf("store tried %d times, want once until the retry interval passes", store.ops)
+	}
+
+	// Pending bytes reach the shared counter once the store is back and
+	// the retry interval has passed.
+	store.setDown(false)
+	now = now.Add(sharedStateRetryInterval)
+	if got := sh.quota.Used("reader1"); got != 10 {
+		t.Errorf("Used after recovery = %d, want 10", got)
+	}
+	if got, _ := store.Get("test:quota:" + now.UTC().Format("2006-01-02") + ":reader1"); got != 10 {
+		t.Errorf("shared counter after recovery = %d, want 10", got)
+	}
+}
+
+func TestSetSharedStateWrapsQuotaStore(t *testing.T) {
+	srv := NewServer(testConfig(), slog.New(slog.DiscardHandler))
+	local := quota.NewStore()
+	srv.SetQuotaStore(local)
+	srv.SetSharedState(newFakeSharedStore(time.Now), "test")
+	srv.shared.quota.Add("reader1", 7)
+	if got := local.Used("reader1"); got != 7 {
+		t.Errorf("local store Used = %d, want 7", got)
+	}
+}
+
+func TestWindowLimit(t *testing.T) {
+	tests := []struct {
+		perMinute float64
+		burst     int
+		want      int64
+	}{
+		{60, 0, 60},
+		{1, 3, 3},
+		{0.5, 0, 1},
+		{10.2, 5, 11},
+	}
+	for _, tt := range tests {
+		if got := windowLimit(tt.perMinute, tt.burst); got != tt.want {
+			t.Errorf("windowLimit(%v, %d) = %d, want %d", tt.perMinute, tt.burst, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net"
+
+	"imap-proxy/internal/config"
+)
+
+// keepAliveConfigured reports whether sc changes the keepalive defaults.
+func keepAliveConfigured(sc config.SocketConfig) bool {
+	return sc.KeepAliveIdle != 0 || sc.KeepAliveInterval != 0 || sc.KeepAliveCount != 0
+}
+
+// tuneConn applies sc to conn if it is a TCP connection.
+func tuneConn(conn net.Conn, sc config.SocketConfig) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if keepAliveConfigured(sc) {
+		err := tc.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     sc.KeepAliveIdle,
+			Interval: sc.KeepAliveInterval,
+			Count:    sc.KeepAliveCount,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if sc.NoDelay != nil {
+		if err := tc.SetNoDelay(*sc.NoDelay); err != nil {
+			return err
+		}
+	}
+	if sc.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(sc.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if sc.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(sc.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+// checkSocketOptions verifies the options tuneConn set on conn.
+func checkSocketOptions(t *testing.T, conn net.Conn, sc config.SocketConfig) {
+	t.Helper()
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	get := func(level, opt int) int {
+		var v int
+		var gerr error
+		raw.Control(func(fd uintptr) { v, gerr = syscall.GetsockoptInt(int(fd), level, opt) })
+		if gerr != nil {
+			t.Fatalf("getsockopt(%d, %d): %v", level, opt, gerr)
+		}
+		return v
+	}
+
+	if sc.KeepAliveIdle > 0 {
+		if got := get(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != int(sc.KeepAliveIdle.Seconds()) {
+			t.Errorf("TCP_KEEPIDLE = %d, want %v", got, sc.KeepAliveIdle)
+		}
+	}
+	if sc.KeepAliveInterval > 0 {
+		if got := get(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); got != int(sc.KeepAliveInterval.Seconds()) {
+			t.Errorf("TCP_KEEPINTVL = %d, want %v", got, sc.KeepAliveInterval)
+		}
+	}
+	if sc.KeepAliveCount > 0 {
+		if got := get(syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT); got != sc.KeepAliveCount {
+			t.Errorf("TCP_KEEPCNT = %d, want %d", got, sc.KeepAliveCount)
+		}
+	}
+	if sc.NoDelay != nil {
+		if got := get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0; got != *sc.NoDelay {
+			t.Errorf("TCP_NODELAY = %v, want %v", got, *sc.NoDelay)
+		}
+	}
+	// Linux doubles the requested buffer sizes to allow for bookkeeping.
+	if sc.ReadBuffer > 0 {
+		if got := get(syscall.SOL_SOCKET, syscall.SO_RCVBUF); got < sc.ReadBuffer {
+			t.Errorf("SO_RCVBUF = %d, want at least %d", got, sc.ReadBuffer)
+		}
+	}
+	if sc.WriteBuffer > 0 {
+		if got := get(syscall.SOL_SOCKET, syscall.SO_SNDBUF); got < sc.WriteBuffer {
+			t.Errorf("SO_SNDBUF = %d, want at least %d", got, sc.WriteBuffer)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestTuneConn(t *testing.T) {
+	off := false
+	tests := []struct {
+		name string
+		sc   config.SocketConfig
+	}{
+		{"defaults", config.SocketConfig{}},
+		{"keepalive", config.SocketConfig{KeepAliveIdle: 30 * time.Second, KeepAliveInterval: 5 * time.Second, KeepAliveCount: 4}},
+		{"nodelay off", config.SocketConfig{NoDelay: &off}},
+		{"buffers", config.SocketConfig{ReadBuffer: 64 << 10, WriteBuffer: 128 << 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, server := tcpPair(t)
+			if err := tuneConn(server, tt.sc); err != nil {
+				t.Fatalf("tuneConn: %v", err)
+			}
+			checkSocketOptions(t, server, tt.sc)
+		})
+	}
+}
+
+func TestTuneConnNonTCP(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := tuneConn(a, config.SocketConfig{ReadBuffer: 1024}); err != nil {
+		t.Fatalf("tuneConn(pipe): %v", err)
+	}
+}
+
+func TestDialUpstreamSocketOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("* OK ready\r\n"))
+		conn.Close()
+	}()
+
+	off := false
+	acct := &config.AccountConfig{
+		RemoteHost:     "127.0.0.1",
+		RemotePort:     ln.Addr().(*net.TCPAddr).Port,
+		UpstreamSocket: config.SocketConfig{KeepAliveIdle: time.Minute, NoDelay: &off, WriteBuffer: 32 << 10},
+	}
+	conn, _, err := dialUpstream(acct, nil, "")
+	if err != nil {
+		t.Fatalf("dialUpstream: %v", err)
+	}
+	defer conn.Close()
+	checkSocketOptions(t, conn, acct.UpstreamSocket)
+}
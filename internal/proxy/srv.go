@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+const (
+	// dnsDefaultTTL is used when the record TTL cannot be determined, e.g.
+	// when the system (cgo) resolver answered.
+	dnsDefaultTTL = 5 * time.Minute
+	// dnsMinTTL keeps a zero or tiny TTL from causing a lookup per login.
+	dnsMinTTL = 30 * time.Second
+	// dnsLookupTimeout bounds a single SRV or address lookup.
+	dnsLookupTimeout = 10 * time.Second
+
+	// DNS record types whose TTLs are tracked.
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+)
+
+// srvLookupFunc resolves SRV records for _service._proto.name, returning
+// them in preference order along with the smallest record TTL (zero if
+// unknown).
+type srvLookupFunc func(ctx context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error)
+
+// srvCache caches SRV lookups for their TTL. If a refresh fails, the
+// expired entry keeps being used so a DNS outage does not block logins.
+type srvCache struct {
+	lookup srvLookupFunc
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]srvEntry
+}
+
+type srvEntry struct {
+	host    string
+	port    int
+	expires time.Time
+}
+
+// upstreamSRV is the process-wide cache used by dialUpstream.
+var upstreamSRV = newSRVCache(lookupSRVWithTTL)
+
+func newSRVCache(lookup srvLookupFunc) *srvCache {
+	return &srvCache{lookup: lookup, now: time.Now, entries: make(map[string]srvEntry)}
+}
+
+// forget removes the SRV records cached for domain, for any service, and
+// returns the target hosts they named.
+func (c *srvCache) forget(domain string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hosts []string
+	for key, e := range c.entries {
+		if strings.HasSuffix(key, "."+domain) {
+			hosts = append(hosts, e.host)
+			delete(c.entries, key)
+		}
+	}
+	return hosts
+}
+
+// resolve returns the preferred target for _service._tcp.domain.
+func (c *srvCache) resolve(service, domain string) (host string, port int, err error) {
+	key := service + "." + domain
+	now := c.now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.host, e.port, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	records, ttl, err := c.lookup(ctx, service, "tcp", domain)
+	if err == nil && (len(records) == 0 || records[0].Target == ".") {
+		// RFC 6186: a target of "." means the service is not offered.
+		err = fmt.Errorf("no %s service for %s", service, domain)
+	}
+	if err != nil {
+		if ok {
+			return e.host, e.port, nil
+		}
+		return "", 0, fmt.Errorf("srv lookup _%s._tcp.%s: %w", service, domain, err)
+	}
+
+	if ttl <= 0 {
+		ttl = dnsDefaultTTL
+	}
+	e = srvEntry{
+		host:    strings.TrimSuffix(records[0].Target, "."),
+		port:    int(records[0].Port),
+		expires: now.Add(max(ttl, dnsMinTTL)),
+	}
+	c.mu.Lock()
+	c.entries[key] = e
+	c.mu.Unlock()
+	return e.host, e.port, nil
+}
+
+// srvService returns the RFC 6186 service name for acct's TLS mode.
+func srvService(acct *config.AccountConfig) string {
+	if acct.RemoteTLS {
+		return "imaps"
+	}
+	return "imap"
+}
+
+// lookupSRVWithTTL resolves SRV records with the pure-Go resolver and
+// recovers the TTL, which net.LookupSRV does not expose, by parsing the DNS
+// responses as they are read.
+func lookupSRVWithTTL(ctx context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error) {
+	rec := &dnsRecorder{}
+	_, records, err := rec.resolver().LookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return records, rec.minTTL(dnsTypeSRV), nil
+}
+
+// dnsRecorder collects the DNS messages read during one lookup.
+type dnsRecorder struct {
+	mu       sync.Mutex
+	messages [][]byte
+}
+
+// resolver returns a pure-Go resolver whose DNS responses r records.
+func (r *dnsRecorder) resolver() *net.Resolver {
+	var d net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := d.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			// The resolver treats packet conns as UDP, so keep that interface.
+			if uc, ok := conn.(*net.UDPConn); ok {
+				return &recordingUDPConn{UDPConn: uc, rec: r}, nil
+			}
+			return &recordingStreamConn{Conn: conn, rec: r}, nil
+		},
+	}
+}
+
+func (r *dnsRecorder) add(msg []byte) {
+	r.mu.Lock()
+	r.messages = append(r.messages, append([]byte(nil), msg...))
+	r.mu.Unlock()
+}
+
+// minTTL returns the smallest TTL of any answer of the given types seen,
+// or zero.
+func (r *dnsRecorder) minTTL(types ...uint16) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var best uint32
+	found := false
+	for _, msg := range r.messages {
+		if ttl, ok := answerTTL(msg, types...); ok && (!found || ttl < best) {
+			best, found = ttl, true
+		}
+	}
+	return time.Duration(best) * time.Second
+}
+
+// recordingUDPConn records every datagram read.
+type recordingUDPConn struct {
+	*net.UDPConn
+	rec *dnsRecorder
+}
+
+func (c *recordingUDPConn) Read(p []byte) (int, error) {
+	n, err := c.UDPConn.Read(p)
+	if n > 0 {
+		c.rec.add(p[:n])
+	}
+	return n, err
+}
+
+// recordingStreamConn reassembles length-prefixed DNS-over-TCP messages.
+type recordingStreamConn struct {
+	net.Conn
+	rec *dnsRecorder
+	buf []byte
+}
+
+func (c *recordingStreamConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.buf = append(c.buf, p[:n]...)
+	for len(c.buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+size {
+			break
+		}
+		c.rec.add(c.buf[2 : 2+size])
+		c.buf = c.buf[2+size:]
+	}
+	return n, err
+}
+
+// answerTTL returns the smallest TTL among the records of the given types
+// in the answer section of a DNS message.
+func answerTTL(msg []byte, types ...uint16) (ttl uint32, ok bool) {
+	if len(msg) < 12 {
+		return 0, false
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:6]))
+	anCount := int(binary.BigEndian.Uint16(msg[6:8]))
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		if off = skipDNSName(msg, off); off < 0 || off+4 > len(msg) {
+			return 0, false
+		}
+		off += 4 // type, class
+	}
+	for i := 0; i < anCount; i++ {
+		if off = skipDNSName(msg, off); off < 0 || off+10 > len(msg) {
+			return 0, false
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		rrTTL := binary.BigEndian.Uint32(msg[off+4:])
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10 + rdLen
+		if off > len(msg) {
+			return 0, false
+		}
+		if slices.Contains(types, typ) && (!ok || rrTTL < ttl) {
+			ttl, ok = rrTTL, true
+		}
+	}
+	return ttl, ok
+}
+
+// skipDNSName returns the offset just past the (possibly compressed) name
+// starting at off, or -1 if it is malformed.
+func skipDNSName(msg []byte, off int) int {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return -1
+			}
+			return off + 2
+		default:
+			off += 1 + l
+		}
+	}
+	return -1
+}
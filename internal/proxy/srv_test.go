@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+// buildSRVResponse returns a DNS response for _imaps._tcp.example.com with
+// one SRV answer per TTL, the first using a compression pointer for its name.
+func buildSRVResponse(ttls ...uint32) []byte {
+	msg := []byte{0, 1, 0x81, 0x80, 0, 1, 0, byte(len(ttls)), 0, 0, 0, 0}
+	for _, label := range []string{"_imaps", "_tcp", "example", "com"} {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 33, 0, 1)
+	for i, ttl := range ttls {
+		if i == 0 {
+			msg = append(msg, 0xC0, 12)
+		} else {
+			msg = append(msg, 5, 'x', 'x', 'x', 'x', 'x', 0)
+		}
+		rdata := []byte{0, 10, 0, 5, 0x03, 0xE1, 4, 'm', 'a', 'i', 'l', 0}
+		rr := make([]byte, 10)
+		binary.BigEndian.PutUint16(rr[0:], 33)
+		binary.BigEndian.PutUint16(rr[2:], 1)
+		binary.BigEndian.PutUint32(rr[4:], ttl)
+		binary.BigEndian.PutUint16(rr[8:], uint16(len(rdata)))
+		msg = append(msg, rr...)
+		msg = append(msg, rdata...)
+	}
+	return msg
+}
+
+func TestSRVAnswerTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    []byte
+		want   uint32
+		wantOK bool
+	}{
+		{"single", buildSRVResponse(300), 300, true},
+		{"minimum", buildSRVResponse(600, 120, 900), 120, true},
+		{"no answers", buildSRVResponse(), 0, false},
+		{"truncated", buildSRVResponse(300)[:40], 0, false},
+		{"short header", []byte{0, 1, 2}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := answerTTL(tt.msg, dnsTypeSRV)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("answerTTL = %d, %v; want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRecordingStreamConn(t *testing.T) {
+	msg := buildSRVResponse(42)
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	framed = append(framed, msg...)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		// Deliver the message in small pieces, as a TCP stream might.
+		for i := 0; i < len(framed); i += 7 {
+			server.Write(framed[i:min(i+7, len(framed))])
+		}
+		server.Close()
+	}()
+
+	rec := &dnsRecorder{}
+	conn := &recordingStreamConn{Conn: client, rec: rec}
+	buf := make([]byte, 5)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	if got := rec.minTTL(dnsTypeSRV); got != 42*time.Second {
+		t.Errorf("minTTL = %v, want 42s", got)
+	}
+}
+
+func TestSRVCache(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	calls := 0
+	var fail bool
+	c := newSRVCache(func(_ context.Context, service, proto, name string) ([]*net.SRV, time.Duration, error) {
+		calls++
+		if fail {
+			return nil, 0, errors.New("dns down")
+		}
+		if service != "imaps" || proto != "tcp" || name != "example.com" {
+			t.Errorf("lookup(%q, %q, %q)", service, proto, name)
+		}
+		return []*net.SRV{
+			{Target: fmt.Sprintf("mail%d.example.com.", calls), Port: 993},
+			{Target: "backup.example.com.", Port: 993},
+		}, 2 * time.Minute, nil
+	})
+	c.now = func() time.Time { return now }
+
+	resolve := func(wantHost string, wantCalls int) {
+		t.Helper()
+		host, port, err := c.resolve("imaps", "example.com")
+		if err != nil {
+			t.Fatalf("resolve: %v", err)
+		}
+		if host != wantHost || port != 993 {
+			t.Errorf("resolve = %s:%d, want %s:993", host, port, wantHost)
+		}
+		if calls != wantCalls {
+			t.Errorf("lookups = %d, want %d", calls, wantCalls)
+		}
+	}
+
+	resolve("mail1.example.com", 1)
+	now = now.Add(time.Minute)
+	resolve("mail1.example.com", 1) // cached within the TTL
+	now = now.Add(2 * time.Minute)
+	resolve("mail2.example.com", 2) // expired, looked up again
+
+	// A failed refresh keeps serving the expired entry.
+	fail = true
+	now = now.Add(time.Hour)
+	resolve("mail2.example.com", 3)
+
+	// Without a cached entry the failure is returned.
+	if _, _, err := c.resolve("imaps", "other.example"); err == nil {
+		t.Error("resolve(other.example) succeeded, want error")
+	}
+}
+
+func TestSRVCacheTTLBounds(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	var ttl time.Duration
+	calls := 0
+	c := newSRVCache(func(context.Context, string, string, string) ([]*net.SRV, time.Duration, error) {
+		calls++
+		return []*net.SRV{{Target: "mail.example.com.", Port: 143}}, ttl, nil
+	})
+	c.now = func() time.Time { return now }
+
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		valid time.Duration
+	}{
+		{"zero ttl uses minimum", 1 * time.Second, dnsMinTTL},
+		{"unknown ttl uses default", 0, dnsDefaultTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl = tt.ttl
+			c.entries = make(map[string]srvEntry)
+			calls = 0
+			c.resolve("imap", "example.com")
+			now = now.Add(tt.valid - time.Second)
+			c.resolve("imap", "example.com")
+			if calls != 1 {
+				t.Errorf("lookups before expiry = %d, want 1", calls)
+			}
+			now = now.Add(2 * time.Second)
+			c.resolve("imap", "example.com")
+			if calls != 2 {
+				t.Errorf("lookups after expiry = %d, want 2", calls)
+			}
+		})
+	}
+}
+
+func TestSRVCacheServiceNotOffered(t *testing.T) {
+	c := newSRVCache(func(context.Context, string, string, string) ([]*net.SRV, time.Duration, error) {
+		return []*net.SRV{{Target: ".", Port: 0}}, time.Hour, nil
+	})
+	if _, _, err := c.resolve("imaps", "example.com"); err == nil {
+		t.Error("resolve with target \".\" succeeded, want error")
+	}
+}
+
+func TestSRVService(t *testing.T) {
+	if got := srvService(&config.AccountConfig{RemoteTLS: true}); got != "imaps" {
+		t.Errorf("srvService(remote_tls) = %q, want imaps", got)
+	}
+	if got := srvService(&config.AccountConfig{RemoteStartTLS: true}); got != "imap" {
+		t.Errorf("srvService(remote_starttls) = %q, want imap", got)
+	}
+}
+
+func TestDialUpstreamSRV(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "* OK ready\r\n")
+		conn.Close()
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	orig := upstreamSRV
+	t.Cleanup(func() { upstreamSRV = orig })
+	upstreamSRV = newSRVCache(func(_ context.Context, service, _, name string) ([]*net.SRV, time.Duration, error) {
+		if service != "imap" || name != "mail.test" {
+			return nil, 0, fmt.Errorf("unexpected lookup %s %s", service, name)
+		}
+		return []*net.SRV{{Target: "127.0.0.1.", Port: uint16(port)}}, time.Minute, nil
+	})
+
+	conn, _, err := dialUpstream(&config.AccountConfig{RemoteSRVDomain: "mail.test"}, nil, "")
+	if err != nil {
+		t.Fatalf("dialUpstream: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var strictRejectionsTotal = metrics.Default.NewCounter("imap_proxy_strict_rejections_total",
+	"Client commands rejected by strict protocol mode.", "reason")
+
+// strict reports whether commands are validated against the RFC 3501
+// grammar: for every session with server.strict_protocol, and after LOGIN
+// for accounts with strict_protocol.
+func (s *Session) strict() bool {
+	return s.config.Server.StrictProtocol || (s.account != nil && s.account.StrictProtocol)
+}
+
+// rejectInvalid answers BAD in strict mode if cmd violates the command
+// grammar, discarding its non-synchronizing literals. It reports whether
+// cmd was rejected; err is set if the client connection failed.
+func (s *Session) rejectInvalid(cmd imap.Command, line string) (rejected bool, err error) {
+	if !s.strict() {
+		return false, nil
+	}
+	state := imap.NotAuthenticated
+	if s.state != StateNotAuth {
+		// The proxy does not see whether a SELECT succeeded, so any
+		// forwarded SELECT or EXAMINE counts.
+		state = imap.Authenticated
+		if s.selectedFolder != "" {
+			state = imap.Selected
+		}
+	}
+	var pe *imap.ProtocolError
+	if !errors.As(imap.Validate(cmd, state), &pe) {
+		return false, nil
+	}
+	strictRejectionsTotal.Inc(pe.Reason)
+	s.logger.Info("command rejected by strict protocol mode", "verb", commandVerb(cmd), "reason", pe.Reason, "err", pe.Msg)
+	tag := cmd.Tag
+	if pe.Reason == imap.ReasonTag {
+		tag = "*"
+	}
+	fmt.Fprintf(s.clientConn, "%s BAD %s\r\n", tag, pe.Msg)
+	return true, s.discardLiterals(line)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imaptest"
+)
+
+// strictExchange runs a session against an imaptest upstream, sends each
+// command and returns the last response line to each.
+func strictExchange(t *testing.T, cfg *config.Config, cmds ...string) []string {
+	t.Helper()
+	up := imaptest.NewServer()
+	t.Cleanup(up.Close)
+	cfg.Accounts[0].RemoteUser, cfg.Accounts[0].RemotePassword = imaptest.User, imaptest.Password
+	clientConn, proxyConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	sess := NewSession(proxyConn, cfg, testLogger())
+	sess.dialUpstream = up.Dial
+	go sess.Run()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(clientConn)
+	readLine(r) // greeting
+
+	var got []string
+	for _, cmd := range cmds {
+		fmt.Fprintf(clientConn, "%s\r\n", cmd)
+		tag, _, _ := strings.Cut(cmd, " ")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+			if strings.HasPrefix(line, tag+" ") || strings.HasPrefix(line, "* BAD") {
+				got = append(got, strings.TrimRight(line, "\r\n"))
+				break
+			}
+		}
+	}
+	return got
+}
+
+func TestSessionStrictProtocol(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.StrictProtocol = true
+	got := strictExchange(t, cfg,
+		"a1 SELECT INBOX",
+		"a+2 NOOP",
+		"a3 LOGIN reader1",
+		"a4 LOGIN reader1 localpass1",
+		"a5 FETCH 1 FLAGS",
+		"a6 EXAMINE INBOX",
+		"a7 FETCH 1:x FLAGS",
+		"a8 FETCH 1 (FLAGS",
+		"a9 FETCH 1 FLAGS",
+	)
+	want := []string{
+		"a1 BAD SELECT requires authentication",
+		"* BAD invalid tag",
+		"a3 BAD LOGIN expects 2 arguments, got 1",
+		"a4 OK",
+		"a5 BAD FETCH requires a selected mailbox",
+		"a6 OK",
+		`a7 BAD FETCH: invalid sequence set "1:x"`,
+		"a8 BAD FETCH: unbalanced parentheses",
+		"a9 OK",
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("response %d = %q, want %q", i+1, got[i], want[i])
+		}
+	}
+}
+
+func TestSessionStrictProtocolAccount(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].StrictProtocol = true
+	got := strictExchange(t, cfg,
+		"a1 SELECT INBOX",
+		"a2 LOGIN reader1 localpass1",
+		"a3 EXAMINE INBOX extra args",
+	)
+	want := []string{
+		"a1 BAD command not recognized", // not strict before LOGIN
+		"a2 OK",
+		"a3 BAD EXAMINE expects 1 to 2 arguments, got 3",
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("response %d = %q, want %q", i+1, got[i], want[i])
+		}
+	}
+}
+
+func TestSessionStrictProtocolOff(t *testing.T) {
+	got := strictExchange(t, testConfig(), "a1 LOGIN reader1 localpass1", "a2 FETCH 1 FLAGS")
+	if strings.Contains(got[1], "requires a selected mailbox") {
+		t.Errorf("FETCH without strict_protocol = %q, want it passed on", got[1])
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"imap-proxy/internal/audit"
+)
+
+// sessionStats accumulates the counts of the session_summary event. The
+// byte counts are updated by the client connection; the rest belongs to
+// the client→upstream goroutine.
+type sessionStats struct {
+	start    time.Time
+	bytesIn  atomic.Int64 // read from the client
+	bytesOut atomic.Int64 // written to the client
+
+	commands map[string]int // by verb
+	blocked  int            // refused by the read-only or folder filter
+}
+
+// command counts a command received from the client.
+func (st *sessionStats) command(verb string) {
+	if st.commands == nil {
+		st.commands = make(map[string]int)
+	}
+	st.commands[verb]++
+}
+
+// recordSessionSummary emits the session_summary audit event for a
+// session that logged in.
+func (s *Session) recordSessionSummary() {
+	if s.account == nil {
+		return
+	}
+	st := &s.stats
+	commands := make([]string, 0, len(st.commands))
+	total := 0
+	for _, verb := range slices.Sorted(maps.Keys(st.commands)) {
+		commands = append(commands, fmt.Sprintf("%s:%d", verb, st.commands[verb]))
+		total += st.commands[verb]
+	}
+	s.recordAudit(audit.Event{
+		Type: audit.SessionSummary, User: s.account.LocalUser,
+		Fields: map[string]string{
+			"duration_seconds": strconv.FormatFloat(time.Since(st.start).Seconds(), 'f', 3, 64),
+			"commands":         strings.Join(commands, ","),
+			"commands_total":   strconv.Itoa(total),
+			"blocked":          strconv.Itoa(st.blocked),
+			"bytes_in":         strconv.FormatInt(st.bytesIn.Load(), 10),
+			"bytes_out":        strconv.FormatInt(st.bytesOut.Load(), 10),
+			"folders":          strings.Join(s.usage.selectedFolders(), ","),
+		},
+	})
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/audit"
+)
+
+func TestSessionRecordsSummary(t *testing.T) {
+	events := make(chan audit.Event, 10)
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+		s.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) {
+			if ev.Type == audit.SessionSummary {
+				events <- ev
+			}
+		}))
+	})
+	env.login(t)
+	env.send(t, "A2 EXAMINE INBOX\r\n")
+	env.drainUpstream(t)
+	env.readUntilTagged(t, "A2")
+	env.send(t, "A3 DELETE INBOX\r\n")
+	env.readUntilTagged(t, "A3")
+	env.send(t, "A4 LOGOUT\r\n")
+	env.readUntilTagged(t, "A4")
+	env.clientConn.Close()
+
+	var ev audit.Event
+	select {
+	case ev = <-events:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no session_summary event recorded at session end")
+	}
+	if ev.User != "reader1" {
+		t.Errorf("user = %q, want reader1", ev.User)
+	}
+	want := map[string]string{
+		"commands":       "DELETE:1,EXAMINE:1,LOGIN:1,LOGOUT:1",
+		"commands_total": "4",
+		"blocked":        "1",
+		"folders":        "INBOX",
+	}
+	for k, v := range want {
+		if ev.Fields[k] != v {
+			t.Errorf("%s = %q, want %q", k, ev.Fields[k], v)
+		}
+	}
+	for _, k := range []string{"bytes_in", "bytes_out", "duration_seconds"} {
+		if _, err := strconv.ParseFloat(ev.Fields[k], 64); err != nil {
+			t.Errorf("%s = %q, want a number", k, ev.Fields[k])
+		}
+	}
+	if ev.Fields["bytes_in"] == "0" || ev.Fields["bytes_out"] == "0" {
+		t.Errorf("bytes_in = %s, bytes_out = %s, want traffic counted", ev.Fields["bytes_in"], ev.Fields["bytes_out"])
+	}
+}
+
+func TestSessionSummaryRequiresLogin(t *testing.T) {
+	var events []audit.Event
+	s := &Session{shared: newShared()}
+	s.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) { events = append(events, ev) }))
+	s.stats.command("CAPABILITY")
+	s.recordSessionSummary()
+	if len(events) != 0 {
+		t.Errorf("recorded %v for a session that never logged in", events)
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+// internalTagPrefix starts the tag of every command the proxy sends to the
+// upstream on its own behalf. After login, client commands whose tag
+// starts with it are refused, so a response to an internal command is never
+// taken for the response to a client's command, or the other way round.
+// Before login nothing the client sends reaches the upstream.
+const internalTagPrefix = "proxy"
+
+// loginTag tags the commands of the upstream login: STARTTLS, CLIENTID,
+// LOGIN or AUTHENTICATE, and the CAPABILITY probe.
+const loginTag = internalTagPrefix + "0"
+
+var reservedTagRejectionsTotal = metrics.Default.NewCounter("imap_proxy_reserved_tag_rejections_total",
+	"Client commands refused because their tag is reserved for the proxy's own commands.")
+
+// internalTag returns the tag of the n-th internal command of a kind, a
+// lower-case letter that keeps the kinds apart, such as "k" for keepalives.
+func internalTag(kind string, n int) string {
+	return fmt.Sprintf("%s%s%d", internalTagPrefix, kind, n)
+}
+
+// isInternalTag reports whether tag is in the proxy's namespace. Upstreams
+// may compare tags without regard to case, so neither does this.
+func isInternalTag(tag string) bool {
+	return len(tag) >= len(internalTagPrefix) && strings.EqualFold(tag[:len(internalTagPrefix)], internalTagPrefix)
+}
+
+// rejectReservedTag answers BAD if cmd uses a tag reserved for the proxy,
+// discarding its non-synchronizing literals. It reports whether cmd was
+// rejected; err is set if the client connection failed.
+func (s *Session) rejectReservedTag(cmd imap.Command, line string) (rejected bool, err error) {
+	if !isInternalTag(cmd.Tag) {
+		return false, nil
+	}
+	reservedTagRejectionsTotal.Inc()
+	s.logger.Info("command with a reserved tag rejected", "verb", commandVerb(cmd), "tag", cmd.Tag)
+	fmt.Fprintf(s.clientConn, "%s BAD tags starting with %q are reserved by the proxy\r\n", cmd.Tag, internalTagPrefix)
+	return true, s.discardLiterals(line)
+}
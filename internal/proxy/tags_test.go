@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsInternalTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want bool
+	}{
+		{"proxy0", true},
+		{internalTag("k", 12), true},
+		{"PROXYv1", true},
+		{"proxy", true},
+		{"prox", false},
+		{"A1", false},
+		{"xproxy1", false},
+	}
+	for _, tt := range tests {
+		if got := isInternalTag(tt.tag); got != tt.want {
+			t.Errorf("isInternalTag(%q) = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+	if got := internalTag("v", 3); got != "proxyv3" {
+		t.Errorf("internalTag = %q, want proxyv3", got)
+	}
+}
+
+func TestReservedTagRejected(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	before := reservedTagRejectionsTotal.Value()
+	for _, tag := range []string{"proxyk1", "PROXY0"} {
+		env.send(t, tag+" NOOP\r\n")
+		if line := env.readLine(t); !strings.HasPrefix(line, tag+" BAD ") {
+			t.Fatalf("response = %q, want BAD", line)
+		}
+	}
+	env.noUpstream(t)
+	if got := reservedTagRejectionsTotal.Value() - before; got != 2 {
+		t.Errorf("rejections = %v, want 2", got)
+	}
+
+	// A non-synchronizing literal of a refused command is not taken for a
+	// command.
+	env.send(t, "proxyv1 APPEND INBOX {6+}\r\nA9 X\r\n\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "proxyv1 BAD ") {
+		t.Fatalf("response = %q, want BAD", line)
+	}
+	env.send(t, "A002 NOOP\r\n")
+	env.expectUpstream(t, "A002 NOOP")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("response = %q, want OK", line)
+	}
+}
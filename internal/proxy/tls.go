@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/transcript"
+)
+
+// clientHandshakeTimeout bounds the TLS handshake with a client.
+const clientHandshakeTimeout = 30 * time.Second
+
+// ServerTLSConfig loads the certificate configured for client connections.
+// It returns nil when tls_cert_file is not set.
+func ServerTLSConfig(sc config.ServerConfig) (*tls.Config, error) {
+	if sc.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(sc.TLSCertFile, sc.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// SetTLSConfig enables STARTTLS on the plaintext listener and is required
+// for the implicit TLS listener. It must be called before Serve.
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// handleStartTLS upgrades the client connection to TLS. It reports whether
+// the session can continue.
+func (s *Session) handleStartTLS(cmd imap.Command) bool {
+	if s.tlsConfig == nil || s.tlsActive {
+		fmt.Fprintf(s.clientConn, "%s BAD STARTTLS not available\r\n", cmd.Tag)
+		return true
+	}
+	// Anything pipelined after STARTTLS was sent in the clear and must not
+	// be interpreted as if it arrived over TLS.
+	if s.clientR.Buffered() > 0 {
+		s.logger.Warn("closing connection: data pipelined after STARTTLS")
+		fmt.Fprintf(s.clientConn, "%s BAD unexpected data after STARTTLS\r\n", cmd.Tag)
+		return false
+	}
+	fmt.Fprintf(s.clientConn, "%s OK begin TLS negotiation now\r\n", cmd.Tag)
+	return s.upgradeTLS()
+}
+
+// upgradeTLS runs the TLS handshake on the client connection and switches
+// the session to it. It reports whether the handshake succeeded.
+func (s *Session) upgradeTLS() bool {
+	// A transcript records the plaintext, so TLS goes beneath the recorder.
+	conn := s.clientConn
+	rec, recording := conn.(*transcript.Conn)
+	if recording {
+		conn = rec.Conn
+	}
+	tlsConn := tls.Server(conn, s.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(clientHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		s.logger.Info("client TLS handshake failed", "err", err)
+		return false
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	if recording {
+		rec.Conn = tlsConn
+	} else {
+		s.clientConn = tlsConn
+	}
+	s.mu.Unlock()
+	s.clientR = bufio.NewReader(s.clientConn)
+	s.tlsActive = true
+	return true
+}
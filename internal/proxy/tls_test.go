@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+// startTLSServer runs a Server with a test certificate and returns the
+// addresses of its plaintext and implicit TLS listeners.
+func startTLSServer(t *testing.T) (plainAddr, tlsAddr string, clientTLS *tls.Config) {
+	t.Helper()
+	serverTLS, clientTLS := generateTestTLSConfigs(t)
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := NewServer(&config.Config{}, slog.New(slog.DiscardHandler))
+	srv.SetTLSConfig(serverTLS)
+	go srv.Serve(pl)
+	go srv.ServeTLS(tl)
+	t.Cleanup(func() { srv.Close() })
+	return pl.Addr().String(), tl.Addr().String(), clientTLS
+}
+
+func readLineConn(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return line
+}
+
+func TestStartTLS(t *testing.T) {
+	plainAddr, _, clientTLS := startTLSServer(t)
+	conn, err := net.DialTimeout("tcp", plainAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	readLineConn(t, r) // greeting
+
+	conn.Write([]byte("A1 CAPABILITY\r\n"))
+	if caps := readLineConn(t, r); !strings.Contains(caps, " STARTTLS") {
+		t.Fatalf("plaintext CAPABILITY %q does not offer STARTTLS", caps)
+	}
+	readLineConn(t, r)
+
+	conn.Write([]byte("A2 STARTTLS\r\n"))
+	if line := readLineConn(t, r); !strings.HasPrefix(line, "A2 OK") {
+		t.Fatalf("STARTTLS response %q", line)
+	}
+	tc := tls.Client(conn, clientTLS)
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tr := bufio.NewReader(tc)
+	tc.Write([]byte("A3 CAPABILITY\r\n"))
+	if caps := readLineConn(t, tr); strings.Contains(caps, "STARTTLS") {
+		t.Fatalf("CAPABILITY after STARTTLS still offers it: %q", caps)
+	}
+	readLineConn(t, tr)
+
+	tc.Write([]byte("A4 STARTTLS\r\n"))
+	if line := readLineConn(t, tr); !strings.HasPrefix(line, "A4 BAD") {
+		t.Fatalf("second STARTTLS response %q, want BAD", line)
+	}
+}
+
+func TestStartTLSRejectsPipelinedData(t *testing.T) {
+	plainAddr, _, _ := startTLSServer(t)
+	conn, err := net.DialTimeout("tcp", plainAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	readLineConn(t, r) // greeting
+
+	conn.Write([]byte("A1 STARTTLS\r\nA2 LOGIN reader1 localpass1\r\n"))
+	if line := readLineConn(t, r); !strings.HasPrefix(line, "A1 BAD") {
+		t.Fatalf("STARTTLS with pipelined data got %q, want BAD", line)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Fatal("connection still open after pipelined STARTTLS")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	_, tlsAddr, clientTLS := startTLSServer(t)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", tlsAddr, clientTLS)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if line := readLineConn(t, r); !strings.HasPrefix(line, "* OK imap-proxy ready") {
+		t.Fatalf("greeting %q", line)
+	}
+	conn.Write([]byte("A1 CAPABILITY\r\n"))
+	if caps := readLineConn(t, r); strings.Contains(caps, "STARTTLS") {
+		t.Fatalf("implicit TLS CAPABILITY offers STARTTLS: %q", caps)
+	}
+}
+
+func TestStartTLSUnavailable(t *testing.T) {
+	env := newIntegrationEnv(t)
+	defer env.clientConn.Close()
+	env.readLine(t) // greeting
+
+	env.send(t, "A1 CAPABILITY\r\n")
+	if caps := env.readLine(t); strings.Contains(caps, "STARTTLS") {
+		t.Fatalf("CAPABILITY without certificate offers STARTTLS: %q", caps)
+	}
+	env.readLine(t)
+	env.send(t, "A2 STARTTLS\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A2 BAD") {
+		t.Fatalf("STARTTLS response %q, want BAD", line)
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		tlsActive bool
+		pass      string
+		want      string
+	}{
+		{name: "plaintext", tlsActive: false, pass: "localpass1", want: "A001 NO [PRIVACYREQUIRED]"},
+		// The password is not checked over plaintext, so a wrong one gets
+		// the same refusal.
+		{name: "plaintext wrong password", tlsActive: false, pass: "wrong", want: "A001 NO [PRIVACYREQUIRED]"},
+		{name: "tls", tlsActive: true, pass: "localpass1", want: "A001 OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Accounts[0].RequireTLS = true
+			env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) { s.tlsActive = tt.tlsActive })
+			defer env.clientConn.Close()
+			env.readLine(t) // greeting
+
+			env.send(t, "A001 LOGIN reader1 "+tt.pass+"\r\n")
+			if tt.tlsActive {
+				env.drainUpstream(t)
+			} else {
+				defer env.noUpstream(t)
+			}
+			if line := env.readLine(t); !strings.HasPrefix(line, tt.want) {
+				t.Fatalf("LOGIN response %q, want prefix %q", line, tt.want)
+			}
+		})
+	}
+}
+
+// With LOGINDISABLED advertised, every plaintext LOGIN gets the same
+// refusal, so it does not reveal which users exist.
+func TestLoginDisabledRefusesUnknownUsers(t *testing.T) {
+	cfg := testConfig()
+	for i := range cfg.Accounts {
+		cfg.Accounts[i].RequireTLS = true
+	}
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	defer env.noUpstream(t)
+	env.readLine(t) // greeting
+
+	env.send(t, "A001 LOGIN nobody secret\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A001 NO [PRIVACYREQUIRED]") {
+		t.Fatalf("LOGIN response %q, want PRIVACYREQUIRED", line)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+)
+
+// unauthenticate returns the session to the not-authenticated state after
+// an RFC 8437 UNAUTHENTICATE, once runPostAuth has logged out of the
+// upstream. Everything tied to the account is dropped, so the client can
+// LOGIN again, possibly as another account. The connection is not counted
+// against max_unauthenticated again.
+func (s *Session) unauthenticate() {
+	s.logger.Info("client unauthenticated")
+	if s.releaseSlot != nil {
+		s.releaseSlot()
+		s.releaseSlot = nil
+	}
+	if s.coalesce != nil {
+		s.coalesce.take()
+		s.coalesce = nil
+	}
+
+	s.mu.Lock()
+	s.logger = s.connLogger
+	s.mu.Unlock()
+	s.trace.user.Store(nil)
+	s.state = StateNotAuth
+	s.account = nil
+	s.upstream = ""
+	s.pinnedIP = ""
+	s.selectedFolder = ""
+	s.mailbox = mailboxState{}
+	s.keepalive = keepalive{mem: &s.memory}
+	s.memory.used.Store(0)
+	s.view.Store(nil)
+	s.internal.Store(nil)
+	s.idle.Store(nil)
+	s.loggingOut.Store(false)
+	s.readOnlySelect.Store(nil)
+	s.opening.Store(nil)
+	s.openFolder = ""
+	s.alerted = nil
+	s.appended = nil
+	s.commandLog = commandLog{}
+	s.usage = usageTracker{}
+	s.script = nil
+
+	s.stats.start = time.Now()
+	s.stats.bytesIn.Store(0)
+	s.stats.bytesOut.Store(0)
+	s.stats.commands = nil
+	s.stats.blocked = 0
+}
+
+// withUnauthenticate advertises UNAUTHENTICATE, which the proxy handles
+// itself, in an untagged CAPABILITY response relayed from the upstream.
+// Other lines are returned unchanged.
+func withUnauthenticate(line string) string {
+	const prefix = "* CAPABILITY "
+	if len(line) <= len(prefix) || !strings.EqualFold(line[:len(prefix)], prefix) {
+		return line
+	}
+	return strings.TrimRight(line, "\r\n") + " UNAUTHENTICATE\r\n"
+}
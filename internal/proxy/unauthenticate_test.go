@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imaptest"
+)
+
+func TestUnauthenticateSwitchesAccount(t *testing.T) {
+	cfg := testConfig()
+	cfg.Accounts[0].RemoteUser, cfg.Accounts[0].RemotePassword = imaptest.User, imaptest.Password
+	second := cfg.Accounts[0]
+	second.LocalUser, second.LocalPassword = "reader2", "localpass2"
+	cfg.Accounts = append(cfg.Accounts, second)
+
+	ups := map[string]*imaptest.Server{"reader1": imaptest.NewServer(), "reader2": imaptest.NewServer()}
+	for _, up := range ups {
+		t.Cleanup(up.Close)
+	}
+	var dialed []string
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			dialed = append(dialed, acct.LocalUser)
+			return ups[acct.LocalUser].Dial(acct)
+		}
+	})
+	defer env.clientConn.Close()
+	env.readLine(t) // greeting
+	env.send(t, "A001 LOGIN reader1 localpass1\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A001 OK") {
+		t.Fatalf("LOGIN = %q", line)
+	}
+
+	env.send(t, "A002 EXAMINE INBOX\r\n")
+	env.readUntilTagged(t, "A002")
+
+	env.send(t, "A003 UNAUTHENTICATE\r\n")
+	if line := env.readLine(t); line != "A003 OK UNAUTHENTICATE completed\r\n" {
+		t.Fatalf("UNAUTHENTICATE response = %q", line)
+	}
+
+	// Back in the not-authenticated state.
+	env.send(t, "A004 EXAMINE INBOX\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A004 BAD") {
+		t.Fatalf("EXAMINE before LOGIN = %q, want BAD", line)
+	}
+	env.send(t, "A005 LOGIN reader2 localpass2\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A005 OK") {
+		t.Fatalf("second LOGIN = %q", line)
+	}
+	env.send(t, "A006 NOOP\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A006 OK") {
+		t.Fatalf("NOOP after switching accounts = %q", line)
+	}
+	if strings.Join(dialed, ",") != "reader1,reader2" {
+		t.Errorf("upstreams dialed for %v, want reader1 then reader2", dialed)
+	}
+	if got := ups["reader2"].Received(); !slices.Contains(got, "NOOP") || slices.Contains(got, "EXAMINE INBOX") {
+		t.Errorf("second upstream received %q, want the NOOP only after LOGIN", got)
+	}
+	// The first upstream is logged out; it may read LOGOUT a little after
+	// the proxy has moved on.
+	for deadline := time.Now().Add(5 * time.Second); !slices.Contains(ups["reader1"].Received(), "LOGOUT"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("first upstream received %q, want LOGOUT", ups["reader1"].Received())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWithUnauthenticate(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"* CAPABILITY IMAP4rev1 IDLE\r\n", "* CAPABILITY IMAP4rev1 IDLE UNAUTHENTICATE\r\n"},
+		{"* capability IMAP4rev1\r\n", "* capability IMAP4rev1 UNAUTHENTICATE\r\n"},
+		{"A1 OK [CAPABILITY IMAP4rev1] done\r\n", "A1 OK [CAPABILITY IMAP4rev1] done\r\n"},
+		{"* 1 EXISTS\r\n", "* 1 EXISTS\r\n"},
+	}
+	for _, tt := range tests {
+		if got := withUnauthenticate(tt.line); got != tt.want {
+			t.Errorf("withUnauthenticate(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -2,87 +2,238 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"syscall"
+	"time"
 
 	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/localstore"
+	"imap-proxy/internal/netproxy"
 )
 
 // DialUpstream connects to the upstream IMAP server described by acct.
 // It reads and validates the server greeting, then returns the connection
 // and a buffered reader positioned after the greeting.
 func DialUpstream(acct *config.AccountConfig) (net.Conn, *bufio.Reader, error) {
-	return dialUpstream(acct, nil)
+	return dialUpstream(acct, nil, "")
 }
 
-// dialUpstream is the internal implementation; tlsCfg overrides the TLS config when non-nil.
-func dialUpstream(acct *config.AccountConfig, tlsCfg *tls.Config) (net.Conn, *bufio.Reader, error) {
-	addr := net.JoinHostPort(acct.RemoteHost, fmt.Sprintf("%d", acct.RemotePort))
+const (
+	// defaultDialTimeout bounds the TCP connect (including any proxy
+	// handshake) when dial_timeout is unset.
+	defaultDialTimeout = 10 * time.Second
+	// defaultHandshakeTimeout bounds TLS, STARTTLS, the greeting and the
+	// upstream LOGIN when handshake_timeout is unset.
+	defaultHandshakeTimeout = 10 * time.Second
+	// defaultDialBackoff is the delay before the first retry when
+	// dial_backoff is unset; it doubles with each further attempt.
+	defaultDialBackoff = time.Second
+)
+
+// dialSleep waits between attempts; tests replace it.
+var dialSleep = time.Sleep
+
+// refusedError reports an upstream that answered but refused the
+// connection. Retrying it is pointless.
+type refusedError struct{ msg string }
+
+func (e *refusedError) Error() string { return e.msg }
+
+// dialUpstream is the internal implementation; tlsCfg overrides the TLS config when non-nil,
+// and a non-empty pinnedIP is connected to instead of the resolved addresses.
+// It makes up to acct.DialAttempts attempts, backing off between them, and
+// returns the last error.
+func dialUpstream(acct *config.AccountConfig, tlsCfg *tls.Config, pinnedIP string) (net.Conn, *bufio.Reader, error) {
+	return dialUpstreamWrapped(acct, tlsCfg, pinnedIP, nil)
+}
+
+// dialUpstreamWrapped is dialUpstream with wrap, if set, applied to each
+// connection once it carries plaintext IMAP, before the greeting is read.
+func dialUpstreamWrapped(acct *config.AccountConfig, tlsCfg *tls.Config, pinnedIP string, wrap func(net.Conn) net.Conn) (net.Conn, *bufio.Reader, error) {
+	attempts := max(acct.DialAttempts, 1)
+	backoff := acct.DialBackoff
+	if backoff <= 0 {
+		backoff = defaultDialBackoff
+	}
+	for i := 1; ; i++ {
+		conn, r, err := dialUpstreamOnce(acct, tlsCfg, pinnedIP, wrap)
+		if err == nil || i >= attempts || !retryableDialError(err) {
+			if err != nil && i > 1 {
+				err = fmt.Errorf("after %d attempts: %w", i, err)
+			}
+			return conn, r, err
+		}
+		dialSleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryableDialError reports whether a failed dial may succeed on retry.
+// Certificate problems and explicit refusals will not fix themselves.
+func retryableDialError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var refused *refusedError
+	return !errors.As(err, &certErr) && !errors.As(err, &refused)
+}
+
+// dialFailureReason summarizes a dial error for the client without
+// revealing upstream addresses.
+func dialFailureReason(err error) string {
+	var certErr *tls.CertificateVerificationError
+	var refused *refusedError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &certErr):
+		return "upstream certificate not trusted"
+	case errors.As(err, &refused):
+		return "upstream refused the connection"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "upstream timed out"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "upstream connection refused"
+	default:
+		return "upstream unreachable"
+	}
+}
 
-	makeTLSConfig := func() *tls.Config {
-		if tlsCfg != nil {
-			return tlsCfg
+// dialUpstreamOnce makes a single connection attempt.
+func dialUpstreamOnce(acct *config.AccountConfig, tlsCfg *tls.Config, pinnedIP string, wrap func(net.Conn) net.Conn) (net.Conn, *bufio.Reader, error) {
+	host, port, serverName := acct.RemoteHost, acct.RemotePort, acct.RemoteHost
+	if acct.RemoteSRVDomain != "" {
+		var err error
+		host, port, err = upstreamSRV.resolve(srvService(acct), acct.RemoteSRVDomain)
+		if err != nil {
+			return nil, nil, err
+		}
+		// RFC 6186: without DNSSEC the SRV answer is untrusted, so the
+		// certificate must match the domain that was looked up.
+		serverName = acct.RemoteSRVDomain
+	}
+	addr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+
+	// Direct connections try the cached (or pinned) addresses in turn. An
+	// upstream_proxy resolves the name itself.
+	targets := []string{addr}
+	if acct.UpstreamProxy == "" && acct.UpstreamPath == "" {
+		ips := []string{pinnedIP}
+		if pinnedIP == "" {
+			var err error
+			if ips, err = upstreamHosts.resolve(host); err != nil {
+				return nil, nil, err
+			}
+		}
+		targets = targets[:0]
+		for _, ip := range ips {
+			targets = append(targets, net.JoinHostPort(ip, fmt.Sprintf("%d", port)))
+		}
+	}
+
+	if tlsCfg == nil && acct.UpstreamTLS() {
+		var err error
+		if tlsCfg, err = upstreamTLSConfig(acct, serverName); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	dialTimeout := acct.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	// dialTCP applies the socket options to the direct connection, which
+	// is the one to the proxy when upstream_proxy is set.
+	var nd net.Dialer
+	dialTCP := func(ctx context.Context, network, address string) (net.Conn, error) {
+		c, err := nd.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := tuneConn(c, acct.UpstreamSocket); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("socket options: %w", err)
+		}
+		return c, nil
+	}
+	dialContext := dialTCP
+	if acct.UpstreamProxy != "" {
+		d, err := netproxy.New(acct.UpstreamProxy)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.Forward = dialTCP
+		dialContext = d.DialContext
+	}
+	// dial connects and arms the handshake deadline, which covers
+	// everything up to and including the greeting.
+	dial := func() (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		var c net.Conn
+		var err error
+		for _, target := range targets {
+			if c, err = dialContext(ctx, "tcp", target); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, err
 		}
-		return &tls.Config{ServerName: acct.RemoteHost}
+		c.SetDeadline(time.Now().Add(handshakeTimeout(acct)))
+		return c, nil
 	}
 
 	var conn net.Conn
 	var r *bufio.Reader
 
 	switch {
+	case acct.UpstreamPath != "":
+		// The local store runs in-process on the other end of a pipe, so
+		// everything above it treats it like any other upstream.
+		c, server := net.Pipe()
+		go localstore.Serve(server, acct.UpstreamPath)
+		c.SetDeadline(time.Now().Add(handshakeTimeout(acct)))
+		conn = c
+		r = bufio.NewReader(conn)
+
 	case acct.RemoteTLS:
-		c, err := tls.Dial("tcp", addr, makeTLSConfig())
+		plain, err := dial()
 		if err != nil {
+			return nil, nil, fmt.Errorf("dial %s: %w", addr, err)
+		}
+		c := tls.Client(plain, tlsCfg)
+		if err := c.Handshake(); err != nil {
+			c.Close()
 			return nil, nil, fmt.Errorf("tls dial %s: %w", addr, err)
 		}
+		countTLSHandshake(c)
 		conn = c
 		r = bufio.NewReader(conn)
 
 	case acct.RemoteStartTLS:
-		plain, err := net.Dial("tcp", addr)
+		plain, err := dial()
 		if err != nil {
 			return nil, nil, fmt.Errorf("dial %s: %w", addr, err)
 		}
-		pr := bufio.NewReader(plain)
-
-		// Read initial greeting before STARTTLS negotiation.
-		if _, err := pr.ReadString('\n'); err != nil {
-			plain.Close()
-			return nil, nil, fmt.Errorf("starttls: read greeting: %w", err)
-		}
-
-		// Request STARTTLS.
-		if _, err := fmt.Fprintf(plain, "proxy0 STARTTLS\r\n"); err != nil {
-			plain.Close()
-			return nil, nil, fmt.Errorf("starttls: send command: %w", err)
-		}
-
-		// Read server response.
-		resp, err := pr.ReadString('\n')
-		if err != nil {
-			plain.Close()
-			return nil, nil, fmt.Errorf("starttls: read response: %w", err)
-		}
-		if !strings.Contains(resp, " OK") {
+		if err := negotiateStartTLS(plain); err != nil {
 			plain.Close()
-			return nil, nil, fmt.Errorf("starttls: server rejected: %s", strings.TrimRight(resp, "\r\n"))
+			return nil, nil, err
 		}
-
-		// Upgrade to TLS. After this point, pr is discarded; the bufio.Reader
-		// buffer should be empty since the server does not send TLS data until
-		// the client initiates the handshake.
-		tlsConn := tls.Client(plain, makeTLSConfig())
+		tlsConn := tls.Client(plain, tlsCfg)
 		if err := tlsConn.Handshake(); err != nil {
 			tlsConn.Close()
 			return nil, nil, fmt.Errorf("starttls: tls handshake: %w", err)
 		}
+		countTLSHandshake(tlsConn)
 		conn = tlsConn
 		r = bufio.NewReader(conn)
 
 	default:
-		c, err := net.Dial("tcp", addr)
+		c, err := dial()
 		if err != nil {
 			return nil, nil, fmt.Errorf("dial %s: %w", addr, err)
 		}
@@ -90,6 +241,17 @@ func dialUpstream(acct *config.AccountConfig, tlsCfg *tls.Config) (net.Conn, *bu
 		r = bufio.NewReader(conn)
 	}
 
+	// A recording wrapper goes beneath chaos, so that it holds what the
+	// upstream really sent.
+	if wrap != nil {
+		conn = wrap(conn)
+		r = bufio.NewReader(conn)
+	}
+	if acct.Chaos.UpstreamEnabled() {
+		conn = newChaosConn(conn, acct.Chaos)
+		r = bufio.NewReader(conn)
+	}
+
 	// Read and validate the (post-TLS) greeting line.
 	greeting, err := r.ReadString('\n')
 	if err != nil {
@@ -98,40 +260,97 @@ func dialUpstream(acct *config.AccountConfig, tlsCfg *tls.Config) (net.Conn, *bu
 	}
 	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
 		conn.Close()
-		return nil, nil, fmt.Errorf("unexpected greeting: %s", strings.TrimRight(greeting, "\r\n"))
+		return nil, nil, &refusedError{"unexpected greeting: " + strings.TrimRight(greeting, "\r\n")}
+	}
+	if caps, ok := parseCapabilities(greeting); ok {
+		upstreamCaps.storeGreeting(upstreamKey(acct), caps)
 	}
 
+	conn.SetDeadline(time.Time{})
 	return conn, r, nil
 }
 
-// quoteIMAPString wraps s in double quotes, escaping backslashes and double quotes per RFC 3501.
-func quoteIMAPString(s string) string {
-	s = strings.ReplaceAll(s, `\`, `\\`)
-	s = strings.ReplaceAll(s, `"`, `\"`)
-	return `"` + s + `"`
+// handshakeTimeout returns acct's handshake timeout or the default.
+func handshakeTimeout(acct *config.AccountConfig) time.Duration {
+	if acct.HandshakeTimeout > 0 {
+		return acct.HandshakeTimeout
+	}
+	return defaultHandshakeTimeout
 }
 
-// LoginUpstream sends an IMAP LOGIN command to the upstream server using the
-// remote credentials from acct and waits for a tagged response.
+// LoginUpstream logs into the upstream server with the remote credentials
+// from acct and waits for a tagged response, for at most the account's
+// handshake timeout. It sends LOGIN unless the upstream advertises
+// LOGINDISABLED, in which case it authenticates with AUTHENTICATE. The
+// account's upstream_clientid, if set, is sent first.
 func LoginUpstream(conn net.Conn, reader *bufio.Reader, acct *config.AccountConfig) error {
-	cmd := fmt.Sprintf("proxy0 LOGIN %s %s\r\n",
-		quoteIMAPString(acct.RemoteUser),
-		quoteIMAPString(acct.RemotePassword),
+	conn.SetDeadline(time.Now().Add(handshakeTimeout(acct)))
+	defer conn.SetDeadline(time.Time{})
+
+	if acct.UpstreamClientID != "" {
+		// A refused CLIENTID does not keep the account from logging in.
+		err := upstreamCommand(conn, reader, acct, "clientid", loginTag+" CLIENTID "+acct.UpstreamClientID+"\r\n", nil)
+		var refused *refusedError
+		if err != nil && !errors.As(err, &refused) {
+			return err
+		}
+	}
+
+	key := upstreamKey(acct)
+	caps, known := upstreamCaps.greeting(key)
+	if known && caps.has("LOGINDISABLED") {
+		return authenticateUpstream(conn, reader, acct, caps)
+	}
+	cmd := fmt.Sprintf("%s LOGIN %s %s\r\n", loginTag,
+		imap.Quote(acct.RemoteUser),
+		imap.Quote(acct.RemotePassword),
 	)
+	err := upstreamCommand(conn, reader, acct, "login", cmd, nil)
+	var refused *refusedError
+	if known || !errors.As(err, &refused) {
+		return err
+	}
+	// The greeting did not list capabilities, so the refusal may come
+	// from a LOGINDISABLED the proxy could not see.
+	caps, capErr := queryCapabilities(conn, reader)
+	if capErr != nil || !caps.has("LOGINDISABLED") {
+		return err
+	}
+	upstreamCaps.storeGreeting(key, caps)
+	return authenticateUpstream(conn, reader, acct, caps)
+}
+
+// upstreamCommand sends cmd, answers continuation requests with responses
+// in turn (cancelling the command when they run out) and waits for the
+// tagged response. Errors are prefixed with op.
+func upstreamCommand(conn net.Conn, reader *bufio.Reader, acct *config.AccountConfig, op, cmd string, responses []string) error {
 	if _, err := fmt.Fprint(conn, cmd); err != nil {
-		return fmt.Errorf("login: send command: %w", err)
+		return fmt.Errorf("%s: send command: %w", op, err)
 	}
 
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			return fmt.Errorf("login: read response: %w", err)
+			return fmt.Errorf("%s: read response: %w", op, err)
+		}
+		if caps, ok := parseCapabilities(line); ok {
+			upstreamCaps.storeAuth(upstreamKey(acct), caps)
+		}
+		if strings.HasPrefix(line, "+") {
+			resp := "*"
+			if len(responses) > 0 {
+				resp, responses = responses[0], responses[1:]
+			}
+			if _, err := fmt.Fprintf(conn, "%s\r\n", resp); err != nil {
+				return fmt.Errorf("%s: send response: %w", op, err)
+			}
+			continue
 		}
-		if strings.HasPrefix(line, "proxy0 ") {
+		if strings.HasPrefix(line, loginTag+" ") {
 			if strings.Contains(line, " OK") {
 				return nil
 			}
-			return fmt.Errorf("login failed: %s", strings.TrimRight(line, "\r\n"))
+			return &refusedError{op + " failed: " + strings.TrimRight(line, "\r\n")}
 		}
 	}
 }
@@ -2,16 +2,24 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -79,7 +87,7 @@ func TestDialUpstreamTLS(t *testing.T) {
 		RemoteTLS:  true,
 	}
 
-	conn, r, err := dialUpstream(acct, clientTLS)
+	conn, r, err := dialUpstream(acct, clientTLS, "")
 	if err != nil {
 		t.Fatalf("dialUpstream: %v", err)
 	}
@@ -94,6 +102,92 @@ func TestDialUpstreamTLS(t *testing.T) {
 	}
 }
 
+// startConnectProxy runs an HTTP CONNECT proxy that forwards to any target
+// and reports each requested target on the returned channel.
+func startConnectProxy(t *testing.T) (addr string, targets <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ch := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				ch <- req.Host
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					fmt.Fprintf(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				fmt.Fprintf(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln.Addr().String(), ch
+}
+
+func TestDialUpstreamViaProxy(t *testing.T) {
+	serverTLS, clientTLS := generateTestTLSConfigs(t)
+	proxyAddr, targets := startConnectProxy(t)
+
+	tests := []struct {
+		name   string
+		listen func() (net.Listener, error)
+		tls    bool
+	}{
+		{"plain", func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") }, false},
+		{"tls", func() (net.Listener, error) { return tls.Listen("tcp", "127.0.0.1:0", serverTLS) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := tt.listen()
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				fmt.Fprintf(conn, "* OK ready\r\n")
+				bufio.NewReader(conn).ReadString('\n')
+			}()
+
+			port := ln.Addr().(*net.TCPAddr).Port
+			acct := &config.AccountConfig{
+				RemoteHost:    "127.0.0.1",
+				RemotePort:    port,
+				RemoteTLS:     tt.tls,
+				UpstreamProxy: "http://" + proxyAddr,
+			}
+			conn, _, err := dialUpstream(acct, clientTLS, "")
+			if err != nil {
+				t.Fatalf("dialUpstream: %v", err)
+			}
+			conn.Close()
+			if got, want := <-targets, fmt.Sprintf("127.0.0.1:%d", port); got != want {
+				t.Errorf("proxy target = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
 func TestDialUpstreamSTARTTLS(t *testing.T) {
 	serverTLS, clientTLS := generateTestTLSConfigs(t)
 
@@ -152,7 +246,7 @@ func TestDialUpstreamSTARTTLS(t *testing.T) {
 		RemoteStartTLS: true,
 	}
 
-	conn, r, err := dialUpstream(acct, clientTLS)
+	conn, r, err := dialUpstream(acct, clientTLS, "")
 	if err != nil {
 		t.Fatalf("dialUpstream: %v", err)
 	}
@@ -237,24 +331,254 @@ func TestLoginUpstream(t *testing.T) {
 	}
 }
 
-func TestLoginUpstreamQuoting(t *testing.T) {
+func TestLoginUpstreamClientID(t *testing.T) {
+	for _, resp := range []string{"proxy0 OK CLIENTID completed\r\n", "proxy0 BAD unknown command\r\n"} {
+		acct := &config.AccountConfig{RemoteUser: "user", RemotePassword: "pass", UpstreamClientID: "UDID 0123abcd"}
+		clientConn, serverConn := net.Pipe()
+		received := make(chan string, 2)
+		go func() {
+			defer serverConn.Close()
+			r := bufio.NewReader(serverConn)
+			line, _ := r.ReadString('\n')
+			received <- line
+			fmt.Fprint(serverConn, resp)
+			line, _ = r.ReadString('\n')
+			received <- line
+			fmt.Fprint(serverConn, "proxy0 OK LOGIN completed\r\n")
+		}()
+		if err := LoginUpstream(clientConn, bufio.NewReader(clientConn), acct); err != nil {
+			t.Errorf("CLIENTID answered %q: LoginUpstream: %v", resp, err)
+		}
+		clientConn.Close()
+		if line := <-received; line != "proxy0 CLIENTID UDID 0123abcd\r\n" {
+			t.Errorf("first command = %q, want CLIENTID", line)
+		}
+		if line := <-received; !strings.Contains(line, "LOGIN") {
+			t.Errorf("second command = %q, want LOGIN", line)
+		}
+	}
+}
+
+// failingListener accepts connections, closes the first fail of them
+// without a greeting, then greets the rest with greeting.
+func failingListener(t *testing.T, fail int, greeting string) (port int, accepted func() int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	n := 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			n++
+			closeNow := n <= fail
+			mu.Unlock()
+			if !closeNow {
+				fmt.Fprint(conn, greeting)
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+}
+
+func TestDialUpstreamRetry(t *testing.T) {
+	var sleeps []time.Duration
+	orig := dialSleep
+	t.Cleanup(func() { dialSleep = orig })
+	dialSleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
 	tests := []struct {
-		input string
-		want  string
+		name         string
+		fail         int
+		greeting     string
+		attempts     int
+		wantErr      string
+		wantAccepted int
+		wantSleeps   []time.Duration
 	}{
-		{`simple`, `"simple"`},
-		{`with"quote`, `"with\"quote"`},
-		{`multiple""quotes`, `"multiple\"\"quotes"`},
-		{``, `""`},
-		{`with\backslash`, `"with\\backslash"`},
-		{`back\and"quote`, `"back\\and\"quote"`},
-		{`trailing\`, `"trailing\\"`},
+		{name: "succeeds after retries", fail: 2, greeting: "* OK ready\r\n", attempts: 3, wantAccepted: 3,
+			wantSleeps: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}},
+		{name: "gives up", fail: 5, greeting: "* OK ready\r\n", attempts: 2, wantErr: "after 2 attempts", wantAccepted: 2,
+			wantSleeps: []time.Duration{100 * time.Millisecond}},
+		{name: "single attempt by default", fail: 1, greeting: "* OK ready\r\n", wantErr: "read greeting", wantAccepted: 1},
+		{name: "refusal is not retried", greeting: "* BYE go away\r\n", attempts: 3, wantErr: "unexpected greeting", wantAccepted: 1},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sleeps = nil
+			port, accepted := failingListener(t, tt.fail, tt.greeting)
+			acct := &config.AccountConfig{
+				RemoteHost:   "127.0.0.1",
+				RemotePort:   port,
+				DialAttempts: tt.attempts,
+				DialBackoff:  100 * time.Millisecond,
+			}
+			conn, _, err := dialUpstream(acct, nil, "")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("dialUpstream: %v", err)
+				}
+				conn.Close()
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("dialUpstream err = %v, want %q", err, tt.wantErr)
+			}
+			if got := accepted(); got != tt.wantAccepted {
+				t.Errorf("connections = %d, want %d", got, tt.wantAccepted)
+			}
+			if fmt.Sprint(sleeps) != fmt.Sprint(tt.wantSleeps) {
+				t.Errorf("backoffs = %v, want %v", sleeps, tt.wantSleeps)
+			}
+		})
+	}
+}
+
+func TestDialUpstreamHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accept but never send a greeting.
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	acct := &config.AccountConfig{
+		RemoteHost:       "127.0.0.1",
+		RemotePort:       ln.Addr().(*net.TCPAddr).Port,
+		HandshakeTimeout: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	_, _, err = dialUpstream(acct, nil, "")
+	if err == nil {
+		t.Fatal("dialUpstream succeeded, want timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dialUpstream took %v", elapsed)
+	}
+	if got := dialFailureReason(err); got != "upstream timed out" {
+		t.Errorf("dialFailureReason = %q, want upstream timed out", got)
+	}
+}
+
+func TestDialFailureReason(t *testing.T) {
+	// A port that was just freed is very likely to refuse connections.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+	_, refusedErr := net.Dial("tcp", closedAddr)
 
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"refused", fmt.Errorf("dial: %w", refusedErr), "upstream connection refused"},
+		{"timeout", fmt.Errorf("dial: %w", context.DeadlineExceeded), "upstream timed out"},
+		{"greeting", &refusedError{"unexpected greeting: * BYE"}, "upstream refused the connection"},
+		{"certificate", fmt.Errorf("tls: %w", &tls.CertificateVerificationError{}), "upstream certificate not trusted"},
+		{"other", errors.New("no such host"), "upstream unreachable"},
+	}
 	for _, tt := range tests {
-		got := quoteIMAPString(tt.input)
-		if got != tt.want {
-			t.Errorf("quoteIMAPString(%q) = %q, want %q", tt.input, got, tt.want)
+		if got := dialFailureReason(tt.err); got != tt.want {
+			t.Errorf("%s: dialFailureReason = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoginUpstreamTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server) // read LOGIN, never answer
+
+	acct := &config.AccountConfig{RemoteUser: "u", RemotePassword: "p", HandshakeTimeout: 50 * time.Millisecond}
+	err := LoginUpstream(client, bufio.NewReader(client), acct)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("LoginUpstream err = %v, want timeout", err)
+	}
+}
+
+func TestLoginDialFailureResponse(t *testing.T) {
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			return nil, nil, fmt.Errorf("dial 192.0.2.1:993: %w", context.DeadlineExceeded)
 		}
+	})
+	env.readLine(t) // greeting
+	env.send(t, "A001 LOGIN reader1 localpass1\r\n")
+	if line := env.readLine(t); line != "A001 NO [UNAVAILABLE] upstream timed out\r\n" {
+		t.Errorf("LOGIN response = %q", line)
+	}
+}
+
+func TestSessionLocalUpstream(t *testing.T) {
+	root := t.TempDir()
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, "INBOX", sub), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := "From: alice@example.com\r\nSubject: archived\r\n\r\nhello\r\n"
+	if err := os.WriteFile(filepath.Join(root, "INBOX", "cur", "1700000000.a.host:2,S"), []byte(msg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Accounts[0] = config.AccountConfig{LocalUser: "reader1", LocalPassword: "localpass1", UpstreamPath: root}
+	clientConn, proxyConn := net.Pipe()
+	defer clientConn.Close()
+	go NewSession(proxyConn, cfg, testLogger()).Run()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(clientConn)
+	r.ReadString('\n') // greeting
+
+	exchange := func(tag, cmd string) []string {
+		t.Helper()
+		fmt.Fprintf(clientConn, "%s %s\r\n", tag, cmd)
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+			lines = append(lines, line)
+			if strings.HasPrefix(line, tag+" ") {
+				return lines
+			}
+		}
+	}
+	if got := exchange("a1", "LOGIN reader1 localpass1"); !strings.HasPrefix(got[len(got)-1], "a1 OK") {
+		t.Fatalf("LOGIN = %q", got)
+	}
+	if got := exchange("a2", "SELECT INBOX"); !slices.Contains(got, "* 1 EXISTS\r\n") {
+		t.Errorf("SELECT = %q", got)
+	}
+	got := strings.Join(exchange("a3", "FETCH 1 BODY.PEEK[HEADER.FIELDS (SUBJECT)]"), "")
+	if !strings.Contains(got, "Subject: archived\r\n") {
+		t.Errorf("FETCH = %q", got)
+	}
+	if got := exchange("a4", `STORE 1 +FLAGS (\Deleted)`); !strings.HasPrefix(got[len(got)-1], "a4 NO") {
+		t.Errorf("STORE = %q", got)
 	}
 }
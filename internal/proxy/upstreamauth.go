@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	"imap-proxy/internal/config"
+)
+
+// authenticateUpstream logs in with AUTHENTICATE for an upstream that
+// advertises LOGINDISABLED, using the first mechanism in caps that works
+// with a password: PLAIN (RFC 4616), then LOGIN.
+func authenticateUpstream(conn net.Conn, reader *bufio.Reader, acct *config.AccountConfig, caps capabilitySet) error {
+	b64 := base64.StdEncoding.EncodeToString
+	switch {
+	case caps.has("AUTH=PLAIN"):
+		resp := b64([]byte("\x00" + acct.RemoteUser + "\x00" + acct.RemotePassword))
+		if caps.has("SASL-IR") {
+			return upstreamCommand(conn, reader, acct, "authenticate", loginTag+" AUTHENTICATE PLAIN "+resp+"\r\n", nil)
+		}
+		return upstreamCommand(conn, reader, acct, "authenticate", loginTag+" AUTHENTICATE PLAIN\r\n", []string{resp})
+	case caps.has("AUTH=LOGIN"):
+		return upstreamCommand(conn, reader, acct, "authenticate", loginTag+" AUTHENTICATE LOGIN\r\n",
+			[]string{b64([]byte(acct.RemoteUser)), b64([]byte(acct.RemotePassword))})
+	}
+	return &refusedError{"login: upstream advertises LOGINDISABLED and none of the AUTHENTICATE mechanisms the proxy supports (PLAIN, LOGIN); " +
+		"connect to it with remote_tls or remote_starttls, or enable LOGIN on the upstream server"}
+}
+
+// queryCapabilities asks the upstream for its capabilities.
+func queryCapabilities(conn net.Conn, reader *bufio.Reader) (capabilitySet, error) {
+	if _, err := fmt.Fprint(conn, loginTag+" CAPABILITY\r\n"); err != nil {
+		return nil, err
+	}
+	var caps capabilitySet
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := parseCapabilities(line); ok && strings.HasPrefix(line, "* ") {
+			caps = c
+		}
+		if strings.HasPrefix(line, loginTag+" ") {
+			if !strings.Contains(line, " OK") {
+				return nil, fmt.Errorf("capability: %s", strings.TrimRight(line, "\r\n"))
+			}
+			return caps, nil
+		}
+	}
+}
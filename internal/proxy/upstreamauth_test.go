@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+// scriptedUpstream answers each line it reads with the next reply in
+// replies and returns the lines read.
+func scriptedUpstream(t *testing.T, conn net.Conn, replies ...string) <-chan []string {
+	t.Helper()
+	done := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var got []string
+		for _, reply := range replies {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			got = append(got, strings.TrimRight(line, "\r\n"))
+			fmt.Fprint(conn, reply)
+		}
+		done <- got
+	}()
+	return done
+}
+
+func TestLoginUpstreamLoginDisabled(t *testing.T) {
+	tests := []struct {
+		name    string
+		caps    string // greeting capabilities; empty if not advertised
+		replies []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "PLAIN with SASL-IR",
+			caps:    "IMAP4rev1 LOGINDISABLED AUTH=PLAIN SASL-IR",
+			replies: []string{"proxy0 OK done\r\n"},
+			want:    []string{"proxy0 AUTHENTICATE PLAIN AHVzZXIAcGFzcw=="},
+		},
+		{
+			name:    "PLAIN",
+			caps:    "IMAP4rev1 LOGINDISABLED AUTH=PLAIN AUTH=LOGIN",
+			replies: []string{"+ \r\n", "proxy0 OK done\r\n"},
+			want:    []string{"proxy0 AUTHENTICATE PLAIN", "AHVzZXIAcGFzcw=="},
+		},
+		{
+			name:    "LOGIN",
+			caps:    "IMAP4rev1 LOGINDISABLED AUTH=LOGIN",
+			replies: []string{"+ VXNlcm5hbWU6\r\n", "+ UGFzc3dvcmQ6\r\n", "proxy0 OK done\r\n"},
+			want:    []string{"proxy0 AUTHENTICATE LOGIN", "dXNlcg==", "cGFzcw=="},
+		},
+		{
+			name:    "no usable mechanism",
+			caps:    "IMAP4rev1 LOGINDISABLED AUTH=GSSAPI",
+			wantErr: "remote_starttls",
+		},
+		{
+			name: "discovered after LOGIN is refused",
+			replies: []string{
+				"proxy0 NO LOGIN is disabled\r\n",
+				"* CAPABILITY IMAP4rev1 LOGINDISABLED AUTH=PLAIN SASL-IR\r\nproxy0 OK done\r\n",
+				"proxy0 OK done\r\n",
+			},
+			want: []string{`proxy0 LOGIN "user" "pass"`, "proxy0 CAPABILITY", "proxy0 AUTHENTICATE PLAIN AHVzZXIAcGFzcw=="},
+		},
+		{
+			name:    "refused LOGIN without LOGINDISABLED",
+			replies: []string{"proxy0 NO wrong password\r\n", "* CAPABILITY IMAP4rev1\r\nproxy0 OK done\r\n"},
+			want:    []string{`proxy0 LOGIN "user" "pass"`, "proxy0 CAPABILITY"},
+			wantErr: "login failed: proxy0 NO wrong password",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acct := &config.AccountConfig{
+				RemoteHost: fmt.Sprintf("logindisabled%d.example.com", i), RemotePort: 143,
+				RemoteUser: "user", RemotePassword: "pass", HandshakeTimeout: 2 * time.Second,
+			}
+			if tt.caps != "" {
+				caps, _ := parseCapabilities("* CAPABILITY " + tt.caps)
+				upstreamCaps.storeGreeting(upstreamKey(acct), caps)
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			lines := scriptedUpstream(t, server, tt.replies...)
+
+			err := LoginUpstream(client, bufio.NewReader(client), acct)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("LoginUpstream: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("LoginUpstream err = %v, want %q", err, tt.wantErr)
+			}
+			client.Close()
+			if got := <-lines; strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("upstream read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"strings"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+var upstreamNoticesTotal = metrics.Default.NewCounter("imap_proxy_upstream_notices_total",
+	"Untagged BYE and [ALERT] responses the upstream sent on its own, by kind: bye or alert.", "kind")
+
+// maxNoticeText is the longest text a sanitized notice keeps.
+const maxNoticeText = 200
+
+// upstreamByeError ends a session whose upstream said BYE. bye is what the
+// client is told.
+type upstreamByeError struct {
+	bye string
+}
+
+func (e *upstreamByeError) Error() string { return "upstream said BYE" }
+
+// isAlert reports whether line is an untagged status response with an
+// [ALERT] response code.
+func isAlert(line string) bool {
+	if !strings.HasPrefix(line, "* ") {
+		return false
+	}
+	status, text, _ := strings.Cut(line[2:], " ")
+	switch strings.ToUpper(status) {
+	case "OK", "NO", "BAD":
+	default:
+		return false
+	}
+	return len(text) >= 7 && strings.EqualFold(text[:7], "[ALERT]")
+}
+
+// handleUpstreamBye handles an untagged BYE the upstream sent on its own. It is
+// logged, and the returned error ends the session unless an IDLE can be
+// resumed on a new connection.
+func (s *Session) handleUpstreamBye(line string) error {
+	upstreamNoticesTotal.Inc("bye")
+	_, text := noticeText(line)
+	s.logger.Warn("upstream said BYE", "text", text)
+	bye := line
+	switch s.account.UpstreamNotices {
+	case config.UpstreamNoticesSanitize:
+		bye = s.sanitizeNotice(line)
+	case config.UpstreamNoticesDrop:
+		bye = "* BYE [UNAVAILABLE] upstream connection lost\r\n"
+	}
+	return &upstreamByeError{bye: bye}
+}
+
+// handleUpstreamAlert handles an untagged [ALERT] response the upstream sent. It
+// is logged and returns the line for the client, reporting false if it is
+// not relayed.
+func (s *Session) handleUpstreamAlert(line string) (string, bool) {
+	upstreamNoticesTotal.Inc("alert")
+	_, text := noticeText(line)
+	s.logger.Warn("upstream alert", "text", text)
+	switch s.account.UpstreamNotices {
+	case config.UpstreamNoticesSanitize:
+		return s.sanitizeNotice(line), true
+	case config.UpstreamNoticesDrop:
+		return line, false
+	}
+	return line, true
+}
+
+// noticeText returns the status and text, with any response code, of an
+// untagged status response.
+func noticeText(line string) (status, text string) {
+	status, text, _ = strings.Cut(strings.TrimPrefix(strings.TrimRight(line, "\r\n"), "* "), " ")
+	return status, text
+}
+
+// sanitizeNotice rewrites an untagged BYE or [ALERT] for the client: only
+// printable ASCII is kept, response codes other than ALERT are removed,
+// the upstream host name is replaced and the text is cut to maxNoticeText.
+func (s *Session) sanitizeNotice(line string) string {
+	status, text := noticeText(line)
+	prefix := "* " + strings.ToUpper(status) + " "
+	if len(text) >= 7 && strings.EqualFold(text[:7], "[ALERT]") {
+		prefix += "[ALERT] "
+	}
+	if strings.HasPrefix(text, "[") {
+		if _, after, ok := strings.Cut(text, "]"); ok {
+			text = after
+		}
+	}
+	text = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, text)
+	if host := s.account.RemoteHost; host != "" {
+		text = replaceFold(text, host, "mail server")
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > maxNoticeText {
+		text = strings.TrimRight(text[:maxNoticeText], " ")
+	}
+	if text == "" {
+		text = "mail server closed the connection"
+		if strings.HasSuffix(prefix, "[ALERT] ") {
+			text = "message from the mail server"
+		}
+	}
+	return prefix + text + "\r\n"
+}
+
+// replaceFold replaces every occurrence of old in the ASCII string s, in
+// any case, by new.
+func replaceFold(s, old, new string) string {
+	lower, target := strings.ToLower(s), strings.ToLower(old)
+	var b strings.Builder
+	for {
+		i := strings.Index(lower, target)
+		if i < 0 || target == "" {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		b.WriteString(new)
+		s, lower = s[i+len(target):], lower[i+len(target):]
+	}
+}
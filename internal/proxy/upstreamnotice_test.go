@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestIsAlert(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"* OK [ALERT] mailbox almost full\r\n", true},
+		{"* no [alert] quota exceeded\r\n", true},
+		{"* OK [UNSEEN 3] first unseen\r\n", false},
+		{"* BYE [ALERT] going down\r\n", false},
+		{"A1 OK [ALERT] done\r\n", false},
+		{"* 3 EXISTS\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := isAlert(tt.line); got != tt.want {
+			t.Errorf("isAlert(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeNotice(t *testing.T) {
+	s := &Session{account: &config.AccountConfig{RemoteHost: "imap.internal.example"}}
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"* OK [ALERT] IMAP.internal.example restarts at 2am\r\n", "* OK [ALERT] mail server restarts at 2am\r\n"},
+		{"* bye [UNAVAILABLE] node\x1b[2J  imap7   down\r\n", "* BYE node[2J imap7 down\r\n"},
+		{"* BYE\r\n", "* BYE mail server closed the connection\r\n"},
+		{"* NO [ALERT] \xc3\xa9\r\n", "* NO [ALERT] message from the mail server\r\n"},
+		{"* OK [ALERT] " + strings.Repeat("x", 300) + "\r\n", "* OK [ALERT] " + strings.Repeat("x", maxNoticeText) + "\r\n"},
+	}
+	for _, tt := range tests {
+		if got := s.sanitizeNotice(tt.line); got != tt.want {
+			t.Errorf("sanitizeNotice(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamNotices(t *testing.T) {
+	const (
+		alert = "* OK [ALERT] imap.internal.example: mailbox \x07almost full\r\n"
+		bye   = "* BYE [UNAVAILABLE] imap.internal.example shutting down\r\n"
+	)
+	tests := []struct {
+		mode      string
+		wantAlert string // "" if not relayed
+		wantBye   string
+	}{
+		{config.UpstreamNoticesForward, alert, bye},
+		{config.UpstreamNoticesSanitize, "* OK [ALERT] mail server: mailbox almost full\r\n", "* BYE mail server shutting down\r\n"},
+		{config.UpstreamNoticesDrop, "", "* BYE [UNAVAILABLE] upstream connection lost\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Accounts[0].RemoteHost = "imap.internal.example"
+			cfg.Accounts[0].UpstreamNotices = tt.mode
+			received := make(chan string, 10)
+			env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+				s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+					upClient, upServer := net.Pipe()
+					go func() {
+						defer upServer.Close()
+						sr := bufio.NewReader(upServer)
+						line, _ := sr.ReadString('\n')
+						received <- strings.TrimRight(line, "\r\n")
+						fmt.Fprint(upServer, "proxy0 OK LOGIN completed\r\n")
+						sr.ReadString('\n')
+						fmt.Fprint(upServer, alert+"A002 OK NOOP completed\r\n")
+						sr.ReadString('\n')
+						// The connection stays open: the BYE alone ends the session.
+						fmt.Fprint(upServer, bye)
+						sr.ReadString('\n')
+					}()
+					return upClient, bufio.NewReader(upClient), nil
+				}
+			})
+			defer env.clientConn.Close()
+			env.received = received
+			env.login(t)
+			before := upstreamNoticesTotal.Value("bye")
+
+			env.send(t, "A002 NOOP\r\n")
+			line := env.readLine(t)
+			if tt.wantAlert != "" {
+				if line != tt.wantAlert {
+					t.Fatalf("alert = %q, want %q", line, tt.wantAlert)
+				}
+				line = env.readLine(t)
+			}
+			if !strings.HasPrefix(line, "A002 OK") {
+				t.Fatalf("expected NOOP completion, got: %q", line)
+			}
+
+			env.send(t, "A003 NOOP\r\n")
+			if line := env.readLine(t); line != tt.wantBye {
+				t.Fatalf("BYE = %q, want %q", line, tt.wantBye)
+			}
+			if line, err := env.clientR.ReadString('\n'); err == nil {
+				t.Fatalf("session continued after BYE, got: %q", line)
+			}
+			if got := upstreamNoticesTotal.Value("bye") - before; got != 1 {
+				t.Errorf("BYE notices counted = %v, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/metrics"
+)
+
+// upstreamSessionCacheSize is the number of TLS sessions kept per upstream.
+const upstreamSessionCacheSize = 64
+
+var upstreamStartTLSInjectionsTotal = metrics.Default.NewCounter("imap_proxy_upstream_starttls_injections_total",
+	"Upstream STARTTLS negotiations aborted because the server sent data ahead of the TLS handshake.")
+
+var upstreamTLSHandshakesTotal = metrics.Default.NewCounter("imap_proxy_upstream_tls_handshakes_total",
+	"Upstream TLS handshakes, by whether a previous session was resumed.", "resumed")
+
+// sessionCaches holds one TLS client session cache per upstream and client
+// identity, shared by all dials so that reconnects can resume sessions.
+type sessionCaches struct {
+	mu     sync.Mutex
+	caches map[string]tls.ClientSessionCache
+}
+
+var upstreamSessions = &sessionCaches{caches: make(map[string]tls.ClientSessionCache)}
+
+// get returns the cache for key, creating it on first use.
+func (c *sessionCaches) get(key string) tls.ClientSessionCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cache, ok := c.caches[key]
+	if !ok {
+		cache = tls.NewLRUClientSessionCache(upstreamSessionCacheSize)
+		c.caches[key] = cache
+	}
+	return cache
+}
+
+// forget drops the session caches of upstream, for every server name and
+// client certificate, and reports whether there were any.
+func (c *sessionCaches) forget(upstream string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := false
+	for key := range c.caches {
+		if strings.HasPrefix(key, upstream+"|") {
+			delete(c.caches, key)
+			found = true
+		}
+	}
+	return found
+}
+
+// sessionCacheKey identifies the sessions acct may resume. It includes the
+// client certificate so that a session authenticated with one account's
+// certificate is never resumed by another account.
+func sessionCacheKey(acct *config.AccountConfig, serverName string) string {
+	return upstreamKey(acct) + "|" + serverName + "|" + acct.RemoteClientCertFile
+}
+
+// countTLSHandshake records whether conn resumed a session.
+func countTLSHandshake(conn *tls.Conn) {
+	if conn.ConnectionState().DidResume {
+		upstreamTLSHandshakesTotal.Inc("true")
+	} else {
+		upstreamTLSHandshakesTotal.Inc("false")
+	}
+}
+
+// negotiateStartTLS reads the upstream's plaintext greeting on plain and
+// requests STARTTLS, returning once the upstream is ready for the TLS
+// handshake. Everything read here is discarded, so anything the upstream
+// sends after its OK would be taken for data protected by TLS without
+// being so. Such data, whether injected by an attacker on the path or
+// sent by a broken server, fails the negotiation instead.
+func negotiateStartTLS(plain net.Conn) error {
+	pr := bufio.NewReader(plain)
+	greeting, err := pr.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("starttls: read greeting: %w", err)
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		// A PREAUTH greeting leaves no room for STARTTLS.
+		return &refusedError{"starttls: unexpected greeting: " + strings.TrimRight(greeting, "\r\n")}
+	}
+	if _, err := fmt.Fprint(plain, loginTag+" STARTTLS\r\n"); err != nil {
+		return fmt.Errorf("starttls: send command: %w", err)
+	}
+	for {
+		resp, err := pr.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("starttls: read response: %w", err)
+		}
+		if strings.HasPrefix(resp, "* ") {
+			continue
+		}
+		if !completedOK(loginTag, resp) {
+			return &refusedError{"starttls: server rejected: " + strings.TrimRight(resp, "\r\n")}
+		}
+		break
+	}
+	if pr.Buffered() > 0 {
+		upstreamStartTLSInjectionsTotal.Inc()
+		return &refusedError{fmt.Sprintf("starttls: upstream sent %d bytes before the TLS handshake", pr.Buffered())}
+	}
+	return nil
+}
+
+// upstreamTLSConfig builds the TLS client config for acct's upstream.
+// defaultServerName is verified unless remote_server_name overrides it.
+func upstreamTLSConfig(acct *config.AccountConfig, defaultServerName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: defaultServerName}
+	if acct.RemoteServerName != "" {
+		cfg.ServerName = acct.RemoteServerName
+	}
+	cfg.ClientSessionCache = upstreamSessions.get(sessionCacheKey(acct, cfg.ServerName))
+	if acct.RemoteCAFile != "" {
+		pool, err := loadCertPool(acct.RemoteCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if acct.RemoteClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(acct.RemoteClientCertFile, acct.RemoteClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load remote client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	cfg.InsecureSkipVerify = acct.RemoteInsecureSkipVerify //nolint:gosec // explicit opt-in, warned about at startup and login
+	return cfg, nil
+}
+
+// loadCertPool reads PEM certificates from path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read remote_ca_file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("remote_ca_file %s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// CheckUpstreamTLS verifies that every account's upstream TLS settings
+// load, so a bad CA file or client certificate is reported at startup rather than on first
+// login, and warns about accounts that skip certificate verification or
+// connect in plaintext.
+func CheckUpstreamTLS(cfg *config.Config, logger *slog.Logger) error {
+	for i := range cfg.Accounts {
+		acct := &cfg.Accounts[i]
+		if acct.Honeypot {
+			continue
+		}
+		if _, err := upstreamTLSConfig(acct, acct.RemoteHost); err != nil {
+			return fmt.Errorf("account %q: %w", acct.LocalUser, err)
+		}
+		if acct.RemoteInsecureSkipVerify && acct.UpstreamTLS() {
+			logger.Warn("upstream TLS certificate verification is DISABLED; the connection and remote password can be intercepted",
+				"user", acct.LocalUser, "remote_host", acct.RemoteHost)
+		}
+		if acct.RemoteAllowPlaintext {
+			logger.Warn("upstream connection is PLAINTEXT (remote_allow_plaintext); the remote password is sent unencrypted",
+				"user", acct.LocalUser, "remote_host", acct.RemoteHost)
+		}
+	}
+	return nil
+}
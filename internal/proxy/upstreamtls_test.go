@@ -0,0 +1,403 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+)
+
+// writeTestCA creates a self-signed certificate for dnsName, writes it to a
+// PEM file and returns the file path and a server config presenting it.
+func writeTestCA(t *testing.T, dnsName string) (caFile string, serverCfg *tls.Config) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+	return caFile, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}}}
+}
+
+// tlsGreeter accepts TLS connections and greets each one.
+func tlsGreeter(t *testing.T, serverCfg *tls.Config) int {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverCfg)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprint(conn, "* OK ready\r\n")
+				buf := make([]byte, 1)
+				conn.Read(buf)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startTLSGreeter accepts plaintext connections, upgrades each one with
+// STARTTLS and greets it over TLS.
+func startTLSGreeter(t *testing.T, serverCfg *tls.Config) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprint(conn, "* OK ready\r\n")
+				buf := make([]byte, 256)
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				fmt.Fprint(conn, "proxy0 OK begin TLS negotiation\r\n")
+				tlsConn := tls.Server(conn, serverCfg)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				fmt.Fprint(tlsConn, "* OK ready\r\n")
+				tlsConn.Read(buf[:1])
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialUpstreamTLSVerification(t *testing.T) {
+	caFile, serverCfg := writeTestCA(t, "mail.internal")
+	tlsPort := tlsGreeter(t, serverCfg)
+	startTLSPort := startTLSGreeter(t, serverCfg)
+
+	tests := []struct {
+		name    string
+		acct    config.AccountConfig
+		wantErr string
+	}{
+		{name: "system pool rejects private CA", acct: config.AccountConfig{RemoteServerName: "mail.internal"}, wantErr: "certificate"},
+		{name: "ca file", acct: config.AccountConfig{RemoteCAFile: caFile, RemoteServerName: "mail.internal"}},
+		{name: "ca file wrong name", acct: config.AccountConfig{RemoteCAFile: caFile}, wantErr: "certificate"},
+		{name: "insecure", acct: config.AccountConfig{RemoteInsecureSkipVerify: true}},
+	}
+	for _, startTLS := range []bool{false, true} {
+		for _, tt := range tests {
+			name := "tls/" + tt.name
+			if startTLS {
+				name = "starttls/" + tt.name
+			}
+			t.Run(name, func(t *testing.T) {
+				acct := tt.acct
+				acct.RemoteHost = "127.0.0.1"
+				acct.RemotePort = tlsPort
+				acct.RemoteTLS = true
+				if startTLS {
+					acct.RemotePort = startTLSPort
+					acct.RemoteTLS = false
+					acct.RemoteStartTLS = true
+				}
+				conn, _, err := dialUpstream(&acct, nil, "")
+				if tt.wantErr == "" {
+					if err != nil {
+						t.Fatalf("dialUpstream: %v", err)
+					}
+					conn.Close()
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dialUpstream err = %v, want %q", err, tt.wantErr)
+				}
+				if got := dialFailureReason(err); got != "upstream certificate not trusted" {
+					t.Errorf("dialFailureReason = %q", got)
+				}
+			})
+		}
+	}
+}
+
+func TestNegotiateStartTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		greeting string
+		reply    string // sent in one write after the STARTTLS command
+		wantErr  string
+	}{
+		{name: "ok", greeting: "* OK ready\r\n", reply: "proxy0 OK begin TLS\r\n"},
+		{name: "untagged before ok", greeting: "* OK ready\r\n", reply: "* CAPABILITY IMAP4rev1\r\nproxy0 OK begin TLS\r\n"},
+		{name: "injected data", greeting: "* OK ready\r\n", reply: "proxy0 OK begin TLS\r\n* OK injected\r\n", wantErr: "before the TLS handshake"},
+		{name: "untagged ok only", greeting: "* OK ready\r\n", reply: "* OK fine\r\nproxy0 NO not now\r\n", wantErr: "rejected"},
+		{name: "preauth", greeting: "* PREAUTH welcome\r\n", wantErr: "unexpected greeting"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				fmt.Fprint(server, tt.greeting)
+				buf := make([]byte, 256)
+				if _, err := server.Read(buf); err != nil {
+					return
+				}
+				fmt.Fprint(server, tt.reply)
+			}()
+			before := upstreamStartTLSInjectionsTotal.Value()
+			err := negotiateStartTLS(client)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("negotiateStartTLS: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("negotiateStartTLS err = %v, want %q", err, tt.wantErr)
+			}
+			if retryableDialError(err) {
+				t.Error("refused STARTTLS is retried")
+			}
+			injected := upstreamStartTLSInjectionsTotal.Value() - before
+			if want := tt.name == "injected data"; (injected == 1) != want {
+				t.Errorf("injections counted = %v", injected)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	caFile, _ := writeTestCA(t, "mail.internal")
+
+	cfg, err := upstreamTLSConfig(&config.AccountConfig{}, "mail.example.com")
+	if err != nil {
+		t.Fatalf("upstreamTLSConfig: %v", err)
+	}
+	if cfg.ServerName != "mail.example.com" || cfg.RootCAs != nil || cfg.InsecureSkipVerify {
+		t.Errorf("default config = %+v", cfg)
+	}
+
+	cfg, err = upstreamTLSConfig(&config.AccountConfig{RemoteCAFile: caFile, RemoteServerName: "mail.internal"}, "10.0.0.5")
+	if err != nil {
+		t.Fatalf("upstreamTLSConfig: %v", err)
+	}
+	if cfg.ServerName != "mail.internal" || cfg.RootCAs == nil {
+		t.Errorf("config with overrides = %+v", cfg)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0o600)
+	for _, file := range []string{empty, filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := upstreamTLSConfig(&config.AccountConfig{RemoteCAFile: file}, "h"); err == nil {
+			t.Errorf("upstreamTLSConfig(%s) succeeded, want error", file)
+		}
+	}
+}
+
+func TestCheckUpstreamTLS(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	cfg := &config.Config{Accounts: []config.AccountConfig{
+		{LocalUser: "ok", RemoteTLS: true},
+		{LocalUser: "insecure", RemoteTLS: true, RemoteInsecureSkipVerify: true},
+		{LocalUser: "cleartext", RemoteAllowPlaintext: true},
+	}}
+	if err := CheckUpstreamTLS(cfg, logger); err != nil {
+		t.Fatalf("CheckUpstreamTLS: %v", err)
+	}
+	if !strings.Contains(buf.String(), "DISABLED") || !strings.Contains(buf.String(), "user=insecure") {
+		t.Errorf("no warning for insecure account: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "PLAINTEXT") || !strings.Contains(buf.String(), "user=cleartext") {
+		t.Errorf("no warning for plaintext account: %s", buf.String())
+	}
+	if strings.Contains(buf.String(), "user=ok") {
+		t.Errorf("unexpected warning for verified account: %s", buf.String())
+	}
+
+	cfg.Accounts = append(cfg.Accounts, config.AccountConfig{LocalUser: "bad", RemoteCAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	if err := CheckUpstreamTLS(cfg, logger); err == nil || !strings.Contains(err.Error(), `"bad"`) {
+		t.Errorf("CheckUpstreamTLS err = %v, want error for account bad", err)
+	}
+}
+
+// writeTestClientCert creates a self-signed client certificate and key,
+// writes them to PEM files and returns a pool that trusts the certificate.
+func writeTestClientCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		Subject:               pkix.Name{CommonName: "imap-proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse cert: %v", err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestDialUpstreamClientCertificate(t *testing.T) {
+	caFile, serverCfg := writeTestCA(t, "mail.internal")
+	certFile, keyFile, clientPool := writeTestClientCert(t)
+	serverCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	serverCfg.ClientCAs = clientPool
+	port := tlsGreeter(t, serverCfg)
+
+	base := config.AccountConfig{
+		RemoteHost:       "127.0.0.1",
+		RemotePort:       port,
+		RemoteTLS:        true,
+		RemoteCAFile:     caFile,
+		RemoteServerName: "mail.internal",
+	}
+
+	withCert := base
+	withCert.RemoteClientCertFile = certFile
+	withCert.RemoteClientKeyFile = keyFile
+	conn, _, err := dialUpstream(&withCert, nil, "")
+	if err != nil {
+		t.Fatalf("dialUpstream with client certificate: %v", err)
+	}
+	conn.Close()
+
+	if conn, _, err := dialUpstream(&base, nil, ""); err == nil {
+		conn.Close()
+		t.Fatal("dialUpstream without client certificate succeeded")
+	}
+}
+
+func TestUpstreamTLSConfigClientCertificate(t *testing.T) {
+	certFile, keyFile, _ := writeTestClientCert(t)
+	cfg, err := upstreamTLSConfig(&config.AccountConfig{RemoteClientCertFile: certFile, RemoteClientKeyFile: keyFile}, "h")
+	if err != nil {
+		t.Fatalf("upstreamTLSConfig: %v", err)
+	}
+	if len(cfg.Certificates) != 1 {
+		t.Errorf("certificates = %d, want 1", len(cfg.Certificates))
+	}
+	// A key that does not match the certificate is an error.
+	_, otherKey, _ := writeTestClientCert(t)
+	if _, err := upstreamTLSConfig(&config.AccountConfig{RemoteClientCertFile: certFile, RemoteClientKeyFile: otherKey}, "h"); err == nil {
+		t.Error("upstreamTLSConfig with mismatched key succeeded")
+	}
+}
+
+func TestDialUpstreamSessionResumption(t *testing.T) {
+	caFile, serverCfg := writeTestCA(t, "mail.internal")
+	port := tlsGreeter(t, serverCfg)
+	acct := &config.AccountConfig{
+		RemoteHost:       "127.0.0.1",
+		RemotePort:       port,
+		RemoteTLS:        true,
+		RemoteCAFile:     caFile,
+		RemoteServerName: "mail.internal",
+	}
+
+	dial := func() bool {
+		t.Helper()
+		// dialUpstream reads the greeting, which also processes any TLS 1.3
+		// session ticket the server sent after the handshake.
+		conn, _, err := dialUpstream(acct, nil, "")
+		if err != nil {
+			t.Fatalf("dialUpstream: %v", err)
+		}
+		defer conn.Close()
+		return conn.(*tls.Conn).ConnectionState().DidResume
+	}
+
+	resumedBefore := upstreamTLSHandshakesTotal.Value("true")
+	if dial() {
+		t.Fatal("first handshake resumed a session")
+	}
+	if !dial() {
+		t.Fatal("second handshake did not resume the session")
+	}
+	if got := upstreamTLSHandshakesTotal.Value("true") - resumedBefore; got != 1 {
+		t.Errorf("resumed handshakes counted = %v, want 1", got)
+	}
+}
+
+func TestSessionCacheKey(t *testing.T) {
+	a := &config.AccountConfig{RemoteHost: "mail", RemotePort: 993}
+	b := &config.AccountConfig{RemoteHost: "mail", RemotePort: 993}
+	if sessionCacheKey(a, "mail") != sessionCacheKey(b, "mail") {
+		t.Error("accounts on the same upstream do not share a session cache")
+	}
+	b.RemoteClientCertFile = "b.pem"
+	if sessionCacheKey(a, "mail") == sessionCacheKey(b, "mail") {
+		t.Error("accounts with different client certificates share a session cache")
+	}
+	if upstreamSessions.get("k") != upstreamSessions.get("k") {
+		t.Error("get returned different caches for the same key")
+	}
+}
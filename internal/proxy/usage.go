@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"imap-proxy/internal/audit"
+)
+
+// folderUsage accumulates what a session did with one folder.
+type folderUsage struct {
+	listed   bool
+	selects  int
+	messages int64 // untagged FETCH responses relayed while selected
+	bytes    int64 // bytes relayed to the client while selected
+}
+
+// usageTracker attributes relayed traffic to folders for access reporting.
+// The client goroutine records selects; the upstream goroutine records
+// listings and relayed responses.
+type usageTracker struct {
+	mu      sync.Mutex
+	current string
+	folders map[string]*folderUsage
+}
+
+// folder returns the usage entry for name; u.mu must be held.
+func (u *usageTracker) folder(name string) *folderUsage {
+	if u.folders == nil {
+		u.folders = make(map[string]*folderUsage)
+	}
+	f, ok := u.folders[name]
+	if !ok {
+		f = &folderUsage{}
+		u.folders[name] = f
+	}
+	return f
+}
+
+func (u *usageTracker) selected(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.current = name
+	u.folder(name).selects++
+}
+
+func (u *usageTracker) listed(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.folder(name).listed = true
+}
+
+// relayed records n bytes sent to the client; line is the response line
+// they belong to, or "" for literal data.
+func (u *usageTracker) relayed(line string, n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.current == "" {
+		return
+	}
+	f := u.folder(u.current)
+	f.bytes += int64(n)
+	if line != "" && isFetchResponse(line) {
+		f.messages++
+	}
+}
+
+// selectedFolders returns the folders selected during the session, sorted.
+func (u *usageTracker) selectedFolders() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var names []string
+	for name, f := range u.folders {
+		if f.selects > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isFetchResponse reports whether line is an untagged "* <n> FETCH" response.
+func isFetchResponse(line string) bool {
+	rest, ok := strings.CutPrefix(line, "* ")
+	if !ok {
+		return false
+	}
+	num, rest, ok := strings.Cut(rest, " ")
+	if !ok {
+		return false
+	}
+	if _, err := strconv.ParseUint(num, 10, 32); err != nil {
+		return false
+	}
+	return len(rest) >= 5 && strings.EqualFold(rest[:5], "FETCH")
+}
+
+// fetched records one message of n bytes served from the current folder
+// by a gateway, which does not relay FETCH responses as such.
+func (u *usageTracker) fetched(n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.current == "" {
+		return
+	}
+	f := u.folder(u.current)
+	f.bytes += int64(n)
+	f.messages++
+}
+
+// events returns one folder_usage audit event for user per folder listed
+// or selected, sorted by folder.
+func (u *usageTracker) events(user string) []audit.Event {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	names := make([]string, 0, len(u.folders))
+	for name := range u.folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	events := make([]audit.Event, 0, len(names))
+	for _, name := range names {
+		f := u.folders[name]
+		events = append(events, audit.Event{
+			Type: audit.FolderUsage, User: user,
+			Fields: map[string]string{
+				"folder":   name,
+				"listed":   strconv.FormatBool(f.listed),
+				"selects":  strconv.Itoa(f.selects),
+				"messages": strconv.FormatInt(f.messages, 10),
+				"bytes":    strconv.FormatInt(f.bytes, 10),
+			},
+		})
+	}
+	return events
+}
+
+// recordUsage emits one folder_usage audit event per folder the session
+// listed or selected.
+func (s *Session) recordUsage() {
+	for _, ev := range s.usage.events(s.account.LocalUser) {
+		s.recordAudit(ev)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"imap-proxy/internal/audit"
+)
+
+func TestIsFetchResponse(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"* 12 FETCH (FLAGS (\\Seen))\r\n", true},
+		{"* 1 fetch (UID 5)\r\n", true},
+		{"* 3 EXISTS\r\n", false},
+		{"* OK [UIDNEXT 4]\r\n", false},
+		{"A1 OK FETCH completed\r\n", false},
+		{"* x FETCH\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := isFetchResponse(tt.line); got != tt.want {
+			t.Errorf("isFetchResponse(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestUsageTracker(t *testing.T) {
+	var u usageTracker
+	u.listed("INBOX")
+	u.listed("Sent")
+	u.relayed("* 1 FETCH (FLAGS ())\r\n", 100) // nothing selected yet
+	u.selected("INBOX")
+	u.relayed("* 1 FETCH (BODY[] {50}\r\n", 24)
+	u.relayed("", 50)
+	u.relayed("* 2 FETCH (FLAGS ())\r\n", 22)
+	u.relayed("A3 OK done\r\n", 12)
+
+	inbox := u.folders["INBOX"]
+	if !inbox.listed || inbox.selects != 1 || inbox.messages != 2 || inbox.bytes != 108 {
+		t.Errorf("INBOX usage = %+v", *inbox)
+	}
+	if sent := u.folders["Sent"]; !sent.listed || sent.selects != 0 || sent.bytes != 0 {
+		t.Errorf("Sent usage = %+v", *sent)
+	}
+}
+
+func TestSessionRecordsFolderUsage(t *testing.T) {
+	events := make(chan audit.Event, 10)
+	env := newIntegrationEnvWithConfig(t, testConfig(), func(s *Session) {
+		s.shared.audit = audit.New(audit.SinkFunc(func(ev audit.Event) {
+			if ev.Type == audit.FolderUsage {
+				events <- ev
+			}
+		}))
+	})
+	env.login(t)
+	env.send(t, "A2 EXAMINE INBOX\r\n")
+	env.drainUpstream(t)
+	env.readUntilTagged(t, "A2")
+	env.send(t, "A3 LOGOUT\r\n")
+	env.readUntilTagged(t, "A3")
+	env.clientConn.Close()
+
+	select {
+	case ev := <-events:
+		if ev.User != "reader1" || ev.Fields["folder"] != "INBOX" || ev.Fields["selects"] != "1" {
+			t.Errorf("folder_usage event = %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no folder_usage event recorded at session end")
+	}
+}
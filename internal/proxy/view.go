@@ -0,0 +1,565 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/metrics"
+)
+
+var messagesHiddenTotal = metrics.Default.NewCounter("imap_proxy_messages_hidden_total",
+	"Messages hidden by visibility rules when a folder was selected.")
+
+// view maps the message sequence numbers a client sees in a folder with
+// hidden messages to the upstream's. Every upstream message is known by
+// UID in sequence order, and the visible ones are numbered consecutively
+// for the client. Responses are translated when they arrive, so lines held
+// back by the keepalive or the coalescer are already in client numbering.
+type view struct {
+	criteria string // search keys matching the visible messages
+
+	mu        sync.Mutex
+	loading   bool     // the folder is being selected; responses are queued
+	queued    []string // untagged lines received while loading
+	uids      []uint32 // all upstream messages, in sequence order
+	visible   []uint32 // visible messages, in sequence order
+	exists    int      // upstream message count; beyond len(uids) is unclassified
+	uidSearch bool     // the last SEARCH or SORT forwarded used UIDs
+}
+
+// VisibilityCriteria returns the search keys matching the messages the
+// account may see in folder, or "" when no visibility rules apply there.
+// Tools reading upstream folders outside a session use it too.
+func VisibilityCriteria(acct *config.AccountConfig, folder string, now time.Time) string {
+	var keys []string
+	if days := acct.MaxAge(folder); days > 0 {
+		keys = append(keys, "SINCE "+now.AddDate(0, 0, -days).Format("2-Jan-2006"))
+	}
+	for _, from := range acct.HideFrom {
+		keys = append(keys, "NOT FROM "+imap.Quote(from))
+	}
+	return strings.Join(keys, " ")
+}
+
+// load installs the upstream's messages and the visible subset, and returns
+// the lines queued while loading.
+func (v *view) load(all, visible []uint32) []string {
+	slices.Sort(all)
+	slices.Sort(visible)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.uids = slices.Compact(all)
+	v.visible = nil
+	for _, uid := range slices.Compact(visible) {
+		if _, ok := slices.BinarySearch(v.uids, uid); ok {
+			v.visible = append(v.visible, uid)
+		}
+	}
+	v.exists = max(v.exists, len(v.uids))
+	v.loading = false
+	queued := v.queued
+	v.queued = nil
+	return queued
+}
+
+// count returns the number of visible messages.
+func (v *view) count() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.visible)
+}
+
+// stale reports whether the upstream announced messages that have not been
+// classified yet, and the highest UID that has.
+func (v *view) stale() (last uint32, ok bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if n := len(v.uids); n > 0 {
+		last = v.uids[n-1]
+	}
+	return last, v.exists > len(v.uids)
+}
+
+// extend classifies messages newer than the known ones and reports the new
+// visible count and whether it grew.
+func (v *view) extend(all, visible []uint32) (int, bool) {
+	slices.Sort(all)
+	slices.Sort(visible)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var last uint32
+	if n := len(v.uids); n > 0 {
+		last = v.uids[n-1]
+	}
+	before := len(v.visible)
+	for _, uid := range slices.Compact(all) {
+		if uid <= last {
+			continue
+		}
+		v.uids = append(v.uids, uid)
+		if _, ok := slices.BinarySearch(visible, uid); ok {
+			v.visible = append(v.visible, uid)
+		}
+	}
+	v.exists = max(v.exists, len(v.uids))
+	return len(v.visible), len(v.visible) > before
+}
+
+// upstreamSet translates a client sequence set, or UID set when uid is
+// set, into the equivalent upstream set covering only visible messages.
+// It reports false when no visible message is in the set.
+func (v *view) upstreamSet(set imap.SeqSet, uid bool) (string, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var last uint32
+	if n := len(v.visible); n > 0 {
+		last = uint32(n)
+		if uid {
+			last = v.visible[n-1]
+		}
+	}
+
+	// Runs of visible messages adjacent in the upstream mailbox collapse
+	// into one range, so the set stays short unless many are hidden.
+	var b strings.Builder
+	start, prev := -1, -1
+	flush := func() {
+		if start < 0 {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		lo, hi := uint32(start+1), uint32(prev+1)
+		if uid {
+			lo, hi = v.uids[start], v.uids[prev]
+		}
+		b.WriteString(strconv.FormatUint(uint64(lo), 10))
+		if hi != lo {
+			b.WriteByte(':')
+			b.WriteString(strconv.FormatUint(uint64(hi), 10))
+		}
+	}
+	for i, u := range v.visible {
+		key := uint32(i + 1)
+		if uid {
+			key = u
+		}
+		if !set.Contains(key, last) {
+			continue
+		}
+		pos, _ := slices.BinarySearch(v.uids, u)
+		if start >= 0 && pos == prev+1 {
+			prev = pos
+			continue
+		}
+		flush()
+		start, prev = pos, pos
+	}
+	flush()
+	return b.String(), b.Len() > 0
+}
+
+// clientSeq returns the client sequence number of upstream message seq;
+// v.mu must be held.
+func (v *view) clientSeq(seq int) (int, bool) {
+	if seq < 1 || seq > len(v.uids) {
+		return 0, false
+	}
+	i, ok := slices.BinarySearch(v.visible, v.uids[seq-1])
+	return i + 1, ok
+}
+
+// response translates an untagged upstream response into client numbering.
+// It reports false if the line concerns hidden messages only and must be
+// dropped.
+func (v *view) response(line string) (string, bool) {
+	if !strings.HasPrefix(line, "* ") {
+		return line, true
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.loading {
+		if _, _, hasLiteral := imap.ParseLiteral([]byte(line)); !hasLiteral {
+			v.queued = append(v.queued, line)
+		}
+		return "", false
+	}
+
+	if n, kind, ok := imap.ParseMessageData([]byte(line)); ok {
+		switch kind {
+		case "EXISTS":
+			// New messages are classified before the client's next
+			// command, which announces them.
+			v.exists = n
+		case "EXPUNGE":
+			return v.expunge(n)
+		}
+		return "", false
+	}
+
+	word, rest, _ := strings.Cut(line[2:], " ")
+	if seq, err := strconv.Atoi(word); err == nil {
+		kind, _, _ := strings.Cut(rest, " ")
+		if !strings.EqualFold(strings.TrimRight(kind, "\r\n"), "FETCH") {
+			return line, true
+		}
+		c, ok := v.clientSeq(seq)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("* %d %s", c, rest), true
+	}
+	switch strings.ToUpper(strings.TrimRight(word, "\r\n")) {
+	case "SEARCH", "SORT":
+		return v.searchResult(line, strings.TrimRight(word, "\r\n")), true
+	case "ESEARCH":
+		// Results in ESEARCH form cannot be renumbered message by message.
+		return "", false
+	case "OK":
+		// The first unseen message may be hidden.
+		if code, _, ok := imap.ParseResponseCode([]byte(line)); ok && code == "UNSEEN" {
+			return "", false
+		}
+	}
+	return line, true
+}
+
+// expunge removes upstream message seq; v.mu must be held.
+func (v *view) expunge(seq int) (string, bool) {
+	v.exists = max(v.exists-1, 0)
+	if seq < 1 || seq > len(v.uids) {
+		return "", false
+	}
+	c, visible := v.clientSeq(seq)
+	v.uids = slices.Delete(v.uids, seq-1, seq)
+	if !visible {
+		return "", false
+	}
+	v.visible = slices.Delete(v.visible, c-1, c)
+	return fmt.Sprintf("* %d EXPUNGE\r\n", c), true
+}
+
+// searchResult drops hidden messages from a SEARCH or SORT response and
+// renumbers the rest; v.mu must be held.
+func (v *view) searchResult(line, word string) string {
+	nums, rest := parseSearchResult(line)
+	var b strings.Builder
+	b.WriteString("* ")
+	b.WriteString(word)
+	for _, n := range nums {
+		if v.uidSearch {
+			if _, ok := slices.BinarySearch(v.visible, n); !ok {
+				continue
+			}
+		} else {
+			c, ok := v.clientSeq(int(n))
+			if !ok {
+				continue
+			}
+			n = uint32(c)
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatUint(uint64(n), 10))
+	}
+	if rest != "" {
+		b.WriteByte(' ')
+		b.WriteString(rest)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// command translates the message numbers in a client command. It returns
+// the line to forward, or a complete reply for the client when the
+// command must not be forwarded.
+func (v *view) command(cmd imap.Command, line string) (forward, reply string) {
+	verb, fields := cmd.Verb, 2
+	uid := verb == "UID"
+	if uid {
+		verb, fields = cmd.SubVerb, 3
+	}
+	parts := strings.SplitN(line, " ", fields+1)
+	if len(parts) <= fields {
+		return line, ""
+	}
+	prefix, args := strings.Join(parts[:fields], " ")+" ", parts[fields]
+
+	switch verb {
+	case "FETCH", "STORE":
+		first, rest, _ := strings.Cut(args, " ")
+		set, err := imap.ParseSeqSet(first)
+		if err != nil {
+			return line, ""
+		}
+		translated, ok := v.upstreamSet(set, uid)
+		switch {
+		case ok:
+			return prefix + translated + " " + rest, ""
+		case uid:
+			return "", fmt.Sprintf("%s OK UID %s completed\r\n", cmd.Tag, verb)
+		default:
+			return "", cmd.Tag + " BAD invalid message sequence number\r\n"
+		}
+	case "SEARCH", "SORT":
+		v.mu.Lock()
+		v.uidSearch = uid
+		v.mu.Unlock()
+		return prefix + v.searchKeys(args, verb == "SORT"), ""
+	case "THREAD":
+		return "", cmd.Tag + " NO THREAD not available for folders with hidden messages\r\n"
+	}
+	return line, ""
+}
+
+// searchKeyArgs is the number of arguments taken by search keys whose
+// arguments could be mistaken for a sequence set.
+var searchKeyArgs = map[string]int{
+	"BCC": 1, "BEFORE": 1, "BODY": 1, "CC": 1, "CHARSET": 1, "FROM": 1,
+	"HEADER": 2, "KEYWORD": 1, "LARGER": 1, "MODSEQ": 1, "OLDER": 1, "ON": 1,
+	"SENTBEFORE": 1, "SENTON": 1, "SENTSINCE": 1, "SINCE": 1, "SMALLER": 1,
+	"SUBJECT": 1, "TEXT": 1, "TO": 1, "UID": 1, "UNKEYWORD": 1, "YOUNGER": 1,
+}
+
+// searchKeys translates the sequence sets in SEARCH or SORT arguments to
+// upstream numbering. A set matching no visible message becomes NOT ALL.
+// UID sets are left alone, since hidden messages are dropped from results.
+func (v *view) searchKeys(args string, sort bool) string {
+	var b strings.Builder
+	skip := 0   // arguments of the previous key still to pass through
+	group := -1 // depth at which a skipped parenthesized group ends
+	depth := 0  // parenthesis nesting
+	copied := 0 // bytes of args already written
+	if sort {
+		group, skip = 0, 1 // the sort criteria, then the charset
+	}
+	for _, tok := range searchTokens(args) {
+		text := args[tok.start:tok.end]
+		switch {
+		case text == "(":
+			depth++
+			continue
+		case text == ")":
+			depth--
+			if depth == group {
+				group = -1
+			}
+			continue
+		case group >= 0:
+			continue
+		case strings.EqualFold(text, "RETURN"):
+			group = depth
+			continue
+		case skip > 0:
+			skip--
+			continue
+		}
+		if n, ok := searchKeyArgs[strings.ToUpper(text)]; ok {
+			skip = n
+			continue
+		}
+		set, err := imap.ParseSeqSet(text)
+		if err != nil {
+			continue
+		}
+		translated, ok := v.upstreamSet(set, false)
+		if !ok {
+			translated = "NOT ALL"
+		}
+		b.WriteString(args[copied:tok.start])
+		b.WriteString(translated)
+		copied = tok.end
+	}
+	b.WriteString(args[copied:])
+	return b.String()
+}
+
+// searchToken is the position of one token in search arguments.
+type searchToken struct{ start, end int }
+
+// searchTokens splits search arguments into atoms, quoted strings and
+// parentheses.
+func searchTokens(s string) []searchToken {
+	var toks []searchToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, searchToken{i, i + 1})
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(s))
+			toks = append(toks, searchToken{i, j})
+			i = j
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" ()\r\n", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, searchToken{i, j})
+			i = j
+		}
+	}
+	return toks
+}
+
+// statusCounts are STATUS items that reveal how many messages a folder
+// holds, including hidden ones.
+var statusCounts = map[string]bool{
+	"MESSAGES": true, "RECENT": true, "UNSEEN": true, "DELETED": true, "SIZE": true,
+}
+
+// stripStatusCounts removes message counts from an untagged STATUS
+// response.
+func stripStatusCounts(line string) string {
+	open := strings.LastIndexByte(line, '(')
+	end := strings.LastIndexByte(line, ')')
+	if open < 0 || end < open {
+		return line
+	}
+	items := strings.Fields(line[open+1 : end])
+	var kept []string
+	for i := 0; i+1 < len(items); i += 2 {
+		if !statusCounts[strings.ToUpper(items[i])] {
+			kept = append(kept, items[i], items[i+1])
+		}
+	}
+	return line[:open+1] + strings.Join(kept, " ") + line[end:]
+}
+
+// visibleResponse applies the account's visibility rules to an untagged
+// upstream response. It reports true if the line must be dropped.
+func (s *Session) visibleResponse(line string) (string, bool) {
+	if v := s.view.Load(); v != nil {
+		translated, keep := v.response(line)
+		if !keep {
+			return "", true
+		}
+		line = translated
+	}
+	if word, _, _ := strings.Cut(strings.TrimPrefix(line, "* "), " "); s.account.HidesMessages() && strings.HasPrefix(line, "* ") && strings.EqualFold(word, "STATUS") {
+		line = stripStatusCounts(line)
+	}
+	return line, false
+}
+
+// forwardVisible forwards a command in a session whose account hides
+// messages, translating message numbers through the selected folder's view.
+func (s *Session) forwardVisible(cmd imap.Command, line []byte) error {
+	switch cmd.Verb {
+	case "SELECT", "EXAMINE":
+		return s.selectView(cmd, line)
+	case "CLOSE", "UNSELECT":
+		s.view.Store(nil)
+		return s.forwardWithLiterals(line)
+	}
+	v := s.view.Load()
+	if v == nil {
+		return s.forwardLimited(cmd, line)
+	}
+	if err := s.refreshView(v); err != nil {
+		return err
+	}
+	translated, reply := v.command(cmd, string(line))
+	if reply != "" {
+		return s.writeClient(reply)
+	}
+	return s.forwardLimited(cmd, []byte(translated))
+}
+
+// selectView selects a folder and builds its view before the client sees
+// the response, so that the announced message count is already the
+// visible one.
+func (s *Session) selectView(cmd imap.Command, line []byte) error {
+	now := time.Now()
+	criteria := VisibilityCriteria(s.account, extractCommandMailbox(cmd), now)
+	if rewritten, virtual, ok := s.virtualSelect(cmd, now); ok {
+		line, criteria = rewritten, virtual
+	}
+	if criteria == "" {
+		s.view.Store(nil)
+		return s.forwardWithLiterals(line)
+	}
+	v := &view{criteria: criteria, loading: true}
+	s.view.Store(v)
+	_, completion, err := s.roundTrip(cmd.Tag, line)
+	if err != nil {
+		return err
+	}
+	if !completedOK(cmd.Tag, completion) {
+		// No folder is selected now. Anything queued may still concern the
+		// previous one, which can no longer be translated.
+		s.view.Store(nil)
+		return s.writeClient(completion)
+	}
+
+	all, err := s.searchUIDs("ALL")
+	var visible []uint32
+	if err == nil {
+		visible, err = s.searchUIDs(v.criteria)
+	}
+	if err != nil {
+		// The folder is selected upstream; an empty view keeps it hidden.
+		v.load(nil, nil)
+		s.logger.Warn("failed to determine visible messages", "err", err)
+		return s.writeClient(cmd.Tag + " NO [UNAVAILABLE] folder temporarily unavailable\r\n")
+	}
+
+	var reply strings.Builder
+	for _, queuedLine := range v.load(all, visible) {
+		if translated, keep := v.response(queuedLine); keep {
+			reply.WriteString(translated)
+		}
+	}
+	n := v.count()
+	messagesHiddenTotal.Add(float64(len(all) - n))
+	fmt.Fprintf(&reply, "* %d EXISTS\r\n%s", n, completion)
+	return s.writeClient(reply.String())
+}
+
+// refreshView classifies messages the upstream announced since the view
+// was built and tells the client about visible ones.
+func (s *Session) refreshView(v *view) error {
+	last, stale := v.stale()
+	if !stale {
+		return nil
+	}
+	newer := fmt.Sprintf("UID %d:*", last+1)
+	all, err := s.searchUIDs(newer)
+	var visible []uint32
+	if err == nil {
+		visible, err = s.searchUIDs(newer + " " + v.criteria)
+	}
+	if err != nil {
+		s.logger.Warn("failed to classify new messages", "err", err)
+		return nil
+	}
+	if n, grew := v.extend(all, visible); grew {
+		return s.writeClient(fmt.Sprintf("* %d EXISTS\r\n", n))
+	}
+	return nil
+}
+
+// writeClient writes proxy-generated responses to the client without
+// interleaving them with relayed ones.
+func (s *Session) writeClient(text string) error {
+	s.out.Lock()
+	defer s.out.Unlock()
+	_, err := io.WriteString(s.out, text)
+	return err
+}
@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+)
+
+// newTestView returns a view of upstream UIDs 10-14 where 11 and 13 are
+// hidden.
+func newTestView() *view {
+	v := &view{loading: true}
+	v.load([]uint32{10, 11, 12, 13, 14}, []uint32{10, 12, 14})
+	return v
+}
+
+func TestVisibilityCriteria(t *testing.T) {
+	now := time.Date(2024, time.March, 31, 12, 0, 0, 0, time.UTC)
+	acct := &config.AccountConfig{
+		HideOlderThanDays: 30,
+		HideFrom:          []string{"hr@example.com", `a"b`},
+		MaxAgeDays:        map[string]int{"Archive": 366, "Legal": 0},
+	}
+	tests := []struct {
+		folder string
+		want   string
+	}{
+		{"INBOX", `SINCE 1-Mar-2024 NOT FROM "hr@example.com" NOT FROM "a\"b"`},
+		{"Archive", `SINCE 31-Mar-2023 NOT FROM "hr@example.com" NOT FROM "a\"b"`},
+		{"Legal", `NOT FROM "hr@example.com" NOT FROM "a\"b"`},
+	}
+	for _, tt := range tests {
+		if got := VisibilityCriteria(acct, tt.folder, now); got != tt.want {
+			t.Errorf("VisibilityCriteria(%q) = %q, want %q", tt.folder, got, tt.want)
+		}
+	}
+
+	acct = &config.AccountConfig{MaxAgeDays: map[string]int{"Archive": 30}}
+	if got := VisibilityCriteria(acct, "INBOX", now); got != "" {
+		t.Errorf("VisibilityCriteria(INBOX) = %q, want none", got)
+	}
+}
+
+func TestViewUpstreamSet(t *testing.T) {
+	v := newTestView()
+	tests := []struct {
+		set  string
+		uid  bool
+		want string
+		ok   bool
+	}{
+		{set: "1:*", want: "1,3,5", ok: true},
+		{set: "2", want: "3", ok: true},
+		{set: "*", want: "5", ok: true},
+		{set: "4:*", want: "5", ok: true}, // n:* always includes the last message
+		{set: "1:*", uid: true, want: "10,12,14", ok: true},
+		{set: "11", uid: true, ok: false},
+		{set: "12:13", uid: true, want: "12", ok: true},
+		{set: "100:*", uid: true, want: "14", ok: true},
+	}
+	for _, tt := range tests {
+		set, err := imap.ParseSeqSet(tt.set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := v.upstreamSet(set, tt.uid)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("upstreamSet(%q, uid=%v) = %q, %v; want %q, %v", tt.set, tt.uid, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// Adjacent visible messages collapse into ranges.
+	v = &view{loading: true}
+	v.load([]uint32{1, 2, 3, 4, 5, 6}, []uint32{1, 2, 3, 5, 6})
+	set, _ := imap.ParseSeqSet("1:*")
+	if got, _ := v.upstreamSet(set, false); got != "1:3,5:6" {
+		t.Errorf("upstreamSet collapsed = %q, want 1:3,5:6", got)
+	}
+}
+
+func TestViewResponse(t *testing.T) {
+	v := newTestView()
+	tests := []struct {
+		line string
+		uid  bool // a UID SEARCH is outstanding
+		want string
+		keep bool
+	}{
+		{line: "* 3 FETCH (FLAGS (\\Seen))\r\n", want: "* 2 FETCH (FLAGS (\\Seen))\r\n", keep: true},
+		{line: "* 2 FETCH (FLAGS ())\r\n", keep: false},
+		{line: "* 5 FETCH (BODY[] {12}\r\n", want: "* 3 FETCH (BODY[] {12}\r\n", keep: true},
+		{line: "* SEARCH 1 2 3 5\r\n", want: "* SEARCH 1 2 3\r\n", keep: true},
+		{line: "* SEARCH 10 11 14\r\n", uid: true, want: "* SEARCH 10 14\r\n", keep: true},
+		{line: "* SEARCH\r\n", want: "* SEARCH\r\n", keep: true},
+		{line: "* SEARCH 3 1 (MODSEQ 9)\r\n", want: "* SEARCH 2 1 (MODSEQ 9)\r\n", keep: true},
+		{line: "* SORT 5 1\r\n", want: "* SORT 3 1\r\n", keep: true},
+		{line: "* ESEARCH (TAG \"A1\") ALL 1:5\r\n", keep: false},
+		{line: "* OK [UNSEEN 2] first unseen\r\n", keep: false},
+		{line: "* 1 RECENT\r\n", keep: false},
+		{line: "* FLAGS (\\Seen)\r\n", want: "* FLAGS (\\Seen)\r\n", keep: true},
+		{line: "A1 OK done\r\n", want: "A1 OK done\r\n", keep: true},
+	}
+	for _, tt := range tests {
+		v.uidSearch = tt.uid
+		got, keep := v.response(tt.line)
+		if got != tt.want || keep != tt.keep {
+			t.Errorf("response(%q) = %q, %v; want %q, %v", tt.line, got, keep, tt.want, tt.keep)
+		}
+	}
+}
+
+func TestViewExpungeAndExists(t *testing.T) {
+	v := newTestView()
+	steps := []struct {
+		line string
+		want string
+		keep bool
+	}{
+		{"* 2 EXPUNGE\r\n", "", false},               // UID 11, hidden
+		{"* 2 EXPUNGE\r\n", "* 2 EXPUNGE\r\n", true}, // UID 12, client message 2
+		{"* 4 EXISTS\r\n", "", false},                // one new, unclassified message
+		{"* 4 FETCH (FLAGS ())\r\n", "", false},      // the new message is not visible yet
+		{"* 1 EXPUNGE\r\n", "* 1 EXPUNGE\r\n", true}, // UID 10
+	}
+	for i, st := range steps {
+		got, keep := v.response(st.line)
+		if got != st.want || keep != st.keep {
+			t.Errorf("step %d: response(%q) = %q, %v; want %q, %v", i, st.line, got, keep, st.want, st.keep)
+		}
+	}
+	last, stale := v.stale()
+	if !stale || last != 14 {
+		t.Fatalf("stale() = %d, %v; want 14, true", last, stale)
+	}
+	if n, grew := v.extend([]uint32{14, 20}, []uint32{20}); n != 2 || !grew {
+		t.Errorf("extend = %d, %v; want 2, true", n, grew)
+	}
+	if _, stale := v.stale(); stale {
+		t.Error("view still stale after extend")
+	}
+}
+
+func TestViewCommand(t *testing.T) {
+	v := newTestView()
+	tests := []struct {
+		line    string
+		forward string
+		reply   string
+	}{
+		{"A1 FETCH 1:* (FLAGS)\r\n", "A1 FETCH 1,3,5 (FLAGS)\r\n", ""},
+		{"A1 UID FETCH 1:* (FLAGS)\r\n", "A1 UID FETCH 10,12,14 (FLAGS)\r\n", ""},
+		{"A1 FETCH 9 (FLAGS)\r\n", "", "A1 BAD invalid message sequence number\r\n"},
+		{"A1 UID FETCH 11 (FLAGS)\r\n", "", "A1 OK UID FETCH completed\r\n"},
+		{"A1 SEARCH 2:3 UNSEEN\r\n", "A1 SEARCH 3,5 UNSEEN\r\n", ""},
+		{"A1 SEARCH LARGER 2 FROM \"3\" (OR 1 9)\r\n", "A1 SEARCH LARGER 2 FROM \"3\" (OR 1 NOT ALL)\r\n", ""},
+		{"A1 UID SEARCH UID 11:13 2\r\n", "A1 UID SEARCH UID 11:13 3\r\n", ""},
+		{"A1 SEARCH RETURN (MIN 2) 2\r\n", "A1 SEARCH RETURN (MIN 2) 3\r\n", ""},
+		{"A1 SORT (DATE) UTF-8 1:2\r\n", "A1 SORT (DATE) UTF-8 1,3\r\n", ""},
+		{"A1 THREAD REFERENCES UTF-8 ALL\r\n", "", "A1 NO THREAD not available for folders with hidden messages\r\n"},
+		{"A1 LIST \"\" *\r\n", "A1 LIST \"\" *\r\n", ""},
+	}
+	for _, tt := range tests {
+		cmd, err := imap.ParseCommand([]byte(tt.line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		forward, reply := v.command(cmd, tt.line)
+		if forward != tt.forward || reply != tt.reply {
+			t.Errorf("command(%q) = %q, %q; want %q, %q", tt.line, forward, reply, tt.forward, tt.reply)
+		}
+	}
+}
+
+func TestStripStatusCounts(t *testing.T) {
+	got := stripStatusCounts("* STATUS \"Shared (old)\" (MESSAGES 12 UIDNEXT 44 UNSEEN 3 UIDVALIDITY 7)\r\n")
+	want := "* STATUS \"Shared (old)\" (UIDNEXT 44 UIDVALIDITY 7)\r\n"
+	if got != want {
+		t.Errorf("stripStatusCounts = %q, want %q", got, want)
+	}
+}
+
+// newViewEnv starts a session for an account with the settings applied by
+// modify. Every upstream folder holds UIDs 10-14; searching NOT FROM
+// hides 11 and 13, searching SINCE hides 10-12, a parenthesized search
+// finds 11 and 12, and all messages are LARGER than any size. Each NOOP returns the next entry of noops.
+func newViewEnv(t *testing.T, modify func(*config.AccountConfig), noops ...string) *integrationEnv {
+	t.Helper()
+	cfg := testConfig()
+	modify(&cfg.Accounts[0])
+	received := make(chan string, 100)
+	env := newIntegrationEnvWithConfig(t, cfg, func(s *Session) {
+		s.dialUpstream = func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+			upClient, upServer := net.Pipe()
+			go serveViewUpstream(upServer, noops, received)
+			return upClient, bufio.NewReader(upClient), nil
+		}
+	})
+	env.received = received
+	return env
+}
+
+func serveViewUpstream(conn net.Conn, noops []string, received chan<- string) {
+	defer conn.Close()
+	sr := bufio.NewReader(conn)
+	uids := []uint32{10, 11, 12, 13, 14}
+	for {
+		line, err := sr.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		received <- line
+		tag, rest, _ := strings.Cut(line, " ")
+		upper := strings.ToUpper(rest)
+		switch {
+		case strings.HasPrefix(upper, "EXAMINE"):
+			fmt.Fprintf(conn, "* FLAGS (\\Seen)\r\n* 5 EXISTS\r\n* 0 RECENT\r\n* OK [UNSEEN 2] first unseen\r\n* OK [UIDVALIDITY 1] ok\r\n%s OK [READ-ONLY] done\r\n", tag)
+			continue
+		case strings.Contains(upper, "NOT LARGER"):
+			fmt.Fprint(conn, "* SEARCH\r\n")
+		case upper == "UID SEARCH ALL":
+			fmt.Fprint(conn, "* SEARCH 10 11 12 13 14\r\n")
+		case strings.HasPrefix(upper, "UID SEARCH UID 15:*"):
+			fmt.Fprint(conn, "* SEARCH 15\r\n")
+		case strings.HasPrefix(upper, "UID SEARCH NOT FROM"):
+			fmt.Fprint(conn, "* SEARCH 10 12 14\r\n")
+		case strings.HasPrefix(upper, "UID SEARCH SINCE"):
+			fmt.Fprint(conn, "* SEARCH 13 14\r\n")
+		case strings.HasPrefix(upper, "UID SEARCH ("):
+			fmt.Fprint(conn, "* SEARCH 11 12\r\n")
+		case strings.HasPrefix(upper, "LIST"):
+			fmt.Fprint(conn, "* LIST () \"/\" INBOX\r\n")
+		case strings.HasPrefix(upper, "UID SEARCH"):
+			fmt.Fprint(conn, "* SEARCH 10 11 12 13 14\r\n")
+		case strings.HasPrefix(upper, "SEARCH"):
+			fmt.Fprint(conn, "* SEARCH 1 2 3 4 5\r\n")
+		case strings.HasPrefix(upper, "FETCH"):
+			set, _ := imap.ParseSeqSet(strings.Fields(rest)[1])
+			for i, uid := range uids {
+				if set.Contains(uint32(i+1), uint32(len(uids))) {
+					fmt.Fprintf(conn, "* %d FETCH (UID %d)\r\n", i+1, uid)
+				}
+			}
+		case upper == "NOOP" && len(noops) > 0:
+			fmt.Fprint(conn, noops[0])
+			noops = noops[1:]
+		}
+		fmt.Fprintf(conn, "%s OK completed\r\n", tag)
+	}
+}
+
+func TestHiddenMessagesRenumbered(t *testing.T) {
+	env := newViewEnv(t, func(acct *config.AccountConfig) {
+		acct.HideFrom = []string{"hr@example.com"}
+	}, "* 6 EXISTS\r\n", "* 2 EXPUNGE\r\n* 2 EXPUNGE\r\n")
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 EXAMINE INBOX\r\n")
+	env.expectUpstream(t, "A002 EXAMINE")
+	env.expectUpstream(t, "UID SEARCH ALL")
+	env.expectUpstream(t, `UID SEARCH NOT FROM "hr@example.com"`)
+	want := []string{"* FLAGS (\\Seen)\r\n", "* OK [UIDVALIDITY 1] ok\r\n", "* 3 EXISTS\r\n"}
+	lines := env.readUntilTagged(t, "A002")
+	if len(lines) != 4 || strings.Join(lines[:3], "") != strings.Join(want, "") || !strings.HasPrefix(lines[3], "A002 OK") {
+		t.Fatalf("EXAMINE response = %q, want %q and the completion", lines, want)
+	}
+
+	env.send(t, "A003 FETCH 1:* (UID)\r\n")
+	env.expectUpstream(t, "A003 FETCH 1,3,5 (UID)")
+	lines = env.readUntilTagged(t, "A003")
+	want = []string{"* 1 FETCH (UID 10)\r\n", "* 2 FETCH (UID 12)\r\n", "* 3 FETCH (UID 14)\r\n"}
+	if strings.Join(lines[:len(lines)-1], "") != strings.Join(want, "") {
+		t.Fatalf("FETCH response = %q, want %q", lines, want)
+	}
+
+	env.send(t, "A004 SEARCH ALL\r\n")
+	env.expectUpstream(t, "A004 SEARCH ALL")
+	if lines := env.readUntilTagged(t, "A004"); lines[0] != "* SEARCH 1 2 3\r\n" {
+		t.Fatalf("SEARCH response = %q", lines)
+	}
+	env.send(t, "A005 UID SEARCH ALL\r\n")
+	env.expectUpstream(t, "A005 UID SEARCH ALL")
+	if lines := env.readUntilTagged(t, "A005"); lines[0] != "* SEARCH 10 12 14\r\n" {
+		t.Fatalf("UID SEARCH response = %q", lines)
+	}
+
+	// A new message is classified before the next command and announced
+	// with the visible count.
+	env.send(t, "A006 NOOP\r\n")
+	env.expectUpstream(t, "A006 NOOP")
+	if lines := env.readUntilTagged(t, "A006"); len(lines) != 1 {
+		t.Fatalf("NOOP response = %q, want only the completion", lines)
+	}
+	env.send(t, "A007 NOOP\r\n")
+	env.expectUpstream(t, "UID SEARCH UID 15:*")
+	env.expectUpstream(t, `UID SEARCH UID 15:* NOT FROM "hr@example.com"`)
+	if line := env.readLine(t); line != "* 4 EXISTS\r\n" {
+		t.Fatalf("got %q, want the new visible count", line)
+	}
+	env.expectUpstream(t, "A007 NOOP")
+	// Of the two expunged messages only the visible one is reported.
+	lines = env.readUntilTagged(t, "A007")
+	if len(lines) != 2 || lines[0] != "* 2 EXPUNGE\r\n" {
+		t.Fatalf("NOOP response = %q, want one EXPUNGE", lines)
+	}
+
+	env.send(t, "A008 IDLE\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A008 NO") {
+		t.Fatalf("IDLE response = %q, want NO", line)
+	}
+	env.noUpstream(t)
+}
+
+func TestFolderMaxAge(t *testing.T) {
+	env := newViewEnv(t, func(acct *config.AccountConfig) {
+		acct.MaxAgeDays = map[string]int{"Archive": 30}
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	// INBOX has no age limit and is relayed as usual.
+	env.send(t, "A002 EXAMINE INBOX\r\n")
+	env.expectUpstream(t, "A002 EXAMINE")
+	if lines := env.readUntilTagged(t, "A002"); lines[1] != "* 5 EXISTS\r\n" {
+		t.Fatalf("EXAMINE INBOX response = %q, want the upstream count", lines)
+	}
+	env.noUpstream(t)
+
+	env.send(t, "A003 EXAMINE Archive\r\n")
+	env.expectUpstream(t, "A003 EXAMINE")
+	env.expectUpstream(t, "UID SEARCH ALL")
+	env.expectUpstream(t, "UID SEARCH SINCE")
+	lines := env.readUntilTagged(t, "A003")
+	if lines[len(lines)-2] != "* 2 EXISTS\r\n" {
+		t.Fatalf("EXAMINE Archive response = %q, want 2 EXISTS", lines)
+	}
+
+	env.send(t, "A004 UID FETCH 1:* (UID)\r\n")
+	env.expectUpstream(t, "A004 UID FETCH 13:14 (UID)")
+	env.readUntilTagged(t, "A004")
+}
+
+func TestHiddenFetchLiteralDropped(t *testing.T) {
+	env := newViewEnv(t, func(acct *config.AccountConfig) {
+		acct.HideFrom = []string{"hr@example.com"}
+	}, "* 2 FETCH (BODY[TEXT] {5}\r\nhello)\r\n")
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 EXAMINE INBOX\r\n")
+	env.readUntilTagged(t, "A002")
+	env.drainUpstream(t)
+
+	// The hidden message's response is dropped whole, including the part
+	// after its literal.
+	env.send(t, "A003 NOOP\r\n")
+	if lines := env.readUntilTagged(t, "A003"); len(lines) != 1 {
+		t.Fatalf("NOOP response = %q, want only the completion", lines)
+	}
+}
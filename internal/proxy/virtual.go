@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/imap"
+)
+
+// virtualDelimiter is the hierarchy delimiter announced for virtual
+// folders in LIST responses.
+const virtualDelimiter = '/'
+
+// usesViews reports whether selected folders may need a view: the account
+// hides messages or has virtual folders.
+func (s *Session) usesViews() bool {
+	return s.account.HidesMessages() || len(s.account.VirtualFolders) > 0
+}
+
+// forwardVirtual handles LIST and STATUS for accounts with virtual
+// folders. It reports false for other commands.
+func (s *Session) forwardVirtual(cmd imap.Command, line []byte) (bool, error) {
+	switch cmd.Verb {
+	case "LIST":
+		return true, s.listVirtual(cmd, line)
+	case "STATUS":
+		mailbox := extractCommandMailbox(cmd)
+		if s.account.VirtualFolder(mailbox) == nil {
+			return false, nil
+		}
+		// Counts would require selecting the folder; an empty STATUS
+		// response is valid and tells the client nothing.
+		return true, s.writeClient(fmt.Sprintf("* STATUS %s ()\r\n%s OK STATUS completed\r\n",
+			imap.Quote(mailbox), cmd.Tag))
+	}
+	return false, nil
+}
+
+// listVirtual forwards a LIST and adds the virtual folders matching its
+// pattern to a successful response. Extended LIST commands are forwarded
+// unchanged.
+func (s *Session) listVirtual(cmd imap.Command, line []byte) error {
+	ref, pattern, ok := listArgs(string(line))
+	if !ok {
+		return s.forwardWithLiterals(line)
+	}
+	_, completion, err := s.roundTrip(cmd.Tag, line)
+	if err != nil {
+		return err
+	}
+	var reply strings.Builder
+	if completedOK(cmd.Tag, completion) {
+		for _, vf := range s.account.VirtualFolders {
+			if listMatch(ref+pattern, vf.Name, virtualDelimiter) && s.account.FolderAllowed(vf.Name) {
+				fmt.Fprintf(&reply, "* LIST (\\HasNoChildren) \"%c\" %s\r\n", virtualDelimiter, imap.Quote(vf.Name))
+			}
+		}
+	}
+	reply.WriteString(completion)
+	return s.writeClient(reply.String())
+}
+
+// listArgs returns the reference and pattern of a basic LIST command.
+func listArgs(line string) (ref, pattern string, ok bool) {
+	parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(parts) < 3 || parts[2] == "" || parts[2][0] == '(' {
+		return "", "", false
+	}
+	ref, rest, err := parseOneArg(parts[2])
+	rest = strings.TrimPrefix(rest, " ")
+	if err != nil || rest == "" || strings.HasPrefix(rest, "{") {
+		return "", "", false
+	}
+	pattern, rest, err = parseOneArg(rest)
+	if err != nil || rest != "" {
+		return "", "", false
+	}
+	return ref, pattern, true
+}
+
+// listMatch reports whether a mailbox name matches a LIST pattern, where
+// "*" matches anything and "%" anything but the hierarchy delimiter.
+func listMatch(pattern, name string, delim byte) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '%':
+			for j := 0; j <= len(name); j++ {
+				if listMatch(pattern[i+1:], name[j:], delim) {
+					return true
+				}
+				if j < len(name) && c == '%' && name[j] == delim {
+					return false
+				}
+			}
+			return false
+		default:
+			if name == "" || name[0] != c {
+				return false
+			}
+			name = name[1:]
+		}
+	}
+	return name == ""
+}
+
+// virtualSelect rewrites a SELECT or EXAMINE of a virtual folder into an
+// EXAMINE of its upstream folder and returns the search keys its view is
+// built from, including the account's visibility rules for that folder.
+// It reports false for other mailboxes.
+func (s *Session) virtualSelect(cmd imap.Command, now time.Time) (line []byte, criteria string, ok bool) {
+	vf := s.account.VirtualFolder(extractCommandMailbox(cmd))
+	if vf == nil {
+		return nil, "", false
+	}
+	line = fmt.Appendf(nil, "%s EXAMINE %s\r\n", cmd.Tag, imap.Quote(vf.Folder))
+	criteria = strings.TrimSpace("(" + vf.Search + ") " + VisibilityCriteria(s.account, vf.Folder, now))
+	return line, criteria, true
+}
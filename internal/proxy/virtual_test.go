@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"imap-proxy/internal/config"
+)
+
+func TestListMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "Virtual/Invoices", true},
+		{"%", "Virtual/Invoices", false},
+		{"Virtual/%", "Virtual/Invoices", true},
+		{"Virtual/*", "Virtual/Invoices", true},
+		{"V*s", "Virtual/Invoices", true},
+		{"%/Inv%", "Virtual/Invoices", true},
+		{"Virtual", "Virtual/Invoices", false},
+		{"Virtual/Invoices", "Virtual/Invoices", true},
+		{"", "Virtual/Invoices", false},
+	}
+	for _, tt := range tests {
+		if got := listMatch(tt.pattern, tt.name, '/'); got != tt.want {
+			t.Errorf("listMatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestListArgs(t *testing.T) {
+	tests := []struct {
+		line         string
+		ref, pattern string
+		ok           bool
+	}{
+		{"A1 LIST \"\" *\r\n", "", "*", true},
+		{"A1 LIST \"Virtual/\" \"%\"\r\n", "Virtual/", "%", true},
+		{"A1 LIST (SUBSCRIBED) \"\" *\r\n", "", "", false},
+		{"A1 LIST \"\" * RETURN (CHILDREN)\r\n", "", "", false},
+		{"A1 LIST \"\" {1}\r\n", "", "", false},
+		{"A1 LIST\r\n", "", "", false},
+	}
+	for _, tt := range tests {
+		ref, pattern, ok := listArgs(tt.line)
+		if ref != tt.ref || pattern != tt.pattern || ok != tt.ok {
+			t.Errorf("listArgs(%q) = %q, %q, %v; want %q, %q, %v", tt.line, ref, pattern, ok, tt.ref, tt.pattern, tt.ok)
+		}
+	}
+}
+
+func TestVirtualFolder(t *testing.T) {
+	env := newViewEnv(t, func(acct *config.AccountConfig) {
+		acct.VirtualFolders = []config.VirtualFolder{{Name: "Virtual/Invoices", Folder: "INBOX", Search: `FROM "billing@"`}}
+	})
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 LIST \"\" *\r\n")
+	env.expectUpstream(t, "A002 LIST")
+	lines := env.readUntilTagged(t, "A002")
+	want := []string{"* LIST () \"/\" INBOX\r\n", "* LIST (\\HasNoChildren) \"/\" \"Virtual/Invoices\"\r\n", "A002 OK completed\r\n"}
+	if strings.Join(lines, "") != strings.Join(want, "") {
+		t.Fatalf("LIST response = %q, want %q", lines, want)
+	}
+	env.send(t, "A003 LIST \"\" %\r\n")
+	env.expectUpstream(t, "A003 LIST")
+	if lines := env.readUntilTagged(t, "A003"); len(lines) != 2 {
+		t.Fatalf("LIST %% response = %q, want no virtual folder", lines)
+	}
+
+	env.send(t, "A004 STATUS Virtual/Invoices (MESSAGES)\r\n")
+	if lines := env.readUntilTagged(t, "A004"); lines[0] != "* STATUS \"Virtual/Invoices\" ()\r\n" {
+		t.Fatalf("STATUS response = %q", lines)
+	}
+	env.noUpstream(t)
+
+	env.send(t, "A005 SELECT Virtual/Invoices\r\n")
+	env.expectUpstream(t, `A005 EXAMINE "INBOX"`)
+	env.expectUpstream(t, "UID SEARCH ALL")
+	env.expectUpstream(t, `UID SEARCH (FROM "billing@")`)
+	lines = env.readUntilTagged(t, "A005")
+	if lines[len(lines)-2] != "* 2 EXISTS\r\n" {
+		t.Fatalf("SELECT response = %q, want 2 EXISTS", lines)
+	}
+
+	env.send(t, "A006 FETCH 1:* (UID)\r\n")
+	env.expectUpstream(t, "A006 FETCH 2:3 (UID)")
+	lines = env.readUntilTagged(t, "A006")
+	want = []string{"* 1 FETCH (UID 11)\r\n", "* 2 FETCH (UID 12)\r\n", "A006 OK completed\r\n"}
+	if strings.Join(lines, "") != strings.Join(want, "") {
+		t.Fatalf("FETCH response = %q, want %q", lines, want)
+	}
+}
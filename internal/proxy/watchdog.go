@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"imap-proxy/internal/metrics"
+)
+
+var stuckSessionsTotal = metrics.Default.NewCounter("imap_proxy_stuck_sessions_terminated_total",
+	"Sessions terminated by the watchdog after making no progress.")
+
+// activityConn records the time of every successful read or write, and
+// counts the bytes in stats.
+type activityConn struct {
+	net.Conn
+	last  *atomic.Int64
+	stats *sessionStats
+}
+
+func (c *activityConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+		c.stats.bytesIn.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+		c.stats.bytesOut.Add(int64(n))
+	}
+	return n, err
+}
+
+// runWatchdog terminates the session once it has been inactive for longer
+// than timeout. Sessions in IDLE are exempt, since silence is expected there.
+// It returns when done is closed.
+func (s *Session) runWatchdog(timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(max(timeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if s.idling.Load() {
+				continue
+			}
+			inactive := time.Since(time.Unix(0, s.lastActivity.Load()))
+			if inactive < timeout {
+				continue
+			}
+			s.mu.Lock()
+			logger := s.logger
+			s.mu.Unlock()
+			logger.Warn("terminating stuck session", "inactive", inactive.Round(time.Millisecond))
+			stuckSessionsTotal.Inc()
+			s.terminate()
+			return
+		}
+	}
+}
+
+// terminate closes both legs of the session, unblocking any pending reads
+// or writes in the relay goroutines.
+func (s *Session) terminate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientConn.Close()
+	if s.upstreamConn != nil {
+		s.upstreamConn.Close()
+	}
+}
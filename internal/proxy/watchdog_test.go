@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdogTerminatesStuckSession(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.StuckSessionTimeout = 100 * time.Millisecond
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	before := stuckSessionsTotal.Value()
+
+	// Stay silent; the proxy should close the connection.
+	_, err := env.clientR.ReadString('\n')
+	if err != io.EOF {
+		t.Fatalf("expected EOF after watchdog timeout, got: %v", err)
+	}
+	if got := stuckSessionsTotal.Value(); got != before+1 {
+		t.Errorf("stuck sessions counter = %v, want %v", got, before+1)
+	}
+}
+
+func TestWatchdogActivityKeepsSessionAlive(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.StuckSessionTimeout = 150 * time.Millisecond
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(60 * time.Millisecond)
+		env.send(t, "A002 NOOP\r\n")
+		env.drainUpstream(t)
+		if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+			t.Fatalf("unexpected response: %q", line)
+		}
+	}
+}
+
+func TestWatchdogIgnoresIdle(t *testing.T) {
+	cfg := testConfig()
+	cfg.Server.StuckSessionTimeout = 100 * time.Millisecond
+	env := newIntegrationEnvWithConfig(t, cfg)
+	defer env.clientConn.Close()
+	env.login(t)
+
+	env.send(t, "A002 IDLE\r\n")
+	env.expectUpstream(t, "IDLE")
+	if line := env.readLine(t); !strings.HasPrefix(line, "+") {
+		t.Fatalf("expected continuation, got: %q", line)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+
+	env.send(t, "DONE\r\n")
+	if line := env.readLine(t); !strings.HasPrefix(line, "A002 OK") {
+		t.Fatalf("expected IDLE completion, got: %q", line)
+	}
+}
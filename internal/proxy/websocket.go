@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is the fixed suffix of the Sec-WebSocket-Accept hash (RFC 6455
+// section 1.3).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsSubprotocol is the WebSocket subprotocol name for IMAP.
+const wsSubprotocol = "imap"
+
+// wsMaxControlPayload is the largest payload a control frame may carry.
+const wsMaxControlPayload = 125
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var errWSProtocol = errors.New("websocket protocol error")
+
+// WebSocketHandler returns an HTTP handler that upgrades requests to
+// WebSocket and runs an IMAP session over them. Data frames carry the
+// IMAP stream in both directions; frame boundaries carry no meaning.
+//
+// The session is treated as encrypted when the HTTP request arrived over
+// TLS. STARTTLS is not offered inside the tunnel.
+func (s *Server) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(s.serveWebSocket)
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	offered := r.Header.Values("Sec-WebSocket-Protocol")
+	if len(offered) > 0 && !headerHasToken(r.Header, "Sec-WebSocket-Protocol", wsSubprotocol) {
+		http.Error(w, "subprotocol imap required", http.StatusBadRequest)
+		return
+	}
+	release, reason := s.admit.admit()
+	if release == nil {
+		connectionsShedTotal.Inc(reason)
+		s.logger.Warn("connection shed: server saturated", "client", r.RemoteAddr, "reason", reason, "websocket", true)
+		http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	raw, rw, err := hj.Hijack()
+	if err != nil {
+		s.logger.Warn("websocket hijack failed", "client", r.RemoteAddr, "err", err)
+		return
+	}
+	raw.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if len(offered) > 0 {
+		fmt.Fprintf(rw, "Sec-WebSocket-Protocol: %s\r\n", wsSubprotocol)
+	}
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		raw.Close()
+		return
+	}
+	conn := &wsConn{Conn: raw, r: rw.Reader}
+
+	// A connection from LimitListener has been checked and counted once
+	// already.
+	if !connChecked(raw) && !s.allowConn(conn, clientIP(conn), protoIMAP) {
+		return
+	}
+	sess := NewSession(conn, s.config, s.logger)
+	sess.logger.Info("new connection", "client", conn.RemoteAddr(), "tls", r.TLS != nil, "websocket", true)
+	sess.shared = s.shared
+	sess.tlsActive = r.TLS != nil
+	sess.releaseUnauth = release
+	sess.Run()
+}
+
+// headerHasToken reports whether the comma-separated values of header
+// name include token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a server-side WebSocket connection presented as a byte
+// stream. Reads return the payload of client data frames and answer
+// control frames; each Write is sent as one binary frame.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// Read state: the unread payload of the current data frame.
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+	closed    bool // a close frame was received
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame with payload begins,
+// handling control frames on the way.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0f
+	if hdr[0]&0x70 != 0 || hdr[1]&0x80 == 0 {
+		// Reserved bits need an extension we never negotiate, and client
+		// frames must be masked.
+		c.writeClose(1002)
+		return errWSProtocol
+	}
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining = length
+		return nil
+	case wsClose, wsPing, wsPong:
+		if length > wsMaxControlPayload || hdr[0]&0x80 == 0 {
+			c.writeClose(1002)
+			return errWSProtocol
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		case wsClose:
+			c.closed = true
+			c.writeClose(1000)
+		}
+		return nil
+	default:
+		c.writeClose(1002)
+		return errWSProtocol
+	}
+}
+
+func (c *wsConn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends one unfragmented, unmasked frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closeSent = true
+	}
+	hdr := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = binary.BigEndian.AppendUint16(append(hdr, 126), uint16(n))
+	default:
+		hdr = binary.BigEndian.AppendUint64(append(hdr, 127), uint64(n))
+	}
+	_, err := c.Conn.Write(slices.Concat(hdr, payload))
+	return err
+}
+
+// writeClose sends a close frame with status code, once.
+func (c *wsConn) writeClose(code uint16) {
+	c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// Close sends a normal close frame and closes the connection.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeClose(1000)
+	return c.Conn.Close()
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClient is the client end of a test WebSocket connection.
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialWS connects to srv and performs the opening handshake with the given
+// extra request headers. It returns the client and the response status
+// line and headers.
+func dialWS(t *testing.T, srv *httptest.Server, headers string) (*wsClient, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /imap HTTP/1.1\r\nHost: proxy\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n%s\r\n", headers)
+	r := bufio.NewReader(conn)
+	var resp strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading handshake: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		resp.WriteString(line)
+	}
+	return &wsClient{conn: conn, r: r}, resp.String()
+}
+
+// send writes a masked frame.
+func (c *wsClient) send(t *testing.T, first byte, payload string) {
+	t.Helper()
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i := range len(payload) {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recv reads one unmasked frame and returns its opcode and payload.
+func (c *wsClient) recv(t *testing.T) (byte, string) {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	if hdr[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+	n := int(hdr[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+	return hdr[0] & 0x0f, string(payload)
+}
+
+// recvText reads binary frames until their payloads end with a line
+// starting with tag.
+func (c *wsClient) recvText(t *testing.T, tag string) string {
+	t.Helper()
+	var text strings.Builder
+	for {
+		op, payload := c.recv(t)
+		if op != wsBinary {
+			t.Fatalf("opcode %#x, want binary", op)
+		}
+		text.WriteString(payload)
+		lines := strings.Split(strings.TrimSuffix(text.String(), "\r\n"), "\r\n")
+		if strings.HasPrefix(lines[len(lines)-1], tag) && strings.HasSuffix(payload, "\r\n") {
+			return text.String()
+		}
+	}
+}
+
+func newWSServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(NewServer(testConfig(), testLogger()).WebSocketHandler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWebSocketSession(t *testing.T) {
+	c, resp := dialWS(t, newWSServer(t), "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: chat, imap\r\n")
+	for _, want := range []string{"HTTP/1.1 101", "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", "Sec-WebSocket-Protocol: imap"} {
+		if !strings.Contains(resp, want) {
+			t.Fatalf("handshake response lacks %q:\n%s", want, resp)
+		}
+	}
+	if got := c.recvText(t, "* OK"); got != "* OK imap-proxy ready\r\n" {
+		t.Fatalf("greeting = %q", got)
+	}
+
+	// A command split across a fragmented text message, with a ping in
+	// between.
+	c.send(t, wsText, "a1 CAPA")
+	c.send(t, 0x80|wsPing, "hi")
+	c.send(t, 0x80|wsContinuation, "BILITY\r\n")
+	if op, payload := c.recv(t); op != wsPong || payload != "hi" {
+		t.Fatalf("got opcode %#x %q, want pong", op, payload)
+	}
+	got := c.recvText(t, "a1 ")
+	if !strings.Contains(got, "* CAPABILITY IMAP4rev1") || strings.Contains(got, "STARTTLS") {
+		t.Errorf("CAPABILITY = %q, want no STARTTLS inside the tunnel", got)
+	}
+
+	c.send(t, 0x80|wsBinary, "a2 LOGOUT\r\n")
+	if got := c.recvText(t, "a2 "); !strings.Contains(got, "* BYE") {
+		t.Errorf("LOGOUT = %q", got)
+	}
+	if op, payload := c.recv(t); op != wsClose || payload != "\x03\xe8" {
+		t.Errorf("got opcode %#x %q, want close 1000", op, payload)
+	}
+}
+
+func TestWebSocketClientClose(t *testing.T) {
+	c, _ := dialWS(t, newWSServer(t), "Sec-WebSocket-Version: 13\r\n")
+	c.recvText(t, "* OK")
+	c.send(t, 0x80|wsClose, "\x03\xe8")
+	if op, _ := c.recv(t); op != wsClose {
+		t.Fatalf("opcode %#x, want close", op)
+	}
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("read after close = %v, want EOF", err)
+	}
+}
+
+func TestWebSocketUnmaskedFrame(t *testing.T) {
+	c, _ := dialWS(t, newWSServer(t), "Sec-WebSocket-Version: 13\r\n")
+	c.recvText(t, "* OK")
+	c.conn.Write([]byte{0x80 | wsBinary, 2, 'a', 'b'})
+	if op, payload := c.recv(t); op != wsClose || payload != "\x03\xea" {
+		t.Errorf("got opcode %#x %q, want close 1002", op, payload)
+	}
+}
+
+func TestWebSocketHandshakeRefused(t *testing.T) {
+	srv := newWSServer(t)
+	tests := []struct {
+		headers string
+		status  int
+	}{
+		{"", http.StatusUpgradeRequired},
+		{"Sec-WebSocket-Version: 8\r\n", http.StatusUpgradeRequired},
+		{"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: chat\r\n", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		_, resp := dialWS(t, srv, tt.headers)
+		if want := fmt.Sprintf("HTTP/1.1 %d", tt.status); !strings.HasPrefix(resp, want) {
+			t.Errorf("headers %q: response %q, want %s", tt.headers, resp, want)
+		}
+	}
+	resp, err := http.Get(srv.URL + "/imap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain GET: status %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,158 @@
+// Package proxyproto parses HAProxy PROXY protocol (v1 and v2) headers so
+// the real client address survives a TCP load balancer.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// v2Signature is the fixed 12-byte prefix of a PROXY protocol v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Line is the maximum length of a v1 header including CRLF.
+const maxV1Line = 107
+
+var errNoHeader = errors.New("proxyproto: missing PROXY header")
+
+// Conn is a net.Conn whose RemoteAddr reports the address from the PROXY header.
+type Conn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+// Read reads from the buffered connection, after the PROXY header.
+func (c *Conn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// RemoteAddr returns the client address from the PROXY header, or the
+// socket peer address for LOCAL/UNKNOWN headers.
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// ReadHeader reads a PROXY header from conn and returns a Conn that reports
+// the proxied client address. The header must arrive within timeout.
+func ReadHeader(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	r := bufio.NewReader(conn)
+	c := &Conn{Conn: conn, r: r, remote: conn.RemoteAddr()}
+
+	prefix, err := r.Peek(len(v2Signature))
+	if err != nil && !(errors.Is(err, io.EOF) && len(prefix) >= 5) {
+		return nil, fmt.Errorf("proxyproto: read header: %w", err)
+	}
+
+	switch {
+	case bytes.Equal(prefix, v2Signature):
+		addr, err := readV2(r)
+		if err != nil {
+			return nil, err
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	case bytes.HasPrefix(prefix, []byte("PROXY")):
+		addr, err := readV1(r)
+		if err != nil {
+			return nil, err
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	default:
+		return nil, errNoHeader
+	}
+	return c, nil
+}
+
+// LocalHeader returns a v2 header with the LOCAL command, which a
+// connection made by the balancer itself, such as a health check, sends in
+// place of a client address.
+func LocalHeader() []byte {
+	return append(append([]byte{}, v2Signature...), 0x20, 0x00, 0x00, 0x00)
+}
+
+// readV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1Line {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: read v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyproto: v1 header too long or not CRLF terminated")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("proxyproto: malformed v1 header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: malformed v1 header %q", string(line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("proxyproto: invalid v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readV2 parses a binary v2 header (signature already peeked).
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("proxyproto: read v2 header: %w", err)
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported v2 version %d", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxyproto: read v2 addresses: %w", err)
+	}
+
+	// LOCAL command (health checks from the balancer): keep the socket address.
+	if verCmd&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch fam >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("proxyproto: short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("proxyproto: short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX: no usable client IP.
+		return nil, nil
+	}
+}
@@ -0,0 +1,89 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func pipeWith(t *testing.T, data []byte) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Write([]byte("A001 NOOP\r\n"))
+		client.Close()
+	}()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func v2Header(cmd byte, fam byte, addrs []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:16], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 10, 10, 0, 0, 1, 0xC3, 0x50, 0, 143}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1").To16())
+	binary.BigEndian.PutUint16(v6[32:34], 4242)
+
+	tests := []struct {
+		name     string
+		header   []byte
+		wantAddr string // empty means socket peer address
+		wantErr  bool
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50000 143\r\n"), wantAddr: "192.0.2.10:50000"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::1 ::1 4242 143\r\n"), wantAddr: "[2001:db8::1]:4242"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 malformed", header: []byte("PROXY TCP4 nope\r\n"), wantErr: true},
+		{name: "v2 tcp4", header: v2Header(1, 0x11, v4), wantAddr: "192.0.2.10:50000"},
+		{name: "v2 tcp6", header: v2Header(1, 0x21, v6), wantAddr: "[2001:db8::1]:4242"},
+		{name: "v2 local", header: v2Header(0, 0x00, nil)},
+		{name: "missing header", header: []byte("A000 CAPABILITY\r\n"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := pipeWith(t, tt.header)
+			c, err := ReadHeader(conn, time.Second)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadHeader: %v", err)
+			}
+			want := tt.wantAddr
+			if want == "" {
+				want = conn.RemoteAddr().String()
+			}
+			if got := c.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr = %q, want %q", got, want)
+			}
+
+			// The stream continues right after the header.
+			rest, _ := io.ReadAll(c)
+			if string(rest) != "A001 NOOP\r\n" {
+				t.Errorf("remaining data = %q", rest)
+			}
+		})
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := ReadHeader(server, 50*time.Millisecond); err == nil {
+		t.Fatal("expected timeout error")
+	}
+}
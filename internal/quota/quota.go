@@ -0,0 +1,160 @@
+// Package quota tracks how many bytes each account has downloaded per day,
+// optionally persisting the counters to a JSON file so they survive restarts.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dayFormat identifies a quota day; days roll over at midnight UTC.
+const dayFormat = "2006-01-02"
+
+// Store holds per-account byte counters for the current day.
+type Store struct {
+	path string // empty for an in-memory store
+	now  func() time.Time
+
+	mu    sync.Mutex
+	day   string
+	used  map[string]int64
+	dirty bool
+}
+
+// state is the on-disk representation of a Store.
+type state struct {
+	Day  string           `json:"day"`
+	Used map[string]int64 `json:"used"`
+}
+
+// NewStore returns an in-memory Store.
+func NewStore() *Store {
+	return &Store{now: time.Now, used: make(map[string]int64)}
+}
+
+// Open returns a Store persisted at path, loading any counters saved there
+// for today. A missing file is not an error.
+func Open(path string) (*Store, error) {
+	s := NewStore()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("quota: %w", err)
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("quota: decode %s: %w", path, err)
+	}
+	if st.Day == s.today() && st.Used != nil {
+		s.day = st.Day
+		s.used = st.Used
+	}
+	return s, nil
+}
+
+func (s *Store) today() string {
+	return s.now().UTC().Format(dayFormat)
+}
+
+// rollover resets the counters when the day has changed; s.mu must be held.
+func (s *Store) rollover() {
+	if day := s.today(); day != s.day {
+		if len(s.used) > 0 {
+			s.dirty = true
+		}
+		s.day = day
+		s.used = make(map[string]int64)
+	}
+}
+
+// Add records n bytes downloaded by user today and returns the new total.
+func (s *Store) Add(user string, n int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover()
+	s.used[user] += n
+	s.dirty = true
+	return s.used[user]
+}
+
+// Used returns the bytes downloaded by user today.
+func (s *Store) Used(user string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollover()
+	return s.used[user]
+}
+
+// Flush writes the counters to disk if they changed since the last flush.
+// It is a no-op for in-memory stores.
+func (s *Store) Flush() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(state{Day: s.day, Used: s.used})
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("quota: encode: %w", err)
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a
+	// truncated state file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".quota-*")
+	if err != nil {
+		return s.flushFailed(err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return s.flushFailed(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return s.flushFailed(err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return s.flushFailed(err)
+	}
+	return nil
+}
+
+// flushFailed marks the store dirty again so the next Flush retries.
+func (s *Store) flushFailed(err error) error {
+	s.mu.Lock()
+	s.dirty = true
+	s.mu.Unlock()
+	return fmt.Errorf("quota: save %s: %w", s.path, err)
+}
+
+// FlushEvery calls Flush every interval until stop is closed, reporting
+// failures to onErr.
+func (s *Store) FlushEvery(interval time.Duration, stop <-chan struct{}, onErr func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.Flush(); err != nil && onErr != nil {
+				onErr(err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
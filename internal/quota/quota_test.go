@@ -0,0 +1,81 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreAddAndRollover(t *testing.T) {
+	s := NewStore()
+	now := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	if got := s.Add("alice", 100); got != 100 {
+		t.Fatalf("Add = %d, want 100", got)
+	}
+	if got := s.Add("alice", 50); got != 150 {
+		t.Fatalf("Add = %d, want 150", got)
+	}
+	if got := s.Used("bob"); got != 0 {
+		t.Fatalf("Used(bob) = %d, want 0", got)
+	}
+
+	now = now.Add(2 * time.Hour) // next UTC day
+	if got := s.Used("alice"); got != 0 {
+		t.Fatalf("Used after rollover = %d, want 0", got)
+	}
+}
+
+func TestStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open missing file: %v", err)
+	}
+	s.Add("alice", 1234)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := reopened.Used("alice"); got != 1234 {
+		t.Fatalf("Used after reopen = %d, want 1234", got)
+	}
+}
+
+func TestOpenIgnoresStaleDay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	if err := os.WriteFile(path, []byte(`{"day":"2000-01-01","used":{"alice":99}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := s.Used("alice"); got != 0 {
+		t.Fatalf("Used = %d, want 0 for a previous day's counters", got)
+	}
+}
+
+func TestOpenInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("Open with invalid JSON succeeded")
+	}
+}
+
+func TestFlushInMemory(t *testing.T) {
+	s := NewStore()
+	s.Add("alice", 1)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush on in-memory store: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Package ratelimit provides token-bucket rate limiters.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a thread-safe token bucket refilled at a constant rate.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket holding up to burst tokens and refilling
+// at rate tokens per second.
+func NewBucket(rate float64, burst float64) *Bucket {
+	return &Bucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// refill adds tokens accrued since the last call; b.mu must be held.
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// Allow reports whether one token is available now, consuming it if so.
+func (b *Bucket) Allow() bool {
+	return b.AllowAt(time.Now(), 1)
+}
+
+// AllowAt reports whether n tokens are available at now, consuming them if so.
+func (b *Bucket) AllowAt(now time.Time, n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Reserve consumes n tokens, going into debt if necessary, and returns how
+// long the caller must wait before the debt is repaid.
+func (b *Bucket) Reserve(now time.Time, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Full reports whether the bucket has refilled to its burst size at now.
+func (b *Bucket) Full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
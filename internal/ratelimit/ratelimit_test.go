@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketAllow(t *testing.T) {
+	b := NewBucket(1, 3) // 1 token/s, burst 3
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if !b.AllowAt(now, 1) {
+			t.Fatalf("token %d should be allowed from burst", i)
+		}
+	}
+	if b.AllowAt(now, 1) {
+		t.Fatal("fourth token should be denied")
+	}
+
+	// After 1.5s one token has refilled.
+	now = now.Add(1500 * time.Millisecond)
+	if !b.AllowAt(now, 1) {
+		t.Fatal("token should refill after 1s")
+	}
+	if b.AllowAt(now, 1) {
+		t.Fatal("only one token should have refilled")
+	}
+
+	// Refill is capped at burst.
+	now = now.Add(time.Hour)
+	if !b.Full(now) {
+		t.Fatal("bucket should be full after an hour")
+	}
+	for i := 0; i < 3; i++ {
+		b.AllowAt(now, 1)
+	}
+	if b.AllowAt(now, 1) {
+		t.Fatal("refill exceeded burst")
+	}
+}
+
+func TestBucketReserve(t *testing.T) {
+	b := NewBucket(100, 100) // 100 tokens/s
+	now := time.Unix(1000, 0)
+
+	if d := b.Reserve(now, 50); d != 0 {
+		t.Fatalf("reserve within burst waited %v", d)
+	}
+	// 50 left; reserving 150 puts us 100 in debt → 1s wait.
+	if d := b.Reserve(now, 150); d != time.Second {
+		t.Fatalf("reserve wait = %v, want 1s", d)
+	}
+	// After 1s the debt is repaid.
+	if d := b.Reserve(now.Add(time.Second), 0); d != 0 {
+		t.Fatalf("wait after repayment = %v, want 0", d)
+	}
+}
@@ -0,0 +1,306 @@
+// Package redis is a minimal Redis client speaking RESP2. It implements
+// only what the proxy needs to share counters between instances:
+// connecting (with optional TLS, AUTH and database selection), a small
+// connection pool, and the handful of integer and expiry commands used
+// for limits, lockouts and quotas. IncrBy runs a Lua script, so the server
+// must support EVAL.
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout    = 5 * time.Second
+	commandTimeout = 2 * time.Second
+	// maxIdle is how many idle connections the pool keeps.
+	maxIdle = 8
+)
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// Client sends commands to one Redis server. It is safe for concurrent
+// use; each command borrows a pooled connection, which is discarded if the
+// command fails other than with an error reply.
+type Client struct {
+	url *url.URL
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// ParseURL checks a Redis URL: redis://[[user]:password@]host[:port][/db],
+// or rediss:// for TLS. The port defaults to 6379.
+func ParseURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("redis: unsupported scheme %q (want redis or rediss)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("redis: missing host")
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if n, err := strconv.Atoi(db); err != nil || n < 0 {
+			return nil, fmt.Errorf("redis: invalid database %q", db)
+		}
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	return u, nil
+}
+
+// New returns a client for the server at rawURL (see ParseURL) after
+// checking that it answers PING.
+func New(rawURL string) (*Client, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{url: u}
+	if _, err := c.Do("PING"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the idle connections. Commands may still be sent; they open
+// new connections.
+func (c *Client) Close() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+	for _, cn := range idle {
+		cn.Close()
+	}
+}
+
+// Do sends a command and returns its reply: a string, an int64, nil, or a
+// []any for arrays. An error reply is returned as an Error.
+func (c *Client) Do(args ...string) (any, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := cn.do(args)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+func (c *Client) get() (*conn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdle {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// dial connects, authenticates and selects the database.
+func (c *Client) dial() (*conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	var nc net.Conn
+	var err error
+	if c.url.Scheme == "rediss" {
+		nc, err = tls.DialWithDialer(d, "tcp", c.url.Host, &tls.Config{ServerName: c.url.Hostname()})
+	} else {
+		nc, err = d.Dial("tcp", c.url.Host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+
+	var setup [][]string
+	if u := c.url.User; u != nil {
+		if pass, ok := u.Password(); ok && u.Username() != "" {
+			setup = append(setup, []string{"AUTH", u.Username(), pass})
+		} else if ok {
+			setup = append(setup, []string{"AUTH", pass})
+		}
+	}
+	if db := strings.Trim(c.url.Path, "/"); db != "" && db != "0" {
+		setup = append(setup, []string{"SELECT", db})
+	}
+	for _, args := range setup {
+		if _, err := cn.do(args); err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("redis: %s: %w", strings.ToLower(args[0]), err)
+		}
+	}
+	return cn, nil
+}
+
+// do writes a command and reads its reply, within commandTimeout.
+func (cn *conn) do(args []string) (any, error) {
+	cn.SetDeadline(time.Now().Add(commandTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(cn, b.String()); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return readReply(cn.r)
+}
+
+// readReply reads one RESP2 reply.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch body := line[1:]; line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad integer reply %q", body)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			item, err := readReply(r)
+			var replyErr Error
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// incrByScript increments KEYS[1] by ARGV[1] and, if the key has no
+// expiry, sets it to ARGV[2] milliseconds, in one atomic step.
+const incrByScript = `local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return n`
+
+// IncrBy adds n to the integer at key and returns the new value. A key
+// without an expiry, such as one created by the increment, expires after
+// ttl. The increment and the expiry are applied together, so a counter
+// cannot be left behind that never expires.
+func (c *Client) IncrBy(key string, n int64, ttl time.Duration) (int64, error) {
+	v, err := c.Do("EVAL", incrByScript, "1", key, strconv.FormatInt(n, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return 0, err
+	}
+	total, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: INCRBY returned %T", v)
+	}
+	return total, nil
+}
+
+// Get returns the integer at key, or zero if it does not exist.
+func (c *Client) Get(key string) (int64, error) {
+	v, err := c.Do("GET", key)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	s, _ := v.(string)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("redis: %s is not an integer", key)
+	}
+	return n, nil
+}
+
+// Set stores the integer v at key, expiring after ttl.
+func (c *Client) Set(key string, v int64, ttl time.Duration) error {
+	_, err := c.Do("SET", key, strconv.FormatInt(v, 10), "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	return err
+}
+
+// TTL returns how long key has left to live, or zero if it does not exist
+// or has no expiry.
+func (c *Client) TTL(key string) (time.Duration, error) {
+	v, err := c.Do("PTTL", key)
+	if err != nil {
+		return 0, err
+	}
+	ms, _ := v.(int64)
+	if ms < 0 {
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Del deletes keys.
+func (c *Client) Del(keys ...string) error {
+	_, err := c.Do(append([]string{"DEL"}, keys...)...)
+	return err
+}
@@ -0,0 +1,327 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal in-memory Redis server supporting the commands
+// the client sends. Every command is recorded in cmds. If password is set,
+// commands other than AUTH are refused until it is given.
+type fakeServer struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	values  map[string]int64
+	expires map[string]time.Time
+	cmds    []string
+	dials   int
+}
+
+func newFakeServer(t *testing.T, password string) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, password: password, values: make(map[string]int64), expires: make(map[string]time.Time)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.dials++
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) url() string { return "redis://" + s.ln.Addr().String() }
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := s.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, strings.Join(args, " "))
+		if !authed && args[0] != "AUTH" {
+			s.mu.Unlock()
+			fmt.Fprint(c, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		reply := s.exec(args)
+		if args[0] == "AUTH" && strings.HasPrefix(reply, "+") {
+			authed = true
+		}
+		s.mu.Unlock()
+		io.WriteString(c, reply)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	v, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := v.([]any)
+	if !ok || len(items) == 0 {
+		return nil, errors.New("not a command")
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		args[i], _ = item.(string)
+	}
+	return args, nil
+}
+
+// exec runs one command with s.mu held and returns the encoded reply.
+func (s *fakeServer) exec(args []string) string {
+	for k, exp := range s.expires {
+		if time.Now().After(exp) {
+			delete(s.values, k)
+			delete(s.expires, k)
+		}
+	}
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH":
+		if args[len(args)-1] != s.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "EVAL":
+		// Only IncrBy's script is sent: EVAL script 1 key n ttl.
+		key := args[3]
+		n, _ := strconv.ParseInt(args[4], 10, 64)
+		ms, _ := strconv.ParseInt(args[5], 10, 64)
+		s.values[key] += n
+		if _, ok := s.expires[key]; !ok && ms > 0 {
+			s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return fmt.Sprintf(":%d\r\n", s.values[key])
+	case "GET":
+		v, ok := s.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		str := strconv.FormatInt(v, 10)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(str), str)
+	case "SET":
+		v, _ := strconv.ParseInt(args[2], 10, 64)
+		s.values[args[1]] = v
+		delete(s.expires, args[1])
+		if len(args) == 5 && args[3] == "PX" {
+			ms, _ := strconv.ParseInt(args[4], 10, 64)
+			s.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "PTTL":
+		if _, ok := s.values[args[1]]; !ok {
+			return ":-2\r\n"
+		}
+		exp, ok := s.expires[args[1]]
+		if !ok {
+			return ":-1\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(exp).Milliseconds())
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := s.values[k]; ok {
+				n++
+			}
+			delete(s.values, k)
+			delete(s.expires, k)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func (s *fakeServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.cmds...)
+}
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		raw, host string
+		wantErr   bool
+	}{
+		{raw: "redis://cache", host: "cache:6379"},
+		{raw: "rediss://:pw@cache:6380/2", host: "cache:6380"},
+		{raw: "redis://[::1]", host: "[::1]:6379"},
+		{raw: "http://cache", wantErr: true},
+		{raw: "redis://", wantErr: true},
+		{raw: "redis://cache/x", wantErr: true},
+		{raw: "redis://cache/-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		u, err := ParseURL(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseURL(%q) succeeded, want error", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseURL(%q): %v", tt.raw, err)
+			continue
+		}
+		if u.Host != tt.host {
+			t.Errorf("ParseURL(%q) host = %q, want %q", tt.raw, u.Host, tt.host)
+		}
+	}
+}
+
+func TestNewAuthenticatesAndSelects(t *testing.T) {
+	srv := newFakeServer(t, "sekrit")
+	c, err := New("redis://:sekrit@" + srv.ln.Addr().String() + "/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	want := []string{"AUTH sekrit", "SELECT 3", "PING"}
+	if got := srv.commands(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestNewWrongPassword(t *testing.T) {
+	srv := newFakeServer(t, "sekrit")
+	_, err := New("redis://:nope@" + srv.ln.Addr().String())
+	var replyErr Error
+	if !errors.As(err, &replyErr) || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("err = %v, want WRONGPASS reply", err)
+	}
+}
+
+func TestNewUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := New("redis://" + addr); err == nil {
+		t.Error("New succeeded against a closed port")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	srv := newFakeServer(t, "")
+	c, err := New(srv.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i, want := range []int64{3, 5} {
+		n, err := c.IncrBy("k", []int64{3, 2}[i], time.Minute)
+		if err != nil || n != want {
+			t.Fatalf("IncrBy #%d = %d, %v; want %d", i, n, err, want)
+		}
+	}
+	for _, cmd := range srv.commands() {
+		if strings.HasPrefix(cmd, "INCRBY") || strings.HasPrefix(cmd, "PEXPIRE") {
+			t.Errorf("sent %q, want the increment and expiry in one script", cmd)
+		}
+	}
+	if ttl, err := c.TTL("k"); err != nil || ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("TTL(k) = %v, %v; want about a minute", ttl, err)
+	}
+	// A counter left without an expiry gets one on its next increment.
+	if _, err := c.Do("SET", "stale", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.IncrBy("stale", 1, time.Minute); err != nil || n != 5 {
+		t.Fatalf("IncrBy(stale) = %d, %v; want 5", n, err)
+	}
+	if ttl, _ := c.TTL("stale"); ttl <= 0 {
+		t.Error("stale counter still has no expiry")
+	}
+	if n, err := c.Get("k"); err != nil || n != 5 {
+		t.Errorf("Get = %d, %v; want 5", n, err)
+	}
+	if n, err := c.Get("missing"); err != nil || n != 0 {
+		t.Errorf("Get(missing) = %d, %v; want 0", n, err)
+	}
+
+	if err := c.Set("ban", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := c.TTL("ban"); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL(ban) = %v, %v; want about an hour", ttl, err)
+	}
+	if ttl, err := c.TTL("missing"); err != nil || ttl != 0 {
+		t.Errorf("TTL(missing) = %v, %v; want 0", ttl, err)
+	}
+
+	if err := c.Del("k", "ban"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := c.Get("k"); n != 0 {
+		t.Errorf("Get after Del = %d, want 0", n)
+	}
+}
+
+func TestErrorReplyKeepsConnection(t *testing.T) {
+	srv := newFakeServer(t, "")
+	c, err := New(srv.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.Do("BOGUS")
+	var replyErr Error
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("err = %v, want an error reply", err)
+	}
+	if _, err := c.Do("PING"); err != nil {
+		t.Fatal(err)
+	}
+	srv.mu.Lock()
+	dials := srv.dials
+	srv.mu.Unlock()
+	if dials != 1 {
+		t.Errorf("dialed %d times, want the connection reused", dials)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	in := "*3\r\n:1\r\n$3\r\nfoo\r\n$-1\r\n"
+	v, err := readReply(bufio.NewReader(strings.NewReader(in)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, ok := v.([]any)
+	if !ok || len(items) != 3 || items[0] != int64(1) || items[1] != "foo" || items[2] != nil {
+		t.Errorf("readReply = %#v", v)
+	}
+	if _, err := readReply(bufio.NewReader(strings.NewReader("?what\r\n"))); err == nil {
+		t.Error("unknown reply type accepted")
+	}
+}
@@ -0,0 +1,125 @@
+// Package report summarizes stored audit events into per-account,
+// per-folder access reports (e.g. for data-access requests).
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"imap-proxy/internal/audit"
+)
+
+// Row summarizes one account's use of one folder over the report period.
+type Row struct {
+	User     string `json:"user"`
+	Folder   string `json:"folder"`
+	Listings int    `json:"listings"` // sessions in which the folder was listed
+	Selects  int    `json:"selects"`
+	Messages int64  `json:"messages"` // FETCH responses, approximate
+	Bytes    int64  `json:"bytes"`    // data relayed while selected, approximate
+}
+
+// Query selects the events a report covers.
+type Query struct {
+	User  string
+	Since time.Time
+	Until time.Time
+}
+
+// Generate builds the report for q from the events in store.
+func Generate(store *audit.Store, q Query) ([]Row, error) {
+	events, err := store.Query(audit.Query{Type: audit.FolderUsage, User: q.User, Since: q.Since, Until: q.Until})
+	if err != nil {
+		return nil, err
+	}
+	return Build(events), nil
+}
+
+// Build aggregates folder_usage events by account and folder. Other event
+// types are ignored. Rows are sorted by account, then folder.
+func Build(events []audit.Event) []Row {
+	type key struct{ user, folder string }
+	rows := make(map[key]*Row)
+	for _, ev := range events {
+		if ev.Type != audit.FolderUsage {
+			continue
+		}
+		k := key{ev.User, ev.Fields["folder"]}
+		r, ok := rows[k]
+		if !ok {
+			r = &Row{User: k.user, Folder: k.folder}
+			rows[k] = r
+		}
+		if ev.Fields["listed"] == "true" {
+			r.Listings++
+		}
+		r.Selects += atoiField(ev.Fields["selects"])
+		r.Messages += int64(atoiField(ev.Fields["messages"]))
+		r.Bytes += int64(atoiField(ev.Fields["bytes"]))
+	}
+
+	out := make([]Row, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, *r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].User != out[j].User {
+			return out[i].User < out[j].User
+		}
+		return out[i].Folder < out[j].Folder
+	})
+	return out
+}
+
+func atoiField(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// Formats accepted by Write.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// Write encodes rows in the given format ("csv" or "json").
+func Write(w io.Writer, rows []Row, format string) error {
+	switch format {
+	case FormatCSV:
+		return WriteCSV(w, rows)
+	case FormatJSON:
+		return WriteJSON(w, rows)
+	default:
+		return fmt.Errorf("report: unknown format %q", format)
+	}
+}
+
+// WriteCSV writes rows as CSV with a header line.
+func WriteCSV(w io.Writer, rows []Row) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"user", "folder", "listings", "selects", "messages", "bytes"})
+	for _, r := range rows {
+		cw.Write([]string{
+			r.User, r.Folder,
+			strconv.Itoa(r.Listings), strconv.Itoa(r.Selects),
+			strconv.FormatInt(r.Messages, 10), strconv.FormatInt(r.Bytes, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes rows as a JSON array.
+func WriteJSON(w io.Writer, rows []Row) error {
+	if rows == nil {
+		rows = []Row{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
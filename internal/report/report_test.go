@@ -0,0 +1,96 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/audit"
+)
+
+func usageEvent(user, folder, listed, selects, messages, bytes string) audit.Event {
+	return audit.Event{Type: audit.FolderUsage, User: user, Fields: map[string]string{
+		"folder": folder, "listed": listed, "selects": selects, "messages": messages, "bytes": bytes,
+	}}
+}
+
+func TestBuild(t *testing.T) {
+	events := []audit.Event{
+		usageEvent("bob", "INBOX", "true", "1", "3", "300"),
+		usageEvent("alice", "INBOX", "true", "2", "10", "1000"),
+		usageEvent("alice", "Sent", "true", "0", "0", "0"),
+		usageEvent("alice", "INBOX", "false", "1", "5", "500"),
+		{Type: audit.LoginSuccess, User: "alice"},
+	}
+	want := []Row{
+		{User: "alice", Folder: "INBOX", Listings: 1, Selects: 3, Messages: 15, Bytes: 1500},
+		{User: "alice", Folder: "Sent", Listings: 1},
+		{User: "bob", Folder: "INBOX", Listings: 1, Selects: 1, Messages: 3, Bytes: 300},
+	}
+	if got := Build(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Build =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rows := []Row{{User: "alice", Folder: "Inbox, old", Listings: 1, Selects: 2, Messages: 3, Bytes: 4}}
+
+	var csvBuf bytes.Buffer
+	if err := Write(&csvBuf, rows, FormatCSV); err != nil {
+		t.Fatalf("Write csv: %v", err)
+	}
+	wantCSV := "user,folder,listings,selects,messages,bytes\nalice,\"Inbox, old\",1,2,3,4\n"
+	if csvBuf.String() != wantCSV {
+		t.Errorf("csv = %q, want %q", csvBuf.String(), wantCSV)
+	}
+
+	var jsonBuf bytes.Buffer
+	if err := Write(&jsonBuf, rows, FormatJSON); err != nil {
+		t.Fatalf("Write json: %v", err)
+	}
+	var got []Row
+	if err := json.Unmarshal(jsonBuf.Bytes(), &got); err != nil || !reflect.DeepEqual(got, rows) {
+		t.Errorf("json round trip = %+v (%v), want %+v", got, err, rows)
+	}
+
+	var empty bytes.Buffer
+	WriteJSON(&empty, nil)
+	if empty.String() != "[]\n" {
+		t.Errorf("empty json = %q, want []", empty.String())
+	}
+
+	if err := Write(&bytes.Buffer{}, rows, "xml"); err == nil {
+		t.Error("Write with unknown format succeeded")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	store, err := audit.OpenStore(filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	defer store.Close()
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	old := usageEvent("alice", "INBOX", "true", "1", "1", "10")
+	old.Time = base
+	recent := usageEvent("alice", "INBOX", "true", "1", "2", "20")
+	recent.Time = base.Add(48 * time.Hour)
+	other := usageEvent("bob", "INBOX", "true", "1", "2", "20")
+	other.Time = base.Add(48 * time.Hour)
+	for _, ev := range []audit.Event{old, recent, other} {
+		store.Record(ev)
+	}
+	store.Flush()
+
+	rows, err := Generate(store, Query{User: "alice", Since: base.Add(24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	want := []Row{{User: "alice", Folder: "INBOX", Listings: 1, Selects: 1, Messages: 2, Bytes: 20}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("Generate = %+v, want %+v", rows, want)
+	}
+}
@@ -0,0 +1,415 @@
+// Package rest serves a read-only HTTP API for pulling messages from the
+// proxied accounts without an IMAP library:
+//
+//	GET /accounts/{user}/folders
+//	GET /accounts/{user}/messages?folder=INBOX[&since_uid=N][&limit=N]
+//	GET /accounts/{user}/messages/{uid}/raw?folder=INBOX[&uid_validity=N]
+//
+// Requests authenticate as {user} with the account's local credentials,
+// go through the same login checks and limits as IMAP logins, and see only
+// what an IMAP client of the account would.
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/imapclient"
+	"imap-proxy/internal/metrics"
+	"imap-proxy/internal/proxy"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+	// commandTimeout bounds the response to each upstream command.
+	commandTimeout = time.Minute
+)
+
+var requestsTotal = metrics.Default.NewCounter("imap_proxy_rest_requests_total",
+	"REST API requests, by endpoint and HTTP status.", "endpoint", "status")
+
+// Server is an http.Handler serving the REST API.
+type Server struct {
+	cfg     *config.Config
+	gateway *proxy.Server
+	logger  *slog.Logger
+	mux     *http.ServeMux
+
+	Upstream imapclient.Upstream
+}
+
+// New returns a Server for the accounts in cfg. Requests log in through
+// gateway, the proxy serving cfg.
+func New(cfg *config.Config, gateway *proxy.Server, logger *slog.Logger) *Server {
+	s := &Server{cfg: cfg, gateway: gateway, logger: logger, mux: http.NewServeMux()}
+	s.Upstream.Hosts = gateway.HostLimits()
+	s.mux.Handle("GET /accounts/{user}/folders", s.handler("folders", s.folders))
+	s.mux.Handle("GET /accounts/{user}/messages", s.handler("messages", s.messages))
+	s.mux.Handle("GET /accounts/{user}/messages/{uid}/raw", s.handler("raw", s.raw))
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// statusError is an error answered with its own HTTP status rather than 502.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string { return e.msg }
+
+var errNotFound = &statusError{http.StatusNotFound, "not found"}
+
+// request is an authenticated request with its upstream connection.
+type request struct {
+	*http.Request
+	acct  *config.AccountConfig
+	login *proxy.GatewayLogin
+	conn  *imapclient.Conn
+}
+
+// handler authenticates requests, connects to the account's upstream and
+// runs fn, answering its error.
+func (s *Server) handler(endpoint string, fn func(http.ResponseWriter, *request) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		defer func() { requestsTotal.Inc(endpoint, strconv.Itoa(status)) }()
+		login, gerr := s.gateway.LoginGateway(r, "rest")
+		if gerr != nil {
+			status = gerr.Status
+			gerr.Write(w)
+			return
+		}
+		defer login.Close()
+		acct := login.Account
+		if r.PathValue("user") != acct.LocalUser {
+			status = http.StatusForbidden
+			http.Error(w, "forbidden", status)
+			return
+		}
+		logger := s.logger.With("user", acct.LocalUser)
+
+		c, err := s.connect(acct)
+		login.Connected(err)
+		if errors.Is(err, proxy.ErrHostLimit) {
+			logger.Warn("REST request rejected: upstream host connection limit reached")
+			status = http.StatusTooManyRequests
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if err != nil {
+			logger.Error("REST upstream connection failed", "err", err)
+			status = http.StatusBadGateway
+			http.Error(w, "upstream unavailable", status)
+			return
+		}
+		defer func() {
+			c.Command("LOGOUT", nil)
+			c.Close()
+		}()
+		err = fn(w, &request{Request: r, acct: acct, login: login, conn: c})
+		var (
+			se *statusError
+			ge *proxy.GatewayError
+		)
+		switch {
+		case err == nil:
+		case errors.As(err, &se):
+			status = se.status
+			http.Error(w, se.msg, status)
+		case errors.As(err, &ge):
+			status = ge.Status
+			ge.Write(w)
+		default:
+			logger.Error("REST request failed", "endpoint", endpoint, "err", err)
+			status = http.StatusBadGateway
+			http.Error(w, "upstream error", status)
+		}
+	})
+}
+
+func (s *Server) connect(acct *config.AccountConfig) (*imapclient.Conn, error) {
+	nc, r, err := s.Upstream.Connect(acct, nil)
+	if err != nil {
+		return nil, err
+	}
+	return imapclient.New(nc, r, "r", commandTimeout), nil
+}
+
+type folderInfo struct {
+	Name    string `json:"name"`
+	Virtual bool   `json:"virtual,omitempty"`
+}
+
+// folders lists the selectable folders the account may see, followed by
+// its virtual folders.
+func (s *Server) folders(w http.ResponseWriter, r *request) error {
+	folders := []folderInfo{}
+	err := r.conn.Command(`LIST "" "*"`, func(resp imapclient.Response) error {
+		entry, ok := imap.ParseListEntry([]byte(resp.Text))
+		if ok && !entry.HasFlag(`\Noselect`) && !entry.HasFlag(`\NonExistent`) && r.acct.FolderAllowed(entry.Mailbox) {
+			folders = append(folders, folderInfo{Name: entry.Mailbox})
+			r.login.Listed(entry.Mailbox)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, vf := range r.acct.VirtualFolders {
+		if r.acct.FolderAllowed(vf.Name) {
+			folders = append(folders, folderInfo{Name: vf.Name, Virtual: true})
+		}
+	}
+	writeJSON(w, folders)
+	return nil
+}
+
+// open examines the folder named by the request's folder parameter and
+// returns its UIDVALIDITY and the search keys selecting the messages the
+// account may see in it.
+func (s *Server) open(r *request) (validity uint32, criteria string, err error) {
+	name := r.URL.Query().Get("folder")
+	if name == "" {
+		return 0, "", &statusError{http.StatusBadRequest, "folder parameter required"}
+	}
+	if !r.acct.FolderAllowed(name) {
+		return 0, "", errNotFound
+	}
+	upstream, keys := name, []string{"ALL"}
+	if vf := r.acct.VirtualFolder(name); vf != nil {
+		upstream = vf.Folder
+		keys = append(keys, "("+vf.Search+")")
+	}
+	if v := proxy.VisibilityCriteria(r.acct, upstream, time.Now()); v != "" {
+		keys = append(keys, v)
+	}
+	v, err := r.conn.Examine(upstream)
+	if errors.Is(err, imapclient.ErrRefused) {
+		return 0, "", errNotFound
+	}
+	r.login.Selected(name)
+	n, _ := strconv.ParseUint(v, 10, 32)
+	return uint32(n), strings.Join(keys, " "), err
+}
+
+type messageInfo struct {
+	UID          uint32   `json:"uid"`
+	Size         int64    `json:"size"`
+	Flags        []string `json:"flags"`
+	InternalDate string   `json:"internal_date"`
+	Date         string   `json:"date,omitempty"`
+	From         string   `json:"from,omitempty"`
+	To           string   `json:"to,omitempty"`
+	Subject      string   `json:"subject,omitempty"`
+	MessageID    string   `json:"message_id,omitempty"`
+}
+
+type messageList struct {
+	Folder      string        `json:"folder"`
+	UIDValidity uint32        `json:"uid_validity"`
+	Messages    []messageInfo `json:"messages"`
+	// NextSinceUID is set when more messages follow; pass it as since_uid
+	// to get them.
+	NextSinceUID uint32 `json:"next_since_uid,omitempty"`
+}
+
+// summaryHeaders are the header fields returned in message listings.
+const summaryHeaders = "(DATE FROM TO SUBJECT MESSAGE-ID)"
+
+// messages lists the messages of a folder with UIDs above since_uid, in
+// UID order, at most limit at a time.
+func (s *Server) messages(w http.ResponseWriter, r *request) error {
+	query := r.URL.Query()
+	since, err := uintParam(query.Get("since_uid"), 0)
+	if err != nil {
+		return &statusError{http.StatusBadRequest, "since_uid: " + err.Error()}
+	}
+	limit, err := uintParam(query.Get("limit"), defaultLimit)
+	if err != nil || limit == 0 {
+		return &statusError{http.StatusBadRequest, "limit must be a positive number"}
+	}
+	limit = min(limit, maxLimit)
+
+	validity, criteria, err := s.open(r)
+	if err != nil {
+		return err
+	}
+	uids, err := r.conn.Search(fmt.Sprintf("UID %d:* %s", since+1, criteria))
+	if err != nil {
+		return err
+	}
+	// n:* always matches the highest UID, even when it is below n.
+	uids = slices.DeleteFunc(uids, func(uid uint32) bool { return uid <= since })
+	slices.Sort(uids)
+	list := messageList{Folder: query.Get("folder"), UIDValidity: validity, Messages: []messageInfo{}}
+	if len(uids) > int(limit) {
+		uids = uids[:limit]
+		list.NextSinceUID = uids[len(uids)-1]
+	}
+	if len(uids) == 0 {
+		writeJSON(w, list)
+		return nil
+	}
+	if err := r.login.CheckQuota(); err != nil {
+		return err
+	}
+	byUID := map[uint32]messageInfo{}
+	cmd := fmt.Sprintf("UID FETCH %s (UID FLAGS INTERNALDATE RFC822.SIZE BODY.PEEK[HEADER.FIELDS %s])",
+		imap.FormatSeqSet(uids), summaryHeaders)
+	err = r.conn.Command(cmd, func(resp imapclient.Response) error {
+		if m, ok := s.summary(r.acct, resp); ok && slices.Contains(uids, m.UID) {
+			byUID[m.UID] = m
+			if len(resp.Literals) == 1 {
+				r.login.Fetched(len(resp.Literals[0]))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		if m, ok := byUID[uid]; ok {
+			list.Messages = append(list.Messages, m)
+		}
+	}
+	writeJSON(w, list)
+	return nil
+}
+
+// raw serves a message as message/rfc822, after checking that the account
+// may see it.
+func (s *Server) raw(w http.ResponseWriter, r *request) error {
+	uid, err := uintParam(r.PathValue("uid"), 0)
+	if err != nil || uid == 0 {
+		return &statusError{http.StatusBadRequest, "invalid uid"}
+	}
+	validity, criteria, err := s.open(r)
+	if err != nil {
+		return err
+	}
+	if v := r.URL.Query().Get("uid_validity"); v != "" && v != strconv.FormatUint(uint64(validity), 10) {
+		return &statusError{http.StatusNotFound, "uid_validity changed"}
+	}
+	visible, err := r.conn.Search(fmt.Sprintf("UID %d %s", uid, criteria))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(visible, uid) {
+		return errNotFound
+	}
+	if err := r.login.CheckQuota(); err != nil {
+		return err
+	}
+	var body []byte
+	err = r.conn.Command(fmt.Sprintf("UID FETCH %d (UID BODY.PEEK[])", uid), func(resp imapclient.Response) error {
+		if fetchUID(resp.Text) == uid && len(resp.Literals) == 1 {
+			body = resp.Literals[0]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return errNotFound
+	}
+	body = proxy.ScrubMessage(r.acct, body)
+	r.login.Fetched(len(body))
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+	return nil
+}
+
+// summary parses a FETCH response for the message listing, scrubbing the
+// header fields as for IMAP clients.
+func (s *Server) summary(acct *config.AccountConfig, resp imapclient.Response) (messageInfo, bool) {
+	m := messageInfo{UID: fetchUID(resp.Text), Flags: []string{}}
+	if m.UID == 0 {
+		return m, false
+	}
+	fields := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(resp.Text))
+	for i := 3; i+1 < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "RFC822.SIZE":
+			m.Size, _ = strconv.ParseInt(fields[i+1], 10, 64)
+		case "FLAGS":
+			for j := i + 2; j < len(fields) && fields[j] != ")"; j++ {
+				m.Flags = append(m.Flags, fields[j])
+			}
+		}
+	}
+	if i := strings.Index(strings.ToUpper(resp.Text), `INTERNALDATE "`); i >= 0 {
+		date, _, _ := strings.Cut(resp.Text[i+len(`INTERNALDATE "`):], `"`)
+		if t, err := time.Parse("_2-Jan-2006 15:04:05 -0700", date); err == nil {
+			m.InternalDate = t.UTC().Format(time.RFC3339)
+		}
+	}
+	if len(resp.Literals) == 1 {
+		header := proxy.ScrubMessage(acct, resp.Literals[0])
+		if msg, err := mail.ReadMessage(bytes.NewReader(header)); err == nil {
+			dec := &mime.WordDecoder{}
+			get := func(name string) string {
+				v := msg.Header.Get(name)
+				if d, err := dec.DecodeHeader(v); err == nil {
+					return d
+				}
+				return v
+			}
+			m.Date, m.From, m.To, m.Subject = get("Date"), get("From"), get("To"), get("Subject")
+			m.MessageID = strings.Trim(get("Message-Id"), "<>")
+		}
+	}
+	return m, true
+}
+
+// fetchUID returns the UID in a FETCH response, or 0.
+func fetchUID(text string) uint32 {
+	fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(text))
+	if len(fields) < 3 || !strings.EqualFold(fields[2], "FETCH") {
+		return 0
+	}
+	for i := 3; i+1 < len(fields); i++ {
+		if strings.EqualFold(fields[i], "UID") {
+			n, _ := strconv.ParseUint(fields[i+1], 10, 32)
+			return uint32(n)
+		}
+	}
+	return 0
+}
+
+// uintParam parses a numeric parameter, returning def when it is empty.
+func uintParam(v string, def uint32) (uint32, error) {
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	return uint32(n), nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
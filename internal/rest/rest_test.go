@@ -0,0 +1,238 @@
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/audit"
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imaptest"
+	"imap-proxy/internal/proxy"
+	"imap-proxy/internal/quota"
+)
+
+var testDate = time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)
+
+// testMail is the upstream mail. Archive/Old is blocked, which leaves its
+// parent Archive listed as \Noselect.
+var testMail = map[string][]imaptest.Message{
+	"INBOX": {
+		{UID: 3, Flags: "S", Date: testDate, Body: "From: alice@example.com\r\nSubject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\nX-Secret: s\r\n\r\nhello\r\n"},
+		{UID: 5, Flags: "S", Date: testDate, Body: "From: spam@example.com\r\nSubject: spam\r\n\r\nbuy\r\n"},
+		{UID: 8, Flags: "S", Date: testDate, Body: "From: carol@example.com\r\nSubject: invoice\r\n\r\npay\r\n"},
+	},
+	"Private":     {{UID: 1, Date: testDate, Body: "Subject: private\r\n\r\nx\r\n"}},
+	"Archive/Old": {{UID: 1, Date: testDate, Body: "Subject: old\r\n\r\nx\r\n"}},
+}
+
+func newTestServer(t *testing.T) (*Server, *imaptest.Server) {
+	return newTestServerWith(t, func(*config.Config) {})
+}
+
+// newTestServerWith is newTestServer with the config modified by configure
+// before the gateway is created.
+func newTestServerWith(t *testing.T, configure func(*config.Config)) (*Server, *imaptest.Server) {
+	t.Helper()
+	up := imaptest.NewServerWith(testMail)
+	t.Cleanup(up.Close)
+	acct := up.Account("reader1", "localpass1")
+	acct.BlockedFolders = []string{"Private", "Archive/Old"}
+	acct.HideFrom = []string{"spam@example.com"}
+	acct.RemoveHeaders = []string{"X-Secret"}
+	acct.VirtualFolders = []config.VirtualFolder{{Name: "Invoices", Folder: "INBOX", Search: "SUBJECT invoice"}}
+	cfg := &config.Config{Accounts: []config.AccountConfig{acct, {
+		LocalUser:     "reader2",
+		LocalPassword: "localpass2",
+	}}}
+	configure(cfg)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := New(cfg, proxy.NewServer(cfg, logger), logger)
+	s.Upstream.Dial = up.Dial
+	return s, up
+}
+
+func get(s *Server, path, user, pass string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAccess(t *testing.T) {
+	s, _ := newTestServer(t)
+	tests := []struct {
+		path, user, pass string
+		want             int
+	}{
+		{"/accounts/reader1/folders", "reader1", "localpass1", http.StatusOK},
+		{"/accounts/reader1/folders", "reader1", "wrong", http.StatusUnauthorized},
+		{"/accounts/reader1/folders", "", "", http.StatusUnauthorized},
+		{"/accounts/reader1/folders", "reader2", "localpass2", http.StatusForbidden},
+		{"/accounts/reader1/messages", "reader1", "localpass1", http.StatusBadRequest},
+		{"/accounts/reader1/messages?folder=Private", "reader1", "localpass1", http.StatusNotFound},
+		{"/accounts/reader1/messages?folder=Missing", "reader1", "localpass1", http.StatusNotFound},
+		{"/accounts/reader1/messages?folder=INBOX&limit=x", "reader1", "localpass1", http.StatusBadRequest},
+		{"/accounts/reader1/messages/5/raw?folder=INBOX", "reader1", "localpass1", http.StatusNotFound},
+		{"/accounts/reader1/messages/3/raw?folder=INBOX&uid_validity=2", "reader1", "localpass1", http.StatusNotFound},
+		{"/accounts/reader1/messages/3/raw?folder=Invoices", "reader1", "localpass1", http.StatusNotFound},
+		{"/accounts/reader1/messages/1/raw?folder=Private", "reader1", "localpass1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if rec := get(s, tt.path, tt.user, tt.pass); rec.Code != tt.want {
+			t.Errorf("GET %s as %s: status %d, want %d (%s)", tt.path, tt.user, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestFolders(t *testing.T) {
+	s, _ := newTestServer(t)
+	rec := get(s, "/accounts/reader1/folders", "reader1", "localpass1")
+	if got := strings.TrimSpace(rec.Body.String()); got != `[{"name":"INBOX"},{"name":"Invoices","virtual":true}]` {
+		t.Errorf("folders = %s", got)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	s, up := newTestServer(t)
+	rec := get(s, "/accounts/reader1/messages?folder=INBOX&limit=1", "reader1", "localpass1")
+	var list messageList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if list.UIDValidity != imaptest.UIDValidity || len(list.Messages) != 1 || list.NextSinceUID != 3 {
+		t.Fatalf("first page = %+v", list)
+	}
+	m := list.Messages[0]
+	if m.UID != 3 || m.Subject != "Grüße" || m.From != "alice@example.com" || m.InternalDate != "2024-01-02T09:00:00Z" || m.Flags[0] != `\Seen` {
+		t.Errorf("message = %+v", m)
+	}
+
+	rec = get(s, "/accounts/reader1/messages?folder=INBOX&since_uid=3", "reader1", "localpass1")
+	list = messageList{}
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Messages) != 1 || list.Messages[0].UID != 8 || list.NextSinceUID != 0 {
+		t.Errorf("second page = %+v, want only UID 8 (5 is hidden)", list)
+	}
+	rec = get(s, "/accounts/reader1/messages?folder=INBOX&since_uid=8", "reader1", "localpass1")
+	list = messageList{}
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Messages) != 0 {
+		t.Errorf("past the end = %+v, want no messages", list)
+	}
+
+	for _, cmd := range up.Received() {
+		if strings.Contains(cmd, "FETCH") && !strings.Contains(cmd, "PEEK") {
+			t.Errorf("upstream received %q", cmd)
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	s, _ := newTestServer(t)
+	rec := get(s, "/accounts/reader1/messages/3/raw?folder=INBOX&uid_validity=1", "reader1", "localpass1")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "message/rfc822" {
+		t.Fatalf("status %d, type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if want := "From: alice@example.com\r\nSubject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n\r\nhello\r\n"; rec.Body.String() != want {
+		t.Errorf("body = %q, want the scrubbed message", rec.Body)
+	}
+	if rec := get(s, "/accounts/reader1/messages/8/raw?folder=Invoices", "reader1", "localpass1"); rec.Code != http.StatusOK {
+		t.Errorf("virtual folder message: status %d", rec.Code)
+	}
+}
+
+func TestFailedLoginsBan(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.cfg.Server.RateLimit = config.RateLimitConfig{FailedLoginsPerMinute: 1, FailedLoginBurst: 2, BanDuration: time.Minute}
+	var events []audit.Event
+	s.gateway.AddAuditSink(audit.SinkFunc(func(ev audit.Event) { events = append(events, ev) }))
+	for range 3 {
+		if rec := get(s, "/accounts/reader1/folders", "reader1", "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password: status %d", rec.Code)
+		}
+	}
+	if rec := get(s, "/accounts/reader1/folders", "reader1", "localpass1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("right password from a banned IP: status %d, want 429", rec.Code)
+	}
+	if len(events) == 0 || events[0].Type != audit.LoginFailure || events[0].Fields["via"] != "rest" {
+		t.Errorf("events = %+v, want login failures via rest", events)
+	}
+}
+
+func TestRawQuota(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.cfg.Accounts[0].DailyDownloadQuotaMB = 1
+	store := quota.NewStore()
+	s.gateway.SetQuotaStore(store)
+	if rec := get(s, "/accounts/reader1/messages/3/raw?folder=INBOX", "reader1", "localpass1"); rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if used := store.Used("reader1"); used != int64(len("From: alice@example.com\r\nSubject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n\r\nhello\r\n")) {
+		t.Errorf("quota used = %d, want the size of the message served", used)
+	}
+	store.Add("reader1", 1<<20)
+	rec := get(s, "/accounts/reader1/messages/3/raw?folder=INBOX", "reader1", "localpass1")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "quota") {
+		t.Errorf("over quota: status %d (%s), want 429", rec.Code, rec.Body)
+	}
+}
+
+func TestMaxConnectionsPerHost(t *testing.T) {
+	s, _ := newTestServerWith(t, func(cfg *config.Config) { cfg.Server.MaxConnectionsPerHost = 1 })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.gateway.Serve(l)
+	defer s.gateway.Close()
+
+	// An IMAP session of the account holds the host's only connection.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	r.ReadString('\n') // greeting
+	fmt.Fprint(conn, "A1 LOGIN reader1 localpass1\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "A1 ") {
+			if !strings.HasPrefix(line, "A1 OK") {
+				t.Fatalf("IMAP login: %q", line)
+			}
+			break
+		}
+	}
+	if rec := get(s, "/accounts/reader1/folders", "reader1", "localpass1"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("REST request while the session is open: status %d, want 429", rec.Code)
+	}
+
+	fmt.Fprint(conn, "A2 LOGOUT\r\n")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec := get(s, "/accounts/reader1/folders", "reader1", "localpass1")
+		if rec.Code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("REST request after LOGOUT: status %d, want 200", rec.Code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,153 @@
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"imap-proxy/internal/imap"
+)
+
+// defaultFixtureGreeting is sent by a fixture recorded without one.
+const defaultFixtureGreeting = "* OK fixture ready"
+
+// Fixture serves the server side of a transcript, typically one recorded
+// with WrapUpstream, as a fake server in tests. Commands must arrive in
+// the recorded order; each is answered with the responses recorded for it,
+// with the recorded tags replaced by the ones received.
+type Fixture struct {
+	greeting []string
+	cmds     []command
+}
+
+// NewFixture returns a fixture serving events.
+func NewFixture(events []Event) *Fixture {
+	greeting, cmds := commands(events)
+	if len(greeting) == 0 {
+		greeting = []string{defaultFixtureGreeting}
+	}
+	return &Fixture{greeting: greeting, cmds: cmds}
+}
+
+// LoadFixture reads a transcript file as a fixture.
+func LoadFixture(path string) (*Fixture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events, err := Read(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewFixture(events), nil
+}
+
+// Serve sends the greeting on conn and answers commands until the client
+// goes away, which is not an error. A command that differs from the next
+// recorded one, or follows the last, is answered with BAD and ends Serve
+// with an error. A recorded LOGIN or AUTHENTICATE matches any credentials.
+func (f *Fixture) Serve(conn net.Conn) error {
+	for _, line := range f.greeting {
+		if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+			return err
+		}
+	}
+	r := bufio.NewReader(conn)
+	tags := make(map[string]string) // recorded tag to the one received
+	for i := 0; ; i++ {
+		var want *command
+		var responses []string
+		if i < len(f.cmds) {
+			want = &f.cmds[i]
+			responses = want.responses
+		}
+		data, err := readCommand(r, conn, &responses)
+		if err != nil {
+			if len(data) == 0 {
+				return nil
+			}
+			return err
+		}
+		tag, _, _ := strings.Cut(firstLine(data), " ")
+		if want == nil || !sameCommand(want.data, data) {
+			fmt.Fprintf(conn, "%s BAD command not in fixture\r\n", tag)
+			if want == nil {
+				return fmt.Errorf("transcript: unexpected command %q after the end of the fixture", firstLine(data))
+			}
+			return fmt.Errorf("transcript: command %d is %q, fixture has %q", i+1, firstLine(data), firstLine(want.data))
+		}
+		if recorded, _, ok := strings.Cut(firstLine(want.data), " "); ok {
+			tags[recorded] = tag
+		}
+		for _, line := range responses {
+			if recorded, rest, ok := strings.Cut(line, " "); ok && tags[recorded] != "" {
+				line = tags[recorded] + " " + rest
+			}
+			if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readCommand reads one command, including its literals, from r. Each
+// synchronizing literal is answered with the next of responses if that is
+// a continuation, which is then removed, or with a generic one.
+func readCommand(r *bufio.Reader, w io.Writer, responses *[]string) ([]byte, error) {
+	var data []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		data = append(data, line...)
+		if err != nil {
+			return data, err
+		}
+		n, nonSync, ok := imap.ParseLiteral(line)
+		if !ok {
+			return data, nil
+		}
+		if !nonSync {
+			cont := "+ Ready for literal data"
+			if len(*responses) > 0 && strings.HasPrefix((*responses)[0], "+") {
+				cont, *responses = (*responses)[0], (*responses)[1:]
+			}
+			if _, err := io.WriteString(w, cont+"\r\n"); err != nil {
+				return data, err
+			}
+		}
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(r, lit); err != nil {
+			return append(data, lit...), err
+		}
+		data = append(data, lit...)
+	}
+}
+
+// sameCommand reports whether received matches the recorded command apart
+// from its tag. Redacted credentials in the recording match anything.
+func sameCommand(recorded, received []byte) bool {
+	recorded, received = untagged(recorded), untagged(received)
+	if before, _, ok := bytes.Cut(recorded, []byte(Redacted)); ok {
+		return bytes.HasPrefix(received, before)
+	}
+	return bytes.Equal(recorded, received)
+}
+
+// untagged returns cmd without its tag; cmd is returned whole if its first
+// line has none, as for DONE.
+func untagged(cmd []byte) []byte {
+	if i := strings.IndexByte(firstLine(cmd), ' '); i >= 0 {
+		return cmd[i+1:]
+	}
+	return cmd
+}
+
+// firstLine returns the first line of cmd without its line ending.
+func firstLine(cmd []byte) string {
+	line, _, _ := strings.Cut(string(cmd), "\n")
+	return strings.TrimRight(line, "\r")
+}
@@ -0,0 +1,146 @@
+package transcript
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/imaptest"
+)
+
+func TestFixtureServesRecordedUpstream(t *testing.T) {
+	root := t.TempDir()
+	if err := imaptest.Seed(root); err != nil {
+		t.Fatal(err)
+	}
+	rp := &Replayer{User: imaptest.User, Password: imaptest.Password, Timeout: 5 * time.Second}
+
+	// Record the client end of a session, as the proxy records its
+	// upstream connections.
+	rec, err := Create(t.TempDir(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.Run(rec.WrapUpstream(serve(t, root, nil)), clientEvents(script...)); err != nil {
+		t.Fatal(err)
+	}
+	rec.Close(imaptest.User)
+	fixture, err := LoadFixture(rec.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(rec.Path())
+	if strings.Contains(string(data), imaptest.Password) {
+		t.Error("fixture holds the password")
+	}
+
+	// The fixture answers the same session exactly as the store did.
+	f, _ := os.Open(rec.Path())
+	events, err := Read(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() { served <- fixture.Serve(server) }()
+	diffs, err := rp.Run(client, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("fixture differs from the recording: %+v", diffs)
+	}
+	client.Close()
+	if err := <-served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+// fixtureSession serves events and returns the client end.
+func fixtureSession(t *testing.T, events []Event) (net.Conn, *bufio.Reader, <-chan error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	served := make(chan error, 1)
+	go func() {
+		served <- NewFixture(events).Serve(server)
+		server.Close()
+	}()
+	return client, bufio.NewReader(client), served
+}
+
+func TestFixtureRewritesTags(t *testing.T) {
+	events := record(t,
+		"S:* OK [CAPABILITY IMAP4rev1] recorded\r\n",
+		"proxy0 LOGIN \"user\" \"secret\"\r\n",
+		"S:proxy0 OK logged in\r\n",
+		"a7 IDLE\r\n",
+		"S:+ idling\r\n",
+		"S:* 3 EXISTS\r\n",
+		"DONE\r\n",
+		"S:a7 OK IDLE done\r\n",
+		"a8 APPEND Sent {5}\r\n",
+		"S:+ go ahead\r\n",
+		"hello\r\n",
+		"S:a8 OK [APPENDUID 1 9] done\r\n",
+	)
+	client, r, _ := fixtureSession(t, events)
+	exchange := []struct{ send, want string }{
+		{"", "* OK [CAPABILITY IMAP4rev1] recorded"},
+		{"proxy0 LOGIN \"other\" \"credentials\"\r\n", "proxy0 OK logged in"},
+		{"B1 IDLE\r\n", "+ idling"},
+		{"", "* 3 EXISTS"},
+		{"DONE\r\n", "B1 OK IDLE done"},
+		{"B2 APPEND Sent {5}\r\n", "+ go ahead"},
+		{"hello\r\n", "B2 OK [APPENDUID 1 9] done"},
+	}
+	for _, x := range exchange {
+		if x.send != "" {
+			io.WriteString(client, x.send)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %q: %v", x.send, err)
+		}
+		if got := strings.TrimRight(line, "\r\n"); got != x.want {
+			t.Errorf("after %q got %q, want %q", x.send, got, x.want)
+		}
+	}
+}
+
+func TestFixtureMismatch(t *testing.T) {
+	events := record(t, "S:* OK ready\r\n", "a1 SELECT INBOX\r\n", "S:a1 OK selected\r\n")
+	tests := []struct {
+		name, send, want string
+	}{
+		{"different command", "x1 SELECT Archive\r\n", `command 1 is "x1 SELECT Archive", fixture has "a1 SELECT INBOX"`},
+		{"past the end", "x1 SELECT INBOX\r\nx2 NOOP\r\n", `unexpected command "x2 NOOP"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, r, served := fixtureSession(t, events)
+			go io.WriteString(client, tt.send)
+			var last string
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				last = line
+			}
+			if !strings.Contains(last, " BAD ") {
+				t.Errorf("last response = %q, want BAD", last)
+			}
+			if err := <-served; err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Serve err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/imap"
+)
+
+// defaultReplayTimeout bounds the wait for each response when
+// Replayer.Timeout is unset.
+const defaultReplayTimeout = 30 * time.Second
+
+// Replayer sends the client side of a transcript to a server, one command
+// at a time, waiting for each command's tagged response.
+type Replayer struct {
+	// User and Password replace the redacted LOGIN credentials.
+	User, Password string
+	// Out receives the live exchange as "C: " and "S: " lines; nil
+	// discards it.
+	Out io.Writer
+	// Timing keeps the recorded pauses between commands, e.g. so that an
+	// IDLE lasts as long as it did.
+	Timing bool
+	// Timeout bounds the wait for each response (default 30s).
+	Timeout time.Duration
+}
+
+// Diff is a command whose responses differ from the recorded ones.
+// Responses are compared line by line, with literals inline.
+type Diff struct {
+	Command  string // first line of the command, without CRLF
+	Recorded []string
+	Replayed []string
+}
+
+// command is a recorded client command and the responses recorded for it.
+type command struct {
+	time      time.Time
+	data      []byte
+	responses []string
+}
+
+// commands splits events into the greeting responses and the commands.
+func commands(events []Event) (greeting []string, cmds []command) {
+	var server []byte
+	flush := func() {
+		prev := &greeting
+		if len(cmds) > 0 {
+			prev = &cmds[len(cmds)-1].responses
+		}
+		*prev = append(*prev, responseLines(server)...)
+		server = nil
+	}
+	for _, e := range events {
+		switch e.Kind {
+		case KindClient:
+			flush()
+			c := command{time: e.Time, data: e.Data()}
+			// The continuations for a command's literals are sent before
+			// the command is complete and recorded.
+			if len(cmds) > 0 {
+				prev := &cmds[len(cmds)-1].responses
+				for n := syncLiterals(c.data); n > 0 && len(*prev) > 0 && strings.HasPrefix((*prev)[len(*prev)-1], "+"); n-- {
+					c.responses = slices.Insert(c.responses, 0, (*prev)[len(*prev)-1])
+					*prev = (*prev)[:len(*prev)-1]
+				}
+			}
+			cmds = append(cmds, c)
+		case KindServer:
+			server = append(server, e.Data()...)
+		}
+	}
+	flush()
+	return greeting, cmds
+}
+
+// syncLiterals counts the synchronizing literals announced in cmd.
+func syncLiterals(cmd []byte) int {
+	count := 0
+	for len(cmd) > 0 {
+		end := len(cmd)
+		if i := bytes.IndexByte(cmd, '\n'); i >= 0 {
+			end = i + 1
+		}
+		n, nonSync, ok := imap.ParseLiteral(cmd[:end])
+		if ok {
+			end = int(min(int64(len(cmd)), int64(end)+n))
+			if !nonSync {
+				count++
+			}
+		}
+		cmd = cmd[end:]
+	}
+	return count
+}
+
+// responseLines splits recorded server output into responses.
+func responseLines(data []byte) []string {
+	r := bufio.NewReader(bytes.NewReader(data))
+	var lines []string
+	for {
+		line, err := readResponse(r)
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err != nil {
+			return lines
+		}
+	}
+}
+
+// readResponse reads one response line, including the data of any
+// literals it contains, without the final CRLF.
+func readResponse(r *bufio.Reader) (string, error) {
+	var b strings.Builder
+	for {
+		line, err := r.ReadBytes('\n')
+		b.Write(line)
+		if err != nil {
+			return strings.TrimRight(b.String(), "\r\n"), err
+		}
+		n, _, ok := imap.ParseLiteral(line)
+		if !ok {
+			return strings.TrimRight(b.String(), "\r\n"), nil
+		}
+		lit := make([]byte, n)
+		if _, err := io.ReadFull(r, lit); err != nil {
+			b.Write(lit)
+			return b.String(), err
+		}
+		b.Write(lit)
+	}
+}
+
+// Run replays events on conn and returns the commands whose responses
+// differ from the recording. STARTTLS is skipped; connect with TLS instead.
+func (rp *Replayer) Run(conn net.Conn, events []Event) ([]Diff, error) {
+	out := rp.Out
+	if out == nil {
+		out = io.Discard
+	}
+	timeout := rp.Timeout
+	if timeout <= 0 {
+		timeout = defaultReplayTimeout
+	}
+	r := bufio.NewReader(conn)
+	next := func() (string, error) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		line, err := readResponse(r)
+		if err == nil {
+			fmt.Fprintf(out, "S: %s\n", line)
+		}
+		return line, err
+	}
+
+	recordedGreeting, cmds := commands(events)
+	var diffs []Diff
+	greeting, err := next()
+	if err != nil {
+		return nil, fmt.Errorf("read greeting: %w", err)
+	}
+	if !slices.Equal(recordedGreeting, []string{greeting}) {
+		diffs = append(diffs, Diff{Command: "(greeting)", Recorded: recordedGreeting, Replayed: []string{greeting}})
+	}
+
+	var idleTag string
+	for i, c := range cmds {
+		if rp.Timing && i > 0 {
+			time.Sleep(c.time.Sub(cmds[i-1].time))
+		}
+		data := c.data
+		first, _, _ := strings.Cut(string(data), "\n")
+		first = strings.TrimRight(first, "\r")
+		fields := strings.Fields(first)
+		if len(fields) == 0 {
+			continue
+		}
+		tag, verb := fields[0], ""
+		if len(fields) > 1 {
+			verb = strings.ToUpper(fields[1])
+		}
+		switch {
+		case first == Redacted:
+			return diffs, errors.New("transcript contains redacted AUTHENTICATE responses and cannot be replayed")
+		case verb == "STARTTLS":
+			fmt.Fprintf(out, "C: %s (skipped)\n", first)
+			continue
+		case verb == "LOGIN":
+			if rp.User == "" {
+				return diffs, errors.New("transcript logs in; a user name and password are required")
+			}
+			data = []byte(fmt.Sprintf("%s LOGIN %s %s\r\n", tag, imap.Quote(rp.User), imap.Quote(rp.Password)))
+			first = tag + " LOGIN " + imap.Quote(rp.User) + " " + Redacted
+		}
+		fmt.Fprintf(out, "C: %s\n", first)
+
+		// Wait for the continuation before each synchronizing literal.
+		var replayed []string
+		refused := false // tagged response instead of a continuation
+		for len(data) > 0 && !refused {
+			end := len(data)
+			if i := bytes.IndexByte(data, '\n'); i >= 0 {
+				end = i + 1
+			}
+			n, nonSync, ok := imap.ParseLiteral(data[:end])
+			if ok && nonSync {
+				end = int(min(int64(len(data)), int64(end)+n))
+			}
+			if _, err := conn.Write(data[:end]); err != nil {
+				return diffs, err
+			}
+			data = data[end:]
+			if !ok || nonSync {
+				continue
+			}
+			line, err := waitFor(next, &replayed, "+", tag)
+			if err != nil {
+				return diffs, err
+			}
+			if !strings.HasPrefix(line, "+") {
+				refused = true
+				break
+			}
+			k := int(min(int64(len(data)), n))
+			if _, err := conn.Write(data[:k]); err != nil {
+				return diffs, err
+			}
+			data = data[k:]
+		}
+
+		switch {
+		case refused:
+		case verb == "IDLE":
+			idleTag = tag
+			_, err = waitFor(next, &replayed, "+", tag)
+		case strings.EqualFold(first, "DONE") && idleTag != "":
+			_, err = waitFor(next, &replayed, "", idleTag)
+			idleTag = ""
+		default:
+			_, err = waitFor(next, &replayed, "", tag)
+		}
+		if err != nil && !(verb == "LOGOUT" && errors.Is(err, io.EOF)) {
+			return diffs, err
+		}
+		if !slices.Equal(c.responses, replayed) {
+			diffs = append(diffs, Diff{Command: first, Recorded: c.responses, Replayed: replayed})
+		}
+	}
+	return diffs, nil
+}
+
+// waitFor reads responses into lines until one is tagged with tag or, when
+// prefix is set, starts with prefix. It returns that last line.
+func waitFor(next func() (string, error), lines *[]string, prefix, tag string) (string, error) {
+	for {
+		line, err := next()
+		if err != nil {
+			return "", err
+		}
+		*lines = append(*lines, line)
+		if strings.HasPrefix(line, tag+" ") || (prefix != "" && strings.HasPrefix(line, prefix)) {
+			return line, nil
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package transcript
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/imaptest"
+	"imap-proxy/internal/localstore"
+)
+
+// script is the client side of a session as the recorder would store it.
+var script = []string{
+	"a1 LOGIN [REDACTED] [REDACTED]\r\n",
+	"a2 SELECT INBOX\r\n",
+	"a3 FETCH 1:* (FLAGS)\r\n",
+	"a4 APPEND INBOX {5}\r\nhello\r\n",
+	"a5 IDLE\r\n",
+	"DONE\r\n",
+	"a6 LOGOUT\r\n",
+}
+
+func clientEvents(cmds ...string) []Event {
+	events := []Event{{Kind: KindStart}}
+	for _, c := range cmds {
+		events = append(events, Event{Kind: KindClient, Text: c})
+	}
+	return append(events, Event{Kind: KindEnd})
+}
+
+// serve starts a local store session for root, recording into rec when
+// it is set, and returns the client end.
+func serve(t *testing.T, root string, rec *Recorder) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	st := &localstore.Store{Root: root, Login: func(user, password string) bool {
+		return user == imaptest.User && password == imaptest.Password
+	}}
+	if rec != nil {
+		go st.Serve(rec.Wrap(server))
+	} else {
+		go st.Serve(server)
+	}
+	return client
+}
+
+func TestReplay(t *testing.T) {
+	root := t.TempDir()
+	if err := imaptest.Seed(root); err != nil {
+		t.Fatal(err)
+	}
+	rp := &Replayer{User: imaptest.User, Password: imaptest.Password, Timeout: 5 * time.Second}
+
+	// Record the script against the store; its responses differ from the
+	// script's empty ones.
+	rec, err := Create(t.TempDir(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	rp.Out = &out
+	diffs, err := rp.Run(serve(t, root, rec), clientEvents(script...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != len(script)+1 {
+		t.Errorf("%d diffs against empty responses, want %d", len(diffs), len(script)+1)
+	}
+	if !strings.Contains(out.String(), `C: a1 LOGIN "user@example.com" [REDACTED]`) || strings.Contains(out.String(), imaptest.Password) {
+		t.Errorf("exchange does not hide the password:\n%s", out.String())
+	}
+	rec.Close("")
+	f, err := os.Open(rec.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the recording against the same mail matches it.
+	rp.Out = nil
+	diffs, err = rp.Run(serve(t, root, nil), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("replay differs: %+v", diffs)
+	}
+
+	// A changed mailbox shows up in the commands that see it.
+	cur, _ := filepath.Glob(filepath.Join(root, "INBOX", "cur", "*"))
+	if err := os.Remove(cur[0]); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err = rp.Run(serve(t, root, nil), events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changed []string
+	for _, d := range diffs {
+		changed = append(changed, d.Command)
+	}
+	if want := []string{"a2 SELECT INBOX", "a3 FETCH 1:* (FLAGS)"}; strings.Join(changed, "|") != strings.Join(want, "|") {
+		t.Errorf("changed commands %q, want %q", changed, want)
+	}
+}
+
+func TestReplayRefusedLiteral(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	got := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		io.WriteString(server, "* OK ready\r\n")
+		var lines []string
+		for range 2 {
+			line, _ := r.ReadString('\n')
+			lines = append(lines, line)
+			tag, _, _ := strings.Cut(line, " ")
+			io.WriteString(server, tag+" NO refused\r\n")
+		}
+		got <- strings.Join(lines, "")
+	}()
+	rp := &Replayer{Timeout: 5 * time.Second}
+	events := clientEvents("a1 APPEND INBOX {5}\r\nhello\r\n", "a2 NOOP\r\n")
+	if _, err := rp.Run(client, events); err != nil {
+		t.Fatal(err)
+	}
+	if lines := <-got; lines != "a1 APPEND INBOX {5}\r\na2 NOOP\r\n" {
+		t.Errorf("server read %q, want the literal withheld", lines)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   string
+		script []string
+		want   string
+	}{
+		{"LOGIN without credentials", "", []string{"a1 LOGIN [REDACTED] [REDACTED]\r\n"}, "user name and password are required"},
+		{"AUTHENTICATE", imaptest.User, []string{"a1 AUTHENTICATE PLAIN\r\n", "[REDACTED]\r\n"}, "redacted AUTHENTICATE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			rp := &Replayer{User: tt.user, Timeout: 5 * time.Second}
+			_, err := rp.Run(serve(t, root, nil), clientEvents(tt.script...))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Run err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Package transcript records IMAP sessions as JSON Lines, replays the
+// client side of a recording against a server and serves the server side
+// of one as a fake server.
+//
+// A transcript starts with a "start" event and ends with an "end" event.
+// In between, each "client" event holds one complete client command,
+// including any literals, and each "server" event holds bytes written to
+// the client in one write. LOGIN credentials and AUTHENTICATE
+// responses are replaced before anything is written.
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"imap-proxy/internal/imap"
+)
+
+// Event kinds.
+const (
+	KindStart  = "start"
+	KindClient = "client"
+	KindServer = "server"
+	KindEnd    = "end"
+)
+
+// Redacted replaces credentials in recorded commands.
+const Redacted = "[REDACTED]"
+
+// Event is one line of a transcript.
+type Event struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Text holds the data of client and server events when it is valid
+	// UTF-8, Bytes otherwise.
+	Text  string `json:"text,omitempty"`
+	Bytes []byte `json:"bytes,omitempty"`
+
+	Remote  string `json:"remote,omitempty"`  // start: peer address
+	Version string `json:"version,omitempty"` // start: proxy version
+	User    string `json:"user,omitempty"`    // end: local user, if logged in
+}
+
+// Data returns the bytes of a client or server event.
+func (e *Event) Data() []byte {
+	if e.Bytes != nil {
+		return e.Bytes
+	}
+	return []byte(e.Text)
+}
+
+func dataEvent(kind string, p []byte) Event {
+	e := Event{Time: time.Now().UTC(), Kind: kind}
+	if utf8.Valid(p) {
+		e.Text = string(p)
+	} else {
+		e.Bytes = bytes.Clone(p)
+	}
+	return e
+}
+
+// Read parses a transcript.
+func Read(r io.Reader) ([]Event, error) {
+	var events []Event
+	dec := json.NewDecoder(r)
+	for {
+		var e Event
+		if err := dec.Decode(&e); errors.Is(err, io.EOF) {
+			return events, nil
+		} else if err != nil {
+			return events, fmt.Errorf("transcript: event %d: %w", len(events)+1, err)
+		}
+		events = append(events, e)
+	}
+}
+
+// Recorder writes a transcript file. Its methods are safe for concurrent
+// use, since a session reads and writes its connection from different
+// goroutines.
+type Recorder struct {
+	path string
+
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error // first write error; later events are dropped
+
+	cmd     []byte // client bytes of the command being received
+	literal int64  // literal bytes still expected for cmd
+	sasl    string // tag of an AUTHENTICATE whose responses are redacted
+}
+
+// Create starts a transcript in a new file in dir for a session from
+// remote.
+func Create(dir, remote, version string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	var id [4]byte
+	rand.Read(id[:])
+	name := time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(id[:]) + ".jsonl"
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{path: f.Name(), f: f, w: bufio.NewWriter(f)}
+	r.enc = json.NewEncoder(r.w)
+	r.write(Event{Time: time.Now().UTC(), Kind: KindStart, Remote: remote, Version: version})
+	return r, nil
+}
+
+// Path returns the transcript file name.
+func (r *Recorder) Path() string { return r.path }
+
+// write encodes e; the caller holds mu or has not shared r yet.
+func (r *Recorder) write(e Event) {
+	if r.err == nil {
+		r.err = r.enc.Encode(e)
+	}
+}
+
+// Client records bytes received from the client. Complete commands are
+// written as one event each.
+func (r *Recorder) Client(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(p) > 0 {
+		if r.literal > 0 {
+			n := min(r.literal, int64(len(p)))
+			r.cmd = append(r.cmd, p[:n]...)
+			r.literal -= n
+			p = p[n:]
+			continue
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			r.cmd = append(r.cmd, p...)
+			return
+		}
+		r.cmd = append(r.cmd, p[:i+1]...)
+		p = p[i+1:]
+		// Only the line just completed can announce a literal.
+		line := r.cmd[bytes.LastIndexByte(r.cmd[:len(r.cmd)-1], '\n')+1:]
+		if n, _, ok := imap.ParseLiteral(line); ok {
+			r.literal = n
+			continue
+		}
+		r.write(dataEvent(KindClient, r.redact(r.cmd)))
+		r.cmd = r.cmd[:0]
+	}
+}
+
+// redact returns cmd with credentials replaced.
+func (r *Recorder) redact(cmd []byte) []byte {
+	if r.sasl != "" {
+		return []byte(Redacted + "\r\n")
+	}
+	fields := strings.Fields(string(cmd))
+	if len(fields) < 2 {
+		return cmd
+	}
+	tag, verb := fields[0], strings.ToUpper(fields[1])
+	switch verb {
+	case "LOGIN":
+		return []byte(tag + " LOGIN " + Redacted + " " + Redacted + "\r\n")
+	case "AUTHENTICATE":
+		r.sasl = tag
+		if len(fields) > 3 {
+			// SASL-IR initial response.
+			return []byte(tag + " AUTHENTICATE " + fields[2] + " " + Redacted + "\r\n")
+		}
+	}
+	return cmd
+}
+
+// Server records bytes sent to the client.
+func (r *Recorder) Server(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sasl != "" && containsTagged(p, r.sasl) {
+		r.sasl = ""
+	}
+	r.write(dataEvent(KindServer, p))
+}
+
+// containsTagged reports whether p holds a line starting with tag.
+func containsTagged(p []byte, tag string) bool {
+	for line := range bytes.Lines(p) {
+		if bytes.HasPrefix(line, []byte(tag+" ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close writes the end event, naming user if the session logged in, and
+// closes the file.
+func (r *Recorder) Close(user string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cmd) > 0 {
+		r.write(dataEvent(KindClient, r.redact(r.cmd)))
+		r.cmd = nil
+	}
+	r.write(Event{Time: time.Now().UTC(), Kind: KindEnd, User: user})
+	if err := r.w.Flush(); r.err == nil {
+		r.err = err
+	}
+	if err := r.f.Close(); r.err == nil {
+		r.err = err
+	}
+	return r.err
+}
+
+// Discard closes and deletes the transcript.
+func (r *Recorder) Discard() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Close()
+	return os.Remove(r.path)
+}
+
+// Conn records what is read from and written to the embedded connection.
+// Conn may be replaced, e.g. after a STARTTLS upgrade, before the
+// connection is shared between goroutines.
+type Conn struct {
+	net.Conn
+	rec      *Recorder
+	upstream bool // the local end is the client
+}
+
+// Wrap returns conn, a connection from a client, recording into r.
+func (r *Recorder) Wrap(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, rec: r}
+}
+
+// WrapUpstream returns conn, a connection to a server, recording into r:
+// what is written is recorded as client commands and what is read as
+// server responses.
+func (r *Recorder) WrapUpstream(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, rec: r, upstream: true}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if c.upstream {
+			c.rec.Server(p[:n])
+		} else {
+			c.rec.Client(p[:n])
+		}
+	}
+	return n, err
+}
+
+// Write records p before writing it, so that a response is in the
+// transcript before the client can act on it.
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.upstream {
+		c.rec.Client(p)
+	} else {
+		c.rec.Server(p)
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,141 @@
+package transcript
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// record feeds client and server chunks to a new recorder in order and
+// returns the events written.
+func record(t *testing.T, chunks ...string) []Event {
+	t.Helper()
+	rec, err := Create(t.TempDir(), "192.0.2.1:1234", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range chunks {
+		if s, ok := strings.CutPrefix(c, "S:"); ok {
+			rec.Server([]byte(s))
+		} else {
+			rec.Client([]byte(c))
+		}
+	}
+	if err := rec.Close("reader1"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(rec.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+// clientData returns the data of the client events.
+func clientData(events []Event) []string {
+	var out []string
+	for _, e := range events {
+		if e.Kind == KindClient {
+			out = append(out, string(e.Data()))
+		}
+	}
+	return out
+}
+
+func TestRecorderClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{
+			name:   "commands split across reads",
+			chunks: []string{"a1 NO", "OP\r\na2 CAPA", "BILITY\r\n"},
+			want:   []string{"a1 NOOP\r\n", "a2 CAPABILITY\r\n"},
+		},
+		{
+			name:   "literal with line breaks",
+			chunks: []string{"a1 APPEND INBOX {7}\r\n", "x\r\ny\r\n\r\n"},
+			want:   []string{"a1 APPEND INBOX {7}\r\nx\r\ny\r\n\r\n"},
+		},
+		{
+			name:   "LOGIN quoted",
+			chunks: []string{"a1 LOGIN \"reader1\" \"secret\"\r\n"},
+			want:   []string{"a1 LOGIN [REDACTED] [REDACTED]\r\n"},
+		},
+		{
+			name:   "LOGIN literal",
+			chunks: []string{"a1 LOGIN {7}\r\n", "reader1 {6+}\r\nsecret\r\n"},
+			want:   []string{"a1 LOGIN [REDACTED] [REDACTED]\r\n"},
+		},
+		{
+			name:   "AUTHENTICATE responses",
+			chunks: []string{"a1 AUTHENTICATE PLAIN\r\n", "S:+ \r\n", "AHJlYWRlcjEAc2VjcmV0\r\n", "S:a1 OK done\r\n", "a2 NOOP\r\n"},
+			want:   []string{"a1 AUTHENTICATE PLAIN\r\n", "[REDACTED]\r\n", "a2 NOOP\r\n"},
+		},
+		{
+			name:   "AUTHENTICATE initial response",
+			chunks: []string{"a1 AUTHENTICATE PLAIN AHJlYWRlcjEAc2VjcmV0\r\n", "S:a1 OK done\r\n", "a2 NOOP\r\n"},
+			want:   []string{"a1 AUTHENTICATE PLAIN [REDACTED]\r\n", "a2 NOOP\r\n"},
+		},
+		{
+			name:   "unterminated command at close",
+			chunks: []string{"a1 NOOP\r\n", "a2 LOG"},
+			want:   []string{"a1 NOOP\r\n", "a2 LOG"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := record(t, tt.chunks...)
+			if got := clientData(events); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("client events %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecorderEvents(t *testing.T) {
+	events := record(t, "S:* OK ready\r\n", "a1 NOOP\r\n", "S:a1 OK\r\n", "S:\xff\xfe\r\n")
+	kinds := make([]string, len(events))
+	for i, e := range events {
+		kinds[i] = e.Kind
+	}
+	if want := "start server client server server end"; strings.Join(kinds, " ") != want {
+		t.Fatalf("kinds %q, want %q", kinds, want)
+	}
+	if e := events[0]; e.Remote != "192.0.2.1:1234" || e.Version != "test" {
+		t.Errorf("start event %+v", e)
+	}
+	if e := events[len(events)-1]; e.User != "reader1" {
+		t.Errorf("end user %q", e.User)
+	}
+	if e := events[4]; e.Text != "" || !bytes.Equal(e.Data(), []byte("\xff\xfe\r\n")) {
+		t.Errorf("binary server event %+v", e)
+	}
+}
+
+func TestRecorderDiscard(t *testing.T) {
+	rec, err := Create(t.TempDir(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rec.Path()); !os.IsNotExist(err) {
+		t.Errorf("transcript still exists: %v", err)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	_, err := Read(strings.NewReader("{\"kind\":\"start\"}\n{oops\n"))
+	if err == nil || !strings.Contains(err.Error(), "event 2") {
+		t.Errorf("Read err = %v, want one naming event 2", err)
+	}
+}
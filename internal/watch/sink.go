@@ -0,0 +1,109 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// sinkTimeout bounds each webhook request and exec hook run.
+const sinkTimeout = 30 * time.Second
+
+// Sink receives watch events. Implementations must be safe for concurrent use.
+type Sink interface {
+	Emit(Event) error
+}
+
+// JSONSink writes one JSON object per line.
+type JSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSink returns a sink writing to w.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+// Emit implements Sink.
+func (s *JSONSink) Emit(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// WebhookSink POSTs each event as JSON to a URL.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Emit implements Sink. Any status other than 2xx is an error.
+func (s *WebhookSink) Emit(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// ExecSink runs a command for each event, with the event as JSON on stdin
+// and its fields in IMAP_WATCH_* environment variables.
+type ExecSink struct {
+	Command []string
+}
+
+// Emit implements Sink.
+func (s *ExecSink) Emit(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(),
+		"IMAP_WATCH_TYPE="+ev.Type,
+		"IMAP_WATCH_USER="+ev.User,
+		"IMAP_WATCH_FOLDER="+ev.Folder,
+		fmt.Sprintf("IMAP_WATCH_COUNT=%d", ev.Count),
+		fmt.Sprintf("IMAP_WATCH_TOTAL=%d", ev.Total),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("exec %s: %w: %s", s.Command[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package watch
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEvent = Event{
+	Time: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), Type: MessagesAdded,
+	User: "reader1", Folder: "INBOX", Count: 2, Total: 7,
+}
+
+func TestJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewJSONSink(&buf)
+	if err := sink.Emit(testEvent); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	want := `{"time":"2026-03-01T12:00:00Z","type":"messages_added","user":"reader1","folder":"INBOX","count":2,"total":7}` + "\n"
+	if buf.String() != want {
+		t.Errorf("output = %s, want %s", buf.String(), want)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got Event
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("request = %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sink := &WebhookSink{URL: srv.URL}
+	if err := sink.Emit(testEvent); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	if !got.Time.Equal(testEvent.Time) || got.Type != testEvent.Type || got.Total != 7 {
+		t.Errorf("received %+v", got)
+	}
+
+	status = http.StatusInternalServerError
+	if err := sink.Emit(testEvent); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Emit err = %v, want 500 error", err)
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	out := filepath.Join(t.TempDir(), "event")
+	sink := &ExecSink{Command: []string{"sh", "-c", `{ echo "$IMAP_WATCH_TYPE $IMAP_WATCH_COUNT"; cat; } > "$0"`, out}}
+	if err := sink.Emit(testEvent); err != nil {
+		t.Fatalf("Emit: %v", err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "messages_added 2\n{") || !strings.Contains(string(b), `"folder":"INBOX"`) {
+		t.Errorf("hook saw %q", b)
+	}
+
+	fail := &ExecSink{Command: []string{"sh", "-c", "echo broken >&2; exit 3"}}
+	if err := fail.Emit(testEvent); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Emit err = %v, want output in error", err)
+	}
+}
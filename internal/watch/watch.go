@@ -0,0 +1,295 @@
+// Package watch monitors upstream folders without a client connection and
+// reports new and removed messages to one or more sinks.
+package watch
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imap"
+	"imap-proxy/internal/imapclient"
+)
+
+// Event types.
+const (
+	// MessagesAdded reports that Count messages arrived; Total is the new
+	// number of messages in the folder.
+	MessagesAdded = "messages_added"
+	// MessagesRemoved reports that Count messages were expunged.
+	MessagesRemoved = "messages_removed"
+)
+
+const (
+	// idleRefresh restarts IDLE before the RFC 2177 30-minute limit.
+	idleRefresh = 29 * time.Minute
+	// commandTimeout bounds the response to EXAMINE, NOOP and DONE.
+	commandTimeout = 2 * time.Minute
+	// defaultPollInterval is how often a folder is polled with NOOP when
+	// the upstream does not support IDLE.
+	defaultPollInterval = time.Minute
+	// maxBackoff caps the delay between reconnect attempts.
+	maxBackoff = time.Minute
+)
+
+// Event describes a change in a watched folder.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	User   string    `json:"user"`
+	Folder string    `json:"folder"`
+	Count  int       `json:"count"`
+	Total  int       `json:"total"`
+}
+
+// Watcher monitors one folder of one account, reconnecting after errors.
+type Watcher struct {
+	Account *config.AccountConfig
+	Folder  string
+	Sinks   []Sink
+	Logger  *slog.Logger
+
+	// PollInterval is used when the upstream refuses IDLE (default 1m).
+	PollInterval time.Duration
+
+	Upstream imapclient.Upstream
+
+	last int  // message count when the previous connection ended
+	seen bool // last is known
+}
+
+// Run watches the folder until stop is closed.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	logger := w.Logger.With("user", w.Account.LocalUser, "folder", w.Folder)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := w.watch(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		// A session that lasted a while resets the backoff.
+		if time.Since(start) > maxBackoff {
+			backoff = time.Second
+		}
+		logger.Warn("watch connection lost, reconnecting", "err", err, "in", backoff)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// conn is one authenticated upstream connection with the folder examined.
+type conn struct {
+	net.Conn
+	r        *bufio.Reader
+	seq      int
+	total    int  // messages in the folder
+	examined bool // the EXAMINE completed; later changes are events
+}
+
+// watch runs one connection until it fails or stop is closed.
+func (w *Watcher) watch(stop <-chan struct{}) error {
+	nc, r, err := w.Upstream.Connect(w.Account, stop)
+	if err != nil {
+		return err
+	}
+	c := &conn{Conn: nc, r: r}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		c.Close()
+	}()
+	go func() {
+		select {
+		case <-stop:
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	// EXAMINE keeps the folder read-only, like the proxy does for clients.
+	if err := w.command(c, "EXAMINE "+imap.Quote(w.Folder)); err != nil {
+		return err
+	}
+	c.examined = true
+	// Report what changed while disconnected.
+	if w.seen {
+		switch {
+		case c.total > w.last:
+			w.emit(Event{Type: MessagesAdded, Count: c.total - w.last, Total: c.total})
+		case c.total < w.last:
+			w.emit(Event{Type: MessagesRemoved, Count: w.last - c.total, Total: c.total})
+		}
+	}
+	w.last, w.seen = c.total, true
+
+	for {
+		ok, err := w.idle(c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return w.poll(c, stop)
+		}
+	}
+}
+
+// idle runs one IDLE of up to idleRefresh. It reports false if the upstream
+// refused IDLE.
+func (w *Watcher) idle(c *conn) (bool, error) {
+	c.seq++
+	tag := fmt.Sprintf("w%d", c.seq)
+	c.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := fmt.Fprintf(c, "%s IDLE\r\n", tag); err != nil {
+		return false, err
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		if strings.HasPrefix(line, "+") {
+			break
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return false, nil
+		}
+		if err := w.update(c, line); err != nil {
+			return false, err
+		}
+	}
+
+	end := time.Now().Add(idleRefresh)
+	c.SetDeadline(end)
+	for {
+		line, err := c.r.ReadString('\n')
+		if isTimeout(err) && time.Now().After(end) {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := w.update(c, line); err != nil {
+			return false, err
+		}
+	}
+
+	c.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := fmt.Fprint(c, "DONE\r\n"); err != nil {
+		return false, err
+	}
+	if err := w.await(c, tag); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// poll checks the folder with NOOP at the poll interval.
+func (w *Watcher) poll(c *conn, stop <-chan struct{}) error {
+	interval := w.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+		if err := w.command(c, "NOOP"); err != nil {
+			return err
+		}
+	}
+}
+
+// command sends a command and processes responses until its completion.
+// A NO or BAD completion is an error.
+func (w *Watcher) command(c *conn, cmd string) error {
+	c.seq++
+	tag := fmt.Sprintf("w%d", c.seq)
+	c.SetDeadline(time.Now().Add(commandTimeout))
+	defer c.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(c, "%s %s\r\n", tag, cmd); err != nil {
+		return err
+	}
+	return w.await(c, tag)
+}
+
+// await processes responses until the tagged completion for tag.
+func (w *Watcher) await(c *conn, tag string) error {
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if rest, ok := strings.CutPrefix(line, tag+" "); ok {
+			if status, _, _ := strings.Cut(rest, " "); !strings.EqualFold(status, "OK") {
+				return fmt.Errorf("upstream: %s", strings.TrimRight(line, "\r\n"))
+			}
+			return nil
+		}
+		if err := w.update(c, line); err != nil {
+			return err
+		}
+	}
+}
+
+// update applies an untagged response to the message count and emits
+// events for changes. Counts reported by the initial EXAMINE establish the
+// baseline without an event.
+func (w *Watcher) update(c *conn, line string) error {
+	if strings.HasPrefix(line, "* BYE") {
+		return errors.New("upstream: " + strings.TrimRight(line, "\r\n"))
+	}
+	n, kind, ok := imap.ParseMessageData([]byte(line))
+	if !ok {
+		return nil
+	}
+	switch kind {
+	case "EXISTS":
+		added := n - c.total
+		c.total = n
+		if added > 0 && c.examined {
+			w.emit(Event{Type: MessagesAdded, Count: added, Total: n})
+		}
+	case "EXPUNGE":
+		c.total = max(c.total-1, 0)
+		if c.examined {
+			w.emit(Event{Type: MessagesRemoved, Count: 1, Total: c.total})
+		}
+	}
+	if c.examined {
+		w.last = c.total
+	}
+	return nil
+}
+
+// emit delivers ev to every sink, logging failures.
+func (w *Watcher) emit(ev Event) {
+	ev.Time = time.Now()
+	ev.User = w.Account.LocalUser
+	ev.Folder = w.Folder
+	for _, s := range w.Sinks {
+		if err := s.Emit(ev); err != nil {
+			w.Logger.Error("failed to deliver watch event", "err", err, "type", ev.Type)
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,156 @@
+package watch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"imap-proxy/internal/config"
+	"imap-proxy/internal/imapclient"
+)
+
+// chanSink delivers events to a channel.
+type chanSink chan Event
+
+func (c chanSink) Emit(ev Event) error {
+	c <- ev
+	return nil
+}
+
+// fakeUpstream serves one connection: it answers EXAMINE with exists
+// messages and hands every later command to handle.
+func fakeUpstream(t *testing.T, exists int, handle func(w io.Writer, tag, verb string, r *bufio.Reader)) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			tag, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			verb, _, _ := strings.Cut(rest, " ")
+			if verb == "EXAMINE" {
+				fmt.Fprintf(server, "* %d EXISTS\r\n* OK [UIDVALIDITY 1] ok\r\n%s OK [READ-ONLY] done\r\n", exists, tag)
+				continue
+			}
+			handle(server, tag, verb, r)
+		}
+	}()
+	return client, bufio.NewReader(client)
+}
+
+func newTestWatcher(sink chanSink, dial func(*config.AccountConfig) (net.Conn, *bufio.Reader, error)) *Watcher {
+	return &Watcher{
+		Account: &config.AccountConfig{LocalUser: "reader1"},
+		Folder:  "INBOX",
+		Sinks:   []Sink{sink},
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Upstream: imapclient.Upstream{
+			Dial:  dial,
+			Login: func(net.Conn, *bufio.Reader, *config.AccountConfig) error { return nil },
+		},
+	}
+}
+
+func expectEvent(t *testing.T, events chanSink, typ string, count, total int) {
+	t.Helper()
+	select {
+	case ev := <-events:
+		if ev.Type != typ || ev.Count != count || ev.Total != total || ev.User != "reader1" || ev.Folder != "INBOX" {
+			t.Fatalf("event = %+v, want %s count=%d total=%d", ev, typ, count, total)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s event", typ)
+	}
+}
+
+func TestWatcherIdle(t *testing.T) {
+	events := make(chanSink, 10)
+	w := newTestWatcher(events, func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+		conn, r := fakeUpstream(t, 3, func(w io.Writer, tag, verb string, r *bufio.Reader) {
+			if verb != "IDLE" {
+				fmt.Fprintf(w, "%s BAD unexpected\r\n", tag)
+				return
+			}
+			fmt.Fprint(w, "+ idling\r\n* 5 EXISTS\r\n* 1 RECENT\r\n* 2 EXPUNGE\r\n")
+			r.ReadString('\n') // DONE
+			fmt.Fprintf(w, "%s OK IDLE terminated\r\n", tag)
+		})
+		return conn, r, nil
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		w.Run(stop)
+		close(done)
+	}()
+	expectEvent(t, events, MessagesAdded, 2, 5)
+	expectEvent(t, events, MessagesRemoved, 1, 4)
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after stop")
+	}
+}
+
+func TestWatcherPollsWithoutIdle(t *testing.T) {
+	events := make(chanSink, 10)
+	noops := 0
+	w := newTestWatcher(events, func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+		conn, r := fakeUpstream(t, 3, func(w io.Writer, tag, verb string, r *bufio.Reader) {
+			switch verb {
+			case "IDLE":
+				fmt.Fprintf(w, "%s BAD IDLE not supported\r\n", tag)
+			case "NOOP":
+				noops++
+				if noops == 2 {
+					fmt.Fprint(w, "* 4 EXISTS\r\n")
+				}
+				fmt.Fprintf(w, "%s OK NOOP completed\r\n", tag)
+			}
+		})
+		return conn, r, nil
+	})
+	w.PollInterval = 10 * time.Millisecond
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.Run(stop)
+	expectEvent(t, events, MessagesAdded, 1, 4)
+}
+
+func TestWatcherReportsChangesAcrossReconnects(t *testing.T) {
+	events := make(chanSink, 10)
+	dials := 0
+	w := newTestWatcher(events, func(*config.AccountConfig) (net.Conn, *bufio.Reader, error) {
+		dials++
+		exists := 3
+		if dials > 1 {
+			exists = 6
+		}
+		conn, r := fakeUpstream(t, exists, func(w io.Writer, tag, verb string, r *bufio.Reader) {
+			if dials == 1 {
+				fmt.Fprint(w, "* BYE shutting down\r\n")
+				return
+			}
+			fmt.Fprint(w, "+ idling\r\n")
+		})
+		return conn, r, nil
+	})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.Run(stop)
+	expectEvent(t, events, MessagesAdded, 3, 6)
+}